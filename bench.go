@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/alsm/hrotti/broker"
+	. "github.com/alsm/hrotti/packets"
+)
+
+//benchHeaderSize is the part of each payload the bench uses, the time the message was sent
+//in unix nanoseconds, the index of its publisher and its sequence number
+const benchHeaderSize = 20
+
+//benchConfig is the load a bench run puts on the broker
+type benchConfig struct {
+	broker      string
+	publishers  int
+	subscribers int
+	rate        float64
+	size        int
+	qos         byte
+	wildcard    bool
+	inflight    int
+	duration    time.Duration
+	drain       time.Duration
+	queueDepth  int
+	//batchPackets and batchDelay are the WriteBatchPackets and WriteBatchDelay of the embedded broker
+	batchPackets int
+	batchDelay   time.Duration
+	//embedded is the broker if it runs in this process so its CPU, allocations and writes
+	//can be reported
+	embedded *Hrotti
+}
+
+//bench is a run of the bench command, the counts are updated by every connection
+type bench struct {
+	benchConfig
+	sent     int64
+	received int64
+}
+
+//benchCommand is "hrotti bench [flags]", it connects publishers and subscribers to a broker,
+//an embedded one unless -broker is given, publishes to them for a while and reports the
+//throughput, message loss and end to end latency. It returns the exit status, 1 if the run
+//couldn't be made or a QoS 1 or 2 message was lost.
+func benchCommand(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.SetOutput(out)
+	var config benchConfig
+	var qos int
+	flags.StringVar(&config.broker, "broker", "", "The host:port of a broker to test, by default one is started in this process")
+	flags.IntVar(&config.publishers, "pubs", 1, "The number of publishers")
+	flags.IntVar(&config.subscribers, "subs", 1, "The number of subscribers, each receives every message")
+	flags.Float64Var(&config.rate, "rate", 1000, "Messages a second from each publisher, 0 is as fast as possible")
+	flags.IntVar(&config.size, "size", 64, "The payload size in bytes, at least "+strconv.Itoa(benchHeaderSize))
+	flags.IntVar(&qos, "qos", 0, "The QoS to publish and subscribe at")
+	flags.BoolVar(&config.wildcard, "wildcard", false, "Subscribe with bench/+ rather than to each publisher's topic")
+	flags.IntVar(&config.inflight, "inflight", 100, "QoS 1 and 2 messages each publisher can have unacknowledged")
+	flags.DurationVar(&config.duration, "duration", 10*time.Second, "How long to publish for")
+	flags.DurationVar(&config.drain, "drain", 5*time.Second, "How long to wait for messages still on their way")
+	flags.IntVar(&config.queueDepth, "queue", 1000, "The maxQueueDepth of the embedded broker")
+	flags.IntVar(&config.batchPackets, "batchpackets", 0, "The most packets the embedded broker writes to a client at once, 0 for no limit")
+	flags.DurationVar(&config.batchDelay, "batchdelay", 0, "How long the embedded broker waits for more packets before writing a batch")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	config.qos = byte(qos)
+	if config.publishers < 1 || config.subscribers < 1 || config.rate < 0 || qos < 0 || qos > 2 ||
+		config.inflight < 1 || config.inflight >= 65535 || config.queueDepth < 1 || config.batchPackets < 0 || config.batchDelay < 0 {
+		fmt.Fprintln(out, "pubs and subs must be at least 1, qos 0, 1 or 2, rate, batchpackets and batchdelay not negative and inflight 1 to 65534")
+		return 2
+	}
+	if config.size < benchHeaderSize {
+		config.size = benchHeaderSize
+	}
+	if config.broker == "" {
+		h, addr, err := startBenchBroker(config)
+		if err != nil {
+			fmt.Fprintln(out, "Failed to start the broker,", err.Error())
+			return 1
+		}
+		defer h.Stop()
+		config.broker = addr
+		config.embedded = h
+	}
+	return runBench(config, out)
+}
+
+//startBenchBroker starts a broker with memory persistence on a free local port, it only
+//logs warnings so its output doesn't get mixed up with the bench's
+func startBenchBroker(config benchConfig) (*Hrotti, string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	SetLogLevel("", LogWarn)
+	h := NewHrotti(config.queueDepth, &MemoryPersistence{})
+	h.WriteBatchPackets = config.batchPackets
+	h.WriteBatchDelay = config.batchDelay
+	if err := h.AddListener("bench", NewListenerConfig("tcp://"+addr)); err != nil {
+		return nil, "", err
+	}
+	return h, addr, nil
+}
+
+func runBench(config benchConfig, out io.Writer) int {
+	b := &bench{benchConfig: config}
+	subscriptions := "exact"
+	if b.wildcard {
+		subscriptions = "wildcard"
+	}
+	fmt.Fprintf(out, "bench: %d publishers, %d subscribers, QoS %d, %d byte payloads, %s subscriptions, %s\n",
+		b.publishers, b.subscribers, b.qos, b.size, subscriptions, b.duration)
+
+	var before benchUsage
+	before.read(b.embedded)
+	subscribers := make([]*benchSubscriber, b.subscribers)
+	for i := range subscribers {
+		s, err := b.subscribe(i)
+		if err != nil {
+			fmt.Fprintf(out, "Subscriber %d failed: %s\n", i, err.Error())
+			return 1
+		}
+		defer s.conn.Close()
+		subscribers[i] = s
+	}
+	publishers := make([]*benchPublisher, b.publishers)
+	for i := range publishers {
+		p, err := b.connectPublisher(i)
+		if err != nil {
+			fmt.Fprintf(out, "Publisher %d failed: %s\n", i, err.Error())
+			return 1
+		}
+		defer p.conn.Close()
+		publishers[i] = p
+	}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, p := range publishers {
+		wg.Add(1)
+		go func(p *benchPublisher) {
+			defer wg.Done()
+			p.run(b, start)
+		}(p)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	//wait for the messages still queued in the broker to arrive
+	expected := atomic.LoadInt64(&b.sent) * int64(b.subscribers)
+	deadline := time.Now().Add(b.drain)
+	for atomic.LoadInt64(&b.received) < expected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, s := range subscribers {
+		s.conn.Close()
+		<-s.done
+	}
+	var after benchUsage
+	after.read(b.embedded)
+
+	var latencies []time.Duration
+	var received, duplicates int64
+	for _, s := range subscribers {
+		latencies = append(latencies, s.latencies...)
+		received += s.received
+		duplicates += s.duplicates
+	}
+	sent := atomic.LoadInt64(&b.sent)
+	lost := expected - received
+	fmt.Fprintf(out, "sent %d messages (%.0f/s), received %d of %d (%.0f/s), lost %d, duplicates %d\n",
+		sent, float64(sent)/elapsed.Seconds(), received, expected, float64(received)/elapsed.Seconds(), lost, duplicates)
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		fmt.Fprintf(out, "latency p50 %s p90 %s p99 %s p99.9 %s max %s\n", percentile(latencies, 50), percentile(latencies, 90),
+			percentile(latencies, 99), percentile(latencies, 99.9), latencies[len(latencies)-1])
+	}
+	if b.embedded != nil {
+		after.report(out, &before)
+	} else {
+		fmt.Fprintln(out, "broker cpu, allocations and writes are only measured for the embedded broker")
+	}
+	if lost > 0 && b.qos > 0 {
+		return 1
+	}
+	return 0
+}
+
+//percentile returns the pth percentile of the sorted latencies
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	i := int(float64(len(latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(latencies) {
+		i = len(latencies) - 1
+	}
+	return latencies[i]
+}
+
+//benchUsage is the CPU time and allocations of the process at a point in the run, and the
+//writes the broker has made to its clients
+type benchUsage struct {
+	user   time.Duration
+	system time.Duration
+	memory runtime.MemStats
+	writes int64
+}
+
+func (u *benchUsage) read(h *Hrotti) {
+	var usage syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	u.user = time.Duration(usage.Utime.Nano())
+	u.system = time.Duration(usage.Stime.Nano())
+	runtime.ReadMemStats(&u.memory)
+	if h != nil {
+		u.writes = benchMetric(h, "hrotti_writes_total")
+	}
+}
+
+//benchMetric returns the value of the broker's metric called name
+func benchMetric(h *Hrotti, name string) int64 {
+	w := httptest.NewRecorder()
+	h.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			value, _ := strconv.ParseInt(strings.TrimPrefix(line, name+" "), 10, 64)
+			return value
+		}
+	}
+	return 0
+}
+
+//report prints the usage since before. It includes the bench's own connections, which do the
+//same work for every run, so changes between runs of the same load are the broker's.
+func (u *benchUsage) report(out io.Writer, before *benchUsage) {
+	fmt.Fprintf(out, "process cpu %s user %s system, allocated %d bytes in %d allocations, %d GCs, broker wrote to clients %d times\n",
+		(u.user - before.user).Round(time.Millisecond), (u.system - before.system).Round(time.Millisecond),
+		u.memory.TotalAlloc-before.memory.TotalAlloc, u.memory.Mallocs-before.memory.Mallocs, u.memory.NumGC-before.memory.NumGC,
+		u.writes-before.writes)
+}
+
+//benchConnect connects to the broker as id with a clean session and no keepalive
+func (b *bench) benchConnect(id string) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.Dial("tcp", b.broker)
+	if err != nil {
+		return nil, nil, err
+	}
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.CleanSession = true
+	cp.ClientIdentifier = id
+	if err := cp.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	rp, err := ReadPacket(r)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if ca, ok := rp.(*ConnackPacket); !ok || ca.ReturnCode != CONN_ACCEPTED {
+		conn.Close()
+		return nil, nil, errors.New("connection refused")
+	}
+	return conn, r, nil
+}
+
+//benchSubscriber receives every message and records its latency, seen has a bit for each
+//sequence number received from each publisher to find duplicates
+type benchSubscriber struct {
+	conn       net.Conn
+	latencies  []time.Duration
+	received   int64
+	duplicates int64
+	seen       [][]uint64
+	done       chan struct{}
+}
+
+func (b *bench) subscribe(i int) (*benchSubscriber, error) {
+	conn, r, err := b.benchConnect("bench-sub-" + strconv.Itoa(i))
+	if err != nil {
+		return nil, err
+	}
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	if b.wildcard {
+		sp.Topics, sp.Qoss = []string{"bench/+"}, []byte{b.qos}
+	} else {
+		for p := 0; p < b.publishers; p++ {
+			sp.Topics, sp.Qoss = append(sp.Topics, "bench/"+strconv.Itoa(p)), append(sp.Qoss, b.qos)
+		}
+	}
+	if err := sp.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if rp, err := ReadPacket(r); err != nil || rp.Type() != SUBACK {
+		conn.Close()
+		return nil, errors.New("no SUBACK")
+	}
+	s := &benchSubscriber{conn: conn, seen: make([][]uint64, b.publishers), done: make(chan struct{})}
+	go s.receive(b, r)
+	return s, nil
+}
+
+//receive reads messages until the connection is closed, acknowledging QoS 1 and 2 ones
+func (s *benchSubscriber) receive(b *bench, r *bufio.Reader) {
+	defer close(s.done)
+	for {
+		rp, err := ReadPacket(r)
+		if err != nil {
+			return
+		}
+		var ack ControlPacket
+		switch rp := rp.(type) {
+		case *PublishPacket:
+			s.record(b, rp.Payload)
+			switch rp.Qos {
+			case 1:
+				pa := NewControlPacket(PUBACK).(*PubackPacket)
+				pa.MessageID = rp.MessageID
+				ack = pa
+			case 2:
+				pr := NewControlPacket(PUBREC).(*PubrecPacket)
+				pr.MessageID = rp.MessageID
+				ack = pr
+			}
+		case *PubrelPacket:
+			pc := NewControlPacket(PUBCOMP).(*PubcompPacket)
+			pc.MessageID = rp.MessageID
+			ack = pc
+		}
+		if ack != nil && ack.Write(s.conn) != nil {
+			return
+		}
+	}
+}
+
+func (s *benchSubscriber) record(b *bench, payload []byte) {
+	if len(payload) < benchHeaderSize {
+		return
+	}
+	latency := time.Duration(time.Now().UnixNano() - int64(binary.BigEndian.Uint64(payload)))
+	publisher := int(binary.BigEndian.Uint32(payload[8:]))
+	seq := binary.BigEndian.Uint64(payload[12:])
+	if publisher >= len(s.seen) {
+		return
+	}
+	for uint64(len(s.seen[publisher])) <= seq/64 {
+		s.seen[publisher] = append(s.seen[publisher], 0)
+	}
+	if s.seen[publisher][seq/64]&(1<<(seq%64)) != 0 {
+		s.duplicates++
+		return
+	}
+	s.seen[publisher][seq/64] |= 1 << (seq % 64)
+	s.received++
+	atomic.AddInt64(&b.received, 1)
+	s.latencies = append(s.latencies, latency)
+}
+
+//benchPublisher publishes to bench/<index>, window holds a slot for each QoS 1 or 2
+//message waiting to be acknowledged
+type benchPublisher struct {
+	index  int
+	conn   net.Conn
+	r      *bufio.Reader
+	writes sync.Mutex
+	window chan struct{}
+}
+
+func (b *bench) connectPublisher(i int) (*benchPublisher, error) {
+	conn, r, err := b.benchConnect("bench-pub-" + strconv.Itoa(i))
+	if err != nil {
+		return nil, err
+	}
+	return &benchPublisher{index: i, conn: conn, r: r, window: make(chan struct{}, b.inflight)}, nil
+}
+
+//run publishes at the bench's rate until its duration is up, then waits for the messages
+//still to be acknowledged
+func (p *benchPublisher) run(b *bench, start time.Time) {
+	acked := make(chan struct{})
+	go p.acknowledgements(acked)
+	topic := "bench/" + strconv.Itoa(p.index)
+	payload := make([]byte, b.size)
+	binary.BigEndian.PutUint32(payload[8:], uint32(p.index))
+	end := start.Add(b.duration)
+	for seq := uint64(0); ; seq++ {
+		if b.rate > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(seq) / b.rate * float64(time.Second)))))
+		}
+		if !time.Now().Before(end) {
+			break
+		}
+		if b.qos > 0 {
+			select {
+			case p.window <- struct{}{}:
+			case <-acked:
+				return
+			}
+		}
+		pp := NewControlPacket(PUBLISH).(*PublishPacket)
+		pp.TopicName = topic
+		pp.Qos = b.qos
+		pp.MessageID = uint16(seq%65535 + 1)
+		binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint64(payload[12:], seq)
+		pp.Payload = payload
+		p.writes.Lock()
+		err := pp.Write(p.conn)
+		p.writes.Unlock()
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&b.sent, 1)
+	}
+	//every slot in the window is free once the broker has acknowledged everything
+	deadline := time.After(b.drain)
+	for i := 0; i < cap(p.window); i++ {
+		select {
+		case p.window <- struct{}{}:
+		case <-acked:
+			return
+		case <-deadline:
+			return
+		}
+	}
+}
+
+//acknowledgements frees a slot in the window for each message the broker acknowledges,
+//sending the PUBREL for a QoS 2 one, acked is closed when the connection is
+func (p *benchPublisher) acknowledgements(acked chan struct{}) {
+	defer close(acked)
+	for {
+		rp, err := ReadPacket(p.r)
+		if err != nil {
+			return
+		}
+		switch rp := rp.(type) {
+		case *PubackPacket, *PubcompPacket:
+			<-p.window
+		case *PubrecPacket:
+			prel := NewControlPacket(PUBREL).(*PubrelPacket)
+			prel.MessageID = rp.MessageID
+			p.writes.Lock()
+			err = prel.Write(p.conn)
+			p.writes.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
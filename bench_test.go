@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBench(t *testing.T) {
+	for _, args := range [][]string{
+		{"-pubs", "2", "-subs", "2", "-qos", "1", "-rate", "200", "-duration", "200ms"},
+		{"-pubs", "2", "-subs", "1", "-qos", "2", "-rate", "0", "-duration", "100ms", "-wildcard"},
+	} {
+		var out bytes.Buffer
+		if status := benchCommand(args, &out); status != 0 {
+			t.Errorf("bench %v exited with %d:\n%s", args, status, out.String())
+		}
+		for _, expected := range []string{"lost 0, duplicates 0", "latency p50", "process cpu"} {
+			if !strings.Contains(out.String(), expected) {
+				t.Errorf("bench %v output doesn't contain %q:\n%s", args, expected, out.String())
+			}
+		}
+	}
+}
+
+func TestBenchPercentile(t *testing.T) {
+	latencies := make([]time.Duration, 1000)
+	for i := range latencies {
+		latencies[i] = time.Duration(i + 1)
+	}
+	for p, expected := range map[float64]time.Duration{50: 500, 99: 990, 99.9: 999, 100: 1000} {
+		if actual := percentile(latencies, p); actual != expected {
+			t.Errorf("p%v is %d, should be %d", p, actual, expected)
+		}
+	}
+}
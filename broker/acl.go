@@ -0,0 +1,109 @@
+package hrotti
+
+import (
+	"strings"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//ACL is the topic filters a user can publish to and subscribe with. A client can publish
+//to a topic matched by one of Publish and subscribe with a filter that only matches topics
+//one of Subscribe also matches, so with "sensors/#" it can subscribe to sensors/+/temp but
+//not to #. For a shared subscription the filter after $share/<group>/ is checked. A message
+//published outside Publish is acknowledged and dropped, a client that does that
+//MaxDeniedPublishes times is disconnected, 0 is never.
+type ACL struct {
+	Publish            []string `json:"publish"`
+	Subscribe          []string `json:"subscribe"`
+	MaxDeniedPublishes int      `json:"maxDeniedPublishes"`
+}
+
+func (a *ACL) canPublish(topic string) bool {
+	levels := topicLevels(topic)
+	for _, filter := range a.Publish {
+		if match(topicLevels(filter), levels) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ACL) canSubscribe(filter string) bool {
+	filter, _ = splitShared(filter)
+	filterLevels := topicLevels(filter)
+	for _, allowed := range a.Subscribe {
+		if covers(topicLevels(allowed), filterLevels) {
+			return true
+		}
+	}
+	return false
+}
+
+//covers returns true if every topic that filter matches is also matched by allowed
+func covers(allowed []string, filter []string) bool {
+	if len(allowed) > 0 && len(filter) > 0 && strings.HasPrefix(filter[0], "$") && (allowed[0] == "+" || allowed[0] == "#") {
+		return false
+	}
+	for i, level := range allowed {
+		switch {
+		case level == "#":
+			return true
+		case i == len(filter):
+			return false
+		case level == "+" && filter[i] != "#":
+		case level != filter[i]:
+			return false
+		}
+	}
+	return len(allowed) == len(filter)
+}
+
+//acl returns the ACL for a client that connected with username, or nil if it is unrestricted
+func (a *Auth) acl(username string) *ACL {
+	if a == nil {
+		return nil
+	}
+	return a.ACLs[username]
+}
+
+//authFor returns the Auth and Authenticator for clients connecting to the listener with
+//config, the listener's own if it has them and otherwise the Hrotti's. It is called with the
+//liveLock held as Reload can change them.
+func (h *Hrotti) authFor(config *ListenerConfig) (*Auth, Authenticator) {
+	auth, authenticator := h.Auth, h.Authenticator
+	if config != nil && config.Auth != nil {
+		auth = config.Auth
+	}
+	if config != nil && config.Authenticator != nil {
+		authenticator = config.Authenticator
+	}
+	return auth, authenticator
+}
+
+//canPublish and canSubscribe check topic and filter against the client's ACL, which Reload
+//can replace
+func (c *Client) canPublish(topic string) bool {
+	c.info.RLock()
+	acl := c.acl
+	c.info.RUnlock()
+	return acl == nil || acl.canPublish(topic)
+}
+
+//publishDenied counts pp, a message c published outside its ACL, and returns true if that is
+//its ACL's MaxDeniedPublishes, so it should be disconnected
+func (c *Client) publishDenied(h *Hrotti, pp *PublishPacket) bool {
+	h.stats.publishDenied()
+	h.discard(DropDenied, pp, "")
+	c.deniedPublishes++
+	c.info.RLock()
+	acl := c.acl
+	c.info.RUnlock()
+	return acl != nil && acl.MaxDeniedPublishes > 0 && c.deniedPublishes >= acl.MaxDeniedPublishes
+}
+
+func (c *Client) canSubscribe(filter string) bool {
+	c.info.RLock()
+	acl := c.acl
+	c.info.RUnlock()
+	return acl == nil || acl.canSubscribe(filter)
+}
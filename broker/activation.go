@@ -0,0 +1,97 @@
+package hrotti
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+//listenFDsStart is the first file descriptor passed by socket activation, after stdin,
+//stdout and stderr
+const listenFDsStart = 3
+
+//SocketActivation returns the listening sockets passed to the process by systemd socket
+//activation, or anything else following its LISTEN_FDS protocol, so they can be set as the
+//Hrotti's InheritedListeners. It returns none if the process wasn't started that way, and
+//the LISTEN_ variables are cleared so they aren't passed on to child processes.
+func SocketActivation() ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	//the sockets were meant for another process if the pid isn't ours
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("LISTEN_FDS %q isn't a number of sockets", fds)
+	}
+	return listenersFromFDs(listenFDsStart, n)
+}
+
+//listenersFromFDs returns the n listening sockets from file descriptor first onwards
+func listenersFromFDs(first, n int) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for fd := first; fd < first+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		if f == nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("inherited socket %d isn't a valid file descriptor", fd)
+		}
+		//FileListener duplicates the descriptor, so the original is closed either way
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("inherited socket %d: %w", fd, err)
+		}
+		if _, ok := ln.Addr().(*net.TCPAddr); !ok {
+			ln.Close()
+			closeListeners(listeners)
+			return nil, errors.New("inherited socket " + strconv.Itoa(fd) + " isn't a TCP socket")
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
+
+//inheritedListener takes the inherited listener for address, a host and port as in a
+//listener's URL, out of the InheritedListeners, or returns nil if there isn't one. The
+//address matches a socket with the same port and IP, or any unspecified IP when the
+//address's IP is unspecified, so 0.0.0.0:1883 matches a systemd ListenStream=1883 that is
+//bound to [::]:1883.
+func (h *Hrotti) inheritedListener(address string) net.Listener {
+	if len(h.InheritedListeners) == 0 {
+		return nil
+	}
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil
+	}
+	for i, ln := range h.InheritedListeners {
+		if addressMatches(addr, ln.Addr().(*net.TCPAddr)) {
+			h.InheritedListeners = append(h.InheritedListeners[:i:i], h.InheritedListeners[i+1:]...)
+			return ln
+		}
+	}
+	return nil
+}
+
+func addressMatches(configured, inherited *net.TCPAddr) bool {
+	if configured.Port != inherited.Port {
+		return false
+	}
+	if configured.IP == nil || configured.IP.IsUnspecified() {
+		return inherited.IP == nil || inherited.IP.IsUnspecified()
+	}
+	return configured.IP.Equal(inherited.IP)
+}
@@ -0,0 +1,339 @@
+package hrotti
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//ClientInfo is a snapshot of a client known to the broker, as returned by the admin API.
+//Inflight is the QoS 1 and 2 messages sent to the client that it hasn't acknowledged and
+//InflightInbound the QoS 2 messages it sent that it hasn't released. KeepAlive is the
+//keepalive the broker enforces and ClientKeepAlive the one in the client's CONNECT. The
+//message and byte counts carry on across the reconnects of a durable session.
+type ClientInfo struct {
+	ClientID         string    `json:"clientId"`
+	Connected        bool      `json:"connected"`
+	RemoteAddr       string    `json:"remoteAddr"`
+	Listener         string    `json:"listener"`
+	Anonymous        bool      `json:"anonymous"`
+	CleanSession     bool      `json:"cleanSession"`
+	KeepAlive        uint16    `json:"keepAlive"`
+	ClientKeepAlive  uint16    `json:"clientKeepAlive"`
+	ProtocolVersion  byte      `json:"protocolVersion"`
+	Subscriptions    int       `json:"subscriptions"`
+	Inflight         int       `json:"inflight"`
+	InflightInbound  int       `json:"inflightInbound"`
+	Queued           int       `json:"queued"`
+	Dropped          int64     `json:"dropped"`
+	MessagesReceived int64     `json:"messagesReceived"`
+	MessagesSent     int64     `json:"messagesSent"`
+	BytesReceived    int64     `json:"bytesReceived"`
+	BytesSent        int64     `json:"bytesSent"`
+	ConnectedAt      time.Time `json:"connectedAt"`
+	LastPacketAt     time.Time `json:"lastPacketAt"`
+	//RetainedStream is set while retained messages are being streamed to the client
+	RetainedStream *RetainedProgress `json:"retainedStream,omitempty"`
+}
+
+//AdminPublish is the body of a POST to /publish on the admin API. A payload that isn't UTF-8
+//can be given base64 encoded in PayloadBase64 instead of Payload. With Client set the
+//message is sent to that client's session rather than the subscribers of its topic, and for
+//QoS 1 or 2 the response says whether the client acknowledged it within AckTimeout seconds
+//(10 by default).
+type AdminPublish struct {
+	Topic         string      `json:"topic"`
+	Payload       string      `json:"payload"`
+	PayloadBase64 []byte      `json:"payloadBase64"`
+	Qos           byte        `json:"qos"`
+	Retain        bool        `json:"retain"`
+	Properties    *Properties `json:"properties"`
+	Client        string      `json:"client"`
+	AckTimeout    int         `json:"ackTimeout"`
+}
+
+//AdminPublishResult is the response to a POST to /publish of a QoS 1 or 2 message for a client
+type AdminPublishResult struct {
+	Acked bool `json:"acked"`
+}
+
+//defaultAdminAckTimeout is how long a POST to /publish waits for a client to acknowledge a
+//message sent to it
+const defaultAdminAckTimeout = 10 * time.Second
+
+//AdminPurge is the response to a DELETE of /retained on the admin API
+type AdminPurge struct {
+	Purged int `json:"purged"`
+}
+
+//AdminBansCleared is the response to a DELETE of /bans on the admin API
+type AdminBansCleared struct {
+	Cleared int `json:"cleared"`
+}
+
+//Clients returns a snapshot of every client the broker knows about, sorted by client id
+func (h *Hrotti) Clients() []ClientInfo {
+	counts := h.subs.subscriptionCounts()
+	clients := h.clients.snapshot()
+	infos := make([]ClientInfo, 0, len(clients))
+	for _, c := range clients {
+		infos = append(infos, c.snapshot(counts))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ClientID < infos[j].ClientID })
+	return infos
+}
+
+//Client returns a snapshot of the client with id, the bool is false if the broker doesn't
+//know the client
+func (h *Hrotti) Client(id string) (ClientInfo, bool) {
+	c := h.getClient(id)
+	if c == nil {
+		return ClientInfo{}, false
+	}
+	return c.snapshot(h.subs.subscriptionCounts()), true
+}
+
+//ClientSubscriptions returns a snapshot of the subscriptions held by the client with id,
+//the bool is false if the broker doesn't know the client
+func (h *Hrotti) ClientSubscriptions(id string) ([]SubscriptionInfo, bool) {
+	if h.getClient(id) == nil {
+		return nil, false
+	}
+	return h.subs.clientSubscriptions(id), true
+}
+
+//Retained returns a snapshot of the retained messages held by the broker
+func (h *Hrotti) Retained() []RetainedInfo {
+	return h.subs.retainedSnapshot()
+}
+
+//DisconnectClient forcibly disconnects the client with id, sending its will message if
+//sendWill is true.
+func (h *Hrotti) DisconnectClient(id string, sendWill bool) error {
+	c := h.getClient(id)
+	if c == nil {
+		return errors.New("Client not found")
+	}
+	//internal clients such as the local side of a bridge have no connection to close
+	if !c.Connected() || c.conn == nil {
+		return errors.New("Client not connected")
+	}
+	h.sessionLog.Info("Disconnecting client from the admin API", "client", id)
+	reason := closeAdmin
+	if sendWill {
+		reason = closeAdminWithWill
+	}
+	c.closeClient(h, reason, "")
+	return nil
+}
+
+//Publish injects a message into the broker as if it had been published by a client
+func (h *Hrotti) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	return h.PublishWithProperties(topic, payload, qos, retain, nil)
+}
+
+//PublishWithProperties is Publish for a message with properties, they are kept with the
+//message when it is retained or queued for an offline client and folded into the payload
+//for subscriptions with a JSONEnvelope that includes them
+func (h *Hrotti) PublishWithProperties(topic string, payload []byte, qos byte, retain bool, properties *Properties) error {
+	if len(topic) == 0 || strings.ContainsAny(topic, "#+") {
+		return errors.New("Invalid topic")
+	}
+	if qos > 2 {
+		return errors.New("Invalid QoS")
+	}
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = topic
+	pp.Payload = payload
+	pp.Qos = qos
+	pp.Retain = retain
+	pp.Properties = properties
+	message := h.ingest(topic, pp)
+	if retain {
+		if retained, _ := h.setRetained(message); !retained {
+			return errors.New("Retained message is over the retained limits")
+		}
+	}
+	h.route(message, nil)
+	return nil
+}
+
+//AddAdminListener starts the HTTP admin API on addr, it is stopped along with the broker.
+//The endpoints are GET /clients, GET /clients/<client id>, GET /clients/<client id>/subscriptions,
+//DELETE /clients/<client id>[?will=true], GET /retained, DELETE /retained?filter=<filter>,
+//POST /publish (see Inject), GET /shared for the shared subscription groups, GET /state for
+//the broker's persistent state as a state file (see ExportState) and the health and
+//readiness checks at GET /healthz and GET /readyz.
+func (h *Hrotti) AddAdminListener(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		h.listenerLog.Error("Failed to start admin API", "err", err)
+		return err
+	}
+	h.admin = ln
+	h.listenerLog.Info("Starting admin API", "addr", ln.Addr())
+	go func() {
+		<-h.stop
+		ln.Close()
+	}()
+	go func() {
+		err := http.Serve(ln, h.adminHandler())
+		select {
+		case <-h.stop:
+		default:
+			h.listenerLog.Error("Admin API stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+func (h *Hrotti) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.writeJSON(w, h.Clients())
+	})
+	//client ids can contain slashes so the subscriptions suffix is checked for rather
+	//than splitting the path
+	mux.HandleFunc("/clients/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/clients/")
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(id, "/subscriptions"):
+			subs, ok := h.ClientSubscriptions(strings.TrimSuffix(id, "/subscriptions"))
+			if !ok {
+				http.Error(w, "Client not found", http.StatusNotFound)
+				return
+			}
+			h.writeJSON(w, subs)
+		case r.Method == "GET":
+			info, ok := h.Client(id)
+			if !ok {
+				http.Error(w, "Client not found", http.StatusNotFound)
+				return
+			}
+			h.writeJSON(w, info)
+		case r.Method == "DELETE":
+			if err := h.DisconnectClient(id, r.URL.Query().Get("will") == "true"); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/retained", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			h.writeJSON(w, h.Retained())
+		//deleting the retained messages matching a filter clears them without publishing an
+		//empty message to every topic
+		case "DELETE":
+			filter := r.URL.Query().Get("filter")
+			if filter == "" {
+				http.Error(w, "A filter is required", http.StatusBadRequest)
+				return
+			}
+			h.writeJSON(w, AdminPurge{Purged: h.PurgeRetained(filter)})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			h.writeJSON(w, h.Bans())
+		//without an ip every ban is lifted
+		case "DELETE":
+			h.writeJSON(w, AdminBansCleared{Cleared: h.ClearBans(r.URL.Query().Get("ip"))})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/quotas", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.writeJSON(w, h.QuotaUsage())
+	})
+	mux.HandleFunc("/shared", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.writeJSON(w, h.subs.sharedSnapshot())
+	})
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		counts, err := ExportState(h.PersistStore, w)
+		if err != nil {
+			//the status has been sent, the missing end record tells an import the file is incomplete
+			h.listenerLog.Error("Failed to export state", "err", err)
+			return
+		}
+		h.listenerLog.Info("Exported state", "sessions", counts.Sessions, "retained", counts.Retained, "inflight", counts.Inflight)
+	})
+	mux.Handle("/healthz", h.HealthHandler())
+	mux.Handle("/readyz", h.ReadyHandler())
+	mux.HandleFunc("/publish", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var p AdminPublish
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		acked, err := h.Inject(p)
+		switch {
+		case err == ErrClientNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, ErrPublishRefused):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case acked == nil:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		timeout := defaultAdminAckTimeout
+		if p.AckTimeout > 0 {
+			timeout = time.Duration(p.AckTimeout) * time.Second
+		}
+		var result AdminPublishResult
+		select {
+		case <-acked:
+			result.Acked = true
+		case <-time.After(timeout):
+		case <-r.Context().Done():
+			return
+		}
+		h.writeJSON(w, result)
+	})
+	return mux
+}
+
+func (h *Hrotti) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.listenerLog.Warn("Failed to write admin API response", "err", err)
+	}
+}
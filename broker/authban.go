@@ -0,0 +1,175 @@
+package hrotti
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Credential stuffing shows up as a flood of CONNECTs refused for their credentials. With
+//BanAuthFailures set an IP address, the client's address from the PROXY header for a
+//connection through a PROXY protocol load balancer, that has that many CONNECTs refused by
+//the certificate identity check, Auth or the Authenticator within BanWindow is banned for
+//BanDuration, and the connections it makes in that time are closed as soon as they are
+//accepted. The addresses with recent failures and the bans are each kept to MaxBans, the
+//least recently failing address and the ban ending soonest make room for new ones, so an
+//attacker with many addresses can't use up the broker's memory. The admin API lists and
+//clears the bans.
+
+const (
+	defaultBanWindow   = time.Minute
+	defaultBanDuration = 10 * time.Minute
+	defaultMaxBans     = 10000
+)
+
+//authBans is the addresses with recent authentication failures and those that are banned
+type authBans struct {
+	sync.Mutex
+	failures map[string]*list.Element
+	//recent is the addresses' failureRecords, the one that failed most recently first
+	recent *list.List
+	bans   map[string]*authBan
+}
+
+//a failureRecord is the times an address failed to authenticate within the window, oldest first
+type failureRecord struct {
+	ip    string
+	times []time.Time
+}
+
+type authBan struct {
+	until    time.Time
+	failures int
+}
+
+//BanInfo is a banned IP address, as returned by the admin API
+type BanInfo struct {
+	IP       string    `json:"ip"`
+	Until    time.Time `json:"until"`
+	Failures int       `json:"failures"`
+}
+
+func newAuthBans() *authBans {
+	return &authBans{failures: make(map[string]*list.Element), recent: list.New(), bans: make(map[string]*authBan)}
+}
+
+//banned returns true if ip is banned at now, forgetting a ban that has ended
+func (b *authBans) banned(ip string, now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	ban, ok := b.bans[ip]
+	if ok && !now.Before(ban.until) {
+		delete(b.bans, ip)
+		return false
+	}
+	return ok
+}
+
+//failed records ip failing to authenticate at now. It returns true if that is threshold
+//failures within window and ip is now banned until now plus duration. No more than max
+//addresses are tracked or banned.
+func (b *authBans) failed(ip string, now time.Time, threshold int, window time.Duration, duration time.Duration, max int) bool {
+	b.Lock()
+	defer b.Unlock()
+	var record *failureRecord
+	if element, ok := b.failures[ip]; ok {
+		record = element.Value.(*failureRecord)
+		b.recent.MoveToFront(element)
+	} else {
+		if b.recent.Len() >= max {
+			oldest := b.recent.Back()
+			b.recent.Remove(oldest)
+			delete(b.failures, oldest.Value.(*failureRecord).ip)
+		}
+		record = &failureRecord{ip: ip}
+		b.failures[ip] = b.recent.PushFront(record)
+	}
+	//only the failures within the window count
+	first := 0
+	for first < len(record.times) && now.Sub(record.times[first]) >= window {
+		first++
+	}
+	record.times = append(record.times[first:], now)
+	if len(record.times) < threshold {
+		return false
+	}
+	if _, ok := b.bans[ip]; !ok && len(b.bans) >= max {
+		b.evictBan()
+	}
+	b.bans[ip] = &authBan{until: now.Add(duration), failures: len(record.times)}
+	b.recent.Remove(b.failures[ip])
+	delete(b.failures, ip)
+	return true
+}
+
+//evictBan removes the ban that ends soonest, the bans must be locked
+func (b *authBans) evictBan() {
+	var soonest string
+	for ip, ban := range b.bans {
+		if soonest == "" || ban.until.Before(b.bans[soonest].until) {
+			soonest = ip
+		}
+	}
+	delete(b.bans, soonest)
+}
+
+//clear lifts the ban on ip and forgets its failures, or those of every address if ip is
+//empty. It returns the number of bans lifted.
+func (b *authBans) clear(ip string) int {
+	b.Lock()
+	defer b.Unlock()
+	if ip == "" {
+		lifted := len(b.bans)
+		b.bans = make(map[string]*authBan)
+		b.failures = make(map[string]*list.Element)
+		b.recent.Init()
+		return lifted
+	}
+	if element, ok := b.failures[ip]; ok {
+		b.recent.Remove(element)
+		delete(b.failures, ip)
+	}
+	if _, ok := b.bans[ip]; ok {
+		delete(b.bans, ip)
+		return 1
+	}
+	return 0
+}
+
+//snapshot returns the bans in force at now sorted by address
+func (b *authBans) snapshot(now time.Time) []BanInfo {
+	b.Lock()
+	bans := make([]BanInfo, 0, len(b.bans))
+	for ip, ban := range b.bans {
+		if now.Before(ban.until) {
+			bans = append(bans, BanInfo{IP: ip, Until: ban.until, Failures: ban.failures})
+		}
+	}
+	b.Unlock()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
+}
+
+//authFailed records a CONNECT from ip refused for its credentials, banning ip if it has
+//failed BanAuthFailures times within BanWindow
+func (h *Hrotti) authFailed(ip string) {
+	if h.BanAuthFailures <= 0 {
+		return
+	}
+	if h.bans.failed(ip, time.Now(), h.BanAuthFailures, h.BanWindow, h.BanDuration, h.MaxBans) {
+		h.listenerLog.Warn("Banned address for repeated authentication failures", "ip", ip, "failures", h.BanAuthFailures, "window", h.BanWindow, "duration", h.BanDuration)
+	}
+}
+
+//Bans returns the IP addresses banned for repeated authentication failures
+func (h *Hrotti) Bans() []BanInfo {
+	return h.bans.snapshot(time.Now())
+}
+
+//ClearBans lifts the ban on ip, or every ban if ip is empty, returning the number lifted
+func (h *Hrotti) ClearBans(ip string) int {
+	lifted := h.bans.clear(ip)
+	h.listenerLog.Info("Cleared bans", "ip", ip, "lifted", lifted)
+	return lifted
+}
@@ -0,0 +1,262 @@
+package hrotti
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	retainedBucket = []byte("retained")
+	sessionsBucket = []byte("sessions")
+	inflightBucket = []byte("inflight")
+)
+
+//BoltPersistence keeps the broker state in a BoltDB file at Path so retained messages,
+//sessions and inflight messages survive a restart. Packets are stored in their MQTT
+//wire format, see packPacket, sessions as JSON. Inflight messages are in a bucket per client keyed by
+//the direction followed by the big endian message id.
+type BoltPersistence struct {
+	Path string
+	db   *bolt.DB
+}
+
+func (p *BoltPersistence) Open() error {
+	db, err := bolt.Open(p.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{retainedBucket, sessionsBucket, inflightBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	p.db = db
+	return nil
+}
+
+func (p *BoltPersistence) Close() error {
+	return p.db.Close()
+}
+
+//packPacket returns message in its wire format for persisting. The properties of a PUBLISH
+//that has them, the time it was received and its publisher, follow the packet as JSON so
+//packets stored without them still unpack.
+func packPacket(message ControlPacket) []byte {
+	var b bytes.Buffer
+	message.Write(&b)
+	if pp, ok := message.(*PublishPacket); ok && (pp.Properties != nil || !pp.ReceivedAt.IsZero() || pp.Publisher != "") {
+		extra := packetExtra{Properties: pp.Properties, Publisher: pp.Publisher}
+		if !pp.ReceivedAt.IsZero() {
+			extra.ReceivedAt = pp.ReceivedAt.UnixNano()
+		}
+		json.NewEncoder(&b).Encode(extra)
+	}
+	return b.Bytes()
+}
+
+//packetExtra is what is kept with a persisted PUBLISH that isn't in its wire format. The
+//properties are inlined, as they were stored before anything else was kept.
+type packetExtra struct {
+	*Properties
+	ReceivedAt int64  `json:"receivedAt,omitempty"`
+	Publisher  string `json:"publisher,omitempty"`
+}
+
+func unpackPacket(b []byte) (ControlPacket, error) {
+	r := bytes.NewReader(b)
+	cp, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if pp, ok := cp.(*PublishPacket); ok && r.Len() > 0 {
+		var extra packetExtra
+		if err := json.NewDecoder(r).Decode(&extra); err != nil {
+			return nil, err
+		}
+		pp.Properties = extra.Properties
+		pp.Publisher = extra.Publisher
+		if extra.ReceivedAt != 0 {
+			pp.ReceivedAt = time.Unix(0, extra.ReceivedAt)
+		}
+	}
+	return cp, nil
+}
+
+func inflightKeyBytes(direction dirFlag, msgID uint16) []byte {
+	key := make([]byte, 3)
+	key[0] = byte(direction)
+	binary.BigEndian.PutUint16(key[1:], msgID)
+	return key
+}
+
+func (p *BoltPersistence) StoreRetained(topic string, message *PublishPacket) error {
+	return p.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(retainedBucket).Put([]byte(topic), packPacket(message))
+	})
+}
+
+//LoadRetained returns the retained message for topic, or nil if there isn't one
+func (p *BoltPersistence) LoadRetained(topic string) (*PublishPacket, error) {
+	var message *PublishPacket
+	err := p.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(retainedBucket).Get([]byte(topic))
+		if data == nil {
+			return nil
+		}
+		cp, err := unpackPacket(data)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if message, ok = cp.(*PublishPacket); !ok {
+			return errors.New("Retained message is not a PUBLISH")
+		}
+		return nil
+	})
+	return message, err
+}
+
+func (p *BoltPersistence) DeleteRetained(topic string) error {
+	return p.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(retainedBucket).Delete([]byte(topic))
+	})
+}
+
+func (p *BoltPersistence) RangeRetained(f func(string, *PublishPacket) bool) error {
+	return p.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(retainedBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			cp, err := unpackPacket(v)
+			if err != nil {
+				return err
+			}
+			message, ok := cp.(*PublishPacket)
+			if !ok {
+				return errors.New("Retained message is not a PUBLISH")
+			}
+			if !f(string(k), message) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (p *BoltPersistence) StoreSession(client string, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return p.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(client), data)
+	})
+}
+
+//LoadSession returns the session for client, or nil if there isn't one
+func (p *BoltPersistence) LoadSession(client string) (*Session, error) {
+	var session *Session
+	err := p.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(sessionsBucket).Get([]byte(client))
+		if data == nil {
+			return nil
+		}
+		session = &Session{}
+		return json.Unmarshal(data, session)
+	})
+	return session, err
+}
+
+//DeleteSession removes the session and any inflight messages for client
+func (p *BoltPersistence) DeleteSession(client string) error {
+	return p.db.Batch(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(sessionsBucket).Delete([]byte(client)); err != nil {
+			return err
+		}
+		err := tx.Bucket(inflightBucket).DeleteBucket([]byte(client))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (p *BoltPersistence) RangeSessions(f func(string, *Session) bool) error {
+	return p.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(sessionsBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			session := &Session{}
+			if err := json.Unmarshal(v, session); err != nil {
+				return err
+			}
+			if !f(string(k), session) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (p *BoltPersistence) StoreInflight(client string, direction dirFlag, msgID uint16, message ControlPacket) error {
+	return p.db.Batch(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(inflightBucket).CreateBucketIfNotExists([]byte(client))
+		if err != nil {
+			return err
+		}
+		return bucket.Put(inflightKeyBytes(direction, msgID), packPacket(message))
+	})
+}
+
+func (p *BoltPersistence) DeleteInflight(client string, direction dirFlag, msgID uint16) error {
+	return p.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(inflightBucket).Bucket([]byte(client))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(inflightKeyBytes(direction, msgID))
+	})
+}
+
+//RangeInflight calls f for the inflight messages for client in direction and message id
+//order. The messages are read in one transaction and f is called after it has finished
+//so f can modify the store.
+func (p *BoltPersistence) RangeInflight(client string, f func(dirFlag, uint16, ControlPacket) bool) error {
+	var keys [][]byte
+	var messages []ControlPacket
+	err := p.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(inflightBucket).Bucket([]byte(client))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			message, err := unpackPacket(v)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, append([]byte(nil), k...))
+			messages = append(messages, message)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if !f(dirFlag(key[0]), binary.BigEndian.Uint16(key[1:]), messages[i]) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,632 @@
+package hrotti
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//BridgeDirection is which way messages for a BridgeTopic are relayed
+type BridgeDirection int
+
+const (
+	//BridgeOut relays local messages to the remote broker
+	BridgeOut BridgeDirection = iota
+	//BridgeIn relays messages from the remote broker to local subscribers
+	BridgeIn
+	//BridgeBoth relays messages in both directions
+	BridgeBoth
+)
+
+//BridgeTopic is a topic filter to relay over a bridge. A message on local topic
+//LocalPrefix+<topic> is relayed as RemotePrefix+<topic> and vice versa, where <topic>
+//matches Pattern.
+type BridgeTopic struct {
+	Pattern      string
+	Direction    BridgeDirection
+	Qos          byte
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+//BridgeConfig is the configuration for a bridge to a remote broker. URL is the remote
+//broker (only tcp is supported), KeepAlive is in seconds. Unless SkipRetainedSync is set
+//the bridge asks the remote broker for the retained messages matching its inbound topics
+//each time it connects, see RetainedSyncRequest.
+//
+//ProtocolVersion is 3 to connect with MQTT 3.1 (protocol name MQIsdp) or 4, the default,
+//for MQTT 3.1.1. The bridge sets the high bit of the version in its CONNECT, as mosquitto
+//does with try_private, so the remote broker knows it is a bridge and doesn't send it back
+//the messages it publishes. DisableTryPrivate connects as an ordinary client for a remote
+//broker that refuses the bit, the bridge's inbound and outbound topics then mustn't overlap.
+type BridgeConfig struct {
+	URL               *url.URL
+	ClientID          string
+	Username          string
+	Password          []byte
+	KeepAlive         uint16
+	CleanSession      bool
+	Topics            []*BridgeTopic
+	SkipRetainedSync  bool
+	ProtocolVersion   byte
+	DisableTryPrivate bool
+}
+
+//BridgeStatus is the current state of a bridge
+type BridgeStatus struct {
+	Connected    bool
+	Connects     int
+	SyncComplete bool
+	SyncCursor   string
+	SyncCount    int
+}
+
+const (
+	bridgeConnectTimeout = 10 * time.Second
+	bridgeMinBackoff     = time.Second
+	bridgeMaxBackoff     = time.Minute
+)
+
+//bridge relays messages between the local broker and a remote one. The QoS 1 and 2 messages
+//it forwards keep the message ids the local side was given them with and stay persisted as
+//the local side's inflight messages until the remote broker acknowledges them, so they are
+//resent if the connection is lost first.
+type bridge struct {
+	sync.Mutex
+	name    string
+	config  *BridgeConfig
+	hrotti  *Hrotti
+	local   *Client
+	conn    net.Conn
+	writeMu sync.Mutex
+	status  BridgeStatus
+	stop    chan struct{}
+	//sent is the ids of the messages written to the remote broker that it hasn't acknowledged
+	sent map[uint16]bool
+	//received is the ids of the inbound QoS 2 messages published locally that the remote
+	//broker hasn't released yet, as with Client.inboundQos2
+	received map[uint16]bool
+	//subscribeID is the message id of the SUBSCRIBE waiting for its SUBACK
+	subscribeID uint16
+}
+
+func (t *BridgeTopic) in() bool {
+	return t.Direction == BridgeIn || t.Direction == BridgeBoth
+}
+
+func (t *BridgeTopic) out() bool {
+	return t.Direction == BridgeOut || t.Direction == BridgeBoth
+}
+
+//remap returns the topic with fromPrefix replaced by toPrefix, if the topic starts with
+//fromPrefix and the rest of it matches the pattern
+func (t *BridgeTopic) remap(topic, fromPrefix, toPrefix string) (string, bool) {
+	if !strings.HasPrefix(topic, fromPrefix) {
+		return "", false
+	}
+	rest := topic[len(fromPrefix):]
+	if !match(topicLevels(t.Pattern), topicLevels(rest)) {
+		return "", false
+	}
+	return toPrefix + rest, true
+}
+
+//AddBridge starts a bridge to a remote broker, the bridge keeps reconnecting with a
+//backoff whenever the connection to the remote broker is lost until the broker is stopped.
+func (h *Hrotti) AddBridge(name string, config *BridgeConfig) error {
+	if config.URL == nil || config.URL.Scheme != "tcp" {
+		return errors.New("Bridge URL must be tcp")
+	}
+	if config.ProtocolVersion != 0 && config.ProtocolVersion != 3 && config.ProtocolVersion != 4 {
+		return errors.New("Bridge protocol version must be 3 or 4")
+	}
+	if _, ok := h.bridges[name]; ok {
+		return errors.New("Bridge already exists")
+	}
+	b := &bridge{
+		name:     name,
+		config:   config,
+		hrotti:   h,
+		stop:     make(chan struct{}),
+		sent:     make(map[uint16]bool),
+		received: make(map[uint16]bool),
+	}
+	if b.config.ClientID == "" {
+		b.config.ClientID = "hrotti-bridge-" + name
+	}
+	//the local side of the bridge is an internal client that subscribes to the outbound
+	//topics. It suppresses echoes so messages the bridge brings in from the remote broker
+	//are never sent back out to it, and as a bridge it doesn't get the messages other
+	//bridges bring in once they have crossed MaxBridgeHops.
+	b.local = newClient(nil, "$bridge/"+name, h.maxQueueDepth)
+	b.local.suppressEcho = true
+	b.local.bridge = true
+	b.local.state.SetValue(CONNECTED)
+	b.restoreInflight()
+	h.clients.Lock()
+	h.clients.list[b.local.clientID] = b.local
+	h.clients.Unlock()
+	for _, topic := range config.Topics {
+		if topic.out() {
+			h.AddSub(b.local, topic.LocalPrefix+topic.Pattern, SubscriptionOptions{Qos: topic.Qos})
+		}
+	}
+	h.bridges[name] = b
+	go b.run()
+	return nil
+}
+
+//restoreInflight picks up the messages the local side of the bridge had inflight when the
+//broker stopped, the outbound ones are resent when the bridge connects. The local side
+//doesn't keep a session otherwise, its subscriptions are made again from the config.
+func (b *bridge) restoreInflight() {
+	b.hrotti.PersistStore.RangeInflight(b.local.clientID, func(direction dirFlag, msgID uint16, message ControlPacket) bool {
+		if direction == OUTBOUND {
+			b.local.claimID(msgID, message.UUID())
+			b.sent[msgID] = true
+		} else {
+			b.received[msgID] = true
+		}
+		return true
+	})
+	b.local.resumeSequence()
+}
+
+//BridgeStatus returns the status of the named bridge
+func (h *Hrotti) BridgeStatus(name string) (BridgeStatus, bool) {
+	b, ok := h.bridges[name]
+	if !ok {
+		return BridgeStatus{}, false
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.status, true
+}
+
+func (b *bridge) run() {
+	backoff := bridgeMinBackoff
+	for {
+		err := b.connect()
+		if err == nil {
+			backoff = bridgeMinBackoff
+			err = b.serve()
+		}
+		b.Lock()
+		b.status.Connected = false
+		b.Unlock()
+		b.hrotti.bridgeLog.Error("Bridge disconnected", "bridge", b.name, "err", err)
+		select {
+		case <-b.stop:
+			return
+		case <-b.hrotti.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > bridgeMaxBackoff {
+			backoff = bridgeMaxBackoff
+		}
+	}
+}
+
+func (b *bridge) write(cp ControlPacket) error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	return cp.Write(b.conn)
+}
+
+//connect opens the connection to the remote broker and completes the CONNECT handshake,
+//then requests the retained sync and subscribes to the inbound topics.
+func (b *bridge) connect() error {
+	conn, err := net.DialTimeout("tcp", b.config.URL.Host, bridgeConnectTimeout)
+	if err != nil {
+		return err
+	}
+	b.conn = conn
+
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	if b.config.ProtocolVersion == 3 {
+		cp.ProtocolName = "MQIsdp"
+		cp.ProtocolVersion = 3
+	}
+	//set the bridge bit in the protocol version so the remote broker doesn't send us back
+	//messages we've published to it
+	if !b.config.DisableTryPrivate {
+		cp.ProtocolVersion |= 0x80
+	}
+	cp.CleanSession = b.config.CleanSession
+	cp.KeepaliveTimer = b.config.KeepAlive
+	cp.ClientIdentifier = b.config.ClientID
+	if b.config.Username != "" {
+		cp.UsernameFlag = true
+		cp.Username = b.config.Username
+	}
+	if b.config.Password != nil {
+		cp.PasswordFlag = true
+		cp.Password = b.config.Password
+	}
+	if err = b.write(cp); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(bridgeConnectTimeout))
+	rp, err := ReadPacket(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	ca, ok := rp.(*ConnackPacket)
+	if !ok {
+		conn.Close()
+		return errors.New("Expected CONNACK from remote broker")
+	}
+	if ca.ReturnCode != CONN_ACCEPTED {
+		conn.Close()
+		return errors.New(ConnackReturnCodes[ca.ReturnCode])
+	}
+	b.hrotti.bridgeLog.Info("Bridge connected", "bridge", b.name, "url", b.config.URL)
+	//a clean session on the remote broker won't resend the QoS 2 messages it hadn't released
+	if b.config.CleanSession {
+		for msgID := range b.received {
+			b.hrotti.PersistStore.DeleteInflight(b.local.clientID, INBOUND, msgID)
+		}
+		b.received = make(map[uint16]bool)
+	}
+	if err = b.resend(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	var filters []string
+	var qoss []byte
+	var syncQoss []int
+	for _, topic := range b.config.Topics {
+		if topic.in() {
+			filters = append(filters, topic.RemotePrefix+topic.Pattern)
+			qoss = append(qoss, topic.Qos)
+			syncQoss = append(syncQoss, int(topic.Qos))
+		}
+	}
+	b.Lock()
+	b.status.Connected = true
+	b.status.Connects++
+	//an interrupted sync is resumed from its cursor, otherwise start a new one as the
+	//remote retained messages may have changed while we were disconnected
+	if b.status.SyncComplete {
+		b.status.SyncComplete = false
+		b.status.SyncCursor = ""
+		b.status.SyncCount = 0
+	}
+	cursor := b.status.SyncCursor
+	b.Unlock()
+	if len(filters) == 0 {
+		return nil
+	}
+	//the sync request has to be sent before subscribing, the remote broker doesn't send
+	//retained messages on subscribe to a client that has asked for a sync
+	if !b.config.SkipRetainedSync {
+		req := NewControlPacket(PUBLISH).(*PublishPacket)
+		req.TopicName = RetainedSyncRequestTopic
+		req.Payload, _ = json.Marshal(RetainedSyncRequest{Filters: filters, Qos: syncQoss, Cursor: cursor})
+		if err = b.write(req); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	//the id of a SUBSCRIBE the last connection didn't get a SUBACK for can be used again
+	if b.subscribeID != 0 {
+		b.local.freeID(b.subscribeID)
+	}
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	if sp.MessageID = b.local.getMsgID(sp.UUID()); sp.MessageID == 0 {
+		conn.Close()
+		return errors.New("No free message ids")
+	}
+	b.subscribeID = sp.MessageID
+	sp.Topics = filters
+	sp.Qoss = qoss
+	if err = b.write(sp); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+//resend writes the messages the remote broker hadn't acknowledged when the last connection
+//was lost again, oldest first. A PUBLISH is sent with DUP set and a QoS 2 message the remote
+//broker has already received has its PUBREL sent instead.
+func (b *bridge) resend() error {
+	b.Lock()
+	ids := make([]uint16, 0, len(b.sent))
+	for msgID := range b.sent {
+		ids = append(ids, msgID)
+	}
+	b.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	b.local.sortByAge(ids)
+	messages := make(map[uint16]ControlPacket)
+	b.hrotti.PersistStore.RangeInflight(b.local.clientID, func(direction dirFlag, msgID uint16, message ControlPacket) bool {
+		if direction == OUTBOUND {
+			messages[msgID] = message
+		}
+		return true
+	})
+	b.hrotti.bridgeLog.Info("Bridge resending unacknowledged messages", "bridge", b.name, "messages", len(ids))
+	for _, msgID := range ids {
+		var err error
+		switch msg := messages[msgID].(type) {
+		case *PublishPacket:
+			pp, ok := b.remoteCopy(msg)
+			if !ok {
+				b.acked(msgID)
+				continue
+			}
+			pp.Dup = true
+			if err = b.write(pp); tooLarge(err) {
+				b.dropTooLarge(pp)
+				err = nil
+			}
+		case *PubrelPacket:
+			err = b.write(msg)
+		//the message couldn't be persisted, so there is nothing to resend
+		default:
+			b.acked(msgID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//remoteCopy returns the local message msg as it is sent to the remote broker, on the topic
+//the first outbound topic it matches remaps it to
+func (b *bridge) remoteCopy(msg *PublishPacket) (*PublishPacket, bool) {
+	for _, topic := range b.config.Topics {
+		if !topic.out() {
+			continue
+		}
+		if remoteTopic, ok := topic.remap(msg.TopicName, topic.LocalPrefix, topic.RemotePrefix); ok {
+			pp := msg.Copy()
+			pp.TopicName = remoteTopic
+			pp.Qos = msg.Qos
+			pp.MessageID = msg.MessageID
+			return pp, true
+		}
+	}
+	return nil, false
+}
+
+//acked forgets an outbound message once the remote broker has acknowledged it, with a
+//PUBACK or PUBCOMP, or it can't be sent at all
+func (b *bridge) acked(msgID uint16) {
+	b.Lock()
+	delete(b.sent, msgID)
+	b.Unlock()
+	b.hrotti.PersistStore.DeleteInflight(b.local.clientID, OUTBOUND, msgID)
+	b.local.ackID(msgID)
+}
+
+//unacked returns true if msgID is a message written to the remote broker that it hasn't
+//acknowledged
+func (b *bridge) unacked(msgID uint16) bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.sent[msgID]
+}
+
+//serve relays messages over the connection until it fails or the bridge is stopped
+func (b *bridge) serve() error {
+	done := make(chan struct{})
+	errChan := make(chan error, 1)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errChan <- b.receive()
+	}()
+	go func() {
+		defer wg.Done()
+		b.forward(done)
+	}()
+	var err error
+	select {
+	case err = <-errChan:
+	case <-b.stop:
+		err = errors.New("Bridge stopped")
+	case <-b.hrotti.stop:
+		err = errors.New("Broker stopped")
+	}
+	close(done)
+	b.conn.Close()
+	wg.Wait()
+	return err
+}
+
+//forward sends messages received by the local side of the bridge to the remote broker,
+//and PINGREQs to keep the connection alive
+func (b *bridge) forward(done chan struct{}) {
+	var ping <-chan time.Time
+	if b.config.KeepAlive > 0 {
+		ticker := time.NewTicker(time.Duration(b.config.KeepAlive) * time.Second)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-ping:
+			b.write(NewControlPacket(PINGREQ))
+		case msg := <-b.local.outboundMessages:
+			pp, ok := b.remoteCopy(msg)
+			if !ok {
+				if msg.Qos > 0 {
+					b.acked(msg.MessageID)
+				}
+				continue
+			}
+			//the message is marked as sent before it is written so an acknowledgement can't
+			//arrive first, if the write fails it is resent when the bridge reconnects
+			if pp.Qos > 0 {
+				b.Lock()
+				b.sent[pp.MessageID] = true
+				b.Unlock()
+			}
+			err := b.write(pp)
+			if tooLarge(err) {
+				b.dropTooLarge(pp)
+				continue
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+//dropTooLarge drops a message that can't be encoded once its topic is remapped for the
+//remote broker, nothing was written so the connection is still usable
+func (b *bridge) dropTooLarge(pp *PublishPacket) {
+	b.hrotti.bridgeLog.Error("Dropped PUBLISH too large to encode", "bridge", b.name, "topic", pp.TopicName, "size", len(pp.Payload))
+	b.hrotti.stats.DroppedMessage()
+	b.hrotti.discard(DropTooLarge, pp, b.local.clientID)
+	if pp.Qos > 0 {
+		b.acked(pp.MessageID)
+	}
+}
+
+//receive reads packets from the remote broker, publishing inbound messages locally
+func (b *bridge) receive() error {
+	reader := NewReader(b.conn)
+	for {
+		if b.config.KeepAlive > 0 {
+			b.conn.SetReadDeadline(time.Now().Add(time.Duration(float64(b.config.KeepAlive)*1.5) * time.Second))
+		}
+		cp, err := reader.ReadPacket(0)
+		if err != nil {
+			return err
+		}
+		switch p := cp.(type) {
+		case *PublishPacket:
+			switch p.Qos {
+			case 0:
+				b.publishLocal(p)
+			case 1:
+				b.publishLocal(p)
+				pa := NewControlPacket(PUBACK).(*PubackPacket)
+				pa.MessageID = p.MessageID
+				err = b.write(pa)
+			case 2:
+				//a QoS 2 message is only published the first time it arrives, until the remote
+				//broker releases it a resend is only acknowledged again
+				if !b.received[p.MessageID] {
+					b.received[p.MessageID] = true
+					b.hrotti.PersistStore.StoreInflight(b.local.clientID, INBOUND, p.MessageID, p)
+					b.publishLocal(p)
+				}
+				pr := NewControlPacket(PUBREC).(*PubrecPacket)
+				pr.MessageID = p.MessageID
+				err = b.write(pr)
+			}
+		case *PubrelPacket:
+			if b.received[p.MessageID] {
+				delete(b.received, p.MessageID)
+				b.hrotti.PersistStore.DeleteInflight(b.local.clientID, INBOUND, p.MessageID)
+			}
+			pc := NewControlPacket(PUBCOMP).(*PubcompPacket)
+			pc.MessageID = p.MessageID
+			err = b.write(pc)
+		//the PUBREL replaces the message in persistence, so it is what is resent if the
+		//connection is lost before the PUBCOMP
+		case *PubrecPacket:
+			if !b.unacked(p.MessageID) {
+				b.hrotti.bridgeLog.Warn("Received PUBREC for unknown message id", "bridge", b.name, "id", p.MessageID)
+				break
+			}
+			prel := NewControlPacket(PUBREL).(*PubrelPacket)
+			prel.MessageID = p.MessageID
+			b.hrotti.PersistStore.StoreInflight(b.local.clientID, OUTBOUND, p.MessageID, prel)
+			err = b.write(prel)
+		case *PubackPacket:
+			if b.unacked(p.MessageID) {
+				b.acked(p.MessageID)
+			}
+		case *PubcompPacket:
+			if b.unacked(p.MessageID) {
+				b.acked(p.MessageID)
+			}
+		case *SubackPacket:
+			if p.MessageID == b.subscribeID {
+				b.local.freeID(p.MessageID)
+				b.subscribeID = 0
+			}
+			b.hrotti.bridgeLog.Info("Bridge subscribed", "bridge", b.name, "granted", p.GrantedQoss)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//publishLocal delivers a message from the remote broker to local subscribers, as coming
+//from the local side of the bridge so it isn't forwarded back out again.
+func (b *bridge) publishLocal(p *PublishPacket) {
+	if p.TopicName == RetainedSyncCompleteTopic {
+		var complete RetainedSyncComplete
+		json.Unmarshal(p.Payload, &complete)
+		b.Lock()
+		b.status.SyncComplete = true
+		b.status.SyncCursor = complete.Cursor
+		b.Unlock()
+		b.hrotti.bridgeLog.Info("Bridge retained sync complete", "bridge", b.name, "messages", complete.Count)
+		return
+	}
+	for _, topic := range b.config.Topics {
+		if !topic.in() {
+			continue
+		}
+		localTopic, ok := topic.remap(p.TopicName, topic.RemotePrefix, topic.LocalPrefix)
+		if !ok {
+			continue
+		}
+		pp := p.Copy()
+		pp.TopicName = localTopic
+		pp.Qos = p.Qos
+		pp.Hops = 1
+		pp.Retain = p.Retain
+		message := b.hrotti.ingest(localTopic, pp)
+		//a retained message over the local broker's retained limits can be rejected
+		deliver := true
+		if p.Retain {
+			deliver, _ = b.hrotti.setRetained(message)
+			b.Lock()
+			if !b.status.SyncComplete {
+				b.status.SyncCursor = p.TopicName
+				b.status.SyncCount++
+			}
+			b.Unlock()
+		}
+		if deliver {
+			b.hrotti.route(message, b.local)
+		}
+		return
+	}
+}
+
+//hopped returns true if a message that has crossed hops bridges has crossed MaxBridgeHops,
+//so it isn't sent over another. Only the bridge a message came in over is counted as MQTT
+//3.1.1 has no way to carry the count between brokers.
+func (h *Hrotti) hopped(hops int) bool {
+	return h.MaxBridgeHops > 0 && hops >= h.MaxBridgeHops
+}
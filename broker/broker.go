@@ -0,0 +1,288 @@
+package hrotti
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+//Broker is a Hrotti along with the listeners, bridges and HTTP endpoints it runs, for
+//embedding the broker in another program. It is built with NewBroker and options, started
+//with Start and stopped with Stop. Everything a Broker uses is its own, its logging included,
+//so any number of them can run in one process as long as their listeners have different
+//addresses.
+type Broker struct {
+	hrotti         *Hrotti
+	persistence    Persistence
+	maxQueueDepth  int
+	settings       []func(*Hrotti)
+	importState    io.Reader
+	importErr      error
+	optionErr      error
+	logs           *loggers
+	profiles       []*ClientProfile
+	listeners      []namedListener
+	bridges        []namedBridge
+	adminAddress   string
+	metricsAddress string
+	startOnce      sync.Once
+	startErr       error
+	stopOnce       sync.Once
+	stopped        chan struct{}
+}
+
+type namedListener struct {
+	name   string
+	config *ListenerConfig
+}
+
+type namedBridge struct {
+	name   string
+	config *BridgeConfig
+}
+
+//Option configures a Broker, see NewBroker
+type Option func(*Broker)
+
+//WithListener adds a listener called name, it is started by Start. Listeners are started in
+//the order they are added.
+func WithListener(name string, config *ListenerConfig) Option {
+	return func(b *Broker) {
+		b.listeners = append(b.listeners, namedListener{name, config})
+	}
+}
+
+//WithInheritedListeners gives the broker sockets to use for the listeners with the same
+//addresses rather than binding new ones, see SocketActivation. Any not used by a listener are
+//closed by Start.
+func WithInheritedListeners(listeners []net.Listener) Option {
+	return WithSettings(func(h *Hrotti) { h.InheritedListeners = listeners })
+}
+
+//WithBridge adds a bridge called name, it is started by Start after the listeners
+func WithBridge(name string, config *BridgeConfig) Option {
+	return func(b *Broker) {
+		b.bridges = append(b.bridges, namedBridge{name, config})
+	}
+}
+
+//WithPersistence sets where the broker keeps its state, the default is MemoryPersistence
+func WithPersistence(persistence Persistence) Option {
+	return func(b *Broker) { b.persistence = persistence }
+}
+
+//WithImportedState loads the state file read from r, written by ExportState, into the
+//broker's persistence before its state is restored, so the broker starts with the sessions,
+//retained messages and inflight messages in it. The persistence has to be empty, if the state
+//can't be imported Start returns the error.
+func WithImportedState(r io.Reader) Option {
+	return func(b *Broker) { b.importState = r }
+}
+
+//WithMaxQueueDepth sets the number of messages queued for each client, the default is 100
+func WithMaxQueueDepth(depth int) Option {
+	return func(b *Broker) { b.maxQueueDepth = depth }
+}
+
+//WithAuth sets the users, ACLs and anonymous access of every listener without its own
+func WithAuth(auth *Auth) Option {
+	return WithSettings(func(h *Hrotti) { h.Auth = auth })
+}
+
+//WithAuthenticator sets the Authenticator of every listener without its own
+func WithAuthenticator(authenticator Authenticator) Option {
+	return WithSettings(func(h *Hrotti) { h.Authenticator = authenticator })
+}
+
+//WithHooks sets the Hooks called for client events, run by workers goroutines with a queue
+//of queueDepth events, 0 for the defaults
+func WithHooks(hooks Hooks, workers int, queueDepth int) Option {
+	return WithSettings(func(h *Hrotti) {
+		h.Hooks = hooks
+		h.HookWorkers = workers
+		h.HookQueueDepth = queueDepth
+	})
+}
+
+//WithConnectionLimits limits the number of connections to the broker and from each IP
+//address, 0 is no limit
+func WithConnectionLimits(max int, perIP int, policy ConnectionLimitPolicy) Option {
+	return WithSettings(func(h *Hrotti) {
+		h.MaxConnections = max
+		h.MaxConnectionsPerIP = perIP
+		h.ConnectionLimitPolicy = policy
+	})
+}
+
+//WithMaxPacketSize sets the largest packet a client can send, 0 is no limit
+func WithMaxPacketSize(size int) Option {
+	return WithSettings(func(h *Hrotti) { h.MaxPacketSize = size })
+}
+
+//WithRateLimit limits the rate each client can publish at
+func WithRateLimit(limit *RateLimit) Option {
+	return WithSettings(func(h *Hrotti) { h.RateLimit = limit })
+}
+
+//WithClientProfile adds a profile of options for the clients with ids matching its prefix
+func WithClientProfile(profile *ClientProfile) Option {
+	return func(b *Broker) { b.profiles = append(b.profiles, profile) }
+}
+
+//WithAdminListener serves the admin API on address when the broker starts
+func WithAdminListener(address string) Option {
+	return func(b *Broker) { b.adminAddress = address }
+}
+
+//WithMetricsListener serves the metrics and health checks on address when the broker starts
+func WithMetricsListener(address string) Option {
+	return func(b *Broker) { b.metricsAddress = address }
+}
+
+//WithLogOutput sets where the broker logs, see SetLogOutput. The default is the output set
+//with SetLogOutput, stderr if it hasn't been called.
+func WithLogOutput(w io.Writer, asJSON bool) Option {
+	return func(b *Broker) { b.logs.setOutput(w, asJSON) }
+}
+
+//WithLogLevel sets the level the broker logs component at, or every component if component
+//is empty, see SetLogLevel. The default is the level set with SetLogLevel, info if it hasn't
+//been called. Start returns the error for an unknown component.
+func WithLogLevel(component string, level LogLevel) Option {
+	return func(b *Broker) {
+		if err := b.logs.setLevel(component, level); err != nil && b.optionErr == nil {
+			b.optionErr = err
+		}
+	}
+}
+
+//WithSettings calls f with the Hrotti before the broker starts, to set any of its fields
+//there is no option for
+func WithSettings(f func(*Hrotti)) Option {
+	return func(b *Broker) { b.settings = append(b.settings, f) }
+}
+
+//NewBroker returns a Broker with options applied. Its persistence is opened and its state
+//restored straight away, after the settings, but nothing is listening until Start.
+func NewBroker(options ...Option) *Broker {
+	b := &Broker{maxQueueDepth: 100, stopped: make(chan struct{}), logs: defaultLoggers.clone()}
+	for _, option := range options {
+		option(b)
+	}
+	if b.persistence == nil {
+		b.persistence = &MemoryPersistence{}
+	}
+	b.hrotti = newHrotti(b.maxQueueDepth, b.persistence, b.logs)
+	for _, f := range b.settings {
+		f(b.hrotti)
+	}
+	if b.importState != nil {
+		counts, err := ImportState(b.importState, b.hrotti.PersistStore)
+		if err != nil {
+			b.hrotti.persistenceLog.Error("Failed to import state", "err", err)
+			b.importErr = err
+		} else {
+			b.hrotti.persistenceLog.Info("Imported state", "sessions", counts.Sessions, "subscriptions", counts.Subscriptions,
+				"retained", counts.Retained, "inflight", counts.Inflight)
+		}
+	}
+	b.hrotti.restore()
+	for _, profile := range b.profiles {
+		b.hrotti.AddClientProfile(profile)
+	}
+	return b
+}
+
+//Hrotti returns the broker the Broker runs, for the admin methods such as Clients, Publish
+//and Reload, or ServeConn
+func (b *Broker) Hrotti() *Hrotti {
+	return b.hrotti
+}
+
+//Start starts the listeners, the admin and metrics listeners and then the bridges. If a
+//listener fails to start the ones already started are stopped and its error is returned,
+//as is a bridge's, so the broker is either running as configured or not at all. Only the
+//first call does anything, later ones return its error. A Broker can't be started again
+//once it has been stopped.
+func (b *Broker) Start() error {
+	b.startOnce.Do(func() {
+		select {
+		case <-b.stopped:
+			b.startErr = errors.New("Broker has been stopped")
+			return
+		default:
+		}
+		b.startErr = b.optionErr
+		if b.startErr == nil {
+			b.startErr = b.importErr
+		}
+		if b.startErr == nil {
+			b.startErr = b.start()
+		}
+		if b.startErr != nil {
+			b.Stop(context.Background())
+		}
+	})
+	return b.startErr
+}
+
+func (b *Broker) start() error {
+	h := b.hrotti
+	for _, l := range b.listeners {
+		if err := h.AddListener(l.name, l.config); err != nil {
+			return err
+		}
+	}
+	for _, ln := range h.InheritedListeners {
+		h.listenerLog.Warn("Inherited socket doesn't match the url of any listener, closing it", "addr", ln.Addr())
+		ln.Close()
+	}
+	h.InheritedListeners = nil
+	if b.adminAddress != "" {
+		if err := h.AddAdminListener(b.adminAddress); err != nil {
+			return err
+		}
+	}
+	if b.metricsAddress != "" {
+		if err := h.AddMetricsListener(b.metricsAddress); err != nil {
+			return err
+		}
+	}
+	for _, bridge := range b.bridges {
+		if err := h.AddBridge(bridge.name, bridge.config); err != nil {
+			h.bridgeLog.Error("Failed to add bridge", "bridge", bridge.name, "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+//Addr returns the address the listener called name is listening on, which is how to find
+//the port of a listener with port 0, or nil if there isn't one running
+func (b *Broker) Addr(name string) net.Addr {
+	listener, ok := b.hrotti.listeners[name]
+	if !ok || listener.ln == nil {
+		return nil
+	}
+	return listener.ln.Addr()
+}
+
+//Stop stops the broker: the listeners are closed, the clients disconnected and persistence
+//closed. It returns ctx's error if ctx is done first, the broker carries on stopping in the
+//background. It can be called more than once, and without Start having been called.
+func (b *Broker) Stop(ctx context.Context) error {
+	b.stopOnce.Do(func() {
+		go func() {
+			b.hrotti.Stop()
+			close(b.stopped)
+		}()
+	})
+	select {
+	case <-b.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,177 @@
+package hrotti
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+//CertFingerprint returns the fingerprint DeniedFingerprints and AllowedFingerprints match a
+//client certificate by, the SHA-256 of its DER encoding in lower case hex. It is the same
+//as `openssl x509 -noout -fingerprint -sha256` without the colons.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+//ParseFingerprint returns fingerprint as CertFingerprint would, it can be in either case and
+//have colons between the bytes
+func ParseFingerprint(fingerprint string) (string, error) {
+	f := strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+	if b, err := hex.DecodeString(f); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("%q isn't a SHA-256 fingerprint", fingerprint)
+	}
+	return f, nil
+}
+
+//certCheck refuses the client certificates of a listener that are revoked by its CRLFile,
+//in its DeniedFingerprints or, when it has AllowedFingerprints, not in them. It is built
+//with the listener's TLS config so Reload replaces it along with the certificates.
+type certCheck struct {
+	listener string
+	stats    *BrokerStats
+	log      *logger
+	//revoked has the revoked serial numbers by the raw issuer of the CRL that lists them
+	revoked map[string]map[string]bool
+	denied  map[string]bool
+	allowed map[string]bool
+}
+
+//newCertCheck returns the check for the listener called name with config, or nil if it
+//doesn't have one. cas are the certificates in its CA file that the CRLs must be signed by.
+func newCertCheck(name string, config *ListenerConfig, cas []*x509.Certificate, stats *BrokerStats, log *logger) (*certCheck, error) {
+	if config.CRLFile == "" && len(config.DeniedFingerprints) == 0 && len(config.AllowedFingerprints) == 0 {
+		return nil, nil
+	}
+	if config.CAFile == "" {
+		return nil, errors.New("Listener " + name + " checks client certificates without a CAFile")
+	}
+	c := &certCheck{listener: name, stats: stats, log: log, revoked: make(map[string]map[string]bool)}
+	var err error
+	if c.denied, err = fingerprintSet(config.DeniedFingerprints); err != nil {
+		return nil, err
+	}
+	if c.allowed, err = fingerprintSet(config.AllowedFingerprints); err != nil {
+		return nil, err
+	}
+	if config.CRLFile != "" {
+		if err := c.loadCRLs(config.CRLFile, cas); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func fingerprintSet(fingerprints []string) (map[string]bool, error) {
+	if len(fingerprints) == 0 {
+		return nil, nil
+	}
+	set := make(map[string]bool, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		f, err := ParseFingerprint(fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		set[f] = true
+	}
+	return set, nil
+}
+
+//loadCRLs reads the CRLs in file, which is either PEM with any number of them or a single
+//DER encoded one. Each must be signed by one of cas. A CRL past its next update is still
+//used, as an old list of revocations is better than none, but it is logged.
+func (c *certCheck) loadCRLs(file string, cas []*x509.Certificate) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var ders [][]byte
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = append(ders, data)
+	}
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("CRL file %s: %w", file, err)
+		}
+		signed := false
+		for _, ca := range cas {
+			if crl.CheckSignatureFrom(ca) == nil {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return fmt.Errorf("CRL file %s has a CRL from %s that isn't signed by a certificate in the CA file", file, crl.Issuer)
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			c.log.Warn("CRL is past its next update", "listener", c.listener, "issuer", crl.Issuer.String(), "nextUpdate", crl.NextUpdate)
+		}
+		serials := c.revoked[string(crl.RawIssuer)]
+		if serials == nil {
+			serials = make(map[string]bool)
+			c.revoked[string(crl.RawIssuer)] = serials
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			serials[entry.SerialNumber.String()] = true
+		}
+	}
+	return nil
+}
+
+//verify is the listener's VerifyConnection, it runs at the end of the handshake after the
+//client's chain has been verified so a refused client never gets to send a packet
+func (c *certCheck) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := cs.PeerCertificates[0]
+	fingerprint := CertFingerprint(cert)
+	var reason string
+	switch {
+	case c.revoked[string(cert.RawIssuer)][cert.SerialNumber.String()]:
+		reason = "revoked"
+	case c.denied[fingerprint]:
+		reason = "denied"
+	case c.allowed != nil && !c.allowed[fingerprint]:
+		reason = "not allowed"
+	default:
+		return nil
+	}
+	c.stats.certificateRefused()
+	c.log.Warn("Refused client certificate", "listener", c.listener, "subject", cert.Subject.String(), "fingerprint", fingerprint, "reason", reason)
+	return errors.New("client certificate " + reason)
+}
+
+//parseCertificates returns the certificates in the PEM data
+func parseCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
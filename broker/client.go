@@ -5,8 +5,12 @@ import (
 	. "github.com/alsm/hrotti/packets"
 	"github.com/google/uuid"
 	//"io"
+	"bufio"
+	"fmt"
+	"hash/fnv"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 	// Plugins currently don't work (they create a cycle). We could break the cycle
 	// by fudging things through main.go, but I think the real solution is to use RPC
@@ -20,6 +24,7 @@ type Client struct {
 	clientID         string
 	conn             net.Conn
 	keepAlive        uint16
+	connectKeepAlive uint16
 	state            State
 	topicSpace       string
 	outboundMessages chan *PublishPacket
@@ -28,8 +33,63 @@ type Client struct {
 	stopOnce         *sync.Once
 	resetTimer       chan bool
 	cleanSession     bool
+	sessionPresent   bool
 	willMessage      *PublishPacket
 	takeOver         bool
+	assignedID       bool
+	suppressEcho     bool
+	retainHandling   RetainHandling
+	bridge           bool
+	retainedSyncStop chan struct{}
+	retainedSynced   bool
+	dropped          int64
+	fullSince        int64
+	username         string
+	//anonymous is set for a client that connected without a username
+	anonymous bool
+	//deniedPublishes is the number of messages published outside the client's ACL since it
+	//connected, it is only used by Receive
+	deniedPublishes int
+	listener        string
+	listenerConfig  *ListenerConfig
+	auth            *Auth
+	acl             *ACL
+	limiter         *rateLimiter
+	rateDelayed     int64
+	rateDropped     int64
+	protocolVersion byte
+	stats           clientStats
+	//inboundQos2 is the message ids of the QoS 2 messages received from the client that are
+	//waiting for its PUBREL and the payloadHash of each, so a message resent with the id can
+	//be told from a new one reusing it. It is only used by the Receive goroutine.
+	inboundQos2 map[uint16]uint64
+	//acksQueued is the PUBACKs and PUBCOMPs queued for the client but not yet written, Send
+	//signals ackWritten as it writes them, see waitToReceive
+	acksQueued int64
+	ackWritten chan struct{}
+	//deliverMu orders the messages queued for the client, see deliver. While resending is set
+	//the inflight messages from its previous connection are being queued, and the QoS 0
+	//messages delivered meanwhile are held in heldQos0 to be queued after them.
+	deliverMu sync.Mutex
+	resending bool
+	heldQos0  []*PublishPacket
+	//unsubscribed is the subscriptionMap version after the client last unsubscribed
+	unsubscribed uint64
+	//retainedStream is the retained messages being streamed to the client, guarded by
+	//deliverMu, and queueDrained is signalled as Send takes messages off the queue
+	retainedStream *retainedStream
+	queueDrained   chan struct{}
+	//info guards the details of the current session that are read by the admin API and
+	//the connection and sync.Once replaced when a client reconnects, the client's own
+	//goroutines don't need it as they start after they are set
+	info           sync.RWMutex
+	remoteAddr     string
+	connectedAt    time.Time
+	disconnectedAt time.Time
+	//quota is the usage of the principal the client is connected as and sessionQuota that of
+	//the principal its durable session is counted against, nil without a Quota
+	quota        *quotaUsage
+	sessionQuota *quotaUsage
 }
 
 func newClient(conn net.Conn, clientID string, maxQDepth int) *Client {
@@ -38,9 +98,12 @@ func newClient(conn net.Conn, clientID string, maxQDepth int) *Client {
 		clientID:         clientID,
 		stop:             make(chan struct{}),
 		resetTimer:       make(chan bool, 1),
+		ackWritten:       make(chan struct{}, 1),
+		queueDrained:     make(chan struct{}, 1),
 		outboundMessages: make(chan *PublishPacket, maxQDepth),
 		outboundPriority: make(chan ControlPacket, maxQDepth),
 		stopOnce:         new(sync.Once),
+		inboundQos2:      make(map[uint16]uint64),
 		messageIDs: messageIDs{
 			//idChan: make(chan uint16, 10),
 			index: make(map[uint16]*uuid.UUID),
@@ -55,19 +118,19 @@ func (c *Client) Connected() bool {
 func (c *Client) KeepAliveTimer(hrotti *Hrotti) {
 	//this function is part of the client's waitgroup so call Done() when the function exits
 	defer c.Done()
+	defer c.recoverPanic(hrotti, "keepalive")
 	//In a continuous loop create a Timer for 1.5 * the keepAlive setting
 	for {
-		t := time.NewTimer(time.Duration(float64(c.keepAlive)*1.5) * time.Second)
+		t := hrotti.Clock.NewTimer(time.Duration(c.keepAlive) * 3 * time.Second / 2)
 		//this select will block on all 3 cases until one of them is ready
 		select {
 		//if we get a value in on the resetTimer channel we drop out, stop the Timer then loop round again
 		case <-c.resetTimer:
-			DEBUG.Println(c.clientID, "resetting keepalive timer")
+			hrotti.sessionLog.Trace("Resetting keepalive timer", "client", c.clientID)
 		//if the timer triggers then the client has failed to send us a packet in the keepAlive period so
-		//must be disconnected, we call Stop() and the function returns.
-		case <-t.C:
-			ERROR.Println(c.clientID, "has timed out", c.keepAlive)
-			go c.Stop(true, hrotti)
+		//must be disconnected, we close the client and the function returns.
+		case <-t.C():
+			c.closeLater(hrotti, closeKeepalive, "")
 			return
 		//the client sent a DISCONNECT or some error occurred that triggered the client to stop, so return.
 		case <-c.stop:
@@ -77,60 +140,50 @@ func (c *Client) KeepAliveTimer(hrotti *Hrotti) {
 	}
 }
 
-func (c *Client) StopForTakeover() {
-	//close the stop channel, close the network connection, wait for all the goroutines in the waitgroup to
-	//finish, set the conn and bufferedconn to nil
-	c.takeOver = true
-	c.stopOnce.Do(func() {
-		INFO.Println("Closing Stop chan")
-		close(c.stop)
-		INFO.Println("Closing connection")
-		c.conn.Close()
-		c.Wait()
-		c.conn = nil
-	})
-}
-
-func (c *Client) Stop(sendWill bool, hrotti *Hrotti) {
-	//Its possible that error conditions with the network connection might cause both Send and Receive to
-	//try and call Stop(), but we only want it to be called once, so using the sync.Once in the client we
-	//run the embedded function, later calls with the same sync.Once will simply return.
-	INFO.Println("Stopping client", c.clientID, c.conn.RemoteAddr())
-	if !c.takeOver {
-		c.stopOnce.Do(func() {
-			//close the stop channel, close the network connection, wait for all the goroutines in the waitgroup
-			//set the state as disconnected, close the message channels.
-			close(c.stop)
-			c.conn.Close()
-			c.Wait()
-			c.state.SetValue(DISCONNECTED)
-			close(c.outboundMessages)
-			close(c.outboundPriority)
-			//If we've stopped in a situation where the will message should be sent, and there is a will
-			//message, then send it.
-			if sendWill && c.willMessage != nil {
-				INFO.Println("Sending will message for", c.clientID)
-				go hrotti.DeliverMessage(c.willMessage.TopicName, c.willMessage)
-			}
-			//if this client connected with cleansession true it means it does not need its state (such as
-			//subscriptions, unreceived messages etc) kept around
-			if c.cleanSession {
-				//so we lock the clients map, delete the clientid and *Client from the map, remove all subscriptions
-				//associated with this client, from the normal tree and any plugins. Then close the persistence
-				//store that it was using.
-				hrotti.clients.Lock()
-				delete(hrotti.clients.list, c.clientID)
-				hrotti.clients.Unlock()
-				hrotti.DeleteSubAll(c.clientID)
-				hrotti.PersistStore.Close(c.clientID)
-			}
-		})
+//effectiveKeepAlive returns the keepalive enforced for a client that asked for requested. A
+//keepalive over MaxKeepAlive, or 0 which is no keepalive at all, is cut to MaxKeepAlive.
+//MQTT 3.1.1 has no way to tell the client, so it has to send something within the shorter
+//period or it is disconnected.
+func (h *Hrotti) effectiveKeepAlive(clientID string, requested uint16) uint16 {
+	if h.MaxKeepAlive == 0 || requested > 0 && requested <= h.MaxKeepAlive {
+		return requested
 	}
+	h.sessionLog.Debug("Keepalive is over the maximum, using the maximum", "client", clientID, "keepalive", requested, "max", h.MaxKeepAlive)
+	return h.MaxKeepAlive
 }
 
 func (c *Client) Start(cp *ConnectPacket, hrotti *Hrotti) {
+	//Start is part of the client's waitgroup so a takeover waits for it to finish starting
+	defer c.Done()
+	defer c.recoverPanic(hrotti, "start")
+	//the liveLock is taken first, as Reload does, so a Reload while the client is starting
+	//can't leave it with the ACL and rate limit from before
+	hrotti.liveLock.RLock()
+	c.info.Lock()
 	//If cleansession was set to 1 in the CONNECT packet set as true in the client.
 	c.cleanSession = cp.CleanSession
+	c.connectKeepAlive = cp.KeepaliveTimer
+	c.keepAlive = hrotti.effectiveKeepAlive(c.clientID, cp.KeepaliveTimer)
+	c.protocolVersion = cp.ProtocolVersion
+	c.username = cp.Username
+	c.anonymous = !cp.UsernameFlag
+	c.deniedPublishes = 0
+	c.auth, _ = hrotti.authFor(c.listenerConfig)
+	c.acl = c.auth.acl(c.username)
+	limit := hrotti.rateLimit(c.auth, c.username)
+	if c.quota != nil {
+		if quotaLimit := c.quota.limits().RateLimit; quotaLimit != nil {
+			limit = quotaLimit
+		}
+	}
+	c.limiter = newRateLimiter(limit)
+	c.remoteAddr = c.conn.RemoteAddr().String()
+	c.connectedAt = hrotti.Clock.Now()
+	c.disconnectedAt = time.Time{}
+	c.info.Unlock()
+	hrotti.liveLock.RUnlock()
+	//acknowledgements queued for the previous connection were never written
+	atomic.StoreInt64(&c.acksQueued, 0)
 	//There is a will message in the connect packet, so construct the publish packet that will be sent if
 	//the will is triggered.
 	if cp.WillFlag {
@@ -144,42 +197,45 @@ func (c *Client) Start(cp *ConnectPacket, hrotti *Hrotti) {
 	} else {
 		c.willMessage = nil
 	}
-	c.keepAlive = cp.KeepaliveTimer
+	c.retainedSynced = false
+	//apply any options from a client profile matching this client id
+	//bridges identify themselves in the CONNECT and never want their own messages back as
+	//that would loop them between the brokers
+	profile := hrotti.clientProfile(c.clientID)
+	c.suppressEcho = profile.SuppressEcho || cp.Bridge()
+	c.retainHandling = profile.RetainHandling
+	c.bridge = cp.Bridge()
 
-	//If cleansession true, or there doesn't already exist a persistence store for this client (ie a new
-	//durable client), create the inbound and outbound persistence stores.
-	if c.cleanSession || !hrotti.PersistStore.Exists(c.clientID) {
-		hrotti.PersistStore.Open(c.clientID)
+	//A clean session starts with nothing stored for the client, otherwise save the session so it is
+	//restored if the broker restarts and resend any messages still inflight, see connecting.
+	resending := !c.cleanSession
+	if c.cleanSession {
+		hrotti.PersistStore.DeleteSession(c.clientID)
 	} else {
-		//we have an existing inbound and outbound persistence store for this client already, so lets
-		//get any messages still in outbound and attempt to send them.
-		INFO.Println("Getting unacknowledged messages from persistence")
-		for _, msg := range hrotti.PersistStore.GetAll(c.clientID) {
-			switch msg.(type) {
-			//If the message in the store is a publish packet
-			case *PublishPacket:
-				//It's possible we already sent this message and didn't remove it from the store because we
-				//didn't get an acknowledgement, so set the dup flag to 1. (only for QoS > 0)
-				if msg.(*PublishPacket).Qos > 0 {
-					msg.(*PublishPacket).Dup = true
-				}
-				c.outboundMessages <- msg.(*PublishPacket)
-			//If it's something else like a PUBACK etc send it to the priority outbound channel
-			default:
-				c.outboundPriority <- msg
-			}
-		}
+		hrotti.saveSession(c)
 	}
 
 	//Prepare and write the CONNACK packet.
 	ca := NewControlPacket(CONNACK).(*ConnackPacket)
 	ca.ReturnCode = CONN_ACCEPTED
+	//in MQTT 3.1.1 the first byte is the session present flag, MQTT 3.1 has no such flag
+	if c.sessionPresent && cp.ProtocolName == "MQTT" {
+		ca.TopicNameCompression = 1
+	}
 	ca.Write(c.conn)
+	hrotti.stats.packetSent(ca)
 	//Receive and Send are part of this WaitGroup, so add 2 to the waitgroup and run the goroutines.
 	c.Add(2)
 	go c.Receive(hrotti)
 	go c.Send(hrotti)
+	if resending {
+		c.Add(1)
+		go c.redeliver(hrotti)
+	}
 	c.state.SetValue(CONNECTED)
+	clientID, username, remoteAddr, cleanSession := c.clientID, c.username, c.remoteAddr, c.cleanSession
+	hrotti.callHook(clientID, func(hooks Hooks) { hooks.OnConnect(clientID, username, remoteAddr, cleanSession) })
+	hrotti.publishPresence(clientID, true)
 	//If keepalive value was set run the keepalive time and add 1 to the waitgroup.
 	if c.keepAlive > 0 {
 		c.Add(1)
@@ -187,6 +243,188 @@ func (c *Client) Start(cp *ConnectPacket, hrotti *Hrotti) {
 	}
 }
 
+//connecting marks the client as connecting with cp. Messages delivered from then on are
+//queued for the new connection, except that a durable session resends any messages still
+//inflight first and until they have all been queued new messages for it are only persisted,
+//or held if they are QoS 0, so they are sent after them.
+func (c *Client) connecting(cp *ConnectPacket) {
+	c.deliverMu.Lock()
+	defer c.deliverMu.Unlock()
+	c.resending = !cp.CleanSession
+	c.state.SetValue(CONNECTING)
+}
+
+//deliver queues msg for the client, QoS 1 and 2 messages are persisted first so they are
+//sent when the client reconnects if it isn't connected or its queue is full. Everything
+//queued for a client goes through deliverMu so messages keep the order they were
+//delivered in. The error is from persisting the message, it is still queued.
+func (c *Client) deliver(msg *PublishPacket, hrotti *Hrotti) error {
+	c.deliverMu.Lock()
+	defer c.deliverMu.Unlock()
+	if c.retainedStream != nil {
+		c.retainedStream.overtake(msg.TopicName)
+	}
+	return c.deliverLocked(msg, hrotti)
+}
+
+//deliverRouted is deliver for a message that was routed to the client when the subscriptionMap
+//was at version. If the client has unsubscribed since then the message is only delivered if
+//it still has a subscription matching it.
+func (c *Client) deliverRouted(msg *PublishPacket, hrotti *Hrotti, version uint64) error {
+	c.deliverMu.Lock()
+	defer c.deliverMu.Unlock()
+	if c.unsubscribed > version && !hrotti.subs.subscribed(c.clientID, msg.TopicName) {
+		return nil
+	}
+	if c.retainedStream != nil {
+		c.retainedStream.overtake(msg.TopicName)
+	}
+	return c.deliverLocked(msg, hrotti)
+}
+
+//purgeQueued removes the messages matching filter from the client's queue, unless it still
+//has another subscription matching them, must be called with deliverMu held. QoS 1 and 2
+//messages are removed from persistence and their message ids freed.
+func (c *Client) purgeQueued(hrotti *Hrotti, filter string) {
+	filter, _ = splitShared(filter)
+	filterLevels := topicLevels(filter)
+	queued := len(c.outboundMessages)
+	for i := 0; i < queued; i++ {
+		var msg *PublishPacket
+		select {
+		case msg = <-c.outboundMessages:
+		default:
+			//Send has taken the rest
+			return
+		}
+		if match(filterLevels, topicLevels(msg.TopicName)) && !hrotti.subs.subscribed(c.clientID, msg.TopicName) {
+			hrotti.packetsLog.Debug("Removing queued message after unsubscribe", "client", c.clientID, "topic", msg.TopicName)
+			if msg.Qos > 0 && msg.MessageID != 0 {
+				hrotti.PersistStore.DeleteInflight(c.clientID, OUTBOUND, msg.MessageID)
+				c.freeID(msg.MessageID)
+			}
+			continue
+		}
+		//messages are put back in the order they were taken so the queue keeps its order
+		select {
+		case c.outboundMessages <- msg:
+		default:
+			atomic.AddInt64(&c.dropped, 1)
+			hrotti.stats.DroppedMessage()
+			hrotti.discard(DropQueueFull, msg, c.clientID)
+		}
+	}
+}
+
+//deliverLocked is deliver for when deliverMu is already held
+func (c *Client) deliverLocked(msg *PublishPacket, hrotti *Hrotti) error {
+	var err error
+	if msg.Qos > 0 {
+		var queue bool
+		if queue, err = hrotti.storeOutbound(c, msg); !queue {
+			return nil
+		}
+	}
+	switch {
+	case c.state.Value() == DISCONNECTED:
+	case !c.resending:
+		c.enqueue(msg, hrotti)
+	//a QoS 1 or 2 message is persisted so the resend picks it up, a QoS 0 one has to be held
+	case msg.Qos == 0:
+		if len(c.heldQos0) >= cap(c.outboundMessages) {
+			atomic.AddInt64(&c.dropped, 1)
+			hrotti.stats.DroppedMessage()
+			hrotti.discard(DropQueueFull, msg, c.clientID)
+			break
+		}
+		c.heldQos0 = append(c.heldQos0, msg)
+	}
+	return err
+}
+
+//redeliver queues the messages that were inflight when the client last disconnected, in the
+//order they were first delivered, and then any delivered since it reconnected. It blocks
+//rather than dropping them when the client's queue is full, once everything has been queued
+//the QoS 0 messages held meanwhile are queued and new messages are queued directly again.
+func (c *Client) redeliver(hrotti *Hrotti) {
+	defer c.Done()
+	defer c.recoverPanic(hrotti, "redeliver")
+	resent := make(map[uint16]bool)
+	for pass := 0; ; pass++ {
+		c.deliverMu.Lock()
+		ids, pending := c.pendingInflight(hrotti, resent)
+		if len(pending) == 0 {
+			for _, msg := range c.heldQos0 {
+				c.enqueue(msg, hrotti)
+			}
+			c.heldQos0 = nil
+			c.resending = false
+			c.deliverMu.Unlock()
+			return
+		}
+		c.deliverMu.Unlock()
+		if pass == 0 {
+			hrotti.sessionLog.Info("Resending unacknowledged messages", "client", c.clientID, "messages", len(pending))
+		}
+		for i, msg := range pending {
+			resent[ids[i]] = true
+			switch msg := msg.(type) {
+			//It's possible we already sent a message from before the client reconnected and didn't
+			//get an acknowledgement, so set the dup flag.
+			case *PublishPacket:
+				if c.dropExpired(hrotti, msg) {
+					continue
+				}
+				msg.Dup = pass == 0
+				select {
+				case c.outboundMessages <- msg:
+				case <-c.stop:
+					c.dropHeld(hrotti)
+					return
+				}
+			//If it's something else like a PUBREL send it to the priority outbound channel
+			default:
+				select {
+				case c.outboundPriority <- msg:
+				case <-c.stop:
+					c.dropHeld(hrotti)
+					return
+				}
+			}
+		}
+	}
+}
+
+//dropHeld discards the QoS 0 messages held for a client that stopped before its resend finished
+func (c *Client) dropHeld(hrotti *Hrotti) {
+	c.deliverMu.Lock()
+	defer c.deliverMu.Unlock()
+	for _, msg := range c.heldQos0 {
+		hrotti.discard(DropSessionEnded, msg, c.clientID)
+	}
+	c.heldQos0 = nil
+}
+
+//pendingInflight returns the outbound inflight messages that haven't been resent, oldest first
+func (c *Client) pendingInflight(hrotti *Hrotti, resent map[uint16]bool) ([]uint16, []ControlPacket) {
+	messages := make(map[uint16]ControlPacket)
+	var ids []uint16
+	//inbound QoS 2 messages are waiting for the client to resend its PUBREL
+	hrotti.PersistStore.RangeInflight(c.clientID, func(direction dirFlag, msgID uint16, msg ControlPacket) bool {
+		if direction == OUTBOUND && !resent[msgID] {
+			ids = append(ids, msgID)
+			messages[msgID] = msg
+		}
+		return true
+	})
+	c.sortByAge(ids)
+	pending := make([]ControlPacket, len(ids))
+	for i, id := range ids {
+		pending[i] = messages[id]
+	}
+	return ids, pending
+}
+
 func validateclientID(clientID string) bool {
 	return true
 }
@@ -205,6 +443,10 @@ func (c *Client) ResetTimer() {
 func (c *Client) Receive(hrotti *Hrotti) {
 	//part of the client waitgroup so call Done() when the function returns.
 	defer c.Done()
+	defer c.recoverPanic(hrotti, "receive")
+	//the connection's packets are read into pooled buffers rather than one allocated for each
+	reader := NewReader(c.conn)
+	acked := newRecentAcks(hrotti.DuplicateWindow)
 	//loop forever...
 	for {
 		select {
@@ -249,10 +491,28 @@ func (c *Client) Receive(hrotti *Hrotti) {
 			//we've recevied the message.
 			c.ResetTimer()
 			//switch on the type of message we've received*/
-			cp, err := ReadPacket(c.conn)
+			if !c.waitToReceive(hrotti) {
+				return
+			}
+			cp, err := reader.ReadPacket(hrotti.maxPacketSize())
 			if err != nil {
-				ERROR.Println(err.Error(), c.clientID)
-				go c.Stop(true, hrotti)
+				c.closeLater(hrotti, closeNetworkError, "read error: "+err.Error())
+				return
+			}
+			hrotti.stats.packetReceived(cp)
+			c.stats.packetReceived(cp)
+			hrotti.fixInbound(c.listenerConfig, cp, c.clientID, c.remoteAddr)
+			//a packet breaking the protocol, such as a second CONNECT or one with the wrong
+			//fixed header flags, closes the client (send will) and returns.
+			if err = ValidateInbound(cp, true); err != nil {
+				c.closeLater(hrotti, closeProtocolError, err.Error())
+				return
+			}
+			//as is a topic over the topic limits, unless the listener is permissive, it is
+			//checked before anything splits the topic into levels
+			overLimits := ValidateTopicLimits(cp, hrotti.topicLimits())
+			if overLimits != nil && !c.listenerConfig.permissive() {
+				c.closeLater(hrotti, closeProtocolError, overLimits.Error())
 				return
 			}
 
@@ -260,33 +520,147 @@ func (c *Client) Receive(hrotti *Hrotti) {
 			c.ResetTimer()
 
 			switch cp.(type) {
-			//a second CONNECT packet is a protocol violation, so Stop (send will) and return.
-			case *ConnectPacket:
-				ERROR.Println("Received second CONNECT from", c.clientID)
-				go c.Stop(true, hrotti)
-				return
-			//client wishes to disconnect so Stop (don't send will) and return.
+			//client wishes to disconnect so close the client (don't send will) and return.
 			case *DisconnectPacket:
-				INFO.Println("Received DISCONNECT from", c.clientID)
-				go c.Stop(false, hrotti)
+				c.closeLater(hrotti, closeDisconnect, "")
 				return
 			//client has sent us a PUBLISH message, unpack it persist (if QoS > 0) in the inbound store
 			case *PublishPacket:
 				pp := cp.(*PublishPacket)
-				PROTOCOL.Println("Received PUBLISH from", c.clientID, pp.TopicName)
-				if pp.Qos > 0 {
-					hrotti.PersistStore.Add(c.clientID, INBOUND, pp)
+				if hrotti.packetsLog.enabled(LogTrace) {
+					hrotti.packetsLog.Trace("Received PUBLISH", "client", c.clientID, "topic", pp.TopicName, "qos", pp.Qos, "id", pp.MessageID)
 				}
-				//if this message has the retained flag set then set as the retained message for the
-				//appropriate node in the topic tree
-				if pp.Retain {
-					hrotti.subs.SetRetained(pp.TopicName, pp)
+				hrotti.received(pp)
+				pp.Publisher = c.clientID
+				//a rewritten topic is used for everything after this, the ACL, policies, hooks,
+				//retained messages and routing, as if the client had published to it
+				if overLimits == nil {
+					pp.TopicName = hrotti.rewriteTopic(c, pp.TopicName, false)
+				}
+				//a message from a remote bridge has crossed a bridge to get here, MQTT 3.1.1 can't
+				//tell us how many it crossed before that
+				if c.bridge {
+					pp.Hops = 1
+				}
+				if c.limiter != nil {
+					switch c.limiter.limit(c, pp) {
+					case rateDrop:
+						hrotti.packetsLog.Debug("Dropped PUBLISH over rate limit", "client", c.clientID, "topic", pp.TopicName)
+						hrotti.discard(DropRateLimited, pp, "")
+						continue
+					case rateDisconnect:
+						c.closeLater(hrotti, closeProtocolError, "over its rate limit too many times")
+						return
+					}
+					//the delay could be longer than the keepalive
+					c.ResetTimer()
+				}
+				//QoS 1 messages are acknowledged straight away, a QoS 2 message is kept until
+				//the client's PUBREL. If the client resends a QoS 2 message because it didn't get
+				//our PUBREC it has already been delivered, so it is only acknowledged again, as is
+				//a QoS 1 message resent with Dup set whose PUBACK was recently sent.
+				//A message id is in use until the QoS 2 message sent with it has been released, so a
+				//QoS 2 message with the id is only the same message being resent if it has dup set
+				//and the same payload, anything else reusing the id breaks the protocol.
+				hash, open := c.inboundQos2[pp.MessageID]
+				if open && (pp.Qos != 2 || !pp.Dup || hash != payloadHash(pp.Payload)) {
+					c.closeLater(hrotti, closeProtocolError, fmt.Sprintf("reused message id %d of an unreleased QoS 2 message", pp.MessageID))
+					return
+				}
+				duplicate := open || pp.Qos == 1 && pp.Dup && acked.contains(pp.MessageID)
+				//a client can only have ReceiveMaximum QoS 1 and 2 messages unacknowledged
+				if pp.Qos > 0 && !duplicate && c.overReceiveMaximum(hrotti) {
+					c.closeLater(hrotti, closeProtocolError, "over its receive maximum")
+					return
+				}
+				//The PUBACK or PUBREC is the broker taking over the message, the publisher won't
+				//send it again, so it is only sent once the message has been enqueued for every
+				//matching connected subscriber and persisted for every disconnected session and
+				//as the retained message. A QoS 2 message is recorded as received after that and
+				//just before the PUBREC, a record made before routing would survive a crash that
+				//lost the routed copies and the resent message would be taken as a duplicate. If
+				//anything can't be persisted the client is disconnected without its ack and
+				//sends the message again when it reconnects, so it may be delivered twice but
+				//is never lost.
+				switch {
+				case duplicate:
+					hrotti.packetsLog.Debug("Received duplicate PUBLISH", "client", c.clientID, "qos", pp.Qos, "id", pp.MessageID)
+				//on a permissive listener a message over the topic limits is acknowledged and dropped
+				case overLimits != nil:
+					hrotti.packetsLog.Warn("Dropped PUBLISH over the topic limits", "client", c.clientID, "err", overLimits)
+					hrotti.discard(DropTopicLimits, pp, "")
+				//a message the client's ACL doesn't allow is still acknowledged but goes nowhere
+				case !c.canPublish(pp.TopicName):
+					hrotti.packetsLog.Warn("PUBLISH denied by ACL", "client", c.clientID, "username", c.username, "topic", pp.TopicName)
+					if c.publishDenied(hrotti, pp) {
+						c.closeLater(hrotti, closeProtocolError, "published outside its ACL too many times")
+						return
+					}
+				//a bridge asking for the retained messages for its topics, this is handled by the
+				//broker and not routed to subscribers
+				case pp.TopicName == RetainedSyncRequestTopic:
+					hrotti.startRetainedSync(c, pp.Payload)
+				default:
+					//the topic's policy can drop the message or deliver it at a lower QoS, it is
+					//still acknowledged at the QoS the client sent it with
+					delivery, disconnect := hrotti.applyTopicPolicy(c, pp)
+					if disconnect {
+						c.closeLater(hrotti, closeProtocolError, "broke the policy for topic "+pp.TopicName)
+						return
+					}
+					if delivery == nil {
+						break
+					}
+					//the hooks can drop the message or publish it to a different topic
+					topic, ok := hrotti.publishHook(c, delivery)
+					if !ok {
+						hrotti.packetsLog.Debug("PUBLISH dropped by OnPublish", "client", c.clientID, "topic", delivery.TopicName)
+						break
+					}
+					message := hrotti.ingest(topic, delivery)
+					//a message mirrored to another system is committed there before the broker takes
+					//it over, one that isn't is resent by the client if it is QoS 1 or 2
+					if err := hrotti.commitIngest(c, message); err != nil {
+						if pp.Qos > 0 {
+							c.closeLater(hrotti, closeServerError, "message not ingested: "+err.Error())
+							return
+						}
+						hrotti.discard(DropIngestFailed, delivery, "")
+						break
+					}
+					//if this message has the retained flag set then set as the retained message for the
+					//appropriate node in the topic tree, a message over the retained limits can be rejected
+					if message.Retain {
+						retained, err := hrotti.setRetained(message)
+						if err != nil && pp.Qos > 0 {
+							c.closeLater(hrotti, closeServerError, "failed to persist retained message: "+err.Error())
+							return
+						}
+						if !retained {
+							break
+						}
+					}
+					//go and deliver the message to any subscribers, this is done before reading the
+					//next packet so the client's messages are delivered in the order it sent them
+					if err := hrotti.route(message, c); err != nil && pp.Qos > 0 {
+						c.closeLater(hrotti, closeServerError, "failed to persist message: "+err.Error())
+						return
+					}
+				}
+				if pp.Qos == 2 && !duplicate {
+					if err := hrotti.PersistStore.StoreInflight(c.clientID, INBOUND, pp.MessageID, pp); err != nil {
+						c.closeLater(hrotti, closeServerError, "failed to persist message: "+err.Error())
+						return
+					}
+					c.inboundQos2[pp.MessageID] = payloadHash(pp.Payload)
+					c.inboundChanged()
 				}
-				//go and deliver the message to any subscribers.
-				go hrotti.DeliverMessage(pp.TopicName, pp)
 				//if the message was QoS1 or QoS2 start the acknowledgement flows.
 				switch pp.Qos {
 				case 1:
+					if !duplicate {
+						acked.add(pp.MessageID)
+					}
 					pa := NewControlPacket(PUBACK).(*PubackPacket)
 					pa.MessageID = pp.MessageID
 					c.HandleFlow(pa, hrotti)
@@ -301,10 +675,10 @@ func (c *Client) Receive(hrotti *Hrotti) {
 				//Check that we also think this message id is in use, if it is remove the original
 				//PUBLISH from the outbound persistence store and set the message id as free for reuse
 				if c.inUse(pa.MessageID) {
-					hrotti.PersistStore.Delete(c.clientID, OUTBOUND, pa.UUID())
-					c.freeID(pa.MessageID)
+					hrotti.PersistStore.DeleteInflight(c.clientID, OUTBOUND, pa.MessageID)
+					c.ackID(pa.MessageID)
 				} else {
-					ERROR.Println("Received a PUBACK for unknown msgid", pa.MessageID, "from", c.clientID)
+					hrotti.packetsLog.Warn("Received PUBACK for unknown message id", "client", c.clientID, "id", pa.MessageID)
 				}
 			//We received a PUBREC for a QoS2 PUBLISH we sent to the client.
 			case *PubrecPacket:
@@ -316,13 +690,15 @@ func (c *Client) Receive(hrotti *Hrotti) {
 					prel.MessageID = pr.MessageID
 					c.HandleFlow(prel, hrotti)
 				} else {
-					ERROR.Println("Received a PUBREC for unknown msgid", pr.MessageID, "from", c.clientID)
+					hrotti.packetsLog.Warn("Received PUBREC for unknown message id", "client", c.clientID, "id", pr.MessageID)
 				}
 			//We received a PUBREL for a QoS2 PUBLISH from the client, hrotti delivers on PUBLISH though
 			//so we've already sent the original message to any subscribers, so just create a new
 			//PUBCOMP message with the correct message id and pass it to the HandleFlow function.
 			case *PubrelPacket:
 				pr := cp.(*PubrelPacket)
+				delete(c.inboundQos2, pr.MessageID)
+				c.inboundChanged()
 				pc := NewControlPacket(PUBCOMP).(*PubcompPacket)
 				pc.MessageID = pr.MessageID
 				c.HandleFlow(pc, hrotti)
@@ -332,35 +708,53 @@ func (c *Client) Receive(hrotti *Hrotti) {
 			case *PubcompPacket:
 				pc := cp.(*PubcompPacket)
 				if c.inUse(pc.MessageID) {
-					//hrotti.PersistStore.Delete(c, OUTBOUND, pc.UUID)
-					c.freeID(pc.MessageID)
+					hrotti.PersistStore.DeleteInflight(c.clientID, OUTBOUND, pc.MessageID)
+					c.ackID(pc.MessageID)
 				} else {
-					ERROR.Println("Received a PUBCOMP for unknown msgid", pc.MessageID, "from", c.clientID)
+					hrotti.packetsLog.Warn("Received PUBCOMP for unknown message id", "client", c.clientID, "id", pc.MessageID)
 				}
 			//The client wishes to make a subscription, unpack the message and call AddSubscription with the
 			//requested topics and QoS'. Create a new SUBACK message and put the granted QoS values in it
 			//and send back to the client.
 			case *SubscribePacket:
-				PROTOCOL.Println("Received SUBSCRIBE from", c.clientID)
+				hrotti.packetsLog.Trace("Received SUBSCRIBE", "client", c.clientID)
 				sp := cp.(*SubscribePacket)
-				rQos := hrotti.AddSubscription(c, sp.Topics, sp.Qoss)
+				//a filter over the topic limits is refused by addSubscription, it isn't rewritten
+				for i, topic := range sp.Topics {
+					if hrotti.topicLimits().Check(topic) == nil {
+						sp.Topics[i] = hrotti.rewriteTopic(c, topic, true)
+					}
+				}
+				rQos, disconnect := hrotti.addSubscription(c, sp.Topics, sp.Qoss)
+				if disconnect {
+					c.closeLater(hrotti, closeProtocolError, "over the subscription limits")
+					return
+				}
+				hrotti.callHook(c.clientID, func(hooks Hooks) { hooks.OnSubscribe(c.clientID, sp.Topics, rQos) })
 				sa := NewControlPacket(SUBACK).(*SubackPacket)
 				sa.MessageID = sp.MessageID
 				sa.GrantedQoss = append(sa.GrantedQoss, rQos...)
-				c.outboundPriority <- sa
+				c.queueControl(sa)
 			//The client wants to unsubscribe from a topic.
 			case *UnsubscribePacket:
-				PROTOCOL.Println("Received UNSUBSCRIBE from", c.clientID)
+				hrotti.packetsLog.Trace("Received UNSUBSCRIBE", "client", c.clientID)
 				up := cp.(*UnsubscribePacket)
-				hrotti.RemoveSubscription(c, up.Topics[0])
+				//every filter is removed before the UNSUBACK is queued, unsubscribing from a filter
+				//the client doesn't have is still acknowledged
+				for _, topic := range up.Topics {
+					//there can't be a subscription to a filter over the topic limits
+					if hrotti.topicLimits().Check(topic) == nil {
+						hrotti.RemoveSubscription(c, hrotti.rewriteTopic(c, topic, true))
+					}
+				}
 				ua := NewControlPacket(UNSUBACK).(*UnsubackPacket)
 				ua.MessageID = up.MessageID
-				c.outboundPriority <- ua
+				c.queueControl(ua)
 			//As part of the keepalive if the client doesn't have any messages to send us for as long as the
 			//keepalive period it will send a ping request, so we send a ping response back
 			case *PingreqPacket:
 				presp := NewControlPacket(PINGRESP).(*PingrespPacket)
-				c.outboundPriority <- presp
+				c.queueControl(presp)
 			}
 		}
 	}
@@ -368,51 +762,263 @@ func (c *Client) Receive(hrotti *Hrotti) {
 
 func (c *Client) HandleFlow(msg ControlPacket, hrotti *Hrotti) {
 	switch msg.(type) {
+	//the PUBREL replaces the PUBLISH it is for as it has the same message id
 	case *PubrelPacket:
-		hrotti.PersistStore.Replace(c.clientID, OUTBOUND, msg)
-	case *PubackPacket, *PubcompPacket:
-		hrotti.PersistStore.Delete(c.clientID, INBOUND, msg.UUID())
+		hrotti.PersistStore.StoreInflight(c.clientID, OUTBOUND, msg.Details().MessageID, msg)
+	case *PubcompPacket:
+		hrotti.PersistStore.DeleteInflight(c.clientID, INBOUND, msg.Details().MessageID)
 	}
-	//send to channel if open, silently drop if channel closed
+	if c.queueControl(msg) {
+		switch msg.(type) {
+		case *PubackPacket, *PubcompPacket:
+			c.ackQueued()
+		}
+	}
+}
+
+//queueControl puts msg on the client's control lane, outboundPriority, which Send drains
+//ahead of the messages queued for the client. Rather than drop an acknowledgement, which
+//the client would time out waiting for and retransmit, it waits for room so a client that
+//isn't reading its acknowledgements stops being read from. It returns false if the client
+//is stopped first.
+func (c *Client) queueControl(msg ControlPacket) bool {
 	select {
 	case c.outboundPriority <- msg:
+		return true
+	case <-c.stop:
+		return false
+	}
+}
+
+//enqueue puts msg on the client's outbound queue, it never blocks so a slow client can't
+//stall the fan-out of messages to other clients. If the queue is full the message is
+//dropped and counted, and depending on the SlowConsumerPolicy the client is disconnected
+//once its queue has been full for longer than the grace period.
+func (c *Client) enqueue(msg *PublishPacket, hrotti *Hrotti) bool {
+	select {
+	case c.outboundMessages <- msg:
+		atomic.StoreInt64(&c.fullSince, 0)
+		return true
 	default:
 	}
+	atomic.AddInt64(&c.dropped, 1)
+	hrotti.stats.DroppedMessage()
+	hrotti.discard(DropQueueFull, msg, c.clientID)
+	hrotti.sessionLog.Debug("Outbound queue full, dropping message", "client", c.clientID, "topic", msg.TopicName)
+	if hrotti.SlowConsumerPolicy == DisconnectSlowConsumer {
+		now := hrotti.Clock.Now().UnixNano()
+		atomic.CompareAndSwapInt64(&c.fullSince, 0, now)
+		if time.Duration(now-atomic.LoadInt64(&c.fullSince)) >= hrotti.SlowConsumerGrace {
+			c.closeLater(hrotti, closeSlowConsumer, "")
+		}
+	}
+	return false
+}
+
+//queueDepth is the number of packets waiting to be written to the client
+func (c *Client) queueDepth() int {
+	return len(c.outboundMessages) + len(c.outboundPriority)
+}
+
+//writeBatchBytes is the size of each client's write buffer, a batch larger than this is
+//written as the buffer fills
+func (h *Hrotti) writeBatchBytes() int {
+	if h.WriteBatchBytes > 0 {
+		return h.WriteBatchBytes
+	}
+	return defaultWriteBatchBytes
 }
 
 func (c *Client) Send(hrotti *Hrotti) {
 	//Send is part of the client waitgroup so call Done when the function returns.
 	defer c.Done()
+	defer c.recoverPanic(hrotti, "send")
+	//packets are written to a buffered writer of WriteBatchBytes and only flushed to the
+	//network when there is nothing else waiting to be sent, or WriteBatchPackets have been
+	//written, so a burst of packets goes out in fewer writes. With a WriteBatchDelay the
+	//flush waits that long for more packets to join the batch.
+	w := bufio.NewWriterSize(c.conn, hrotti.writeBatchBytes())
+	var batched int
+	var delay *time.Timer
+	var flushDue <-chan time.Time
+	for {
+		msg, control, ok := c.nextPacket(hrotti, flushDue)
+		if !ok {
+			c.flushControl(hrotti, w)
+			return
+		}
+		//the batch delay is up
+		if msg == nil {
+			flushDue, batched = nil, 0
+			if err := w.Flush(); err != nil {
+				c.closeLater(hrotti, closeNetworkError, "write error: "+err.Error())
+				return
+			}
+			continue
+		}
+		err := msg.Write(w)
+		switch msg.(type) {
+		case *PubackPacket, *PubcompPacket:
+			c.ackSent()
+		}
+		//nothing is written for a packet too large to encode so the connection is still usable
+		if tooLarge(err) {
+			c.dropTooLarge(hrotti, msg)
+			continue
+		}
+		if err == nil {
+			hrotti.stats.packetSent(msg)
+			c.stats.packetSent(msg)
+			c.sentInflight(hrotti, msg)
+			batched++
+			switch {
+			//a full batch is flushed straight away
+			case hrotti.WriteBatchPackets > 0 && batched >= hrotti.WriteBatchPackets:
+			//control packets are flushed as soon as there are no more of them, rather than
+			//waiting for the client's queue of messages to empty
+			case c.queueDepth() == 0 || (control && len(c.outboundPriority) == 0):
+				if hrotti.WriteBatchDelay > 0 {
+					if flushDue == nil {
+						if delay == nil {
+							delay = time.NewTimer(hrotti.WriteBatchDelay)
+							defer delay.Stop()
+						} else {
+							delay.Reset(hrotti.WriteBatchDelay)
+						}
+						flushDue = delay.C
+					}
+					continue
+				}
+			default:
+				continue
+			}
+			//a tick left over from a timer stopped as it fired only flushes a later batch early
+			if flushDue != nil {
+				delay.Stop()
+			}
+			flushDue, batched = nil, 0
+			err = w.Flush()
+		}
+		if err != nil {
+			c.closeLater(hrotti, closeNetworkError, "write error: "+err.Error())
+			return
+		}
+	}
+}
+
+//tooLarge returns true if err is from writing a packet that can't be encoded, its body is
+//over the maximum remaining length or one of its fields over the maximum field length
+func tooLarge(err error) bool {
+	return err == ErrRemainingLengthTooLarge || err == ErrFieldTooLong
+}
+
+//dropTooLarge drops a packet that can't be encoded, see tooLarge, such as a message
+//published at the maximum size that a QoS 1 delivery's message id takes over it. A QoS 1 or
+//2 message can never be sent so its message id and persisted copy are freed.
+func (c *Client) dropTooLarge(hrotti *Hrotti, msg ControlPacket) {
+	pp, ok := msg.(*PublishPacket)
+	if !ok {
+		hrotti.packetsLog.Error("Dropped packet too large to encode", "client", c.clientID, "type", msg.Type())
+		return
+	}
+	hrotti.packetsLog.Error("Dropped PUBLISH too large to encode", "client", c.clientID, "topic", pp.TopicName, "qos", pp.Qos, "size", len(pp.Payload))
+	hrotti.stats.DroppedMessage()
+	hrotti.discard(DropTooLarge, pp, c.clientID)
+	if pp.Qos > 0 && c.inUse(pp.MessageID) {
+		hrotti.PersistStore.DeleteInflight(c.clientID, OUTBOUND, pp.MessageID)
+		c.freeID(pp.MessageID)
+	}
+}
+
+//nextPacket waits for the next packet to send to the client, control is true if it came
+//from outboundPriority. The client has two lanes, outboundPriority for control packets, the
+//acknowledgements, SUBACKs, UNSUBACKs and PINGRESPs, and outboundMessages for PUBLISHes.
+//Control packets are sent ahead of any queued messages so a client with a long queue
+//doesn't time out its handshakes or PINGREQ and retransmit. A message's acknowledgements
+//can't overtake it as they are only sent once the client has answered it, and resends of an
+//unacknowledged message share the control lane with the PUBREL that replaces it so they stay
+//in order. Messages that expired while queued are dropped. ok is false once the client is
+//stopped, msg is nil if flush fires first.
+func (c *Client) nextPacket(hrotti *Hrotti, flush <-chan time.Time) (msg ControlPacket, control bool, ok bool) {
+	select {
+	case pmsg, open := <-c.outboundPriority:
+		if open {
+			return c.assignControlID(pmsg), true, true
+		}
+	default:
+	}
 	for {
 		//3 way blocking select
 		select {
 		//the stop channel has been closed so we should return
 		case <-c.stop:
-			return
+			return nil, false, false
+		case <-flush:
+			return nil, false, true
 		//the two value receive from a channel tells us whether the channel is closed
 		//as reading from a closed channel always returns the empty value for the channel
-		//type. ok == false means the channel is closed and the msg will be nil
-		case msg, ok := <-c.outboundPriority:
-			if ok {
-				//Message IDs are not assigned until we're ready to send the message
-				switch msg.(type) {
-				case *SubscribePacket:
-					msg.(*SubscribePacket).MessageID = c.getMsgID(msg.UUID())
-				case *UnsubscribePacket:
-					msg.(*UnsubscribePacket).MessageID = c.getMsgID(msg.UUID())
-				}
-				msg.Write(c.conn)
+		//type. open == false means the channel is closed and the msg will be nil
+		case pmsg, open := <-c.outboundPriority:
+			if open {
+				return c.assignControlID(pmsg), true, true
+			}
+		case pp, open := <-c.outboundMessages:
+			if open {
+				c.signalDrained()
 			}
-		case msg, ok := <-c.outboundMessages:
-			//ok == false means we were triggered because the channel
-			//is closed, and the msg will be nil
-			if ok {
-				switch msg.Details().Qos {
-				case 1, 2:
-					msg.MessageID = c.getMsgID(msg.UUID())
+			if open && !c.dropExpired(hrotti, pp) {
+				//persisted messages already have their message id, see storeOutbound
+				if pp.Qos > 0 && pp.MessageID == 0 {
+					pp.MessageID = c.getMsgID(pp.UUID())
 				}
-				msg.Write(c.conn)
+				return pp, false, true
 			}
 		}
 	}
 }
+
+//flushControl writes the control packets still queued when the client is stopped, such as
+//the acknowledgements for the messages a client sent before its DISCONNECT. The connection
+//is being closed so write errors are ignored.
+func (c *Client) flushControl(hrotti *Hrotti, w *bufio.Writer) {
+	for {
+		select {
+		case msg, open := <-c.outboundPriority:
+			if !open {
+				w.Flush()
+				return
+			}
+			if c.assignControlID(msg).Write(w) != nil {
+				return
+			}
+			switch msg.(type) {
+			case *PubackPacket, *PubcompPacket:
+				c.ackSent()
+			}
+			hrotti.stats.packetSent(msg)
+			c.stats.packetSent(msg)
+		default:
+			w.Flush()
+			return
+		}
+	}
+}
+
+//assignControlID gives a SUBSCRIBE or UNSUBSCRIBE its message id, message ids are not
+//assigned until we're ready to send the message
+func (c *Client) assignControlID(pmsg ControlPacket) ControlPacket {
+	switch pmsg.(type) {
+	case *SubscribePacket:
+		pmsg.(*SubscribePacket).MessageID = c.getMsgID(pmsg.UUID())
+	case *UnsubscribePacket:
+		pmsg.(*UnsubscribePacket).MessageID = c.getMsgID(pmsg.UUID())
+	}
+	return pmsg
+}
+
+//payloadHash is the hash of a QoS 2 message's payload kept while it is waiting for its PUBREL
+func payloadHash(payload []byte) uint64 {
+	hash := fnv.New64a()
+	hash.Write(payload)
+	return hash.Sum64()
+}
@@ -1,6 +1,8 @@
 package hrotti
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"sync"
 )
 
@@ -18,3 +20,39 @@ func newClients() *clients {
 	}
 	return c
 }
+
+//snapshot returns the clients currently known to the broker, the Clients themselves are
+//still live so only their own snapshot methods should be used to read them
+func (c *clients) snapshot() []*Client {
+	c.RLock()
+	defer c.RUnlock()
+	list := make([]*Client, 0, len(c.list))
+	for _, client := range c.list {
+		list = append(list, client)
+	}
+	return list
+}
+
+//assignedIDPrefix starts the ids the broker assigns to clients that connect without one
+const assignedIDPrefix = "hrotti-"
+
+//assignID returns a new id for a client that connected with a zero length client id,
+//it must be called with the lock held so the id can't be taken before the client is added
+func (c *clients) assignID() string {
+	b := make([]byte, 8)
+	for {
+		rand.Read(b)
+		id := assignedIDPrefix + hex.EncodeToString(b)
+		if _, ok := c.list[id]; !ok {
+			return id
+		}
+	}
+}
+
+//assigned returns true if id is in use by a client that was assigned its id by the broker
+func (c *clients) assigned(id string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	client, ok := c.list[id]
+	return ok && client.assignedID
+}
@@ -0,0 +1,130 @@
+package hrotti
+
+import (
+	"sync/atomic"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//clientStats are the counters kept for each client. They carry on across the reconnects of
+//a durable session and start again when the client connects with a clean session. The
+//bytes are counted by the client's meteredConn and don't include its CONNECT.
+type clientStats struct {
+	messagesReceived int64
+	messagesSent     int64
+	bytesReceived    int64
+	bytesSent        int64
+	//lastPacket is when the client last sent a packet, in unix nanoseconds
+	lastPacket int64
+	//inboundInflight is the number of QoS 2 messages from the client waiting for its PUBREL,
+	//the Receive goroutine keeps it up to date as only it can use inboundQos2
+	inboundInflight int64
+	//the progress of the retained messages being streamed to the client, see retainedProgress
+	retainedTotal   int64
+	retainedSent    int64
+	retainedSkipped int64
+	retainedPaused  int32
+}
+
+func (s *clientStats) packetReceived(cp ControlPacket) {
+	atomic.StoreInt64(&s.lastPacket, time.Now().UnixNano())
+	if cp.Type() == PUBLISH {
+		atomic.AddInt64(&s.messagesReceived, 1)
+	}
+}
+
+func (s *clientStats) packetSent(cp ControlPacket) {
+	if cp.Type() == PUBLISH {
+		atomic.AddInt64(&s.messagesSent, 1)
+	}
+}
+
+//reset zeroes the counters for a client starting a clean session
+func (s *clientStats) reset() {
+	atomic.StoreInt64(&s.messagesReceived, 0)
+	atomic.StoreInt64(&s.messagesSent, 0)
+	atomic.StoreInt64(&s.bytesReceived, 0)
+	atomic.StoreInt64(&s.bytesSent, 0)
+	atomic.StoreInt64(&s.lastPacket, 0)
+	atomic.StoreInt64(&s.inboundInflight, 0)
+	atomic.StoreInt64(&s.retainedTotal, 0)
+	atomic.StoreInt64(&s.retainedSent, 0)
+	atomic.StoreInt64(&s.retainedSkipped, 0)
+}
+
+//inboundChanged records the number of entries in inboundQos2 for the admin API and $SYS
+func (c *Client) inboundChanged() {
+	atomic.StoreInt64(&c.stats.inboundInflight, int64(len(c.inboundQos2)))
+}
+
+//clientStatsPublisher publishes the stats of every connected client as retained messages
+//under $SYS/broker/clients/<client id>/ every ClientStatsInterval until the broker is stopped
+func (h *Hrotti) clientStatsPublisher() {
+	ticker := time.NewTicker(h.ClientStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.publishClientStats()
+		}
+	}
+}
+
+func (h *Hrotti) publishClientStats() {
+	counts := h.subs.subscriptionCounts()
+	for _, c := range h.clients.snapshot() {
+		if !c.Connected() {
+			continue
+		}
+		info := c.snapshot(counts)
+		prefix := "$SYS/broker/clients/" + c.clientID + "/"
+		h.publishSys(prefix+"messages/received", info.MessagesReceived)
+		h.publishSys(prefix+"messages/sent", info.MessagesSent)
+		h.publishSys(prefix+"bytes/received", info.BytesReceived)
+		h.publishSys(prefix+"bytes/sent", info.BytesSent)
+		h.publishSys(prefix+"queue/depth", int64(info.Queued))
+		h.publishSys(prefix+"queue/dropped", info.Dropped)
+		h.publishSys(prefix+"inflight/inbound", int64(info.InflightInbound))
+		h.publishSys(prefix+"inflight/outbound", int64(info.Inflight))
+		h.publishSys(prefix+"protocol/version", int64(info.ProtocolVersion))
+		h.publishSys(prefix+"connected/at", info.ConnectedAt.Unix())
+		if !info.LastPacketAt.IsZero() {
+			h.publishSys(prefix+"lastpacket/at", info.LastPacketAt.Unix())
+		}
+	}
+}
+
+//snapshot returns the ClientInfo for c, counts are the subscription counts by client id
+func (c *Client) snapshot(counts map[string]int) ClientInfo {
+	c.info.RLock()
+	defer c.info.RUnlock()
+	info := ClientInfo{
+		ClientID:         c.clientID,
+		Connected:        c.Connected(),
+		RemoteAddr:       c.remoteAddr,
+		Listener:         c.listener,
+		Anonymous:        c.anonymous,
+		CleanSession:     c.cleanSession,
+		KeepAlive:        c.keepAlive,
+		ClientKeepAlive:  c.connectKeepAlive,
+		ProtocolVersion:  c.protocolVersion,
+		Subscriptions:    counts[c.clientID],
+		Inflight:         c.inflight(),
+		InflightInbound:  int(atomic.LoadInt64(&c.stats.inboundInflight)),
+		Queued:           c.queueDepth(),
+		Dropped:          atomic.LoadInt64(&c.dropped),
+		MessagesReceived: atomic.LoadInt64(&c.stats.messagesReceived),
+		MessagesSent:     atomic.LoadInt64(&c.stats.messagesSent),
+		BytesReceived:    atomic.LoadInt64(&c.stats.bytesReceived),
+		BytesSent:        atomic.LoadInt64(&c.stats.bytesSent),
+		ConnectedAt:      c.connectedAt,
+		RetainedStream:   c.retainedProgress(),
+	}
+	if last := atomic.LoadInt64(&c.stats.lastPacket); last != 0 {
+		info.LastPacketAt = time.Unix(0, last)
+	}
+	return info
+}
@@ -0,0 +1,73 @@
+package hrotti
+
+import (
+	"time"
+)
+
+//Clock is the time the broker's session timing runs on: keepalives, will delays, retries,
+//message and session expiry and the times clients connected and disconnected. The default
+//is the system clock, a test can set Hrotti.Clock to one it moves on itself so timeouts of
+//minutes happen at once, and happen at exactly the time they are due. Network deadlines,
+//such as the ConnectTimeout and flushing a closing connection, are always on the system
+//clock as the network is.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+	//After is NewTimer(d).C() for a timer that is never stopped
+	After(d time.Duration) <-chan time.Time
+	//AfterFunc calls f in its own goroutine after d, unless the returned timer is stopped
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+//Timer is a time.Timer from a Clock
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+//Ticker is a time.Ticker from a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+//systemClock is the Clock of the time package
+type systemClock struct{}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
@@ -1,32 +1,90 @@
 package hrotti
 
 import (
-	"io/ioutil"
-	"log"
+	"crypto/x509"
+	"net"
 	"net/url"
-)
+	"time"
 
-//loggers
-var (
-	INFO     *log.Logger
-	PROTOCOL *log.Logger
-	ERROR    *log.Logger
-	DEBUG    *log.Logger
+	. "github.com/alsm/hrotti/packets"
 )
 
-//The default output for all the loggers is set to ioutil.Discard
-func init() {
-	INFO = log.New(ioutil.Discard, "", 0)
-	PROTOCOL = log.New(ioutil.Discard, "", 0)
-	ERROR = log.New(ioutil.Discard, "", 0)
-	DEBUG = log.New(ioutil.Discard, "", 0)
+//ListenerConfig is a struct containing a URL, the scheme is tcp, ws, tls (or ssl) or wss.
+//tls and wss listeners use the certificate and key in CertFile and KeyFile. If
+//MaxConnections is set connections over that number are closed as soon as they are
+//accepted. AcceptRate limits how many connections a second are accepted, with a burst of a
+//second's worth, the others wait in the listen backlog so a reconnect storm after a restart
+//is spread out rather than refused. With ProxyProtocol set every connection has to start
+//with a PROXY protocol v1 or v2 header, as sent by load balancers such as HAProxy, and the
+//client's address is taken from the header.
+//
+//A tls or wss listener with a CAFile requires clients to have a certificate signed by one
+//of the CAs in it. If UseIdentityFromCert is set the client's username is taken from its
+//certificate instead of the CONNECT and the password isn't checked, CertIdentity picks
+//which part of the certificate, "cn" (the default) for the Common Name or "dns", "email"
+//or "uri" for the first Subject Alternative Name of that type. Any username and password
+//in the CONNECT are ignored, or the client is refused if RejectCredentials is set.
+//
+//Auth and Authenticator replace the Hrotti's for clients connecting to this listener, so
+//an internal listener can allow anonymous access while a public one requires credentials
+//and restricts each user's topics.
+type ListenerConfig struct {
+	URL                 *url.URL
+	MaxConnections      int
+	AcceptRate          float64
+	CertFile            string
+	KeyFile             string
+	ProxyProtocol       bool
+	CAFile              string
+	UseIdentityFromCert bool
+	CertIdentity        string
+	RejectCredentials   bool
+	Auth                *Auth
+	Authenticator       Authenticator
+	//TopicRewrites are applied to the topics of the listener's clients before the broker's
+	TopicRewrites []*TopicRewrite
+	//TCP tunes the listener's connections, see TCPOptions
+	TCP TCPOptions
+	//CRLFile has the CRLs, signed by a certificate in the CAFile, whose revoked client
+	//certificates are refused. DeniedFingerprints are refused too and, if there are any
+	//AllowedFingerprints, only those are accepted. Fingerprints are as CertFingerprint
+	//returns. They are checked at the end of the TLS handshake and Reload applies them.
+	CRLFile             string
+	DeniedFingerprints  []string
+	AllowedFingerprints []string
+	//Permissive keeps the connections of clients that break the spec in the ways in Fixups,
+	//all of them if it is empty, the packets are corrected and the violations logged and
+	//counted. Otherwise the listener is strict and closes the connection of a client that
+	//breaks the spec.
+	Permissive bool
+	Fixups     []Fixup
 }
 
-//ListenerConfig is a struct containing a URL
-type ListenerConfig struct {
-	URL *url.URL
+//permissive returns true if the listener keeps the connections of clients that break the spec
+func (l *ListenerConfig) permissive() bool {
+	return l != nil && l.Permissive
 }
 
+//fixups returns the Fixups applied to the packets from the listener's clients, none unless
+//it is permissive
+func (l *ListenerConfig) fixups() []Fixup {
+	if !l.permissive() {
+		return nil
+	}
+	if len(l.Fixups) == 0 {
+		return allFixups
+	}
+	return l.Fixups
+}
+
+var allFixups = func() []Fixup {
+	fixups := make([]Fixup, NumFixups)
+	for i := range fixups {
+		fixups[i] = Fixup(i)
+	}
+	return fixups
+}()
+
 //NewListenerConfig returns a pointer to a ListenerConfig prepared to listen
 //on the URL specified as rawURL
 func NewListenerConfig(rawURL string) *ListenerConfig {
@@ -37,3 +95,127 @@ func NewListenerConfig(rawURL string) *ListenerConfig {
 	l := &ListenerConfig{URL: listenerURL}
 	return l
 }
+
+//identify replaces the credentials in cp with the identity from the client's certificate,
+//certs is the client's verified chain
+func (l *ListenerConfig) identify(cp *ConnectPacket, certs []*x509.Certificate) byte {
+	if l.RejectCredentials && (cp.UsernameFlag || cp.PasswordFlag) {
+		return CONN_REF_BAD_USER_PASS
+	}
+	if len(certs) == 0 {
+		return CONN_REF_NOT_AUTH
+	}
+	var identity string
+	cert := certs[0]
+	switch l.CertIdentity {
+	case "", "cn":
+		identity = cert.Subject.CommonName
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			identity = cert.DNSNames[0]
+		}
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			identity = cert.EmailAddresses[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			identity = cert.URIs[0].String()
+		}
+	}
+	if identity == "" {
+		return CONN_REF_NOT_AUTH
+	}
+	cp.Username, cp.UsernameFlag = identity, true
+	cp.Password, cp.PasswordFlag = nil, false
+	return CONN_ACCEPTED
+}
+
+//defaultConnectTimeout is how long a new connection has to send its CONNECT
+const defaultConnectTimeout = 10 * time.Second
+
+//defaultDuplicateWindow is how many of the QoS 1 message ids each connection acknowledged
+//most recently are kept to spot the client resending a message
+const defaultDuplicateWindow = 16
+
+//defaultMatchCacheSize is how many topics the subscriptions matching them are cached for
+const defaultMatchCacheSize = 10000
+
+//defaultMaxBridgeHops is how many bridges a message can cross, so a message that came in
+//over a bridge isn't sent out over another
+const defaultMaxBridgeHops = 1
+
+//defaultWriteBatchBytes is the size of each client's write buffer when WriteBatchBytes isn't
+//set, the same as bufio's default
+const defaultWriteBatchBytes = 4096
+
+//SlowConsumerPolicy is what the broker does when a message is delivered to a client
+//whose outbound queue is full
+type SlowConsumerPolicy int
+
+const (
+	//DropMessages drops the message and counts it in the stats, QoS 1 and 2 messages
+	//are still persisted and sent when the client next reconnects
+	DropMessages SlowConsumerPolicy = iota
+	//DisconnectSlowConsumer drops the message as above, but if the client's queue is
+	//still full after SlowConsumerGrace the client is disconnected
+	DisconnectSlowConsumer
+)
+
+//ClientProfile is a set of options applied to any client whose client id starts
+//with ClientIDPrefix, an empty prefix matches every client. SuppressEcho stops a
+//client receiving its own publishes, the same as subscribing with the v5 NoLocal
+//option, and RetainHandling is the v5 Retain Handling option for all of the client's
+//subscriptions, for clients that can't set them themselves.
+type ClientProfile struct {
+	ClientIDPrefix string         `json:"clientIdPrefix"`
+	SuppressEcho   bool           `json:"suppressEcho"`
+	RetainHandling RetainHandling `json:"retainHandling"`
+}
+
+//Auth is the broker wide authentication, a client has to connect with the username and
+//password of one of Users, which are either the password or a hash of it from HashPassword. Clients that don't send a username are only allowed if
+//AllowAnonymous is set. When the Hrotti's Auth is nil every client is allowed.
+type Auth struct {
+	AllowAnonymous bool
+	Users          map[string]string
+	//RateLimits are the rate limits for particular usernames, they override the Hrotti's RateLimit
+	RateLimits map[string]*RateLimit
+	//ACLs restrict the topics particular usernames can use, anonymous clients use the ACL
+	//for "". A username without an ACL can use every topic.
+	ACLs map[string]*ACL
+	//Quotas are the quotas of particular usernames, anonymous clients use the Quota for ""
+	Quotas map[string]*Quota
+}
+
+//Authenticator authenticates clients against something other than the users in Auth, it
+//is called for each CONNECT that Auth accepts with details of the connection it arrived on
+//and returns the CONNACK return code.
+type Authenticator interface {
+	Authenticate(cp *ConnectPacket, conn ConnectionInfo) byte
+}
+
+//ConnectionInfo is what an Authenticator is told about a client's connection. Listener is
+//the name of the listener it connected to, RemoteAddr is the address the client connected
+//from and Certificates is the verified chain of the client's certificate, starting with the
+//client's own, on a listener with a CAFile.
+type ConnectionInfo struct {
+	Listener     string
+	RemoteAddr   net.Addr
+	Certificates []*x509.Certificate
+}
+
+//authenticate returns the CONNACK return code for the credentials in cp
+func (a *Auth) authenticate(cp *ConnectPacket) byte {
+	if !cp.UsernameFlag {
+		if a.AllowAnonymous {
+			return CONN_ACCEPTED
+		}
+		return CONN_REF_NOT_AUTH
+	}
+	password, ok := a.Users[cp.Username]
+	if !ok || !checkPassword(password, cp.Password) {
+		return CONN_REF_BAD_USER_PASS
+	}
+	return CONN_ACCEPTED
+}
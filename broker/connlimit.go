@@ -0,0 +1,99 @@
+package hrotti
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+	"golang.org/x/net/websocket"
+)
+
+//ConnectionLimitPolicy is what the broker does with a connection over its MaxConnections
+//or MaxConnectionsPerIP
+type ConnectionLimitPolicy int
+
+const (
+	//CloseConnection closes the connection as soon as it is accepted
+	CloseConnection ConnectionLimitPolicy = iota
+	//ConnackServerUnavailable reads the client's CONNECT and answers it with a CONNACK
+	//with the server unavailable return code before closing the connection, some clients
+	//back off better when they are told why
+	ConnackServerUnavailable
+)
+
+//connectionCounter counts the broker's open connections, in total and from each IP
+//address. A connection is counted from when it is accepted until it is closed, whatever
+//closes it.
+type connectionCounter struct {
+	sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newConnectionCounter() *connectionCounter {
+	return &connectionCounter{perIP: make(map[string]int)}
+}
+
+//open counts a new connection from ip, unless it would take the total over max or the
+//connections from ip over maxPerIP, a limit of 0 is no limit
+func (cc *connectionCounter) open(ip string, max int, maxPerIP int) bool {
+	cc.Lock()
+	defer cc.Unlock()
+	if (max > 0 && cc.total >= max) || (maxPerIP > 0 && cc.perIP[ip] >= maxPerIP) {
+		return false
+	}
+	cc.total++
+	cc.perIP[ip]++
+	return true
+}
+
+func (cc *connectionCounter) close(ip string) {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.total--
+	if cc.perIP[ip]--; cc.perIP[ip] <= 0 {
+		delete(cc.perIP, ip)
+	}
+}
+
+func (cc *connectionCounter) count() int {
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.total
+}
+
+//remoteIP is the IP address conn is from, for a connection through a PROXY protocol
+//load balancer it is the client's address from the PROXY header
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	//a websocket connection's RemoteAddr is its Origin, the address is in the request
+	if ws, ok := conn.(*websocket.Conn); ok {
+		addr = ws.Request().RemoteAddr
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+//refuseConnection closes a connection over the connection limits, answering its CONNECT
+//first if the ConnectionLimitPolicy says to
+func (h *Hrotti) refuseConnection(conn net.Conn, ip string) {
+	defer conn.Close()
+	h.listenerLog.Warn("Connection limit reached, refusing connection", "addr", conn.RemoteAddr(), "ip", ip)
+	h.stats.connectResult(CONN_REF_SERV_UNAVAIL)
+	if h.ConnectionLimitPolicy != ConnackServerUnavailable {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(h.ConnectTimeout))
+	if rp, err := ReadPacketLimit(conn, h.maxPacketSize()); err != nil {
+		return
+	} else if _, ok := rp.(*ConnectPacket); !ok {
+		return
+	}
+	ca := NewControlPacket(CONNACK).(*ConnackPacket)
+	ca.ReturnCode = CONN_REF_SERV_UNAVAIL
+	ca.Write(conn)
+	h.stats.packetSent(ca)
+}
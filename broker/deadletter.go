@@ -0,0 +1,216 @@
+package hrotti
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//DropReason is why the broker dropped a message rather than delivering it. Every dropped
+//message is counted by its reason, and the reason is part of the topic it is dead lettered to.
+type DropReason int
+
+const (
+	//DropQueueFull is a message for a client whose outbound queue was full
+	DropQueueFull DropReason = iota
+	//DropInflightFull is a QoS 1 or 2 message for a client that already had MaxInflight
+	//messages unacknowledged, or no free message ids
+	DropInflightFull
+	//DropExpired is a message that wasn't delivered within MessageExpiry
+	DropExpired
+	//DropPolicy is a message that broke its topic's policy
+	DropPolicy
+	//DropDenied is a message published to a topic outside the publisher's ACL
+	DropDenied
+	//DropRateLimited is a QoS 0 message over its publisher's RateLimit
+	DropRateLimited
+	//DropTooLarge is a message too large to encode for a subscriber
+	DropTooLarge
+	//DropTransformFailed is a message whose PayloadTransformer returned an error
+	DropTransformFailed
+	//DropSessionEnded is a message still queued or unacknowledged for a client when its clean
+	//session ended
+	DropSessionEnded
+	//DropIngestFailed is a QoS 0 message its Ingester didn't commit
+	DropIngestFailed
+	//DropTopicLimits is a message from a client on a permissive listener whose topic was over
+	//the topic limits
+	DropTopicLimits
+	//DropQuota is a message for a session whose principal was over its MaxQueuedBytes, or
+	//dropped from a disconnected session to make room for a newer one
+	DropQuota
+	numDropReasons
+)
+
+var dropReasonNames = [numDropReasons]string{
+	DropQueueFull:       "queue-full",
+	DropInflightFull:    "inflight-full",
+	DropExpired:         "expired",
+	DropPolicy:          "policy",
+	DropDenied:          "denied",
+	DropRateLimited:     "rate-limited",
+	DropTooLarge:        "too-large",
+	DropTransformFailed: "transform-failed",
+	DropSessionEnded:    "session-ended",
+	DropIngestFailed:    "ingest-failed",
+	DropTopicLimits:     "topic-limits",
+	DropQuota:           "quota",
+}
+
+func (r DropReason) String() string {
+	if r < 0 || r >= numDropReasons {
+		return "unknown"
+	}
+	return dropReasonNames[r]
+}
+
+//ParseDropReason returns the DropReason called name, as it appears in metrics and dead letter
+//topics, and false if there isn't one
+func ParseDropReason(name string) (DropReason, bool) {
+	for reason, reasonName := range dropReasonNames {
+		if reasonName == name {
+			return DropReason(reason), true
+		}
+	}
+	return 0, false
+}
+
+//DefaultDeadLetterTopic is the prefix of the dead letter topics when DeadLetter.Topic is empty
+const DefaultDeadLetterTopic = "$deadletter"
+
+//deadLetterQueueDepth is how many dead letters can be waiting to be published, more are
+//counted as dropped
+const deadLetterQueueDepth = 1000
+
+//DeadLetter republishes the messages the broker drops so they can be inspected rather than
+//disappearing. A message on topic dropped for a reason is published to
+//Topic/<reason>/<topic> at Qos with its payload and properties, and the user properties
+//reason, topic, publisher, subscriber and received added when they are known. Reasons picks
+//the reasons messages are dead lettered for, all of them if it is empty. So a dead letter
+//subscriber that can't keep up doesn't make more of them, messages on the dead letter topics
+//are never dead lettered themselves, those with more than MaxSize bytes of payload and over
+//Rate a second are only counted, 0 is no limit for either.
+type DeadLetter struct {
+	Topic   string
+	Reasons []DropReason
+	MaxSize int
+	Rate    float64
+	Qos     byte
+}
+
+//deadLetters queues the dead letters for a goroutine to publish, they can't be published
+//where the message is dropped as that can be while delivering to the client it was for
+type deadLetters struct {
+	topic   string
+	maxSize int
+	qos     byte
+	reasons [numDropReasons]bool
+	queue   chan *PublishPacket
+	sync.Mutex
+	bucket *tokenBucket
+}
+
+func newDeadLetters(config *DeadLetter) *deadLetters {
+	d := &deadLetters{
+		topic:   config.Topic,
+		maxSize: config.MaxSize,
+		qos:     config.Qos,
+		queue:   make(chan *PublishPacket, deadLetterQueueDepth),
+		bucket:  newTokenBucket(config.Rate),
+	}
+	if d.topic == "" {
+		d.topic = DefaultDeadLetterTopic
+	}
+	for reason := range d.reasons {
+		d.reasons[reason] = len(config.Reasons) == 0
+	}
+	for _, reason := range config.Reasons {
+		if reason >= 0 && reason < numDropReasons {
+			d.reasons[reason] = true
+		}
+	}
+	return d
+}
+
+//run publishes the dead letters until the broker is stopped
+func (d *deadLetters) run(h *Hrotti) {
+	for {
+		select {
+		case letter := <-d.queue:
+			h.DeliverMessage(letter.TopicName, letter, nil)
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+//isDeadLetter returns true if topic is one of the dead letter topics
+func (d *deadLetters) isDeadLetter(topic string) bool {
+	return topic == d.topic || strings.HasPrefix(topic, d.topic+"/")
+}
+
+//add queues the dead letter for msg, dropped for reason while being delivered to subscriber,
+//which is empty if it was dropped before it was routed
+func (d *deadLetters) add(h *Hrotti, reason DropReason, msg *PublishPacket, subscriber string) {
+	if !d.reasons[reason] || d.isDeadLetter(msg.TopicName) {
+		return
+	}
+	if d.maxSize > 0 && len(msg.Payload) > d.maxSize {
+		h.stats.deadLetterDropped()
+		return
+	}
+	d.Lock()
+	limited := d.bucket.wait(1, time.Now()) > 0
+	if !limited {
+		d.bucket.take(1)
+	}
+	d.Unlock()
+	if limited {
+		h.stats.deadLetterDropped()
+		return
+	}
+	letter := NewControlPacket(PUBLISH).(*PublishPacket)
+	letter.TopicName = d.topic + "/" + reason.String() + "/" + msg.TopicName
+	letter.Payload = msg.Payload
+	letter.Qos = d.qos
+	letter.Properties = deadLetterProperties(reason, msg, subscriber)
+	select {
+	case d.queue <- letter:
+		h.stats.deadLetter()
+	default:
+		h.stats.deadLetterDropped()
+	}
+}
+
+//deadLetterProperties returns the properties of msg with the user properties saying why and
+//where it was dropped added
+func deadLetterProperties(reason DropReason, msg *PublishPacket, subscriber string) *Properties {
+	var properties Properties
+	if msg.Properties != nil {
+		properties = *msg.Properties
+	}
+	metadata := []UserProperty{{Key: "reason", Value: reason.String()}, {Key: "topic", Value: msg.TopicName}}
+	if msg.Publisher != "" {
+		metadata = append(metadata, UserProperty{Key: "publisher", Value: msg.Publisher})
+	}
+	if subscriber != "" {
+		metadata = append(metadata, UserProperty{Key: "subscriber", Value: subscriber})
+	}
+	if !msg.ReceivedAt.IsZero() {
+		metadata = append(metadata, UserProperty{Key: "received", Value: msg.ReceivedAt.UTC().Format(time.RFC3339Nano)})
+	}
+	properties.UserProperties = append(append([]UserProperty(nil), properties.UserProperties...), metadata...)
+	return &properties
+}
+
+//discard counts msg being dropped for reason and dead letters it. subscriber is the client
+//it was being delivered to, empty if it was dropped before it was routed.
+func (h *Hrotti) discard(reason DropReason, msg *PublishPacket, subscriber string) {
+	atomic.AddInt64(&h.stats.discarded[reason], 1)
+	if h.deadLetters != nil {
+		h.deadLetters.add(h, reason, msg, subscriber)
+	}
+}
@@ -0,0 +1,227 @@
+package hrotti
+
+import (
+	"net"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//closeReason is why a client's connection is closed, it decides whether the client's will
+//is published
+type closeReason int
+
+const (
+	//closeDisconnect is the client sending a DISCONNECT
+	closeDisconnect closeReason = iota
+	//closeNetworkError is a failed read from or write to the connection
+	closeNetworkError
+	//closeKeepalive is the client sending nothing for one and a half keepalive periods
+	closeKeepalive
+	//closeProtocolError is the client breaking the protocol or going over one of the
+	//broker's limits
+	closeProtocolError
+	//closeSlowConsumer is the client's queue staying full, see DisconnectSlowConsumer
+	closeSlowConsumer
+	//closeTakeover is a new connection with the same client id
+	closeTakeover
+	//closeAdmin and closeAdminWithWill are the admin API disconnecting the client
+	closeAdmin
+	closeAdminWithWill
+	//closeShutdown is the broker stopping
+	closeShutdown
+	//closeServerError is the broker failing to persist a message the client sent, or its
+	//Ingester failing to commit it, so it isn't acknowledged and the client sends it again
+	//when it reconnects
+	closeServerError
+	//closePanic is one of the client's goroutines panicking, see recoverPanic
+	closePanic
+)
+
+var closeReasonNames = map[closeReason]string{
+	closeDisconnect:    "client sent DISCONNECT",
+	closeNetworkError:  "network error",
+	closeKeepalive:     "keepalive timeout",
+	closeProtocolError: "protocol error",
+	closeSlowConsumer:  "slow consumer",
+	closeTakeover:      "taken over by a new connection",
+	closeAdmin:         "disconnected by the admin API",
+	closeAdminWithWill: "disconnected by the admin API",
+	closeShutdown:      "broker shutting down",
+	closeServerError:   "server error",
+	closePanic:         "panic",
+}
+
+func (r closeReason) String() string {
+	return closeReasonNames[r]
+}
+
+//sendsWill is true if closing the connection for r publishes the client's will. It isn't
+//published when the client disconnects cleanly, the broker shuts down or fails, or the admin
+//API asks for it not to be, or for a takeover unless WillOnTakeover is set.
+func (r closeReason) sendsWill(hrotti *Hrotti) bool {
+	switch r {
+	case closeDisconnect, closeAdmin, closeShutdown, closeServerError:
+		return false
+	case closeTakeover:
+		return hrotti.WillOnTakeover
+	}
+	return true
+}
+
+//closeFlushTimeout is how long the acknowledgements queued for a client that sent a
+//DISCONNECT have to be written before its connection is closed
+const closeFlushTimeout = time.Second
+
+//closeClient closes the client's connection for reason, detail is logged with the reason.
+//Every disconnect goes through closeClient, it can be called concurrently and more than once
+//for a connection and only the first call closes it. The client's goroutines are stopped,
+//after writing any acknowledgements still queued if the client disconnected cleanly, the will
+//is published or not for the reason and the session is kept, or removed for a clean session.
+//A takeover leaves the session for the new connection. The connection is taken when
+//closeClient is called so a late call after a takeover or a durable reconnect doesn't close
+//the new connection, calls while a takeover is stopping the old connection do nothing.
+func (c *Client) closeClient(hrotti *Hrotti, reason closeReason, detail string) {
+	c.info.Lock()
+	stopOnce, conn, takingOver := c.stopOnce, c.conn, c.takeOver
+	if reason == closeTakeover {
+		c.takeOver = true
+	}
+	c.info.Unlock()
+	if takingOver {
+		return
+	}
+	var closed, cleanSession bool
+	//the takeover calls this with the clients lock held, so the clients lock can't be taken
+	//inside stopOnce as the takeover would be waiting on it
+	stopOnce.Do(func() {
+		closed = true
+		cleanSession = c.teardown(hrotti, conn, reason, detail)
+	})
+	if closed && cleanSession {
+		c.removeSession(hrotti)
+	}
+}
+
+//closeLater is closeClient from a new goroutine, for the client's own goroutines that
+//closeClient waits for
+func (c *Client) closeLater(hrotti *Hrotti, reason closeReason, detail string) {
+	c.info.RLock()
+	takingOver := c.takeOver
+	c.info.RUnlock()
+	if !takingOver {
+		go c.closeClient(hrotti, reason, detail)
+	}
+}
+
+//teardown stops the client's connection conn, it returns true if the client's clean session
+//has to be removed
+func (c *Client) teardown(hrotti *Hrotti, conn net.Conn, reason closeReason, detail string) bool {
+	description := reason.String()
+	if detail != "" {
+		description += ": " + detail
+	}
+	hrotti.sessionLog.Info("Client disconnected", "client", c.clientID, "addr", conn.RemoteAddr(), "reason", description)
+	clientID := c.clientID
+	hrotti.callHook(clientID, func(hooks Hooks) { hooks.OnDisconnect(clientID, description) })
+	hrotti.quotas.disconnected(c)
+	//close the stop channel and the network connection and wait for all the goroutines in the
+	//waitgroup. A client that disconnected cleanly is waiting on nothing else so Send can write
+	//the acknowledgements that are still queued first.
+	close(c.stop)
+	if reason == closeDisconnect {
+		conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+		c.Wait()
+		conn.Close()
+	} else {
+		conn.Close()
+		c.Wait()
+	}
+	//once the client is marked disconnected a durable client can reconnect and reuse it, so
+	//take what's needed from this connection first
+	willMessage, cleanSession := c.willMessage, c.cleanSession
+	if reason == closeTakeover {
+		//the new connection carries on with the session and message channels
+		c.info.Lock()
+		c.conn = nil
+		c.info.Unlock()
+		//the new connection has already cancelled any delayed will so this one isn't delayed
+		if reason.sendsWill(hrotti) && willMessage != nil {
+			hrotti.sessionLog.Debug("Sending will message", "client", c.clientID)
+			go hrotti.DeliverMessage(willMessage.TopicName, willMessage, nil)
+		}
+		return false
+	}
+	//the client goes offline with its connection, or its session if presence waits for that
+	if hrotti.Presence != nil && (!hrotti.Presence.OnSessionEnd || cleanSession) {
+		hrotti.publishPresence(c.clientID, false)
+	}
+	c.info.Lock()
+	c.disconnectedAt = hrotti.Clock.Now()
+	c.info.Unlock()
+	//a durable session is saved with when the client disconnected so it can be expired
+	if !cleanSession {
+		hrotti.saveSession(c)
+	}
+	c.deliverMu.Lock()
+	close(c.outboundMessages)
+	close(c.outboundPriority)
+	c.state.SetValue(DISCONNECTED)
+	c.deliverMu.Unlock()
+	if reason != closeShutdown {
+		hrotti.redistributeShared(c)
+	}
+	//publish the will, after the WillDelay if there is one
+	if reason.sendsWill(hrotti) && willMessage != nil {
+		hrotti.publishWill(c.clientID, willMessage)
+	}
+	return cleanSession
+}
+
+//removeSession removes the client, its subscriptions and anything persisted for it, after
+//its clean session connection has closed. A client that has already been replaced or has a
+//new connection, which was too quick for the old one to be removed, is left alone.
+func (c *Client) removeSession(hrotti *Hrotti) {
+	hrotti.clients.Lock()
+	if hrotti.clients.list[c.clientID] != c || c.state.Value() != DISCONNECTED {
+		hrotti.clients.Unlock()
+		return
+	}
+	delete(hrotti.clients.list, c.clientID)
+	hrotti.clients.Unlock()
+	hrotti.DeleteSubAll(c.clientID)
+	//the messages still queued or unacknowledged for the client go with its session, the QoS 1
+	//and 2 ones are all persisted
+	for msg := range c.outboundMessages {
+		if msg.Qos == 0 {
+			hrotti.discard(DropSessionEnded, msg, c.clientID)
+		}
+	}
+	hrotti.PersistStore.RangeInflight(c.clientID, func(direction dirFlag, msgID uint16, message ControlPacket) bool {
+		if pp, ok := message.(*PublishPacket); ok && direction == OUTBOUND {
+			hrotti.discard(DropSessionEnded, pp, c.clientID)
+		}
+		return true
+	})
+	hrotti.PersistStore.DeleteSession(c.clientID)
+	hrotti.quotas.sessionEnded(c)
+}
+
+//closeClients closes the connection of every connected client when the broker stops, their
+//wills aren't published and durable sessions are saved
+func (h *Hrotti) closeClients() {
+	var connected []*Client
+	h.clients.RLock()
+	for _, c := range h.clients.list {
+		c.info.RLock()
+		//internal clients such as the local side of a bridge have no connection
+		if c.Connected() && c.conn != nil {
+			connected = append(connected, c)
+		}
+		c.info.RUnlock()
+	}
+	h.clients.RUnlock()
+	for _, c := range connected {
+		c.closeClient(h, closeShutdown, "")
+	}
+}
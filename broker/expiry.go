@@ -0,0 +1,58 @@
+package hrotti
+
+import (
+	"time"
+)
+
+//sessionSweeper expires the sessions of clients that have been disconnected for longer than
+//SessionExpiry, checking at least every minute, until the broker is stopped.
+func (h *Hrotti) sessionSweeper() {
+	interval := h.SessionExpiry / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := h.Clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case now := <-ticker.C():
+			h.expireSessions(now)
+		}
+	}
+}
+
+//expireSessions removes the sessions of clients disconnected for longer than SessionExpiry
+//before now: their subscriptions, queued and inflight messages. Nothing is published for
+//them other than their presence going offline if Presence waits for the session to end. A
+//client is only expired while it is disconnected under the clients lock, which is held while
+//a reconnecting client or a takeover marks it as connecting.
+func (h *Hrotti) expireSessions(now time.Time) {
+	var expired []*Client
+	h.clients.Lock()
+	for id, c := range h.clients.list {
+		if c.state.Value() != DISCONNECTED {
+			continue
+		}
+		c.info.RLock()
+		disconnectedAt := c.disconnectedAt
+		c.info.RUnlock()
+		if !disconnectedAt.IsZero() && now.Sub(disconnectedAt) > h.SessionExpiry {
+			h.sessionLog.Info("Session expired", "client", id, "disconnectedAt", disconnectedAt.Format(time.RFC3339))
+			delete(h.clients.list, id)
+			expired = append(expired, c)
+		}
+	}
+	h.clients.Unlock()
+	for _, c := range expired {
+		h.DeleteSubAll(c.clientID)
+		if err := h.PersistStore.DeleteSession(c.clientID); err != nil {
+			h.persistenceLog.Error("Failed to delete expired session", "client", c.clientID, "err", err)
+		}
+		h.quotas.sessionEnded(c)
+		if h.Presence != nil && h.Presence.OnSessionEnd {
+			h.publishPresence(c.clientID, false)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package hrotti
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//A state file holds everything a Persistence keeps, to move a broker's durable sessions,
+//retained messages and inflight messages to another node or another kind of persistence.
+//It is a line of JSON for each record: a header with the format and version, then each
+//retained message, each session followed by its inflight messages, and an end record with
+//the counts so a file that was cut short is noticed. Packets are in the form the persistence
+//stores them, the wire format followed by the JSON of what isn't in it, base64 encoded.
+
+//StateVersion is the version of the state file ExportState writes, ImportState reads files
+//of this version
+const StateVersion = 1
+
+const stateFormat = "hrotti-state"
+
+//StateCounts is the number of each kind of record written to or read from a state file
+type StateCounts struct {
+	Sessions      int `json:"sessions"`
+	Subscriptions int `json:"subscriptions"`
+	Retained      int `json:"retained"`
+	Inflight      int `json:"inflight"`
+}
+
+//a stateRecord is a line of a state file, Type says which of the other fields are set
+type stateRecord struct {
+	Type      string       `json:"type"`
+	Format    string       `json:"format,omitempty"`
+	Version   int          `json:"version,omitempty"`
+	Exported  *time.Time   `json:"exported,omitempty"`
+	Topic     string       `json:"topic,omitempty"`
+	Client    string       `json:"client,omitempty"`
+	Session   *Session     `json:"session,omitempty"`
+	Direction string       `json:"direction,omitempty"`
+	MessageID uint16       `json:"messageId,omitempty"`
+	Packet    []byte       `json:"packet,omitempty"`
+	Counts    *StateCounts `json:"counts,omitempty"`
+}
+
+var directionNames = map[dirFlag]string{INBOUND: "inbound", OUTBOUND: "outbound"}
+
+//ExportState writes the state in p to w as a state file and returns what it wrote. The
+//inflight messages of clients without a session, clean session clients that are connected,
+//aren't written as they would be discarded when the broker restarted anyway. p should not
+//be changing, a broker exporting its own persistence while clients are connected writes
+//whatever each record is when it gets to it.
+func ExportState(p Persistence, w io.Writer) (StateCounts, error) {
+	var counts StateCounts
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	now := time.Now().UTC()
+	if err := encoder.Encode(stateRecord{Type: "header", Format: stateFormat, Version: StateVersion, Exported: &now}); err != nil {
+		return counts, err
+	}
+	var err error
+	rangeErr := p.RangeRetained(func(topic string, message *PublishPacket) bool {
+		err = encoder.Encode(stateRecord{Type: "retained", Topic: topic, Packet: packPacket(message)})
+		counts.Retained++
+		return err == nil
+	})
+	if err != nil || rangeErr != nil {
+		return counts, firstError(err, rangeErr)
+	}
+	sessions := make(map[string]*Session)
+	if err := p.RangeSessions(func(client string, session *Session) bool {
+		sessions[client] = session
+		return true
+	}); err != nil {
+		return counts, err
+	}
+	for client, session := range sessions {
+		if err := encoder.Encode(stateRecord{Type: "session", Client: client, Session: session}); err != nil {
+			return counts, err
+		}
+		counts.Sessions++
+		counts.Subscriptions += len(session.Subscriptions)
+		rangeErr := p.RangeInflight(client, func(direction dirFlag, msgID uint16, message ControlPacket) bool {
+			err = encoder.Encode(stateRecord{Type: "inflight", Client: client, Direction: directionNames[direction], MessageID: msgID, Packet: packPacket(message)})
+			counts.Inflight++
+			return err == nil
+		})
+		if err != nil || rangeErr != nil {
+			return counts, firstError(err, rangeErr)
+		}
+	}
+	if err := encoder.Encode(stateRecord{Type: "end", Counts: &counts}); err != nil {
+		return counts, err
+	}
+	return counts, bw.Flush()
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//an importedInflight is an inflight record read from a state file
+type importedInflight struct {
+	client    string
+	direction dirFlag
+	msgID     uint16
+	message   ControlPacket
+}
+
+//ImportState loads the state file read from r into p, which has to be empty, and returns
+//what it loaded. The whole file is checked before anything is stored, so a file of another
+//version, with a corrupt packet, a client id or retained topic that appears twice, an
+//inflight message for a client without a session or that is cut short loads nothing.
+func ImportState(r io.Reader, p Persistence) (StateCounts, error) {
+	var counts StateCounts
+	empty := true
+	p.RangeRetained(func(string, *PublishPacket) bool {
+		empty = false
+		return false
+	})
+	p.RangeSessions(func(string, *Session) bool {
+		empty = false
+		return false
+	})
+	if !empty {
+		return counts, errors.New("the persistence already has sessions or retained messages")
+	}
+
+	retained := make(map[string]*PublishPacket)
+	var topics []string
+	sessions := make(map[string]*Session)
+	var clients []string
+	var inflight []importedInflight
+	inflightIDs := make(map[string]map[inflightKey]bool)
+	var end *StateCounts
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for line := 1; ; line++ {
+		var record stateRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return counts, fmt.Errorf("record %d: %s", line, err.Error())
+		}
+		if line == 1 && (record.Type != "header" || record.Format != stateFormat) {
+			return counts, errors.New("not a state file")
+		}
+		if end != nil {
+			return counts, fmt.Errorf("record %d: after the end record", line)
+		}
+		switch record.Type {
+		case "header":
+			if line != 1 {
+				return counts, fmt.Errorf("record %d: a second header", line)
+			}
+			if record.Version != StateVersion {
+				return counts, fmt.Errorf("state file version %d isn't supported, only %d is", record.Version, StateVersion)
+			}
+		case "retained":
+			if _, ok := retained[record.Topic]; ok || record.Topic == "" {
+				return counts, fmt.Errorf("record %d: retained topic %q is empty or appears twice", line, record.Topic)
+			}
+			cp, err := unpackPacket(record.Packet)
+			if err != nil {
+				return counts, fmt.Errorf("record %d: corrupt retained message for %s: %s", line, record.Topic, err.Error())
+			}
+			message, ok := cp.(*PublishPacket)
+			if !ok {
+				return counts, fmt.Errorf("record %d: retained message for %s is a %s", line, record.Topic, cp.Type())
+			}
+			retained[record.Topic] = message
+			topics = append(topics, record.Topic)
+		case "session":
+			if _, ok := sessions[record.Client]; ok || record.Session == nil {
+				return counts, fmt.Errorf("record %d: session for client %q is missing or appears twice", line, record.Client)
+			}
+			sessions[record.Client] = record.Session
+			clients = append(clients, record.Client)
+		case "inflight":
+			var direction dirFlag
+			for flag, name := range directionNames {
+				if name == record.Direction {
+					direction = flag
+				}
+			}
+			cp, err := unpackPacket(record.Packet)
+			if err != nil {
+				return counts, fmt.Errorf("record %d: corrupt inflight message %d for %s: %s", line, record.MessageID, record.Client, err.Error())
+			}
+			if err := checkImportedInflight(direction, record.MessageID, cp); err != nil {
+				return counts, fmt.Errorf("record %d: inflight message %d for %s %s", line, record.MessageID, record.Client, err.Error())
+			}
+			if _, ok := sessions[record.Client]; !ok {
+				return counts, fmt.Errorf("record %d: inflight message %d for %s, which has no session", line, record.MessageID, record.Client)
+			}
+			key := inflightKey{direction, record.MessageID}
+			if inflightIDs[record.Client] == nil {
+				inflightIDs[record.Client] = make(map[inflightKey]bool)
+			}
+			if inflightIDs[record.Client][key] {
+				return counts, fmt.Errorf("record %d: inflight message %d for %s appears twice", line, record.MessageID, record.Client)
+			}
+			inflightIDs[record.Client][key] = true
+			inflight = append(inflight, importedInflight{record.Client, direction, record.MessageID, cp})
+		case "end":
+			if record.Counts == nil {
+				return counts, fmt.Errorf("record %d: end record without counts", line)
+			}
+			end = record.Counts
+		default:
+			return counts, fmt.Errorf("record %d: unknown type %q", line, record.Type)
+		}
+	}
+	if end == nil {
+		return counts, errors.New("the state file has no end record, it may have been cut short")
+	}
+	for _, session := range sessions {
+		counts.Subscriptions += len(session.Subscriptions)
+	}
+	found := StateCounts{Sessions: len(sessions), Subscriptions: counts.Subscriptions, Retained: len(retained), Inflight: len(inflight)}
+	if found != *end {
+		return StateCounts{}, fmt.Errorf("the state file has %+v but its end record says %+v", found, *end)
+	}
+
+	counts = StateCounts{}
+	for _, topic := range topics {
+		if err := p.StoreRetained(topic, retained[topic]); err != nil {
+			return counts, err
+		}
+		counts.Retained++
+	}
+	for _, client := range clients {
+		if err := p.StoreSession(client, sessions[client]); err != nil {
+			return counts, err
+		}
+		counts.Sessions++
+		counts.Subscriptions += len(sessions[client].Subscriptions)
+	}
+	for _, message := range inflight {
+		if err := p.StoreInflight(message.client, message.direction, message.msgID, message.message); err != nil {
+			return counts, err
+		}
+		counts.Inflight++
+	}
+	return counts, nil
+}
+
+//checkImportedInflight returns an error if cp can't be an inflight message with msgID in
+//direction, an OUTBOUND PUBLISH or PUBREL or an INBOUND PUBLISH with the same message id
+func checkImportedInflight(direction dirFlag, msgID uint16, cp ControlPacket) error {
+	if direction == 0 {
+		return errors.New("has no direction")
+	}
+	if msgID == 0 || cp.Details().MessageID != msgID {
+		return fmt.Errorf("has message id %d in its packet", cp.Details().MessageID)
+	}
+	switch {
+	case cp.Type() == PUBLISH && cp.Details().Qos > 0:
+	case cp.Type() == PUBREL && direction == OUTBOUND:
+	default:
+		return fmt.Errorf("is a %s", cp.Type())
+	}
+	return nil
+}
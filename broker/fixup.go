@@ -0,0 +1,25 @@
+package hrotti
+
+import (
+	"sync/atomic"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//fixInbound corrects the ways cp, from client at addr, breaks the spec that the fixups of
+//the listener with config allow, counting and logging each one
+func (h *Hrotti) fixInbound(config *ListenerConfig, cp ControlPacket, client string, addr string) {
+	fixups := config.fixups()
+	if len(fixups) == 0 {
+		return
+	}
+	for _, fixup := range FixInbound(cp, fixups) {
+		atomic.AddInt64(&h.stats.fixups[fixup], 1)
+		//a CONNECT is logged as a warning, a connected client could log one for every packet
+		if cp.Type() == CONNECT {
+			h.sessionLog.Warn("Corrected protocol violation", "client", client, "addr", addr, "type", cp.Type(), "fixup", fixup)
+		} else {
+			h.packetsLog.Debug("Corrected protocol violation", "client", client, "addr", addr, "type", cp.Type(), "fixup", fixup)
+		}
+	}
+}
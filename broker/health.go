@@ -0,0 +1,175 @@
+package hrotti
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+	bolt "go.etcd.io/bbolt"
+)
+
+//defaultHealthTimeout is how long each health check has when HealthTimeout isn't set
+const defaultHealthTimeout = time.Second
+
+//healthTopic is what the health check publishes to its own internal client, a $ topic so
+//no one else's wildcard subscriptions match it
+const healthTopic = "$health/loopback"
+
+//Pinger is implemented by a Persistence that can check it is still reachable, the health
+//check pings it. BoltPersistence and RedisPersistence are Pingers.
+type Pinger interface {
+	Ping() error
+}
+
+//Ping checks the database is still open
+func (p *BoltPersistence) Ping() error {
+	return p.db.View(func(*bolt.Tx) error { return nil })
+}
+
+//Ping checks the Redis server answers
+func (p *RedisPersistence) Ping() error {
+	_, err := p.pool.do([]string{"PING"})
+	return err
+}
+
+//HealthReport is the result of a health or readiness check, Checks has "ok" or what is
+//wrong for each thing checked
+type HealthReport struct {
+	OK     bool              `json:"ok"`
+	Checks map[string]string `json:"checks"`
+}
+
+func (r *HealthReport) check(name string, err error) {
+	if err != nil {
+		r.OK = false
+		r.Checks[name] = err.Error()
+	} else {
+		r.Checks[name] = "ok"
+	}
+}
+
+//checkListeners adds whether each listener's accept loop is running to the report
+func (h *Hrotti) checkListeners(r *HealthReport) {
+	if len(h.listeners) == 0 {
+		r.check("listeners", errors.New("no listeners"))
+	}
+	for name, listener := range h.listeners {
+		var err error
+		if atomic.LoadInt32(&listener.accepting) == 0 {
+			err = errors.New("not accepting connections")
+		}
+		r.check("listener "+name, err)
+	}
+}
+
+func (h *Hrotti) checkStopping(r *HealthReport) {
+	select {
+	case <-h.stop:
+		r.check("broker", errors.New("stopping"))
+	default:
+		r.check("broker", nil)
+	}
+}
+
+//Ready reports whether the broker is ready for clients: its retained messages and sessions
+//have been recovered from persistence and every listener is accepting connections.
+func (h *Hrotti) Ready() HealthReport {
+	r := HealthReport{OK: true, Checks: make(map[string]string)}
+	h.checkStopping(&r)
+	var err error
+	if atomic.LoadInt32(&h.recovered) == 0 {
+		err = errors.New("recovering state from persistence")
+	}
+	r.check("recovered", err)
+	h.checkListeners(&r)
+	return r
+}
+
+//Health reports whether the broker is working: every listener's accept loop is running,
+//the persistence answers a ping if it is a Pinger and a message published to an internal
+//client is routed to it. Each check has HealthTimeout to complete.
+func (h *Hrotti) Health() HealthReport {
+	r := HealthReport{OK: true, Checks: make(map[string]string)}
+	h.checkStopping(&r)
+	h.checkListeners(&r)
+	timeout := h.HealthTimeout
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	if pinger, ok := h.PersistStore.(Pinger); ok {
+		r.check("persistence", withTimeout(timeout, pinger.Ping))
+	}
+	r.check("router", withTimeout(timeout, h.loopback))
+	return r
+}
+
+//withTimeout returns the error from check, or an error if it takes longer than timeout.
+//The check is left to finish on its own.
+func withTimeout(timeout time.Duration, check func() error) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- check()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no answer within %s", timeout)
+	}
+}
+
+//loopback publishes a message to the broker's internal health client and waits for it to
+//be queued for the client. The client is only subscribed the first time it is used.
+func (h *Hrotti) loopback() error {
+	h.healthMu.Lock()
+	defer h.healthMu.Unlock()
+	if h.healthClient == nil {
+		c := newClient(nil, "$health", 10)
+		c.state.SetValue(CONNECTED)
+		h.AddSub(c, healthTopic, SubscriptionOptions{})
+		h.healthClient = c
+	}
+	h.healthSeq++
+	payload := strconv.FormatUint(h.healthSeq, 10)
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = healthTopic
+	pp.Payload = []byte(payload)
+	if err := h.DeliverMessage(healthTopic, pp, nil); err != nil {
+		return err
+	}
+	//messages from earlier checks that timed out may still be queued ahead of this one
+	for {
+		if msg := <-h.healthClient.outboundMessages; string(msg.Payload) == payload {
+			return nil
+		}
+	}
+}
+
+//healthHandler serves a report as JSON, with 503 Service Unavailable if it isn't OK
+func healthHandler(report func() HealthReport) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hr := report()
+		w.Header().Set("Content-Type", "application/json")
+		if !hr.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(hr)
+	})
+}
+
+//HealthHandler returns an http.Handler that serves Health as JSON, for a liveness probe.
+//The admin API and metrics serve it at /healthz.
+func (h *Hrotti) HealthHandler() http.Handler {
+	return healthHandler(h.Health)
+}
+
+//ReadyHandler returns an http.Handler that serves Ready as JSON, for a readiness probe.
+//The admin API and metrics serve it at /readyz.
+func (h *Hrotti) ReadyHandler() http.Handler {
+	return healthHandler(h.Ready)
+}
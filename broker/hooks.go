@@ -0,0 +1,136 @@
+package hrotti
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//Hooks are told about clients connecting, disconnecting, subscribing and publishing, for
+//when the broker is embedded in a service that needs to react to them. OnConnect,
+//OnDisconnect and OnSubscribe are called on a pool of HookWorkers goroutines, in order for
+//each client, and a call is dropped and counted if its worker already has HookQueueDepth
+//calls waiting, so a slow hook never holds up the broker. OnPublish decides what happens to
+//a message so it is called by the publishing client's goroutine before the message is
+//routed, it returns the topic to publish the message to, which can be different to topic,
+//and false to drop the message. A slow OnPublish only holds up the client that is
+//publishing. None of them are called with any of the broker's locks held. Embed NopHooks to
+//only implement some of them.
+type Hooks interface {
+	OnConnect(clientID string, username string, remoteAddr string, cleanSession bool)
+	OnDisconnect(clientID string, reason string)
+	OnSubscribe(clientID string, filters []string, grantedQoss []byte)
+	OnPublish(clientID string, topic string, qos byte, size int) (string, bool)
+}
+
+//NopHooks are Hooks that do nothing and let every message through unchanged
+type NopHooks struct{}
+
+func (NopHooks) OnConnect(clientID string, username string, remoteAddr string, cleanSession bool) {}
+
+func (NopHooks) OnDisconnect(clientID string, reason string) {}
+
+func (NopHooks) OnSubscribe(clientID string, filters []string, grantedQoss []byte) {}
+
+func (NopHooks) OnPublish(clientID string, topic string, qos byte, size int) (string, bool) {
+	return topic, true
+}
+
+const (
+	defaultHookWorkers    = 4
+	defaultHookQueueDepth = 1024
+)
+
+//hookPool runs the calls to the Hooks on its workers, every call for a client goes to the
+//same worker so they are made in the order they happened
+type hookPool struct {
+	queues []chan func()
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newHookPool(workers int, depth int) *hookPool {
+	if workers <= 0 {
+		workers = defaultHookWorkers
+	}
+	if depth <= 0 {
+		depth = defaultHookQueueDepth
+	}
+	p := &hookPool{queues: make([]chan func(), workers), done: make(chan struct{})}
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), depth)
+		p.wg.Add(1)
+		go p.run(p.queues[i])
+	}
+	return p
+}
+
+//run makes the calls on queue until the pool is stopped, then the ones still waiting
+func (p *hookPool) run(queue chan func()) {
+	defer p.wg.Done()
+	for {
+		select {
+		case f := <-queue:
+			f()
+		case <-p.done:
+			for {
+				select {
+				case f := <-queue:
+					f()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+//call queues f on clientID's worker, it returns false if the worker's queue is full
+func (p *hookPool) call(clientID string, f func()) bool {
+	hash := fnv.New32a()
+	hash.Write([]byte(clientID))
+	select {
+	case p.queues[hash.Sum32()%uint32(len(p.queues))] <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+//stop waits for the calls already queued to be made, anything queued after is dropped
+func (p *hookPool) stop() {
+	close(p.done)
+	p.wg.Wait()
+}
+
+//callHook queues f to be called with the Hooks for clientID, if there are any
+func (h *Hrotti) callHook(clientID string, f func(Hooks)) {
+	if h.hooks == nil {
+		return
+	}
+	hooks := h.Hooks
+	call := func() {
+		defer h.recoverHook(clientID)
+		f(hooks)
+	}
+	if !h.hooks.call(clientID, call) {
+		h.stats.droppedHook()
+		h.sessionLog.Debug("Dropped hook call, the queue is full", "client", clientID)
+	}
+}
+
+//publishHook calls OnPublish for a message c has published, returning the topic to publish
+//it to and false if the hook dropped it
+func (h *Hrotti) publishHook(c *Client, pp *PublishPacket) (string, bool) {
+	if h.Hooks == nil {
+		return pp.TopicName, true
+	}
+	topic, ok := h.Hooks.OnPublish(c.clientID, pp.TopicName, pp.Qos, len(pp.Payload))
+	if ok && (len(topic) == 0 || strings.ContainsAny(topic, "+#")) {
+		h.packetsLog.Warn("OnPublish rewrote the topic to one that isn't valid, dropping the message", "client", c.clientID, "topic", pp.TopicName, "rewritten", topic)
+		return topic, false
+	}
+	return topic, ok
+}
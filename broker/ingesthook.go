@@ -0,0 +1,152 @@
+package hrotti
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+//Ingester commits the messages clients publish to some of the broker's topics to another
+//system, such as a Kafka topic they are mirrored to, before the broker acknowledges them. It
+//is called after the message has passed the publisher's ACL, its topic's policy and the
+//OnPublish hook, and before it is retained or routed. Until it returns the publisher doesn't
+//get its PUBACK or PUBREC, so a broker that crashes before then hasn't told the device it
+//has the message and the device sends it again.
+//
+//An error, or not returning within IngestTimeout, means the message wasn't committed: a QoS
+//1 or 2 message isn't delivered and the publisher is disconnected without its ack so it
+//resends the message when it reconnects, a QoS 0 message is dropped. A call that timed out
+//can still commit the message after the publisher has been disconnected, so OnIngest should
+//be idempotent for a message sent again. Calls are made on a pool of IngestWorkers
+//goroutines, publishers whose messages are waiting for a worker are held up rather than the
+//broker starting more, so a slow downstream slows down the clients publishing to it.
+type Ingester interface {
+	OnIngest(message *Message) error
+}
+
+const (
+	defaultIngestWorkers = 8
+	defaultIngestTimeout = 10 * time.Second
+)
+
+var (
+	//errIngestTimeout is the error for a message the Ingester didn't commit within IngestTimeout
+	errIngestTimeout = errors.New("Timed out waiting for the ingest hook")
+	//errIngestStopped is the error for a message whose publisher stopped while it waited
+	errIngestStopped = errors.New("Client stopped waiting for the ingest hook")
+)
+
+//an ingestJob is a message to give to an Ingester, with where to send the result
+type ingestJob struct {
+	ingester Ingester
+	message  *Message
+	result   chan error
+}
+
+//ingestPool is the workers that call the Ingesters
+type ingestPool struct {
+	jobs chan ingestJob
+	done chan struct{}
+}
+
+func newIngestPool(h *Hrotti, workers int) *ingestPool {
+	if workers <= 0 {
+		workers = defaultIngestWorkers
+	}
+	p := &ingestPool{jobs: make(chan ingestJob), done: make(chan struct{})}
+	for i := 0; i < workers; i++ {
+		go p.run(h)
+	}
+	return p
+}
+
+//run calls the Ingesters for the jobs it is given until the pool is stopped
+func (p *ingestPool) run(h *Hrotti) {
+	for {
+		select {
+		case job := <-p.jobs:
+			//the result channel has room for the result, whether or not it is still wanted
+			job.result <- h.callIngester(job.ingester, job.message)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+//stop stops the workers once the calls they are making return, a call to a downstream that
+//has stopped responding doesn't hold up stopping the broker
+func (p *ingestPool) stop() {
+	close(p.done)
+}
+
+//callIngester calls ingester for message, a panic is returned as an error
+func (h *Hrotti) callIngester(ingester Ingester, message *Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&h.stats.panics, 1)
+			h.packetsLog.Error("Recovered from a panic in an ingest hook", "topic", message.Topic, "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("ingest hook panicked: %v", r)
+		}
+	}()
+	return ingester.OnIngest(message)
+}
+
+//ingester returns the Ingester with the longest matching filter for topic, or nil if there
+//isn't one
+func (h *Hrotti) ingester(topic string) Ingester {
+	if len(h.Ingesters) == 0 {
+		return nil
+	}
+	var matched string
+	var ingester Ingester
+	levels := topicLevels(topic)
+	for filter, i := range h.Ingesters {
+		if (ingester == nil || moreSpecific(filter, matched)) && match(topicLevels(filter), levels) {
+			matched, ingester = filter, i
+		}
+	}
+	return ingester
+}
+
+//commitIngest gives message, published by c, to the Ingester for its topic and waits for it
+//to be committed, returning nil if there is no Ingester for the topic. Waiting for a worker
+//counts towards the IngestTimeout.
+func (h *Hrotti) commitIngest(c *Client, message *Message) error {
+	ingester := h.ingester(message.Topic)
+	if ingester == nil || h.ingestPool == nil {
+		return nil
+	}
+	start := time.Now()
+	timeout := time.NewTimer(h.IngestTimeout)
+	defer timeout.Stop()
+	job := ingestJob{ingester: ingester, message: message, result: make(chan error, 1)}
+	var err error
+	select {
+	case h.ingestPool.jobs <- job:
+		select {
+		case err = <-job.result:
+		case <-timeout.C:
+			err = errIngestTimeout
+		case <-c.stop:
+			err = errIngestStopped
+		}
+	case <-timeout.C:
+		err = errIngestTimeout
+	case <-c.stop:
+		err = errIngestStopped
+	}
+	switch {
+	case err == errIngestStopped:
+	case err == errIngestTimeout:
+		atomic.AddInt64(&h.stats.ingestTimeouts, 1)
+		h.packetsLog.Warn("Ingest hook timed out", "client", c.clientID, "topic", message.Topic, "timeout", h.IngestTimeout)
+	case err != nil:
+		atomic.AddInt64(&h.stats.ingestErrors, 1)
+		h.packetsLog.Warn("Ingest hook failed", "client", c.clientID, "topic", message.Topic, "err", err)
+	case h.packetsLog.enabled(LogTrace):
+		h.packetsLog.Trace("Ingest hook committed message", "client", c.clientID, "topic", message.Topic, "took", time.Since(start))
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+package hrotti
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//Messages published through the admin API are injected as if an internal client had
+//published them, whose client id and username are AdminUsername. They are checked against
+//the ACL for that username, the topic's policy and the OnPublish hook as a client's messages
+//are, the admin user is their publisher in the hooks, dead letters and logs, and they are
+//counted in hrotti_admin_publishes_total. A message can also be sent to one client's session
+//whatever its subscriptions, such as a command for a single device, rather than routed to
+//the subscribers of its topic, and a QoS 1 or 2 message sent that way can be waited on until
+//the client acknowledges it.
+
+//defaultAdminUsername is the client id and username of messages published through the
+//admin API
+const defaultAdminUsername = "admin"
+
+var (
+	//ErrClientNotFound is returned for a client id the broker has no session for
+	ErrClientNotFound = errors.New("Client not found")
+	//ErrPublishRefused is wrapped by the error for an injected message that the admin user's
+	//ACL, its topic's policy or the OnPublish hook refused
+	ErrPublishRefused = errors.New("Message refused")
+)
+
+//adminClient returns the client injected messages are published by, with the ACL for
+//AdminUsername, which Reload can change
+func (h *Hrotti) adminClient() *Client {
+	c := newClient(nil, h.AdminUsername, 0)
+	h.liveLock.RLock()
+	c.username = h.AdminUsername
+	c.acl = h.Auth.acl(h.AdminUsername)
+	h.liveLock.RUnlock()
+	return c
+}
+
+//checkInjectedTopic returns an error for a topic a client couldn't publish to, one that is
+//empty, has a wildcard, is too long to encode or isn't valid UTF-8 without U+0000, or is
+//over the topic limits, so it is refused before it is routed to anyone
+func (h *Hrotti) checkInjectedTopic(topic string) error {
+	switch {
+	case len(topic) == 0 || strings.ContainsAny(topic, "#+"):
+		return errors.New("Invalid topic")
+	case len(topic) > MaxFieldLength:
+		return fmt.Errorf("Invalid topic: topic is %d bytes, more than the maximum of %d", len(topic), MaxFieldLength)
+	case !utf8.ValidString(topic) || strings.ContainsRune(topic, 0):
+		return errors.New("Invalid topic: topic isn't valid UTF-8 or contains U+0000")
+	}
+	if err := h.topicLimits().Check(topic); err != nil {
+		return fmt.Errorf("Invalid topic: %s", err)
+	}
+	return nil
+}
+
+//Inject publishes the message p as the admin user, to the subscribers of its topic or, if
+//p.Client is set, to that client's session. For a QoS 1 or 2 message to a client acked is
+//closed once the client has acknowledged it, it is nil otherwise. The error wraps
+//ErrPublishRefused if the message was refused and is ErrClientNotFound for an unknown client.
+func (h *Hrotti) Inject(p AdminPublish) (acked <-chan struct{}, err error) {
+	payload := []byte(p.Payload)
+	if p.PayloadBase64 != nil {
+		if p.Payload != "" {
+			return nil, errors.New("Only one of payload and payloadBase64 can be given")
+		}
+		payload = p.PayloadBase64
+	}
+	if err := h.checkInjectedTopic(p.Topic); err != nil {
+		return nil, err
+	}
+	if p.Qos > 2 {
+		return nil, errors.New("Invalid QoS")
+	}
+	if p.Client != "" && p.Retain {
+		return nil, errors.New("A message for one client can't be retained")
+	}
+	admin := h.adminClient()
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = p.Topic
+	pp.Payload = payload
+	pp.Qos = p.Qos
+	pp.Retain = p.Retain
+	pp.Properties = p.Properties
+	pp.Publisher = admin.clientID
+	h.received(pp)
+	if h.packetsLog.enabled(LogTrace) {
+		h.packetsLog.Trace("Injected PUBLISH", "client", admin.clientID, "topic", pp.TopicName, "qos", pp.Qos, "target", p.Client)
+	}
+	if !admin.canPublish(pp.TopicName) {
+		h.packetsLog.Warn("Injected PUBLISH denied by ACL", "client", admin.clientID, "topic", pp.TopicName)
+		h.stats.publishDenied()
+		h.discard(DropDenied, pp, "")
+		return nil, fmt.Errorf("%w, the ACL for %s doesn't allow publishing to %s", ErrPublishRefused, admin.username, pp.TopicName)
+	}
+	delivery, _ := h.applyTopicPolicy(admin, pp)
+	if delivery == nil {
+		return nil, fmt.Errorf("%w, it breaks the policy for its topic", ErrPublishRefused)
+	}
+	topic, ok := h.publishHook(admin, delivery)
+	if !ok {
+		return nil, fmt.Errorf("%w by the OnPublish hook", ErrPublishRefused)
+	}
+	message := h.ingest(topic, delivery)
+	if p.Client != "" {
+		if acked, err = h.publishTo(p.Client, message); err == nil {
+			atomic.AddInt64(&h.stats.adminPublishes, 1)
+		}
+		return acked, err
+	}
+	if message.Retain {
+		if retained, _ := h.setRetained(message); !retained {
+			return nil, errors.New("Retained message is over the retained limits")
+		}
+	}
+	atomic.AddInt64(&h.stats.adminPublishes, 1)
+	h.route(message, nil)
+	return nil, nil
+}
+
+//publishTo queues message for the session of the client with clientID, whatever its
+//subscriptions. For a QoS 1 or 2 message the channel returned is closed when the client
+//acknowledges it.
+func (h *Hrotti) publishTo(clientID string, message *Message) (<-chan struct{}, error) {
+	c := h.getClient(clientID)
+	if c == nil {
+		return nil, ErrClientNotFound
+	}
+	pp := message.packet(message.Qos, false)
+	var acked chan struct{}
+	//the client could acknowledge the message as soon as it is queued
+	if pp.Qos > 0 {
+		acked = c.awaitAck(pp.UUID())
+	}
+	c.deliver(pp, h)
+	if pp.Qos > 0 && pp.MessageID == 0 {
+		c.cancelAck(pp.UUID())
+		return nil, errors.New("The client has too many messages inflight")
+	}
+	h.sessionLog.Info("Injected message for client", "client", clientID, "topic", pp.TopicName, "qos", pp.Qos)
+	return acked, nil
+}
@@ -0,0 +1,232 @@
+package hrotti
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//LogLevel is how much a component logs, each level includes the ones before it
+type LogLevel int32
+
+const (
+	LogOff LogLevel = iota
+	LogError
+	LogWarn
+	LogInfo
+	LogDebug
+	LogTrace
+)
+
+var logLevelNames = []string{"off", "error", "warn", "info", "debug", "trace"}
+
+func (l LogLevel) String() string {
+	if l < LogOff || int(l) >= len(logLevelNames) {
+		return strconv.Itoa(int(l))
+	}
+	return logLevelNames[l]
+}
+
+//ParseLogLevel returns the LogLevel called name, off, error, warn, info, debug or trace
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, n := range logLevelNames {
+		if n == name {
+			return LogLevel(i), nil
+		}
+	}
+	return LogOff, fmt.Errorf("Unknown log level %q, it should be one of off, error, warn, info, debug or trace", name)
+}
+
+//a logger is the log for one component of the broker, its level is checked before any
+//formatting is done so a disabled level costs a single atomic load. A nil logger logs
+//nothing.
+type logger struct {
+	component string
+	level     int32
+	output    *logOutput
+}
+
+//logOutput is where a broker's components write, lines are written whole under the lock so
+//they don't interleave
+type logOutput struct {
+	sync.Mutex
+	w    io.Writer
+	json bool
+}
+
+//loggers are the logs of one broker's components, the level of each can be set separately
+//and they share an output. Each Hrotti has its own, so brokers embedded in one program can
+//log at different levels to different places.
+type loggers struct {
+	output         *logOutput
+	listenerLog    *logger
+	sessionLog     *logger
+	packetsLog     *logger
+	persistenceLog *logger
+	bridgeLog      *logger
+}
+
+//newLoggers returns loggers writing text to w with every component at info
+func newLoggers(w io.Writer) *loggers {
+	output := &logOutput{w: w}
+	component := func(name string) *logger {
+		return &logger{component: name, level: int32(LogInfo), output: output}
+	}
+	return &loggers{
+		output:         output,
+		listenerLog:    component("listener"),
+		sessionLog:     component("session"),
+		packetsLog:     component("packets"),
+		persistenceLog: component("persistence"),
+		bridgeLog:      component("bridge"),
+	}
+}
+
+//defaultLoggers are copied by each Hrotti when it is created, set by SetLogOutput and
+//SetLogLevel
+var defaultLoggers = newLoggers(os.Stderr)
+
+func (l *loggers) components() []*logger {
+	return []*logger{l.listenerLog, l.sessionLog, l.packetsLog, l.persistenceLog, l.bridgeLog}
+}
+
+//clone returns loggers with the same output and levels as l that can be changed without
+//changing l
+func (l *loggers) clone() *loggers {
+	l.output.Lock()
+	c := newLoggers(l.output.w)
+	c.output.json = l.output.json
+	l.output.Unlock()
+	for i, component := range c.components() {
+		atomic.StoreInt32(&component.level, atomic.LoadInt32(&l.components()[i].level))
+	}
+	return c
+}
+
+func (l *loggers) setOutput(w io.Writer, asJSON bool) {
+	l.output.Lock()
+	l.output.w = w
+	l.output.json = asJSON
+	l.output.Unlock()
+}
+
+func (l *loggers) setLevel(component string, level LogLevel) error {
+	found := false
+	for _, c := range l.components() {
+		if component == "" || c.component == component {
+			atomic.StoreInt32(&c.level, int32(level))
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("Unknown log component " + strconv.Quote(component))
+	}
+	return nil
+}
+
+//SetLogOutput sets where brokers created after it is called log, with asJSON set each line
+//is a JSON object with time, level, component and msg fields plus the fields of the message,
+//for log shippers. By default a broker logs text to stderr. It is for the standalone broker,
+//an embedded Broker sets its own with WithLogOutput.
+func SetLogOutput(w io.Writer, asJSON bool) {
+	defaultLoggers.setOutput(w, asJSON)
+}
+
+//SetLogLevel sets the level brokers created after it is called log component at, one of
+//listener, session, packets, persistence or bridge, or every component if component is
+//empty. Every component defaults to info. It is for the standalone broker, an embedded
+//Broker sets its own with WithLogLevel.
+func SetLogLevel(component string, level LogLevel) error {
+	return defaultLoggers.setLevel(component, level)
+}
+
+//SetLogOutput sets where h logs, as the package's SetLogOutput does for new brokers
+func (h *Hrotti) SetLogOutput(w io.Writer, asJSON bool) {
+	h.loggers.setOutput(w, asJSON)
+}
+
+//SetLogLevel sets the level h logs component at, as the package's SetLogLevel does for new
+//brokers
+func (h *Hrotti) SetLogLevel(component string, level LogLevel) error {
+	return h.loggers.setLevel(component, level)
+}
+
+//enabled is true if the logger logs messages at level, callers building expensive fields
+//should check it first
+func (l *logger) enabled(level LogLevel) bool {
+	return l != nil && LogLevel(atomic.LoadInt32(&l.level)) >= level
+}
+
+//Error, Warn, Info, Debug and Trace log msg with fields, given as alternating names and
+//values, if the logger's level includes them
+func (l *logger) Error(msg string, fields ...interface{}) { l.log(LogError, msg, fields) }
+func (l *logger) Warn(msg string, fields ...interface{})  { l.log(LogWarn, msg, fields) }
+func (l *logger) Info(msg string, fields ...interface{})  { l.log(LogInfo, msg, fields) }
+func (l *logger) Debug(msg string, fields ...interface{}) { l.log(LogDebug, msg, fields) }
+func (l *logger) Trace(msg string, fields ...interface{}) { l.log(LogTrace, msg, fields) }
+
+func (l *logger) log(level LogLevel, msg string, fields []interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	var b bytes.Buffer
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	l.output.Lock()
+	defer l.output.Unlock()
+	if l.output.json {
+		b.WriteString(`{"time":`)
+		writeLogJSON(&b, now)
+		b.WriteString(`,"level":`)
+		writeLogJSON(&b, level.String())
+		b.WriteString(`,"component":`)
+		writeLogJSON(&b, l.component)
+		b.WriteString(`,"msg":`)
+		writeLogJSON(&b, msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			b.WriteByte(',')
+			writeLogJSON(&b, fmt.Sprint(fields[i]))
+			b.WriteByte(':')
+			writeLogJSON(&b, logValue(fields[i+1]))
+		}
+		b.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&b, "%s %-5s %s: %s", now, strings.ToUpper(level.String()), l.component, msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			value := fmt.Sprint(logValue(fields[i+1]))
+			if value == "" || strings.ContainsAny(value, " \"=") {
+				value = strconv.Quote(value)
+			}
+			fmt.Fprintf(&b, " %v=%s", fields[i], value)
+		}
+		b.WriteByte('\n')
+	}
+	l.output.w.Write(b.Bytes())
+}
+
+//logValue turns errors and anything with a String method into strings so they read the
+//same in JSON as in text
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeLogJSON(b *bytes.Buffer, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		out, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(out)
+}
@@ -0,0 +1,167 @@
+package hrotti
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+//matchCache remembers the levels of the most recently published topics and the
+//subscriptions matching them, so a topic published to again isn't split and matched against
+//the filter tree every time. An entry keeps what its match depended on, the generation of
+//each node of the tree it visited and the children it looked for that weren't there, and is
+//only used while they are unchanged. So a subscription being added or removed only
+//invalidates the entries for topics whose match went through the nodes it changed, and
+//subscribing to a filter that already has subscribers, or unsubscribing from one that still
+//has some, invalidates nothing as the subscribers are looked up for each message. The
+//subscriptionMap lock orders the changes to the tree and the cache's own lock lets entries be
+//used and stored under the read lock.
+type matchCache struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	//lru is the entries, most recently used first
+	lru           *list.List
+	max           int
+	hits          int64
+	misses        int64
+	invalidations int64
+}
+
+//a matchEntry is a topic split into its levels and the subscriptions matching it
+type matchEntry struct {
+	topic         string
+	levels        []string
+	subscriptions []string
+	trace         matchTrace
+}
+
+//a matchTrace is what a match of the filter tree depended on
+type matchTrace struct {
+	visited []visitedNode
+	absent  []absentChild
+}
+
+type visitedNode struct {
+	node       *topicNode
+	generation uint64
+}
+
+type absentChild struct {
+	node  *topicNode
+	level string
+}
+
+func newMatchCache() *matchCache {
+	return &matchCache{entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+//visit records that the match visited n
+func (t *matchTrace) visit(n *topicNode) {
+	if t != nil {
+		t.visited = append(t.visited, visitedNode{n, n.generation})
+	}
+}
+
+//valid is true if matching again would find the same subscriptions, the subscriptionMap
+//must be locked
+func (t *matchTrace) valid() bool {
+	for _, v := range t.visited {
+		if v.node.generation != v.generation {
+			return false
+		}
+	}
+	for _, a := range t.absent {
+		if _, ok := a.node.children[a.level]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+//setSize sets the most topics cached, 0 turns the cache off, and evicts entries until the
+//cache is within it
+func (m *matchCache) setSize(max int) {
+	m.Lock()
+	defer m.Unlock()
+	m.max = max
+	m.evict()
+}
+
+//get returns the entry for topic if there is one that is still valid, cached is false if
+//the cache is off. The subscriptionMap must be locked.
+func (m *matchCache) get(topic string) (entry *matchEntry, cached bool) {
+	m.Lock()
+	defer m.Unlock()
+	if m.max <= 0 {
+		return nil, false
+	}
+	element, ok := m.entries[topic]
+	if !ok {
+		atomic.AddInt64(&m.misses, 1)
+		return nil, true
+	}
+	entry = element.Value.(*matchEntry)
+	if !entry.trace.valid() {
+		m.lru.Remove(element)
+		delete(m.entries, topic)
+		atomic.AddInt64(&m.invalidations, 1)
+		atomic.AddInt64(&m.misses, 1)
+		return nil, true
+	}
+	m.lru.MoveToFront(element)
+	atomic.AddInt64(&m.hits, 1)
+	return entry, true
+}
+
+//put adds entry to the cache, evicting the least recently used entries if it is full
+func (m *matchCache) put(entry *matchEntry) {
+	m.Lock()
+	defer m.Unlock()
+	if m.max <= 0 {
+		return
+	}
+	if element, ok := m.entries[entry.topic]; ok {
+		element.Value = entry
+		m.lru.MoveToFront(element)
+		return
+	}
+	m.entries[entry.topic] = m.lru.PushFront(entry)
+	m.evict()
+}
+
+//evict removes the least recently used entries until there are no more than max, the
+//cache must be locked
+func (m *matchCache) evict() {
+	for m.lru.Len() > m.max && m.lru.Len() > 0 {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.entries, oldest.Value.(*matchEntry).topic)
+	}
+}
+
+func (m *matchCache) len() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.lru.Len()
+}
+
+//matching returns topic split into its levels and the subscriptions with filters matching
+//it, from the match cache if it has them. The subscriptionMap must be locked.
+func (s *subscriptionMap) matching(topic string) ([]string, []string) {
+	entry, cached := s.matches.get(topic)
+	if entry != nil {
+		return entry.levels, entry.subscriptions
+	}
+	entry = &matchEntry{topic: topic, levels: topicLevels(topic)}
+	var trace *matchTrace
+	if cached {
+		trace = &entry.trace
+	}
+	s.filters.matchTraced(entry.levels, func(subscription string) {
+		entry.subscriptions = append(entry.subscriptions, subscription)
+	}, trace)
+	if cached {
+		s.matches.put(entry)
+	}
+	return entry.levels, entry.subscriptions
+}
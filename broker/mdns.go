@@ -0,0 +1,303 @@
+package hrotti
+
+import (
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//mdnsAddr is the multicast group and port mDNS queries and announcements are sent to
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+//mdnsTTL is how long in seconds the advertised records can be cached for
+const mdnsTTL = 120
+
+//mdnsServices are the DNS-SD service types of the listener schemes that are advertised,
+//WebSocket listeners aren't as there is no service type registered for MQTT over them
+var mdnsServices = map[string]string{
+	"tcp": "_mqtt._tcp.local.",
+	"tls": "_secure-mqtt._tcp.local.",
+	"ssl": "_secure-mqtt._tcp.local.",
+}
+
+//mdnsBrowse is the name queried to find every service type on the network
+const mdnsBrowse = "_services._dns-sd._udp.local."
+
+//mdnsProtocols is the TXT record listing the MQTT versions the broker speaks
+var mdnsProtocols = []string{"txtvers=1", "protocols=3.1,3.1.1"}
+
+//mdnsCacheFlush is the class of a record only this host answers for, telling other hosts
+//to replace what they have cached for it
+const mdnsCacheFlush = dnsmessage.ClassINET | 1<<15
+
+//mdnsListener is a listener being advertised
+type mdnsListener struct {
+	service string
+	port    uint16
+}
+
+//mdnsResponder advertises the broker's listeners with multicast DNS so clients on the LAN
+//can find it with DNS-SD. It answers queries for the service types, the instance of each
+//listener and the host's addresses, announces a listener when it starts and sends goodbyes
+//when it stops.
+type mdnsResponder struct {
+	sync.Mutex
+	//name is the instance name of the broker's services, a service type with several
+	//listeners has an instance for each named after the listener as well
+	name      string
+	host      string
+	listeners map[string]mdnsListener
+	conn      *net.UDPConn
+	log       *logger
+}
+
+//newMDNSResponder returns a responder advertising as name, it doesn't send anything
+//until listen is called
+func newMDNSResponder(name string, log *logger) *mdnsResponder {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "hrotti"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	return &mdnsResponder{name: name, host: host + ".local.", listeners: make(map[string]mdnsListener), log: log}
+}
+
+//listen joins the mDNS multicast group and answers queries until close is called
+func (r *mdnsResponder) listen() error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsAddr)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	r.conn = conn
+	r.Unlock()
+	go func() {
+		buf := make([]byte, 9000)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			response, ok := r.respond(buf[:n], from.Port != mdnsAddr.Port)
+			if !ok {
+				continue
+			}
+			//a query from a port other than 5353 is a plain DNS query sent to the group,
+			//which is answered directly
+			to := mdnsAddr
+			if from.Port != mdnsAddr.Port {
+				to = from
+			}
+			conn.WriteToUDP(response, to)
+		}
+	}()
+	return nil
+}
+
+//advertise announces listener, or announces it again if it was restarted on another port.
+//It is announced twice a second apart as the first can be lost.
+func (r *mdnsResponder) advertise(listener string, scheme string, addr net.Addr) {
+	service, ok := mdnsServices[scheme]
+	tcpAddr, isTCP := addr.(*net.TCPAddr)
+	if !ok || !isTCP || tcpAddr.IP.IsLoopback() {
+		return
+	}
+	r.Lock()
+	r.listeners[listener] = mdnsListener{service: service, port: uint16(tcpAddr.Port)}
+	r.Unlock()
+	r.log.Info("Advertising listener with mDNS", "listener", listener, "service", service, "port", tcpAddr.Port)
+	r.announce(mdnsTTL)
+	time.AfterFunc(time.Second, func() { r.announce(mdnsTTL) })
+}
+
+//withdraw sends a goodbye for listener so clients stop using it
+func (r *mdnsResponder) withdraw(listener string) {
+	r.Lock()
+	l, ok := r.listeners[listener]
+	var goodbye []dnsmessage.Resource
+	if ok {
+		goodbye = r.instanceRecords(0, listener, l)
+		delete(r.listeners, listener)
+	}
+	r.Unlock()
+	if ok {
+		r.send(r.message(0, goodbye))
+	}
+}
+
+//close sends goodbyes for every listener and leaves the multicast group
+func (r *mdnsResponder) close() {
+	r.announce(0)
+	r.Lock()
+	defer r.Unlock()
+	if r.conn != nil {
+		r.conn.Close()
+	}
+}
+
+//announce sends every record with ttl, a ttl of 0 is a goodbye
+func (r *mdnsResponder) announce(ttl uint32) {
+	r.send(r.message(0, r.records(ttl)))
+}
+
+func (r *mdnsResponder) send(msg []byte) {
+	r.Lock()
+	conn := r.conn
+	r.Unlock()
+	if conn == nil || msg == nil {
+		return
+	}
+	if _, err := conn.WriteToUDP(msg, mdnsAddr); err != nil {
+		r.log.Warn("Failed to send mDNS announcement", "err", err)
+	}
+}
+
+//message packs answers into a response, nil if it can't be packed
+func (r *mdnsResponder) message(id uint16, answers []dnsmessage.Resource, questions ...dnsmessage.Question) []byte {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Questions: questions,
+		Answers:   answers,
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		r.log.Warn("Failed to pack mDNS response", "err", err)
+		return nil
+	}
+	return packed
+}
+
+//instance returns the instance name of listener, the broker's name unless its service type
+//has more than one listener. It is called with the lock held.
+func (r *mdnsResponder) instance(listener string, service string) string {
+	for name, l := range r.listeners {
+		if name != listener && l.service == service {
+			return r.name + " (" + listener + ")." + service
+		}
+	}
+	return r.name + "." + service
+}
+
+//records returns every record the responder answers for, the services, the instances of
+//the listeners and the host's addresses
+func (r *mdnsResponder) records(ttl uint32) []dnsmessage.Resource {
+	r.Lock()
+	names := make([]string, 0, len(r.listeners))
+	for name := range r.listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var records []dnsmessage.Resource
+	services := make(map[string]bool)
+	for _, name := range names {
+		l := r.listeners[name]
+		if !services[l.service] {
+			services[l.service] = true
+			records = append(records, mdnsRecord(mdnsBrowse, ttl, dnsmessage.ClassINET, &dnsmessage.PTRResource{PTR: mdnsName(l.service)}))
+		}
+		records = append(records, r.instanceRecords(ttl, name, l)...)
+	}
+	r.Unlock()
+	if len(records) == 0 {
+		return nil
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			a := &dnsmessage.AResource{}
+			copy(a.A[:], ip4)
+			records = append(records, mdnsRecord(r.host, ttl, mdnsCacheFlush, a))
+		} else {
+			aaaa := &dnsmessage.AAAAResource{}
+			copy(aaaa.AAAA[:], ipNet.IP.To16())
+			records = append(records, mdnsRecord(r.host, ttl, mdnsCacheFlush, aaaa))
+		}
+	}
+	return records
+}
+
+//instanceRecords returns the PTR from the service type to a listener's instance, and the
+//instance's SRV and TXT. It is called with the lock held.
+func (r *mdnsResponder) instanceRecords(ttl uint32, name string, l mdnsListener) []dnsmessage.Resource {
+	instance := r.instance(name, l.service)
+	return []dnsmessage.Resource{
+		mdnsRecord(l.service, ttl, dnsmessage.ClassINET, &dnsmessage.PTRResource{PTR: mdnsName(instance)}),
+		mdnsRecord(instance, ttl, mdnsCacheFlush, &dnsmessage.SRVResource{Port: l.port, Target: mdnsName(r.host)}),
+		mdnsRecord(instance, ttl, mdnsCacheFlush, &dnsmessage.TXTResource{TXT: mdnsProtocols}),
+	}
+}
+
+//respond returns the response to a query, ok is false if it isn't a query for anything the
+//responder has. A legacy query from a plain DNS resolver gets its id and questions back.
+func (r *mdnsResponder) respond(query []byte, legacy bool) ([]byte, bool) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil, false
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, false
+	}
+	records := r.records(mdnsTTL)
+	var answers []dnsmessage.Resource
+	answered := make(map[int]bool)
+	for _, q := range questions {
+		for i, record := range records {
+			if !answered[i] && strings.EqualFold(q.Name.String(), record.Header.Name.String()) && (q.Type == record.Header.Type || q.Type == dnsmessage.TypeALL) {
+				answered[i] = true
+				answers = append(answers, record)
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return nil, false
+	}
+	//the SRV, TXT and addresses a client asking for the services will want next are added
+	//so it doesn't have to ask again
+	for i, record := range records {
+		if !answered[i] && record.Header.Type != dnsmessage.TypePTR {
+			answers = append(answers, record)
+		}
+	}
+	if !legacy {
+		return r.message(0, answers), true
+	}
+	return r.message(header.ID, answers, questions...), true
+}
+
+func mdnsRecord(name string, ttl uint32, class dnsmessage.Class, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	var resourceType dnsmessage.Type
+	switch body.(type) {
+	case *dnsmessage.PTRResource:
+		resourceType = dnsmessage.TypePTR
+	case *dnsmessage.SRVResource:
+		resourceType = dnsmessage.TypeSRV
+	case *dnsmessage.TXTResource:
+		resourceType = dnsmessage.TypeTXT
+	case *dnsmessage.AResource:
+		resourceType = dnsmessage.TypeA
+	case *dnsmessage.AAAAResource:
+		resourceType = dnsmessage.TypeAAAA
+	}
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: mdnsName(name), Type: resourceType, Class: class, TTL: ttl},
+		Body:   body,
+	}
+}
+
+//mdnsName returns name as a dnsmessage.Name, a name with a label that is too long fails
+//when the message is packed
+func mdnsName(name string) dnsmessage.Name {
+	n, _ := dnsmessage.NewName(name)
+	return n
+}
@@ -1,179 +1,155 @@
 package hrotti
 
 import (
-	. "github.com/alsm/hrotti/packets"
-	"github.com/google/uuid"
+	"sort"
 	"sync"
+
+	. "github.com/alsm/hrotti/packets"
 )
 
-//a persistence entry is a map of msgIds and ControlPackets
-type MemoryPersistenceEntry struct {
-	sync.Mutex
-	messages map[string]ControlPacket
+//an inflightKey identifies a message in a client's inflight store
+type inflightKey struct {
+	direction dirFlag
+	msgID     uint16
 }
 
-//the MemoryPersistence struct is a map of client pointers to pointers
-//to a Persistence Entry. So each client has its own map of msgIds/packets.
+//MemoryPersistence keeps everything in memory so nothing survives a restart, it is
+//the default persistence for the broker.
 type MemoryPersistence struct {
 	sync.RWMutex
-	inbound  map[string]*MemoryPersistenceEntry
-	outbound map[string]*MemoryPersistenceEntry
+	retained map[string]*PublishPacket
+	sessions map[string]*Session
+	inflight map[string]map[inflightKey]ControlPacket
+	log      *logger
 }
 
-func (p *MemoryPersistence) Init() error {
-	//init the Memory persistence, we haven't created our persistenceentrys yet
-	p.inbound = make(map[string]*MemoryPersistenceEntry)
-	p.outbound = make(map[string]*MemoryPersistenceEntry)
+//setLog sets the logger p traces to, that of the broker using it
+func (p *MemoryPersistence) setLog(log *logger) {
+	p.Lock()
+	p.log = log
+	p.Unlock()
+}
+
+func (p *MemoryPersistence) Open() error {
+	p.Lock()
+	defer p.Unlock()
+	p.retained = make(map[string]*PublishPacket)
+	p.sessions = make(map[string]*Session)
+	p.inflight = make(map[string]map[inflightKey]ControlPacket)
+	return nil
+}
+
+func (p *MemoryPersistence) Close() error {
 	return nil
 }
 
-func (p *MemoryPersistence) Open(client string) {
-	//lock the whole persistence store while we add a new client entry
+func (p *MemoryPersistence) StoreRetained(topic string, message *PublishPacket) error {
 	p.Lock()
 	defer p.Unlock()
-	DEBUG.Println("Opening memory persistence for", client)
-	//init the MemoryPersistenceEntry for this client
-	p.inbound[client] = &MemoryPersistenceEntry{messages: make(map[string]ControlPacket)}
-	p.outbound[client] = &MemoryPersistenceEntry{messages: make(map[string]ControlPacket)}
+	p.retained[topic] = message
+	return nil
 }
 
-func (p *MemoryPersistence) Close(client string) {
-	//lock the whole persistence store while we delete a client from the map
+func (p *MemoryPersistence) LoadRetained(topic string) (*PublishPacket, error) {
+	p.RLock()
+	defer p.RUnlock()
+	return p.retained[topic], nil
+}
+
+func (p *MemoryPersistence) DeleteRetained(topic string) error {
 	p.Lock()
 	defer p.Unlock()
-	delete(p.inbound, client)
-	delete(p.outbound, client)
+	delete(p.retained, topic)
+	return nil
 }
 
-func (p *MemoryPersistence) Add(client string, direction dirFlag, message ControlPacket) bool {
-	//only need to get a read lock on the persistence store, but lock the underlying
-	//persistenceentry for the client we're working with.
+func (p *MemoryPersistence) RangeRetained(f func(string, *PublishPacket) bool) error {
 	p.RLock()
 	defer p.RUnlock()
-	//the uuid is the key in the persistence entry
-	id := message.UUID().String()
-	switch direction {
-	case INBOUND:
-		p.inbound[client].Lock()
-		defer p.inbound[client].Unlock()
-		DEBUG.Println("Persisting inbound packet for", client, id)
-		//if there is already an entry for this message id return false
-		if _, ok := p.inbound[client].messages[id]; ok {
-			return false
-		}
-		//otherwise insert this message into the map
-		p.inbound[client].messages[id] = message
-	case OUTBOUND:
-		p.outbound[client].Lock()
-		defer p.outbound[client].Unlock()
-		DEBUG.Println("Persisting outbound packet for", client, id)
-		//if there is already an entry for this message id return false
-		if _, ok := p.outbound[client].messages[id]; ok {
-			return false
+	for topic, message := range p.retained {
+		if !f(topic, message) {
+			break
 		}
-		//otherwise insert this message into the map
-		p.outbound[client].messages[id] = message
 	}
-	return true
+	return nil
 }
 
-func (p *MemoryPersistence) Replace(client string, direction dirFlag, message ControlPacket) bool {
-	//only need to get a read lock on the persistence store, but lock the underlying
-	//persistenceentry for the client we're working with.
+func (p *MemoryPersistence) StoreSession(client string, session *Session) error {
+	p.Lock()
+	defer p.Unlock()
+	p.sessions[client] = session
+	return nil
+}
+
+func (p *MemoryPersistence) LoadSession(client string) (*Session, error) {
 	p.RLock()
 	defer p.RUnlock()
-
-	id := message.UUID().String()
-	switch direction {
-	//For QoS2 flows we want to replace the original PUBLISH with the related PUBREL
-	//as it maintains the same message id
-	case INBOUND:
-		p.inbound[client].Lock()
-		defer p.inbound[client].Unlock()
-		DEBUG.Println("Replacing persisted message for", client, id)
-		//if there is already an entry for this message id return false
-		if _, ok := p.inbound[client].messages[id]; ok {
-			return false
-		}
-		//otherwise insert this message into the map
-		p.inbound[client].messages[id] = message
-	case OUTBOUND:
-		p.outbound[client].Lock()
-		defer p.outbound[client].Unlock()
-		DEBUG.Println("Replacing persisted message for", client, id)
-		//if there is already an entry for this message id return false
-		if _, ok := p.outbound[client].messages[id]; ok {
-			return false
-		}
-		//otherwise insert this message into the map
-		p.outbound[client].messages[id] = message
-	}
-	return true
+	return p.sessions[client], nil
 }
 
-func (p *MemoryPersistence) AddBatch(batch map[string]*PublishPacket) {
-	//adding messages to many different client entries at the same time, as we're doing
-	//this grabbing a full lock on the whole persistence mechanism
+//DeleteSession removes the session and any inflight messages for client
+func (p *MemoryPersistence) DeleteSession(client string) error {
 	p.Lock()
 	defer p.Unlock()
-	//the batch is a map keyed by client and value is a pointer to a PUBLISH
-	//for each create an appropriate entry
-	for client, message := range batch {
-		p.inbound[client].messages[message.UUID().String()] = message
-	}
+	delete(p.sessions, client)
+	delete(p.inflight, client)
+	return nil
 }
 
-func (p *MemoryPersistence) Delete(client string, direction dirFlag, uid uuid.UUID) bool {
-	//only need to get a read lock on the persistence store, but lock the underlying
-	//persistenceentry for the client we're working with.
+func (p *MemoryPersistence) RangeSessions(f func(string, *Session) bool) error {
 	p.RLock()
 	defer p.RUnlock()
-	//checks that there is actually an entry for the message id we're being asked to
-	//delete, if there isn't return false, otherwise delete the entry.
-	id := uid.String()
-	DEBUG.Println("Removing persisted message for", client)
-	switch direction {
-	case INBOUND:
-		p.inbound[client].Lock()
-		defer p.inbound[client].Unlock()
-		//if there is already an entry for this message id return false
-		if _, ok := p.inbound[client].messages[id]; !ok {
-			return false
-		}
-		delete(p.inbound[client].messages, id)
-	case OUTBOUND:
-		p.outbound[client].Lock()
-		defer p.outbound[client].Unlock()
-		//if there is already an entry for this message id return false
-		if _, ok := p.outbound[client].messages[id]; !ok {
-			return false
+	for client, session := range p.sessions {
+		if !f(client, session) {
+			break
 		}
-		delete(p.outbound[client].messages, id)
 	}
-	return true
+	return nil
 }
 
-func (p *MemoryPersistence) GetAll(client string) (messages []ControlPacket) {
-	//only need to get a read lock on the persistence store, but lock the underlying
-	//persistenceentry for the client we're working with.
-	p.RLock()
-	p.outbound[client].Lock()
-	defer p.outbound[client].Unlock()
-	defer p.RUnlock()
-	//Get every message in the persistence store for a given client, create a slice
-	//of the ControlPackets (not just PUBLISHES in there)
-	for _, message := range p.outbound[client].messages {
-		messages = append(messages, message)
+func (p *MemoryPersistence) StoreInflight(client string, direction dirFlag, msgID uint16, message ControlPacket) error {
+	p.Lock()
+	defer p.Unlock()
+	p.log.Trace("Persisting inflight message", "client", client, "id", msgID)
+	if _, ok := p.inflight[client]; !ok {
+		p.inflight[client] = make(map[inflightKey]ControlPacket)
 	}
-	return messages
+	p.inflight[client][inflightKey{direction, msgID}] = message
+	return nil
 }
 
-func (p *MemoryPersistence) Exists(client string) bool {
-	//grab a read lock on the persistence and check if there is already an entry
-	//for this client.
+func (p *MemoryPersistence) DeleteInflight(client string, direction dirFlag, msgID uint16) error {
+	p.Lock()
+	defer p.Unlock()
+	p.log.Trace("Removing inflight message", "client", client, "id", msgID)
+	delete(p.inflight[client], inflightKey{direction, msgID})
+	return nil
+}
+
+//RangeInflight calls f for the inflight messages for client in direction and message id
+//order, the same order as the BoltPersistence
+func (p *MemoryPersistence) RangeInflight(client string, f func(dirFlag, uint16, ControlPacket) bool) error {
 	p.RLock()
-	defer p.RUnlock()
-	_, okInbound := p.inbound[client]
-	_, okOutbound := p.outbound[client]
-	return okInbound && okOutbound
+	keys := make([]inflightKey, 0, len(p.inflight[client]))
+	for key := range p.inflight[client] {
+		keys = append(keys, key)
+	}
+	messages := make([]ControlPacket, len(keys))
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].direction != keys[j].direction {
+			return keys[i].direction < keys[j].direction
+		}
+		return keys[i].msgID < keys[j].msgID
+	})
+	for i, key := range keys {
+		messages[i] = p.inflight[client][key]
+	}
+	p.RUnlock()
+	//f is called without the lock held so it can modify the store
+	for i, key := range keys {
+		if !f(key.direction, key.msgID, messages[i]) {
+			break
+		}
+	}
+	return nil
 }
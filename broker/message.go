@@ -0,0 +1,82 @@
+package hrotti
+
+import (
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//Message is a message being routed by the broker, separate from the PUBLISH packets that
+//carry it. It is made once when the broker takes the message in, from a client's PUBLISH,
+//the admin API, a will, a bridge or the broker itself, and is never changed after that, so
+//the routing, the retained store and every subscriber it goes to share it without copying.
+//What differs for each subscriber, the QoS it is sent at, its message id and the dup and
+//retain flags, is only set on the PUBLISH made for that subscriber by packet, which shares
+//the message's payload and encoded topic.
+//
+//The payload isn't reference counted. Nothing changes or reuses a payload once it is in a
+//Message, a transform gives the subscriber's packet a new one, so it is freed by the garbage
+//collector once the message and the last packet made from it have gone.
+type Message struct {
+	Topic      string
+	Payload    []byte
+	Qos        byte
+	Retain     bool
+	Properties *Properties
+	//Publisher is the client id of the client that published the message, empty if the
+	//broker published it
+	Publisher string
+	//Hops is how many bridges the message has crossed
+	Hops       int
+	ReceivedAt time.Time
+	ExpiresAt  time.Time
+	//template is the PUBLISH the packets for each subscriber are copied from, so the topic is
+	//encoded once for all of them
+	template *PublishPacket
+}
+
+//newMessage makes the message pp carries, to be routed by topic
+func newMessage(topic string, pp *PublishPacket) *Message {
+	m := &Message{
+		Topic:      topic,
+		Payload:    pp.Payload,
+		Qos:        pp.Qos,
+		Retain:     pp.Retain,
+		Properties: pp.Properties,
+		Publisher:  pp.Publisher,
+		Hops:       pp.Hops,
+		ReceivedAt: pp.ReceivedAt,
+		ExpiresAt:  pp.ExpiresAt,
+	}
+	template := NewControlPacket(PUBLISH).(*PublishPacket)
+	template.TopicName = topic
+	template.Payload = m.Payload
+	template.Properties = m.Properties
+	template.Publisher = m.Publisher
+	template.Hops = m.Hops
+	template.ReceivedAt = m.ReceivedAt
+	template.ExpiresAt = m.ExpiresAt
+	//the copy keeps the topic it encoded for the copies made from it
+	m.template = template.Copy()
+	return m
+}
+
+//ingest makes the message for pp, published to topic, stamping it with when it was received
+//and when it expires if it hasn't been already
+func (h *Hrotti) ingest(topic string, pp *PublishPacket) *Message {
+	h.received(pp)
+	if h.MessageExpiry > 0 && pp.ExpiresAt.IsZero() {
+		pp.ExpiresAt = pp.ReceivedAt.Add(h.MessageExpiry)
+	}
+	return newMessage(topic, pp)
+}
+
+//packet returns a PUBLISH of the message at qos for one subscriber, with retain set for a
+//retained message sent to a new subscription. It is the subscriber's own to give a message
+//id, queue and persist, but shares the message's payload, which mustn't be changed.
+func (m *Message) packet(qos byte, retain bool) *PublishPacket {
+	p := m.template.Copy()
+	p.Qos = qos
+	p.Retain = retain
+	return p
+}
@@ -1,19 +1,38 @@
 package hrotti
 
 import (
-	"github.com/google/uuid"
+	"sort"
 	"sync"
+
+	. "github.com/alsm/hrotti/packets"
+	"github.com/google/uuid"
 )
 
 type messageIDs struct {
 	sync.RWMutex
 	//idChan chan uint16
 	index map[uint16]*uuid.UUID
+	//last is the most recently allocated id, ids are allocated in sequence after it so
+	//the order of the ids in use is the order they were allocated in
+	last uint16
+	//sent is the messages with ids in use that have been written to the client, see sentInflight
+	sent map[uint16]*inflightMessage
+	//ackWaiters are closed when the client acknowledges the message with their uuid, see awaitAck
+	ackWaiters map[uuid.UUID]chan struct{}
+	//shared is the shared subscription each message given to the client by a group was
+	//delivered through, so it can be moved to another member if the client goes, see
+	//redistributeShared
+	shared map[uuid.UUID]string
+	//queued is the payload size of each message with an id in use that is counted against
+	//the quota of queuedTo, the principal the client's session belongs to, see holdQueued
+	queued   map[uint16]int64
+	queuedTo *quotaUsage
 }
 
 const (
 	msgIDMax uint16 = 65535
 	msgIDMin uint16 = 1
+	msgIDs          = int(msgIDMax - msgIDMin)
 )
 
 /*func (c *Client) genMsgIDs() {
@@ -39,13 +58,53 @@ const (
 func (m *messageIDs) getMsgID(id uuid.UUID) uint16 {
 	m.Lock()
 	defer m.Unlock()
-	for i := msgIDMin; i < msgIDMax; i++ {
-		if m.index[i] == nil {
-			m.index[i] = &id
-			return i
+	next := NextMessageID(m.last, func(msgID uint16) bool { return m.index[msgID] != nil })
+	if next != 0 {
+		m.last = next
+		m.index[next] = &id
+	}
+	return next
+}
+
+//age is how many ids were allocated before msgID in the current sequence, 0 is the
+//oldest id that could be in use
+func (m *messageIDs) age(msgID uint16) int {
+	return (int(msgID) - int(m.last) - 1 + msgIDs) % msgIDs
+}
+
+//sortByAge sorts ids, which should all be in use, into the order they were allocated in
+func (m *messageIDs) sortByAge(ids []uint16) {
+	m.RLock()
+	defer m.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return m.age(ids[i]) < m.age(ids[j]) })
+}
+
+//resumeSequence sets the last allocated id from the ids in use after they have been
+//restored with claimID. The sequence is assumed to restart after the largest gap
+//between ids in use, where the ids wrapped round most recently.
+func (m *messageIDs) resumeSequence() {
+	m.Lock()
+	defer m.Unlock()
+	var ids []int
+	for id, u := range m.index {
+		if u != nil {
+			ids = append(ids, int(id))
 		}
 	}
-	return 0
+	if len(ids) == 0 {
+		return
+	}
+	sort.Ints(ids)
+	//the gap from the last id wrapping round to the first
+	newest := ids[len(ids)-1]
+	gap := ids[0] + msgIDs - newest
+	for i := 1; i < len(ids); i++ {
+		if ids[i]-ids[i-1] > gap {
+			gap = ids[i] - ids[i-1]
+			newest = ids[i-1]
+		}
+	}
+	m.last = uint16(newest)
 }
 
 func (m *messageIDs) inUse(id uint16) bool {
@@ -57,5 +116,111 @@ func (m *messageIDs) inUse(id uint16) bool {
 func (m *messageIDs) freeID(id uint16) {
 	m.Lock()
 	defer m.Unlock()
-	m.index[id] = nil
+	if u := m.index[id]; u != nil {
+		delete(m.shared, *u)
+	}
+	m.releaseQueued(id)
+	delete(m.index, id)
+	delete(m.sent, id)
+}
+
+//ackID frees id once the client has acknowledged the message sent with it, with a PUBACK
+//or PUBCOMP, closing the channel of anything waiting for the acknowledgement
+func (m *messageIDs) ackID(id uint16) {
+	m.Lock()
+	defer m.Unlock()
+	if u := m.index[id]; u != nil {
+		if waiter, ok := m.ackWaiters[*u]; ok {
+			close(waiter)
+			delete(m.ackWaiters, *u)
+		}
+		delete(m.shared, *u)
+	}
+	m.releaseQueued(id)
+	delete(m.index, id)
+	delete(m.sent, id)
+}
+
+//awaitAck returns a channel that is closed when the client acknowledges the message with
+//uuid id, it has to be called before the message is queued
+func (m *messageIDs) awaitAck(id uuid.UUID) chan struct{} {
+	m.Lock()
+	defer m.Unlock()
+	if m.ackWaiters == nil {
+		m.ackWaiters = make(map[uuid.UUID]chan struct{})
+	}
+	waiter := make(chan struct{})
+	m.ackWaiters[id] = waiter
+	return waiter
+}
+
+//cancelAck stops waiting for the acknowledgement of the message with uuid id
+func (m *messageIDs) cancelAck(id uuid.UUID) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.ackWaiters, id)
+}
+
+//markShared records that msg was delivered through the shared subscription, before it is
+//queued
+func (m *messageIDs) markShared(msg *PublishPacket, subscription string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.shared == nil {
+		m.shared = make(map[uuid.UUID]string)
+	}
+	m.shared[msg.UUID()] = subscription
+}
+
+//unmarkShared forgets the shared subscription of msg, which wasn't given a message id
+func (m *messageIDs) unmarkShared(msg *PublishPacket) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.shared, msg.UUID())
+}
+
+//sharedInflight returns the shared subscription of each message id in use for a message
+//delivered through one
+func (m *messageIDs) sharedInflight() map[uint16]string {
+	m.RLock()
+	defer m.RUnlock()
+	inflight := make(map[uint16]string)
+	for msgID, u := range m.index {
+		if u == nil {
+			continue
+		}
+		if subscription, ok := m.shared[*u]; ok {
+			inflight[msgID] = subscription
+		}
+	}
+	return inflight
+}
+
+//inflight is the number of message ids currently in use
+func (m *messageIDs) inflight() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.index)
+}
+
+//claimID marks id as in use for the message with uuid id, used when restoring inflight
+//messages that were given their message ids before a restart
+func (m *messageIDs) claimID(msgID uint16, id uuid.UUID) {
+	m.Lock()
+	defer m.Unlock()
+	m.index[msgID] = &id
+}
+
+//clear frees every message id, for when a client starts a clean session
+func (m *messageIDs) clear() {
+	m.Lock()
+	defer m.Unlock()
+	m.index = make(map[uint16]*uuid.UUID)
+	m.sent = nil
+	m.ackWaiters = nil
+	m.shared = nil
+	m.last = 0
+	for id := range m.queued {
+		m.releaseQueued(id)
+	}
 }
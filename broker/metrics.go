@@ -0,0 +1,244 @@
+package hrotti
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//meteredConn counts the bytes read from and written to a client connection, and for the
+//client once it is known, client is set before the client's goroutines start. The writes to
+//the connection are counted too, to show how well packets are batched.
+type meteredConn struct {
+	net.Conn
+	stats  *BrokerStats
+	client *clientStats
+}
+
+func (m *meteredConn) Read(b []byte) (int, error) {
+	n, err := m.Conn.Read(b)
+	atomic.AddInt64(&m.stats.bytesReceived, int64(n))
+	if m.client != nil {
+		atomic.AddInt64(&m.client.bytesReceived, int64(n))
+	}
+	return n, err
+}
+
+func (m *meteredConn) Write(b []byte) (int, error) {
+	n, err := m.Conn.Write(b)
+	atomic.AddInt64(&m.stats.writes, 1)
+	atomic.AddInt64(&m.stats.bytesSent, int64(n))
+	if m.client != nil {
+		atomic.AddInt64(&m.client.bytesSent, int64(n))
+	}
+	return n, err
+}
+
+//MetricsHandler returns an http.Handler that serves the broker metrics in the Prometheus
+//text format, for embedding in an existing HTTP server. AddMetricsListener serves it on
+//its own port.
+func (h *Hrotti) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		h.writeMetrics(w)
+	})
+}
+
+//AddMetricsListener serves the Prometheus metrics at /metrics on addr, and the health and
+//readiness checks at /healthz and /readyz, it is stopped along with the broker.
+func (h *Hrotti) AddMetricsListener(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		h.listenerLog.Error("Failed to start metrics", "err", err)
+		return err
+	}
+	h.listenerLog.Info("Starting metrics", "addr", ln.Addr())
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", h.MetricsHandler())
+	mux.Handle("/healthz", h.HealthHandler())
+	mux.Handle("/readyz", h.ReadyHandler())
+	go func() {
+		<-h.stop
+		ln.Close()
+	}()
+	go func() {
+		err := http.Serve(ln, mux)
+		select {
+		case <-h.stop:
+		default:
+			h.listenerLog.Error("Metrics stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+//labelValue escapes a Prometheus label value
+var labelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetric(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (h *Hrotti) writeMetrics(w io.Writer) {
+	s := &h.stats
+	types := make([]int, 0, len(PacketNames))
+	for packetType := range PacketNames {
+		types = append(types, int(packetType))
+	}
+	sort.Ints(types)
+
+	writeMetric(w, "hrotti_packets_received_total", "counter", "MQTT packets received by type.")
+	for _, packetType := range types {
+		fmt.Fprintf(w, "hrotti_packets_received_total{type=\"%s\"} %d\n", PacketType(packetType), atomic.LoadInt64(&s.packetsReceived[packetType]))
+	}
+	writeMetric(w, "hrotti_packets_sent_total", "counter", "MQTT packets sent by type.")
+	for _, packetType := range types {
+		fmt.Fprintf(w, "hrotti_packets_sent_total{type=\"%s\"} %d\n", PacketType(packetType), atomic.LoadInt64(&s.packetsSent[packetType]))
+	}
+	writeMetric(w, "hrotti_bytes_received_total", "counter", "Bytes received from clients.")
+	fmt.Fprintf(w, "hrotti_bytes_received_total %d\n", atomic.LoadInt64(&s.bytesReceived))
+	writeMetric(w, "hrotti_bytes_sent_total", "counter", "Bytes sent to clients.")
+	fmt.Fprintf(w, "hrotti_bytes_sent_total %d\n", atomic.LoadInt64(&s.bytesSent))
+	writeMetric(w, "hrotti_writes_total", "counter", "Writes to client connections, each one or more system calls.")
+	fmt.Fprintf(w, "hrotti_writes_total %d\n", atomic.LoadInt64(&s.writes))
+
+	codes := make([]int, 0, len(ConnackReturnCodes))
+	for code := range ConnackReturnCodes {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	writeMetric(w, "hrotti_connections_total", "counter", "Connection attempts by CONNACK return code, 0 is accepted.")
+	for _, code := range codes {
+		fmt.Fprintf(w, "hrotti_connections_total{code=\"%d\"} %d\n", code, atomic.LoadInt64(&s.connectResults[code]))
+	}
+	writeMetric(w, "hrotti_connections_banned_total", "counter", "Connections closed as they were accepted because their address was banned for repeated authentication failures.")
+	fmt.Fprintf(w, "hrotti_connections_banned_total %d\n", atomic.LoadInt64(&s.connectionsBanned))
+	writeMetric(w, "hrotti_bans", "gauge", "Addresses banned for repeated authentication failures.")
+	fmt.Fprintf(w, "hrotti_bans %d\n", len(h.Bans()))
+	writeMetric(w, "hrotti_quic_connections_total", "counter", "Connections accepted by QUIC listeners.")
+	fmt.Fprintf(w, "hrotti_quic_connections_total %d\n", atomic.LoadInt64(&s.quicConnections))
+	writeMetric(w, "hrotti_mqttsn_clients", "gauge", "MQTT-SN clients connected through a gateway listener, sleeping ones included.")
+	fmt.Fprintf(w, "hrotti_mqttsn_clients %d\n", atomic.LoadInt64(&s.mqttsnClients))
+	writeMetric(w, "hrotti_mqttsn_sleeping_clients", "gauge", "MQTT-SN clients that are asleep, their messages are buffered until they wake.")
+	fmt.Fprintf(w, "hrotti_mqttsn_sleeping_clients %d\n", atomic.LoadInt64(&s.mqttsnSleeping))
+	writeMetric(w, "hrotti_messages_dropped_total", "counter", "Messages dropped because a client's queue was full.")
+	fmt.Fprintf(w, "hrotti_messages_dropped_total %d\n", atomic.LoadInt64(&s.publishMessagesDropped))
+	writeMetric(w, "hrotti_messages_expired_total", "counter", "Messages that expired before they were acknowledged.")
+	fmt.Fprintf(w, "hrotti_messages_expired_total %d\n", atomic.LoadInt64(&s.publishMessagesExpired))
+	writeMetric(w, "hrotti_hook_calls_dropped_total", "counter", "Calls to the embedding hooks dropped because their queue was full.")
+	fmt.Fprintf(w, "hrotti_hook_calls_dropped_total %d\n", atomic.LoadInt64(&s.hookCallsDropped))
+	writeMetric(w, "hrotti_policy_violations_total", "counter", "Messages dropped for breaking their topic's policy.")
+	fmt.Fprintf(w, "hrotti_policy_violations_total %d\n", atomic.LoadInt64(&s.policyViolations))
+	writeMetric(w, "hrotti_publishes_denied_total", "counter", "Messages dropped because the publisher's ACL doesn't allow their topic.")
+	fmt.Fprintf(w, "hrotti_publishes_denied_total %d\n", atomic.LoadInt64(&s.publishesDenied))
+	writeMetric(w, "hrotti_panics_total", "counter", "Panics recovered from, each closed a client's connection or restarted one of the broker's goroutines.")
+	fmt.Fprintf(w, "hrotti_panics_total %d\n", atomic.LoadInt64(&s.panics))
+	writeMetric(w, "hrotti_admin_publishes_total", "counter", "Messages published through the admin API.")
+	fmt.Fprintf(w, "hrotti_admin_publishes_total %d\n", atomic.LoadInt64(&s.adminPublishes))
+	writeMetric(w, "hrotti_topic_rewrites_total", "counter", "Topics and subscription filters changed by a topic rewrite rule.")
+	fmt.Fprintf(w, "hrotti_topic_rewrites_total %d\n", atomic.LoadInt64(&s.topicsRewritten))
+	writeMetric(w, "hrotti_transform_errors_total", "counter", "Messages not delivered to a client because transforming their payload failed.")
+	fmt.Fprintf(w, "hrotti_transform_errors_total %d\n", atomic.LoadInt64(&s.transformsFailed))
+	writeMetric(w, "hrotti_ingest_errors_total", "counter", "Messages an ingest hook returned an error for, they weren't acknowledged or delivered.")
+	fmt.Fprintf(w, "hrotti_ingest_errors_total %d\n", atomic.LoadInt64(&s.ingestErrors))
+	writeMetric(w, "hrotti_ingest_timeouts_total", "counter", "Messages an ingest hook didn't commit within the ingest timeout, they weren't acknowledged or delivered.")
+	fmt.Fprintf(w, "hrotti_ingest_timeouts_total %d\n", atomic.LoadInt64(&s.ingestTimeouts))
+	writeMetric(w, "hrotti_subscriptions_refused_total", "counter", "Subscription filters refused for being over the subscription limits.")
+	fmt.Fprintf(w, "hrotti_subscriptions_refused_total %d\n", atomic.LoadInt64(&s.subscriptionsRefused))
+	writeMetric(w, "hrotti_certificates_refused_total", "counter", "Client certificates refused by a listener's CRL or fingerprint lists.")
+	fmt.Fprintf(w, "hrotti_certificates_refused_total %d\n", atomic.LoadInt64(&s.certificatesRefused))
+	writeMetric(w, "hrotti_retained_over_limits_total", "counter", "Retained messages that were over the retained limits.")
+	fmt.Fprintf(w, "hrotti_retained_over_limits_total %d\n", atomic.LoadInt64(&s.retainedOverLimits))
+	writeMetric(w, "hrotti_messages_discarded_total", "counter", "Messages dropped rather than delivered, by reason.")
+	for reason := DropReason(0); reason < numDropReasons; reason++ {
+		fmt.Fprintf(w, "hrotti_messages_discarded_total{reason=\"%s\"} %d\n", reason, atomic.LoadInt64(&s.discarded[reason]))
+	}
+	writeMetric(w, "hrotti_protocol_fixups_total", "counter", "Spec violations by clients of permissive listeners that were corrected, by fixup.")
+	for fixup := Fixup(0); fixup < NumFixups; fixup++ {
+		fmt.Fprintf(w, "hrotti_protocol_fixups_total{fixup=\"%s\"} %d\n", fixup, atomic.LoadInt64(&s.fixups[fixup]))
+	}
+	writeMetric(w, "hrotti_dead_letters_total", "counter", "Dropped messages republished to the dead letter topics.")
+	fmt.Fprintf(w, "hrotti_dead_letters_total %d\n", atomic.LoadInt64(&s.deadLetters))
+	writeMetric(w, "hrotti_dead_letters_dropped_total", "counter", "Dropped messages not dead lettered for being over the dead letter limits.")
+	fmt.Fprintf(w, "hrotti_dead_letters_dropped_total %d\n", atomic.LoadInt64(&s.deadLettersDropped))
+	h.topicStats.writeMetrics(w)
+
+	var connected []*Client
+	for _, c := range h.clients.snapshot() {
+		if c.Connected() {
+			connected = append(connected, c)
+		}
+	}
+	sort.Slice(connected, func(i, j int) bool { return connected[i].clientID < connected[j].clientID })
+	writeMetric(w, "hrotti_connections_open", "gauge", "Open network connections, including those that haven't sent a CONNECT yet.")
+	fmt.Fprintf(w, "hrotti_connections_open %d\n", h.connections.count())
+	writeMetric(w, "hrotti_clients_connected", "gauge", "Connected clients.")
+	fmt.Fprintf(w, "hrotti_clients_connected %d\n", len(connected))
+	writeMetric(w, "hrotti_subscriptions", "gauge", "Active subscriptions.")
+	fmt.Fprintf(w, "hrotti_subscriptions %d\n", h.subs.total())
+	writeMetric(w, "hrotti_retained_messages", "gauge", "Retained messages.")
+	fmt.Fprintf(w, "hrotti_retained_messages %d\n", h.subs.retained.len())
+	cached, cachedBytes := h.subs.retained.usage()
+	writeMetric(w, "hrotti_retained_cache_messages", "gauge", "Retained messages kept in memory.")
+	fmt.Fprintf(w, "hrotti_retained_cache_messages %d\n", cached)
+	writeMetric(w, "hrotti_retained_cache_bytes", "gauge", "Payload bytes of the retained messages kept in memory.")
+	fmt.Fprintf(w, "hrotti_retained_cache_bytes %d\n", cachedBytes)
+	writeMetric(w, "hrotti_retained_cache_hits_total", "counter", "Retained messages wanted that were in memory.")
+	fmt.Fprintf(w, "hrotti_retained_cache_hits_total %d\n", atomic.LoadInt64(&h.subs.retained.hits))
+	writeMetric(w, "hrotti_retained_cache_misses_total", "counter", "Retained messages wanted that had been evicted and were loaded from persistence.")
+	fmt.Fprintf(w, "hrotti_retained_cache_misses_total %d\n", atomic.LoadInt64(&h.subs.retained.misses))
+	writeMetric(w, "hrotti_retained_cache_evictions_total", "counter", "Retained messages evicted from memory.")
+	fmt.Fprintf(w, "hrotti_retained_cache_evictions_total %d\n", atomic.LoadInt64(&h.subs.retained.evictions))
+	writeMetric(w, "hrotti_match_cache_topics", "gauge", "Topics whose matching subscriptions are cached.")
+	fmt.Fprintf(w, "hrotti_match_cache_topics %d\n", h.subs.matches.len())
+	writeMetric(w, "hrotti_match_cache_hits_total", "counter", "Messages routed to the subscriptions cached for their topic.")
+	fmt.Fprintf(w, "hrotti_match_cache_hits_total %d\n", atomic.LoadInt64(&h.subs.matches.hits))
+	writeMetric(w, "hrotti_match_cache_misses_total", "counter", "Messages whose topic was matched against the subscription filters as it wasn't cached or had been invalidated.")
+	fmt.Fprintf(w, "hrotti_match_cache_misses_total %d\n", atomic.LoadInt64(&h.subs.matches.misses))
+	writeMetric(w, "hrotti_match_cache_invalidations_total", "counter", "Cached matches dropped because the subscriptions they depended on changed.")
+	fmt.Fprintf(w, "hrotti_match_cache_invalidations_total %d\n", atomic.LoadInt64(&h.subs.matches.invalidations))
+	writeMetric(w, "hrotti_recovery_seconds", "gauge", "How long restoring the sessions and retained messages from persistence took when the broker started.")
+	fmt.Fprintf(w, "hrotti_recovery_seconds %g\n", h.recovery.duration.Seconds())
+	writeMetric(w, "hrotti_recovered_sessions", "gauge", "Sessions restored from persistence when the broker started.")
+	fmt.Fprintf(w, "hrotti_recovered_sessions %d\n", h.recovery.sessions)
+	writeMetric(w, "hrotti_recovered_subscriptions", "gauge", "Subscriptions of the sessions restored from persistence when the broker started.")
+	fmt.Fprintf(w, "hrotti_recovered_subscriptions %d\n", h.recovery.subscriptions)
+	shared := h.subs.sharedSnapshot()
+	writeMetric(w, "hrotti_shared_deliveries_total", "counter", "Messages each member of a shared subscription group has been given.")
+	for _, group := range shared {
+		for _, member := range group.Members {
+			fmt.Fprintf(w, "hrotti_shared_deliveries_total{group=\"%s\",client_id=\"%s\"} %d\n", labelValue.Replace(group.Subscription), labelValue.Replace(member.ClientID), member.Delivered)
+		}
+	}
+	writeMetric(w, "hrotti_shared_redeliveries_total", "counter", "Unacknowledged messages moved from a shared subscription group member that disconnected to another member.")
+	for _, group := range shared {
+		fmt.Fprintf(w, "hrotti_shared_redeliveries_total{group=\"%s\"} %d\n", labelValue.Replace(group.Subscription), group.Redelivered)
+	}
+	quotas := h.QuotaUsage()
+	writeMetric(w, "hrotti_quota_connections", "gauge", "Connected clients of each principal with a quota.")
+	for _, u := range quotas {
+		fmt.Fprintf(w, "hrotti_quota_connections{username=\"%s\"} %d\n", labelValue.Replace(u.Username), u.Connections)
+	}
+	writeMetric(w, "hrotti_quota_sessions", "gauge", "Durable sessions of each principal with a quota.")
+	for _, u := range quotas {
+		fmt.Fprintf(w, "hrotti_quota_sessions{username=\"%s\"} %d\n", labelValue.Replace(u.Username), u.Sessions)
+	}
+	writeMetric(w, "hrotti_quota_queued_bytes", "gauge", "Payload bytes of the QoS 1 and 2 messages held for the sessions of each principal with a quota.")
+	for _, u := range quotas {
+		fmt.Fprintf(w, "hrotti_quota_queued_bytes{username=\"%s\"} %d\n", labelValue.Replace(u.Username), u.QueuedBytes)
+	}
+	writeMetric(w, "hrotti_quota_retained", "gauge", "Retained topics owned by each principal with a quota.")
+	for _, u := range quotas {
+		fmt.Fprintf(w, "hrotti_quota_retained{username=\"%s\"} %d\n", labelValue.Replace(u.Username), u.Retained)
+	}
+	writeMetric(w, "hrotti_client_queue_depth", "gauge", "Packets waiting to be sent to each connected client.")
+	for _, c := range connected {
+		fmt.Fprintf(w, "hrotti_client_queue_depth{client_id=\"%s\"} %d\n", labelValue.Replace(c.clientID), c.queueDepth())
+	}
+}
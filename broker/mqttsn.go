@@ -0,0 +1,728 @@
+package hrotti
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alsm/hrotti/mqttsn"
+	. "github.com/alsm/hrotti/packets"
+)
+
+//snDatagramQueue is the number of datagrams from a client waiting to be translated, more are
+//dropped as a congested network would drop them
+const snDatagramQueue = 16
+
+//listenMQTTSN listens for MQTT-SN clients on the UDP address of listener. The gateway is a
+//net.Listener that accepts a connection for each client that sends a CONNECT, the broker's
+//end of a pipe the gateway translates the client's MQTT-SN to MQTT over, so the client is
+//authenticated and has its session, subscriptions, retained messages and queue exactly as
+//a tcp client does.
+func (h *Hrotti) listenMQTTSN(listener *internalListener) (net.Listener, error) {
+	addr, err := net.ResolveUDPAddr("udp", listener.url.Host)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	g := &snGateway{
+		h:       h,
+		pc:      pc,
+		clients: make(map[string]*snClient),
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	go g.receive()
+	return g, nil
+}
+
+//snGateway translates between the MQTT-SN clients of a listener, each known by its UDP
+//address, and the broker
+type snGateway struct {
+	sync.Mutex
+	h         *Hrotti
+	pc        *net.UDPConn
+	clients   map[string]*snClient
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (g *snGateway) Accept() (net.Conn, error) {
+	select {
+	case conn := <-g.conns:
+		return conn, nil
+	case <-g.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+//Close stops the gateway, its clients are sent a DISCONNECT and their connections closed
+func (g *snGateway) Close() error {
+	var err error
+	g.closeOnce.Do(func() {
+		close(g.closed)
+		g.Lock()
+		clients := make([]*snClient, 0, len(g.clients))
+		for _, c := range g.clients {
+			clients = append(clients, c)
+		}
+		g.Unlock()
+		for _, c := range clients {
+			c.close(true)
+		}
+		err = g.pc.Close()
+	})
+	return err
+}
+
+func (g *snGateway) Addr() net.Addr {
+	return g.pc.LocalAddr()
+}
+
+//receive reads datagrams until the gateway is closed, handing each to the client at the
+//address it came from
+func (g *snGateway) receive() {
+	defer g.Close()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := g.pc.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-g.closed:
+			default:
+				g.h.listenerLog.Error("MQTT-SN gateway stopped reading", "addr", g.pc.LocalAddr(), "err", err)
+			}
+			return
+		}
+		p, err := mqttsn.Decode(buf[:n])
+		if err != nil {
+			g.h.listenerLog.Debug("Dropping MQTT-SN datagram", "addr", addr, "err", err)
+			continue
+		}
+		g.dispatch(addr, p)
+	}
+}
+
+//dispatch hands p to the client at addr. A CONNECT starts a new client, unless it resumes the
+//session of the one already at the address, anything else from an address without a client
+//is answered with a DISCONNECT so the client knows to connect again.
+func (g *snGateway) dispatch(addr *net.UDPAddr, p mqttsn.Packet) {
+	g.Lock()
+	c := g.clients[addr.String()]
+	if connect, ok := p.(*mqttsn.Connect); ok && !c.resumes(connect) {
+		if rc := g.refuse(connect); rc != mqttsn.Accepted {
+			g.Unlock()
+			g.send(addr, &mqttsn.Connack{ReturnCode: rc})
+			return
+		}
+		if c != nil {
+			delete(g.clients, addr.String())
+			g.Unlock()
+			c.close(false)
+			g.Lock()
+		}
+		c = newSNClient(g, addr, connect)
+		g.clients[addr.String()] = c
+		g.Unlock()
+		go c.serve(connect)
+		return
+	}
+	g.Unlock()
+	if c == nil {
+		g.h.listenerLog.Debug("MQTT-SN message from an address that hasn't connected", "addr", addr, "type", p.Type())
+		if _, ok := p.(*mqttsn.Disconnect); !ok {
+			g.send(addr, &mqttsn.Disconnect{})
+		}
+		return
+	}
+	select {
+	case c.in <- p:
+	default:
+		g.h.listenerLog.Debug("Dropping MQTT-SN message, the client has too many waiting", "client", c.clientID, "type", p.Type())
+	}
+}
+
+//refuse returns the return code of a CONNECT the gateway can't translate, or Accepted
+func (g *snGateway) refuse(connect *mqttsn.Connect) byte {
+	switch {
+	case connect.ProtocolID != mqttsn.ProtocolID:
+		g.h.listenerLog.Debug("MQTT-SN CONNECT with an unknown protocol id", "client", connect.ClientID, "protocolID", connect.ProtocolID)
+		return mqttsn.RejectedNotSupported
+	case connect.Will:
+		g.h.listenerLog.Debug("MQTT-SN CONNECT asked for a will, which isn't supported", "client", connect.ClientID)
+		return mqttsn.RejectedNotSupported
+	}
+	return mqttsn.Accepted
+}
+
+//remove forgets c, if it is still the client at its address
+func (g *snGateway) remove(c *snClient) {
+	g.Lock()
+	defer g.Unlock()
+	if g.clients[c.addr.String()] == c {
+		delete(g.clients, c.addr.String())
+	}
+}
+
+func (g *snGateway) send(addr *net.UDPAddr, p mqttsn.Packet) {
+	if _, err := g.pc.WriteToUDP(p.Pack(), addr); err != nil {
+		g.h.listenerLog.Debug("Failed to send MQTT-SN message", "addr", addr, "type", p.Type(), "err", err)
+	}
+}
+
+//snState is where an MQTT-SN client is in its connection
+type snState int
+
+const (
+	//snConnecting is a client whose CONNECT the broker hasn't answered
+	snConnecting snState = iota
+	snActive
+	//snAsleep is a client that disconnected with a duration, messages for it are buffered
+	snAsleep
+	//snAwake is a sleeping client that sent a PINGREQ, it is sent its buffered messages and
+	//goes back to sleep with the PINGRESP after them
+	snAwake
+)
+
+//snClient is an MQTT-SN client of a gateway, translated to and from the MQTT connection conn.
+//Only serve writes to conn, receive reads from it.
+type snClient struct {
+	g         *snGateway
+	addr      *net.UDPAddr
+	clientID  string
+	keepAlive time.Duration
+	conn      net.Conn
+	broker    net.Conn
+	in        chan mqttsn.Packet
+	stop      chan struct{}
+	stopOnce  sync.Once
+	//disconnecting is set once the client has sent a DISCONNECT, so it isn't sent one back
+	disconnecting int32
+
+	sync.Mutex
+	state snState
+	sleep time.Duration
+	//topics are the ids given to topic names, known are those the client has been told of
+	//or registered itself
+	topics      map[string]uint16
+	names       map[uint16]string
+	known       map[uint16]bool
+	nextTopicID uint16
+	nextMsgID   uint16
+	//registering is the message id of the REGISTER the first pending message waits on
+	registering uint16
+	pending     []*PublishPacket
+	//publishing and subscribing are the topic ids of the client's QoS 1 publishes and
+	//subscriptions the broker is still to acknowledge, by message id
+	publishing  map[uint16]uint16
+	subscribing map[uint16]uint16
+}
+
+func newSNClient(g *snGateway, addr *net.UDPAddr, connect *mqttsn.Connect) *snClient {
+	local, remote := net.Pipe()
+	c := &snClient{
+		g:           g,
+		addr:        addr,
+		clientID:    connect.ClientID,
+		keepAlive:   time.Duration(g.h.effectiveKeepAlive(connect.ClientID, connect.Duration)) * time.Second,
+		conn:        local,
+		broker:      &snConn{Conn: remote, local: g.pc.LocalAddr(), remote: addr},
+		in:          make(chan mqttsn.Packet, snDatagramQueue),
+		stop:        make(chan struct{}),
+		topics:      make(map[string]uint16),
+		names:       make(map[uint16]string),
+		known:       make(map[uint16]bool),
+		publishing:  make(map[uint16]uint16),
+		subscribing: make(map[uint16]uint16),
+	}
+	atomic.AddInt64(&g.h.stats.mqttsnClients, 1)
+	return c
+}
+
+//resumes returns true if connect, from c's address, carries on c's session rather than
+//starting a new one, as a sleeping client does to become active again
+func (c *snClient) resumes(connect *mqttsn.Connect) bool {
+	return c != nil && !connect.CleanSession && !connect.Will && connect.ClientID == c.clientID
+}
+
+//close ends the client's MQTT connection. If notify is set and the client didn't disconnect
+//itself it is told, with a DISCONNECT or, if it was still connecting, a CONNACK refusing it.
+func (c *snClient) close(notify bool) {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		c.conn.Close()
+		c.g.remove(c)
+		c.Lock()
+		connecting := c.state == snConnecting
+		c.setState(snConnecting)
+		c.Unlock()
+		atomic.AddInt64(&c.g.h.stats.mqttsnClients, -1)
+		if !notify || atomic.LoadInt32(&c.disconnecting) == 1 {
+			return
+		}
+		if connecting {
+			c.g.send(c.addr, &mqttsn.Connack{ReturnCode: mqttsn.RejectedCongestion})
+		} else {
+			c.g.send(c.addr, &mqttsn.Disconnect{})
+		}
+	})
+}
+
+//setState moves the client to state, counting the sleeping clients. The client must be
+//locked.
+func (c *snClient) setState(state snState) {
+	wasSleeping := c.state == snAsleep || c.state == snAwake
+	sleeping := state == snAsleep || state == snAwake
+	if sleeping && !wasSleeping {
+		atomic.AddInt64(&c.g.h.stats.mqttsnSleeping, 1)
+	} else if wasSleeping && !sleeping {
+		atomic.AddInt64(&c.g.h.stats.mqttsnSleeping, -1)
+	}
+	c.state = state
+}
+
+//serve connects the client to the broker and translates what it sends until it disconnects.
+//While it is asleep the broker is pinged every keepalive on its behalf, and if it doesn't
+//wake within one and a half times its sleep duration of going to sleep or last waking it
+//has gone.
+func (c *snClient) serve(connect *mqttsn.Connect) {
+	defer c.close(false)
+	select {
+	case c.g.conns <- c.broker:
+	case <-c.g.closed:
+		return
+	}
+	go c.receive()
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.CleanSession = connect.CleanSession
+	cp.KeepaliveTimer = connect.Duration
+	cp.ClientIdentifier = connect.ClientID
+	if cp.Write(c.conn) != nil {
+		c.close(true)
+		return
+	}
+	clock := c.g.h.Clock
+	var ping Ticker
+	var wake Timer
+	var pings, missed <-chan time.Time
+	defer func() {
+		if wake != nil {
+			wake.Stop()
+		}
+		if ping != nil {
+			ping.Stop()
+		}
+	}()
+	for {
+		var restart bool
+		select {
+		case p := <-c.in:
+			if !c.handle(p) {
+				return
+			}
+			restart = p.Type() == mqttsn.PINGREQ || p.Type() == mqttsn.DISCONNECT
+		case <-pings:
+			if NewControlPacket(PINGREQ).Write(c.conn) != nil {
+				return
+			}
+			continue
+		case <-missed:
+			c.g.h.listenerLog.Info("Sleeping MQTT-SN client didn't wake up", "client", c.clientID, "addr", c.addr)
+			return
+		case <-c.stop:
+			return
+		}
+		c.Lock()
+		asleep, sleep := c.state == snAsleep || c.state == snAwake, c.sleep
+		c.Unlock()
+		switch {
+		case asleep && wake == nil:
+			wake = clock.NewTimer(sleep * 3 / 2)
+			missed = wake.C()
+			if c.keepAlive > 0 {
+				ping = clock.NewTicker(c.keepAlive)
+				pings = ping.C()
+			}
+		case asleep && restart:
+			wake.Reset(sleep * 3 / 2)
+		case !asleep && wake != nil:
+			wake.Stop()
+			wake, missed = nil, nil
+			if ping != nil {
+				ping.Stop()
+				ping, pings = nil, nil
+			}
+		}
+	}
+}
+
+//handle translates a message from the client, it returns false once the client has gone
+func (c *snClient) handle(p mqttsn.Packet) bool {
+	var cp ControlPacket
+	switch p := p.(type) {
+	case *mqttsn.Connect:
+		c.Lock()
+		if c.state == snConnecting {
+			c.Unlock()
+			return true
+		}
+		c.setState(snActive)
+		c.registering = 0
+		c.Unlock()
+		c.g.h.listenerLog.Debug("MQTT-SN client resumed its session", "client", c.clientID)
+		c.g.send(c.addr, &mqttsn.Connack{ReturnCode: mqttsn.Accepted})
+		c.flush()
+	case *mqttsn.Register:
+		rc := byte(mqttsn.Accepted)
+		var id uint16
+		if strings.ContainsAny(p.TopicName, "+#") {
+			rc = mqttsn.RejectedNotSupported
+		} else {
+			c.Lock()
+			id = c.topicID(p.TopicName)
+			c.known[id] = true
+			c.Unlock()
+		}
+		c.g.send(c.addr, &mqttsn.Regack{TopicID: id, MsgID: p.MsgID, ReturnCode: rc})
+	case *mqttsn.Regack:
+		cp = c.registered(p)
+	case *mqttsn.Publish:
+		cp = c.publish(p)
+	case *mqttsn.Puback:
+		if p.ReturnCode != mqttsn.Accepted {
+			c.g.h.listenerLog.Debug("MQTT-SN client rejected a message", "client", c.clientID, "topicID", p.TopicID, "rc", p.ReturnCode)
+			if p.ReturnCode == mqttsn.RejectedInvalidTopicID {
+				c.Lock()
+				delete(c.known, p.TopicID)
+				c.Unlock()
+			}
+		}
+		pa := NewControlPacket(PUBACK).(*PubackPacket)
+		pa.MessageID = p.MsgID
+		cp = pa
+	case *mqttsn.Subscribe:
+		cp = c.subscribe(p)
+	case *mqttsn.Unsubscribe:
+		topic, ok := snFilter(p.TopicIDType, p.TopicName)
+		if !ok {
+			c.g.send(c.addr, &mqttsn.Unsuback{MsgID: p.MsgID})
+			break
+		}
+		up := NewControlPacket(UNSUBSCRIBE).(*UnsubscribePacket)
+		up.MessageID = p.MsgID
+		up.Topics = []string{topic}
+		cp = up
+	case *mqttsn.Pingreq:
+		c.Lock()
+		active := c.state == snActive
+		if c.state == snAsleep {
+			c.setState(snAwake)
+		}
+		//a REGISTER that was lost is sent again
+		c.registering = 0
+		c.Unlock()
+		if active {
+			cp = NewControlPacket(PINGREQ)
+		}
+		c.flush()
+	case *mqttsn.Disconnect:
+		if p.Duration > 0 {
+			c.Lock()
+			c.setState(snAsleep)
+			c.sleep = time.Duration(p.Duration) * time.Second
+			c.Unlock()
+			c.g.h.listenerLog.Debug("MQTT-SN client is going to sleep", "client", c.clientID, "duration", c.sleep)
+			c.g.send(c.addr, &mqttsn.Disconnect{})
+			break
+		}
+		atomic.StoreInt32(&c.disconnecting, 1)
+		NewControlPacket(DISCONNECT).Write(c.conn)
+		c.g.send(c.addr, &mqttsn.Disconnect{})
+		return false
+	default:
+		c.g.h.listenerLog.Debug("Ignoring MQTT-SN message from client", "client", c.clientID, "type", p.Type())
+	}
+	return cp == nil || cp.Write(c.conn) == nil
+}
+
+//publish returns the PUBLISH of a message from the client, or nil if it is rejected
+func (c *snClient) publish(p *mqttsn.Publish) ControlPacket {
+	reject := func(rc byte) ControlPacket {
+		c.g.send(c.addr, &mqttsn.Puback{TopicID: p.TopicID, MsgID: p.MsgID, ReturnCode: rc})
+		return nil
+	}
+	if p.Qos > 1 {
+		return reject(mqttsn.RejectedNotSupported)
+	}
+	var topic string
+	switch p.TopicIDType {
+	case mqttsn.TopicShortName:
+		topic = mqttsn.ShortTopicName(p.TopicID)
+	case mqttsn.TopicNormal:
+		c.Lock()
+		topic = c.names[p.TopicID]
+		if topic != "" && p.Qos == 1 {
+			c.publishing[p.MsgID] = p.TopicID
+		}
+		c.Unlock()
+	}
+	if topic == "" {
+		return reject(mqttsn.RejectedInvalidTopicID)
+	}
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = topic
+	pp.Qos = p.Qos
+	pp.Retain = p.Retain
+	pp.Dup = p.Dup && p.Qos > 0
+	pp.Payload = p.Data
+	if p.Qos > 0 {
+		pp.MessageID = p.MsgID
+	}
+	return pp
+}
+
+//subscribe returns the SUBSCRIBE for a subscription of the client, or nil if it is rejected.
+//A topic name without wildcards is given a topic id, which the SUBACK tells the client.
+func (c *snClient) subscribe(p *mqttsn.Subscribe) ControlPacket {
+	filter, ok := snFilter(p.TopicIDType, p.TopicName)
+	if !ok || p.Qos == mqttsn.QosNoConnection {
+		rc := byte(mqttsn.RejectedNotSupported)
+		if !ok {
+			rc = mqttsn.RejectedInvalidTopicID
+		}
+		c.g.send(c.addr, &mqttsn.Suback{MsgID: p.MsgID, ReturnCode: rc})
+		return nil
+	}
+	if p.TopicIDType == mqttsn.TopicNormal && !strings.ContainsAny(filter, "+#") {
+		c.Lock()
+		c.subscribing[p.MsgID] = c.topicID(filter)
+		c.Unlock()
+	}
+	qos := p.Qos
+	if qos > 1 {
+		qos = 1
+	}
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = p.MsgID
+	sp.Topics = []string{filter}
+	sp.Qoss = []byte{qos}
+	return sp
+}
+
+//snFilter returns the filter a SUBSCRIBE or UNSUBSCRIBE is for, predefined topic ids aren't
+//supported
+func snFilter(topicIDType byte, name string) (string, bool) {
+	if topicIDType == mqttsn.TopicPredefined || name == "" {
+		return "", false
+	}
+	return name, true
+}
+
+//registered takes the REGACK for the REGISTER the first pending message is waiting on and
+//carries on sending. If the client refused the topic the message is dropped, the PUBACK
+//returned is the broker's acknowledgement of it.
+func (c *snClient) registered(p *mqttsn.Regack) ControlPacket {
+	var cp ControlPacket
+	c.Lock()
+	if p.MsgID != c.registering || len(c.pending) == 0 {
+		c.Unlock()
+		return nil
+	}
+	c.registering = 0
+	if p.ReturnCode == mqttsn.Accepted {
+		c.known[p.TopicID] = true
+	} else {
+		pp := c.pending[0]
+		c.pending = c.pending[1:]
+		c.g.h.listenerLog.Debug("MQTT-SN client refused a topic, dropping the message", "client", c.clientID, "topic", pp.TopicName, "rc", p.ReturnCode)
+		if pp.Qos > 0 {
+			pa := NewControlPacket(PUBACK).(*PubackPacket)
+			pa.MessageID = pp.MessageID
+			cp = pa
+		}
+	}
+	c.Unlock()
+	c.flush()
+	return cp
+}
+
+//topicID returns the id of topic, giving it one if it hasn't got one. The client must be
+//locked.
+func (c *snClient) topicID(topic string) uint16 {
+	if id, ok := c.topics[topic]; ok {
+		return id
+	}
+	c.nextTopicID++
+	//a client with 65535 topics has its oldest ids reused
+	if c.nextTopicID == 0 {
+		c.nextTopicID = 1
+	}
+	id := c.nextTopicID
+	if old, ok := c.names[id]; ok {
+		delete(c.topics, old)
+		delete(c.known, id)
+	}
+	c.topics[topic] = id
+	c.names[id] = topic
+	return id
+}
+
+//receive translates the packets the broker sends the client until the connection closes
+func (c *snClient) receive() {
+	defer c.close(true)
+	r := NewReader(c.conn)
+	for {
+		cp, err := r.ReadPacket(0)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *ConnackPacket:
+			rc := byte(mqttsn.Accepted)
+			switch p.ReturnCode {
+			case CONN_ACCEPTED:
+			case CONN_REF_SERV_UNAVAIL:
+				rc = mqttsn.RejectedCongestion
+			default:
+				rc = mqttsn.RejectedNotSupported
+			}
+			c.g.send(c.addr, &mqttsn.Connack{ReturnCode: rc})
+			if rc != mqttsn.Accepted {
+				atomic.StoreInt32(&c.disconnecting, 1)
+				return
+			}
+			c.Lock()
+			c.setState(snActive)
+			c.Unlock()
+			c.flush()
+		case *PublishPacket:
+			c.queue(p)
+		case *PubackPacket:
+			c.Lock()
+			id := c.publishing[p.MessageID]
+			delete(c.publishing, p.MessageID)
+			c.Unlock()
+			c.g.send(c.addr, &mqttsn.Puback{TopicID: id, MsgID: p.MessageID, ReturnCode: mqttsn.Accepted})
+		case *SubackPacket:
+			c.Lock()
+			id := c.subscribing[p.MessageID]
+			delete(c.subscribing, p.MessageID)
+			sa := &mqttsn.Suback{MsgID: p.MessageID, ReturnCode: mqttsn.Accepted}
+			if len(p.GrantedQoss) == 0 || p.GrantedQoss[0] > 2 {
+				sa.ReturnCode = mqttsn.RejectedNotSupported
+			} else {
+				sa.Qos, sa.TopicID = p.GrantedQoss[0], id
+				if id != 0 {
+					c.known[id] = true
+				}
+			}
+			c.Unlock()
+			c.g.send(c.addr, sa)
+		case *UnsubackPacket:
+			c.g.send(c.addr, &mqttsn.Unsuback{MsgID: p.MessageID})
+		case *PingrespPacket:
+			//the broker is pinged on a sleeping client's behalf, it is only told of its own
+			c.Lock()
+			active := c.state == snActive
+			c.Unlock()
+			if active {
+				c.g.send(c.addr, &mqttsn.Pingresp{})
+			}
+		}
+	}
+}
+
+//queue buffers a message for the client and sends it if the client is awake. A resent QoS 1
+//message replaces the one buffered. Once MaxQueueDepth messages are buffered for a sleeping
+//client the oldest QoS 0 one is dropped, QoS 1 messages are held until acknowledged and the
+//broker sends no more than MaxInflight of them.
+func (c *snClient) queue(pp *PublishPacket) {
+	c.Lock()
+	replaced := false
+	if pp.Qos > 0 {
+		for i, queued := range c.pending {
+			if queued.Qos > 0 && queued.MessageID == pp.MessageID {
+				c.pending[i], replaced = pp, true
+				break
+			}
+		}
+	}
+	var dropped *PublishPacket
+	if !replaced {
+		if len(c.pending) >= c.g.h.maxQueueDepth {
+			for i, queued := range c.pending {
+				if queued.Qos == 0 {
+					dropped = queued
+					c.pending = append(c.pending[:i], c.pending[i+1:]...)
+					break
+				}
+			}
+		}
+		c.pending = append(c.pending, pp)
+	}
+	c.Unlock()
+	if dropped != nil {
+		c.g.h.discard(DropQueueFull, dropped, c.clientID)
+	}
+	c.flush()
+}
+
+//flush sends an awake client its buffered messages, registering each topic it doesn't know
+//the id of and waiting for the REGACK before carrying on. A client woken by a PINGREQ is
+//sent the PINGRESP once they have all been sent and goes back to sleep.
+func (c *snClient) flush() {
+	c.Lock()
+	defer c.Unlock()
+	if c.state == snConnecting || c.state == snAsleep {
+		return
+	}
+	for len(c.pending) > 0 {
+		pp := c.pending[0]
+		p := &mqttsn.Publish{Dup: pp.Dup, Qos: pp.Qos, Retain: pp.Retain, MsgID: pp.MessageID, Data: pp.Payload}
+		if len(pp.TopicName) == 2 {
+			p.TopicIDType, p.TopicID = mqttsn.TopicShortName, mqttsn.ShortTopicID(pp.TopicName)
+		} else {
+			p.TopicID = c.topicID(pp.TopicName)
+			if !c.known[p.TopicID] {
+				if c.registering == 0 {
+					c.nextMsgID++
+					if c.nextMsgID == 0 {
+						c.nextMsgID = 1
+					}
+					c.registering = c.nextMsgID
+					c.g.send(c.addr, &mqttsn.Register{TopicID: p.TopicID, MsgID: c.registering, TopicName: pp.TopicName})
+				}
+				return
+			}
+		}
+		c.pending = c.pending[1:]
+		c.g.send(c.addr, p)
+	}
+	if c.state == snAwake {
+		c.g.send(c.addr, &mqttsn.Pingresp{})
+		c.setState(snAsleep)
+	}
+}
+
+//snConn is the broker's end of the pipe to an MQTT-SN client, its addresses are the
+//gateway's and the client's so the client is logged, limited and banned by its own address
+type snConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *snConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *snConn) RemoteAddr() net.Addr {
+	return c.remote
+}
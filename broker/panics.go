@@ -0,0 +1,88 @@
+package hrotti
+
+import (
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+//A panic in one of a client's goroutines, from a packet Unpack doesn't expect or a Hooks
+//implementation that panics, closes only that client's connection, with its will published,
+//rather than taking the broker and every other client down with it. The broker's own
+//goroutines, the accept loops, sweepers and publishers, are restarted after a panic, waiting
+//longer each time it happens again. Each panic is logged with its stack and counted in
+//hrotti_panics_total.
+
+const (
+	//minPanicBackoff and maxPanicBackoff are the least and most time a broker goroutine that
+	//panicked waits before it is restarted
+	minPanicBackoff = 100 * time.Millisecond
+	maxPanicBackoff = 30 * time.Second
+)
+
+//recoverPanic is deferred at the top of each of the client's goroutines, after anything else
+//it defers, to close the client's connection if the goroutine panics
+func (c *Client) recoverPanic(hrotti *Hrotti, goroutine string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&hrotti.stats.panics, 1)
+	hrotti.sessionLog.Error("Recovered from a panic, closing the client's connection", "client", c.clientID, "goroutine", goroutine, "panic", r, "stack", string(debug.Stack()))
+	c.closeLater(hrotti, closePanic, fmt.Sprint(r))
+}
+
+//recoverConnection is deferred at the top of the goroutine handling a new connection, it
+//closes conn if the connection panics before it becomes a client
+func (h *Hrotti) recoverConnection(conn net.Conn) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&h.stats.panics, 1)
+	h.listenerLog.Error("Recovered from a panic, closing the connection", "addr", conn.RemoteAddr(), "panic", r, "stack", string(debug.Stack()))
+	conn.Close()
+}
+
+//recoverHook is deferred around a call to the Hooks for clientID on the hook workers, so a
+//hook that panics loses only that call
+func (h *Hrotti) recoverHook(clientID string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&h.stats.panics, 1)
+	h.sessionLog.Error("Recovered from a panic in a hook", "client", clientID, "panic", r, "stack", string(debug.Stack()))
+}
+
+//supervise runs task, one of the broker's own goroutines, until it returns. If it panics it
+//is run again after a backoff that doubles each time, up to maxPanicBackoff, unless the
+//broker has stopped.
+func (h *Hrotti) supervise(task string, run func()) {
+	backoff := minPanicBackoff
+	for !h.runRecovered(task, run) {
+		h.listenerLog.Warn("Restarting after a panic", "task", task, "backoff", backoff)
+		select {
+		case <-h.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxPanicBackoff {
+			backoff = maxPanicBackoff
+		}
+	}
+}
+
+//runRecovered runs task, it returns false if it panicked
+func (h *Hrotti) runRecovered(task string, run func()) (returned bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&h.stats.panics, 1)
+			h.listenerLog.Error("Recovered from a panic", "task", task, "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	run()
+	return true
+}
@@ -0,0 +1,83 @@
+package hrotti
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+//passwordHashPrefix starts a hashed password in Auth's Users, the rest is the iterations,
+//salt and key separated by $, with the salt and key base64 encoded
+const passwordHashPrefix = "pbkdf2-sha256$"
+
+const (
+	passwordIterations = 100000
+	passwordSaltSize   = 16
+)
+
+//HashPassword returns a PBKDF2-SHA256 hash of password with a random salt for use in Auth's
+//Users in place of the password itself. The password is binary data, as it is in a CONNECT,
+//so a hash also allows passwords that can't be written in a JSON config file.
+func HashPassword(password []byte) string {
+	salt := make([]byte, passwordSaltSize)
+	rand.Read(salt)
+	key := pbkdf2SHA256(password, salt, passwordIterations, sha256.Size)
+	return passwordHashPrefix + strconv.Itoa(passwordIterations) + "$" +
+		base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key)
+}
+
+//checkPassword is true if password matches stored, either a hash from HashPassword or the
+//password itself. The comparison takes the same time however much of the password matches.
+func checkPassword(stored string, password []byte) bool {
+	if !strings.HasPrefix(stored, passwordHashPrefix) {
+		return subtle.ConstantTimeCompare([]byte(stored), password) == 1
+	}
+	parts := strings.Split(strings.TrimPrefix(stored, passwordHashPrefix), "$")
+	if len(parts) != 3 {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2SHA256(password, salt, iterations, len(key)), key) == 1
+}
+
+//pbkdf2SHA256 derives a keyLen byte key from password and salt with PBKDF2 (RFC 8018)
+//using HMAC-SHA256
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	block := make([]byte, 4)
+	for i := uint32(1); len(key) < keyLen; i++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(block, i)
+		prf.Write(block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
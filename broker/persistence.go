@@ -1,25 +1,45 @@
 package hrotti
 
 import (
+	"time"
+
 	. "github.com/alsm/hrotti/packets"
-	"github.com/google/uuid"
 )
 
 type dirFlag byte
 
 const (
-	INBOUND  = 1
-	OUTBOUND = 2
+	INBOUND  dirFlag = 1
+	OUTBOUND dirFlag = 2
 )
 
+//Session is the state kept for a client that connected with cleanSession false, so its
+//subscriptions are restored when the broker restarts. DisconnectedAt is when the client
+//last disconnected, it is zero while the client is connected.
+type Session struct {
+	Subscriptions  map[string]SubscriptionOptions `json:"subscriptions"`
+	DisconnectedAt time.Time                      `json:"disconnectedAt,omitempty"`
+}
+
+//Persistence is where the broker keeps the state that should survive a restart: retained
+//messages, the sessions of cleanSession false clients, and the QoS 1 and 2 messages that
+//are inflight for each client. Inflight messages are keyed by client id, direction and
+//message id; an OUTBOUND PUBLISH is replaced by its PUBREL once the client has sent a
+//PUBREC, an INBOUND PUBLISH is kept until the client's PUBREL.
+//The Range functions call f for each entry until f returns false, the Load functions return
+//nil if there is no entry.
 type Persistence interface {
-	Init() error
-	Open(string)
-	Close(string)
-	Add(string, dirFlag, ControlPacket) bool
-	Replace(string, dirFlag, ControlPacket) bool
-	AddBatch(map[string]*PublishPacket)
-	Delete(string, dirFlag, uuid.UUID) bool
-	GetAll(string) []ControlPacket
-	Exists(string) bool
+	Open() error
+	Close() error
+	StoreRetained(topic string, message *PublishPacket) error
+	LoadRetained(topic string) (*PublishPacket, error)
+	DeleteRetained(topic string) error
+	RangeRetained(f func(topic string, message *PublishPacket) bool) error
+	StoreSession(client string, session *Session) error
+	LoadSession(client string) (*Session, error)
+	DeleteSession(client string) error
+	RangeSessions(f func(client string, session *Session) bool) error
+	StoreInflight(client string, direction dirFlag, msgID uint16, message ControlPacket) error
+	DeleteInflight(client string, direction dirFlag, msgID uint16) error
+	RangeInflight(client string, f func(direction dirFlag, msgID uint16, message ControlPacket) bool) error
 }
@@ -0,0 +1,101 @@
+package hrotti
+
+import (
+	"strings"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//TopicPolicyAction is what the broker does with a PUBLISH that breaks its topic's policy
+type TopicPolicyAction int
+
+const (
+	//DropViolation drops the message and counts it, a QoS 1 or 2 message is still
+	//acknowledged as MQTT 3.1.1 has no way to refuse a publish
+	DropViolation TopicPolicyAction = iota
+	//DisconnectViolation drops the message and disconnects the client
+	DisconnectViolation
+)
+
+//TopicPolicy sets how messages can be published to the topics its filter matches, an ACL
+//decides whether a client may publish to a topic and the policy how. MaxSize is the largest
+//payload allowed in bytes, 0 is no limit. MaxQos is the highest QoS allowed, 2 allows every
+//QoS, and a message over it is delivered at MaxQos if DowngradeQos is set. NoRetain forbids
+//the retain flag. A message that breaks the policy in any other way gets Action.
+type TopicPolicy struct {
+	MaxSize      int
+	MaxQos       byte
+	DowngradeQos bool
+	NoRetain     bool
+	Action       TopicPolicyAction
+}
+
+//moreSpecific is true if filter is a longer match than other: it has more levels before its
+//first wildcard, or as many and more levels, with ties going to the first in sort order
+func moreSpecific(filter string, other string) bool {
+	if a, b := literalLevels(filter), literalLevels(other); a != b {
+		return a > b
+	}
+	if a, b := strings.Count(filter, "/"), strings.Count(other, "/"); a != b {
+		return a > b
+	}
+	return filter < other
+}
+
+//literalLevels returns the number of levels of filter before its first wildcard
+func literalLevels(filter string) int {
+	levels := topicLevels(filter)
+	for i, level := range levels {
+		if level == "+" || level == "#" {
+			return i
+		}
+	}
+	return len(levels)
+}
+
+//topicPolicy returns the filter and policy with the longest match for topic, or nil if no
+//policy applies. The policies are read with the liveLock held as Reload can replace them.
+func (h *Hrotti) topicPolicy(topic string) (string, *TopicPolicy) {
+	h.liveLock.RLock()
+	defer h.liveLock.RUnlock()
+	var matched string
+	var policy *TopicPolicy
+	levels := topicLevels(topic)
+	for filter, p := range h.TopicPolicies {
+		if (policy == nil || moreSpecific(filter, matched)) && match(topicLevels(filter), levels) {
+			matched, policy = filter, p
+		}
+	}
+	return matched, policy
+}
+
+//applyTopicPolicy checks a message c published against its topic's policy. It returns the
+//message to deliver, which is a copy at a lower QoS if the policy downgrades it, or nil if
+//the message is dropped, and true if c should be disconnected.
+func (h *Hrotti) applyTopicPolicy(c *Client, pp *PublishPacket) (*PublishPacket, bool) {
+	filter, policy := h.topicPolicy(pp.TopicName)
+	if policy == nil {
+		return pp, false
+	}
+	var broken string
+	switch {
+	case policy.MaxSize > 0 && len(pp.Payload) > policy.MaxSize:
+		broken = "payload over its maximum size"
+	case pp.Retain && policy.NoRetain:
+		broken = "retain flag not allowed"
+	case pp.Qos > policy.MaxQos && policy.DowngradeQos:
+		h.packetsLog.Debug("Downgraded PUBLISH to the QoS its topic policy allows", "client", c.clientID, "topic", pp.TopicName, "policy", filter, "qos", pp.Qos, "maxQos", policy.MaxQos)
+		downgraded := pp.Copy()
+		downgraded.Qos = policy.MaxQos
+		downgraded.Retain = pp.Retain
+		return downgraded, false
+	case pp.Qos > policy.MaxQos:
+		broken = "QoS over its maximum"
+	default:
+		return pp, false
+	}
+	h.stats.policyViolation()
+	h.discard(DropPolicy, pp, "")
+	h.packetsLog.Warn("PUBLISH broke its topic policy", "client", c.clientID, "topic", pp.TopicName, "policy", filter, "reason", broken)
+	return nil, policy.Action == DisconnectViolation
+}
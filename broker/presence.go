@@ -0,0 +1,74 @@
+package hrotti
+
+import (
+	"strings"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//Presence has the broker publish whether clients are connected, rather than every device
+//having to get a retained online message and a will of offline right. For a client whose id
+//starts with ClientIDPrefix the broker publishes Online to Topic, with %c replaced by the
+//client id, when it connects and Offline when it goes, both retained at Qos. They are
+//published whether or not the client has a will and however its connection ends, other than
+//being taken over by a new connection, which carries on with the client online. With
+//OnSessionEnd set Offline is published when the client's session ends rather than when its
+//connection drops, a clean session ends with its connection and a durable one when it
+//expires after SessionExpiry. A nil Online or Offline is "online" or "offline", an empty one
+//removes the retained message.
+type Presence struct {
+	ClientIDPrefix string
+	Topic          string
+	Online         []byte
+	Offline        []byte
+	Qos            byte
+	OnSessionEnd   bool
+}
+
+const defaultPresenceTopic = "presence/%c"
+
+//presenceTopic returns the topic the presence of clientID is published to, or "" if it isn't
+//published
+func (h *Hrotti) presenceTopic(clientID string) string {
+	p := h.Presence
+	if p == nil || !strings.HasPrefix(clientID, p.ClientIDPrefix) {
+		return ""
+	}
+	template := p.Topic
+	if template == "" {
+		template = defaultPresenceTopic
+	}
+	return strings.Replace(template, "%c", clientID, -1)
+}
+
+//publishPresence publishes the retained message saying clientID is online or offline, if its
+//presence is published. Online is published while the client is starting, which closing its
+//connection waits for, and Offline before a closed connection is marked disconnected, so the
+//online message of a quick reconnect can't be overtaken by the offline one before it.
+func (h *Hrotti) publishPresence(clientID string, online bool) {
+	topic := h.presenceTopic(clientID)
+	if topic == "" {
+		return
+	}
+	if strings.ContainsAny(topic, "+#") {
+		h.sessionLog.Warn("Not publishing presence, the client id makes the topic a filter", "client", clientID, "topic", topic)
+		return
+	}
+	state, payload := "offline", h.Presence.Offline
+	if online {
+		state, payload = "online", h.Presence.Online
+	}
+	if payload == nil {
+		payload = []byte(state)
+	}
+	h.sessionLog.Debug("Publishing presence", "client", clientID, "topic", topic, "state", state)
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = topic
+	pp.Payload = payload
+	pp.Qos = h.Presence.Qos
+	pp.Retain = true
+	message := h.ingest(topic, pp)
+	h.persistenceLog.Debug("Setting retained message", "topic", topic)
+	h.subs.retain(message)
+	h.route(message, nil)
+}
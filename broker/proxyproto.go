@@ -0,0 +1,205 @@
+package hrotti
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//PROXY protocol support, for listeners behind a load balancer such as HAProxy. The load
+//balancer starts each connection with a header giving the address of the real client,
+//either the v1 text form or the v2 binary form, before any TLS or MQTT.
+
+//proxyV2Signature starts a v2 header
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+//proxyV1MaxLength is the longest a v1 header can be, including the CRLF
+const proxyV1MaxLength = 107
+
+var errBadProxyHeader = errors.New("Connection did not start with a valid PROXY protocol header")
+
+//proxyListener reads the PROXY header of each connection it accepts in a goroutine of its
+//own, so a slow connection doesn't hold up the others, and only returns connections from
+//Accept once their header has been read. Connections without a valid header within timeout
+//are closed.
+type proxyListener struct {
+	net.Listener
+	timeout time.Duration
+	conns   chan net.Conn
+	done    chan struct{}
+	err     error
+	log     *logger
+}
+
+func newProxyListener(ln net.Listener, timeout time.Duration, log *logger) *proxyListener {
+	l := &proxyListener{
+		Listener: ln,
+		timeout:  timeout,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		log:      log,
+	}
+	go l.serve()
+	return l
+}
+
+func (l *proxyListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *proxyListener) handshake(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(l.timeout))
+	pc, err := readProxyHeader(conn)
+	if err != nil {
+		l.log.Warn("Failed to read PROXY header", "addr", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	select {
+	case l.conns <- pc:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+//proxyConn is a connection that started with a PROXY header, RemoteAddr is the real
+//client's address from the header, or the load balancer's if the header didn't have one
+//(such as for a load balancer health check).
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	//anything read past the header is still in the bufio.Reader
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+//readProxyHeader reads the v1 or v2 header from the start of conn
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	var addr net.Addr
+	switch first[0] {
+	case 'P':
+		addr, err = readProxyV1(r)
+	case proxyV2Signature[0]:
+		addr, err = readProxyV2(r)
+	default:
+		err = errBadProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: r, remoteAddr: addr}, nil
+}
+
+//readProxyV1 reads a header like "PROXY TCP4 192.168.0.1 192.168.0.11 56324 1883\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errBadProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, errBadProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, errBadProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errBadProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+//readProxyV2 reads a binary header, only the source address of a PROXY command over TCP is
+//used, anything else such as the TLVs is skipped
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, errBadProxyHeader
+	}
+	command := header[12] & 0x0F
+	family := header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	//a LOCAL command is the load balancer's own connection, such as a health check
+	if command == 0 {
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, errBadProxyHeader
+	}
+	switch family {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,156 @@
+//go:build quic
+
+package hrotti
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+//quicALPN is the application protocol QUIC clients have to ask for, the same as EMQX's
+const quicALPN = "mqtt"
+
+//listenQUIC listens for QUIC connections on the address of listener, each carries MQTT on
+//the first bidirectional stream the client opens. The TLS config is the listener's current
+//one, so Reload replaces its certificates as it does a tls listener's. QUIC's own idle
+//timeout is longer than any keepalive the broker allows, so it is the MQTT keepalive that
+//decides when a quiet client has gone. A client whose address changes, such as a phone
+//moving from WiFi to cellular, carries on over the same connection.
+func (h *Hrotti) listenQUIC(listener *internalListener) (net.Listener, error) {
+	tlsConfig := &tls.Config{
+		NextProtos: []string{quicALPN},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config, err := h.currentTLSConfig(listener)
+			if err != nil {
+				return nil, err
+			}
+			config = config.Clone()
+			config.NextProtos = []string{quicALPN}
+			return config, nil
+		},
+	}
+	keepAlive := time.Duration(h.MaxKeepAlive) * time.Second
+	if keepAlive == 0 {
+		keepAlive = 65535 * time.Second
+	}
+	ln, err := quic.ListenAddr(listener.url.Host, tlsConfig, &quic.Config{
+		HandshakeIdleTimeout: h.ConnectTimeout,
+		MaxIdleTimeout:       keepAlive * 3 / 2,
+	})
+	if err != nil {
+		return nil, err
+	}
+	q := &quicListener{ln: ln, conns: make(chan net.Conn), closed: make(chan struct{}), stats: &h.stats, log: h.listenerLog}
+	go q.acceptConnections(h.ConnectTimeout)
+	return q, nil
+}
+
+//quicListener is a net.Listener of the MQTT streams of QUIC connections
+type quicListener struct {
+	ln        *quic.Listener
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	stats     *BrokerStats
+	log       *logger
+}
+
+//acceptConnections accepts QUIC connections until the listener is closed, a connection
+//that doesn't open a stream within timeout is closed
+func (q *quicListener) acceptConnections(timeout time.Duration) {
+	defer q.Close()
+	for {
+		conn, err := q.ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(conn.Context(), timeout)
+			defer cancel()
+			stream, err := conn.AcceptStream(ctx)
+			if err != nil {
+				q.log.Debug("QUIC connection opened no stream", "addr", conn.RemoteAddr(), "err", err)
+				conn.CloseWithError(0, "no stream")
+				return
+			}
+			atomic.AddInt64(&q.stats.quicConnections, 1)
+			select {
+			case q.conns <- &quicConn{Stream: stream, conn: conn}:
+			case <-q.closed:
+				conn.CloseWithError(0, "listener closed")
+			}
+		}()
+	}
+}
+
+func (q *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-q.conns:
+		return conn, nil
+	case <-q.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (q *quicListener) Close() error {
+	var err error
+	q.closeOnce.Do(func() {
+		close(q.closed)
+		err = q.ln.Close()
+	})
+	return err
+}
+
+func (q *quicListener) Addr() net.Addr {
+	return q.ln.Addr()
+}
+
+//quicConn is the MQTT stream of a QUIC connection. Its RemoteAddr is the client's current
+//address, which changes if the connection migrates.
+type quicConn struct {
+	*quic.Stream
+	conn      *quic.Conn
+	closeOnce sync.Once
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+//ConnectionState returns the connection's TLS state, for the client's certificates
+func (c *quicConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+//quicCloseDelay is how long a closed quicConn waits for the client to close the connection,
+//closing it straight away would discard the packets still being sent such as a refused
+//CONNACK
+const quicCloseDelay = time.Second
+
+//Close stops reading from the stream and closes it for writing, sending what has been
+//written. The connection is closed once the client closes it or after quicCloseDelay.
+func (c *quicConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.Stream.CancelRead(0)
+		err = c.Stream.Close()
+		go func() {
+			select {
+			case <-c.conn.Context().Done():
+			case <-time.After(quicCloseDelay):
+				c.conn.CloseWithError(0, "")
+			}
+		}()
+	})
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !quic
+
+package hrotti
+
+import (
+	"errors"
+	"net"
+)
+
+//listenQUIC fails as QUIC listeners are only built with the quic build tag, so the default
+//build doesn't need quic-go
+func (h *Hrotti) listenQUIC(listener *internalListener) (net.Listener, error) {
+	return nil, errors.New("QUIC listeners need hrotti built with -tags quic")
+}
@@ -0,0 +1,427 @@
+package hrotti
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//Quota limits what the clients of one principal, the username they connected with, can use
+//of the broker between them, so one tenant of a shared broker can't crowd out the others.
+//MaxConnections is how many of its clients can be connected at once and MaxSessions how
+//many durable sessions they can have, a CONNECT that would go over either is refused with
+//the server unavailable return code. MaxQueuedBytes is the payload bytes of the QoS 1 and 2
+//messages held for its clients' sessions until they are acknowledged, and MaxRetained the
+//retained topics it can own, a topic being owned by the principal whose client last set its
+//retained message. Policy is what happens to a message that would go over either of those.
+//RateLimit replaces the rate limit of each of its clients. 0 is no limit.
+//
+//What a principal is using is counted from when the broker starts, the messages held for
+//sessions restored from persistence and the owners of retained messages aren't persisted so
+//they aren't counted until the clients connect or publish again.
+type Quota struct {
+	MaxConnections int
+	MaxSessions    int
+	MaxQueuedBytes int64
+	MaxRetained    int
+	RateLimit      *RateLimit
+	Policy         QuotaPolicy
+}
+
+//QuotaPolicy is what the broker does with a message that would take a principal over its
+//MaxQueuedBytes or MaxRetained
+type QuotaPolicy int
+
+const (
+	//RejectOverQuota drops a message that would be held over MaxQueuedBytes, and doesn't
+	//retain or deliver a retained message that would be over MaxRetained
+	RejectOverQuota QuotaPolicy = iota
+	//DropOldestOverQuota makes room for a retained message by clearing the retained topic
+	//the principal set longest ago, and for a message to a disconnected session by dropping
+	//the oldest messages held for that session. A connected client's messages may already be
+	//being written to it, so a message for one is still dropped.
+	DropOldestOverQuota
+)
+
+//QuotaAuthenticator is an Authenticator that decides the Quota of the principal it
+//authenticates, nil for no Quota, in place of the one for the username in the Auth. It is
+//called instead of Authenticate.
+type QuotaAuthenticator interface {
+	Authenticator
+	AuthenticateQuota(cp *ConnectPacket, conn ConnectionInfo) (byte, *Quota)
+}
+
+//quota returns the Quota for username, nil if it has none
+func (a *Auth) quota(username string) *Quota {
+	if a == nil {
+		return nil
+	}
+	return a.Quotas[username]
+}
+
+//quotaUsage is what one principal with a Quota is using, it is guarded by the lock of its
+//quotaTracker
+type quotaUsage struct {
+	tracker     *quotaTracker
+	principal   string
+	quota       *Quota
+	connections int
+	sessions    int
+	queuedBytes int64
+	//retained is the retained topics the principal owns, the one it set longest ago first
+	retained *list.List
+}
+
+//quotaTracker is the usage of every principal that has connected with a Quota. A principal's
+//Quota is the one it last connected with.
+type quotaTracker struct {
+	sync.Mutex
+	principals map[string]*quotaUsage
+	//owners is the element in its owner's retained list of each topic a principal owns
+	owners map[string]*list.Element
+}
+
+//an ownedTopic is a retained topic in its owner's list
+type ownedTopic struct {
+	topic string
+	owner *quotaUsage
+}
+
+//QuotaInfo is what a principal with a Quota is using, as returned by the admin API
+type QuotaInfo struct {
+	Username       string `json:"username"`
+	Connections    int    `json:"connections"`
+	MaxConnections int    `json:"maxConnections,omitempty"`
+	Sessions       int    `json:"sessions"`
+	MaxSessions    int    `json:"maxSessions,omitempty"`
+	QueuedBytes    int64  `json:"queuedBytes"`
+	MaxQueuedBytes int64  `json:"maxQueuedBytes,omitempty"`
+	Retained       int    `json:"retained"`
+	MaxRetained    int    `json:"maxRetained,omitempty"`
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{principals: make(map[string]*quotaUsage), owners: make(map[string]*list.Element)}
+}
+
+//reserve counts a new connection for principal, which has quota, and a new durable session
+//if it is durable and doesn't resume one the principal already has. connected and session
+//are the usage the existing client with the connection's client id, if there is one, has
+//its connection and durable session counted in. A takeover by the same principal doesn't
+//count against MaxConnections as the connection it replaces is closed. It returns the
+//principal's usage, or the name of the limit the connection would go over.
+func (t *quotaTracker) reserve(principal string, quota *Quota, connected *quotaUsage, session *quotaUsage, durable bool) (*quotaUsage, string) {
+	t.Lock()
+	defer t.Unlock()
+	u, ok := t.principals[principal]
+	if !ok {
+		u = &quotaUsage{tracker: t, principal: principal, retained: list.New()}
+		t.principals[principal] = u
+	}
+	u.quota = quota
+	connections := u.connections
+	if connected == u {
+		connections--
+	}
+	if quota.MaxConnections > 0 && connections >= quota.MaxConnections {
+		return nil, "connections"
+	}
+	newSession := durable && session != u
+	if newSession && quota.MaxSessions > 0 && u.sessions >= quota.MaxSessions {
+		return nil, "sessions"
+	}
+	u.connections++
+	if newSession {
+		u.sessions++
+	}
+	return u, ""
+}
+
+//attach makes u, which has had the connection reserved, the usage of the principal c is
+//connecting as, nil for one without a Quota. A durable session is moved to u and the
+//messages held for the session are charged to it.
+func (t *quotaTracker) attach(c *Client, u *quotaUsage, durable bool) {
+	session := u
+	if !durable {
+		session = nil
+	}
+	c.info.Lock()
+	previous := c.sessionQuota
+	c.quota, c.sessionQuota = u, session
+	c.info.Unlock()
+	if previous != nil && previous != session {
+		t.Lock()
+		previous.sessions--
+		t.Unlock()
+	}
+	c.chargeQueued(u)
+}
+
+//disconnected stops counting the connection of c, which has closed
+func (t *quotaTracker) disconnected(c *Client) {
+	c.info.Lock()
+	u := c.quota
+	c.quota = nil
+	c.info.Unlock()
+	if u != nil {
+		t.Lock()
+		u.connections--
+		t.Unlock()
+	}
+}
+
+//sessionEnded stops counting the session of c, which has been removed, and the messages
+//held for it
+func (t *quotaTracker) sessionEnded(c *Client) {
+	c.info.Lock()
+	u := c.sessionQuota
+	c.sessionQuota = nil
+	c.info.Unlock()
+	if u != nil {
+		t.Lock()
+		u.sessions--
+		t.Unlock()
+	}
+	c.chargeQueued(nil)
+}
+
+//limits returns the Quota u is using
+func (u *quotaUsage) limits() *Quota {
+	u.tracker.Lock()
+	defer u.tracker.Unlock()
+	return u.quota
+}
+
+//charge adds size to the bytes held for the principal, unless that would take it over its
+//MaxQueuedBytes
+func (u *quotaUsage) charge(size int64) bool {
+	u.tracker.Lock()
+	defer u.tracker.Unlock()
+	if max := u.quota.MaxQueuedBytes; max > 0 && u.queuedBytes+size > max {
+		return false
+	}
+	u.queuedBytes += size
+	return true
+}
+
+func (u *quotaUsage) uncharge(size int64) {
+	u.tracker.Lock()
+	defer u.tracker.Unlock()
+	u.queuedBytes -= size
+}
+
+//holdQueued counts size bytes for the message given id against the principal the client's
+//session belongs to. It returns false, and that principal's usage, if they would take it
+//over its MaxQueuedBytes.
+func (m *messageIDs) holdQueued(id uint16, size int64) (bool, *quotaUsage) {
+	m.Lock()
+	defer m.Unlock()
+	u := m.queuedTo
+	if u == nil {
+		return true, nil
+	}
+	if !u.charge(size) {
+		return false, u
+	}
+	if m.queued == nil {
+		m.queued = make(map[uint16]int64)
+	}
+	m.queued[id] = size
+	return true, u
+}
+
+//releaseQueued stops counting the message given id, the ids must be locked
+func (m *messageIDs) releaseQueued(id uint16) {
+	if size, ok := m.queued[id]; ok {
+		delete(m.queued, id)
+		m.queuedTo.uncharge(size)
+	}
+}
+
+//chargeQueued moves the bytes of the messages held for the client to u, nil stops
+//counting them
+func (m *messageIDs) chargeQueued(u *quotaUsage) {
+	m.Lock()
+	defer m.Unlock()
+	if m.queuedTo == u {
+		return
+	}
+	var total int64
+	for _, size := range m.queued {
+		total += size
+	}
+	if m.queuedTo != nil {
+		m.queuedTo.uncharge(total)
+	}
+	if u == nil {
+		m.queued = nil
+	} else {
+		u.tracker.Lock()
+		u.queuedBytes += total
+		u.tracker.Unlock()
+	}
+	m.queuedTo = u
+}
+
+//holdQueued counts msg, which has been given a message id, against the MaxQueuedBytes of the
+//principal c's session belongs to. Over the quota, a disconnected session whose Quota has
+//DropOldestOverQuota has its oldest messages dropped until msg fits, otherwise it returns
+//false and msg isn't to be queued. It is called with deliverMu held, so a disconnected
+//client can't start resending its messages while they are being dropped.
+func (h *Hrotti) holdQueued(c *Client, msg *PublishPacket) bool {
+	for {
+		held, u := c.messageIDs.holdQueued(msg.MessageID, int64(len(msg.Payload)))
+		if held {
+			return true
+		}
+		if u.limits().Policy != DropOldestOverQuota || c.state.Value() != DISCONNECTED || !h.dropOldestQueued(c) {
+			h.sessionLog.Warn("Queued bytes quota reached, dropping message", "client", c.clientID, "username", u.principal, "topic", msg.TopicName)
+			return false
+		}
+	}
+}
+
+//dropOldestQueued drops the oldest message held for c against its quota, returning false if
+//there isn't one
+func (h *Hrotti) dropOldestQueued(c *Client) bool {
+	c.messageIDs.RLock()
+	ids := make([]uint16, 0, len(c.queued))
+	for id := range c.queued {
+		ids = append(ids, id)
+	}
+	c.messageIDs.RUnlock()
+	c.sortByAge(ids)
+	//a QoS 2 message the client has received is only a PUBREL now
+	held := make(map[uint16]*PublishPacket)
+	h.PersistStore.RangeInflight(c.clientID, func(direction dirFlag, msgID uint16, message ControlPacket) bool {
+		if pp, ok := message.(*PublishPacket); ok && direction == OUTBOUND {
+			held[msgID] = pp
+		}
+		return true
+	})
+	for _, id := range ids {
+		if msg, ok := held[id]; ok {
+			h.sessionLog.Debug("Dropping oldest message for the queued bytes quota", "client", c.clientID, "id", id, "topic", msg.TopicName)
+			h.PersistStore.DeleteInflight(c.clientID, OUTBOUND, id)
+			c.freeID(id)
+			h.stats.DroppedMessage()
+			h.discard(DropQuota, msg, c.clientID)
+			return true
+		}
+	}
+	return false
+}
+
+//own makes owner, nil for a publisher without a Quota, the owner of the retained message
+//being set on topic, an empty one clearing it. It returns false if owner is at its
+//MaxRetained and rejects the message, and the topic to clear if it makes room by dropping
+//the oldest topic it owns.
+func (t *quotaTracker) own(topic string, owner *quotaUsage, clearing bool) (bool, string) {
+	t.Lock()
+	defer t.Unlock()
+	element, owned := t.owners[topic]
+	if owned && !clearing && element.Value.(*ownedTopic).owner == owner {
+		//setting it again makes it the newest topic the owner set
+		owner.retained.MoveToBack(element)
+		return true, ""
+	}
+	var evicted string
+	if owner != nil && !clearing {
+		if max := owner.quota.MaxRetained; max > 0 && owner.retained.Len() >= max {
+			if owner.quota.Policy != DropOldestOverQuota {
+				return false, ""
+			}
+			evicted = owner.retained.Front().Value.(*ownedTopic).topic
+			t.disown(evicted)
+		}
+	}
+	if owned {
+		t.disown(topic)
+	}
+	if owner != nil && !clearing {
+		t.owners[topic] = owner.retained.PushBack(&ownedTopic{topic: topic, owner: owner})
+	}
+	return true, evicted
+}
+
+//disown forgets the owner of topic, the tracker must be locked
+func (t *quotaTracker) disown(topic string) {
+	if element, ok := t.owners[topic]; ok {
+		element.Value.(*ownedTopic).owner.retained.Remove(element)
+		delete(t.owners, topic)
+	}
+}
+
+//retainedOwner returns the usage of the principal of the client that published message, nil
+//if it wasn't published by a client with a Quota
+func (h *Hrotti) retainedOwner(message *Message) *quotaUsage {
+	//a broker without quotas doesn't need to look up the publisher of every retained message
+	h.quotas.Lock()
+	none := len(h.quotas.principals) == 0
+	h.quotas.Unlock()
+	if none {
+		return nil
+	}
+	c := h.getClient(message.Publisher)
+	if c == nil {
+		return nil
+	}
+	c.info.RLock()
+	defer c.info.RUnlock()
+	return c.quota
+}
+
+//clearRetained clears the retained message on topic, from the broker and from persistence
+func (h *Hrotti) clearRetained(topic string) {
+	h.subs.Lock()
+	h.subs.retained.set(topic, nil, false, 0)
+	h.subs.Unlock()
+	h.topicStats.retained(topic, true)
+	if err := h.PersistStore.DeleteRetained(topic); err != nil {
+		h.persistenceLog.Error("Failed to delete retained message", "topic", topic, "err", err)
+	}
+}
+
+//reserveQuota reserves the connection and durable session of the client connecting with cp
+//against quota, returning the principal's usage or the server unavailable return code if
+//either would be over the quota
+func (h *Hrotti) reserveQuota(cp *ConnectPacket, quota *Quota) (*quotaUsage, byte) {
+	var connected, session *quotaUsage
+	if existing := h.getClient(cp.ClientIdentifier); existing != nil {
+		existing.info.RLock()
+		connected, session = existing.quota, existing.sessionQuota
+		existing.info.RUnlock()
+	}
+	u, over := h.quotas.reserve(cp.Username, quota, connected, session, !cp.CleanSession)
+	if over != "" {
+		h.sessionLog.Warn("Quota reached, refusing client", "client", cp.ClientIdentifier, "username", cp.Username, "quota", over)
+		return nil, CONN_REF_SERV_UNAVAIL
+	}
+	return u, CONN_ACCEPTED
+}
+
+//QuotaUsage returns what each principal that has connected with a Quota is using, sorted by
+//username
+func (h *Hrotti) QuotaUsage() []QuotaInfo {
+	t := h.quotas
+	t.Lock()
+	usage := make([]QuotaInfo, 0, len(t.principals))
+	for _, u := range t.principals {
+		usage = append(usage, QuotaInfo{
+			Username:       u.principal,
+			Connections:    u.connections,
+			MaxConnections: u.quota.MaxConnections,
+			Sessions:       u.sessions,
+			MaxSessions:    u.quota.MaxSessions,
+			QueuedBytes:    u.queuedBytes,
+			MaxQueuedBytes: u.quota.MaxQueuedBytes,
+			Retained:       u.retained.Len(),
+			MaxRetained:    u.quota.MaxRetained,
+		})
+	}
+	t.Unlock()
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Username < usage[j].Username })
+	return usage
+}
@@ -0,0 +1,134 @@
+package hrotti
+
+import (
+	"sync/atomic"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//RateLimitPolicy is what the broker does when a client publishes faster than its RateLimit
+type RateLimitPolicy int
+
+const (
+	//DelayPublishes stops reading from the client until it is back within its limit, so
+	//the client is slowed down by TCP backpressure
+	DelayPublishes RateLimitPolicy = iota
+	//DropQos0Publishes drops QoS 0 messages over the limit, QoS 1 and 2 messages are
+	//delayed as they have to be acknowledged
+	DropQos0Publishes
+	//DisconnectPublisher delays messages over the limit until the client has gone over it
+	//MaxViolations times, then disconnects it
+	DisconnectPublisher
+)
+
+//RateLimit limits the PUBLISH messages a client can send to MessagesPerSecond messages
+//and BytesPerSecond bytes of payload a second, 0 is no limit. A client can send a second's
+//worth in a burst before it is limited.
+type RateLimit struct {
+	MessagesPerSecond float64
+	BytesPerSecond    float64
+	Policy            RateLimitPolicy
+	MaxViolations     int
+}
+
+//the results of rateLimiter.limit
+const (
+	rateAccept = iota
+	rateDrop
+	rateDisconnect
+)
+
+//tokenBucket holds up to rate tokens and refills at rate tokens a second, a rate of 0
+//means it never runs out
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+//wait returns how long until n tokens are available, the tokens can go below 0 so a
+//message larger than the bucket is allowed once it has filled
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	if b.tokens >= n || b.tokens >= b.rate {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64) {
+	b.tokens -= n
+}
+
+//rateLimiter applies a RateLimit to the messages from one client, it is only used by the
+//client's Receive goroutine
+type rateLimiter struct {
+	RateLimit
+	messages   *tokenBucket
+	bytes      *tokenBucket
+	violations int
+}
+
+func newRateLimiter(limit *RateLimit) *rateLimiter {
+	if limit == nil || (limit.MessagesPerSecond <= 0 && limit.BytesPerSecond <= 0) {
+		return nil
+	}
+	return &rateLimiter{
+		RateLimit: *limit,
+		messages:  newTokenBucket(limit.MessagesPerSecond),
+		bytes:     newTokenBucket(limit.BytesPerSecond),
+	}
+}
+
+//limit decides what to do with pp received from c, if pp is over the limit and is to be
+//delivered limit blocks until it is within the limit or the client is stopped.
+func (r *rateLimiter) limit(c *Client, pp *PublishPacket) int {
+	size := float64(len(pp.Payload))
+	now := time.Now()
+	wait := r.messages.wait(1, now)
+	if bytesWait := r.bytes.wait(size, now); bytesWait > wait {
+		wait = bytesWait
+	}
+	if wait > 0 {
+		r.violations++
+		switch {
+		case r.Policy == DropQos0Publishes && pp.Qos == 0:
+			atomic.AddInt64(&c.rateDropped, 1)
+			return rateDrop
+		case r.Policy == DisconnectPublisher && r.violations >= r.MaxViolations:
+			return rateDisconnect
+		}
+		atomic.AddInt64(&c.rateDelayed, 1)
+		select {
+		case <-time.After(wait):
+		case <-c.stop:
+			return rateDrop
+		}
+	}
+	r.messages.take(1)
+	r.bytes.take(size)
+	return rateAccept
+}
+
+//rateLimit returns the RateLimit for a client that connected with username and is using
+//auth, a limit for the username in the Auth overrides the broker's RateLimit
+func (h *Hrotti) rateLimit(auth *Auth, username string) *RateLimit {
+	if auth != nil && username != "" {
+		if limit, ok := auth.RateLimits[username]; ok {
+			return limit
+		}
+	}
+	return h.RateLimit
+}
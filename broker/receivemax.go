@@ -0,0 +1,48 @@
+package hrotti
+
+import (
+	"sync/atomic"
+)
+
+//receiving is the number of QoS 1 and 2 messages from the client that haven't been fully
+//acknowledged: QoS 2 messages waiting for the client's PUBREL, and PUBACKs and PUBCOMPs
+//that are queued but not yet written. It is only called by the Receive goroutine.
+func (c *Client) receiving() int {
+	return len(c.inboundQos2) + int(atomic.LoadInt64(&c.acksQueued))
+}
+
+//waitToReceive stops reading from the client while it has ReceiveMaximum messages
+//unacknowledged and the broker is still to write some of the acknowledgements, so a client
+//publishing faster than the broker can acknowledge is slowed by TCP backpressure. It can't
+//wait for messages waiting on the client's PUBREL as the PUBREL has to be read. It returns
+//false if the client is stopped while waiting.
+func (c *Client) waitToReceive(hrotti *Hrotti) bool {
+	for hrotti.ReceiveMaximum > 0 && c.receiving() >= hrotti.ReceiveMaximum && atomic.LoadInt64(&c.acksQueued) > 0 {
+		select {
+		case <-c.ackWritten:
+		case <-c.stop:
+			return false
+		}
+	}
+	return true
+}
+
+//overReceiveMaximum is true if a new QoS 1 or 2 message would take the client over its
+//ReceiveMaximum, which after waitToReceive means it has sent that many QoS 2 messages
+//without releasing them
+func (c *Client) overReceiveMaximum(hrotti *Hrotti) bool {
+	return hrotti.ReceiveMaximum > 0 && c.receiving() >= hrotti.ReceiveMaximum
+}
+
+//ackQueued and ackSent count the PUBACKs and PUBCOMPs between being queued and written
+func (c *Client) ackQueued() {
+	atomic.AddInt64(&c.acksQueued, 1)
+}
+
+func (c *Client) ackSent() {
+	atomic.AddInt64(&c.acksQueued, -1)
+	select {
+	case c.ackWritten <- struct{}{}:
+	default:
+	}
+}
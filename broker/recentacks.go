@@ -0,0 +1,37 @@
+package hrotti
+
+//recentAcks is a ring of the message ids of the last QoS 1 messages acknowledged on a
+//client's connection. A client that didn't get our PUBACK sends the message again with Dup
+//set, if its id is one of these the message has already been delivered and is only
+//acknowledged again. It is only used by the Receive goroutine and starts empty for each
+//connection, so a message resent after a reconnect is delivered again, which QoS 1 allows.
+type recentAcks struct {
+	ids  []uint16
+	next int
+}
+
+//newRecentAcks returns a ring of size message ids, a size of 0 remembers none
+func newRecentAcks(size int) *recentAcks {
+	return &recentAcks{ids: make([]uint16, 0, size)}
+}
+
+func (r *recentAcks) contains(id uint16) bool {
+	for _, acked := range r.ids {
+		if acked == id {
+			return true
+		}
+	}
+	return false
+}
+
+//add remembers id, replacing the oldest id once the ring is full
+func (r *recentAcks) add(id uint16) {
+	switch {
+	case cap(r.ids) == 0:
+	case len(r.ids) < cap(r.ids):
+		r.ids = append(r.ids, id)
+	default:
+		r.ids[r.next] = id
+		r.next = (r.next + 1) % len(r.ids)
+	}
+}
@@ -0,0 +1,211 @@
+package hrotti
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+//A minimal client for the Redis protocol (RESP), enough for RedisPersistence. Commands are
+//sent as arrays of bulk strings and pipelined, every command of a call to do is written
+//before any reply is read.
+
+//redisTimeout is how long a connection to Redis gets to connect or to answer a pipeline
+const redisTimeout = 5 * time.Second
+
+//redisError is an error reply from Redis, the connection it came from is still usable
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+//redisPool hands out connections to Redis, keeping up to size idle connections for reuse
+type redisPool struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+func newRedisPool(addr, password string, db, size int) *redisPool {
+	if size <= 0 {
+		size = 1
+	}
+	return &redisPool{
+		addr:     addr,
+		password: password,
+		db:       db,
+		idle:     make(chan *redisConn, size),
+	}
+}
+
+//dial opens a new connection, authenticating and selecting the database if they are set
+func (p *redisPool) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", p.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	var setup [][]string
+	if p.password != "" {
+		setup = append(setup, []string{"AUTH", p.password})
+	}
+	if p.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(p.db)})
+	}
+	if len(setup) > 0 {
+		if _, err := rc.pipeline(setup); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+//do sends the commands to Redis and returns their replies. An error reply to any of them is
+//returned as a redisError after all the replies have been read.
+func (p *redisPool) do(commands ...[]string) ([]interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-p.idle:
+	default:
+		var err error
+		if rc, err = p.dial(); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := rc.pipeline(commands)
+	if _, ok := err.(redisError); err != nil && !ok {
+		//the connection is in an unknown state after a network or protocol error
+		rc.Close()
+		return nil, err
+	}
+	select {
+	case p.idle <- rc:
+	default:
+		rc.Close()
+	}
+	return replies, err
+}
+
+func (p *redisPool) close() {
+	for {
+		select {
+		case rc := <-p.idle:
+			rc.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (rc *redisConn) pipeline(commands [][]string) ([]interface{}, error) {
+	rc.SetDeadline(time.Now().Add(redisTimeout))
+	for _, command := range commands {
+		fmt.Fprintf(rc.w, "*%d\r\n", len(command))
+		for _, arg := range command {
+			fmt.Fprintf(rc.w, "$%d\r\n", len(arg))
+			rc.w.WriteString(arg)
+			rc.w.WriteString("\r\n")
+		}
+	}
+	if err := rc.w.Flush(); err != nil {
+		return nil, err
+	}
+	var replyErr error
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		reply, err := readRedisReply(rc.r)
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := reply.(redisError); ok && replyErr == nil {
+			replyErr = e
+		}
+		replies[i] = reply
+	}
+	return replies, replyErr
+}
+
+var errBadRedisReply = errors.New("Malformed reply from Redis")
+
+//readRedisReply reads one reply, a simple or bulk string is returned as a string, a null
+//as nil, an integer as an int64, an array as a []interface{} and an error as a redisError
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errBadRedisReply
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return redisError(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errBadRedisReply
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errBadRedisReply
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		array := make([]interface{}, count)
+		for i := range array {
+			if array[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return nil, errBadRedisReply
+}
+
+//redisStrings returns the strings in an array reply, nil elements are returned as ""
+func redisStrings(reply interface{}) []string {
+	array, _ := reply.([]interface{})
+	strings := make([]string, len(array))
+	for i, element := range array {
+		strings[i], _ = element.(string)
+	}
+	return strings
+}
+
+//redisHash returns an HGETALL reply as a map
+func redisHash(reply interface{}) map[string]string {
+	fields := redisStrings(reply)
+	hash := make(map[string]string, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		hash[fields[i]] = fields[i+1]
+	}
+	return hash
+}
@@ -0,0 +1,248 @@
+package hrotti
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//RedisPersistence keeps the broker state in the Redis server at Addr, every key starting
+//with Prefix, using up to PoolSize idle connections. Retained messages are a hash of topic
+//to packet, each session is a hash of its subscriptions and disconnect time with the set of
+//client ids that have one, and each client's inflight messages are a sorted set of keys in
+//direction and message id order with a hash of key to packet. Packets are stored in their
+//MQTT wire format.
+//Only one broker can use a Prefix, two brokers writing the same keys overwrite each other's
+//sessions. Open fails if Redis can't be reached, so the broker keeps its state in memory.
+type RedisPersistence struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string
+	PoolSize int
+	pool     *redisPool
+	log      *logger
+}
+
+//setLog sets the logger p traces to, that of the broker using it
+func (p *RedisPersistence) setLog(log *logger) {
+	p.log = log
+}
+
+func (p *RedisPersistence) Open() error {
+	p.pool = newRedisPool(p.Addr, p.Password, p.DB, p.PoolSize)
+	_, err := p.pool.do([]string{"PING"})
+	return err
+}
+
+func (p *RedisPersistence) Close() error {
+	p.pool.close()
+	return nil
+}
+
+func (p *RedisPersistence) key(name string) string {
+	return p.Prefix + name
+}
+
+//inflightScore orders a client's inflight messages by direction then message id
+func inflightScore(direction dirFlag, msgID uint16) string {
+	return strconv.Itoa(int(direction)<<16 | int(msgID))
+}
+
+func (p *RedisPersistence) StoreRetained(topic string, message *PublishPacket) error {
+	_, err := p.pool.do([]string{"HSET", p.key("retained"), topic, string(packPacket(message))})
+	return err
+}
+
+//LoadRetained returns the retained message for topic, or nil if there isn't one
+func (p *RedisPersistence) LoadRetained(topic string) (*PublishPacket, error) {
+	replies, err := p.pool.do([]string{"HGET", p.key("retained"), topic})
+	if err != nil {
+		return nil, err
+	}
+	data, ok := replies[0].(string)
+	if !ok {
+		return nil, nil
+	}
+	cp, err := unpackPacket([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	message, ok := cp.(*PublishPacket)
+	if !ok {
+		return nil, errors.New("Retained message is not a PUBLISH")
+	}
+	return message, nil
+}
+
+func (p *RedisPersistence) DeleteRetained(topic string) error {
+	_, err := p.pool.do([]string{"HDEL", p.key("retained"), topic})
+	return err
+}
+
+func (p *RedisPersistence) RangeRetained(f func(string, *PublishPacket) bool) error {
+	replies, err := p.pool.do([]string{"HGETALL", p.key("retained")})
+	if err != nil {
+		return err
+	}
+	for topic, data := range redisHash(replies[0]) {
+		cp, err := unpackPacket([]byte(data))
+		if err != nil {
+			return err
+		}
+		message, ok := cp.(*PublishPacket)
+		if !ok {
+			return errors.New("Retained message is not a PUBLISH")
+		}
+		if !f(topic, message) {
+			break
+		}
+	}
+	return nil
+}
+
+func (p *RedisPersistence) StoreSession(client string, session *Session) error {
+	subscriptions, err := json.Marshal(session.Subscriptions)
+	if err != nil {
+		return err
+	}
+	var disconnectedAt string
+	if !session.DisconnectedAt.IsZero() {
+		disconnectedAt = session.DisconnectedAt.Format(time.RFC3339Nano)
+	}
+	_, err = p.pool.do(
+		[]string{"MULTI"},
+		[]string{"HSET", p.key("session:" + client), "subscriptions", string(subscriptions), "disconnectedAt", disconnectedAt},
+		[]string{"SADD", p.key("sessions"), client},
+		[]string{"EXEC"},
+	)
+	return err
+}
+
+//sessionFromHash returns the session stored in a session hash, or nil if it is empty
+func sessionFromHash(hash map[string]string) (*Session, error) {
+	if len(hash) == 0 {
+		return nil, nil
+	}
+	session := &Session{}
+	if err := json.Unmarshal([]byte(hash["subscriptions"]), &session.Subscriptions); err != nil {
+		return nil, err
+	}
+	if hash["disconnectedAt"] != "" {
+		disconnectedAt, err := time.Parse(time.RFC3339Nano, hash["disconnectedAt"])
+		if err != nil {
+			return nil, err
+		}
+		session.DisconnectedAt = disconnectedAt
+	}
+	return session, nil
+}
+
+//LoadSession returns the session for client, or nil if there isn't one
+func (p *RedisPersistence) LoadSession(client string) (*Session, error) {
+	replies, err := p.pool.do([]string{"HGETALL", p.key("session:" + client)})
+	if err != nil {
+		return nil, err
+	}
+	return sessionFromHash(redisHash(replies[0]))
+}
+
+//DeleteSession removes the session and any inflight messages for client
+func (p *RedisPersistence) DeleteSession(client string) error {
+	_, err := p.pool.do(
+		[]string{"MULTI"},
+		[]string{"DEL", p.key("session:" + client), p.key("inflight:" + client), p.key("packets:" + client)},
+		[]string{"SREM", p.key("sessions"), client},
+		[]string{"EXEC"},
+	)
+	return err
+}
+
+func (p *RedisPersistence) RangeSessions(f func(string, *Session) bool) error {
+	replies, err := p.pool.do([]string{"SMEMBERS", p.key("sessions")})
+	if err != nil {
+		return err
+	}
+	clients := redisStrings(replies[0])
+	if len(clients) == 0 {
+		return nil
+	}
+	commands := make([][]string, len(clients))
+	for i, client := range clients {
+		commands[i] = []string{"HGETALL", p.key("session:" + client)}
+	}
+	if replies, err = p.pool.do(commands...); err != nil {
+		return err
+	}
+	for i, client := range clients {
+		session, err := sessionFromHash(redisHash(replies[i]))
+		if err != nil {
+			return err
+		}
+		if session != nil && !f(client, session) {
+			break
+		}
+	}
+	return nil
+}
+
+func (p *RedisPersistence) StoreInflight(client string, direction dirFlag, msgID uint16, message ControlPacket) error {
+	p.log.Trace("Persisting inflight message", "client", client, "id", msgID)
+	key := string(inflightKeyBytes(direction, msgID))
+	_, err := p.pool.do(
+		[]string{"MULTI"},
+		[]string{"ZADD", p.key("inflight:" + client), inflightScore(direction, msgID), key},
+		[]string{"HSET", p.key("packets:" + client), key, string(packPacket(message))},
+		[]string{"EXEC"},
+	)
+	return err
+}
+
+func (p *RedisPersistence) DeleteInflight(client string, direction dirFlag, msgID uint16) error {
+	p.log.Trace("Removing inflight message", "client", client, "id", msgID)
+	key := string(inflightKeyBytes(direction, msgID))
+	_, err := p.pool.do(
+		[]string{"MULTI"},
+		[]string{"ZREM", p.key("inflight:" + client), key},
+		[]string{"HDEL", p.key("packets:" + client), key},
+		[]string{"EXEC"},
+	)
+	return err
+}
+
+//RangeInflight calls f for the inflight messages for client in direction and message id
+//order, the same order as the BoltPersistence. They are all read before f is called so f
+//can modify the store.
+func (p *RedisPersistence) RangeInflight(client string, f func(dirFlag, uint16, ControlPacket) bool) error {
+	replies, err := p.pool.do(
+		[]string{"ZRANGE", p.key("inflight:" + client), "0", "-1"},
+		[]string{"HGETALL", p.key("packets:" + client)},
+	)
+	if err != nil {
+		return err
+	}
+	packets := redisHash(replies[1])
+	var keys []string
+	var messages []ControlPacket
+	for _, key := range redisStrings(replies[0]) {
+		data, ok := packets[key]
+		if !ok || len(key) != 3 {
+			continue
+		}
+		message, err := unpackPacket([]byte(data))
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		messages = append(messages, message)
+	}
+	for i, key := range keys {
+		if !f(dirFlag(key[0]), uint16(key[1])<<8|uint16(key[2]), messages[i]) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package hrotti
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"reflect"
+)
+
+//ReloadConfig is the configuration Reload applies to a running broker. Listeners are the
+//configs of the running listeners by name, the certificate, key, CA file, client
+//certificate checks and Auth of each are applied and anything else about a listener needs
+//a restart.
+type ReloadConfig struct {
+	MaxPacketSize int
+	RateLimit     *RateLimit
+	Auth          *Auth
+	TopicPolicies map[string]*TopicPolicy
+	Listeners     map[string]*ListenerConfig
+}
+
+//Reload applies config to the running broker without dropping any connections. New TLS
+//handshakes use the reloaded certificates, the ACLs of connected clients are replaced and
+//the MaxPacketSize and TopicPolicies apply to the next packet each client sends. Rate limits apply from a
+//client's next connection. A listener that was added, removed or changed in a way that
+//can't be applied live is logged as needing a restart. A listener whose certificates fail
+//to load keeps the ones it has and the error is returned.
+func (h *Hrotti) Reload(config *ReloadConfig) error {
+	var reloadErr error
+	h.liveLock.Lock()
+	defer h.liveLock.Unlock()
+	h.MaxPacketSize = config.MaxPacketSize
+	h.RateLimit = config.RateLimit
+	h.Auth = config.Auth
+	h.TopicPolicies = config.TopicPolicies
+	for name, listener := range h.listeners {
+		newConfig, ok := config.Listeners[name]
+		if !ok {
+			h.listenerLog.Warn("Listener removed from the config, it needs a restart to stop", "listener", name)
+			continue
+		}
+		if !listener.config.sameListener(newConfig) {
+			h.listenerLog.Warn("Listener changed in a way that needs a restart to take effect", "listener", name)
+		}
+		listener.config.Auth = newConfig.Auth
+		if listener.tlsConfig == nil {
+			continue
+		}
+		tlsConfig, err := h.loadTLSConfig(name, newConfig)
+		if err != nil {
+			reloadErr = err
+			continue
+		}
+		listener.tlsConfig = tlsConfig
+		h.listenerLog.Info("Reloaded certificates", "listener", name)
+	}
+	for name := range config.Listeners {
+		if _, ok := h.listeners[name]; !ok {
+			h.listenerLog.Warn("Listener added to the config, it needs a restart to start", "listener", name)
+		}
+	}
+	//clients that are still starting pick up their ACL in Start, which takes the liveLock
+	h.clients.RLock()
+	for _, c := range h.clients.list {
+		c.info.Lock()
+		//internal clients such as the local side of a bridge have no connection or ACL
+		if c.conn != nil {
+			c.auth, _ = h.authFor(c.listenerConfig)
+			c.acl = c.auth.acl(c.username)
+		}
+		c.info.Unlock()
+	}
+	h.clients.RUnlock()
+	h.listenerLog.Info("Configuration reloaded")
+	return reloadErr
+}
+
+//maxPacketSize is the MaxPacketSize, which Reload can change
+func (h *Hrotti) maxPacketSize() int {
+	h.liveLock.RLock()
+	defer h.liveLock.RUnlock()
+	return h.MaxPacketSize
+}
+
+//sameListener is true if l and other only differ in what Reload applies
+func (l *ListenerConfig) sameListener(other *ListenerConfig) bool {
+	a, b := *l, *other
+	a.CertFile, a.KeyFile, a.CAFile, a.Auth, a.Authenticator = "", "", "", nil, nil
+	b.CertFile, b.KeyFile, b.CAFile, b.Auth, b.Authenticator = "", "", "", nil, nil
+	a.CRLFile, a.DeniedFingerprints, a.AllowedFingerprints = "", nil, nil
+	b.CRLFile, b.DeniedFingerprints, b.AllowedFingerprints = "", nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+//loadTLSConfig loads the certificate, key, CA file and client certificate checks of the tls
+//or wss listener called name with config
+func (h *Hrotti) loadTLSConfig(name string, config *ListenerConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		h.listenerLog.Error("Failed to load certificate", "listener", name, "err", err)
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	var ca []byte
+	if config.CAFile != "" {
+		ca, err = ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			h.listenerLog.Error("Failed to load CA file", "listener", name, "err", err)
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(ca) {
+			h.listenerLog.Error("No certificates found in CA file", "listener", name)
+			return nil, errors.New("No certificates found in CA file " + config.CAFile)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	check, err := newCertCheck(name, config, parseCertificates(ca), &h.stats, h.listenerLog)
+	if err != nil {
+		h.listenerLog.Error("Failed to load client certificate checks", "listener", name, "err", err)
+		return nil, err
+	}
+	if check != nil {
+		tlsConfig.VerifyConnection = check.verify
+	}
+	return tlsConfig, nil
+}
+
+//currentTLSConfig returns the TLS config for a new handshake on listener, the one loaded
+//by AddListener or the last Reload
+func (h *Hrotti) currentTLSConfig(listener *internalListener) (*tls.Config, error) {
+	h.liveLock.RLock()
+	defer h.liveLock.RUnlock()
+	return listener.tlsConfig, nil
+}
@@ -0,0 +1,331 @@
+package hrotti
+
+import (
+	"container/list"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//RetainedLimitPolicy is what the broker does with a retained message over its MaxRetainedMessages
+//or MaxRetainedSize
+type RetainedLimitPolicy int
+
+const (
+	//DeliverNotRetained delivers the message to its subscribers without retaining it
+	DeliverNotRetained RetainedLimitPolicy = iota
+	//RejectRetained drops the message, it is neither retained nor delivered. MQTT 3.1.1 has no
+	//way to tell the publisher so a QoS 1 or 2 message is still acknowledged.
+	RejectRetained
+)
+
+//retainWithin sets the retained message for topic unless that would take the number of
+//retained topics over max, a max of 0 is no limit. Replacing or clearing a retained message
+//is always allowed.
+func (s *subscriptionMap) retainWithin(topic string, message *Message, max int) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.retained.set(topic, message, false, max)
+}
+
+//overRetainedLimits is true if message can't be retained on topic with the broker's
+//retained limits
+func (h *Hrotti) overRetainedLimits(topic string, message *Message) bool {
+	if h.MaxRetainedSize > 0 && len(message.Payload) > h.MaxRetainedSize {
+		return true
+	}
+	return !h.subs.retainWithin(topic, message, h.MaxRetainedMessages)
+}
+
+//PurgeRetained deletes the retained messages on every topic matching filter, from the broker
+//and from persistence, and returns how many were deleted
+func (h *Hrotti) PurgeRetained(filter string) int {
+	route := topicLevels(filter)
+	var purged []string
+	h.subs.Lock()
+	for _, topic := range h.subs.retained.topics() {
+		if match(route, topicLevels(topic)) {
+			h.subs.retained.set(topic, nil, false, 0)
+			purged = append(purged, topic)
+		}
+	}
+	h.subs.Unlock()
+	for _, topic := range purged {
+		h.quotas.own(topic, nil, true)
+		h.topicStats.retained(topic, true)
+		if err := h.PersistStore.DeleteRetained(topic); err != nil {
+			h.persistenceLog.Error("Failed to delete purged retained message", "topic", topic, "err", err)
+		}
+	}
+	h.persistenceLog.Info("Purged retained messages", "filter", filter, "count", len(purged))
+	return len(purged)
+}
+
+//retainedStore is the broker's retained messages. Every retained topic has an entry, but
+//with a cache limit only the most recently used messages are kept in memory, the rest are
+//evicted down to their topic, QoS and size and loaded from persistence when a subscription
+//matches them. A message is only evicted once it has been persisted, so one that couldn't be,
+//or a $SYS message that never is, stays in memory. The subscriptionMap lock decides the order
+//retained messages are set and copied, the store's own lock lets a message be loaded, cached
+//or moved to the front of the LRU list under the read lock.
+type retainedStore struct {
+	sync.Mutex
+	entries map[string]*retainedEntry
+	//lru is the persisted entries with their message in memory, most recently used first
+	lru         *list.List
+	bytes       int
+	inMemory    int
+	maxBytes    int
+	maxMessages int
+	hits        int64
+	misses      int64
+	evictions   int64
+}
+
+//a retainedEntry is a retained topic, message is nil once it has been evicted. version
+//changes each time the topic's message is replaced, so a message loaded from persistence
+//after being replaced isn't cached over its replacement.
+type retainedEntry struct {
+	topic     string
+	qos       byte
+	size      int
+	message   *Message
+	persisted bool
+	version   uint64
+	element   *list.Element
+}
+
+//a retainedMatch is a retained message matching a subscription, to be delivered at qos.
+//message is the PUBLISH ready to deliver, or nil if it was evicted and has to be loaded.
+type retainedMatch struct {
+	topic   string
+	qos     byte
+	version uint64
+	message *PublishPacket
+}
+
+func newRetainedStore() *retainedStore {
+	return &retainedStore{entries: make(map[string]*retainedEntry), lru: list.New()}
+}
+
+//setLimits sets the most payload bytes and messages kept in memory, 0 is no limit, and
+//evicts messages until the store is within them
+func (r *retainedStore) setLimits(maxBytes int, maxMessages int) {
+	r.Lock()
+	defer r.Unlock()
+	r.maxBytes, r.maxMessages = maxBytes, maxMessages
+	r.evict()
+}
+
+//set makes message the retained message for topic, a nil or empty message clears it.
+//persisted is true for a message loaded from persistence, one that is set otherwise can't be
+//evicted until it has been persisted. A new topic isn't added if that would take the number
+//of topics over max, 0 is no limit, and set returns false.
+func (r *retainedStore) set(topic string, message *Message, persisted bool, max int) bool {
+	r.Lock()
+	defer r.Unlock()
+	entry, ok := r.entries[topic]
+	if message == nil || len(message.Payload) == 0 {
+		if ok {
+			r.drop(entry)
+			delete(r.entries, topic)
+		}
+		return true
+	}
+	if !ok {
+		if max > 0 && len(r.entries) >= max {
+			return false
+		}
+		entry = &retainedEntry{topic: topic}
+		r.entries[topic] = entry
+	}
+	r.drop(entry)
+	entry.qos, entry.size, entry.version = message.Qos, len(message.Payload), entry.version+1
+	r.keep(entry, message, persisted)
+	r.evict()
+	return true
+}
+
+//persisted marks message as persisted if it is still the retained message for topic, so it
+//can be evicted
+func (r *retainedStore) persisted(topic string, message *Message) {
+	r.Lock()
+	defer r.Unlock()
+	if entry, ok := r.entries[topic]; ok && entry.message == message && !entry.persisted {
+		r.drop(entry)
+		r.keep(entry, message, true)
+		r.evict()
+	}
+}
+
+//get returns the retained message for topic and its version, the message is nil if it has
+//been evicted. ok is false if topic has no retained message.
+func (r *retainedStore) get(topic string) (message *Message, version uint64, ok bool) {
+	r.Lock()
+	defer r.Unlock()
+	entry, ok := r.entries[topic]
+	if !ok {
+		return nil, 0, false
+	}
+	r.used(entry)
+	return entry.message, entry.version, true
+}
+
+//cache keeps message, loaded from persistence, in memory if it is still version of the
+//retained message for topic
+func (r *retainedStore) cache(topic string, version uint64, message *Message) {
+	r.Lock()
+	defer r.Unlock()
+	if entry, ok := r.entries[topic]; ok && entry.version == version && entry.message == nil {
+		r.keep(entry, message, true)
+		r.evict()
+	}
+}
+
+//matching returns the retained messages on topics matching filter to deliver at qos,
+//making the PUBLISH for those in memory and leaving the evicted ones to be loaded
+func (r *retainedStore) matching(filter string, qos byte) []retainedMatch {
+	r.Lock()
+	defer r.Unlock()
+	if !strings.ContainsAny(filter, "#+") {
+		if entry, ok := r.entries[filter]; ok {
+			return []retainedMatch{r.match(entry, qos)}
+		}
+		return nil
+	}
+	var matches []retainedMatch
+	route := topicLevels(filter)
+	for topic, entry := range r.entries {
+		if match(route, topicLevels(topic)) {
+			matches = append(matches, r.match(entry, qos))
+		}
+	}
+	return matches
+}
+
+//match returns the retainedMatch for entry at qos, the store must be locked
+func (r *retainedStore) match(entry *retainedEntry, qos byte) retainedMatch {
+	r.used(entry)
+	m := retainedMatch{topic: entry.topic, qos: calcMinQos(entry.qos, qos), version: entry.version}
+	if entry.message != nil {
+		m.message = entry.message.packet(m.qos, true)
+	}
+	return m
+}
+
+//used counts a hit or a miss for entry and moves it to the front of the LRU list
+func (r *retainedStore) used(entry *retainedEntry) {
+	if entry.message == nil {
+		atomic.AddInt64(&r.misses, 1)
+		return
+	}
+	atomic.AddInt64(&r.hits, 1)
+	if entry.element != nil {
+		r.lru.MoveToFront(entry.element)
+	}
+}
+
+//keep puts message in memory as entry's message
+func (r *retainedStore) keep(entry *retainedEntry, message *Message, persisted bool) {
+	entry.message, entry.persisted = message, persisted
+	r.bytes += entry.size
+	r.inMemory++
+	if persisted {
+		entry.element = r.lru.PushFront(entry)
+	}
+}
+
+//drop takes entry's message out of memory
+func (r *retainedStore) drop(entry *retainedEntry) {
+	if entry.message == nil {
+		return
+	}
+	if entry.element != nil {
+		r.lru.Remove(entry.element)
+		entry.element = nil
+	}
+	r.bytes -= entry.size
+	r.inMemory--
+	entry.message = nil
+}
+
+//evict drops the least recently used persisted messages until the store is within its
+//limits or only messages that can't be evicted are left
+func (r *retainedStore) evict() {
+	for (r.maxBytes > 0 && r.bytes > r.maxBytes) || (r.maxMessages > 0 && r.inMemory > r.maxMessages) {
+		last := r.lru.Back()
+		if last == nil {
+			return
+		}
+		r.drop(last.Value.(*retainedEntry))
+		atomic.AddInt64(&r.evictions, 1)
+	}
+}
+
+//len returns the number of retained topics
+func (r *retainedStore) len() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.entries)
+}
+
+//usage returns the number of messages and payload bytes in memory
+func (r *retainedStore) usage() (int, int) {
+	r.Lock()
+	defer r.Unlock()
+	return r.inMemory, r.bytes
+}
+
+//topics returns the retained topics in order
+func (r *retainedStore) topics() []string {
+	r.Lock()
+	topics := make([]string, 0, len(r.entries))
+	for topic := range r.entries {
+		topics = append(topics, topic)
+	}
+	r.Unlock()
+	sort.Strings(topics)
+	return topics
+}
+
+//snapshot returns the retained topics sorted by topic
+func (r *retainedStore) snapshot() []RetainedInfo {
+	r.Lock()
+	retained := make([]RetainedInfo, 0, len(r.entries))
+	for topic, entry := range r.entries {
+		retained = append(retained, RetainedInfo{Topic: topic, Qos: entry.qos, Size: entry.size})
+	}
+	r.Unlock()
+	sort.Slice(retained, func(i, j int) bool { return retained[i].Topic < retained[j].Topic })
+	return retained
+}
+
+//retainedMessage returns the retained message for topic, loading it from persistence if it
+//has been evicted, or nil if there isn't one. The message is shared and mustn't be changed.
+func (h *Hrotti) retainedMessage(topic string) *Message {
+	message, version, ok := h.subs.retained.get(topic)
+	if !ok || message != nil {
+		return message
+	}
+	return h.loadRetained(topic, version)
+}
+
+//loadRetained loads the evicted retained message for topic from persistence and caches it if
+//it is still version of the topic's message. It returns nil if it couldn't be loaded, or the
+//topic's message has been cleared since.
+func (h *Hrotti) loadRetained(topic string, version uint64) *Message {
+	pp, err := h.PersistStore.LoadRetained(topic)
+	if err != nil {
+		h.persistenceLog.Error("Failed to load retained message", "topic", topic, "err", err)
+		return nil
+	}
+	if pp == nil {
+		return nil
+	}
+	message := newMessage(topic, pp)
+	h.subs.retained.cache(topic, version, message)
+	return message
+}
@@ -0,0 +1,182 @@
+package hrotti
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//Retained sync lets an edge broker that bridges to this one fetch the retained messages
+//for its topics when it first comes online, without them all being sent in one burst.
+//The bridge client publishes a RetainedSyncRequest as JSON to $bridge/sync/request, the
+//matching retained messages are then sent to it in topic order at no more than
+//RetainedSyncRate messages a second, followed by a RetainedSyncComplete on
+//$bridge/sync/complete. As messages arrive in topic order the last topic received works
+//as a cursor that can be passed in a later request to resume an interrupted sync.
+//Once a client has asked for a sync it is no longer sent retained messages when it
+//subscribes, so the sync request should be published before subscribing. Filters the
+//client's ACL doesn't let it subscribe to are left out of the sync, and messages are sent at
+//no more than the QoS they were retained at, MaxRetainedQos and the QoS of the filters they
+//match, as they would be on subscribing.
+
+const (
+	RetainedSyncRequestTopic  = "$bridge/sync/request"
+	RetainedSyncCompleteTopic = "$bridge/sync/complete"
+	defaultRetainedSyncRate   = 1000
+	//MaxRetainedSyncRate is the highest RetainedSyncRate, one message a nanosecond
+	MaxRetainedSyncRate = int(time.Second)
+)
+
+//RetainedSyncRequest is the payload a bridge publishes to start a retained sync,
+//only retained messages matching Filters with topics sorting after Cursor are sent.
+//Qos is the QoS of each filter as the bridge subscribes to it, a filter without one is
+//QoS 2. Rate can ask for fewer messages a second than the broker's RetainedSyncRate.
+type RetainedSyncRequest struct {
+	Filters []string `json:"filters"`
+	Qos     []int    `json:"qos,omitempty"`
+	Cursor  string   `json:"cursor,omitempty"`
+	Rate    int      `json:"rate,omitempty"`
+}
+
+//RetainedSyncComplete is the payload of the completion marker sent when a sync has
+//finished, Cursor is the last topic sent (or the request's cursor if none were)
+type RetainedSyncComplete struct {
+	Count  int    `json:"count"`
+	Cursor string `json:"cursor"`
+}
+
+//retainedTopicsAfter returns the topics with retained messages that match any of the
+//filters and sort after cursor, in order, with the highest QoS of the filters each matches.
+func (h *Hrotti) retainedTopicsAfter(filters []string, qoss []byte, cursor string) ([]string, []byte) {
+	var topics []string
+	var topicQoss []byte
+	splitFilters := make([][]string, len(filters))
+	for i, filter := range filters {
+		splitFilters[i] = topicLevels(filter)
+	}
+	h.subs.RLock()
+	for _, topic := range h.subs.retained.topics() {
+		if topic <= cursor {
+			continue
+		}
+		splitTopic := topicLevels(topic)
+		matched := false
+		var qos byte
+		for i, filter := range splitFilters {
+			if match(filter, splitTopic) {
+				matched = true
+				if qoss[i] > qos {
+					qos = qoss[i]
+				}
+			}
+		}
+		if matched {
+			topics = append(topics, topic)
+			topicQoss = append(topicQoss, qos)
+		}
+	}
+	h.subs.RUnlock()
+	return topics, topicQoss
+}
+
+//startRetainedSync parses a sync request published by c and starts sending it the
+//matching retained messages, any sync already running for c is cancelled first.
+func (h *Hrotti) startRetainedSync(c *Client, payload []byte) {
+	var req RetainedSyncRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.sessionLog.Warn("Bad retained sync request", "client", c.clientID, "err", err)
+		return
+	}
+	//a filter the client couldn't subscribe to is dropped with its QoS
+	var filters []string
+	var qoss []byte
+	for i, filter := range req.Filters {
+		if !c.canSubscribe(filter) {
+			h.sessionLog.Warn("Retained sync filter denied by ACL", "client", c.clientID, "filter", filter)
+			continue
+		}
+		qos := byte(2)
+		if i < len(req.Qos) && req.Qos[i] >= 0 && req.Qos[i] < 2 {
+			qos = byte(req.Qos[i])
+		}
+		filters = append(filters, filter)
+		qoss = append(qoss, qos)
+	}
+	req.Filters = filters
+	rate := h.RetainedSyncRate
+	if rate <= 0 {
+		rate = defaultRetainedSyncRate
+	} else if rate > MaxRetainedSyncRate {
+		rate = MaxRetainedSyncRate
+	}
+	if req.Rate > 0 && req.Rate < rate {
+		rate = req.Rate
+	}
+	//from now on this client gets retained messages through syncs rather than when it subscribes
+	c.retainedSynced = true
+	if c.retainedSyncStop != nil {
+		close(c.retainedSyncStop)
+	}
+	c.retainedSyncStop = make(chan struct{})
+	h.sessionLog.Info("Starting retained sync", "client", c.clientID, "filters", req.Filters, "cursor", req.Cursor)
+	go h.retainedSync(c, req, qoss, rate, c.retainedSyncStop)
+}
+
+func (h *Hrotti) retainedSync(c *Client, req RetainedSyncRequest, qoss []byte, rate int, stop chan struct{}) {
+	defer c.recoverPanic(h, "retained sync")
+	topics, topicQoss := h.retainedTopicsAfter(req.Filters, qoss, req.Cursor)
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+
+	complete := RetainedSyncComplete{Cursor: req.Cursor}
+	for i, topic := range topics {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-c.stop:
+			return
+		}
+		msg := h.retainedMessage(topic)
+		//the retained message may have been cleared since the topics were collected, and one
+		//that came in over a bridge isn't synced to another if it has crossed enough already
+		if msg == nil || c.bridge && h.hopped(msg.Hops) {
+			continue
+		}
+		qos := calcMinQos(calcMinQos(msg.Qos, h.MaxRetainedQos), topicQoss[i])
+		if !h.sendRetainedSync(c, msg.packet(qos, true), stop) {
+			return
+		}
+		complete.Count++
+		complete.Cursor = topic
+	}
+
+	marker := NewControlPacket(PUBLISH).(*PublishPacket)
+	marker.TopicName = RetainedSyncCompleteTopic
+	marker.Qos = 1
+	marker.Payload, _ = json.Marshal(complete)
+	if h.sendRetainedSync(c, marker, stop) {
+		h.sessionLog.Info("Retained sync complete", "client", c.clientID, "messages", complete.Count)
+	}
+}
+
+//sendRetainedSync queues msg for c, blocking until there is room in the client's queue
+//so a large sync is paced by the client rather than dropping messages.
+func (h *Hrotti) sendRetainedSync(c *Client, msg *PublishPacket, stop chan struct{}) bool {
+	if !c.Connected() {
+		return false
+	}
+	if msg.Qos > 0 {
+		if queue, _ := h.storeOutbound(c, msg); !queue {
+			return false
+		}
+	}
+	select {
+	case c.outboundMessages <- msg:
+		return true
+	case <-stop:
+	case <-c.stop:
+	}
+	return false
+}
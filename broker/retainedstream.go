@@ -0,0 +1,222 @@
+package hrotti
+
+import (
+	"sync/atomic"
+)
+
+//A new subscription matching more retained messages than fit in the client's queue has them
+//streamed to it, rather than queued at once with the ones that don't fit dropped and the
+//client taken for a slow consumer. A goroutine queues them while fewer than
+//RetainedHighWater messages are waiting for the client and otherwise waits for Send to take
+//messages off the queue, so the rest of the queue is left for live messages, which are
+//queued as they arrive in between. A live message to a topic whose retained message hasn't
+//been streamed yet means that retained message is skipped, so the client still never gets an
+//older retained message after a newer live one. Unsubscribing drops the subscription's
+//retained messages that are still to be streamed, and the stream stops when the client
+//disconnects.
+
+//a retainedStream is the retained messages still to be streamed to a client, it is guarded
+//by the client's deliverMu
+type retainedStream struct {
+	subscriptions []*streamedSubscription
+	//pending is the number of messages still to be streamed for each topic, and overtaken the
+	//topics among them that a live message has been queued for
+	pending   map[string]int
+	overtaken map[string]bool
+	//stop is the stop channel of the connection the stream is for
+	stop chan struct{}
+	log  *logger
+}
+
+//a streamedSubscription is the retained messages still to be streamed for a subscription
+type streamedSubscription struct {
+	subscription string
+	retained     []retainedMatch
+}
+
+//RetainedProgress is the progress of the retained messages being streamed to a client, in
+//its ClientInfo. Skipped are the ones that weren't sent, because they were cleared, a live
+//message to their topic was sent first or the subscription was removed.
+type RetainedProgress struct {
+	Sent      int64 `json:"sent"`
+	Skipped   int64 `json:"skipped"`
+	Remaining int64 `json:"remaining"`
+	//Paused is set while the client's queue is at the high-water mark
+	Paused bool `json:"paused"`
+}
+
+//retainedHighWater is the number of messages waiting for c that streamed retained messages
+//are queued up to, by default half the client's queue
+func (h *Hrotti) retainedHighWater(c *Client) int {
+	capacity := cap(c.outboundMessages)
+	if h.RetainedHighWater > 0 && h.RetainedHighWater < capacity {
+		return h.RetainedHighWater
+	}
+	if capacity < 2 {
+		return 1
+	}
+	return capacity / 2
+}
+
+//streamRetained adds the retained messages for subscription to the client's stream, starting
+//one if it hasn't got one. Any of the subscription's messages still to be streamed from an
+//earlier SUBSCRIBE are replaced. The client's deliverMu must be held.
+func (h *Hrotti) streamRetained(c *Client, subscription string, retained []retainedMatch) {
+	stream := c.retainedStream
+	if stream == nil {
+		c.info.RLock()
+		stop := c.stop
+		c.info.RUnlock()
+		stream = &retainedStream{pending: make(map[string]int), overtaken: make(map[string]bool), stop: stop, log: h.sessionLog}
+		c.retainedStream = stream
+		atomic.StoreInt64(&c.stats.retainedTotal, 0)
+		atomic.StoreInt64(&c.stats.retainedSent, 0)
+		atomic.StoreInt64(&c.stats.retainedSkipped, 0)
+		go h.retainedStreamer(c, stream)
+	}
+	stream.cancel(c, subscription)
+	stream.subscriptions = append(stream.subscriptions, &streamedSubscription{subscription, retained})
+	for _, m := range retained {
+		stream.pending[m.topic]++
+	}
+	atomic.AddInt64(&c.stats.retainedTotal, int64(len(retained)))
+	h.sessionLog.Debug("Streaming retained messages", "client", c.clientID, "filter", subscription, "messages", len(retained))
+}
+
+//retainedStreamer queues the stream's messages for c as there is room for them until they
+//have all been queued or the connection is closed
+func (h *Hrotti) retainedStreamer(c *Client, stream *retainedStream) {
+	defer c.recoverPanic(h, "retained stream")
+	for {
+		if finished := h.streamQueued(c, stream); finished {
+			atomic.StoreInt32(&c.stats.retainedPaused, 0)
+			return
+		}
+		atomic.StoreInt32(&c.stats.retainedPaused, 1)
+		select {
+		case <-c.queueDrained:
+		case <-stream.stop:
+		}
+		atomic.StoreInt32(&c.stats.retainedPaused, 0)
+	}
+}
+
+//streamQueued queues the stream's messages while there is room for them and returns true
+//once there are none left or the connection has closed. deliverMu is unlocked by a defer so
+//a panic doesn't leave it held as the connection is closed.
+func (h *Hrotti) streamQueued(c *Client, stream *retainedStream) bool {
+	c.deliverMu.Lock()
+	defer c.deliverMu.Unlock()
+	for len(stream.subscriptions) > 0 && c.queueDepth() < h.retainedHighWater(c) && !stream.stopped() {
+		h.streamNext(c, stream)
+	}
+	finished := len(stream.subscriptions) == 0 || stream.stopped()
+	if finished {
+		stream.abandon(c)
+		if c.retainedStream == stream {
+			c.retainedStream = nil
+		}
+	}
+	return finished
+}
+
+//streamNext queues the stream's next message, unless a live message to its topic has been
+//queued since the stream started
+func (h *Hrotti) streamNext(c *Client, stream *retainedStream) {
+	sub := stream.subscriptions[0]
+	m := sub.retained[0]
+	if sub.retained = sub.retained[1:]; len(sub.retained) == 0 {
+		stream.subscriptions = stream.subscriptions[1:]
+	}
+	overtaken := stream.overtaken[m.topic]
+	stream.unpend(m.topic)
+	if !overtaken && h.sendRetained(c, sub.subscription, m) {
+		atomic.AddInt64(&c.stats.retainedSent, 1)
+	} else {
+		atomic.AddInt64(&c.stats.retainedSkipped, 1)
+	}
+}
+
+func (s *retainedStream) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+//overtake records that a live message to topic has been queued for the client
+func (s *retainedStream) overtake(topic string) {
+	if s.pending[topic] > 0 {
+		s.overtaken[topic] = true
+	}
+}
+
+func (s *retainedStream) unpend(topic string) {
+	if s.pending[topic]--; s.pending[topic] <= 0 {
+		delete(s.pending, topic)
+		delete(s.overtaken, topic)
+	}
+}
+
+//cancel drops the messages still to be streamed for subscription
+func (s *retainedStream) cancel(c *Client, subscription string) {
+	kept := s.subscriptions[:0]
+	for _, sub := range s.subscriptions {
+		if sub.subscription != subscription {
+			kept = append(kept, sub)
+			continue
+		}
+		for _, m := range sub.retained {
+			s.unpend(m.topic)
+		}
+		atomic.AddInt64(&c.stats.retainedSkipped, int64(len(sub.retained)))
+		s.log.Debug("Stopped streaming retained messages", "client", c.clientID, "filter", subscription, "remaining", len(sub.retained))
+	}
+	s.subscriptions = kept
+}
+
+//abandon drops every message still to be streamed as the connection has been closed
+func (s *retainedStream) abandon(c *Client) {
+	for _, sub := range s.subscriptions {
+		atomic.AddInt64(&c.stats.retainedSkipped, int64(len(sub.retained)))
+	}
+	s.subscriptions = nil
+}
+
+//cancelRetained stops streaming the retained messages for subscription to c, the client's
+//deliverMu must be held
+func (c *Client) cancelRetained(subscription string) {
+	if c.retainedStream == nil {
+		return
+	}
+	c.retainedStream.cancel(c, subscription)
+	//the streamer may be waiting for the queue to drain, with nothing left it can finish now
+	if len(c.retainedStream.subscriptions) == 0 {
+		c.signalDrained()
+	}
+}
+
+//signalDrained wakes a retained streamer waiting for room in the client's queue
+func (c *Client) signalDrained() {
+	select {
+	case c.queueDrained <- struct{}{}:
+	default:
+	}
+}
+
+//retainedProgress returns the progress of the stream of retained messages to c, nil if
+//there aren't any still to be sent
+func (c *Client) retainedProgress() *RetainedProgress {
+	progress := &RetainedProgress{
+		Sent:    atomic.LoadInt64(&c.stats.retainedSent),
+		Skipped: atomic.LoadInt64(&c.stats.retainedSkipped),
+		Paused:  atomic.LoadInt32(&c.stats.retainedPaused) == 1,
+	}
+	progress.Remaining = atomic.LoadInt64(&c.stats.retainedTotal) - progress.Sent - progress.Skipped
+	if progress.Remaining <= 0 {
+		return nil
+	}
+	return progress
+}
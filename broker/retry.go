@@ -0,0 +1,143 @@
+package hrotti
+
+import (
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//an inflightMessage is a QoS 1 or 2 PUBLISH, or the PUBREL for one, that has been written to
+//the client and not yet acknowledged. packet is the last copy written, so a timer set for an
+//earlier one knows it has been superseded.
+type inflightMessage struct {
+	packet   ControlPacket
+	expires  time.Time
+	attempts int
+}
+
+//sentInflight is called by Send after writing msg, if it is a QoS 1 or 2 PUBLISH or a PUBREL
+//it is resent every RetryInterval, up to MaxRetries times, until the client acknowledges it,
+//and a PUBLISH is dropped when it expires. Once the client has sent its PUBREC the message
+//has been delivered so the PUBREL doesn't expire.
+func (c *Client) sentInflight(hrotti *Hrotti, msg ControlPacket) {
+	if hrotti.wheel == nil {
+		return
+	}
+	var msgID uint16
+	var expires time.Time
+	switch msg := msg.(type) {
+	case *PublishPacket:
+		if msg.Qos == 0 {
+			return
+		}
+		msgID, expires = msg.MessageID, hrotti.expiresAt(msg)
+	case *PubrelPacket:
+		msgID = msg.MessageID
+	default:
+		return
+	}
+	c.messageIDs.Lock()
+	//a resend is already scheduled, and a message acknowledged before it got here is done
+	if entry := c.sent[msgID]; (entry != nil && entry.packet == msg) || c.index[msgID] == nil {
+		c.messageIDs.Unlock()
+		return
+	}
+	entry := &inflightMessage{packet: msg, expires: expires}
+	if c.sent == nil {
+		c.sent = make(map[uint16]*inflightMessage)
+	}
+	c.sent[msgID] = entry
+	c.messageIDs.Unlock()
+	c.scheduleRetry(hrotti, msgID, entry)
+}
+
+//scheduleRetry sets the timer for the next resend or the expiry of entry, whichever is sooner
+func (c *Client) scheduleRetry(hrotti *Hrotti, msgID uint16, entry *inflightMessage) {
+	var next time.Duration
+	if hrotti.RetryInterval > 0 && (hrotti.MaxRetries == 0 || entry.attempts < hrotti.MaxRetries) {
+		next = hrotti.RetryInterval
+	}
+	if !entry.expires.IsZero() {
+		if untilExpiry := entry.expires.Sub(hrotti.Clock.Now()); next == 0 || untilExpiry < next {
+			next = untilExpiry
+		}
+	} else if next == 0 {
+		return
+	}
+	hrotti.wheel.schedule(next, func() { c.retry(hrotti, msgID, entry) })
+}
+
+//retry runs on the timing wheel when entry is due to be resent or expire. It does nothing if
+//the message has been acknowledged or superseded since, and a client that has disconnected
+//has its inflight messages resent when it reconnects.
+func (c *Client) retry(hrotti *Hrotti, msgID uint16, entry *inflightMessage) {
+	c.messageIDs.Lock()
+	if c.sent[msgID] != entry {
+		c.messageIDs.Unlock()
+		return
+	}
+	if !entry.expires.IsZero() && !hrotti.Clock.Now().Before(entry.expires) {
+		delete(c.sent, msgID)
+		delete(c.index, msgID)
+		c.messageIDs.Unlock()
+		hrotti.packetsLog.Debug("Unacknowledged message expired", "client", c.clientID, "id", msgID)
+		hrotti.PersistStore.DeleteInflight(c.clientID, OUTBOUND, msgID)
+		hrotti.stats.expiredMessage()
+		hrotti.discard(DropExpired, entry.packet.(*PublishPacket), c.clientID)
+		return
+	}
+	if !c.Connected() {
+		delete(c.sent, msgID)
+		c.messageIDs.Unlock()
+		return
+	}
+	resend := entry.packet
+	if pp, ok := entry.packet.(*PublishPacket); ok {
+		//the copy that was written may still be being read by Send
+		copied := pp.Copy()
+		copied.Qos, copied.Retain, copied.MessageID = pp.Qos, pp.Retain, pp.MessageID
+		copied.Dup = true
+		resend = copied
+	}
+	entry.attempts++
+	entry.packet = resend
+	c.messageIDs.Unlock()
+	hrotti.packetsLog.Debug("Resending unacknowledged message", "client", c.clientID, "id", msgID, "attempt", entry.attempts)
+	//the channels are only closed with deliverMu held, after the client is marked disconnected
+	c.deliverMu.Lock()
+	if c.Connected() {
+		select {
+		case c.outboundPriority <- resend:
+		default:
+		}
+	}
+	c.deliverMu.Unlock()
+	c.scheduleRetry(hrotti, msgID, entry)
+}
+
+//dropExpired drops msg if it has expired before being sent, freeing its message id and
+//removing it from persistence if it has one. It returns true if msg was dropped.
+func (c *Client) dropExpired(hrotti *Hrotti, msg *PublishPacket) bool {
+	expires := hrotti.expiresAt(msg)
+	if expires.IsZero() || hrotti.Clock.Now().Before(expires) {
+		return false
+	}
+	hrotti.packetsLog.Debug("Queued message expired", "client", c.clientID, "topic", msg.TopicName)
+	if msg.Qos > 0 && msg.MessageID != 0 {
+		hrotti.PersistStore.DeleteInflight(c.clientID, OUTBOUND, msg.MessageID)
+		c.freeID(msg.MessageID)
+	}
+	hrotti.stats.expiredMessage()
+	hrotti.discard(DropExpired, msg, c.clientID)
+	return true
+}
+
+//expiresAt returns when msg expires, zero for never. A message loaded from persistence has
+//no expiry time but has the time it was received, so it expires MessageExpiry after that
+//as it would have if the broker hadn't restarted.
+func (h *Hrotti) expiresAt(msg *PublishPacket) time.Time {
+	if msg.ExpiresAt.IsZero() && h.MessageExpiry > 0 && !msg.ReceivedAt.IsZero() {
+		return msg.ReceivedAt.Add(h.MessageExpiry)
+	}
+	return msg.ExpiresAt
+}
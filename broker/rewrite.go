@@ -0,0 +1,179 @@
+package hrotti
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//TopicRewrite is a rule that rewrites the topic of a PUBLISH from a client, and the filters
+//it subscribes to, so devices can keep using old topics while the rest of the system moves
+//to new ones. Each level of From is either a literal or a {name} that captures whatever is
+//at that level, which To can use, so "v1/{id}/data -> telemetry/{id}" rewrites v1/a/data to
+//telemetry/a and the filter v1/+/data to telemetry/+.
+type TopicRewrite struct {
+	From string
+	To   string
+	from []rewriteLevel
+	to   []rewriteLevel
+}
+
+//rewriteLevel is a level of a rule, capture is the index of the level of From a {name} is
+//captured from, or -1 for a literal
+type rewriteLevel struct {
+	literal string
+	capture int
+}
+
+//ParseTopicRewrite returns the rule written as "from -> to"
+func ParseTopicRewrite(rule string) (*TopicRewrite, error) {
+	from, to, ok := strings.Cut(rule, "->")
+	if !ok {
+		return nil, fmt.Errorf("topic rewrite %q should be written as from -> to", rule)
+	}
+	return NewTopicRewrite(strings.TrimSpace(from), strings.TrimSpace(to))
+}
+
+//NewTopicRewrite returns the rule rewriting from to to, each {name} used in to has to be
+//captured by from and neither can have wildcards
+func NewTopicRewrite(from string, to string) (*TopicRewrite, error) {
+	r := &TopicRewrite{From: from, To: to}
+	captures := make(map[string]int)
+	for i, level := range topicLevels(from) {
+		name, capture, err := rewriteCapture(level)
+		if err != nil {
+			return nil, fmt.Errorf("topic rewrite %s -> %s: %s", from, to, err.Error())
+		}
+		if !capture {
+			r.from = append(r.from, rewriteLevel{literal: level, capture: -1})
+			continue
+		}
+		if _, ok := captures[name]; ok {
+			return nil, fmt.Errorf("topic rewrite %s -> %s captures {%s} twice", from, to, name)
+		}
+		captures[name] = i
+		r.from = append(r.from, rewriteLevel{capture: i})
+	}
+	for _, level := range topicLevels(to) {
+		name, capture, err := rewriteCapture(level)
+		if err != nil {
+			return nil, fmt.Errorf("topic rewrite %s -> %s: %s", from, to, err.Error())
+		}
+		if !capture {
+			r.to = append(r.to, rewriteLevel{literal: level, capture: -1})
+			continue
+		}
+		i, ok := captures[name]
+		if !ok {
+			return nil, fmt.Errorf("topic rewrite %s -> %s uses {%s} which isn't captured", from, to, name)
+		}
+		r.to = append(r.to, rewriteLevel{capture: i})
+	}
+	if from == "" || to == "" || strings.HasPrefix(from, "$") || strings.HasPrefix(to, "$") {
+		return nil, fmt.Errorf("topic rewrite %s -> %s has an empty or $ topic", from, to)
+	}
+	return r, nil
+}
+
+//rewriteCapture returns the name of a level that is a {name}
+func rewriteCapture(level string) (string, bool, error) {
+	if strings.ContainsAny(level, "+#") {
+		return "", false, errors.New("wildcards can't be used, capture a level with {name}")
+	}
+	if !strings.HasPrefix(level, "{") || !strings.HasSuffix(level, "}") {
+		if strings.ContainsAny(level, "{}") {
+			return "", false, fmt.Errorf("level %q isn't a {name}", level)
+		}
+		return "", false, nil
+	}
+	name := level[1 : len(level)-1]
+	if name == "" || strings.ContainsAny(name, "{}") {
+		return "", false, fmt.Errorf("level %q isn't a {name}", level)
+	}
+	return name, true, nil
+}
+
+//rewrite returns the rewritten topic or filter if levels matches From. A capture matches any
+//level, including + in a filter, but a filter's # only matches the same # so it is left as
+//it is: it could match topics the rule doesn't rewrite.
+func (r *TopicRewrite) rewrite(levels []string) (string, bool) {
+	if len(levels) != len(r.from) {
+		return "", false
+	}
+	for i, level := range r.from {
+		if level.capture < 0 && levels[i] != level.literal || level.capture >= 0 && levels[i] == "#" {
+			return "", false
+		}
+	}
+	rewritten := make([]string, len(r.to))
+	for i, level := range r.to {
+		if level.capture < 0 {
+			rewritten[i] = level.literal
+		} else {
+			rewritten[i] = levels[level.capture]
+		}
+	}
+	return strings.Join(rewritten, "/"), true
+}
+
+//produces is true if a topic rewritten by r could be rewritten again by other
+func (r *TopicRewrite) produces(other *TopicRewrite) bool {
+	if len(r.to) != len(other.from) {
+		return false
+	}
+	for i, level := range r.to {
+		if level.capture < 0 && other.from[i].capture < 0 && level.literal != other.from[i].literal {
+			return false
+		}
+	}
+	return true
+}
+
+//checkTopicRewrites refuses rules where a rewritten topic matches a rule, including the one
+//that rewrote it, as rewriting it again could go on forever and only the first rule that
+//matches is ever applied
+func checkTopicRewrites(rules []*TopicRewrite) error {
+	for _, r := range rules {
+		for _, other := range rules {
+			if r.produces(other) {
+				return fmt.Errorf("topic rewrite %s -> %s makes topics that %s -> %s rewrites again", r.From, r.To, other.From, other.To)
+			}
+		}
+	}
+	return nil
+}
+
+//CheckTopicRewrites checks the rules for a listener together with the broker's own rules,
+//which are applied after it
+func CheckTopicRewrites(listener []*TopicRewrite, global []*TopicRewrite) error {
+	return checkTopicRewrites(append(append([]*TopicRewrite(nil), listener...), global...))
+}
+
+//rewriteTopic applies the first rule matching topic, those of c's listener then the broker's,
+//and returns the topic to use in its place. filter is true for a SUBSCRIBE or UNSUBSCRIBE.
+func (h *Hrotti) rewriteTopic(c *Client, topic string, filter bool) string {
+	var listenerRules []*TopicRewrite
+	if c.listenerConfig != nil {
+		listenerRules = c.listenerConfig.TopicRewrites
+	}
+	if len(listenerRules) == 0 && len(h.TopicRewrites) == 0 {
+		return topic
+	}
+	levels := topicLevels(topic)
+	for _, rules := range [][]*TopicRewrite{listenerRules, h.TopicRewrites} {
+		for _, r := range rules {
+			rewritten, ok := r.rewrite(levels)
+			if !ok {
+				continue
+			}
+			h.stats.topicRewritten()
+			if filter {
+				h.packetsLog.Debug("Rewrote subscription filter", "client", c.clientID, "filter", topic, "rewritten", rewritten, "rule", r.From)
+			} else {
+				h.packetsLog.Debug("Rewrote PUBLISH topic", "client", c.clientID, "topic", topic, "rewritten", rewritten, "rule", r.From)
+			}
+			return rewritten
+		}
+	}
+	return topic
+}
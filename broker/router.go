@@ -2,45 +2,138 @@ package hrotti
 
 import (
 	. "github.com/alsm/hrotti/packets"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 type subscriptionMap struct {
-	subElements map[string][]string
-	subMap      map[string]map[string]byte
-	subBitmap   []map[string]map[string]bool
-	retained    map[string]*PublishPacket
+	filters  *topicNode
+	subMap   map[string]map[string]*subscriber
+	shared   map[string]*sharedGroup
+	retained *retainedStore
+	matches  *matchCache
+	//counts is the number of subscriptions each client has, including those of sessions
+	//restored from persistence
+	counts map[string]int
+	//version is incremented each time a subscription is removed, see Client.deliverRouted
+	version uint64
 	sync.RWMutex
 }
 
-var subs subscriptionMap
+//a subscriber is a single client's entry for a topic filter, the client pointer
+//is kept so that fan-out can compare publisher identity without any string compares
+type subscriber struct {
+	client  *Client
+	qos     byte
+	noLocal bool
+	//delivered is the number of messages a shared group member has been given
+	delivered int64
+}
+
+//SubscriptionOptions are the options a client can set when making a subscription,
+//NoLocal is the MQTT v5 option that stops messages being sent back to their publisher
+//and RetainHandling the one for when the subscription is sent the retained messages
+//matching it
+type SubscriptionOptions struct {
+	Qos            byte
+	NoLocal        bool
+	RetainHandling RetainHandling
+}
+
+//RetainHandling is the MQTT v5 Retain Handling subscription option
+type RetainHandling byte
+
+const (
+	//RetainSendOnSubscribe sends the retained messages every time the subscription is made
+	RetainSendOnSubscribe RetainHandling = iota
+	//RetainSendIfNew only sends them if the client didn't already have the subscription,
+	//so a durable client resubscribing when it reconnects isn't sent them again
+	RetainSendIfNew
+	//RetainDontSend never sends them
+	RetainDontSend
+)
+
+//sendsRetained returns true if a subscription made with these options is sent the retained
+//messages matching it, existed is whether the client already had the subscription
+func (o SubscriptionOptions) sendsRetained(existed bool) bool {
+	switch o.RetainHandling {
+	case RetainSendIfNew:
+		return !existed
+	case RetainDontSend:
+		return false
+	}
+	return true
+}
+
+const sharePrefix = "$share/"
+
+//suppressed returns true if this subscription should not receive a message sent by
+//publisher, either because the subscription was made with NoLocal or the client is
+//configured to suppress echoes of its own publishes, or because the subscriber is a bridge
+//and the message has crossed the most bridges it can (hopped)
+func (s *subscriber) suppressed(publisher *Client, hopped bool) bool {
+	if hopped && s.client.bridge {
+		return true
+	}
+	return publisher != nil && s.client == publisher && (s.noLocal || publisher.suppressEcho)
+}
+
+//splitShared returns the topic filter part of a subscription, and whether the subscription
+//was for a shared group ($share/<group>/<filter>)
+func splitShared(subscription string) (string, bool) {
+	if !strings.HasPrefix(subscription, sharePrefix) {
+		return subscription, false
+	}
+	groupAndFilter := strings.SplitN(subscription[len(sharePrefix):], "/", 2)
+	if len(groupAndFilter) != 2 {
+		return subscription, false
+	}
+	return groupAndFilter[1], true
+}
 
 func newSubMap() *subscriptionMap {
 	s := &subscriptionMap{}
-	s.subElements = make(map[string][]string)
-	s.subMap = make(map[string]map[string]byte)
-	s.subBitmap = make([]map[string]map[string]bool, 10)
-	for i, _ := range s.subBitmap {
-		s.subBitmap[i] = make(map[string]map[string]bool)
-	}
-	s.retained = make(map[string]*PublishPacket)
+	s.filters = newTopicNode()
+	s.subMap = make(map[string]map[string]*subscriber)
+	s.shared = make(map[string]*sharedGroup)
+	s.retained = newRetainedStore()
+	s.matches = newMatchCache()
+	s.counts = make(map[string]int)
 
 	return s
 }
 
 func (s *subscriptionMap) SetRetained(topic string, message *PublishPacket) {
-	DEBUG.Println("Setting retained message for", topic)
-	s.RLock()
-	defer s.RUnlock()
-	if len(message.Payload) == 0 {
-		delete(s.retained, topic)
-	} else {
-		s.retained[topic] = message
-	}
+	s.retain(newMessage(topic, message))
 }
 
+//retain makes message the retained message for its topic, without persisting it
+func (s *subscriptionMap) retain(message *Message) {
+	s.Lock()
+	defer s.Unlock()
+	s.retained.set(message.Topic, message, false, 0)
+}
+
+//topicLevels splits a topic name or filter into its levels. Empty levels are levels like any
+//other, so foo//bar has three, foo/bar/ is a different topic to foo/bar and /foo starts with
+//an empty level. Everything that matches topics (the subscription tree, the retained store,
+//ACLs and policies) splits with this so they can't disagree on where the levels are.
+func topicLevels(topic string) []string {
+	return strings.Split(topic, "/")
+}
+
+//match returns true if the filter route matches topic. A topic starting with $, such as the
+//$SYS topics, is only matched by a filter with the same first level, not by a + or # there.
 func match(route []string, topic []string) bool {
+	if len(route) > 0 && len(topic) > 0 && strings.HasPrefix(topic[0], "$") && (route[0] == "+" || route[0] == "#") {
+		return false
+	}
+	return matchLevels(route, topic)
+}
+
+func matchLevels(route []string, topic []string) bool {
 	if len(route) == 0 {
 		if len(topic) == 0 {
 			return true
@@ -60,170 +153,446 @@ func match(route []string, topic []string) bool {
 	}
 
 	if (route[0] == "+") || (route[0] == topic[0]) {
-		return match(route[1:], topic[1:])
+		return matchLevels(route[1:], topic[1:])
 	}
 
 	return false
 }
 
-func (h *Hrotti) FindRetained(id string, topic string, qos byte) {
-	var deliverList []*PublishPacket
-	client := h.getClient(id)
-	if strings.ContainsAny(topic, "#+") {
-		for rTopic, msg := range h.subs.retained {
-			if match(strings.Split(topic, "/"), strings.Split(rTopic, "/")) {
-				deliveryMsg := msg.Copy()
-				deliveryMsg.Qos = calcMinQos(msg.Qos, qos)
-				deliverList = append(deliverList, deliveryMsg)
-			}
-		}
-	} else {
-		if msg, ok := h.subs.retained[topic]; ok {
-			deliveryMsg := msg.Copy()
-			deliveryMsg.Qos = calcMinQos(msg.Qos, qos)
-			deliverList = append(deliverList, deliveryMsg)
-		}
-	}
-	if len(deliverList) > 0 {
-		for _, msg := range deliverList {
-			if msg.Qos > 0 {
-				if client.Connected() {
-					h.PersistStore.Add(id, OUTBOUND, msg)
-					select {
-					case client.outboundMessages <- msg:
-					default:
-					}
-				} else {
-					h.PersistStore.Add(id, OUTBOUND, msg)
-				}
-			} else if client.Connected() {
-				select {
-				case client.outboundMessages <- msg:
-				default:
-				}
-			}
+//FindRetained sends client the retained messages matching subscription
+func (h *Hrotti) FindRetained(client *Client, subscription string, qos byte) {
+	client.deliverMu.Lock()
+	defer client.deliverMu.Unlock()
+	h.findRetained(client, subscription, qos)
+}
+
+//findRetained is FindRetained for when the client's deliverMu is already held
+func (h *Hrotti) findRetained(client *Client, subscription string, qos byte) {
+	h.subs.RLock()
+	retained := h.retainedFor(subscription, qos)
+	h.subs.RUnlock()
+	h.deliverRetained(client, subscription, retained)
+}
+
+//retainedFor returns the retained messages matching subscription to deliver at qos, copies
+//of those in memory and the topics of those that have been evicted. Each is delivered at the
+//lowest of the QoS it was published at, qos and MaxRetainedQos. The subscriptionMap must be
+//locked.
+func (h *Hrotti) retainedFor(subscription string, qos byte) []retainedMatch {
+	topic, _ := splitShared(subscription)
+	return h.subs.retained.matching(topic, calcMinQos(qos, h.MaxRetainedQos))
+}
+
+//deliverRetained queues the retained messages for the client's subscription, the client's
+//deliverMu must be held. Evicted messages are loaded from persistence one at a time as they
+//are queued, so a subscription matching many of them doesn't load them all at once. If they
+//would take the client's queue over its high-water mark, or some are already being streamed
+//to it, they are streamed rather than queued at once, see streamRetained.
+func (h *Hrotti) deliverRetained(client *Client, subscription string, retained []retainedMatch) {
+	if len(retained) == 0 {
+		return
+	}
+	if client.Connected() && (client.retainedStream != nil || client.queueDepth()+len(retained) > h.retainedHighWater(client)) {
+		h.streamRetained(client, subscription, retained)
+		return
+	}
+	for _, m := range retained {
+		h.sendRetained(client, subscription, m)
+	}
+}
+
+//sendRetained queues the retained message m for the client's subscription, returning false
+//if it wasn't queued as it has been cleared or isn't for the client. The client's deliverMu
+//must be held.
+func (h *Hrotti) sendRetained(client *Client, subscription string, m retainedMatch) bool {
+	msg := m.message
+	if msg == nil {
+		loaded := h.loadRetained(m.topic, m.version)
+		if loaded == nil {
+			return false
 		}
+		msg = loaded.packet(m.qos, true)
+	}
+	if client.bridge && h.hopped(msg.Hops) {
+		return false
 	}
+	if transformer := h.payloadTransformer(msg.TopicName); transformer != nil && !h.transform(transformer, msg, "", client, subscription) {
+		return false
+	}
+	client.deliverLocked(msg, h)
+	return true
+}
+
+//AddSub subscribes client to subscription and queues the retained messages matching it.
+//
+//The retained messages are queued before any live message routed to the subscription. The
+//subscription is added and the retained messages copied under the same subscriptionMap lock,
+//and a retained PUBLISH sets its retained message before it is routed, so a retained PUBLISH
+//to a matching topic either sets its message before the copy is taken and is in it, or is
+//routed to the new subscription afterwards. The client's deliverMu is held until the copies
+//are queued so a live message routed to the subscription in the meantime waits behind them.
+//A client never gets an older retained message after a newer live one, though it can get
+//the same message twice, once retained and once live. Retained messages that are streamed
+//are the exception to them all being queued first, live messages are queued in between.
+//None are queued if the options' RetainHandling says not to.
+//
+//A client that already has the subscription with the same options, as a durable session
+//that sends its whole SUBSCRIBE list again on reconnecting does, is left as it is, and with
+//SkipRetainedOnResubscribe set isn't sent the retained messages again either. AddSub returns
+//false for such an unchanged subscription, which doesn't need the session saving again.
+func (h *Hrotti) AddSub(client *Client, subscription string, options SubscriptionOptions) bool {
+	client.deliverMu.Lock()
+	defer client.deliverMu.Unlock()
+	h.subs.Lock()
+	existed, changed := h.insertSub(client, subscription, options)
+	var retained []retainedMatch
+	if !client.retainedSynced && options.sendsRetained(existed) && (changed || !h.SkipRetainedOnResubscribe) {
+		retained = h.retainedFor(subscription, options.Qos)
+	}
+	h.subs.Unlock()
+	h.deliverRetained(client, subscription, retained)
+	return changed
 }
 
-func (h *Hrotti) AddSub(client string, subscription string, qos byte) {
+//addSub adds the subscription to the subscriptionMap without sending any retained messages
+func (h *Hrotti) addSub(client *Client, subscription string, options SubscriptionOptions) {
 	h.subs.Lock()
 	defer h.subs.Unlock()
-	if _, ok := h.subs.subElements[subscription]; !ok {
-		h.subs.subElements[subscription] = strings.Split(subscription, "/")
+	h.insertSub(client, subscription, options)
+}
+
+//insertSub is addSub with the subscriptionMap already locked, it returns true if the client
+//already had the subscription, and false for changed if it had it with the same options and
+//nothing was done
+func (h *Hrotti) insertSub(client *Client, subscription string, options SubscriptionOptions) (existed bool, changed bool) {
+	if current := h.subs.subscriber(client.clientID, subscription); current != nil && current.same(client, options) {
+		return true, false
+	}
+	filter, shared := splitShared(subscription)
+	h.subs.filters.add(topicLevels(filter), subscription)
+	sub := &subscriber{client: client, qos: options.Qos, noLocal: options.NoLocal}
+	if shared {
+		group, ok := h.subs.shared[subscription]
+		if !ok {
+			group = &sharedGroup{strategy: h.sharedStrategy(subscription)}
+			h.subs.shared[subscription] = group
+		}
+		existed := group.add(sub)
+		if !existed {
+			h.subs.counts[client.clientID]++
+		}
+		return existed, true
 	}
 	if _, ok := h.subs.subMap[subscription]; !ok {
-		h.subs.subMap[subscription] = make(map[string]byte)
+		h.subs.subMap[subscription] = make(map[string]*subscriber)
+	}
+	_, existed = h.subs.subMap[subscription][client.clientID]
+	if !existed {
+		h.subs.counts[client.clientID]++
 	}
-	h.subs.subMap[subscription][client] = qos
-	for i, element := range append(h.subs.subElements[subscription], "\u0000") {
-		if _, ok := h.subs.subBitmap[i][element]; !ok {
-			h.subs.subBitmap[i][element] = make(map[string]bool)
+	h.subs.subMap[subscription][client.clientID] = sub
+	return existed, true
+}
+
+//subscriber returns the subscriber for client's subscription, nil if it doesn't have it,
+//must be called with the subscriptionMap locked
+func (s *subscriptionMap) subscriber(client string, subscription string) *subscriber {
+	if group, ok := s.shared[subscription]; ok {
+		for _, member := range group.members {
+			if member.client.clientID == client {
+				return member
+			}
 		}
-		h.subs.subBitmap[i][element][subscription] = true
+		return nil
 	}
-	go h.FindRetained(client, subscription, qos)
+	return s.subMap[subscription][client]
+}
+
+//same returns true if s is client's subscription with options
+func (s *subscriber) same(client *Client, options SubscriptionOptions) bool {
+	return s.client == client && s.qos == options.Qos && s.noLocal == options.NoLocal
 }
 
 func (h *Hrotti) DeleteSub(client string, subscription string) {
 	h.subs.Lock()
 	defer h.subs.Unlock()
-	if _, ok := h.subs.subMap[subscription]; ok {
+	h.subs.version++
+	if _, ok := h.subs.subMap[subscription][client]; ok {
 		delete(h.subs.subMap[subscription], client)
+		h.subs.uncount(client)
+	}
+	if group, ok := h.subs.shared[subscription]; ok && group.remove(client) {
+		h.subs.uncount(client)
+	}
+	h.subs.prune(subscription)
+}
+
+//uncount takes a removed subscription off client's count, must be called with the
+//subscriptionMap locked
+func (s *subscriptionMap) uncount(client string) {
+	if s.counts[client]--; s.counts[client] <= 0 {
+		delete(s.counts, client)
 	}
 }
 
 func (h *Hrotti) DeleteSubAll(client string) {
 	h.subs.Lock()
 	defer h.subs.Unlock()
-	for _, topic := range h.subs.subMap {
+	h.subs.version++
+	for subscription, topic := range h.subs.subMap {
 		if _, ok := topic[client]; ok {
 			delete(topic, client)
+			h.subs.prune(subscription)
 		}
 	}
+	for subscription, group := range h.subs.shared {
+		group.remove(client)
+		h.subs.prune(subscription)
+	}
+	delete(h.subs.counts, client)
 }
 
-func (h *Hrotti) DeliverMessage(topic string, message *PublishPacket) {
-	h.subs.RLock()
-	topicElements := strings.Split(topic, "/")
-	var matches []string
-	var hashMatches []string
-	deliverList := make(map[string]byte)
-	for i, element := range append(topicElements, "\u0000") {
-		DEBUG.Println("Searching bitmap level", i, element)
-		switch i {
-		case 0:
-			for sub, _ := range h.subs.subBitmap[i][element] {
-				matches = append(matches, sub)
-			}
-			for sub, _ := range h.subs.subBitmap[i]["+"] {
-				matches = append(matches, sub)
-			}
-			for sub, _ := range h.subs.subBitmap[i]["#"] {
-				hashMatches = append(hashMatches, sub)
-			}
-		default:
-			var tmpMatches []string
-			for _, sub := range matches {
-				switch element {
-				case "\u0000":
-					if h.subs.subBitmap[i][element][sub] {
-						tmpMatches = append(tmpMatches, sub)
-					}
-				default:
-					if h.subs.subBitmap[i][element][sub] || h.subs.subBitmap[i]["+"][sub] {
-						tmpMatches = append(tmpMatches, sub)
-					} else if h.subs.subBitmap[i]["#"][sub] {
-						hashMatches = append(hashMatches, sub)
-					}
+//prune removes subscription from the filter tree once no client has it, must be called
+//with the subscriptionMap locked
+func (s *subscriptionMap) prune(subscription string) {
+	if len(s.subMap[subscription]) > 0 {
+		return
+	}
+	if group, ok := s.shared[subscription]; ok && len(group.members) > 0 {
+		return
+	}
+	delete(s.subMap, subscription)
+	delete(s.shared, subscription)
+	filter, _ := splitShared(subscription)
+	s.filters.remove(topicLevels(filter), subscription)
+}
+
+//subscribed returns true if client has a subscription matching topic
+func (s *subscriptionMap) subscribed(client string, topic string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	_, subscriptions := s.matching(topic)
+	for _, subscription := range subscriptions {
+		if _, ok := s.subMap[subscription][client]; ok {
+			return true
+		}
+		if group, ok := s.shared[subscription]; ok {
+			for _, member := range group.members {
+				if member.client.clientID == client {
+					return true
 				}
 			}
-			matches = tmpMatches
 		}
-		if len(matches) == 0 {
-			break
+	}
+	return false
+}
+
+//DeliverMessage sends message to every client with a subscription matching topic,
+//publisher is the client that sent the message (nil if it didn't come from a client)
+//and is used to suppress echoes back to the publisher before anything is enqueued. It
+//returns the first error persisting a QoS 1 or 2 copy of the message, the copies are still
+//delivered but the message shouldn't be acknowledged as it won't survive a restart.
+func (h *Hrotti) DeliverMessage(topic string, message *PublishPacket, publisher *Client) error {
+	return h.route(h.ingest(topic, message), publisher)
+}
+
+//route is DeliverMessage for a message the broker has already taken in
+func (h *Hrotti) route(message *Message, publisher *Client) error {
+	topic := message.Topic
+	h.subs.RLock()
+	version := h.subs.version
+	levels, matches := h.subs.matching(topic)
+	//a client with several subscriptions matching the topic gets one copy of the message at
+	//the highest QoS of those subscriptions, unless AllowDuplicateMessages is set when it
+	//gets a copy for each subscription
+	deliverList := make(map[*Client]recipient)
+	var recipients []recipient
+
+	addRecipient := func(s *subscriber, filter string) {
+		qos := calcMinQos(s.qos, message.Qos)
+		if h.AllowDuplicateMessages {
+			recipients = append(recipients, recipient{s.client, qos, filter})
+		} else if r, ok := deliverList[s.client]; !ok || qos > r.qos {
+			deliverList[s.client] = recipient{s.client, qos, filter}
+		}
+	}
+	//echo suppression is done here, before anything is copied or enqueued for the client
+	hopped := h.hopped(message.Hops)
+	for _, sub := range matches {
+		for _, s := range h.subs.subMap[sub] {
+			if !s.suppressed(publisher, hopped) {
+				addRecipient(s, sub)
+			}
+		}
+		if group, ok := h.subs.shared[sub]; ok {
+			if s := group.pick(publisher, hopped, topic, nil); s != nil {
+				addRecipient(s, sub)
+			}
 		}
 	}
 	h.subs.RUnlock()
 
-	zeroCopy := message.Copy()
-	zeroCopy.Qos = 0
+	//the QoS 0 recipients share a single PUBLISH, the rest get their own to give a message id
+	zeroCopy := message.packet(0, false)
 
-	for _, sub := range append(hashMatches, matches...) {
-		for c, qos := range h.subs.subMap[sub] {
-			if currQos, ok := deliverList[c]; ok {
-				deliverList[c] = calcMinQos(calcMaxQos(currQos, qos), message.Qos)
-			} else {
-				deliverList[c] = calcMinQos(qos, message.Qos)
-			}
+	for _, r := range deliverList {
+		recipients = append(recipients, r)
+	}
+	h.topicStats.routed(levels, len(message.Payload), len(recipients), message.ReceivedAt)
+	if h.packetsLog.enabled(LogTrace) {
+		h.packetsLog.Trace("Routing PUBLISH", "topic", topic, "recipients", len(recipients))
+	}
+	//a transformed message is a copy of its own for each recipient
+	transformer := h.payloadTransformer(topic)
+	var publisherID string
+	if publisher != nil {
+		publisherID = publisher.clientID
+	}
+	var persistErr error
+	for _, r := range recipients {
+		deliveryMessage := zeroCopy
+		if r.qos > 0 || transformer != nil {
+			deliveryMessage = message.packet(r.qos, false)
+		}
+		if transformer != nil && !h.transform(transformer, deliveryMessage, publisherID, r.client, r.filter) {
+			continue
+		}
+		viaGroup := r.qos > 0 && strings.HasPrefix(r.filter, sharePrefix)
+		if viaGroup {
+			r.client.markShared(deliveryMessage, r.filter)
+		}
+		if err := r.client.deliverRouted(deliveryMessage, h, version); err != nil && persistErr == nil {
+			persistErr = err
+		}
+		if viaGroup && deliveryMessage.MessageID == 0 {
+			r.client.unmarkShared(deliveryMessage)
 		}
 	}
+	return persistErr
+}
 
-	DEBUG.Println(deliverList)
-	for cid, subQos := range deliverList {
-		client := h.getClient(cid)
-		if subQos > 0 {
-			go func(c *Client, subQos byte) {
-				deliveryMessage := message.Copy()
-				deliveryMessage.Qos = subQos
-				if c.Connected() {
-					//deliveryMessage.MessageID = c.getMsgID(deliveryMessage.UUID())
-					h.PersistStore.Add(c.clientID, OUTBOUND, deliveryMessage)
-					select {
-					case c.outboundMessages <- deliveryMessage:
-					default:
-					}
-				} else {
-					h.PersistStore.Add(c.clientID, OUTBOUND, deliveryMessage)
-				}
-			}(client, subQos)
-		} else if client.Connected() {
-			select {
-			case client.outboundMessages <- zeroCopy:
-			default:
+//timestampKey is the name of the user property TimestampProperty adds
+const timestampKey = "ts"
+
+//received records that message was received now if it hasn't been already, a message from
+//a client is stamped when it is read and one published by the broker when it is routed.
+//With TimestampProperty set the time is also given to subscribers as the user property ts,
+//replacing any the publisher set so it can be trusted.
+func (h *Hrotti) received(message *PublishPacket) {
+	if !message.ReceivedAt.IsZero() {
+		return
+	}
+	message.ReceivedAt = h.Clock.Now()
+	if h.TimestampProperty {
+		message.Properties = withTimestamp(message.Properties, message.ReceivedAt)
+	}
+}
+
+//withTimestamp returns a copy of properties with the user property ts set to at, in
+//RFC 3339 format in UTC with nanoseconds
+func withTimestamp(properties *Properties, at time.Time) *Properties {
+	var stamped Properties
+	if properties != nil {
+		stamped = *properties
+		stamped.UserProperties = nil
+		for _, property := range properties.UserProperties {
+			if property.Key != timestampKey {
+				stamped.UserProperties = append(stamped.UserProperties, property)
 			}
 		}
 	}
+	stamped.UserProperties = append(stamped.UserProperties, UserProperty{Key: timestampKey, Value: at.UTC().Format(time.RFC3339Nano)})
+	return &stamped
+}
+
+//a recipient is a client a message is being delivered to, the QoS to deliver it at and the
+//filter of the subscription it matched
+type recipient struct {
+	client *Client
+	qos    byte
+	filter string
+}
+
+//storeOutbound gives a QoS 1 or 2 message for c its message id and persists it. It returns
+//false if the message is dropped because c already has MaxInflight messages waiting to be
+//acknowledged or no free message ids, and the error persisting the message.
+func (h *Hrotti) storeOutbound(c *Client, msg *PublishPacket) (bool, error) {
+	if h.MaxInflight > 0 && c.inflight() >= h.MaxInflight {
+		h.sessionLog.Warn("Too many messages inflight, dropping message", "client", c.clientID, "inflight", h.MaxInflight, "topic", msg.TopicName)
+		h.stats.DroppedMessage()
+		h.discard(DropInflightFull, msg, c.clientID)
+		return false, nil
+	}
+	msg.MessageID = c.getMsgID(msg.UUID())
+	if msg.MessageID == 0 {
+		h.sessionLog.Warn("No free message ids, dropping message", "client", c.clientID, "topic", msg.TopicName)
+		h.stats.DroppedMessage()
+		h.discard(DropInflightFull, msg, c.clientID)
+		return false, nil
+	}
+	if !h.holdQueued(c, msg) {
+		c.freeID(msg.MessageID)
+		h.stats.DroppedMessage()
+		h.discard(DropQuota, msg, c.clientID)
+		return false, nil
+	}
+	//the message is persisted before it is queued, so if the broker stops before the client
+	//acknowledges it it is resent rather than lost
+	err := h.PersistStore.StoreInflight(c.clientID, OUTBOUND, msg.MessageID, msg)
+	if err != nil {
+		h.persistenceLog.Error("Failed to persist message", "client", c.clientID, "err", err)
+	}
+	return true, err
+}
+
+//setRetained sets message as the retained message for its topic and persists it, an empty
+//payload clears the retained message. Nothing is retained when DisableRetain is set. It
+//returns false if the message is over the retained limits and the RetainedLimitPolicy rejects
+//it, or over its publisher's MaxRetained and the Quota rejects it, the message shouldn't then
+//be delivered either, and the error persisting it. A message
+//that couldn't be persisted is still the retained message until the broker restarts.
+func (h *Hrotti) setRetained(message *Message) (bool, error) {
+	topic := message.Topic
+	if h.DisableRetain {
+		h.persistenceLog.Debug("Retain is disabled, not retaining message", "topic", topic)
+		return true, nil
+	}
+	//a topic over the topic limits is delivered but never split into the retained store's levels
+	if err := h.topicLimits().Check(topic); err != nil {
+		h.persistenceLog.Warn("Topic over the topic limits, not retaining message", "err", err)
+		h.stats.retainedRejected()
+		return true, nil
+	}
+	//the topic is owned by the publisher's principal, which may have to make room for it
+	allowed, evicted := h.quotas.own(topic, h.retainedOwner(message), len(message.Payload) == 0)
+	if !allowed {
+		h.persistenceLog.Warn("Retained quota reached, not retaining message", "topic", topic, "publisher", message.Publisher)
+		h.stats.retainedRejected()
+		return false, nil
+	}
+	if evicted != "" {
+		h.persistenceLog.Debug("Clearing oldest retained message for the retained quota", "topic", evicted, "publisher", message.Publisher)
+		h.clearRetained(evicted)
+	}
+	h.persistenceLog.Debug("Setting retained message", "topic", topic)
+	if h.overRetainedLimits(topic, message) {
+		h.persistenceLog.Warn("Retained limits reached, not retaining message", "topic", topic, "size", len(message.Payload))
+		h.stats.retainedRejected()
+		return h.RetainedLimitPolicy != RejectRetained, nil
+	}
+	var err error
+	if len(message.Payload) == 0 {
+		err = h.PersistStore.DeleteRetained(topic)
+	} else {
+		err = h.PersistStore.StoreRetained(topic, message.packet(message.Qos, true))
+	}
+	if err != nil {
+		h.persistenceLog.Error("Failed to persist retained message", "topic", topic, "err", err)
+	} else if len(message.Payload) > 0 {
+		h.subs.retained.persisted(topic, message)
+	}
+	h.topicStats.retained(topic, len(message.Payload) == 0)
+	return true, err
 }
 
 func calcMinQos(a, b byte) byte {
@@ -239,3 +608,86 @@ func calcMaxQos(a, b byte) byte {
 	}
 	return b
 }
+
+//SubscriptionInfo is a snapshot of one of a client's subscriptions
+type SubscriptionInfo struct {
+	Filter  string `json:"filter"`
+	Qos     byte   `json:"qos"`
+	NoLocal bool   `json:"noLocal"`
+}
+
+//clientSubscriptions returns a snapshot of the subscriptions held by client, including
+//its memberships of shared subscription groups
+func (s *subscriptionMap) clientSubscriptions(client string) []SubscriptionInfo {
+	s.RLock()
+	defer s.RUnlock()
+	subs := []SubscriptionInfo{}
+	for filter, subscribers := range s.subMap {
+		if sub, ok := subscribers[client]; ok {
+			subs = append(subs, SubscriptionInfo{Filter: filter, Qos: sub.qos, NoLocal: sub.noLocal})
+		}
+	}
+	for filter, group := range s.shared {
+		for _, sub := range group.members {
+			if sub.client.clientID == client {
+				subs = append(subs, SubscriptionInfo{Filter: filter, Qos: sub.qos, NoLocal: sub.noLocal})
+			}
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Filter < subs[j].Filter })
+	return subs
+}
+
+//subscriptionCounts returns the number of subscriptions held by each client
+func (s *subscriptionMap) subscriptionCounts() map[string]int {
+	s.RLock()
+	defer s.RUnlock()
+	counts := make(map[string]int, len(s.counts))
+	for client, count := range s.counts {
+		counts[client] = count
+	}
+	return counts
+}
+
+//total returns the number of subscriptions held by all the clients
+func (s *subscriptionMap) total() int {
+	s.RLock()
+	defer s.RUnlock()
+	total := 0
+	for _, count := range s.counts {
+		total += count
+	}
+	return total
+}
+
+//subscriptionCount returns the number of subscriptions client has and whether one of
+//them is to subscription
+func (s *subscriptionMap) subscriptionCount(client string, subscription string) (int, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	if _, ok := s.subMap[subscription][client]; ok {
+		return s.counts[client], true
+	}
+	if group, ok := s.shared[subscription]; ok {
+		for _, member := range group.members {
+			if member.client.clientID == client {
+				return s.counts[client], true
+			}
+		}
+	}
+	return s.counts[client], false
+}
+
+//RetainedInfo is a snapshot of a retained message, without its payload
+type RetainedInfo struct {
+	Topic string `json:"topic"`
+	Qos   byte   `json:"qos"`
+	Size  int    `json:"size"`
+}
+
+//retainedSnapshot returns the retained messages sorted by topic
+func (s *subscriptionMap) retainedSnapshot() []RetainedInfo {
+	s.RLock()
+	defer s.RUnlock()
+	return s.retained.snapshot()
+}
@@ -1,127 +1,554 @@
 package hrotti
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	. "github.com/alsm/hrotti/packets"
-	"github.com/google/uuid"
 	"golang.org/x/net/websocket"
 )
 
 type Hrotti struct {
-	PersistStore       Persistence
+	PersistStore              Persistence
+	Clock                     Clock
+	RetainedSyncRate          int
+	SlowConsumerPolicy        SlowConsumerPolicy
+	SlowConsumerGrace         time.Duration
+	StatsInterval             time.Duration
+	ConnectTimeout            time.Duration
+	MaxKeepAlive              uint16
+	MinKeepAlive              uint16
+	MaxPacketSize             int
+	MaxInflight               int
+	ReceiveMaximum            int
+	DisableRetain             bool
+	Auth                      *Auth
+	Authenticator             Authenticator
+	RateLimit                 *RateLimit
+	AllowDuplicateMessages    bool
+	DuplicateWindow           int
+	MaxConnections            int
+	MaxConnectionsPerIP       int
+	ConnectionLimitPolicy     ConnectionLimitPolicy
+	BanAuthFailures           int
+	BanWindow                 time.Duration
+	BanDuration               time.Duration
+	MaxBans                   int
+	MaxRetainedMessages       int
+	MaxRetainedSize           int
+	RetainedLimitPolicy       RetainedLimitPolicy
+	RetainedCacheSize         int
+	RetainedCacheMessages     int
+	RetainedHighWater         int
+	MatchCacheSize            int
+	AdminUsername             string
+	SharedStrategies          map[string]SharedStrategy
+	MaxSubscriptions          int
+	MaxFilterLength           int
+	MaxFilterLevels           int
+	MaxTopicLevels            int
+	MaxTopicLevelLength       int
+	MaxTopicLength            int
+	SubscriptionLimitPolicy   SubscriptionLimitPolicy
+	SessionExpiry             time.Duration
+	WillDelay                 time.Duration
+	WillOnTakeover            bool
+	Presence                  *Presence
+	RetryInterval             time.Duration
+	MaxRetries                int
+	MessageExpiry             time.Duration
+	MaxRetainedQos            byte
+	SkipRetainedOnResubscribe bool
+	TimestampProperty         bool
+	DeadLetter                *DeadLetter
+	TopicPolicies             map[string]*TopicPolicy
+	TopicRewrites             []*TopicRewrite
+	PayloadTransformers       map[string]PayloadTransformer
+	Ingesters                 map[string]Ingester
+	IngestWorkers             int
+	IngestTimeout             time.Duration
+	ClientStatsInterval       time.Duration
+	Hooks                     Hooks
+	HookWorkers               int
+	HookQueueDepth            int
+	MDNSName                  string
+	MaxBridgeHops             int
+	InheritedListeners        []net.Listener
+	HealthTimeout             time.Duration
+	TopicMetrics              []string
+	WriteBatchPackets         int
+	WriteBatchBytes           int
+	WriteBatchDelay           time.Duration
+	//liveLock guards the fields Reload changes while the broker is running
+	liveLock           sync.RWMutex
 	listeners          map[string]*internalListener
 	listenersWaitGroup sync.WaitGroup
 	maxQueueDepth      int
 	clients            *clients
+	connections        *connectionCounter
 	subs               *subscriptionMap
+	profiles           []*ClientProfile
+	bridges            map[string]*bridge
+	admin              net.Listener
+	stats              BrokerStats
+	wills              *delayedWills
+	wheel              *timingWheel
+	hooks              *hookPool
+	ingestPool         *ingestPool
+	bans               *authBans
+	quotas             *quotaTracker
+	mdns               *mdnsResponder
+	topicStats         *topicStats
+	deadLetters        *deadLetters
+	recovered          int32
+	recovery           recoveryStats
+	healthMu           sync.Mutex
+	healthClient       *Client
+	healthSeq          uint64
+	stop               chan struct{}
+	startOnce          sync.Once
+	*loggers
 }
 
 type internalListener struct {
 	name        string
 	url         url.URL
+	config      *ListenerConfig
+	tlsConfig   *tls.Config
+	ln          net.Listener
 	connections []net.Conn
 	stop        chan struct{}
+	//accepting is set while the listener's accept loop is running
+	accepting int32
 }
 
 func NewHrotti(maxQueueDepth int, persistence Persistence) *Hrotti {
+	h := newHrotti(maxQueueDepth, persistence, defaultLoggers.clone())
+	h.restore()
+	return h
+}
+
+//newHrotti is NewHrotti without restoring the broker's state, so options that change how it
+//is restored, such as the retained cache limits, can be set first
+func newHrotti(maxQueueDepth int, persistence Persistence, logs *loggers) *Hrotti {
 	h := &Hrotti{
-		PersistStore:  persistence,
-		listeners:     make(map[string]*internalListener),
-		maxQueueDepth: maxQueueDepth,
-		clients:       newClients(),
-		subs:          newSubMap(),
-	}
-	//start the goroutine that generates internal message ids for when clients receive messages
-	//but are not connected.
-	h.PersistStore.Init()
+		PersistStore:    persistence,
+		Clock:           systemClock{},
+		ConnectTimeout:  defaultConnectTimeout,
+		DuplicateWindow: defaultDuplicateWindow,
+		MaxBridgeHops:   defaultMaxBridgeHops,
+		MatchCacheSize:  defaultMatchCacheSize,
+		MaxRetainedQos:  2,
+		MaxTopicLevels:  DefaultMaxTopicLevels,
+		AdminUsername:   defaultAdminUsername,
+		IngestTimeout:   defaultIngestTimeout,
+		BanWindow:       defaultBanWindow,
+		BanDuration:     defaultBanDuration,
+		MaxBans:         defaultMaxBans,
+		listeners:       make(map[string]*internalListener),
+		bridges:         make(map[string]*bridge),
+		maxQueueDepth:   maxQueueDepth,
+		clients:         newClients(),
+		connections:     newConnectionCounter(),
+		bans:            newAuthBans(),
+		quotas:          newQuotaTracker(),
+		subs:            newSubMap(),
+		wills:           newDelayedWills(),
+		stop:            make(chan struct{}),
+		loggers:         logs,
+	}
+	if err := h.PersistStore.Open(); err != nil {
+		h.persistenceLog.Error("Failed to open persistence, falling back to memory persistence", "err", err)
+		h.PersistStore = &MemoryPersistence{}
+		h.PersistStore.Open()
+	}
+	//the persistence the broker ships with trace what they persist to the broker's log
+	if p, ok := h.PersistStore.(interface{ setLog(*logger) }); ok {
+		p.setLog(h.persistenceLog)
+	}
 	return h
 }
 
+//restore recovers the broker's state from persistence when it starts. The retained
+//messages are loaded, then each session is restored as a disconnected client and its
+//subscriptions are added back to the subscription tree, so messages for it are kept until
+//it reconnects. The message ids of its outbound inflight messages are marked as in use and
+//the messages are resent with Dup set when it reconnects, a stored PUBREL is a QoS 2
+//message the client has sent a PUBREC for so the PUBREL is resent rather than the message.
+//Its inbound QoS 2 messages are marked as received, so if the client sends one again it is
+//acknowledged but not delivered twice. This is done before any listener is started, so a
+//client reconnecting with cleanSession false after a restart gets sessionPresent and doesn't
+//have to subscribe again.
+func (h *Hrotti) restore() {
+	start := time.Now()
+	h.subs.retained.setLimits(h.RetainedCacheSize, h.RetainedCacheMessages)
+	h.PersistStore.RangeRetained(func(topic string, message *PublishPacket) bool {
+		h.subs.retained.set(topic, newMessage(topic, message), true, 0)
+		return true
+	})
+	sessions := make(map[string]*Session)
+	h.PersistStore.RangeSessions(func(client string, session *Session) bool {
+		sessions[client] = session
+		return true
+	})
+	for id, session := range sessions {
+		c := newClient(nil, id, h.maxQueueDepth)
+		//a session saved without a disconnect time was connected when the broker stopped
+		c.disconnectedAt = session.DisconnectedAt
+		if c.disconnectedAt.IsZero() {
+			c.disconnectedAt = h.Clock.Now()
+		}
+		h.clients.list[id] = c
+		for filter, options := range session.Subscriptions {
+			h.addSub(c, filter, options)
+		}
+		h.recovery.subscriptions += len(session.Subscriptions)
+		h.PersistStore.RangeInflight(id, func(direction dirFlag, msgID uint16, message ControlPacket) bool {
+			if direction == OUTBOUND {
+				c.claimID(msgID, message.UUID())
+			} else if pp, ok := message.(*PublishPacket); ok {
+				c.inboundQos2[msgID] = payloadHash(pp.Payload)
+			}
+			return true
+		})
+		c.inboundChanged()
+		c.resumeSequence()
+	}
+	h.recovery.sessions = len(sessions)
+	h.recovery.duration = time.Since(start)
+	if retained := h.subs.retained.len(); len(sessions) > 0 || retained > 0 {
+		h.persistenceLog.Info("Restored sessions and retained messages", "sessions", len(sessions),
+			"subscriptions", h.recovery.subscriptions, "retained", retained, "took", h.recovery.duration)
+	}
+	atomic.StoreInt32(&h.recovered, 1)
+}
+
+//recoveryStats is what restore recovered from persistence and how long it took, it is set
+//before the broker starts and doesn't change
+type recoveryStats struct {
+	duration      time.Duration
+	sessions      int
+	subscriptions int
+}
+
 func (h *Hrotti) getClient(id string) *Client {
 	h.clients.RLock()
 	defer h.clients.RUnlock()
 	return h.clients.list[id]
 }
 
+//AddClientProfile adds a profile of options for clients with ids matching its prefix,
+//profiles should be added before any listeners are started.
+func (h *Hrotti) AddClientProfile(profile *ClientProfile) {
+	h.profiles = append(h.profiles, profile)
+}
+
+//clientProfile returns the profile with the longest prefix matching id, or an empty
+//profile if none match
+func (h *Hrotti) clientProfile(id string) *ClientProfile {
+	match := &ClientProfile{}
+	matched := false
+	for _, profile := range h.profiles {
+		if strings.HasPrefix(id, profile.ClientIDPrefix) && (!matched || len(profile.ClientIDPrefix) > len(match.ClientIDPrefix)) {
+			match = profile
+			matched = true
+		}
+	}
+	return match
+}
+
+//start runs the background tasks for the broker, it is called when the first listener
+//is added so any options set on the Hrotti after NewHrotti are in effect.
+func (h *Hrotti) start() {
+	h.topicStats = newTopicStats(h.TopicMetrics)
+	h.subs.retained.setLimits(h.RetainedCacheSize, h.RetainedCacheMessages)
+	h.subs.matches.setSize(h.MatchCacheSize)
+	if h.DeadLetter != nil {
+		h.deadLetters = newDeadLetters(h.DeadLetter)
+		go h.supervise("dead letters", func() { h.deadLetters.run(h) })
+	}
+	if h.StatsInterval > 0 {
+		go h.supervise("stats publisher", h.statsPublisher)
+	}
+	if h.ClientStatsInterval > 0 {
+		go h.supervise("client stats publisher", h.clientStatsPublisher)
+	}
+	if h.SessionExpiry > 0 {
+		go h.supervise("session sweeper", h.sessionSweeper)
+	}
+	if h.RetryInterval > 0 || h.MessageExpiry > 0 {
+		h.wheel = newTimingWheel()
+		go h.supervise("timing wheel", func() { h.wheel.run(h.Clock, h.stop) })
+	}
+	if h.Hooks != nil {
+		h.hooks = newHookPool(h.HookWorkers, h.HookQueueDepth)
+	}
+	if len(h.Ingesters) > 0 {
+		h.ingestPool = newIngestPool(h, h.IngestWorkers)
+	}
+	if h.MDNSName != "" {
+		mdns := newMDNSResponder(h.MDNSName, h.listenerLog)
+		if err := mdns.listen(); err != nil {
+			h.listenerLog.Error("Failed to start mDNS responder, listeners won't be advertised", "err", err)
+		} else {
+			h.mdns = mdns
+		}
+	}
+}
+
 func (h *Hrotti) AddListener(name string, config *ListenerConfig) error {
-	listener := &internalListener{name: name, url: *config.URL}
+	h.startOnce.Do(h.start)
+	if err := CheckTopicRewrites(config.TopicRewrites, h.TopicRewrites); err != nil {
+		h.listenerLog.Error("Failed to start listener", "listener", name, "err", err)
+		return err
+	}
+	listener := &internalListener{name: name, url: *config.URL, config: config}
 	listener.stop = make(chan struct{})
 
 	h.listeners[name] = listener
 
-	ln, err := net.Listen("tcp", listener.url.Host)
-	if err != nil {
-		ERROR.Println(err.Error())
-		return err
+	var ln net.Listener
+	if listener.url.Scheme == "quic" {
+		if config.ProxyProtocol {
+			h.listenerLog.Error("QUIC listener can't use the PROXY protocol", "listener", name)
+			return errors.New("Listener " + name + " uses quic so it can't have ProxyProtocol")
+		}
+		tlsConfig, err := h.loadTLSConfig(name, config)
+		if err != nil {
+			return err
+		}
+		listener.tlsConfig = tlsConfig
+		if ln, err = h.listenQUIC(listener); err != nil {
+			h.listenerLog.Error("Failed to start listener", "listener", name, "err", err)
+			return err
+		}
+	} else if listener.url.Scheme == "mqttsn" {
+		if config.ProxyProtocol {
+			h.listenerLog.Error("MQTT-SN listener can't use the PROXY protocol", "listener", name)
+			return errors.New("Listener " + name + " uses mqttsn so it can't have ProxyProtocol")
+		}
+		var err error
+		if ln, err = h.listenMQTTSN(listener); err != nil {
+			h.listenerLog.Error("Failed to start listener", "listener", name, "err", err)
+			return err
+		}
+	} else {
+		//a socket passed in by socket activation for the listener's address is used rather
+		//than binding a new one
+		ln = h.inheritedListener(listener.url.Host)
+		if ln != nil {
+			h.listenerLog.Info("Using inherited socket for listener", "listener", name, "addr", ln.Addr())
+		} else {
+			var err error
+			if ln, err = net.Listen("tcp", listener.url.Host); err != nil {
+				h.listenerLog.Error("Failed to start listener", "listener", name, "err", err)
+				return err
+			}
+		}
+		ln = &tcpListener{Listener: ln, name: name, options: config.TCP, log: h.listenerLog}
+	}
+	addr := ln.Addr()
+	if config.MaxConnections > 0 {
+		ln = &limitListener{Listener: ln, max: int64(config.MaxConnections), log: h.listenerLog}
+	}
+	if config.AcceptRate > 0 {
+		ln = newRateListener(ln, config.AcceptRate)
 	}
+	//the PROXY header comes before anything else, including the TLS handshake
+	if config.ProxyProtocol {
+		ln = newProxyListener(ln, h.ConnectTimeout, h.listenerLog)
+	}
+	switch listener.url.Scheme {
+	case "tls", "ssl", "wss":
+		tlsConfig, err := h.loadTLSConfig(name, config)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		listener.tlsConfig = tlsConfig
+		//each handshake uses the listener's current config so Reload can replace it
+		ln = tls.NewListener(ln, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return h.currentTLSConfig(listener)
+			},
+		})
+	}
+	if config.UseIdentityFromCert && config.CAFile == "" {
+		h.listenerLog.Error("Listener takes identities from client certificates but has no CA file", "listener", name)
+		ln.Close()
+		return errors.New("Listener " + name + " has UseIdentityFromCert without a CAFile")
+	}
+	listener.ln = ln
 
-	if listener.url.Scheme == "ws" && len(listener.url.Path) == 0 {
+	isWebsocket := listener.url.Scheme == "ws" || listener.url.Scheme == "wss"
+	if isWebsocket && len(listener.url.Path) == 0 {
 		listener.url.Path = "/"
 	}
 
 	h.listenersWaitGroup.Add(1)
-	INFO.Println("Starting MQTT listener on", listener.url.String())
+	h.listenerLog.Info("Starting MQTT listener", "listener", name, "url", &listener.url, "tcp", config.TCP)
+	if h.mdns != nil {
+		h.mdns.advertise(name, listener.url.Scheme, addr)
+	}
 
 	go func() {
 		<-listener.stop
-		INFO.Println("Listener", name, "is stopping...")
+		h.listenerLog.Info("Listener stopping", "listener", name)
 		ln.Close()
 	}()
 	//if this is a WebSocket listener
-	if listener.url.Scheme == "ws" {
+	if isWebsocket {
 		var server websocket.Server
 		//override the Websocket handshake to accept any protocol name
 		server.Handshake = func(c *websocket.Config, req *http.Request) error {
-			c.Origin, _ = url.Parse(req.RemoteAddr)
+			//the connection's RemoteAddr is its Origin, url.Parse can't parse a bare host:port
+			c.Origin = &url.URL{Scheme: listener.url.Scheme, Host: req.RemoteAddr}
 			c.Protocol = []string{"mqtt"}
 			return nil
 		}
 		//set up the ws connection handler, ie what we do when we get a new websocket connection
 		server.Handler = func(ws *websocket.Conn) {
 			ws.PayloadType = websocket.BinaryFrame
-			INFO.Println("New incoming websocket connection", ws.RemoteAddr())
+			h.listenerLog.Debug("New incoming websocket connection", "listener", name, "addr", ws.Request().RemoteAddr)
 			listener.connections = append(listener.connections, ws)
-			h.InitClient(ws)
+			h.initClient(ws, name, config)
 		}
-		//set the path that the http server will recognise as related to this websocket
-		//server, needs to be configurable really.
-		http.Handle(listener.url.Path, server)
+		//each listener has its own mux, the default one is shared by the whole process so
+		//two brokers, or a listener restarted by Reload, would register the same path twice
+		mux := http.NewServeMux()
+		mux.Handle(listener.url.Path, server)
 		//ListenAndServe loops forever receiving connections and initiating the handler
 		//for each one.
+		atomic.StoreInt32(&listener.accepting, 1)
 		go func(ln net.Listener) {
 			defer h.listenersWaitGroup.Done()
-			err := http.Serve(ln, nil)
+			defer atomic.StoreInt32(&listener.accepting, 0)
+			err := http.Serve(ln, mux)
 			if err != nil {
-				ERROR.Println(err.Error())
+				h.listenerLog.Info("Listener stopped", "listener", name, "err", err)
 				return
 			}
 		}(ln)
 	} else {
 		//loop forever accepting connections and launch InitClient as a goroutine with the connection
+		atomic.StoreInt32(&listener.accepting, 1)
 		go func() {
 			defer h.listenersWaitGroup.Done()
-			for {
-				conn, err := ln.Accept()
-				if err != nil {
-					ERROR.Println(err.Error())
-					return
+			defer atomic.StoreInt32(&listener.accepting, 0)
+			h.supervise("listener "+name, func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						h.listenerLog.Info("Listener stopped", "listener", name, "err", err)
+						return
+					}
+					h.listenerLog.Debug("New incoming connection", "listener", name, "addr", conn.RemoteAddr())
+					listener.connections = append(listener.connections, conn)
+					go h.initClient(conn, name, config)
 				}
-				INFO.Println("New incoming connection", conn.RemoteAddr())
-				listener.connections = append(listener.connections, conn)
-				go h.InitClient(conn)
-			}
+			})
 		}()
 	}
 	return nil
 }
 
+//peerCertificates returns the verified certificate chain of a tls, wss or quic client
+func peerCertificates(conn net.Conn) []*x509.Certificate {
+	var state *tls.ConnectionState
+	switch c := conn.(type) {
+	//a *tls.Conn or the stream of a QUIC connection
+	case interface{ ConnectionState() tls.ConnectionState }:
+		cs := c.ConnectionState()
+		state = &cs
+	case *websocket.Conn:
+		state = c.Request().TLS
+	}
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0]
+}
+
+//limitListener closes the connections it accepts while max connections are already open
+type limitListener struct {
+	net.Listener
+	max   int64
+	count int64
+	log   *logger
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if atomic.AddInt64(&l.count, 1) > l.max {
+			atomic.AddInt64(&l.count, -1)
+			l.log.Warn("Listener at its connection limit, closing connection", "addr", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		return &limitConn{Conn: conn, listener: l}, nil
+	}
+}
+
+//limitConn frees its place in the limitListener when it is closed
+type limitConn struct {
+	net.Conn
+	listener  *limitListener
+	closeOnce sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { atomic.AddInt64(&c.listener.count, -1) })
+	return err
+}
+
+// rateListener accepts at most a token bucket's rate of connections a second, Accept waits
+// for a token before accepting the next connection
+type rateListener struct {
+	net.Listener
+	bucket    *tokenBucket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newRateListener(ln net.Listener, rate float64) *rateListener {
+	return &rateListener{Listener: ln, bucket: newTokenBucket(rate), closed: make(chan struct{})}
+}
+
+func (l *rateListener) Accept() (net.Conn, error) {
+	if wait := l.bucket.wait(1, time.Now()); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-l.closed:
+			return nil, net.ErrClosed
+		}
+	}
+	l.bucket.take(1)
+	return l.Listener.Accept()
+}
+
+func (l *rateListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
 func (h *Hrotti) StopListener(name string) error {
 	if listener, ok := h.listeners[name]; ok {
+		if h.mdns != nil {
+			h.mdns.withdraw(name)
+		}
 		close(listener.stop)
 		for _, conn := range listener.connections {
 			conn.Close()
@@ -133,15 +560,72 @@ func (h *Hrotti) StopListener(name string) error {
 }
 
 func (h *Hrotti) Stop() {
-	INFO.Println("Exiting...")
+	h.listenerLog.Info("Exiting")
+	close(h.stop)
+	if h.mdns != nil {
+		h.mdns.close()
+	}
 	for _, listener := range h.listeners {
 		close(listener.stop)
 	}
+	h.closeClients()
 	h.listenersWaitGroup.Wait()
+	//the clients' OnDisconnect calls are made before Stop returns
+	if h.hooks != nil {
+		h.hooks.stop()
+	}
+	if h.ingestPool != nil {
+		h.ingestPool.stop()
+	}
+	h.PersistStore.Close()
 }
 
+//InitClient runs conn as a client connection until it disconnects, see ServeConn
 func (h *Hrotti) InitClient(conn net.Conn) {
+	h.startOnce.Do(h.start)
+	h.initClient(conn, "", nil)
+}
+
+//ServeConn runs conn as a client connection, in the background, exactly as if it had been
+//accepted by a listener: it has ConnectTimeout to send its CONNECT, is authenticated with
+//the broker's Auth and Authenticator and then has its keepalive, session and will handled
+//as usual. It lets an embedder serve connections it got some other way, or tests drive the
+//broker over a net.Pipe without a socket. The connection has no listener, so it has no
+//listener's auth, rewrites or certificate identity, and counts towards MaxConnectionsPerIP
+//under whatever its RemoteAddr is, "pipe" for a net.Pipe. After Stop conn is just closed.
+func (h *Hrotti) ServeConn(conn net.Conn) {
+	h.startOnce.Do(h.start)
+	select {
+	case <-h.stop:
+		conn.Close()
+		return
+	default:
+	}
+	go h.initClient(conn, "", nil)
+}
+
+//initClient runs a new connection to the listener called listener with config until it
+//disconnects. A connection passed to InitClient has no listener or config.
+func (h *Hrotti) initClient(conn net.Conn, listener string, config *ListenerConfig) {
+	defer h.recoverConnection(conn)
 	var sendSessionID bool
+	raw := conn
+	//count the bytes in and out for the metrics and, once it has connected, the client's stats
+	metered := &meteredConn{Conn: conn, stats: &h.stats}
+	conn = metered
+	//the connection is counted until this returns, which is when it is closed
+	ip := remoteIP(raw)
+	if h.BanAuthFailures > 0 && h.bans.banned(ip, time.Now()) {
+		h.listenerLog.Debug("Closing connection from banned address", "addr", conn.RemoteAddr(), "ip", ip)
+		atomic.AddInt64(&h.stats.connectionsBanned, 1)
+		conn.Close()
+		return
+	}
+	if !h.connections.open(ip, h.MaxConnections, h.MaxConnectionsPerIP) {
+		h.refuseConnection(conn, ip)
+		return
+	}
+	defer h.connections.close(ip)
 	/*var cph fixedHeader
 
 	//create a bufio conn from the network connection
@@ -167,11 +651,89 @@ func (h *Hrotti) InitClient(conn net.Conn) {
 	cp := newControlPacket(CONNECT).(*connectPacket)
 	cp.fixedHeader = cph
 	cp.unpack(body)*/
-	rp, _ := ReadPacket(conn)
+	//a connection has ConnectTimeout to send its CONNECT, anything else and it is closed
+	//without a response so idle or bogus connections can't tie up the broker
+	conn.SetReadDeadline(time.Now().Add(h.ConnectTimeout))
+	rp, err := ReadPacketLimit(conn, h.maxPacketSize())
+	if err != nil {
+		h.sessionLog.Warn("Failed to read CONNECT", "addr", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	h.stats.packetReceived(rp)
+	if connect, ok := rp.(*ConnectPacket); ok {
+		h.fixInbound(config, rp, connect.ClientIdentifier, conn.RemoteAddr().String())
+	}
+	if err = ValidateInbound(rp, false); err != nil {
+		h.sessionLog.Warn("Protocol violation before CONNECT", "addr", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
 	cp := rp.(*ConnectPacket)
+	//a will topic over the topic limits closes the connection, or on a permissive listener
+	//the client connects without its will
+	if err = ValidateTopicLimits(cp, h.topicLimits()); err != nil {
+		if !config.permissive() {
+			h.sessionLog.Warn("Protocol violation in CONNECT", "client", cp.ClientIdentifier, "addr", conn.RemoteAddr(), "err", err)
+			conn.Close()
+			return
+		}
+		h.sessionLog.Warn("Dropped will over the topic limits", "client", cp.ClientIdentifier, "addr", conn.RemoteAddr(), "err", err)
+		cp.WillFlag = false
+	}
+	conn.SetReadDeadline(time.Time{})
 
 	//Validate the CONNECT, check fields, values etc.
 	rc := cp.Validate()
+	valid := rc == CONN_ACCEPTED
+	info := ConnectionInfo{Listener: listener, RemoteAddr: conn.RemoteAddr(), Certificates: peerCertificates(raw)}
+	h.liveLock.RLock()
+	auth, authenticator := h.authFor(config)
+	h.liveLock.RUnlock()
+	//a client identified by its certificate has no password for Auth to check
+	certIdentified := false
+	if rc == CONN_ACCEPTED && config != nil && config.UseIdentityFromCert {
+		rc = config.identify(cp, info.Certificates)
+		certIdentified = rc == CONN_ACCEPTED
+	}
+	if rc == CONN_ACCEPTED && auth != nil && !certIdentified {
+		rc = auth.authenticate(cp)
+	}
+	quota := auth.quota(cp.Username)
+	if rc == CONN_ACCEPTED && authenticator != nil {
+		if quotaAuthenticator, ok := authenticator.(QuotaAuthenticator); ok {
+			var authenticated *Quota
+			if rc, authenticated = quotaAuthenticator.AuthenticateQuota(cp, info); authenticated != nil {
+				quota = authenticated
+			}
+		} else {
+			rc = authenticator.Authenticate(cp, info)
+		}
+	}
+	//credentials that were refused count towards banning the address they came from
+	if valid && rc != CONN_ACCEPTED {
+		h.authFailed(ip)
+	}
+	//a client can't leave a will on a topic it isn't allowed to publish to
+	if acl := auth.acl(cp.Username); rc == CONN_ACCEPTED && cp.WillFlag && acl != nil && !acl.canPublish(cp.WillTopic) {
+		rc = CONN_REF_NOT_AUTH
+	}
+	//a keepalive so short the client would be sending PINGREQs all the time is refused
+	if rc == CONN_ACCEPTED && cp.KeepaliveTimer > 0 && cp.KeepaliveTimer < h.MinKeepAlive {
+		h.sessionLog.Warn("Keepalive is below the minimum", "client", cp.ClientIdentifier, "keepalive", cp.KeepaliveTimer, "min", h.MinKeepAlive)
+		rc = CONN_REF_NOT_AUTH
+	}
+	//a client can't choose an id the broker has assigned to another client
+	if rc == CONN_ACCEPTED && h.clients.assigned(cp.ClientIdentifier) {
+		rc = CONN_REF_ID_REJ
+	}
+	//the connection and durable session are counted against the principal's quota last, once
+	//nothing else can refuse the client
+	var usage *quotaUsage
+	if rc == CONN_ACCEPTED && quota != nil {
+		usage, rc = h.reserveQuota(cp, quota)
+	}
+	h.stats.connectResult(rc)
 	//If it didn't validate...
 	if rc != CONN_ACCEPTED {
 		//and it wasn't because of a protocol violation...
@@ -180,52 +742,86 @@ func (h *Hrotti) InitClient(conn net.Conn) {
 			ca := NewControlPacket(CONNACK).(*ConnackPacket)
 			ca.ReturnCode = rc
 			ca.Write(conn)
+			h.stats.packetSent(ca)
 		}
 		//Put up a local message indicating an errored connection attempt and close the connection
-		ERROR.Println(ConnackReturnCodes[rc], conn.RemoteAddr())
+		h.sessionLog.Info("Client refused", "client", cp.ClientIdentifier, "addr", conn.RemoteAddr(), "rc", rc, "reason", ConnackReturnCodes[rc])
 		conn.Close()
 		return
 	} else {
 		//Put up an INFO message with the client id and the address they're connecting from.
-		INFO.Println(ConnackReturnCodes[rc], cp.ClientIdentifier, conn.RemoteAddr())
+		h.sessionLog.Info("Client connected", "client", cp.ClientIdentifier, "addr", conn.RemoteAddr(), "rc", rc, "cleanSession", cp.CleanSession)
 	}
 
-	//check for a zero length client id and if it exists create one from the UUID library and return
-	//it on $SYS/session_identifier
+	//Lock the clients hashmap while we check if we already know this clientid.
+	h.clients.Lock()
+	//a zero length client id (only allowed with cleansession true) is given a unique id, which
+	//is returned on $SYS/session_identifier
 	if len(cp.ClientIdentifier) == 0 {
-		cp.ClientIdentifier = uuid.New().String()
+		cp.ClientIdentifier = h.clients.assignID()
 		sendSessionID = true
 	}
-	//Lock the clients hashmap while we check if we already know this clientid.
-	h.clients.Lock()
+	//the client is back so its delayed will, if it has one, isn't published
+	h.cancelWill(cp.ClientIdentifier)
+	//the stop channel for this connection, a takeover replaces the client's after the
+	//clients lock is released
+	var stop chan struct{}
 	c, ok := h.clients.list[cp.ClientIdentifier]
-	if ok && cp.CleanSession {
-		//and if we do, if the clientid is currently connected...
-		if c.Connected() {
-			INFO.Println("Clientid", c.clientID, "already connected, stopping first client")
+	if ok {
+		//and if we do, if the clientid is currently connected, or still starting...
+		if c.Connected() || c.state.Value() == CONNECTING {
+			h.sessionLog.Info("Client id already connected, taking over", "client", c.clientID)
 			//stop the parts of it that need to stop before we can change the network connection it's using.
-			c.StopForTakeover()
+			c.closeClient(h, closeTakeover, "")
 		} else {
 			//if the clientid known but not connected, ie cleansession false
-			INFO.Println("Durable client reconnecting", c.clientID)
-			//disconnected client will no longer have the channels for messages
+			h.sessionLog.Debug("Durable client reconnecting", "client", c.clientID)
+		}
+		//disconnected client will no longer have the channels for messages, this includes one
+		//whose connection closed for another reason while it was being taken over
+		if c.state.Value() == DISCONNECTED {
 			c.outboundMessages = make(chan *PublishPacket, h.maxQueueDepth)
 			c.outboundPriority = make(chan ControlPacket, h.maxQueueDepth)
 		}
+		//a clean session doesn't keep any of the subscriptions the previous session held
+		if cp.CleanSession {
+			h.DeleteSubAll(c.clientID)
+			c.clear()
+			c.inboundQos2 = make(map[uint16]uint64)
+			c.stats.reset()
+			atomic.StoreInt64(&c.dropped, 0)
+		}
 		//this function stays running until the client disconnects as the function called by an http
-		//Handler has to remain running until its work is complete. So add one to the client waitgroup.
-		c.Add(1)
+		//Handler has to remain running until its work is complete. So add one to the client waitgroup,
+		//and one for Start.
+		c.Add(2)
+		c.connecting(cp)
 		//create a new sync.Once for stopping with later, set the connections and create the stop channel.
+		c.info.Lock()
 		c.stopOnce = new(sync.Once)
+		//closeClient does nothing while a takeover is stopping the old connection, the new one
+		//has to be closable again
+		c.takeOver = false
+		//the session is kept if neither this connection nor the last one asked for a clean session
+		c.sessionPresent = !cp.CleanSession && !c.cleanSession
 		c.conn = conn
+		c.listener, c.listenerConfig = listener, config
 		//c.bufferedConn = bufferedConn
 		c.stop = make(chan struct{})
+		stop = c.stop
+		c.info.Unlock()
+		metered.client = &c.stats
+		h.quotas.attach(c, usage, !cp.CleanSession)
 		//start the client.
 		go c.Start(cp, h)
 	} else {
 		//This is a brand new client so create a NewClient and add to the clients map
 		c = newClient(conn, cp.ClientIdentifier, h.maxQueueDepth)
+		c.assignedID = sendSessionID
+		metered.client = &c.stats
+		c.listener, c.listenerConfig = listener, config
 		h.clients.list[cp.ClientIdentifier] = c
+		stop = c.stop
 		if sendSessionID {
 			go func() {
 				sessionIDPacket := NewControlPacket(PUBLISH).(*PublishPacket)
@@ -236,15 +832,17 @@ func (h *Hrotti) InitClient(conn net.Conn) {
 			}()
 		}
 		//As before this function has to remain running but to avoid races we want to make sure its finished
-		//before doing anything else so add it to the waitgroup so we can wait on it later
-		c.Add(1)
+		//before doing anything else so add it to the waitgroup so we can wait on it later, with Start
+		c.Add(2)
+		c.connecting(cp)
+		h.quotas.attach(c, usage, !cp.CleanSession)
 		go c.Start(cp, h)
 	}
 	//finished with the clients hashmap
 	h.clients.Unlock()
 	//wait on the stop channel, we never actually send values down this channel but a closed channel with
 	//return the default empty value for it's type without blocking.
-	<-c.stop
+	<-stop
 	//call Done() on the client waitgroup.
 	c.Done()
 }
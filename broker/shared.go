@@ -0,0 +1,282 @@
+package hrotti
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//Each message matching a shared subscription ($share/<group>/<filter>) is delivered to one
+//member of the group, chosen by the group's SharedStrategy. SharedStrategies sets the
+//strategy for the groups whose name starts with each prefix, the longest prefix wins and
+//groups matching none are round robin. Members that are connected are chosen over those
+//whose durable session is offline, which only get messages when no member is connected.
+//When a member disconnects, the QoS 1 and 2 messages it was given by a group and hasn't
+//acknowledged are moved to another connected member, so a worker going away mid-stream
+//doesn't hold on to its share of the work until it comes back.
+
+//SharedStrategy is how a shared subscription group chooses the member each message goes to
+type SharedStrategy int
+
+const (
+	//SharedRoundRobin gives the members a message each in turn
+	SharedRoundRobin SharedStrategy = iota
+	//SharedLeastQueue gives each message to the member with the fewest messages waiting to be
+	//sent to it, in turn among those with the same number
+	SharedLeastQueue
+	//SharedSticky gives every message for a topic to the same member, so they are processed in
+	//order, by a consistent hash of the topic so a member joining or leaving only moves the
+	//topics that hash to it
+	SharedSticky
+)
+
+var sharedStrategyNames = map[SharedStrategy]string{
+	SharedRoundRobin: "round-robin",
+	SharedLeastQueue: "least-queue",
+	SharedSticky:     "sticky",
+}
+
+func (s SharedStrategy) String() string {
+	return sharedStrategyNames[s]
+}
+
+//sharedRingPoints is the number of points each member has on a sticky group's hash ring,
+//more points spread the topics more evenly between the members
+const sharedRingPoints = 64
+
+//a sharedGroup is the set of clients subscribed to the same $share/<group>/<filter>,
+//each message matching the filter is delivered to only one member, chosen by strategy
+type sharedGroup struct {
+	strategy SharedStrategy
+	members  []*subscriber
+	next     uint32
+	//ring is the members' points on the hash ring of a sticky group, sorted by hash
+	ring []ringPoint
+	//delivered is the number of messages given to the members and redelivered the number
+	//moved from a member that disconnected to another
+	delivered   int64
+	redelivered int64
+}
+
+type ringPoint struct {
+	hash   uint32
+	member *subscriber
+}
+
+//sharedStrategy returns the strategy for the groups of subscription, from the
+//SharedStrategies entry with the longest prefix of the group's name
+func (h *Hrotti) sharedStrategy(subscription string) SharedStrategy {
+	group := strings.SplitN(strings.TrimPrefix(subscription, sharePrefix), "/", 2)[0]
+	strategy := SharedRoundRobin
+	longest := -1
+	for prefix, s := range h.SharedStrategies {
+		if strings.HasPrefix(group, prefix) && len(prefix) > longest {
+			strategy, longest = s, len(prefix)
+		}
+	}
+	return strategy
+}
+
+//add adds member to the group, replacing any existing membership for the same client so it
+//keeps its place in the rotation and its count of messages. It returns true if the client
+//was already a member. Must be called with the subscriptionMap locked.
+func (g *sharedGroup) add(member *subscriber) bool {
+	replaced := false
+	for i, existing := range g.members {
+		if existing.client.clientID == member.client.clientID {
+			member.delivered = existing.delivered
+			g.members[i] = member
+			replaced = true
+		}
+	}
+	if !replaced {
+		g.members = append(g.members, member)
+	}
+	g.buildRing()
+	return replaced
+}
+
+//remove takes a client out of the group, must be called with the subscriptionMap locked
+func (g *sharedGroup) remove(client string) bool {
+	var members []*subscriber
+	for _, member := range g.members {
+		if member.client.clientID != client {
+			members = append(members, member)
+		}
+	}
+	removed := len(members) != len(g.members)
+	g.members = members
+	if removed {
+		g.buildRing()
+	}
+	return removed
+}
+
+//buildRing places the members of a sticky group on its hash ring, each member's points
+//only depend on its client id so they are where they were before any other member changed
+func (g *sharedGroup) buildRing() {
+	if g.strategy != SharedSticky {
+		return
+	}
+	g.ring = g.ring[:0]
+	for _, member := range g.members {
+		for i := 0; i < sharedRingPoints; i++ {
+			g.ring = append(g.ring, ringPoint{ringHash(member.client.clientID + "#" + strconv.Itoa(i)), member})
+		}
+	}
+	sort.Slice(g.ring, func(i, j int) bool { return g.ring[i].hash < g.ring[j].hash })
+}
+
+func ringHash(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return hash.Sum32()
+}
+
+//pick chooses the member of the group to deliver a message for topic to, skipping any member
+//that would have the message suppressed and except, and preferring connected members. It
+//returns nil if no member can take the message. Must be called with the subscriptionMap
+//read locked.
+func (g *sharedGroup) pick(publisher *Client, hopped bool, topic string, except *Client) *subscriber {
+	n := uint32(len(g.members))
+	if n == 0 {
+		return nil
+	}
+	start := atomic.AddUint32(&g.next, 1) - 1
+	var picked *subscriber
+	for _, offline := range []bool{false, true} {
+		eligible := func(member *subscriber) bool {
+			return member.client != except && !member.suppressed(publisher, hopped) && (offline || member.client.Connected())
+		}
+		switch g.strategy {
+		case SharedLeastQueue:
+			depth := 0
+			for i := uint32(0); i < n; i++ {
+				if member := g.members[(start+i)%n]; eligible(member) && (picked == nil || member.client.queueDepth() < depth) {
+					picked, depth = member, member.client.queueDepth()
+				}
+			}
+		case SharedSticky:
+			hash := ringHash(topic)
+			first := sort.Search(len(g.ring), func(i int) bool { return g.ring[i].hash >= hash })
+			for i := 0; i < len(g.ring) && picked == nil; i++ {
+				if point := g.ring[(first+i)%len(g.ring)]; eligible(point.member) {
+					picked = point.member
+				}
+			}
+		default:
+			for i := uint32(0); i < n && picked == nil; i++ {
+				if member := g.members[(start+i)%n]; eligible(member) {
+					picked = member
+				}
+			}
+		}
+		//messages being moved from a member that disconnected only go to connected members
+		if picked != nil || except != nil {
+			break
+		}
+	}
+	if picked != nil {
+		atomic.AddInt64(&picked.delivered, 1)
+		atomic.AddInt64(&g.delivered, 1)
+	}
+	return picked
+}
+
+//redistributeShared moves the QoS 1 and 2 messages c was given by shared subscription groups,
+//and hasn't acknowledged or received, to other connected members of the groups now that c
+//has disconnected. Messages with no other member to go to are left with c.
+func (h *Hrotti) redistributeShared(c *Client) {
+	inflight := c.sharedInflight()
+	if len(inflight) == 0 {
+		return
+	}
+	messages := make(map[uint16]*PublishPacket)
+	h.PersistStore.RangeInflight(c.clientID, func(direction dirFlag, msgID uint16, message ControlPacket) bool {
+		//a PUBREL means the client has received the QoS 2 message
+		if pp, ok := message.(*PublishPacket); ok && direction == OUTBOUND {
+			if _, shared := inflight[msgID]; shared {
+				messages[msgID] = pp
+			}
+		}
+		return true
+	})
+	ids := make([]uint16, 0, len(messages))
+	for msgID := range messages {
+		ids = append(ids, msgID)
+	}
+	//they are moved in the order they were delivered
+	c.sortByAge(ids)
+	moved := 0
+	for _, msgID := range ids {
+		msg, subscription := messages[msgID], inflight[msgID]
+		h.subs.RLock()
+		var member *subscriber
+		group, ok := h.subs.shared[subscription]
+		if ok {
+			member = group.pick(nil, false, msg.TopicName, c)
+		}
+		h.subs.RUnlock()
+		if member == nil {
+			continue
+		}
+		h.PersistStore.DeleteInflight(c.clientID, OUTBOUND, msgID)
+		c.freeID(msgID)
+		redelivery := msg.Copy()
+		redelivery.Qos = calcMinQos(member.qos, msg.Qos)
+		if redelivery.Qos > 0 {
+			member.client.markShared(redelivery, subscription)
+		}
+		member.client.deliver(redelivery, h)
+		if redelivery.Qos > 0 && redelivery.MessageID == 0 {
+			member.client.unmarkShared(redelivery)
+		}
+		atomic.AddInt64(&group.redelivered, 1)
+		moved++
+	}
+	if moved > 0 {
+		h.sessionLog.Info("Moved unacknowledged shared subscription messages to other members", "client", c.clientID, "messages", moved)
+	}
+}
+
+//SharedGroupInfo is a snapshot of a shared subscription group, as returned by the admin API
+type SharedGroupInfo struct {
+	Subscription string             `json:"subscription"`
+	Strategy     string             `json:"strategy"`
+	Delivered    int64              `json:"delivered"`
+	Redelivered  int64              `json:"redelivered"`
+	Members      []SharedMemberInfo `json:"members"`
+}
+
+//SharedMemberInfo is a member of a shared subscription group and the number of messages the
+//group has given it
+type SharedMemberInfo struct {
+	ClientID  string `json:"clientId"`
+	Connected bool   `json:"connected"`
+	Delivered int64  `json:"delivered"`
+}
+
+//sharedSnapshot returns the shared subscription groups sorted by subscription
+func (s *subscriptionMap) sharedSnapshot() []SharedGroupInfo {
+	s.RLock()
+	defer s.RUnlock()
+	groups := []SharedGroupInfo{}
+	for subscription, group := range s.shared {
+		info := SharedGroupInfo{
+			Subscription: subscription,
+			Strategy:     group.strategy.String(),
+			Delivered:    atomic.LoadInt64(&group.delivered),
+			Redelivered:  atomic.LoadInt64(&group.redelivered),
+		}
+		for _, member := range group.members {
+			info.Members = append(info.Members, SharedMemberInfo{member.client.clientID, member.client.Connected(), atomic.LoadInt64(&member.delivered)})
+		}
+		groups = append(groups, info)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Subscription < groups[j].Subscription })
+	return groups
+}
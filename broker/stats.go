@@ -1,7 +1,11 @@
 package hrotti
 
 import (
+	"strconv"
 	"sync/atomic"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
 )
 
 type stat int64
@@ -9,6 +13,7 @@ type stat int64
 type BrokerStats struct {
 	bytesReceived           int64
 	bytesSent               int64
+	writes                  int64
 	clientsConnected        int64
 	clientsDisconnected     int64
 	clientsMaximum          int64
@@ -18,14 +23,182 @@ type BrokerStats struct {
 	messagesSent            int64
 	messagesStored          int64
 	publishMessagesDropped  int64
+	publishMessagesExpired  int64
+	hookCallsDropped        int64
 	publishMessagesReceived int64
 	publishMessagesSent     int64
 	messagesRetained        int64
+	retainedOverLimits      int64
+	policyViolations        int64
+	publishesDenied         int64
+	adminPublishes          int64
+	panics                  int64
+	topicsRewritten         int64
+	subscriptionsRefused    int64
+	transformsFailed        int64
+	ingestErrors            int64
+	ingestTimeouts          int64
+	certificatesRefused     int64
+	quicConnections         int64
+	mqttsnClients           int64
+	mqttsnSleeping          int64
+	connectionsBanned       int64
+	deadLetters             int64
+	deadLettersDropped      int64
 	subscriptions           int64
 	brokerTime              int64
 	brokerUptime            int64
+	packetsReceived         [16]int64
+	packetsSent             [16]int64
+	connectResults          [256]int64
+	discarded               [numDropReasons]int64
+	fixups                  [NumFixups]int64
 }
 
 func (b *BrokerStats) AddClient() {
 	atomic.AddInt64(&b.clientsConnected, 1)
 }
+
+func (b *BrokerStats) DroppedMessage() {
+	atomic.AddInt64(&b.publishMessagesDropped, 1)
+}
+
+func (b *BrokerStats) packetReceived(cp ControlPacket) {
+	atomic.AddInt64(&b.packetsReceived[cp.Type()&0x0f], 1)
+}
+
+func (b *BrokerStats) packetSent(cp ControlPacket) {
+	atomic.AddInt64(&b.packetsSent[cp.Type()&0x0f], 1)
+}
+
+//droppedHook counts a call to the Hooks dropped because its worker's queue was full
+func (b *BrokerStats) droppedHook() {
+	atomic.AddInt64(&b.hookCallsDropped, 1)
+}
+
+//expiredMessage counts a message that expired before the client acknowledged it
+func (b *BrokerStats) expiredMessage() {
+	atomic.AddInt64(&b.publishMessagesExpired, 1)
+}
+
+//retainedRejected counts a retained message that was over the retained limits
+func (b *BrokerStats) retainedRejected() {
+	atomic.AddInt64(&b.retainedOverLimits, 1)
+}
+
+//publishDenied counts a message dropped because the publisher's ACL doesn't allow its topic
+func (b *BrokerStats) publishDenied() {
+	atomic.AddInt64(&b.publishesDenied, 1)
+}
+
+//policyViolation counts a message dropped for breaking its topic's policy
+func (b *BrokerStats) policyViolation() {
+	atomic.AddInt64(&b.policyViolations, 1)
+}
+
+//subscriptionRefused counts a filter in a SUBSCRIBE that was over the subscription limits
+func (b *BrokerStats) subscriptionRefused() {
+	atomic.AddInt64(&b.subscriptionsRefused, 1)
+}
+
+//transformFailed counts a message not delivered to a client because its PayloadTransformer
+//returned an error
+func (b *BrokerStats) transformFailed() {
+	atomic.AddInt64(&b.transformsFailed, 1)
+}
+
+//topicRewritten counts a topic or subscription filter changed by a TopicRewrite
+func (b *BrokerStats) topicRewritten() {
+	atomic.AddInt64(&b.topicsRewritten, 1)
+}
+
+//certificateRefused counts a client certificate refused by its listener's CRL or fingerprint
+//lists
+func (b *BrokerStats) certificateRefused() {
+	atomic.AddInt64(&b.certificatesRefused, 1)
+}
+
+//deadLetter counts a dropped message queued to be dead lettered
+func (b *BrokerStats) deadLetter() {
+	atomic.AddInt64(&b.deadLetters, 1)
+}
+
+//deadLetterDropped counts a dropped message not dead lettered because it was over the
+//DeadLetter limits
+func (b *BrokerStats) deadLetterDropped() {
+	atomic.AddInt64(&b.deadLettersDropped, 1)
+}
+
+//connectResult counts a connection attempt by the CONNACK return code it was given
+func (b *BrokerStats) connectResult(rc byte) {
+	atomic.AddInt64(&b.connectResults[rc], 1)
+}
+
+//statsPublisher publishes the broker stats as retained messages under $SYS every
+//StatsInterval until the broker is stopped.
+func (h *Hrotti) statsPublisher() {
+	ticker := time.NewTicker(h.StatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.publishStats()
+		}
+	}
+}
+
+func (h *Hrotti) publishStats() {
+	h.publishSys("$SYS/broker/publish/messages/dropped", atomic.LoadInt64(&h.stats.publishMessagesDropped))
+	h.publishSys("$SYS/broker/publish/messages/expired", atomic.LoadInt64(&h.stats.publishMessagesExpired))
+	h.publishSys("$SYS/broker/hooks/dropped", atomic.LoadInt64(&h.stats.hookCallsDropped))
+	h.publishSys("$SYS/broker/publish/messages/policy", atomic.LoadInt64(&h.stats.policyViolations))
+	h.publishSys("$SYS/broker/publish/messages/denied", atomic.LoadInt64(&h.stats.publishesDenied))
+	h.publishSys("$SYS/broker/topics/rewritten", atomic.LoadInt64(&h.stats.topicsRewritten))
+	h.publishSys("$SYS/broker/subscriptions/count", int64(h.subs.total()))
+	h.publishSys("$SYS/broker/subscriptions/refused", atomic.LoadInt64(&h.stats.subscriptionsRefused))
+	h.publishSys("$SYS/broker/publish/messages/untransformed", atomic.LoadInt64(&h.stats.transformsFailed))
+	h.publishSys("$SYS/broker/connections/certificates/refused", atomic.LoadInt64(&h.stats.certificatesRefused))
+	for reason := DropReason(0); reason < numDropReasons; reason++ {
+		h.publishSys("$SYS/broker/messages/discarded/"+reason.String(), atomic.LoadInt64(&h.stats.discarded[reason]))
+	}
+	h.publishSys("$SYS/broker/messages/deadletters", atomic.LoadInt64(&h.stats.deadLetters))
+	h.topicStats.publish(h)
+	//the queue depth and drop count for each connected client shows up slow consumers
+	var connected int64
+	for _, c := range h.clients.snapshot() {
+		if !c.Connected() {
+			continue
+		}
+		connected++
+		h.publishSys("$SYS/broker/clients/"+c.clientID+"/queue/depth", int64(c.queueDepth()))
+		h.publishSys("$SYS/broker/clients/"+c.clientID+"/queue/dropped", atomic.LoadInt64(&c.dropped))
+		//and the messages held up or dropped by its rate limit show who is being throttled
+		c.info.RLock()
+		limited := c.limiter != nil
+		c.info.RUnlock()
+		if limited {
+			h.publishSys("$SYS/broker/clients/"+c.clientID+"/ratelimit/delayed", atomic.LoadInt64(&c.rateDelayed))
+			h.publishSys("$SYS/broker/clients/"+c.clientID+"/ratelimit/dropped", atomic.LoadInt64(&c.rateDropped))
+		}
+	}
+	h.publishSys("$SYS/broker/clients/connected", connected)
+}
+
+//publishSys publishes value as a retained QoS 0 message on topic
+func (h *Hrotti) publishSys(topic string, value int64) {
+	h.publishSysText(topic, strconv.FormatInt(value, 10))
+}
+
+//publishSysText is publishSys for a value that isn't a number
+func (h *Hrotti) publishSysText(topic string, value string) {
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = topic
+	pp.Payload = []byte(value)
+	pp.Retain = true
+	message := h.ingest(topic, pp)
+	h.persistenceLog.Debug("Setting retained message", "topic", topic)
+	h.subs.retain(message)
+	h.route(message, nil)
+}
@@ -0,0 +1,39 @@
+package hrotti
+
+import (
+	"strings"
+)
+
+//SubscriptionLimitPolicy is what the broker does with a SUBSCRIBE for a filter over its
+//MaxFilterLength or MaxFilterLevels, or that would take the client over MaxSubscriptions
+type SubscriptionLimitPolicy int
+
+const (
+	//RefuseSubscription refuses the filters over the limits with the 0x80 failure return code
+	//and grants the rest
+	RefuseSubscription SubscriptionLimitPolicy = iota
+	//DisconnectSubscriber disconnects the client without a SUBACK, the filters before the one
+	//over the limits are kept
+	DisconnectSubscriber
+)
+
+//overSubscriptionLimits returns why c can't subscribe to filter, or "" if it can. A filter
+//the client is already subscribed to only replaces that subscription so it doesn't count
+//towards MaxSubscriptions, nor do the subscriptions of other clients.
+func (h *Hrotti) overSubscriptionLimits(c *Client, filter string) string {
+	if err := h.topicLimits().Check(filter); err != nil {
+		return err.Error()
+	}
+	if h.MaxFilterLength > 0 && len(filter) > h.MaxFilterLength {
+		return "filter is over the maximum length"
+	}
+	if h.MaxFilterLevels > 0 && strings.Count(filter, "/")+1 > h.MaxFilterLevels {
+		return "filter has more than the maximum levels"
+	}
+	if h.MaxSubscriptions > 0 {
+		if count, ok := h.subs.subscriptionCount(c.clientID, filter); !ok && count >= h.MaxSubscriptions {
+			return "client has the maximum subscriptions"
+		}
+	}
+	return ""
+}
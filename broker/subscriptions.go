@@ -4,19 +4,78 @@ package hrotti
 //slice of QoS values for the topics, return a slice of byte values indicating the granted
 //QoS values in topics order.
 func (h *Hrotti) AddSubscription(c *Client, topics []string, qoss []byte) []byte {
+	rQos, _ := h.addSubscription(c, topics, qoss)
+	return rQos
+}
+
+//addSubscription is AddSubscription, disconnect is true if a filter was over the
+//subscription limits and the SubscriptionLimitPolicy is DisconnectSubscriber, in which case
+//the filters after it aren't added
+func (h *Hrotti) addSubscription(c *Client, topics []string, qoss []byte) (rQos []byte, disconnect bool) {
 	//this is the slice we'll return and needs to be the same length as the input QoS' slice
-	rQos := make([]byte, len(qoss))
+	rQos = make([]byte, len(qoss))
+	//the session is only saved again if a subscription changed
+	changed := false
 
 	//for every topic in the topics slice, also get the index number of the topic...
 	for i, topic := range topics {
-		h.AddSub(c.clientID, topic, qoss[i])
+		//a filter the client's ACL doesn't allow is refused with the failure return code
+		if !c.canSubscribe(topic) {
+			h.packetsLog.Warn("SUBSCRIBE denied by ACL", "client", c.clientID, "username", c.username, "filter", topic)
+			rQos[i] = 0x80
+			continue
+		}
+		//as is one over the subscription limits, unless the client is disconnected for it
+		if reason := h.overSubscriptionLimits(c, topic); reason != "" {
+			h.packetsLog.Warn("SUBSCRIBE over the subscription limits", "client", c.clientID, "filter", topic, "reason", reason)
+			h.stats.subscriptionRefused()
+			if h.SubscriptionLimitPolicy == DisconnectSubscriber {
+				disconnect = true
+				break
+			}
+			rQos[i] = 0x80
+			continue
+		}
+		if h.AddSub(c, topic, SubscriptionOptions{Qos: qoss[i], RetainHandling: c.retainHandling}) {
+			changed = true
+		}
 		rQos[i] = qoss[i]
 	}
+	if !c.cleanSession && changed {
+		h.saveSession(c)
+	}
 	//return the slice of granted QoS values.
-	return rQos
+	return rQos, disconnect
 }
 
+//RemoveSubscription removes a client's subscription to topic, any messages already queued
+//for the client because of it are removed from the queue and none will be queued after it
+//returns.
 func (h *Hrotti) RemoveSubscription(c *Client, topic string) bool {
+	c.deliverMu.Lock()
 	h.DeleteSub(c.clientID, topic)
+	h.subs.RLock()
+	c.unsubscribed = h.subs.version
+	h.subs.RUnlock()
+	c.cancelRetained(topic)
+	c.purgeQueued(h, topic)
+	c.deliverMu.Unlock()
+	if !c.cleanSession {
+		h.saveSession(c)
+	}
 	return true
 }
+
+//saveSession persists the subscriptions of a cleanSession false client so they are
+//restored if the broker restarts
+func (h *Hrotti) saveSession(c *Client) {
+	c.info.RLock()
+	session := &Session{Subscriptions: make(map[string]SubscriptionOptions), DisconnectedAt: c.disconnectedAt}
+	c.info.RUnlock()
+	for _, sub := range h.subs.clientSubscriptions(c.clientID) {
+		session.Subscriptions[sub.Filter] = SubscriptionOptions{Qos: sub.Qos, NoLocal: sub.NoLocal}
+	}
+	if err := h.PersistStore.StoreSession(c.clientID, session); err != nil {
+		h.persistenceLog.Error("Failed to persist session", "client", c.clientID, "err", err)
+	}
+}
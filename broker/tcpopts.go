@@ -0,0 +1,120 @@
+package hrotti
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//TCPOptions tune the TCP connections a listener accepts, they are set on each connection
+//as it is accepted, before a PROXY header, TLS handshake or CONNECT is read from it.
+//
+//Go turns Nagle's algorithm off for every connection so small packets such as PUBACKs are
+//sent straight away, DisableNoDelay turns it back on for higher throughput at the cost of
+//latency. Go also sends TCP keepalive probes after 15 seconds idle, every 15 seconds, and
+//drops the connection after 9 go unanswered. KeepAliveIdle, KeepAliveInterval and
+//KeepAliveCount replace those, zero keeps Go's, so that a NAT that forgets idle connections
+//faster than the MQTT keepalive doesn't leave the broker holding dead clients.
+//DisableKeepAlive turns the probes off. Some platforms can't set all of these, Windows
+//can't set the count, and a failure is logged once for the listener. ReadBuffer and
+//WriteBuffer set the socket's receive and send buffer sizes in bytes, zero leaves the
+//operating system's.
+type TCPOptions struct {
+	DisableNoDelay    bool
+	DisableKeepAlive  bool
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+	ReadBuffer        int
+	WriteBuffer       int
+}
+
+//String describes the options for the listener's startup log
+func (o TCPOptions) String() string {
+	settings := []string{fmt.Sprintf("nodelay=%t", !o.DisableNoDelay)}
+	switch {
+	case o.DisableKeepAlive:
+		settings = append(settings, "keepalive=off")
+	default:
+		idle, interval, count := o.KeepAliveIdle, o.KeepAliveInterval, o.KeepAliveCount
+		if idle <= 0 {
+			idle = 15 * time.Second
+		}
+		if interval <= 0 {
+			interval = 15 * time.Second
+		}
+		if count <= 0 {
+			count = 9
+		}
+		settings = append(settings, fmt.Sprintf("keepalive=%s/%s/%d", idle, interval, count))
+	}
+	if o.ReadBuffer > 0 {
+		settings = append(settings, fmt.Sprintf("readbuffer=%d", o.ReadBuffer))
+	}
+	if o.WriteBuffer > 0 {
+		settings = append(settings, fmt.Sprintf("writebuffer=%d", o.WriteBuffer))
+	}
+	return strings.Join(settings, " ")
+}
+
+//keepAliveSet returns true if the options change Go's default keepalive
+func (o TCPOptions) keepAliveSet() bool {
+	return o.DisableKeepAlive || o.KeepAliveIdle > 0 || o.KeepAliveInterval > 0 || o.KeepAliveCount > 0
+}
+
+//apply sets the options on conn, returning the first one that couldn't be set
+func (o TCPOptions) apply(conn *net.TCPConn) error {
+	if o.DisableNoDelay {
+		if err := conn.SetNoDelay(false); err != nil {
+			return fmt.Errorf("nodelay: %w", err)
+		}
+	}
+	if o.keepAliveSet() {
+		if err := conn.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   !o.DisableKeepAlive,
+			Idle:     o.KeepAliveIdle,
+			Interval: o.KeepAliveInterval,
+			Count:    o.KeepAliveCount,
+		}); err != nil {
+			return fmt.Errorf("keepalive: %w", err)
+		}
+	}
+	if o.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(o.ReadBuffer); err != nil {
+			return fmt.Errorf("read buffer: %w", err)
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := conn.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return fmt.Errorf("write buffer: %w", err)
+		}
+	}
+	return nil
+}
+
+//tcpListener applies a listener's TCPOptions to each connection it accepts
+type tcpListener struct {
+	net.Listener
+	name     string
+	options  TCPOptions
+	warnOnce sync.Once
+	log      *logger
+}
+
+func (l *tcpListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		//the connection is still usable with the options it has
+		if err := l.options.apply(tc); err != nil {
+			l.warnOnce.Do(func() {
+				l.log.Warn("Failed to set TCP options on connection", "listener", l.name, "err", err)
+			})
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,89 @@
+package hrotti
+
+import (
+	"sync"
+	"time"
+)
+
+//wheelTick and wheelSlots are the resolution of the broker's timing wheel and the number of
+//ticks in one turn of it
+const (
+	wheelTick  = 50 * time.Millisecond
+	wheelSlots = 1024
+)
+
+//timingWheel runs functions after a delay for the whole broker from a single goroutine, so
+//a timer per inflight message costs an entry in a slice rather than a goroutine. A function
+//is put in the slot for the tick it is due in, with the number of whole turns of the wheel
+//still to go, and each tick the next slot is run. Functions can be up to a tick late and run
+//on the wheel's goroutine, so they mustn't block.
+type timingWheel struct {
+	sync.Mutex
+	slots   [][]wheelEntry
+	current int
+}
+
+type wheelEntry struct {
+	rounds int
+	f      func()
+}
+
+func newTimingWheel() *timingWheel {
+	return &timingWheel{slots: make([][]wheelEntry, wheelSlots)}
+}
+
+//schedule runs f after delay, rounded up to a whole number of ticks
+func (w *timingWheel) schedule(delay time.Duration, f func()) {
+	ticks := int((delay + wheelTick - 1) / wheelTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	w.Lock()
+	defer w.Unlock()
+	slot := (w.current + ticks) % wheelSlots
+	w.slots[slot] = append(w.slots[slot], wheelEntry{rounds: (ticks - 1) / wheelSlots, f: f})
+}
+
+//run turns the wheel on clock until stop is closed. A tick that comes late, as the wheel's
+//goroutine was held up or the clock was moved on by a test, turns the wheel for every tick
+//that has passed.
+func (w *timingWheel) run(clock Clock, stop chan struct{}) {
+	ticker := clock.NewTicker(wheelTick)
+	defer ticker.Stop()
+	last := clock.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			for now := clock.Now(); now.Sub(last) >= wheelTick; last = last.Add(wheelTick) {
+				for _, f := range w.advance() {
+					f()
+				}
+			}
+		}
+	}
+}
+
+//advance moves the wheel on a tick and returns the functions that are now due
+func (w *timingWheel) advance() []func() {
+	w.Lock()
+	defer w.Unlock()
+	w.current = (w.current + 1) % wheelSlots
+	var due []func()
+	waiting := w.slots[w.current][:0]
+	for _, entry := range w.slots[w.current] {
+		if entry.rounds == 0 {
+			due = append(due, entry.f)
+			continue
+		}
+		entry.rounds--
+		waiting = append(waiting, entry)
+	}
+	//clear the tail so the functions that ran can be collected
+	for i := len(waiting); i < len(w.slots[w.current]); i++ {
+		w.slots[w.current][i] = wheelEntry{}
+	}
+	w.slots[w.current] = waiting
+	return due
+}
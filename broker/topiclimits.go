@@ -0,0 +1,20 @@
+package hrotti
+
+import (
+	. "github.com/alsm/hrotti/packets"
+)
+
+//The topic names and filters clients send are checked against MaxTopicLevels (default
+//DefaultMaxTopicLevels), MaxTopicLevelLength and MaxTopicLength as soon as the packet is
+//read, before they are rewritten, split into levels or added to the subscription trie, so a
+//filter of 100,000 levels can't make the broker allocate a node for each of them. A PUBLISH
+//topic, SUBSCRIBE or UNSUBSCRIBE filter or will topic over them is a protocol violation that
+//closes the connection on a strict listener. On a permissive one the PUBLISH is acknowledged
+//and dropped, the filter is refused with the 0x80 return code or ignored when unsubscribing,
+//and the will is dropped. The retained store refuses topics over the limits as well, so a
+//message from the admin API or a bridge can't get round them.
+
+//topicLimits returns the limits on the topics the broker accepts
+func (h *Hrotti) topicLimits() TopicLimits {
+	return TopicLimits{MaxLevels: h.MaxTopicLevels, MaxLevelLength: h.MaxTopicLevelLength, MaxLength: h.MaxTopicLength}
+}
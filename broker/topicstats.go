@@ -0,0 +1,167 @@
+package hrotti
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//otherTopics is the name of the counters for topics under none of the TopicMetrics prefixes
+const otherTopics = "other"
+
+//topicCounters are the counts for the topics under one of the TopicMetrics prefixes
+type topicCounters struct {
+	prefix          string
+	messages        int64
+	bytes           int64
+	retainedSet     int64
+	retainedCleared int64
+	subscribers     int64
+	//lastReceived is when the last message routed was received, in Unix nanoseconds
+	lastReceived int64
+}
+
+//prefixNode is a level of the tree of TopicMetrics prefixes, counters is set on the node
+//for the last level of a prefix
+type prefixNode struct {
+	children map[string]*prefixNode
+	counters *topicCounters
+}
+
+//topicStats counts the messages routed to topics by the TopicMetrics prefix they are under,
+//the topic's levels are walked down a tree of the prefixes to find the longest one so it
+//costs a map lookup per level whatever the number of prefixes. It isn't changed once it is
+//built so it needs no locking.
+type topicStats struct {
+	root     prefixNode
+	counters []*topicCounters
+	other    *topicCounters
+}
+
+//newTopicStats returns the stats for prefixes, or nil if there are none. A prefix is whole
+//topic levels, with or without a trailing /, so telemetry/ counts telemetry/temp but not
+//telemetryx/temp.
+func newTopicStats(prefixes []string) *topicStats {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	t := &topicStats{other: &topicCounters{prefix: otherTopics}}
+	for _, prefix := range prefixes {
+		node := &t.root
+		for _, level := range topicLevels(strings.TrimSuffix(prefix, "/")) {
+			if node.children == nil {
+				node.children = make(map[string]*prefixNode)
+			}
+			child, ok := node.children[level]
+			if !ok {
+				child = &prefixNode{}
+				node.children[level] = child
+			}
+			node = child
+		}
+		if node.counters == nil {
+			node.counters = &topicCounters{prefix: prefix}
+			t.counters = append(t.counters, node.counters)
+		}
+	}
+	t.counters = append(t.counters, t.other)
+	return t
+}
+
+//lookup returns the counters for the longest prefix of the topic with levels
+func (t *topicStats) lookup(levels []string) *topicCounters {
+	counters := t.other
+	node := &t.root
+	for _, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			break
+		}
+		node = child
+		if node.counters != nil {
+			counters = node.counters
+		}
+	}
+	return counters
+}
+
+//routed counts a message of size bytes routed to the topic with levels and the number of
+//subscribers it matched, and records when it was received
+func (t *topicStats) routed(levels []string, size int, subscribers int, receivedAt time.Time) {
+	if t == nil {
+		return
+	}
+	counters := t.lookup(levels)
+	atomic.AddInt64(&counters.messages, 1)
+	atomic.AddInt64(&counters.bytes, int64(size))
+	atomic.AddInt64(&counters.subscribers, int64(subscribers))
+	//messages are routed concurrently, so one received earlier can be routed after a later one
+	for received := receivedAt.UnixNano(); ; {
+		last := atomic.LoadInt64(&counters.lastReceived)
+		if received <= last || atomic.CompareAndSwapInt64(&counters.lastReceived, last, received) {
+			break
+		}
+	}
+}
+
+//retained counts the retained message for topic being set, or cleared
+func (t *topicStats) retained(topic string, cleared bool) {
+	if t == nil {
+		return
+	}
+	counters := t.lookup(topicLevels(topic))
+	if cleared {
+		atomic.AddInt64(&counters.retainedCleared, 1)
+	} else {
+		atomic.AddInt64(&counters.retainedSet, 1)
+	}
+}
+
+//publish publishes the counters under $SYS/broker/load/topics/, by the prefix without its
+//trailing /, and the time the last message was received under $SYS/broker/messages/last/
+func (t *topicStats) publish(h *Hrotti) {
+	if t == nil {
+		return
+	}
+	for _, counters := range t.counters {
+		base := "$SYS/broker/load/topics/" + strings.TrimSuffix(counters.prefix, "/")
+		h.publishSys(base+"/messages", atomic.LoadInt64(&counters.messages))
+		h.publishSys(base+"/bytes", atomic.LoadInt64(&counters.bytes))
+		h.publishSys(base+"/retained/set", atomic.LoadInt64(&counters.retainedSet))
+		h.publishSys(base+"/retained/cleared", atomic.LoadInt64(&counters.retainedCleared))
+		h.publishSys(base+"/subscribers", atomic.LoadInt64(&counters.subscribers))
+		if last := atomic.LoadInt64(&counters.lastReceived); last != 0 {
+			h.publishSysText("$SYS/broker/messages/last/"+strings.TrimSuffix(counters.prefix, "/"), time.Unix(0, last).UTC().Format(time.RFC3339Nano))
+		}
+	}
+}
+
+//writeMetrics writes the counters with the prefix as a label
+func (t *topicStats) writeMetrics(w io.Writer) {
+	if t == nil {
+		return
+	}
+	for _, metric := range []struct {
+		name  string
+		help  string
+		value func(*topicCounters) *int64
+	}{
+		{"hrotti_topic_messages_total", "Messages routed by topic prefix.", func(c *topicCounters) *int64 { return &c.messages }},
+		{"hrotti_topic_bytes_total", "Payload bytes routed by topic prefix.", func(c *topicCounters) *int64 { return &c.bytes }},
+		{"hrotti_topic_retained_set_total", "Retained messages set by topic prefix.", func(c *topicCounters) *int64 { return &c.retainedSet }},
+		{"hrotti_topic_retained_cleared_total", "Retained messages cleared by topic prefix.", func(c *topicCounters) *int64 { return &c.retainedCleared }},
+		{"hrotti_topic_subscribers_matched_total", "Subscribers matched by the messages routed, by topic prefix.", func(c *topicCounters) *int64 { return &c.subscribers }},
+	} {
+		writeMetric(w, metric.name, "counter", metric.help)
+		for _, counters := range t.counters {
+			fmt.Fprintf(w, "%s{prefix=\"%s\"} %d\n", metric.name, labelValue.Replace(counters.prefix), atomic.LoadInt64(metric.value(counters)))
+		}
+	}
+	writeMetric(w, "hrotti_topic_last_received_timestamp_seconds", "gauge", "When the last message routed by topic prefix was received, 0 if none has been.")
+	for _, counters := range t.counters {
+		last := float64(atomic.LoadInt64(&counters.lastReceived)) / float64(time.Second)
+		fmt.Fprintf(w, "hrotti_topic_last_received_timestamp_seconds{prefix=\"%s\"} %.3f\n", labelValue.Replace(counters.prefix), last)
+	}
+}
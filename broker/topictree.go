@@ -0,0 +1,107 @@
+package hrotti
+
+import (
+	"strings"
+)
+
+//a topicNode is a level in the tree of subscription filters, each level of a filter is a
+//child of the level before it so a topic is matched by walking down the tree a level at a
+//time, following the + and # children as well as the one for the topic's level.
+type topicNode struct {
+	children map[string]*topicNode
+	//subscriptions are the subscriptions whose filter ends at this node, shared subscriptions
+	//to the filter each have their own entry as $share/<group>/<filter>
+	subscriptions map[string]bool
+	//generation is incremented when the subscriptions change or the node is removed from the
+	//tree, see matchCache
+	generation uint64
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children:      make(map[string]*topicNode),
+		subscriptions: make(map[string]bool),
+	}
+}
+
+//add adds subscription to the tree at the node for the filter levels
+func (n *topicNode) add(levels []string, subscription string) {
+	for _, level := range levels {
+		child, ok := n.children[level]
+		if !ok {
+			child = newTopicNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+	if !n.subscriptions[subscription] {
+		n.subscriptions[subscription] = true
+		n.generation++
+	}
+}
+
+//remove takes subscription out of the tree and removes any nodes left empty, it returns
+//true if n itself is now empty
+func (n *topicNode) remove(levels []string, subscription string) bool {
+	if len(levels) == 0 {
+		if n.subscriptions[subscription] {
+			delete(n.subscriptions, subscription)
+			n.generation++
+		}
+	} else if child, ok := n.children[levels[0]]; ok && child.remove(levels[1:], subscription) {
+		delete(n.children, levels[0])
+		child.generation++
+	}
+	return len(n.subscriptions) == 0 && len(n.children) == 0
+}
+
+//match calls f for each subscription with a filter matching the topic levels, n should be
+//the root of the tree. A topic starting with $ is only matched by filters with the same
+//first level, never by a + or # at the root.
+func (n *topicNode) match(levels []string, f func(subscription string)) {
+	n.matchTraced(levels, f, nil)
+}
+
+//matchTraced is match recording in trace, if it isn't nil, what the match depended on
+func (n *topicNode) matchTraced(levels []string, f func(subscription string), trace *matchTrace) {
+	if len(levels) > 0 && strings.HasPrefix(levels[0], "$") {
+		trace.visit(n)
+		if child := n.child(levels[0], trace); child != nil {
+			child.matchLevels(levels[1:], f, trace)
+		}
+		return
+	}
+	n.matchLevels(levels, f, trace)
+}
+
+func (n *topicNode) matchLevels(levels []string, f func(subscription string), trace *matchTrace) {
+	trace.visit(n)
+	//a # matches the level before it as well, so a/# matches a
+	if hash := n.child("#", trace); hash != nil {
+		trace.visit(hash)
+		for subscription := range hash.subscriptions {
+			f(subscription)
+		}
+	}
+	if len(levels) == 0 {
+		for subscription := range n.subscriptions {
+			f(subscription)
+		}
+		return
+	}
+	if child := n.child(levels[0], trace); child != nil {
+		child.matchLevels(levels[1:], f, trace)
+	}
+	if plus := n.child("+", trace); plus != nil {
+		plus.matchLevels(levels[1:], f, trace)
+	}
+}
+
+//child returns the child of n for level, or nil recording in trace that there wasn't one
+func (n *topicNode) child(level string, trace *matchTrace) *topicNode {
+	child, ok := n.children[level]
+	if !ok && trace != nil {
+		trace.absent = append(trace.absent, absentChild{n, level})
+	}
+	return child
+}
@@ -0,0 +1,145 @@
+package hrotti
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+	"unicode/utf8"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//PayloadTransformer changes the payload of a message for each subscription it is delivered
+//to, such as wrapping it in an envelope for consumers that need to know where it came from.
+//It is called once for every client the message goes to, before the message is queued, so
+//the QoS, persistence and packet size limits all apply to the payload it returns. An error
+//skips delivering the message to that client.
+type PayloadTransformer interface {
+	TransformPayload(delivery Delivery) ([]byte, error)
+}
+
+//Delivery is a message being delivered to one subscription. Payload is shared with every
+//other delivery of the message so it must not be changed, a transformer returns a new slice.
+//Publisher is the client id of the client that published it, empty for a message published
+//by the broker itself or a retained message sent to a new subscription. Filter is the
+//subscription the message matched and Qos the QoS it is delivered at. Properties are the
+//message's properties, which the MQTT 3.1.1 subscribers can't otherwise be sent, and are
+//shared like Payload.
+type Delivery struct {
+	Topic      string
+	Payload    []byte
+	Publisher  string
+	Subscriber string
+	Filter     string
+	Qos        byte
+	Retained   bool
+	Properties *Properties
+}
+
+//payloadTransformer returns the PayloadTransformer with the longest matching filter for
+//topic, or nil if there isn't one
+func (h *Hrotti) payloadTransformer(topic string) PayloadTransformer {
+	if len(h.PayloadTransformers) == 0 {
+		return nil
+	}
+	var matched string
+	var transformer PayloadTransformer
+	levels := topicLevels(topic)
+	for filter, t := range h.PayloadTransformers {
+		if (transformer == nil || moreSpecific(filter, matched)) && match(topicLevels(filter), levels) {
+			matched, transformer = filter, t
+		}
+	}
+	return transformer
+}
+
+//transform sets the payload of message, a copy of the message being delivered to c, to
+//what transformer returns for it. It returns false if the message shouldn't be delivered.
+func (h *Hrotti) transform(transformer PayloadTransformer, message *PublishPacket, publisher string, c *Client, filter string) bool {
+	payload, err := transformer.TransformPayload(Delivery{
+		Topic:      message.TopicName,
+		Payload:    message.Payload,
+		Publisher:  publisher,
+		Subscriber: c.clientID,
+		Filter:     filter,
+		Qos:        message.Qos,
+		Retained:   message.Retain,
+		Properties: message.Properties,
+	})
+	if err != nil {
+		h.packetsLog.Warn("Failed to transform payload, not delivering message", "client", c.clientID, "topic", message.TopicName, "err", err)
+		h.stats.transformFailed()
+		h.discard(DropTransformFailed, message, c.clientID)
+		return false
+	}
+	message.Payload = payload
+	return true
+}
+
+//JSONEnvelope is a PayloadTransformer that wraps each payload in a JSON object with the
+//topic, the publisher's client id and the time it was delivered, so
+//{"topic":"a/b","clientId":"sensor1","timestamp":"2026-01-02T15:04:05.123Z","payload":21.5}.
+//A payload that is JSON is included as it is, other text as a string and anything else is
+//base64 encoded with "encoding":"base64" set.
+//
+//Properties picks the message properties folded into the envelope as "properties", by
+//their names in JSON: contentType, responseTopic, correlationData (base64 encoded) and
+//userProperties. The rest are left out, as they are for subscribers without an envelope.
+type JSONEnvelope struct {
+	Properties []string
+}
+
+//EnvelopeProperties are the names of the properties a JSONEnvelope can include
+var EnvelopeProperties = []string{"contentType", "responseTopic", "correlationData", "userProperties"}
+
+type jsonEnvelope struct {
+	Topic      string          `json:"topic"`
+	ClientID   string          `json:"clientId,omitempty"`
+	Timestamp  string          `json:"timestamp"`
+	Payload    json.RawMessage `json:"payload"`
+	Encoding   string          `json:"encoding,omitempty"`
+	Properties *Properties     `json:"properties,omitempty"`
+}
+
+func (e JSONEnvelope) TransformPayload(delivery Delivery) ([]byte, error) {
+	envelope := jsonEnvelope{
+		Topic:      delivery.Topic,
+		ClientID:   delivery.Publisher,
+		Timestamp:  time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		Properties: e.properties(delivery.Properties),
+	}
+	switch {
+	case len(delivery.Payload) > 0 && json.Valid(delivery.Payload):
+		envelope.Payload = delivery.Payload
+	case utf8.Valid(delivery.Payload):
+		envelope.Payload, _ = json.Marshal(string(delivery.Payload))
+	default:
+		envelope.Payload, _ = json.Marshal(base64.StdEncoding.EncodeToString(delivery.Payload))
+		envelope.Encoding = "base64"
+	}
+	return json.Marshal(envelope)
+}
+
+//properties returns the properties the envelope includes, or nil if there are none
+func (e JSONEnvelope) properties(all *Properties) *Properties {
+	if all == nil || len(e.Properties) == 0 {
+		return nil
+	}
+	var included Properties
+	for _, name := range e.Properties {
+		switch name {
+		case "contentType":
+			included.ContentType = all.ContentType
+		case "responseTopic":
+			included.ResponseTopic = all.ResponseTopic
+		case "correlationData":
+			included.CorrelationData = all.CorrelationData
+		case "userProperties":
+			included.UserProperties = all.UserProperties
+		}
+	}
+	if included.ContentType == "" && included.ResponseTopic == "" && included.CorrelationData == nil && included.UserProperties == nil {
+		return nil
+	}
+	return &included
+}
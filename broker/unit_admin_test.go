@@ -0,0 +1,354 @@
+package hrotti
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//connectListener sends a CONNECT with username, if it isn't "", to the listener called name
+//and returns the connection and the CONNACK return code
+func connectListener(t testing.TB, h *Hrotti, name string, id string, username string, cleanSession bool) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", h.listeners[name].ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.CleanSession = cleanSession
+	cp.KeepaliveTimer = 30
+	cp.ClientIdentifier = id
+	if username != "" {
+		cp.UsernameFlag, cp.Username = true, username
+		cp.PasswordFlag, cp.Password = true, []byte("password")
+	}
+	cp.Write(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	rp, err := ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("client %s received no CONNACK: %s", id, err.Error())
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn, rp.(*ConnackPacket).ReturnCode
+}
+
+//connectTestClient connects an MQTT client without a username to the broker's "test"
+//listener
+func connectTestClient(t testing.TB, h *Hrotti, id string, cleanSession bool) net.Conn {
+	conn, rc := connectListener(t, h, "test", id, "", cleanSession)
+	if rc != CONN_ACCEPTED {
+		t.Fatalf("client %s was not accepted", id)
+	}
+	return conn
+}
+
+//dialTestClient connects a clean session MQTT client and subscribes it to filter
+func dialTestClient(t *testing.T, h *Hrotti, id string, filter string) net.Conn {
+	conn := connectTestClient(t, h, id, true)
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{filter}
+	sp.Qoss = []byte{1}
+	sp.Write(conn)
+	if _, err := ReadPacket(conn); err != nil {
+		t.Fatalf("client %s did not receive a SUBACK", id)
+	}
+	return conn
+}
+
+func adminRequest(t *testing.T, server *httptest.Server, method string, path string, body string, v interface{}) int {
+	req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %s", method, path, err.Error())
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s returned bad JSON: %s", method, path, err.Error())
+		}
+	}
+	return resp.StatusCode
+}
+
+func Test_AdminAPI(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	server := httptest.NewServer(h.adminHandler())
+	defer server.Close()
+	conn := dialTestClient(t, h, "admin/test", "a/#")
+	defer conn.Close()
+
+	var clients []ClientInfo
+	adminRequest(t, server, "GET", "/clients", "", &clients)
+	if len(clients) != 1 || clients[0].ClientID != "admin/test" || !clients[0].Connected ||
+		clients[0].KeepAlive != 30 || !clients[0].CleanSession || clients[0].Subscriptions != 1 ||
+		clients[0].RemoteAddr != conn.LocalAddr().String() {
+		t.Errorf("clients are %+v", clients)
+	}
+
+	var subs []SubscriptionInfo
+	adminRequest(t, server, "GET", "/clients/admin/test/subscriptions", "", &subs)
+	if len(subs) != 1 || subs[0].Filter != "a/#" || subs[0].Qos != 1 {
+		t.Errorf("subscriptions are %+v", subs)
+	}
+	if code := adminRequest(t, server, "GET", "/clients/unknown/subscriptions", "", nil); code != http.StatusNotFound {
+		t.Errorf("subscriptions for an unknown client returned %d", code)
+	}
+
+	if code := adminRequest(t, server, "POST", "/publish", `{"topic":"a/b","payload":"hello","retain":true}`, nil); code != http.StatusNoContent {
+		t.Fatalf("publish returned %d", code)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	rp, err := ReadPacket(conn)
+	if pp, ok := rp.(*PublishPacket); err != nil || !ok || pp.TopicName != "a/b" || string(pp.Payload) != "hello" {
+		t.Errorf("client received %v %v, should be the injected message", rp, err)
+	}
+	if code := adminRequest(t, server, "POST", "/publish", `{"topic":"a/#"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("publish to a wildcard returned %d", code)
+	}
+
+	var retained []RetainedInfo
+	adminRequest(t, server, "GET", "/retained", "", &retained)
+	if len(retained) != 1 || retained[0].Topic != "a/b" || retained[0].Size != 5 {
+		t.Errorf("retained messages are %+v", retained)
+	}
+	var purge AdminPurge
+	adminRequest(t, server, "DELETE", "/retained?filter=a/%23", "", &purge)
+	if purge.Purged != 1 || len(h.Retained()) != 0 {
+		t.Errorf("purge deleted %d retained messages, %d are left", purge.Purged, len(h.Retained()))
+	}
+	if code := adminRequest(t, server, "DELETE", "/retained", "", nil); code != http.StatusBadRequest {
+		t.Errorf("purge without a filter returned %d", code)
+	}
+
+	if code := adminRequest(t, server, "DELETE", "/clients/admin/test", "", nil); code != http.StatusNoContent {
+		t.Fatalf("disconnect returned %d", code)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ReadPacket(conn); err == nil {
+		t.Errorf("client connection is still open after being disconnected")
+	}
+	if code := adminRequest(t, server, "DELETE", "/clients/admin/test", "", nil); code != http.StatusNotFound {
+		t.Errorf("disconnecting a removed client returned %d", code)
+	}
+}
+
+func Test_AdminInject(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.Auth = &Auth{AllowAnonymous: true, ACLs: map[string]*ACL{"admin": {Publish: []string{"a/#", "device/#"}}}}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	server := httptest.NewServer(h.adminHandler())
+	defer server.Close()
+	conn := dialTestClient(t, h, "sub", "a/#")
+	defer conn.Close()
+	device := connectTestClient(t, h, "device", true)
+	defer device.Close()
+
+	//"AAEC" is the bytes 0, 1 and 2
+	if code := adminRequest(t, server, "POST", "/publish", `{"topic":"a/b","payloadBase64":"AAEC"}`, nil); code != http.StatusNoContent {
+		t.Fatalf("publish returned %d", code)
+	}
+	if pp := readPublish(t, conn, time.Second); pp == nil || pp.TopicName != "a/b" || string(pp.Payload) != "\x00\x01\x02" {
+		t.Errorf("client received %v, should be the injected message", pp)
+	}
+	if code := adminRequest(t, server, "POST", "/publish", `{"topic":"b/c","payload":"hello"}`, nil); code != http.StatusForbidden {
+		t.Errorf("publish outside the admin ACL returned %d", code)
+	}
+	if code := adminRequest(t, server, "POST", "/publish", `{"topic":"a/b","payload":"x","payloadBase64":"AAEC"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("publish with both payloads returned %d", code)
+	}
+	h.MaxTopicLevels = 3
+	for _, topic := range []string{"a/" + strings.Repeat("x", MaxFieldLength), "a/b/c/d", "a/\\u0000"} {
+		if code := adminRequest(t, server, "POST", "/publish", `{"topic":"`+topic+`","payload":"x"}`, nil); code != http.StatusBadRequest {
+			t.Errorf("publish to an invalid topic returned %d", code)
+		}
+	}
+	//JSON decoding replaces invalid UTF-8, so it can only reach Inject from Go
+	if _, err := h.Inject(AdminPublish{Topic: "a/\xff"}); err == nil {
+		t.Error("publish to a topic that isn't UTF-8 succeeded")
+	}
+	if pp := readPublish(t, conn, 100*time.Millisecond); pp != nil {
+		t.Errorf("client received %s, a message to an invalid topic shouldn't be routed", pp.TopicName)
+	}
+	if code := adminRequest(t, server, "POST", "/publish", `{"topic":"device/cmd","client":"unknown"}`, nil); code != http.StatusNotFound {
+		t.Errorf("publish to an unknown client returned %d", code)
+	}
+
+	//the device has no subscriptions, the message is sent to its session directly
+	results := make(chan AdminPublishResult, 1)
+	go func() {
+		var result AdminPublishResult
+		adminRequest(t, server, "POST", "/publish", `{"topic":"device/cmd","payload":"reboot","qos":1,"client":"device"}`, &result)
+		results <- result
+	}()
+	pp := readPublish(t, device, time.Second)
+	if pp == nil || pp.TopicName != "device/cmd" || pp.Qos != 1 {
+		t.Fatalf("device received %v, should be the command", pp)
+	}
+	if pp := readPublish(t, conn, 100*time.Millisecond); pp != nil {
+		t.Errorf("subscriber received %s, a message for one client shouldn't be routed", pp.TopicName)
+	}
+	pa := NewControlPacket(PUBACK).(*PubackPacket)
+	pa.MessageID = pp.MessageID
+	pa.Write(device)
+	if result := <-results; !result.Acked {
+		t.Errorf("result is %+v, the device acknowledged the command", result)
+	}
+
+	var result AdminPublishResult
+	adminRequest(t, server, "POST", "/publish", `{"topic":"device/cmd","payload":"reboot","qos":1,"client":"device","ackTimeout":1}`, &result)
+	if result.Acked {
+		t.Errorf("result is %+v, the device didn't acknowledge the command", result)
+	}
+	if n := atomic.LoadInt64(&h.stats.adminPublishes); n != 3 {
+		t.Errorf("%d admin publishes counted, should be 3", n)
+	}
+}
+
+func Test_ClientStats(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.ClientStatsInterval = 50 * time.Millisecond
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	server := httptest.NewServer(h.adminHandler())
+	defer server.Close()
+	conn := connectTestClient(t, h, "stats", false)
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"a/#"}
+	sp.Qoss = []byte{1}
+	sp.Write(conn)
+	ReadPacket(conn)
+	//the client receives its own message, and leaves a QoS 2 message unreleased
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "a/b"
+	pp.Payload = []byte("hello")
+	pp.Qos = 1
+	pp.MessageID = 2
+	pp.Write(conn)
+	for i := 0; i < 2; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		rp, err := ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("failed to read: %s", err.Error())
+		}
+		if received, ok := rp.(*PublishPacket); ok {
+			pa := NewControlPacket(PUBACK).(*PubackPacket)
+			pa.MessageID = received.MessageID
+			pa.Write(conn)
+		}
+	}
+	pp.TopicName = "x"
+	pp.Qos = 2
+	pp.MessageID = 3
+	pp.Write(conn)
+	ReadPacket(conn)
+
+	var info ClientInfo
+	waitFor(t, "PUBACK to be received", func() bool {
+		adminRequest(t, server, "GET", "/clients/stats", "", &info)
+		return info.Inflight == 0
+	})
+	if info.MessagesReceived != 2 || info.MessagesSent != 1 || info.BytesReceived == 0 || info.BytesSent == 0 ||
+		info.InflightInbound != 1 || info.ProtocolVersion != 4 || info.LastPacketAt.IsZero() {
+		t.Errorf("client stats are %+v", info)
+	}
+	if code := adminRequest(t, server, "GET", "/clients/unknown", "", nil); code != http.StatusNotFound {
+		t.Errorf("stats for an unknown client returned %d", code)
+	}
+	waitFor(t, "client stats to be published", func() bool {
+		for _, retained := range h.Retained() {
+			if retained.Topic == "$SYS/broker/clients/stats/inflight/inbound" {
+				return true
+			}
+		}
+		return false
+	})
+
+	//the counts carry on when a durable session reconnects and start again with a clean one
+	reconnect := func(cleanSession bool) {
+		conn.Close()
+		waitFor(t, "client to disconnect", func() bool { return !h.getClient("stats").Connected() })
+		conn = connectTestClient(t, h, "stats", cleanSession)
+		adminRequest(t, server, "GET", "/clients/stats", "", &info)
+	}
+	reconnect(false)
+	if info.MessagesReceived != 2 || info.MessagesSent != 1 || info.InflightInbound != 1 {
+		t.Errorf("client stats after reconnecting are %+v", info)
+	}
+	reconnect(true)
+	defer conn.Close()
+	if info.MessagesReceived != 0 || info.MessagesSent != 0 || info.BytesReceived != 0 || info.InflightInbound != 0 {
+		t.Errorf("client stats after a clean session are %+v", info)
+	}
+}
+
+//failingPersistence is a memory persistence whose ping fails
+type failingPersistence struct {
+	MemoryPersistence
+}
+
+func (p *failingPersistence) Ping() error {
+	return errors.New("unreachable")
+}
+
+func Test_HealthEndpoints(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	server := httptest.NewServer(h.adminHandler())
+	defer server.Close()
+	defer h.Stop()
+
+	//nothing is listening yet
+	var report HealthReport
+	if code := adminRequest(t, server, "GET", "/readyz", "", &report); code != http.StatusServiceUnavailable || report.OK || report.Checks["listeners"] != "no listeners" {
+		t.Errorf("readyz before listening returned %d %+v", code, report)
+	}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	report = HealthReport{}
+	if code := adminRequest(t, server, "GET", "/readyz", "", &report); code != http.StatusOK || !report.OK || report.Checks["recovered"] != "ok" || report.Checks["listener test"] != "ok" {
+		t.Errorf("readyz returned %d %+v", code, report)
+	}
+	//the loopback check can be run again and again
+	for i := 0; i < 3; i++ {
+		report = HealthReport{}
+		if code := adminRequest(t, server, "GET", "/healthz", "", &report); code != http.StatusOK || !report.OK || report.Checks["router"] != "ok" {
+			t.Errorf("healthz returned %d %+v", code, report)
+		}
+	}
+
+	//a listener whose accept loop has stopped fails both
+	h.listeners["test"].ln.Close()
+	waitFor(t, "accept loop to stop", func() bool {
+		return !h.Ready().OK
+	})
+	if health := h.Health(); health.OK || health.Checks["listener test"] != "not accepting connections" {
+		t.Errorf("health with a stopped listener is %+v", health)
+	}
+
+	//as does a persistence that can't be reached
+	failing := NewHrotti(100, &failingPersistence{})
+	defer failing.Stop()
+	if health := failing.Health(); health.OK || health.Checks["persistence"] != "unreachable" || health.Checks["router"] != "ok" {
+		t.Errorf("health with unreachable persistence is %+v", health)
+	}
+}
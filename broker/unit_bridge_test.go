@@ -0,0 +1,308 @@
+package hrotti
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; !cond(); i++ {
+		if i > 200 {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func expectNothing(t *testing.T, c *Client) {
+	select {
+	case msg := <-c.outboundMessages:
+		t.Errorf("%s received unexpected message on %s", c.clientID, msg.TopicName)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func newBridgedBrokers(t *testing.T, topics []*BridgeTopic) (*Hrotti, *Hrotti) {
+	core := NewHrotti(100, &MemoryPersistence{})
+	if err := core.AddListener("core", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start core listener: %s", err.Error())
+	}
+	edge := NewHrotti(100, &MemoryPersistence{})
+	coreURL, _ := url.Parse("tcp://" + core.listeners["core"].ln.Addr().String())
+	if err := edge.AddBridge("core", &BridgeConfig{URL: coreURL, KeepAlive: 30, Topics: topics}); err != nil {
+		t.Fatalf("failed to add bridge: %s", err.Error())
+	}
+	return core, edge
+}
+
+func Test_Bridge(t *testing.T) {
+	core, edge := newBridgedBrokers(t, []*BridgeTopic{
+		{Pattern: "in/#", Direction: BridgeIn},
+		{Pattern: "up/#", Direction: BridgeOut, RemotePrefix: "edge1/"},
+		{Pattern: "both/#", Direction: BridgeBoth},
+	})
+	defer core.Stop()
+	defer edge.Stop()
+	waitFor(t, "bridge to connect", func() bool {
+		status, _ := edge.BridgeStatus("core")
+		return status.SyncComplete
+	})
+
+	coreSub := newTestClient(core, "coreSub")
+	core.AddSub(coreSub, "edge1/up/#", SubscriptionOptions{})
+	core.AddSub(coreSub, "both/#", SubscriptionOptions{})
+	edgeSub := newTestClient(edge, "edgeSub")
+	edge.AddSub(edgeSub, "in/#", SubscriptionOptions{})
+	edge.AddSub(edgeSub, "both/#", SubscriptionOptions{})
+
+	publish(core, "in/1", nil)
+	if msg := receive(t, edgeSub); msg.TopicName != "in/1" {
+		t.Errorf("edge received %s, should be in/1", msg.TopicName)
+	}
+
+	publish(edge, "up/1", nil)
+	if msg := receive(t, coreSub); msg.TopicName != "edge1/up/1" {
+		t.Errorf("core received %s, should be edge1/up/1", msg.TopicName)
+	}
+
+	//a message relayed in either direction must not come back over the bridge
+	publish(core, "both/1", nil)
+	if msg := receive(t, edgeSub); msg.TopicName != "both/1" {
+		t.Errorf("edge received %s, should be both/1", msg.TopicName)
+	}
+	if msg := receive(t, coreSub); msg.TopicName != "both/1" {
+		t.Errorf("core received %s, should be both/1", msg.TopicName)
+	}
+	publish(edge, "both/2", nil)
+	if msg := receive(t, edgeSub); msg.TopicName != "both/2" {
+		t.Errorf("edge received %s, should be both/2", msg.TopicName)
+	}
+	if msg := receive(t, coreSub); msg.TopicName != "both/2" {
+		t.Errorf("core received %s, should be both/2", msg.TopicName)
+	}
+	expectNothing(t, edgeSub)
+	expectNothing(t, coreSub)
+}
+
+func Test_BridgeRetainedSync(t *testing.T) {
+	core := NewHrotti(100, &MemoryPersistence{})
+	if err := core.AddListener("core", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start core listener: %s", err.Error())
+	}
+	defer core.Stop()
+	for _, topic := range []string{"catalog/1", "catalog/2", "catalog/3", "other/1"} {
+		setRetained(core, topic, topic)
+	}
+
+	edge := NewHrotti(100, &MemoryPersistence{})
+	defer edge.Stop()
+	coreURL, _ := url.Parse("tcp://" + core.listeners["core"].ln.Addr().String())
+	edge.AddBridge("core", &BridgeConfig{URL: coreURL, Topics: []*BridgeTopic{{Pattern: "catalog/#", Direction: BridgeBoth}}})
+	waitFor(t, "retained sync", func() bool {
+		status, _ := edge.BridgeStatus("core")
+		return status.SyncComplete
+	})
+
+	status, _ := edge.BridgeStatus("core")
+	if status.SyncCount != 3 || status.SyncCursor != "catalog/3" {
+		t.Errorf("bridge status is %+v, should have synced 3 messages to cursor catalog/3", status)
+	}
+	for _, topic := range []string{"catalog/1", "catalog/2", "catalog/3"} {
+		if msg := edge.retainedMessage(topic); msg == nil || string(msg.Payload) != topic {
+			t.Errorf("edge does not have the retained message for %s", topic)
+		}
+	}
+	if msg := edge.retainedMessage("other/1"); msg != nil {
+		t.Errorf("edge has a retained message for other/1 which it did not ask for")
+	}
+
+	//synced messages are not sent back to the core
+	coreSub := newTestClient(core, "coreSub")
+	core.AddSub(coreSub, "catalog/+", SubscriptionOptions{})
+	for i := 0; i < 3; i++ {
+		receive(t, coreSub)
+	}
+	expectNothing(t, coreSub)
+}
+
+func Test_BridgeRing(t *testing.T) {
+	//three brokers each bridged to the next, so every message has two ways round the ring
+	var brokers []*Hrotti
+	for _, name := range []string{"a", "b", "c"} {
+		h := NewHrotti(100, &MemoryPersistence{})
+		if err := h.AddListener("ring", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+			t.Fatalf("failed to start listener %s: %s", name, err.Error())
+		}
+		defer h.Stop()
+		brokers = append(brokers, h)
+	}
+	for i, name := range []string{"a", "b", "c"} {
+		nextURL, _ := url.Parse("tcp://" + brokers[(i+1)%3].listeners["ring"].ln.Addr().String())
+		config := &BridgeConfig{URL: nextURL, ClientID: "bridge-" + name, KeepAlive: 30, Topics: []*BridgeTopic{{Pattern: "ring/#", Direction: BridgeBoth, Qos: 1}}}
+		//one bridge connects as mosquitto would with MQTT 3.1
+		if name == "c" {
+			config.ProtocolVersion = 3
+		}
+		if err := brokers[i].AddBridge("next", config); err != nil {
+			t.Fatalf("failed to add bridge: %s", err.Error())
+		}
+	}
+	var subs []*Client
+	for i, h := range brokers {
+		waitFor(t, "bridge to connect", func() bool {
+			status, _ := h.BridgeStatus("next")
+			return status.SyncComplete
+		})
+		sub := newTestClient(h, "sub")
+		h.AddSub(sub, "ring/#", SubscriptionOptions{Qos: 1})
+		subs = append(subs, sub)
+		if i == 0 {
+			if info, _ := h.Client("bridge-c"); info.ProtocolVersion != 0x83 {
+				t.Errorf("bridge from c connected with protocol version %#x, should be 0x83", info.ProtocolVersion)
+			}
+		}
+	}
+
+	publish(brokers[0], "ring/1", nil)
+	for _, sub := range subs {
+		if msg := receive(t, sub); msg.TopicName != "ring/1" {
+			t.Errorf("received %s, should be ring/1", msg.TopicName)
+		}
+	}
+	for _, sub := range subs {
+		expectNothing(t, sub)
+	}
+}
+
+//acceptBridge accepts the bridge's next connection to a remote broker played by the test
+//and answers its CONNECT
+func acceptBridge(t *testing.T, ln net.Listener) net.Conn {
+	t.Helper()
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("bridge didn't connect: %s", err.Error())
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ReadPacket(conn); err != nil {
+		t.Fatalf("no CONNECT from the bridge: %s", err.Error())
+	}
+	NewControlPacket(CONNACK).Write(conn)
+	return conn
+}
+
+//The remote broker playing the other end of the bridge loses the connection before it
+//acknowledges a message, and sends a QoS 2 message twice
+func Test_BridgeRedelivery(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	defer ln.Close()
+	edge := NewHrotti(100, &MemoryPersistence{})
+	defer edge.Stop()
+	remoteURL, _ := url.Parse("tcp://" + ln.Addr().String())
+	err = edge.AddBridge("remote", &BridgeConfig{URL: remoteURL, SkipRetainedSync: true, Topics: []*BridgeTopic{
+		{Pattern: "up/#", Direction: BridgeOut, Qos: 2},
+		{Pattern: "down/#", Direction: BridgeIn, Qos: 2},
+	}})
+	if err != nil {
+		t.Fatalf("failed to add bridge: %s", err.Error())
+	}
+	b := edge.bridges["remote"]
+	edgeSub := newTestClient(edge, "edgeSub")
+	edge.AddSub(edgeSub, "down/#", SubscriptionOptions{Qos: 2})
+
+	conn := acceptBridge(t, ln)
+	if rp, err := ReadPacket(conn); err != nil || rp.Type() != SUBSCRIBE {
+		t.Fatalf("bridge sent %v, should be a SUBSCRIBE", rp)
+	}
+	edge.Publish("up/1", []byte("once"), 1, false)
+	edge.Publish("up/2", []byte("twice"), 2, false)
+	var sent []*PublishPacket
+	for len(sent) < 2 {
+		rp, err := ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("message not forwarded: %s", err.Error())
+		}
+		sent = append(sent, rp.(*PublishPacket))
+	}
+	pr := NewControlPacket(PUBREC).(*PubrecPacket)
+	pr.MessageID = sent[1].MessageID
+	pr.Write(conn)
+	if rp, err := ReadPacket(conn); err != nil || rp.(*PubrelPacket).MessageID != sent[1].MessageID {
+		t.Fatalf("PUBREC answered with %v, should be a PUBREL for %d", rp, sent[1].MessageID)
+	}
+	conn.Close()
+
+	//the unacknowledged messages are resent in order when the bridge reconnects, the one the
+	//remote broker has received by its PUBREL
+	conn = acceptBridge(t, ln)
+	defer conn.Close()
+	rp, err := ReadPacket(conn)
+	if pp, ok := rp.(*PublishPacket); err != nil || !ok || !pp.Dup || pp.MessageID != sent[0].MessageID || string(pp.Payload) != "once" {
+		t.Fatalf("bridge resent %v, should be once with DUP set and id %d", rp, sent[0].MessageID)
+	}
+	if rp, err = ReadPacket(conn); err != nil || rp.(*PubrelPacket).MessageID != sent[1].MessageID {
+		t.Fatalf("bridge resent %v, should be a PUBREL for %d", rp, sent[1].MessageID)
+	}
+	rp, err = ReadPacket(conn)
+	sp, ok := rp.(*SubscribePacket)
+	if err != nil || !ok {
+		t.Fatalf("bridge sent %v, should be a SUBSCRIBE", rp)
+	}
+	pa := NewControlPacket(PUBACK).(*PubackPacket)
+	pa.MessageID = sent[0].MessageID
+	pa.Write(conn)
+	pc := NewControlPacket(PUBCOMP).(*PubcompPacket)
+	pc.MessageID = sent[1].MessageID
+	pc.Write(conn)
+	sa := NewControlPacket(SUBACK).(*SubackPacket)
+	sa.MessageID = sp.MessageID
+	sa.GrantedQoss = []byte{2}
+	sa.Write(conn)
+	//the id of the SUBSCRIBE the first connection didn't answer was freed too
+	waitFor(t, "the acknowledgements to free the message ids", func() bool {
+		persisted := 0
+		edge.PersistStore.RangeInflight(b.local.clientID, func(dirFlag, uint16, ControlPacket) bool {
+			persisted++
+			return true
+		})
+		return b.local.inflight() == 0 && persisted == 0
+	})
+
+	//a QoS 2 message the remote broker sends again before releasing it is only published once
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "down/1"
+	pp.Payload = []byte("exactly once")
+	pp.Qos = 2
+	pp.MessageID = 7
+	for dup := 0; dup < 2; dup++ {
+		pp.Dup = dup == 1
+		pp.Write(conn)
+		if rp, err := ReadPacket(conn); err != nil || rp.(*PubrecPacket).MessageID != 7 {
+			t.Fatalf("QoS 2 message answered with %v, should be a PUBREC for 7", rp)
+		}
+	}
+	if msg := receive(t, edgeSub); string(msg.Payload) != "exactly once" {
+		t.Errorf("edge received %s, should be exactly once", msg.Payload)
+	}
+	expectNothing(t, edgeSub)
+	prel := NewControlPacket(PUBREL).(*PubrelPacket)
+	prel.MessageID = 7
+	prel.Write(conn)
+	if rp, err := ReadPacket(conn); err != nil || rp.(*PubcompPacket).MessageID != 7 {
+		t.Fatalf("PUBREL answered with %v, should be a PUBCOMP for 7", rp)
+	}
+	//once released the id is a new message
+	pp.Dup = false
+	pp.Payload = []byte("again")
+	pp.Write(conn)
+	if msg := receive(t, edgeSub); string(msg.Payload) != "again" {
+		t.Errorf("edge received %s, should be again", msg.Payload)
+	}
+}
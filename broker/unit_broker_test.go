@@ -0,0 +1,186 @@
+package hrotti
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+	"golang.org/x/net/websocket"
+)
+
+//brokerConnect connects to the listener called name of b, over a WebSocket for "ws", as
+//id with username, and returns the connection and the CONNACK return code
+func brokerConnect(t *testing.T, b *Broker, name string, id string, username string) (net.Conn, byte) {
+	addr := b.Addr(name).String()
+	var conn net.Conn
+	if name == "ws" {
+		ws, err := websocket.Dial("ws://"+addr+"/mqtt", "mqtt", "http://"+addr)
+		if err != nil {
+			t.Fatalf("failed to connect to %s: %s", addr, err.Error())
+		}
+		ws.PayloadType = websocket.BinaryFrame
+		conn = ws
+	} else {
+		var err error
+		if conn, err = net.Dial("tcp", addr); err != nil {
+			t.Fatalf("failed to connect to %s: %s", addr, err.Error())
+		}
+	}
+	cp := newConnect(id)
+	cp.UsernameFlag, cp.Username = true, username
+	cp.PasswordFlag, cp.Password = true, []byte("password")
+	cp.Write(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	rp, err := ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("no CONNACK from %s: %s", addr, err.Error())
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn, rp.(*ConnackPacket).ReturnCode
+}
+
+func Test_TwoBrokers(t *testing.T) {
+	var brokers []*Broker
+	for _, user := range []string{"first", "second"} {
+		b := NewBroker(
+			WithListener("tcp", NewListenerConfig("tcp://127.0.0.1:0")),
+			WithListener("ws", NewListenerConfig("ws://127.0.0.1:0/mqtt")),
+			WithAuth(&Auth{Users: map[string]string{user: "password"}}),
+		)
+		if err := b.Start(); err != nil {
+			t.Fatalf("%s broker failed to start: %s", user, err.Error())
+		}
+		defer b.Stop(context.Background())
+		b.Hrotti().Publish("status", []byte(user), 0, true)
+		brokers = append(brokers, b)
+	}
+
+	for i, user := range []string{"first", "second"} {
+		conn, rc := brokerConnect(t, brokers[i], "ws", "subscriber", user)
+		if rc != CONN_ACCEPTED {
+			t.Fatalf("%s was refused by its own broker", user)
+		}
+		sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+		sp.MessageID = 1
+		sp.Topics = []string{"status"}
+		sp.Qoss = []byte{0}
+		sp.Write(conn)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for received := false; !received; {
+			rp, err := ReadPacket(conn)
+			if err != nil {
+				t.Fatalf("%s's broker didn't send its retained message: %s", user, err.Error())
+			}
+			if msg, ok := rp.(*PublishPacket); ok {
+				if string(msg.Payload) != user {
+					t.Errorf("%s's broker sent the retained message %q", user, msg.Payload)
+				}
+				received = true
+			}
+		}
+		conn.Close()
+
+		other := brokers[1-i]
+		conn, rc = brokerConnect(t, other, "tcp", "stranger", user)
+		if rc != CONN_REF_BAD_USER_PASS {
+			t.Errorf("%s connecting to the other broker got return code %d", user, rc)
+		}
+		conn.Close()
+	}
+
+	//stopping one broker leaves the other running
+	brokers[0].Stop(context.Background())
+	conn, rc := brokerConnect(t, brokers[1], "tcp", "after", "second")
+	if rc != CONN_ACCEPTED {
+		t.Errorf("second broker refused a client after the first stopped")
+	}
+	conn.Close()
+}
+
+//brokerLog returns what b has logged to buf
+func brokerLog(b *Broker, buf *bytes.Buffer) string {
+	b.hrotti.output.Lock()
+	defer b.hrotti.output.Unlock()
+	return buf.String()
+}
+
+func Test_BrokerLogging(t *testing.T) {
+	var logs [2]bytes.Buffer
+	var brokers [2]*Broker
+	names := []string{"first", "second"}
+	for i, level := range []LogLevel{LogDebug, LogInfo} {
+		brokers[i] = NewBroker(
+			WithListener(names[i], NewListenerConfig("tcp://127.0.0.1:0")),
+			WithLogOutput(&logs[i], false),
+			WithLogLevel("", level),
+		)
+		if err := brokers[i].Start(); err != nil {
+			t.Fatalf("broker %d failed to start: %s", i, err.Error())
+		}
+		defer brokers[i].Stop(context.Background())
+	}
+	//changing the second broker's levels, as a reload does, leaves the first's alone
+	brokers[1].Hrotti().SetLogLevel("session", LogOff)
+	for i, b := range brokers {
+		conn, _ := brokerConnect(t, b, names[i], "client", "user")
+		conn.Close()
+	}
+
+	for i, b := range brokers {
+		logged := brokerLog(b, &logs[i])
+		if !strings.Contains(logged, "listener="+names[i]) {
+			t.Errorf("%s broker didn't log starting its listener: %q", names[i], logged)
+		}
+		if strings.Contains(logged, "listener="+names[1-i]) {
+			t.Errorf("%s broker logged the other broker's listener: %q", names[i], logged)
+		}
+	}
+	if logged := brokerLog(brokers[0], &logs[0]); !strings.Contains(logged, "New incoming connection") || !strings.Contains(logged, "Client connected") {
+		t.Errorf("first broker didn't log at debug: %q", logged)
+	}
+	if logged := brokerLog(brokers[1], &logs[1]); strings.Contains(logged, "New incoming connection") || strings.Contains(logged, "Client connected") {
+		t.Errorf("second broker logged below its levels: %q", logged)
+	}
+	if defaultLoggers.sessionLog.enabled(LogDebug) || !defaultLoggers.sessionLog.enabled(LogInfo) {
+		t.Errorf("the brokers' levels changed the default levels")
+	}
+
+	b := NewBroker(WithLogLevel("nothing", LogDebug))
+	if err := b.Start(); err == nil {
+		t.Errorf("broker started with a level for an unknown log component")
+	}
+}
+
+func Test_BrokerStartFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	defer taken.Close()
+	b := NewBroker(
+		WithListener("first", NewListenerConfig("tcp://127.0.0.1:0")),
+		WithListener("second", NewListenerConfig("tcp://"+taken.Addr().String())),
+	)
+	if err := b.Start(); err == nil {
+		t.Fatalf("broker started with a listener on an address in use")
+	}
+	if _, err := net.Dial("tcp", b.Addr("first").String()); err == nil {
+		t.Errorf("first listener is still running after the broker failed to start")
+	}
+	if err := b.Start(); err == nil {
+		t.Errorf("second Start didn't return the error")
+	}
+	if err := b.Stop(context.Background()); err != nil {
+		t.Errorf("Stop of a broker that failed to start returned %s", err.Error())
+	}
+
+	b = NewBroker()
+	b.Stop(context.Background())
+	if err := b.Start(); err == nil {
+		t.Errorf("stopped broker started")
+	}
+}
@@ -0,0 +1,1011 @@
+package hrotti
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+func newPipeClient(h *Hrotti, id string, maxQDepth int) (*Client, net.Conn) {
+	server, client := net.Pipe()
+	c := newClient(server, id, maxQDepth)
+	c.state.SetValue(CONNECTED)
+	h.clients.list[id] = c
+	return c, client
+}
+
+func Test_SlowConsumerDrop(t *testing.T) {
+	h := NewHrotti(1, &MemoryPersistence{})
+	c, _ := newPipeClient(h, "slow", 1)
+	h.AddSub(c, "a/#", SubscriptionOptions{})
+
+	for i := 0; i < 5; i++ {
+		publish(h, "a/b", nil)
+	}
+	if c.queueDepth() != 1 {
+		t.Errorf("queue depth is %d, should be 1", c.queueDepth())
+	}
+	if dropped := atomic.LoadInt64(&c.dropped); dropped != 4 {
+		t.Errorf("client dropped count is %d, should be 4", dropped)
+	}
+	if dropped := atomic.LoadInt64(&h.stats.publishMessagesDropped); dropped != 4 {
+		t.Errorf("broker dropped count is %d, should be 4", dropped)
+	}
+	if !c.Connected() {
+		t.Errorf("client was disconnected with the drop policy")
+	}
+}
+
+func Test_SlowConsumerDisconnect(t *testing.T) {
+	h := NewHrotti(1, &MemoryPersistence{})
+	h.SlowConsumerPolicy = DisconnectSlowConsumer
+	h.SlowConsumerGrace = 50 * time.Millisecond
+	c, _ := newPipeClient(h, "slow", 1)
+	h.AddSub(c, "a/#", SubscriptionOptions{})
+
+	publish(h, "a/b", nil)
+	publish(h, "a/b", nil)
+	if !c.Connected() {
+		t.Fatalf("client was disconnected before the grace period")
+	}
+	time.Sleep(100 * time.Millisecond)
+	publish(h, "a/b", nil)
+	for i := 0; c.Connected(); i++ {
+		if i > 100 {
+			t.Fatalf("slow consumer was not disconnected after the grace period")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//expectClosed checks the broker closes conn without sending anything
+func expectClosed(t *testing.T, conn net.Conn, what string) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if rp, err := ReadPacket(conn); err == nil {
+		t.Errorf("%s: received %v, connection should have been closed", what, rp)
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Errorf("%s: connection was not closed", what)
+	}
+}
+
+func Test_ConnectDeadline(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.ConnectTimeout = 100 * time.Millisecond
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	addr := h.listeners["test"].ln.Addr().String()
+
+	idle, _ := net.Dial("tcp", addr)
+	defer idle.Close()
+	expectClosed(t, idle, "idle connection")
+
+	notConnect, _ := net.Dial("tcp", addr)
+	defer notConnect.Close()
+	NewControlPacket(PINGREQ).Write(notConnect)
+	expectClosed(t, notConnect, "PINGREQ before CONNECT")
+
+	//a connected client isn't subject to the deadline
+	conn := connectTestClient(t, h, "deadline", true)
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	NewControlPacket(PINGREQ).Write(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if rp, err := ReadPacket(conn); err != nil || rp.Type() != PINGRESP {
+		t.Fatalf("connected client received %v %v, should be a PINGRESP", rp, err)
+	}
+
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.ClientIdentifier = "deadline"
+	cp.Write(conn)
+	expectClosed(t, conn, "second CONNECT")
+}
+
+func Test_KeepAliveLimits(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.MaxKeepAlive = 2
+	h.MinKeepAlive = 2
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	addr := h.listeners["test"].ln.Addr().String()
+	connect := func(id string, keepAlive uint16) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect: %s", err.Error())
+		}
+		cp := NewControlPacket(CONNECT).(*ConnectPacket)
+		cp.ProtocolName = "MQTT"
+		cp.ProtocolVersion = 4
+		cp.CleanSession = true
+		cp.KeepaliveTimer = keepAlive
+		cp.ClientIdentifier = id
+		cp.Write(conn)
+		rp, err := ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("client %s did not receive a CONNACK", id)
+		}
+		return conn, rp.(*ConnackPacket).ReturnCode
+	}
+
+	if conn, rc := connect("storm", 1); rc != CONN_REF_NOT_AUTH {
+		t.Errorf("client with keepalive 1 got return code %d, should be refused", rc)
+		conn.Close()
+	}
+	//no keepalive and the longest possible are both cut to the maximum
+	conns := make(map[string]net.Conn)
+	for id, keepAlive := range map[string]uint16{"forever": 0, "longest": 65535} {
+		conn, rc := connect(id, keepAlive)
+		defer conn.Close()
+		if rc != CONN_ACCEPTED {
+			t.Fatalf("client with keepalive %d was refused", keepAlive)
+		}
+		conns[id] = conn
+		waitFor(t, "client to start", func() bool { info, ok := h.Client(id); return ok && info.Connected })
+		if info, _ := h.Client(id); info.KeepAlive != 2 || info.ClientKeepAlive != keepAlive {
+			t.Errorf("client has keepalive %d asking for %d, should be 2 asking for %d", info.KeepAlive, info.ClientKeepAlive, keepAlive)
+		}
+	}
+	for id, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := ReadPacket(conn); err == nil {
+			t.Errorf("%s received a packet, should have been disconnected", id)
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Errorf("%s wasn't disconnected after the maximum keepalive", id)
+		}
+	}
+}
+
+func Test_DuplicateQos2(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub := newTestClient(h, "sub")
+	h.AddSub(sub, "q/#", SubscriptionOptions{Qos: 2})
+	conn := connectTestClient(t, h, "pub", true)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "q/1"
+	pp.Qos = 2
+	pp.MessageID = 7
+	pp.Payload = []byte("once")
+	for i := 0; i < 3; i++ {
+		pp.Dup = i > 0
+		pp.Write(conn)
+		if rp, err := ReadPacket(conn); err != nil || rp.Type() != PUBREC || rp.Details().MessageID != 7 {
+			t.Fatalf("publish %d received %v %v, should be a PUBREC for 7", i, rp, err)
+		}
+	}
+	receive(t, sub)
+	expectNothing(t, sub)
+
+	//once released the message id can be used for a new message
+	prel := NewControlPacket(PUBREL).(*PubrelPacket)
+	prel.MessageID = 7
+	prel.Write(conn)
+	if rp, err := ReadPacket(conn); err != nil || rp.Type() != PUBCOMP || rp.Details().MessageID != 7 {
+		t.Fatalf("received %v %v, should be a PUBCOMP for 7", rp, err)
+	}
+	pp.Dup = false
+	pp.Payload = []byte("again")
+	pp.Write(conn)
+	ReadPacket(conn)
+	if msg := receive(t, sub); string(msg.Payload) != "again" {
+		t.Errorf("received %s, should be the new message for the reused id", msg.Payload)
+	}
+}
+
+func Test_DuplicateQos1(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub := newTestClient(h, "sub")
+	h.AddSub(sub, "q/#", SubscriptionOptions{Qos: 1})
+	conn := connectTestClient(t, h, "pub", true)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	//the message is resent with Dup set before the PUBACK for it is read, as if it was lost
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "q/1"
+	pp.Qos = 1
+	pp.MessageID = 3
+	pp.Payload = []byte("once")
+	pp.Write(conn)
+	pp.Dup = true
+	pp.Write(conn)
+	for i := 0; i < 2; i++ {
+		if rp, err := ReadPacket(conn); err != nil || rp.Type() != PUBACK || rp.Details().MessageID != 3 {
+			t.Fatalf("publish %d received %v %v, should be a PUBACK for 3", i, rp, err)
+		}
+	}
+	receive(t, sub)
+	expectNothing(t, sub)
+
+	//the id can be used for a new message once acknowledged
+	pp.Dup = false
+	pp.Payload = []byte("again")
+	pp.Write(conn)
+	ReadPacket(conn)
+	if msg := receive(t, sub); string(msg.Payload) != "again" {
+		t.Errorf("received %s, should be the new message for the reused id", msg.Payload)
+	}
+
+	//once the id has left the window a resent message is delivered again
+	for id := uint16(100); id < 100+defaultDuplicateWindow; id++ {
+		pp.MessageID = id
+		pp.Write(conn)
+		ReadPacket(conn)
+		receive(t, sub)
+	}
+	pp.MessageID = 3
+	pp.Dup = true
+	pp.Write(conn)
+	ReadPacket(conn)
+	if msg := receive(t, sub); string(msg.Payload) != "again" {
+		t.Errorf("received %s, a message resent after leaving the window should be delivered", msg.Payload)
+	}
+}
+
+func Test_DeliverTooLarge(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub := dialTestClient(t, h, "sub", "big/#")
+	defer sub.Close()
+
+	//a message too large to encode is dropped, the payload is never read so its pages
+	//aren't touched
+	big := NewControlPacket(PUBLISH).(*PublishPacket)
+	big.TopicName = "big/1"
+	big.Qos = 1
+	big.Payload = make([]byte, MaxRemainingLength)
+	h.DeliverMessage(big.TopicName, big, nil)
+	//as is one whose topic's length doesn't fit in its 2 byte length
+	long := NewControlPacket(PUBLISH).(*PublishPacket)
+	long.TopicName = "big/" + strings.Repeat("x", MaxFieldLength)
+	long.Qos = 1
+	long.Payload = []byte("wraps")
+	h.DeliverMessage(long.TopicName, long, nil)
+	small := NewControlPacket(PUBLISH).(*PublishPacket)
+	small.TopicName = "big/2"
+	small.Qos = 1
+	small.Payload = []byte("fits")
+	h.DeliverMessage(small.TopicName, small, nil)
+
+	//the connection is still in step and only the message that was sent is inflight
+	received := readPublish(t, sub, time.Second)
+	if received == nil || received.TopicName != "big/2" || string(received.Payload) != "fits" {
+		t.Fatalf("subscriber received %v, should be the message on big/2", received)
+	}
+	if inflight := countInflight(h.PersistStore, "sub"); inflight != 1 {
+		t.Errorf("%d messages are inflight, the oversized ones should have been removed", inflight)
+	}
+	if dropped := atomic.LoadInt64(&h.stats.discarded[DropTooLarge]); dropped != 2 {
+		t.Errorf("%d messages were dropped as too large, should be 2", dropped)
+	}
+	pa := NewControlPacket(PUBACK).(*PubackPacket)
+	pa.MessageID = received.MessageID
+	pa.Write(sub)
+	waitFor(t, "the acknowledged message to be removed", func() bool { return countInflight(h.PersistStore, "sub") == 0 })
+}
+
+func Test_ReceiveMaximum(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.ReceiveMaximum = 2
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	conn := connectTestClient(t, h, "pub", true)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	publishQos2 := func(id uint16) {
+		pp := NewControlPacket(PUBLISH).(*PublishPacket)
+		pp.TopicName = "q/1"
+		pp.Qos = 2
+		pp.MessageID = id
+		pp.Write(conn)
+	}
+	publishQos2(1)
+	publishQos2(2)
+	for i := 0; i < 2; i++ {
+		if rp, err := ReadPacket(conn); err != nil || rp.Type() != PUBREC {
+			t.Fatalf("received %v %v, should be a PUBREC", rp, err)
+		}
+	}
+	//releasing a message makes room for another
+	prel := NewControlPacket(PUBREL).(*PubrelPacket)
+	prel.MessageID = 1
+	prel.Write(conn)
+	if rp, err := ReadPacket(conn); err != nil || rp.Type() != PUBCOMP {
+		t.Fatalf("received %v %v, should be a PUBCOMP", rp, err)
+	}
+	publishQos2(3)
+	if rp, err := ReadPacket(conn); err != nil || rp.Type() != PUBREC {
+		t.Fatalf("received %v %v, should be a PUBREC", rp, err)
+	}
+	publishQos2(4)
+	expectClosed(t, conn, "client over its receive maximum")
+}
+
+//a client isn't read from while ReceiveMaximum acknowledgements are waiting to be written
+func Test_ReceiveMaximumBackpressure(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.ReceiveMaximum = 2
+	c, _ := newPipeClient(h, "pub", 100)
+	for i := uint16(1); i <= 2; i++ {
+		pa := NewControlPacket(PUBACK).(*PubackPacket)
+		pa.MessageID = i
+		c.HandleFlow(pa, h)
+	}
+	waited := make(chan bool)
+	go func() { waited <- c.waitToReceive(h) }()
+	select {
+	case <-waited:
+		t.Fatalf("didn't wait with 2 acknowledgements queued")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-c.outboundPriority
+	c.ackSent()
+	select {
+	case ok := <-waited:
+		if !ok {
+			t.Errorf("waitToReceive returned false for a running client")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("still waiting after an acknowledgement was written")
+	}
+}
+
+func Test_OrderedDelivery(t *testing.T) {
+	h := NewHrotti(1000, &MemoryPersistence{})
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	const count = 300
+
+	sub := connectTestClient(t, h, "ordered", false)
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"seq"}
+	sp.Qoss = []byte{1}
+	sp.Write(sub)
+	ReadPacket(sub)
+	sub.Close()
+
+	//publish a numbered sequence from a client while the subscriber keeps reconnecting
+	pub := connectTestClient(t, h, "publisher", true)
+	defer pub.Close()
+	go func() {
+		for {
+			if _, err := ReadPacket(pub); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for i := 1; i <= count; i++ {
+			pp := NewControlPacket(PUBLISH).(*PublishPacket)
+			pp.TopicName = "seq"
+			pp.Qos = 1
+			pp.MessageID = uint16(i)
+			pp.Payload = []byte(strconv.Itoa(i))
+			pp.Write(pub)
+			if i%20 == 0 {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+	}()
+
+	//each connection reads a few messages, leaving every third unacknowledged, and drops.
+	//The unacknowledged messages are resent first when it reconnects, then the ones
+	//queued while it was away, then new ones, so each connection sees the sequence in order.
+	acked := make(map[int]bool)
+	for connection := 1; len(acked) < count; connection++ {
+		if connection > 100 {
+			t.Fatalf("only %d of %d messages acknowledged", len(acked), count)
+		}
+		waitFor(t, "subscriber to disconnect", func() bool {
+			return !h.getClient("ordered").Connected()
+		})
+		sub = connectTestClient(t, h, "ordered", false)
+		last := 0
+		for read := 0; read < 40; read++ {
+			sub.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			rp, err := ReadPacket(sub)
+			if err != nil {
+				break
+			}
+			pp := rp.(*PublishPacket)
+			n, _ := strconv.Atoi(string(pp.Payload))
+			if n <= last {
+				t.Fatalf("connection %d received %d after %d", connection, n, last)
+			}
+			//an ack written just before the connection drops may never be read by the broker, so
+			//the message can be resent but only as a duplicate
+			if acked[n] && !pp.Dup {
+				t.Fatalf("connection %d received %d which was already acknowledged", connection, n)
+			}
+			last = n
+			if read%3 != 2 {
+				pa := NewControlPacket(PUBACK).(*PubackPacket)
+				pa.MessageID = pp.MessageID
+				pa.Write(sub)
+				acked[n] = true
+			}
+		}
+		sub.Close()
+	}
+}
+
+func Test_Auth(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	//passwords are binary, they can be kept as they are or hashed
+	binary := "\x00se\xffcret\x00"
+	h.Auth = &Auth{Users: map[string]string{"user": "secret", "binary": binary, "hashed": HashPassword([]byte(binary))}}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+
+	for _, test := range []struct {
+		username string
+		password string
+		rc       byte
+	}{
+		{"user", "secret", CONN_ACCEPTED},
+		{"user", "wrong", CONN_REF_BAD_USER_PASS},
+		{"unknown", "secret", CONN_REF_BAD_USER_PASS},
+		{"binary", binary, CONN_ACCEPTED},
+		{"binary", "\x00se\xffcret", CONN_REF_BAD_USER_PASS},
+		{"hashed", binary, CONN_ACCEPTED},
+		{"hashed", "\x00se\xfecret\x00", CONN_REF_BAD_USER_PASS},
+		{"", "", CONN_REF_NOT_AUTH},
+	} {
+		conn, _ := net.Dial("tcp", h.listeners["test"].ln.Addr().String())
+		cp := NewControlPacket(CONNECT).(*ConnectPacket)
+		cp.ProtocolName = "MQTT"
+		cp.ProtocolVersion = 4
+		cp.CleanSession = true
+		cp.ClientIdentifier = "auth"
+		if test.username != "" {
+			cp.UsernameFlag = true
+			cp.Username = test.username
+			cp.PasswordFlag = true
+			cp.Password = []byte(test.password)
+		}
+		cp.Write(conn)
+		rp, err := ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("no CONNACK for %q: %s", test.username, err.Error())
+		}
+		if rc := rp.(*ConnackPacket).ReturnCode; rc != test.rc {
+			t.Errorf("CONNACK for %q/%q is %d, should be %d", test.username, test.password, rc, test.rc)
+		}
+		conn.Close()
+	}
+}
+
+func Test_AuthBans(t *testing.T) {
+	//only failures within the window count, and the least recently failing address is
+	//forgotten to make room for another
+	bans := newAuthBans()
+	start := time.Now()
+	for i, at := range []time.Duration{0, 30 * time.Second, 70 * time.Second, 80 * time.Second} {
+		if banned := bans.failed("10.0.0.1", start.Add(at), 3, time.Minute, time.Minute, 2); banned != (i == 3) {
+			t.Errorf("failure %d banned %t", i, banned)
+		}
+	}
+	if !bans.banned("10.0.0.1", start.Add(90*time.Second)) || bans.banned("10.0.0.1", start.Add(140*time.Second)) {
+		t.Errorf("ban should last from 80 seconds to 140 seconds")
+	}
+	bans.failed("10.0.0.2", start, 2, time.Minute, time.Minute, 2)
+	bans.failed("10.0.0.3", start, 2, time.Minute, time.Minute, 2)
+	bans.failed("10.0.0.4", start, 2, time.Minute, time.Minute, 2)
+	if bans.failed("10.0.0.2", start, 2, time.Minute, time.Minute, 2) {
+		t.Errorf("10.0.0.2 was banned, its first failure should have been forgotten")
+	}
+
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.Auth = &Auth{Users: map[string]string{"user": "secret"}}
+	h.BanAuthFailures = 3
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	server := httptest.NewServer(h.adminHandler())
+	defer server.Close()
+	connect := func(password string) net.Conn {
+		conn, err := net.Dial("tcp", h.listeners["test"].ln.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %s", err.Error())
+		}
+		cp := NewControlPacket(CONNECT).(*ConnectPacket)
+		cp.ProtocolName = "MQTT"
+		cp.ProtocolVersion = 4
+		cp.CleanSession = true
+		cp.ClientIdentifier = "stuffer"
+		cp.UsernameFlag = true
+		cp.Username = "user"
+		cp.PasswordFlag = true
+		cp.Password = []byte(password)
+		cp.Write(conn)
+		return conn
+	}
+	for i := 0; i < 3; i++ {
+		conn := connect("guess" + strconv.Itoa(i))
+		if rp, err := ReadPacket(conn); err != nil || rp.(*ConnackPacket).ReturnCode != CONN_REF_BAD_USER_PASS {
+			t.Fatalf("attempt %d received %v %v, should be refused for bad credentials", i, rp, err)
+		}
+		conn.Close()
+	}
+	//the right password doesn't help once the address is banned
+	conn := connect("secret")
+	expectClosed(t, conn, "connection from a banned address")
+	conn.Close()
+	if banned := atomic.LoadInt64(&h.stats.connectionsBanned); banned != 1 {
+		t.Errorf("%d connections counted as banned, should be 1", banned)
+	}
+	var listed []BanInfo
+	adminRequest(t, server, "GET", "/bans", "", &listed)
+	if len(listed) != 1 || listed[0].IP != "127.0.0.1" || listed[0].Failures != 3 {
+		t.Fatalf("bans are %+v, should be 127.0.0.1 after 3 failures", listed)
+	}
+	var cleared AdminBansCleared
+	adminRequest(t, server, "DELETE", "/bans?ip=127.0.0.1", "", &cleared)
+	if cleared.Cleared != 1 {
+		t.Errorf("%d bans were cleared, should be 1", cleared.Cleared)
+	}
+	conn = connect("secret")
+	defer conn.Close()
+	if rp, err := ReadPacket(conn); err != nil || rp.(*ConnackPacket).ReturnCode != CONN_ACCEPTED {
+		t.Errorf("received %v %v after the ban was lifted, should be accepted", rp, err)
+	}
+}
+
+func Test_HashPassword(t *testing.T) {
+	//the PBKDF2-HMAC-SHA256 test vector from RFC 7914
+	expected, _ := hex.DecodeString("55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783")
+	if key := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64); !bytes.Equal(key, expected) {
+		t.Errorf("pbkdf2 key is %x, should be %x", key, expected)
+	}
+	hash := HashPassword([]byte("secret"))
+	if hash == HashPassword([]byte("secret")) {
+		t.Errorf("hashes of the same password should have different salts")
+	}
+	for stored, ok := range map[string]bool{
+		hash:                        true,
+		hash[:len(hash)-2]:          false,
+		"pbkdf2-sha256$1$c2FsdA$":   false,
+		"pbkdf2-sha256$x$c2FsdA$YQ": false,
+		"pbkdf2-sha256$secret":      false,
+		"secret":                    true,
+		"secret\x00":                false,
+	} {
+		if checkPassword(stored, []byte("secret")) != ok {
+			t.Errorf("checking secret against %q should be %t", stored, ok)
+		}
+	}
+}
+
+func Test_MaxPacketSize(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.MaxPacketSize = 64
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	conn := connectTestClient(t, h, "large", true)
+	defer conn.Close()
+
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "a/b"
+	pp.Payload = make([]byte, 64)
+	pp.Write(conn)
+	expectClosed(t, conn, "PUBLISH over the maximum packet size")
+}
+
+func Test_AssignedClientID(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	connect := func(id string, cleanSession bool) (net.Conn, byte) {
+		conn, _ := net.Dial("tcp", h.listeners["test"].ln.Addr().String())
+		cp := NewControlPacket(CONNECT).(*ConnectPacket)
+		cp.ProtocolName = "MQTT"
+		cp.ProtocolVersion = 4
+		cp.CleanSession = cleanSession
+		cp.ClientIdentifier = id
+		cp.Write(conn)
+		rp, err := ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("no CONNACK for %q: %s", id, err.Error())
+		}
+		return conn, rp.(*ConnackPacket).ReturnCode
+	}
+
+	first, rc := connect("", true)
+	defer first.Close()
+	if rc != CONN_ACCEPTED {
+		t.Fatalf("client with no id was refused with %d", rc)
+	}
+	second, _ := connect("", true)
+	defer second.Close()
+	var assigned []string
+	for _, c := range h.clients.snapshot() {
+		if strings.HasPrefix(c.clientID, assignedIDPrefix) && c.assignedID {
+			assigned = append(assigned, c.clientID)
+		}
+	}
+	if len(assigned) != 2 || assigned[0] == assigned[1] {
+		t.Fatalf("assigned client ids are %v, should be 2 unique ids", assigned)
+	}
+
+	if conn, rc := connect(assigned[0], true); rc != CONN_REF_ID_REJ {
+		t.Errorf("client choosing an assigned id was accepted with %d", rc)
+		conn.Close()
+	}
+	if conn, rc := connect("", false); rc != CONN_REF_ID_REJ {
+		t.Errorf("client with no id and cleansession false was accepted with %d", rc)
+		conn.Close()
+	}
+}
+
+func Test_ControlPacketsFirst(t *testing.T) {
+	h := NewHrotti(1000, &MemoryPersistence{})
+	c, conn := newPipeClient(h, "backlog", 1000)
+	defer conn.Close()
+	h.AddSub(c, "a/#", SubscriptionOptions{})
+	for i := 0; i < 500; i++ {
+		publish(h, "a/b", nil)
+	}
+	c.outboundPriority <- NewControlPacket(PINGRESP)
+
+	c.Add(1)
+	go c.Send(h)
+	defer close(c.stop)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if rp, err := ReadPacket(conn); err != nil || rp.Type() != PINGRESP {
+		t.Fatalf("received %v %v first, should be the PINGRESP ahead of the queued messages", rp, err)
+	}
+}
+
+func Test_CloseClientRace(t *testing.T) {
+	h := NewHrotti(1000, &MemoryPersistence{})
+	watcher, _ := newPipeClient(h, "watcher", 1000)
+	h.AddSub(watcher, "will/#", SubscriptionOptions{})
+	//a DISCONNECT racing a keepalive timeout closes the connection once, the will is published
+	//at most once and only if the keepalive timeout won
+	const races = 50
+	for i := 0; i < races; i++ {
+		c, conn := newPipeClient(h, "racer", 10)
+		c.cleanSession = true
+		c.willMessage = NewControlPacket(PUBLISH).(*PublishPacket)
+		c.willMessage.TopicName = "will/racer"
+		var wg sync.WaitGroup
+		for _, reason := range []closeReason{closeDisconnect, closeKeepalive, closeNetworkError} {
+			wg.Add(1)
+			go func(reason closeReason) {
+				defer wg.Done()
+				c.closeClient(h, reason, "")
+			}(reason)
+		}
+		wg.Wait()
+		conn.Close()
+		if c.state.Value() != DISCONNECTED || h.getClient("racer") != nil {
+			t.Fatalf("client should be disconnected and removed")
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if wills := watcher.queueDepth(); wills > races {
+		t.Errorf("%d wills published for %d connections", wills, races)
+	}
+}
+
+func Test_DisconnectFlushesAcks(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	conn := connectTestClient(t, h, "quick", true)
+	defer conn.Close()
+	//the publishes and DISCONNECT arrive together, every PUBACK is written before the
+	//connection is closed
+	var packets bytes.Buffer
+	for i := 1; i <= 50; i++ {
+		pp := NewControlPacket(PUBLISH).(*PublishPacket)
+		pp.TopicName = "a/b"
+		pp.Qos = 1
+		pp.MessageID = uint16(i)
+		pp.Write(&packets)
+	}
+	NewControlPacket(DISCONNECT).Write(&packets)
+	conn.Write(packets.Bytes())
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 1; i <= 50; i++ {
+		if rp, err := ReadPacket(conn); err != nil || rp.Type() != PUBACK {
+			t.Fatalf("received %v %v for PUBACK %d, every PUBACK should be written before the connection is closed", rp, err, i)
+		}
+	}
+	expectClosed(t, conn, "client that sent DISCONNECT")
+}
+
+func Test_ProtocolViolations(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	connect := []byte{0x10, 0x0e, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c, 0x00, 0x02, 'i', 'd'}
+	for _, test := range []struct {
+		name   string
+		packet []byte
+	}{
+		{"SUBSCRIBE without topics", []byte{0x82, 0x02, 0x00, 0x01}},
+		{"SUBSCRIBE with flags 0", []byte{0x80, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x01}},
+		{"PUBREL without QoS 1", []byte{0x60, 0x02, 0x00, 0x01}},
+		{"second CONNECT", connect},
+	} {
+		conn := connectTestClient(t, h, "violator", true)
+		conn.Write(test.packet)
+		expectClosed(t, conn, test.name)
+		conn.Close()
+	}
+
+	//a packet before CONNECT
+	conn, err := net.Dial("tcp", h.listeners["test"].ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.Write([]byte{0xc0, 0x00})
+	expectClosed(t, conn, "PINGREQ before CONNECT")
+	//the broker is still working
+	connectTestClient(t, h, "after", true).Close()
+}
+
+func Test_PermissiveListener(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	strict := NewListenerConfig("tcp://127.0.0.1:0")
+	permissive := NewListenerConfig("tcp://127.0.0.1:0")
+	permissive.Permissive = true
+	limited := NewListenerConfig("tcp://127.0.0.1:0")
+	limited.Permissive = true
+	limited.Fixups = []Fixup{FixProtocolName}
+	for name, config := range map[string]*ListenerConfig{"strict": strict, "permissive": permissive, "limited": limited} {
+		if err := h.AddListener(name, config); err != nil {
+			t.Fatalf("failed to start listener: %s", err.Error())
+		}
+	}
+	defer h.Stop()
+	dial := func(listener string) net.Conn {
+		conn, err := net.Dial("tcp", h.listeners[listener].ln.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %s", err.Error())
+		}
+		return conn
+	}
+	//MQIsdp with a trailing space and the keepalive of 60 seconds sent little endian
+	connect := []byte{0x10, 0x11, 0x00, 0x07, 'M', 'Q', 'I', 's', 'd', 'p', ' ', 0x03, 0x02, 0x3c, 0x00, 0x00, 0x02, 'i', 'd'}
+
+	conn := dial("strict")
+	conn.Write(connect)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if rp, err := ReadPacket(conn); err == nil && rp.(*ConnackPacket).ReturnCode == CONN_ACCEPTED {
+		t.Errorf("strict listener accepted the CONNECT")
+	}
+	conn.Close()
+
+	conn = dial("permissive")
+	defer conn.Close()
+	conn.Write(connect)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if rp, err := ReadPacket(conn); err != nil || rp.(*ConnackPacket).ReturnCode != CONN_ACCEPTED {
+		t.Fatalf("permissive listener returned %v %v, should accept the CONNECT", rp, err)
+	}
+	h.clients.RLock()
+	keepAlive := h.clients.list["id"].keepAlive
+	h.clients.RUnlock()
+	if keepAlive != 60 {
+		t.Errorf("keepalive is %d, should be 60", keepAlive)
+	}
+	//a PINGREQ with flags and a QoS 0 PUBLISH with dup set are corrected
+	conn.Write([]byte{0xc1, 0x00})
+	conn.Write([]byte{0x38, 0x03, 0x00, 0x01, 'a'})
+	conn.Write([]byte{0xc0, 0x00})
+	for i := 0; i < 2; i++ {
+		if rp, err := ReadPacket(conn); err != nil || rp.Type() != PINGRESP {
+			t.Fatalf("permissive client received %v %v, should be a PINGRESP", rp, err)
+		}
+	}
+	//as is a SUBSCRIBE with the reserved bits of its requested QoS set
+	conn.Write([]byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x2d})
+	if rp, err := ReadPacket(conn); err != nil || rp.Type() != SUBACK || !bytes.Equal(rp.(*SubackPacket).GrantedQoss, []byte{1}) {
+		t.Fatalf("permissive client received %v %v, should be a SUBACK granting QoS 1", rp, err)
+	}
+	for fixup, want := range map[Fixup]int64{FixProtocolName: 1, FixKeepaliveByteOrder: 1, FixReservedFlags: 1, FixQos0Dup: 1, FixSubscribeOptions: 1} {
+		if got := atomic.LoadInt64(&h.stats.fixups[fixup]); got != want {
+			t.Errorf("%s was counted %d times, should be %d", fixup, got, want)
+		}
+	}
+
+	//a listener only corrects the fixups it has
+	limitedConn := dial("limited")
+	defer limitedConn.Close()
+	limitedConn.Write(connect[:13])
+	limitedConn.Write([]byte{0x00, 0x3c, 0x00, 0x02, 'i', '2'})
+	limitedConn.SetReadDeadline(time.Now().Add(time.Second))
+	if rp, err := ReadPacket(limitedConn); err != nil || rp.(*ConnackPacket).ReturnCode != CONN_ACCEPTED {
+		t.Fatalf("limited listener returned %v %v, should accept the CONNECT", rp, err)
+	}
+	limitedConn.Write([]byte{0xc1, 0x00})
+	expectClosed(t, limitedConn, "PINGREQ with flags")
+}
+
+//a client with thousands of messages queued gets its SUBACK long before the queue drains
+func Test_SubackLatencyUnderFlood(t *testing.T) {
+	const flood = 20000
+	h := NewHrotti(flood, &MemoryPersistence{})
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	conn := dialTestClient(t, h, "flooded", "flood/#")
+	defer conn.Close()
+	payload := make([]byte, 1024)
+	for i := 0; i < flood; i++ {
+		h.Publish("flood/a", payload, 0, false)
+	}
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 2
+	sp.Topics = []string{"other"}
+	sp.Qoss = []byte{1}
+	sent := time.Now()
+	sp.Write(conn)
+	before := 0
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		rp, err := ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("failed to read: %s", err.Error())
+		}
+		if rp.Type() == SUBACK {
+			break
+		}
+		before++
+	}
+	t.Logf("SUBACK took %s, behind %d of %d queued messages", time.Since(sent), before, flood)
+	//the messages ahead of it are the ones already written to the socket's buffers
+	if before >= flood/2 {
+		t.Errorf("SUBACK was behind %d of %d queued messages", before, flood)
+	}
+}
+
+//a burst of small messages goes out in batches of WriteBatchPackets, and what is left once
+//the queue is empty after WriteBatchDelay
+//countingConn counts the writes made to it as each starts, so a write is counted before
+//anything reading the other end of a pipe can see it
+type countingConn struct {
+	net.Conn
+	writes int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func Test_WriteBatching(t *testing.T) {
+	h := NewHrotti(1000, &MemoryPersistence{})
+	h.WriteBatchPackets = 10
+	//long enough that the first batch isn't flushed early if publishing the burst is slow
+	h.WriteBatchDelay = time.Second
+	defer h.Stop()
+	conn, server := net.Pipe()
+	defer conn.Close()
+	counted := &countingConn{Conn: server}
+	h.ServeConn(counted)
+	newConnect("batched").Write(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ReadPacket(conn); err != nil {
+		t.Fatalf("no CONNACK: %s", err.Error())
+	}
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"batch/#"}
+	sp.Qoss = []byte{0}
+	sp.Write(conn)
+	if _, err := ReadPacket(conn); err != nil {
+		t.Fatalf("no SUBACK: %s", err.Error())
+	}
+	before := atomic.LoadInt64(&counted.writes)
+	for i := 0; i < 95; i++ {
+		h.Publish("batch/"+strconv.Itoa(i), []byte("x"), 0, false)
+	}
+	var last time.Duration
+	start := time.Now()
+	for i := 0; i < 95; i++ {
+		if _, err := ReadPacket(conn); err != nil {
+			t.Fatalf("failed to read message %d: %s", i, err.Error())
+		}
+		last = time.Since(start)
+	}
+	if writes := atomic.LoadInt64(&counted.writes) - before; writes != 10 {
+		t.Errorf("95 messages were sent in %d writes, should be 10", writes)
+	}
+	if last < 500*time.Millisecond {
+		t.Errorf("the last 5 messages arrived after %s, should have waited for the batch delay", last)
+	}
+}
+
+//BenchmarkQos0Traffic publishes a steady 10000 64 byte QoS 0 messages a second from one
+//client to another through the broker, the allocations are mostly those of the broker reading,
+//routing and writing each message
+func BenchmarkQos0Traffic(b *testing.B) {
+	h := NewHrotti(1000, &MemoryPersistence{})
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		b.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub := connectTestClient(b, h, "sub", true)
+	defer sub.Close()
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"sensors/+/temperature"}
+	sp.Qoss = []byte{0}
+	sp.Write(sub)
+	ReadPacket(sub)
+	pub := connectTestClient(b, h, "pub", true)
+	defer pub.Close()
+	received := make(chan struct{})
+	go func() {
+		reader := NewReader(sub)
+		for i := 0; i < b.N; i++ {
+			if _, err := reader.ReadPacket(0); err != nil {
+				break
+			}
+		}
+		close(received)
+	}()
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "sensors/building1/temperature"
+	pp.Payload = make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		//messages are sent in bursts of 10 each millisecond
+		if i%10 == 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(i) * 100 * time.Microsecond)))
+		}
+		pp.Write(pub)
+	}
+	<-received
+}
@@ -0,0 +1,270 @@
+package hrotti
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//fakeClock is a Clock that only moves when Advance is called. Timers fire during Advance at
+//the time they are due, an AfterFunc's function is called by Advance rather than in a
+//goroutine of its own.
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	when   time.Time
+	period time.Duration
+	c      chan time.Time
+	f      func()
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) add(d time.Duration, period time.Duration, f func()) *fakeTimer {
+	c.Lock()
+	defer c.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), period: period, c: make(chan time.Time, 1), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	return c.add(d, 0, nil)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{c.add(d, d, nil)}
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0, nil).c
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.add(d, 0, f)
+}
+
+//remove takes t off the timers waiting to fire, returning true if it was waiting. The clock
+//must be locked.
+func (c *fakeClock) remove(t *fakeTimer) bool {
+	for i, waiting := range c.timers {
+		if waiting == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+//Advance moves the clock on by d, firing the timers due by then in the order they are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.when
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			c.remove(next)
+		}
+		now := c.now
+		c.Unlock()
+		if next.f != nil {
+			next.f()
+		} else {
+			select {
+			case next.c <- now:
+			default:
+			}
+		}
+		c.Lock()
+	}
+	c.now = end
+	c.Unlock()
+}
+
+//waiting returns true if there is a timer due d from now
+func (c *fakeClock) waiting(d time.Duration) bool {
+	c.Lock()
+	defer c.Unlock()
+	for _, t := range c.timers {
+		if t.when.Equal(c.now.Add(d)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	active := t.clock.remove(t)
+	t.when = t.clock.now.Add(d)
+	t.clock.timers = append(t.clock.timers, t)
+	return active
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+//expectOpen checks nothing is read from conn and it isn't closed
+func expectOpen(t *testing.T, conn net.Conn, what string) {
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	rp, err := ReadPacket(conn)
+	if err == nil {
+		t.Errorf("%s: received %v", what, rp)
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("%s: connection was closed: %s", what, err.Error())
+	}
+}
+
+func Test_ClockKeepalive(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	clock := newFakeClock()
+	h.Clock = clock
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	//a keepalive of 30 seconds is enforced at 45
+	conn := connectTestClient(t, h, "device", true)
+	defer conn.Close()
+	waitFor(t, "the keepalive timer", func() bool { return clock.waiting(45 * time.Second) })
+
+	//a packet from the client starts the 45 seconds again
+	clock.Advance(30 * time.Second)
+	NewControlPacket(PINGREQ).Write(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if rp, err := ReadPacket(conn); err != nil || rp.Type() != PINGRESP {
+		t.Fatalf("received %v %v, should be a PINGRESP", rp, err)
+	}
+	waitFor(t, "the keepalive timer to restart", func() bool { return clock.waiting(45 * time.Second) })
+	clock.Advance(45*time.Second - time.Millisecond)
+	expectOpen(t, conn, "just before 1.5 times the keepalive")
+	clock.Advance(time.Millisecond)
+	expectClosed(t, conn, "1.5 times the keepalive")
+}
+
+func Test_ClockWillDelay(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	clock := newFakeClock()
+	h.Clock = clock
+	h.WillDelay = 30 * time.Second
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	//the subscriber is internal so it has no keepalive to time out
+	h.clients.Lock()
+	sub := newTestClient(h, "sub")
+	h.clients.Unlock()
+	h.AddSub(sub, "will/#", SubscriptionOptions{})
+	willDelayed := func() bool {
+		h.wills.Lock()
+		defer h.wills.Unlock()
+		return h.wills.timers["device"] != nil
+	}
+
+	//a client that reconnects within the delay doesn't have its will published
+	connectWillClient(t, h, "device").Close()
+	waitFor(t, "the will to be delayed", willDelayed)
+	conn := connectWillClient(t, h, "device")
+	defer conn.Close()
+	if willDelayed() {
+		t.Fatalf("will still delayed after the client reconnected")
+	}
+	clock.Advance(40 * time.Second)
+	expectNothing(t, sub)
+
+	//one that stays away has it published exactly when the delay is up
+	conn.Close()
+	waitFor(t, "the will to be delayed", willDelayed)
+	clock.Advance(30*time.Second - time.Millisecond)
+	expectNothing(t, sub)
+	clock.Advance(time.Millisecond)
+	if msg := receive(t, sub); msg.TopicName != "will/device" {
+		t.Errorf("received %s, should be the will on will/device", msg.TopicName)
+	}
+}
+
+func Test_ClockRetry(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	clock := newFakeClock()
+	h.Clock = clock
+	h.RetryInterval = 10 * time.Second
+	h.MaxRetries = 2
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub := dialTestClient(t, h, "sub", "a/#")
+	defer sub.Close()
+	h.Publish("a/b", []byte("unacked"), 1, false)
+	first := readPublish(t, sub, time.Second)
+	if first == nil || first.Dup {
+		t.Fatalf("first delivery is %v, should be a PUBLISH without dup", first)
+	}
+	c := h.getClient("sub")
+	waitFor(t, "the resend to be scheduled", func() bool {
+		c.messageIDs.Lock()
+		defer c.messageIDs.Unlock()
+		return c.sent[first.MessageID] != nil
+	})
+
+	//each resend is a RetryInterval after the last, up to MaxRetries of them
+	for i := 0; i < h.MaxRetries; i++ {
+		clock.Advance(h.RetryInterval - wheelTick)
+		if pp := readPublish(t, sub, 100*time.Millisecond); pp != nil {
+			t.Fatalf("resend %d sent before the retry interval", i+1)
+		}
+		clock.Advance(wheelTick)
+		pp := readPublish(t, sub, time.Second)
+		if pp == nil || !pp.Dup || pp.MessageID != first.MessageID {
+			t.Fatalf("resend %d is %v, should be the PUBLISH with dup set", i+1, pp)
+		}
+	}
+	clock.Advance(h.RetryInterval)
+	if pp := readPublish(t, sub, 100*time.Millisecond); pp != nil {
+		t.Errorf("message resent more than MaxRetries times")
+	}
+}
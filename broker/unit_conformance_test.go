@@ -0,0 +1,172 @@
+package hrotti
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Test_Conformance replays the scripts in testdata/conformance, raw byte exchanges in the
+//form the client libraries people use with the broker send them, against a broker on a
+//random port and checks the broker replies with exactly the expected bytes. Each line of a
+//script is a command for a connection the script names:
+//
+//	connect <name>       open a new connection called name
+//	send <name> <hex>    write the bytes to name
+//	expect <name> <hex>  read exactly those bytes from name, .. matches any byte and
+//	                     alternatives of the same length are separated by |
+//	nothing <name>       nothing arrives on name within a short wait
+//	drop <name>          close name without sending a DISCONNECT
+//	closed <name>        the broker closes name
+//
+//Spaces in the hex are ignored and anything after a # is a comment.
+func Test_Conformance(t *testing.T) {
+	scripts, _ := filepath.Glob(filepath.Join("testdata", "conformance", "*.txt"))
+	if len(scripts) == 0 {
+		t.Fatalf("no conformance scripts found")
+	}
+	for _, script := range scripts {
+		script := script
+		t.Run(strings.TrimSuffix(filepath.Base(script), ".txt"), func(t *testing.T) {
+			runConformanceScript(t, script)
+		})
+	}
+}
+
+func runConformanceScript(t *testing.T, script string) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	addr := h.listeners["test"].ln.Addr().String()
+	conns := make(map[string]net.Conn)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	f, err := os.Open(script)
+	if err != nil {
+		t.Fatalf("failed to open script: %s", err.Error())
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			t.Fatalf("%s:%d: %s needs a connection name", script, line, fields[0])
+		}
+		command, name := fields[0], fields[1]
+		conn := conns[name]
+		if conn == nil && command != "connect" {
+			t.Fatalf("%s:%d: no connection called %s", script, line, name)
+		}
+		switch command {
+		case "connect":
+			if conn, err = net.Dial("tcp", addr); err != nil {
+				t.Fatalf("%s:%d: failed to connect: %s", script, line, err.Error())
+			}
+			conns[name] = conn
+		case "send":
+			want, _ := parseScriptBytes(t, script, line, fields[2:])
+			if _, err := conn.Write(want); err != nil {
+				t.Fatalf("%s:%d: failed to write to %s: %s", script, line, name, err.Error())
+			}
+		case "expect":
+			var wants, wilds [][]byte
+			for _, alternative := range strings.Split(strings.Join(fields[2:], " "), "|") {
+				want, wild := parseScriptBytes(t, script, line, strings.Fields(alternative))
+				if len(wants) > 0 && len(want) != len(wants[0]) {
+					t.Fatalf("%s:%d: alternatives are different lengths", script, line)
+				}
+				wants, wilds = append(wants, want), append(wilds, wild)
+			}
+			got := make([]byte, len(wants[0]))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := io.ReadFull(conn, got)
+			if err != nil {
+				t.Fatalf("%s:%d: %s received [% x] then %s, expected [% x]", script, line, name, got[:n], err.Error(), wants[0])
+			}
+			if !matchesAny(got, wants, wilds) {
+				t.Fatalf("%s:%d: %s received [% x], expected [% x]", script, line, name, got, wants)
+			}
+		case "nothing":
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			b := make([]byte, 1)
+			if n, err := conn.Read(b); n > 0 {
+				t.Fatalf("%s:%d: %s received %02x, expected nothing", script, line, name, b[0])
+			} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				t.Fatalf("%s:%d: %s was closed, expected nothing", script, line, name)
+			}
+		case "drop":
+			conn.Close()
+			delete(conns, name)
+		case "closed":
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			b := make([]byte, 1)
+			if n, err := conn.Read(b); n > 0 {
+				t.Fatalf("%s:%d: %s received %02x, expected to be closed", script, line, name, b[0])
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatalf("%s:%d: %s wasn't closed", script, line, name)
+			}
+			conn.Close()
+			delete(conns, name)
+		default:
+			t.Fatalf("%s:%d: unknown command %s", script, line, command)
+		}
+	}
+}
+
+//matchesAny returns true if got matches one of wants, ignoring the bytes wilds marks
+func matchesAny(got []byte, wants [][]byte, wilds [][]byte) bool {
+	for i, want := range wants {
+		matched := true
+		for j := range want {
+			if wilds[i][j] == 0 && got[j] != want[j] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+//parseScriptBytes decodes the hex in fields, returning the bytes and a mask that is 1 for
+//the bytes that are .. wildcards
+func parseScriptBytes(t *testing.T, script string, line int, fields []string) ([]byte, []byte) {
+	text := strings.Join(fields, "")
+	if len(text)%2 != 0 {
+		t.Fatalf("%s:%d: odd number of hex digits", script, line)
+	}
+	b := make([]byte, len(text)/2)
+	wild := make([]byte, len(b))
+	for i := range b {
+		pair := text[2*i : 2*i+2]
+		if pair == ".." {
+			wild[i] = 1
+			continue
+		}
+		if _, err := hex.Decode(b[i:i+1], []byte(pair)); err != nil {
+			t.Fatalf("%s:%d: bad hex %q", script, line, pair)
+		}
+	}
+	return b, wild
+}
@@ -0,0 +1,95 @@
+package hrotti
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//userProperty returns the value of the user property key of pp, or "" if it hasn't one
+func userProperty(pp *PublishPacket, key string) string {
+	if pp.Properties == nil {
+		return ""
+	}
+	for _, property := range pp.Properties.UserProperties {
+		if property.Key == key {
+			return property.Value
+		}
+	}
+	return ""
+}
+
+func Test_DeadLetter(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.DeadLetter = &DeadLetter{Reasons: []DropReason{DropPolicy, DropQueueFull, DropSessionEnded}, MaxSize: 100}
+	h.TopicPolicies = map[string]*TopicPolicy{"limited/#": {MaxSize: 2, MaxQos: 2}}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	letters := newTestClient(h, "letters")
+	h.AddSub(letters, DefaultDeadLetterTopic+"/#", SubscriptionOptions{})
+	//a dead letter subscriber that can't keep up drops every letter, they aren't dead lettered again
+	full := newClient(nil, "full", 1)
+	full.state.SetValue(CONNECTED)
+	h.clients.list["full"] = full
+	full.outboundMessages <- NewControlPacket(PUBLISH).(*PublishPacket)
+	h.AddSub(full, DefaultDeadLetterTopic+"/#", SubscriptionOptions{})
+
+	//a message breaking its topic's policy
+	pub := connectTestClient(t, h, "pub", true)
+	defer pub.Close()
+	publishPolicyTest(t, pub, "limited/a", []byte("too big"), 1, false)
+	letter := receive(t, letters)
+	if letter.TopicName != "$deadletter/policy/limited/a" || string(letter.Payload) != "too big" {
+		t.Errorf("dead letter is %s %q, should be $deadletter/policy/limited/a", letter.TopicName, letter.Payload)
+	}
+	if userProperty(letter, "reason") != "policy" || userProperty(letter, "topic") != "limited/a" || userProperty(letter, "publisher") != "pub" || userProperty(letter, "received") == "" {
+		t.Errorf("dead letter has properties %+v", letter.Properties)
+	}
+
+	//a message for a client whose queue is full
+	slow := newClient(nil, "slow", 1)
+	slow.state.SetValue(CONNECTED)
+	h.clients.list["slow"] = slow
+	h.AddSub(slow, "slow/#", SubscriptionOptions{})
+	h.Publish("slow/a", []byte("1"), 0, false)
+	h.Publish("slow/a", []byte("2"), 0, false)
+	letter = receive(t, letters)
+	if letter.TopicName != "$deadletter/queue-full/slow/a" || string(letter.Payload) != "2" || userProperty(letter, "subscriber") != "slow" {
+		t.Errorf("dead letter is %s %q with properties %+v", letter.TopicName, letter.Payload, letter.Properties)
+	}
+
+	//a message unacknowledged by a client whose clean session ends
+	gone := dialTestClient(t, h, "gone", "gone/#")
+	h.Publish("gone/a", []byte("unacked"), 1, false)
+	if received := readPublish(t, gone, time.Second); received == nil {
+		t.Fatalf("gone didn't receive its message")
+	}
+	gone.Close()
+	letter = receive(t, letters)
+	if letter.TopicName != "$deadletter/session-ended/gone/a" || userProperty(letter, "subscriber") != "gone" {
+		t.Errorf("dead letter is %s with properties %+v", letter.TopicName, letter.Properties)
+	}
+
+	//one over the size limit is only counted
+	publishPolicyTest(t, pub, "limited/b", bytes.Repeat([]byte("x"), 101), 1, false)
+	select {
+	case letter := <-letters.outboundMessages:
+		t.Errorf("received dead letter %s", letter.TopicName)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if dropped := atomic.LoadInt64(&h.stats.deadLettersDropped); dropped != 1 {
+		t.Errorf("%d dead letters were dropped, should be 1", dropped)
+	}
+	if policy := atomic.LoadInt64(&h.stats.discarded[DropPolicy]); policy != 2 {
+		t.Errorf("%d messages were discarded for their policy, should be 2", policy)
+	}
+	//slow/a and the three dead letters for full
+	if queueFull := atomic.LoadInt64(&h.stats.discarded[DropQueueFull]); queueFull != 4 {
+		t.Errorf("%d messages were discarded for full queues, should be 4", queueFull)
+	}
+}
@@ -0,0 +1,265 @@
+package hrotti
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//recordingHooks sends a line for each call to events, it drops messages to secret/ and
+//publishes messages to in/ to out/ instead
+type recordingHooks struct {
+	events chan string
+	block  chan struct{}
+}
+
+func (r *recordingHooks) OnConnect(clientID string, username string, remoteAddr string, cleanSession bool) {
+	if r.block != nil {
+		<-r.block
+	}
+	r.events <- fmt.Sprintf("connect %s %t", clientID, cleanSession)
+}
+
+func (r *recordingHooks) OnDisconnect(clientID string, reason string) {
+	r.events <- fmt.Sprintf("disconnect %s %s", clientID, reason)
+}
+
+func (r *recordingHooks) OnSubscribe(clientID string, filters []string, grantedQoss []byte) {
+	r.events <- fmt.Sprintf("subscribe %s %v %v", clientID, filters, grantedQoss)
+}
+
+func (r *recordingHooks) OnPublish(clientID string, topic string, qos byte, size int) (string, bool) {
+	r.events <- fmt.Sprintf("publish %s %s %d %d", clientID, topic, qos, size)
+	switch {
+	case strings.HasPrefix(topic, "secret/"):
+		return topic, false
+	case strings.HasPrefix(topic, "in/"):
+		return "out/" + strings.TrimPrefix(topic, "in/"), true
+	}
+	return topic, true
+}
+
+func expectEvent(t *testing.T, events chan string, expected string) {
+	select {
+	case event := <-events:
+		if event != expected {
+			t.Fatalf("hook call was %q, should be %q", event, expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("hook call %q wasn't made", expected)
+	}
+}
+
+func Test_Hooks(t *testing.T) {
+	hooks := &recordingHooks{events: make(chan string, 10)}
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.Hooks = hooks
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub := dialTestClient(t, h, "sub", "out/#")
+	defer sub.Close()
+	expectEvent(t, hooks.events, "connect sub true")
+	expectEvent(t, hooks.events, "subscribe sub [out/#] [1]")
+
+	pub := connectTestClient(t, h, "pub", true)
+	expectEvent(t, hooks.events, "connect pub true")
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "secret/a"
+	pp.Payload = []byte("hidden")
+	pp.Write(pub)
+	expectEvent(t, hooks.events, "publish pub secret/a 0 6")
+	pp.TopicName = "in/a"
+	pp.Payload = []byte("moved")
+	pp.Write(pub)
+	expectEvent(t, hooks.events, "publish pub in/a 0 5")
+	//the rewritten message is delivered and the dropped one isn't
+	if received := readPublish(t, sub, time.Second); received == nil || received.TopicName != "out/a" || string(received.Payload) != "moved" {
+		t.Fatalf("subscriber received %v, should be the message rewritten to out/a", received)
+	}
+	NewControlPacket(DISCONNECT).Write(pub)
+	expectEvent(t, hooks.events, "disconnect pub client sent DISCONNECT")
+	pub.Close()
+}
+
+func Test_HooksDropped(t *testing.T) {
+	hooks := &recordingHooks{events: make(chan string, 10), block: make(chan struct{})}
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.Hooks = hooks
+	h.HookWorkers = 1
+	h.HookQueueDepth = 1
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	//the first OnConnect blocks the only worker, the second waits in its queue and the rest
+	//are dropped, a blocked hook doesn't stop clients connecting
+	for i := 0; i < 4; i++ {
+		conn := connectTestClient(t, h, fmt.Sprintf("client%d", i), true)
+		defer conn.Close()
+		if i == 0 {
+			waitFor(t, "worker to take the first call", func() bool { return len(h.hooks.queues[0]) == 0 })
+		}
+	}
+	waitFor(t, "hook calls to be dropped", func() bool { return atomic.LoadInt64(&h.stats.hookCallsDropped) == 2 })
+	close(hooks.block)
+	expectEvent(t, hooks.events, "connect client0 true")
+	expectEvent(t, hooks.events, "connect client1 true")
+}
+
+//panickingHooks panics when the client "bad" publishes, or connects with a clean session
+type panickingHooks struct {
+	NopHooks
+}
+
+func (panickingHooks) OnConnect(clientID string, username string, remoteAddr string, cleanSession bool) {
+	if clientID == "bad" {
+		panic("OnConnect for bad")
+	}
+}
+
+func (panickingHooks) OnPublish(clientID string, topic string, qos byte, size int) (string, bool) {
+	if clientID == "bad" {
+		panic("OnPublish for bad")
+	}
+	return topic, true
+}
+
+func Test_PanicIsolation(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.Hooks = panickingHooks{}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub := dialTestClient(t, h, "sub", "#")
+	defer sub.Close()
+	bad := connectWillClient(t, h, "bad")
+	defer bad.Close()
+	good := connectTestClient(t, h, "good", true)
+	defer good.Close()
+
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "a/b"
+	pp.Payload = []byte("boom")
+	pp.Write(bad)
+	//only bad's connection is closed, with its will published
+	if topic := receivedTopic(sub, time.Second); topic != "will/bad" {
+		t.Fatalf("subscriber received %q, should be bad's will", topic)
+	}
+	bad.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ReadPacket(bad); err == nil {
+		t.Error("bad's connection is still open")
+	}
+	pp.Payload = []byte("fine")
+	pp.Write(good)
+	if topic := receivedTopic(sub, time.Second); topic != "a/b" {
+		t.Errorf("subscriber received %q, should be good's message", topic)
+	}
+	//one in OnConnect, on a hook worker, and one in OnPublish
+	waitFor(t, "both panics to be counted", func() bool { return atomic.LoadInt64(&h.stats.panics) == 2 })
+
+	restarts := 0
+	h.supervise("test", func() {
+		if restarts++; restarts < 3 {
+			panic("task")
+		}
+	})
+	if restarts != 3 {
+		t.Errorf("task ran %d times, should have been restarted until it returned", restarts)
+	}
+}
+
+//gatedIngester commits a message once it is released, fails "fail" and never commits "hang"
+type gatedIngester struct {
+	release chan struct{}
+	hang    chan struct{}
+}
+
+func (g *gatedIngester) OnIngest(message *Message) error {
+	switch string(message.Payload) {
+	case "fail":
+		return errors.New("downstream unavailable")
+	case "hang":
+		<-g.hang
+		return nil
+	}
+	<-g.release
+	return nil
+}
+
+func Test_Ingester(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	ingester := &gatedIngester{release: make(chan struct{}), hang: make(chan struct{})}
+	defer close(ingester.hang)
+	h.Ingesters = map[string]Ingester{"mirrored/#": ingester}
+	h.IngestTimeout = 200 * time.Millisecond
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub := dialTestClient(t, h, "sub", "#")
+	defer sub.Close()
+	publish := func(conn net.Conn, topic string, qos byte, payload string) {
+		pp := NewControlPacket(PUBLISH).(*PublishPacket)
+		pp.TopicName = topic
+		pp.Qos = qos
+		pp.MessageID = 1
+		pp.Payload = []byte(payload)
+		pp.Write(conn)
+	}
+
+	//the PUBACK waits for the message to be committed
+	pub := connectTestClient(t, h, "pub", true)
+	defer pub.Close()
+	publish(pub, "mirrored/a", 1, "ok")
+	pub.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if rp, err := ReadPacket(pub); err == nil {
+		t.Fatalf("publisher received %v before the message was committed", rp)
+	}
+	if topic := receivedTopic(sub, 50*time.Millisecond); topic != "" {
+		t.Fatalf("subscriber received %q before the message was committed", topic)
+	}
+	ingester.release <- struct{}{}
+	pub.SetReadDeadline(time.Now().Add(time.Second))
+	if rp, err := ReadPacket(pub); err != nil || rp.Type() != PUBACK {
+		t.Fatalf("publisher received %v %v, should be a PUBACK", rp, err)
+	}
+	if topic := receivedTopic(sub, time.Second); topic != "mirrored/a" {
+		t.Fatalf("subscriber received %q, should be mirrored/a", topic)
+	}
+
+	//a message that isn't committed isn't acknowledged or delivered, and the publisher is
+	//disconnected to send it again
+	publish(pub, "mirrored/a", 1, "fail")
+	expectClosed(t, pub, "QoS 1 message that failed")
+	hung := connectTestClient(t, h, "hung", true)
+	defer hung.Close()
+	publish(hung, "mirrored/b", 2, "hang")
+	expectClosed(t, hung, "QoS 2 message that timed out")
+	if topic := receivedTopic(sub, 100*time.Millisecond); topic != "" {
+		t.Errorf("subscriber received %q, which wasn't committed", topic)
+	}
+	//a QoS 0 message is dropped, topics without an Ingester aren't held up
+	other := connectTestClient(t, h, "other", true)
+	defer other.Close()
+	publish(other, "mirrored/c", 0, "fail")
+	publish(other, "plain", 1, "hang")
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	if rp, err := ReadPacket(other); err != nil || rp.Type() != PUBACK {
+		t.Fatalf("publisher received %v %v, should be a PUBACK", rp, err)
+	}
+	if topic := receivedTopic(sub, time.Second); topic != "plain" {
+		t.Errorf("subscriber received %q, should be plain", topic)
+	}
+	if errs, timeouts, dropped := atomic.LoadInt64(&h.stats.ingestErrors), atomic.LoadInt64(&h.stats.ingestTimeouts), atomic.LoadInt64(&h.stats.discarded[DropIngestFailed]); errs != 2 || timeouts != 1 || dropped != 1 {
+		t.Errorf("counted %d errors, %d timeouts and %d dropped, should be 2, 1 and 1", errs, timeouts, dropped)
+	}
+}
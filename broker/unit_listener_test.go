@@ -0,0 +1,691 @@
+package hrotti
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//writeTestCert writes a self signed certificate and key for 127.0.0.1 with the common name
+//name to dir
+func writeTestCert(t *testing.T, dir string, name string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err.Error())
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile := filepath.Join(dir, name+"-cert.pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func Test_TLSListener(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	defer h.Stop()
+	config := NewListenerConfig("tls://127.0.0.1:0")
+	if err := h.AddListener("nocert", config); err == nil {
+		t.Errorf("tls listener started without a certificate")
+	}
+	config.CertFile, config.KeyFile = writeTestCert(t, t.TempDir(), "server")
+	if err := h.AddListener("tls", config); err != nil {
+		t.Fatalf("failed to start tls listener: %s", err.Error())
+	}
+
+	conn, err := tls.Dial("tcp", h.listeners["tls"].ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("failed to connect over tls: %s", err.Error())
+	}
+	defer conn.Close()
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.CleanSession = true
+	cp.ClientIdentifier = "tls"
+	cp.Write(conn)
+	if rp, err := ReadPacket(conn); err != nil || rp.(*ConnackPacket).ReturnCode != CONN_ACCEPTED {
+		t.Errorf("tls client was not accepted: %v %v", rp, err)
+	}
+}
+
+func Test_MaxConnections(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	config := NewListenerConfig("tcp://127.0.0.1:0")
+	config.MaxConnections = 1
+	if err := h.AddListener("test", config); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+
+	first := connectTestClient(t, h, "first", true)
+	second, _ := net.Dial("tcp", h.listeners["test"].ln.Addr().String())
+	defer second.Close()
+	expectClosed(t, second, "connection over the limit")
+
+	//closing the first connection frees its place
+	first.Close()
+	waitFor(t, "first client to disconnect", func() bool {
+		return h.getClient("first") == nil
+	})
+	connectTestClient(t, h, "third", true).Close()
+}
+
+func Test_AcceptRate(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	config := NewListenerConfig("tcp://127.0.0.1:0")
+	config.AcceptRate = 10
+	if err := h.AddListener("test", config); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+
+	//a second's worth are accepted straight away, the other 5 at 10 a second
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		connectTestClient(t, h, "client"+strconv.Itoa(i), true).Close()
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("15 connections took %s, should be about 500ms", elapsed)
+	}
+}
+
+type authenticated struct {
+	username string
+	conn     ConnectionInfo
+}
+
+//recordingAuthenticator accepts every client and records the username and connection of each
+type recordingAuthenticator chan authenticated
+
+func (a recordingAuthenticator) Authenticate(cp *ConnectPacket, conn ConnectionInfo) byte {
+	a <- authenticated{cp.Username, conn}
+	return CONN_ACCEPTED
+}
+
+func Test_ProxyProtocol(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	auth := make(recordingAuthenticator, 1)
+	h.Authenticator = auth
+	config := NewListenerConfig("tcp://127.0.0.1:0")
+	config.ProxyProtocol = true
+	if err := h.AddListener("test", config); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+
+	v2 := append([]byte{}, proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 192, 0, 2, 2, 127, 0, 0, 1, 0xdc, 0x05, 0x07, 0x5b)
+	headers := map[string][]byte{
+		"192.0.2.1:56324": []byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 1883\r\n"),
+		"192.0.2.2:56325": v2,
+	}
+	for addr, header := range headers {
+		conn, err := net.Dial("tcp", h.listeners["test"].ln.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %s", err.Error())
+		}
+		cp := NewControlPacket(CONNECT).(*ConnectPacket)
+		cp.ProtocolName = "MQTT"
+		cp.ProtocolVersion = 4
+		cp.CleanSession = true
+		cp.ClientIdentifier = addr
+		conn.Write(header)
+		cp.Write(conn)
+		if rp, err := ReadPacket(conn); err != nil || rp.(*ConnackPacket).ReturnCode != CONN_ACCEPTED {
+			t.Fatalf("client behind proxy was not accepted: %v %v", rp, err)
+		}
+		if got := (<-auth).conn.RemoteAddr.String(); got != addr {
+			t.Errorf("authenticator was given address %s, should be %s", got, addr)
+		}
+		for _, info := range h.Clients() {
+			if info.ClientID == addr && info.RemoteAddr != addr {
+				t.Errorf("admin client listing has address %s, should be %s", info.RemoteAddr, addr)
+			}
+		}
+		conn.Close()
+	}
+
+	//a client connecting directly, without the header, is closed
+	conn, err := net.Dial("tcp", h.listeners["test"].ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	defer conn.Close()
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.ClientIdentifier = "direct"
+	cp.Write(conn)
+	expectClosed(t, conn, "connection without a PROXY header")
+}
+
+func Test_CertIdentity(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.Auth = &Auth{Users: map[string]string{"other": "password"}}
+	auth := make(recordingAuthenticator, 1)
+	h.Authenticator = auth
+	defer h.Stop()
+	config := NewListenerConfig("tls://127.0.0.1:0")
+	config.CertFile, config.KeyFile = writeTestCert(t, dir, "server")
+	config.UseIdentityFromCert = true
+	if err := h.AddListener("noca", config); err == nil {
+		t.Errorf("listener took identities from certificates without a CA file")
+	}
+	//the client's self signed certificate is its own CA
+	clientCert, clientKey := writeTestCert(t, dir, "sensor")
+	config.CAFile = clientCert
+	config.RejectCredentials = true
+	if err := h.AddListener("mtls", config); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	cert, _ := tls.LoadX509KeyPair(clientCert, clientKey)
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}}
+
+	for _, sendUsername := range []bool{false, true} {
+		conn, err := tls.Dial("tcp", h.listeners["mtls"].ln.Addr().String(), tlsConfig)
+		if err != nil {
+			t.Fatalf("failed to connect over tls: %s", err.Error())
+		}
+		cp := NewControlPacket(CONNECT).(*ConnectPacket)
+		cp.ProtocolName = "MQTT"
+		cp.ProtocolVersion = 4
+		cp.CleanSession = true
+		cp.ClientIdentifier = "sensor"
+		if sendUsername {
+			cp.UsernameFlag, cp.Username = true, "other"
+			cp.PasswordFlag, cp.Password = true, []byte("password")
+		}
+		cp.Write(conn)
+		rp, err := ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("no CONNACK: %s", err.Error())
+		}
+		rc := rp.(*ConnackPacket).ReturnCode
+		switch {
+		case sendUsername && rc != CONN_REF_BAD_USER_PASS:
+			t.Errorf("credentials were accepted with RejectCredentials set, rc %d", rc)
+		case !sendUsername && rc != CONN_ACCEPTED:
+			t.Errorf("client with a certificate was refused, rc %d", rc)
+		case !sendUsername:
+			a := <-auth
+			if a.username != "sensor" || len(a.conn.Certificates) == 0 || a.conn.Certificates[0].Subject.CommonName != "sensor" {
+				t.Errorf("authenticator was given username %q and %d certificates", a.username, len(a.conn.Certificates))
+			}
+		}
+		conn.Close()
+	}
+
+	//without a certificate the handshake fails
+	conn, err := tls.Dial("tcp", h.listeners["mtls"].ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		defer conn.Close()
+		expectClosed(t, conn, "client without a certificate")
+	}
+}
+
+func Test_CertChecks(t *testing.T) {
+	dir := t.TempDir()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "devices"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	caDer, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(caDer)
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}), 0600)
+	//devices 2 and 3 have certificates from the CA, 2 is revoked
+	devices := make(map[int64]tls.Certificate)
+	for serial := int64(2); serial <= 3; serial++ {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		der, _ := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "device" + strconv.FormatInt(serial, 10)},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, &key.PublicKey, caKey)
+		leaf, _ := x509.ParseCertificate(der)
+		devices[serial] = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-time.Hour),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: big.NewInt(2), RevocationTime: time.Now()}},
+	}, ca, caKey)
+	if err != nil {
+		t.Fatalf("failed to create CRL: %s", err.Error())
+	}
+	crlFile := filepath.Join(dir, "ca.crl")
+	ioutil.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), 0600)
+
+	h := NewHrotti(100, &MemoryPersistence{})
+	defer h.Stop()
+	config := NewListenerConfig("tls://127.0.0.1:0")
+	config.CertFile, config.KeyFile = writeTestCert(t, dir, "server")
+	config.CAFile = caFile
+	config.CRLFile = crlFile
+	if err := h.AddListener("mtls", config); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	connects := func(serial int64) bool {
+		conn, err := tls.Dial("tcp", h.listeners["mtls"].ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{devices[serial]}})
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		cp := NewControlPacket(CONNECT).(*ConnectPacket)
+		cp.ProtocolName = "MQTT"
+		cp.ProtocolVersion = 4
+		cp.CleanSession = true
+		cp.ClientIdentifier = "device" + strconv.FormatInt(serial, 10)
+		cp.Write(conn)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = ReadPacket(conn)
+		return err == nil
+	}
+	if connects(2) {
+		t.Errorf("client with a revoked certificate connected")
+	}
+	if !connects(3) {
+		t.Errorf("client with a good certificate was refused")
+	}
+
+	//a reload applies new lists to the next handshake
+	fingerprint := CertFingerprint(devices[3].Leaf)
+	reloaded := *config
+	reloaded.DeniedFingerprints = []string{strings.ToUpper(fingerprint)}
+	if err := h.Reload(&ReloadConfig{Listeners: map[string]*ListenerConfig{"mtls": &reloaded}}); err != nil {
+		t.Fatalf("failed to reload: %s", err.Error())
+	}
+	if connects(3) {
+		t.Errorf("client with a denied certificate connected")
+	}
+	reloaded.CRLFile, reloaded.DeniedFingerprints = "", nil
+	reloaded.AllowedFingerprints = []string{CertFingerprint(devices[2].Leaf)}
+	h.Reload(&ReloadConfig{Listeners: map[string]*ListenerConfig{"mtls": &reloaded}})
+	if connects(3) {
+		t.Errorf("client with a certificate that isn't allowed connected")
+	}
+	if !connects(2) {
+		t.Errorf("client with an allowed certificate was refused")
+	}
+	if refused := atomic.LoadInt64(&h.stats.certificatesRefused); refused != 3 {
+		t.Errorf("%d certificates counted as refused, should be 3", refused)
+	}
+
+	reloaded.AllowedFingerprints = []string{"not a fingerprint"}
+	if err := h.Reload(&ReloadConfig{Listeners: map[string]*ListenerConfig{"mtls": &reloaded}}); err == nil {
+		t.Errorf("reload with a bad fingerprint succeeded")
+	}
+	if !connects(2) {
+		t.Errorf("failed reload didn't keep the listener's checks")
+	}
+}
+
+//limitedBroker starts a broker with the connection limits on a tcp listener, the limits
+//can't be changed once it is listening
+func limitedBroker(t *testing.T, max, maxPerIP int, policy ConnectionLimitPolicy) *Hrotti {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.MaxConnections = max
+	h.MaxConnectionsPerIP = maxPerIP
+	h.ConnectionLimitPolicy = policy
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	return h
+}
+
+func Test_ConnectionLimits(t *testing.T) {
+	h := limitedBroker(t, 0, 1, CloseConnection)
+	first := connectTestClient(t, h, "first", true)
+	second, _ := net.Dial("tcp", h.listeners["test"].ln.Addr().String())
+	defer second.Close()
+	expectClosed(t, second, "second connection from the same address")
+	first.Close()
+	waitFor(t, "first connection to close", func() bool { return h.connections.count() == 0 })
+	h.Stop()
+
+	//over the broker wide limit clients are told the server is unavailable
+	h = limitedBroker(t, 1, 0, ConnackServerUnavailable)
+	defer h.Stop()
+	first = connectTestClient(t, h, "first", true)
+	defer first.Close()
+	third, _ := net.Dial("tcp", h.listeners["test"].ln.Addr().String())
+	defer third.Close()
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.CleanSession = true
+	cp.ClientIdentifier = "third"
+	cp.Write(third)
+	if rp, err := ReadPacket(third); err != nil || rp.(*ConnackPacket).ReturnCode != CONN_REF_SERV_UNAVAIL {
+		t.Errorf("connection over the limit was not refused with server unavailable: %v %v", rp, err)
+	}
+	expectClosed(t, third, "refused connection")
+}
+
+//churnConnection connects a client over a pipe and disconnects it in one of the ways a
+//client can go, by DISCONNECT, by closing the connection, or by being taken over
+func churnConnection(t *testing.T, h *Hrotti, i int) {
+	connect := func(id string) net.Conn {
+		client, server := net.Pipe()
+		h.ServeConn(server)
+		cp := NewControlPacket(CONNECT).(*ConnectPacket)
+		cp.ProtocolName = "MQTT"
+		cp.ProtocolVersion = 4
+		cp.CleanSession = true
+		cp.KeepaliveTimer = 30
+		cp.ClientIdentifier = id
+		cp.Write(client)
+		if _, err := ReadPacket(client); err != nil {
+			t.Errorf("no CONNACK for %s: %s", id, err.Error())
+		}
+		return client
+	}
+	id := "churn" + strconv.Itoa(i)
+	conn := connect(id)
+	switch i % 3 {
+	case 0:
+		NewControlPacket(DISCONNECT).Write(conn)
+	case 2:
+		//the first connection is closed by the broker when the second takes over
+		defer connect(id).Close()
+	}
+	conn.Close()
+}
+
+func Test_ConnectionCountLeak(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	//enough for every worker to take over a client while the idle clients are connected
+	h.MaxConnections = 200
+	defer h.Stop()
+
+	//clients that time out take 1.5 seconds so start them first
+	for i := 0; i < 10; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		h.ServeConn(server)
+		cp := NewControlPacket(CONNECT).(*ConnectPacket)
+		cp.ProtocolName = "MQTT"
+		cp.ProtocolVersion = 4
+		cp.CleanSession = true
+		cp.KeepaliveTimer = 1
+		cp.ClientIdentifier = "idle" + strconv.Itoa(i)
+		cp.Write(client)
+		ReadPacket(client)
+		go func() {
+			//keep reading so the broker isn't blocked writing to the pipe
+			for {
+				if _, err := ReadPacket(client); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < 50; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := worker; i < 10000; i += 50 {
+				churnConnection(t, h, i)
+			}
+		}(worker)
+	}
+	wg.Wait()
+	waitFor(t, "connection count to return to zero", func() bool { return h.connections.count() == 0 })
+}
+
+func Test_ListenerAuth(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	defer h.Stop()
+	public := NewListenerConfig("tcp://127.0.0.1:0")
+	public.Auth = &Auth{
+		Users: map[string]string{"sensor": "password"},
+		ACLs:  map[string]*ACL{"sensor": {Publish: []string{"sensors/#"}, Subscribe: []string{"sensors/+/cmd"}}},
+	}
+	internal := NewListenerConfig("tcp://127.0.0.1:0")
+	internal.Auth = &Auth{AllowAnonymous: true}
+	if err := h.AddListener("public", public); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	if err := h.AddListener("internal", internal); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+
+	if conn, rc := connectListener(t, h, "public", "anon", "", true); rc != CONN_REF_NOT_AUTH {
+		t.Errorf("anonymous client on the public listener got rc %d", rc)
+		conn.Close()
+	}
+	service, rc := connectListener(t, h, "internal", "service", "", true)
+	if rc != CONN_ACCEPTED {
+		t.Fatalf("anonymous client on the internal listener got rc %d", rc)
+	}
+	defer service.Close()
+	sensor, rc := connectListener(t, h, "public", "sensor", "sensor", true)
+	if rc != CONN_ACCEPTED {
+		t.Fatalf("sensor on the public listener got rc %d", rc)
+	}
+	defer sensor.Close()
+	if infos := h.Clients(); len(infos) != 2 || infos[0].Listener != "public" || infos[1].Listener != "internal" {
+		t.Errorf("clients should show the listeners they connected to: %+v", infos)
+	}
+
+	subscribe := func(conn net.Conn, filters ...string) []byte {
+		sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+		sp.MessageID = 1
+		sp.Topics = filters
+		sp.Qoss = make([]byte, len(filters))
+		sp.Write(conn)
+		rp, err := ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("no SUBACK: %s", err.Error())
+		}
+		return rp.(*SubackPacket).GrantedQoss
+	}
+	if granted := subscribe(service, "#"); granted[0] != 0 {
+		t.Errorf("internal client was refused #")
+	}
+	if granted := subscribe(sensor, "sensors/a/cmd", "sensors/#", "$share/g/sensors/b/cmd"); granted[0] != 0 || granted[1] != 0x80 || granted[2] != 0 {
+		t.Errorf("sensor subscriptions granted %v, should be [0 128 0]", granted)
+	}
+
+	//a publish outside the ACL is acknowledged but not delivered
+	for _, topic := range []string{"other", "sensors/a/temp"} {
+		pp := NewControlPacket(PUBLISH).(*PublishPacket)
+		pp.TopicName = topic
+		pp.Qos = 1
+		pp.MessageID = 1
+		pp.Write(sensor)
+		if rp, err := ReadPacket(sensor); err != nil || rp.Type() != PUBACK {
+			t.Fatalf("received %v %v, should be a PUBACK", rp, err)
+		}
+	}
+	service.SetReadDeadline(time.Now().Add(time.Second))
+	if rp, err := ReadPacket(service); err != nil || rp.(*PublishPacket).TopicName != "sensors/a/temp" {
+		t.Errorf("internal client received %v %v, should be only the message on sensors/a/temp", rp, err)
+	}
+}
+
+func Test_AnonymousReadOnly(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	defer h.Stop()
+	feed := NewListenerConfig("tcp://127.0.0.1:0")
+	feed.Auth = &Auth{
+		AllowAnonymous: true,
+		Users:          map[string]string{"publisher": "password"},
+		ACLs:           map[string]*ACL{"": {Subscribe: []string{"feeds/#"}, MaxDeniedPublishes: 2}},
+	}
+	if err := h.AddListener("feed", feed); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	reader, rc := connectListener(t, h, "feed", "reader", "", true)
+	if rc != CONN_ACCEPTED {
+		t.Fatalf("anonymous client got rc %d", rc)
+	}
+	defer reader.Close()
+	publisher, rc := connectListener(t, h, "feed", "publisher", "publisher", true)
+	if rc != CONN_ACCEPTED {
+		t.Fatalf("publisher got rc %d", rc)
+	}
+	defer publisher.Close()
+	for _, info := range h.Clients() {
+		if info.Anonymous != (info.ClientID == "reader") {
+			t.Errorf("%s has anonymous %t", info.ClientID, info.Anonymous)
+		}
+	}
+
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"feeds/weather", "private/#"}
+	sp.Qoss = []byte{1, 1}
+	sp.Write(reader)
+	if rp, err := ReadPacket(reader); err != nil || rp.(*SubackPacket).GrantedQoss[0] != 1 || rp.(*SubackPacket).GrantedQoss[1] != 0x80 {
+		t.Fatalf("anonymous subscribe returned %v %v, should grant feeds/weather and refuse private/#", rp, err)
+	}
+	//the authenticated client has no ACL and publishes as usual
+	publish := func(conn net.Conn, id uint16) (ControlPacket, error) {
+		pp := NewControlPacket(PUBLISH).(*PublishPacket)
+		pp.TopicName = "feeds/weather"
+		pp.Qos = 1
+		pp.MessageID = id
+		pp.Payload = []byte("sunny")
+		pp.Write(conn)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		return ReadPacket(conn)
+	}
+	if rp, err := publish(publisher, 1); err != nil || rp.Type() != PUBACK {
+		t.Fatalf("publisher received %v %v, should be a PUBACK", rp, err)
+	}
+	reader.SetReadDeadline(time.Now().Add(time.Second))
+	if rp, err := ReadPacket(reader); err != nil || string(rp.(*PublishPacket).Payload) != "sunny" {
+		t.Fatalf("anonymous client received %v %v, should be the publisher's message", rp, err)
+	}
+	//an anonymous publish is acknowledged and dropped, the second disconnects the client
+	if rp, err := publish(reader, 2); err != nil || rp.Type() != PUBACK {
+		t.Fatalf("anonymous publish returned %v %v, should be acknowledged", rp, err)
+	}
+	if denied := atomic.LoadInt64(&h.stats.publishesDenied); denied != 1 {
+		t.Errorf("%d denied publishes were counted, should be 1", denied)
+	}
+	if rp, err := publish(reader, 3); err == nil {
+		t.Errorf("anonymous client received %v after its second denied publish, should be disconnected", rp)
+	}
+	waitFor(t, "anonymous client to disconnect", func() bool {
+		info, ok := h.Client("reader")
+		return !ok || !info.Connected
+	})
+}
+
+func Test_ACLCovers(t *testing.T) {
+	for _, test := range []struct {
+		allowed, filter string
+		covered         bool
+	}{
+		{"sensors/#", "sensors/+/temp", true},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "#", false},
+		{"sensors/+/cmd", "sensors/a/cmd", true},
+		{"sensors/+/cmd", "sensors/+/cmd", true},
+		{"sensors/+/cmd", "sensors/#", false},
+		{"sensors/+/cmd", "sensors/a", false},
+		{"#", "$SYS/broker", false},
+	} {
+		if covered := covers(strings.Split(test.allowed, "/"), strings.Split(test.filter, "/")); covered != test.covered {
+			t.Errorf("covers(%s, %s) is %t", test.allowed, test.filter, covered)
+		}
+	}
+}
+
+func Test_SocketActivation(t *testing.T) {
+	//an inherited socket is passed as a bare file descriptor
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	f, err := ln.(*net.TCPListener).File()
+	ln.Close()
+	if err != nil {
+		t.Fatalf("failed to get socket file: %s", err.Error())
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatalf("failed to dup socket: %s", err.Error())
+	}
+	inherited, err := listenersFromFDs(fd, 1)
+	if err != nil || len(inherited) != 1 {
+		t.Fatalf("inherited %v: %v", inherited, err)
+	}
+	port := inherited[0].Addr().(*net.TCPAddr).Port
+
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.InheritedListeners = inherited
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:"+strconv.Itoa(port))); err != nil {
+		t.Fatalf("failed to start listener on inherited socket: %s", err.Error())
+	}
+	defer h.Stop()
+	if len(h.InheritedListeners) != 0 {
+		t.Errorf("inherited socket wasn't taken by the listener")
+	}
+	//a normally bound listener works alongside it
+	if err := h.AddListener("bound", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	conn := connectTestClient(t, h, "activated", true)
+	conn.Close()
+	if _, ok := h.Client("activated"); !ok {
+		t.Errorf("client didn't connect over the inherited socket")
+	}
+
+	for _, test := range []struct {
+		configured, inherited string
+		matches               bool
+	}{
+		{"0.0.0.0:1883", "[::]:1883", true},
+		{":1883", "0.0.0.0:1883", true},
+		{"127.0.0.1:1883", "127.0.0.1:1883", true},
+		{"127.0.0.1:1883", "[::]:1883", false},
+		{"0.0.0.0:1883", "0.0.0.0:8883", false},
+	} {
+		configured, _ := net.ResolveTCPAddr("tcp", test.configured)
+		inherited, _ := net.ResolveTCPAddr("tcp", test.inherited)
+		if addressMatches(configured, inherited) != test.matches {
+			t.Errorf("%s matching inherited %s should be %t", test.configured, test.inherited, test.matches)
+		}
+	}
+}
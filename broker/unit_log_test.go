@@ -0,0 +1,56 @@
+package hrotti
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+//testLogLines returns the lines logged by l while f runs, in text or JSON
+func testLogLines(l *logger, asJSON bool, f func()) []string {
+	var buf bytes.Buffer
+	l.output = &logOutput{w: &buf, json: asJSON}
+	f()
+	if buf.Len() == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+func Test_Logging(t *testing.T) {
+	l := &logger{component: "testcomponent", level: int32(LogInfo)}
+	lines := testLogLines(l, false, func() {
+		l.Debug("Not logged", "client", "a")
+		l.Info("Client disconnected", "client", "a", "reason", "read error", "err", errors.New("EOF"))
+	})
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines at info, should be 1: %q", len(lines), lines)
+	}
+	if !strings.HasSuffix(lines[0], ` INFO  testcomponent: Client disconnected client=a reason="read error" err=EOF`) {
+		t.Errorf("bad text log line %q", lines[0])
+	}
+
+	l.level = int32(LogTrace)
+	lines = testLogLines(l, true, func() {
+		l.Trace("Received PUBLISH", "client", "a", "qos", 1)
+	})
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines at trace, should be 1: %q", len(lines), lines)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("bad JSON log line %q: %s", lines[0], err.Error())
+	}
+	if entry["level"] != "trace" || entry["component"] != "testcomponent" || entry["msg"] != "Received PUBLISH" || entry["client"] != "a" || entry["qos"] != float64(1) {
+		t.Errorf("bad JSON log entry %v", entry)
+	}
+
+	if err := SetLogLevel("nothing", LogDebug); err == nil {
+		t.Errorf("set the level of an unknown component")
+	}
+	if level, err := ParseLogLevel("warn"); err != nil || level != LogWarn {
+		t.Errorf("warn parsed as %s %v", level, err)
+	}
+}
@@ -0,0 +1,97 @@
+package hrotti
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+//mdnsQuery asks for name's records of type t and returns the answers the responder gives
+func mdnsQuery(t *testing.T, r *mdnsResponder, name string, qtype dnsmessage.Type) []dnsmessage.Resource {
+	msg := dnsmessage.Message{Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}}}
+	query, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %s", err.Error())
+	}
+	response, ok := r.respond(query, false)
+	if !ok {
+		return nil
+	}
+	if err := msg.Unpack(response); err != nil {
+		t.Fatalf("failed to unpack response: %s", err.Error())
+	}
+	return msg.Answers
+}
+
+func Test_MDNSResponder(t *testing.T) {
+	r := newMDNSResponder("hrotti", nil)
+	addr := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 1883}
+	r.advertise("plain", "tcp", addr)
+	r.advertise("secure", "tls", &net.TCPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 8883})
+	//neither of these are advertised
+	r.advertise("local", "tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1884})
+	r.advertise("websocket", "ws", &net.TCPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 8080})
+
+	answers := mdnsQuery(t, r, "_mqtt._tcp.local.", dnsmessage.TypePTR)
+	var ptr, srv, txt bool
+	for _, answer := range answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if answer.Header.Name.String() == "_mqtt._tcp.local." && body.PTR.String() == "hrotti._mqtt._tcp.local." {
+				ptr = true
+			}
+		case *dnsmessage.SRVResource:
+			if answer.Header.Name.String() == "hrotti._mqtt._tcp.local." && body.Port == 1883 {
+				srv = true
+			}
+		case *dnsmessage.TXTResource:
+			if answer.Header.Name.String() == "hrotti._mqtt._tcp.local." && strings.Join(body.TXT, " ") == "txtvers=1 protocols=3.1,3.1.1" {
+				txt = true
+			}
+		}
+		if answer.Header.TTL != mdnsTTL {
+			t.Errorf("%s has a TTL of %d, should be %d", answer.Header.Name, answer.Header.TTL, mdnsTTL)
+		}
+	}
+	if !ptr || !srv || !txt {
+		t.Errorf("answers %v should have the PTR, SRV and TXT of the tcp listener", answers)
+	}
+	if answers := mdnsQuery(t, r, "_secure-mqtt._tcp.local.", dnsmessage.TypePTR); len(answers) == 0 {
+		t.Errorf("the tls listener wasn't advertised")
+	}
+	if answers := mdnsQuery(t, r, "_printer._tcp.local.", dnsmessage.TypePTR); answers != nil {
+		t.Errorf("a query for another service was answered with %v", answers)
+	}
+	if _, ok := r.listeners["local"]; ok {
+		t.Errorf("a listener on a loopback address was advertised")
+	}
+	if _, ok := r.listeners["websocket"]; ok {
+		t.Errorf("a websocket listener was advertised")
+	}
+
+	//a second tcp listener gives each an instance of its own
+	r.advertise("other", "tcp", &net.TCPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 1885})
+	instances := make(map[string]bool)
+	for _, answer := range mdnsQuery(t, r, "_mqtt._tcp.local.", dnsmessage.TypePTR) {
+		if body, ok := answer.Body.(*dnsmessage.PTRResource); ok && answer.Header.Name.String() == "_mqtt._tcp.local." {
+			instances[body.PTR.String()] = true
+		}
+	}
+	if !instances["hrotti (plain)._mqtt._tcp.local."] || !instances["hrotti (other)._mqtt._tcp.local."] {
+		t.Errorf("instances are %v, should be named after each listener", instances)
+	}
+
+	//a withdrawn listener's records go
+	r.withdraw("other")
+	r.withdraw("secure")
+	if answers := mdnsQuery(t, r, "_secure-mqtt._tcp.local.", dnsmessage.TypePTR); answers != nil {
+		t.Errorf("a withdrawn listener was still advertised with %v", answers)
+	}
+	for _, record := range r.records(0) {
+		if record.Header.TTL != 0 {
+			t.Errorf("goodbye for %s has a TTL of %d", record.Header.Name, record.Header.TTL)
+		}
+	}
+}
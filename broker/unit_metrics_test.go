@@ -0,0 +1,110 @@
+package hrotti
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+func Test_Metrics(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	conn := dialTestClient(t, h, "metrics\"test", "a/#")
+	defer conn.Close()
+	setRetained(h, "a/b", "retained")
+
+	recorder := httptest.NewRecorder()
+	h.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	metrics := string(body)
+	for _, expected := range []string{
+		`hrotti_packets_received_total{type="CONNECT"} 1`,
+		`hrotti_packets_received_total{type="SUBSCRIBE"} 1`,
+		`hrotti_packets_sent_total{type="CONNACK"} 1`,
+		`hrotti_packets_sent_total{type="SUBACK"} 1`,
+		`hrotti_connections_total{code="0"} 1`,
+		`hrotti_clients_connected 1`,
+		`hrotti_subscriptions 1`,
+		`hrotti_retained_messages 1`,
+		`hrotti_client_queue_depth{client_id="metrics\"test"} 0`,
+		"# TYPE hrotti_bytes_received_total counter",
+	} {
+		if !strings.Contains(metrics, expected+"\n") {
+			t.Errorf("metrics do not contain %s", expected)
+		}
+	}
+	if strings.Contains(metrics, "hrotti_bytes_received_total 0\n") || strings.Contains(metrics, "hrotti_bytes_sent_total 0\n") {
+		t.Errorf("bytes were not counted")
+	}
+}
+
+func Test_TopicMetrics(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	//the $SYS messages publishStats routes are counted too, so they mustn't land in other
+	h.TopicMetrics = []string{"telemetry/", "a", "a/b/", "$SYS/"}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	c := newTestClient(h, "subscriber")
+	h.AddSub(c, "telemetry/#", SubscriptionOptions{})
+
+	start := time.Now()
+	for _, topic := range []string{"telemetry/temp", "telemetry/humidity", "a/b/c", "a/x", "telemetryx/temp"} {
+		publish(h, topic, nil)
+	}
+	for _, payload := range []string{"21.5", ""} {
+		pp := NewControlPacket(PUBLISH).(*PublishPacket)
+		pp.TopicName = "telemetry/temp"
+		pp.Payload = []byte(payload)
+		pp.Retain = true
+		h.setRetained(newMessage(pp.TopicName, pp))
+	}
+
+	recorder := httptest.NewRecorder()
+	h.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	metrics := string(body)
+	for _, expected := range []string{
+		`hrotti_topic_messages_total{prefix="telemetry/"} 2`,
+		`hrotti_topic_bytes_total{prefix="telemetry/"} 8`,
+		`hrotti_topic_subscribers_matched_total{prefix="telemetry/"} 2`,
+		`hrotti_topic_retained_set_total{prefix="telemetry/"} 1`,
+		`hrotti_topic_retained_cleared_total{prefix="telemetry/"} 1`,
+		`hrotti_topic_messages_total{prefix="a/b/"} 1`,
+		`hrotti_topic_messages_total{prefix="a"} 1`,
+		`hrotti_topic_messages_total{prefix="other"} 1`,
+		`hrotti_topic_subscribers_matched_total{prefix="other"} 0`,
+	} {
+		if !strings.Contains(metrics, expected+"\n") {
+			t.Errorf("metrics do not contain %s", expected)
+		}
+	}
+
+	h.publishStats()
+	for topic, expected := range map[string]string{
+		"$SYS/broker/load/topics/telemetry/messages": "2",
+		"$SYS/broker/load/topics/a/b/messages":       "1",
+		"$SYS/broker/load/topics/other/messages":     "1",
+	} {
+		msg := h.retainedMessage(topic)
+		if msg == nil || string(msg.Payload) != expected {
+			t.Errorf("%s is %v, should be %s", topic, msg, expected)
+		}
+	}
+	//the time the last message under each prefix was received
+	last := h.retainedMessage("$SYS/broker/messages/last/telemetry")
+	if last == nil {
+		t.Fatalf("the last message received under telemetry/ wasn't published")
+	}
+	if received, err := time.Parse(time.RFC3339Nano, string(last.Payload)); err != nil || received.Before(start) || received.After(time.Now()) {
+		t.Errorf("the last message under telemetry/ was received at %s, should be after %v", last.Payload, start)
+	}
+}
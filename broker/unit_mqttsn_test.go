@@ -0,0 +1,196 @@
+package hrotti
+
+import (
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alsm/hrotti/mqttsn"
+	. "github.com/alsm/hrotti/packets"
+)
+
+func snBroker(t *testing.T, clock Clock) *Hrotti {
+	h := NewHrotti(100, &MemoryPersistence{})
+	if clock != nil {
+		h.Clock = clock
+	}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	if err := h.AddListener("sn", NewListenerConfig("mqttsn://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start MQTT-SN listener: %s", err.Error())
+	}
+	return h
+}
+
+//snDial connects an MQTT-SN client with a keepalive of 30 seconds and checks it is accepted
+func snDial(t *testing.T, h *Hrotti, id string) *net.UDPConn {
+	conn, err := net.DialUDP("udp", nil, h.listeners["sn"].ln.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial the gateway: %s", err.Error())
+	}
+	snSend(conn, &mqttsn.Connect{ProtocolID: mqttsn.ProtocolID, Duration: 30, ClientID: id})
+	snExpect(t, conn, &mqttsn.Connack{ReturnCode: mqttsn.Accepted})
+	return conn
+}
+
+func snSend(conn *net.UDPConn, p mqttsn.Packet) {
+	conn.Write(p.Pack())
+}
+
+//snRead returns the next message the gateway sends, or nil if there isn't one within wait
+func snRead(t *testing.T, conn *net.UDPConn, wait time.Duration) mqttsn.Packet {
+	buf := make([]byte, 65535)
+	conn.SetReadDeadline(time.Now().Add(wait))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	p, err := mqttsn.Decode(buf[:n])
+	if err != nil {
+		t.Fatalf("gateway sent a bad message % x: %s", buf[:n], err.Error())
+	}
+	return p
+}
+
+//snExpect checks the next message the gateway sends is want
+func snExpect(t *testing.T, conn *net.UDPConn, want mqttsn.Packet) {
+	t.Helper()
+	if p := snRead(t, conn, time.Second); !reflect.DeepEqual(p, want) {
+		t.Fatalf("gateway sent %#v, should be %#v", p, want)
+	}
+}
+
+//inflight returns the number of messages sent to id that it hasn't acknowledged
+func inflight(h *Hrotti, id string) int {
+	c := h.getClient(id)
+	c.messageIDs.Lock()
+	defer c.messageIDs.Unlock()
+	return len(c.sent)
+}
+
+func Test_MQTTSNPublishSubscribe(t *testing.T) {
+	h := snBroker(t, nil)
+	defer h.Stop()
+	sub := dialTestClient(t, h, "sub", "sensors/#")
+	defer sub.Close()
+	sn := snDial(t, h, "sensor")
+	defer sn.Close()
+
+	//a topic is published to by the id the client registered it as
+	snSend(sn, &mqttsn.Register{MsgID: 1, TopicName: "sensors/1/temp"})
+	regack, ok := snRead(t, sn, time.Second).(*mqttsn.Regack)
+	if !ok || regack.TopicID == 0 || regack.MsgID != 1 || regack.ReturnCode != mqttsn.Accepted {
+		t.Fatalf("REGISTER answered with %#v", regack)
+	}
+	snSend(sn, &mqttsn.Publish{Qos: 1, TopicID: regack.TopicID, MsgID: 2, Data: []byte("21.5")})
+	snExpect(t, sn, &mqttsn.Puback{TopicID: regack.TopicID, MsgID: 2, ReturnCode: mqttsn.Accepted})
+	if pp := readPublish(t, sub, time.Second); pp == nil || pp.TopicName != "sensors/1/temp" || string(pp.Payload) != "21.5" {
+		t.Errorf("subscriber received %v, should be 21.5 on sensors/1/temp", pp)
+	}
+	snSend(sn, &mqttsn.Publish{TopicID: 99, Data: []byte("lost")})
+	snExpect(t, sn, &mqttsn.Puback{TopicID: 99, ReturnCode: mqttsn.RejectedInvalidTopicID})
+	//a short topic name needs no registering
+	snSend(sn, &mqttsn.Publish{Retain: true, TopicIDType: mqttsn.TopicShortName, TopicID: mqttsn.ShortTopicID("ab"), Data: []byte("short")})
+	waitFor(t, "the short topic to be retained", func() bool {
+		_, _, ok := h.subs.retained.get("ab")
+		return ok
+	})
+
+	//a subscription to a topic name is given its id in the SUBACK, a filter isn't
+	snSend(sn, &mqttsn.Subscribe{Qos: 1, MsgID: 3, TopicName: "cmd/1"})
+	suback, ok := snRead(t, sn, time.Second).(*mqttsn.Suback)
+	if !ok || suback.TopicID == 0 || suback.Qos != 1 || suback.ReturnCode != mqttsn.Accepted {
+		t.Fatalf("SUBSCRIBE answered with %#v", suback)
+	}
+	snSend(sn, &mqttsn.Subscribe{Qos: 2, MsgID: 4, TopicName: "cmd/+"})
+	snExpect(t, sn, &mqttsn.Suback{Qos: 1, MsgID: 4, ReturnCode: mqttsn.Accepted})
+	h.Publish("cmd/1", []byte("on"), 1, false)
+	pub, ok := snRead(t, sn, time.Second).(*mqttsn.Publish)
+	if !ok || pub.TopicID != suback.TopicID || pub.Qos != 1 || string(pub.Data) != "on" {
+		t.Fatalf("client received %#v, should be on as topic %d", pub, suback.TopicID)
+	}
+	snSend(sn, &mqttsn.Puback{TopicID: pub.TopicID, MsgID: pub.MsgID})
+	waitFor(t, "the PUBACK to reach the broker", func() bool { return inflight(h, "sensor") == 0 })
+
+	//a topic the client doesn't know is registered before it is published to
+	h.Publish("cmd/2", []byte("off"), 0, false)
+	register, ok := snRead(t, sn, time.Second).(*mqttsn.Register)
+	if !ok || register.TopicName != "cmd/2" {
+		t.Fatalf("client received %#v, should be a REGISTER of cmd/2", register)
+	}
+	if p := snRead(t, sn, 100*time.Millisecond); p != nil {
+		t.Fatalf("client sent %#v before it acknowledged the REGISTER", p)
+	}
+	snSend(sn, &mqttsn.Regack{TopicID: register.TopicID, MsgID: register.MsgID, ReturnCode: mqttsn.Accepted})
+	snExpect(t, sn, &mqttsn.Publish{TopicID: register.TopicID, Data: []byte("off")})
+
+	//the client's DISCONNECT ends its connection
+	snSend(sn, &mqttsn.Disconnect{})
+	snExpect(t, sn, &mqttsn.Disconnect{})
+	waitFor(t, "the client to disconnect", func() bool { return !h.getClient("sensor").Connected() })
+	if n := atomic.LoadInt64(&h.stats.mqttsnClients); n != 0 {
+		t.Errorf("%d MQTT-SN clients after the only one disconnected", n)
+	}
+	snSend(sn, &mqttsn.Connect{Will: true, ProtocolID: mqttsn.ProtocolID, ClientID: "sensor"})
+	snExpect(t, sn, &mqttsn.Connack{ReturnCode: mqttsn.RejectedNotSupported})
+}
+
+func Test_MQTTSNSleep(t *testing.T) {
+	clock := newFakeClock()
+	h := snBroker(t, clock)
+	defer h.Stop()
+	sn := snDial(t, h, "sensor")
+	defer sn.Close()
+	snSend(sn, &mqttsn.Subscribe{Qos: 1, MsgID: 1, TopicName: "cmd/#"})
+	snExpect(t, sn, &mqttsn.Suback{Qos: 1, MsgID: 1, ReturnCode: mqttsn.Accepted})
+	snSend(sn, &mqttsn.Disconnect{Duration: 60})
+	snExpect(t, sn, &mqttsn.Disconnect{})
+	waitFor(t, "the client to be given 90 seconds to wake", func() bool { return clock.waiting(90 * time.Second) })
+	if n := atomic.LoadInt64(&h.stats.mqttsnSleeping); n != 1 {
+		t.Errorf("%d clients sleeping, should be 1", n)
+	}
+
+	//messages for a sleeping client are held until it wakes, then sent before the PINGRESP
+	h.Publish("cmd/a", []byte("one"), 1, false)
+	h.Publish("cmd/a", []byte("two"), 0, false)
+	if p := snRead(t, sn, 100*time.Millisecond); p != nil {
+		t.Fatalf("sleeping client was sent %#v", p)
+	}
+	snSend(sn, &mqttsn.Pingreq{ClientID: "sensor"})
+	register, ok := snRead(t, sn, time.Second).(*mqttsn.Register)
+	if !ok || register.TopicName != "cmd/a" {
+		t.Fatalf("woken client received %#v, should be a REGISTER of cmd/a", register)
+	}
+	snSend(sn, &mqttsn.Regack{TopicID: register.TopicID, MsgID: register.MsgID, ReturnCode: mqttsn.Accepted})
+	one, ok := snRead(t, sn, time.Second).(*mqttsn.Publish)
+	if !ok || one.Qos != 1 || string(one.Data) != "one" {
+		t.Fatalf("woken client received %#v, should be one at QoS 1", one)
+	}
+	snExpect(t, sn, &mqttsn.Publish{TopicID: register.TopicID, Data: []byte("two")})
+	snExpect(t, sn, &mqttsn.Pingresp{})
+	snSend(sn, &mqttsn.Puback{TopicID: one.TopicID, MsgID: one.MsgID})
+	waitFor(t, "the PUBACK to reach the broker", func() bool { return inflight(h, "sensor") == 0 })
+
+	//the gateway keeps the session alive while the client sleeps
+	for i := 0; i < 2; i++ {
+		pings := atomic.LoadInt64(&h.stats.packetsReceived[PINGREQ])
+		clock.Advance(30 * time.Second)
+		waitFor(t, "the gateway to ping the broker", func() bool {
+			return atomic.LoadInt64(&h.stats.packetsReceived[PINGREQ]) > pings && clock.waiting(45*time.Second)
+		})
+	}
+	if !h.getClient("sensor").Connected() {
+		t.Fatalf("sleeping client disconnected after 60 seconds")
+	}
+	//but it has gone if it doesn't wake within one and a half times its sleep
+	clock.Advance(30 * time.Second)
+	waitFor(t, "the client to be disconnected", func() bool { return !h.getClient("sensor").Connected() })
+	waitFor(t, "the client to be forgotten", func() bool {
+		return atomic.LoadInt64(&h.stats.mqttsnClients) == 0 && atomic.LoadInt64(&h.stats.mqttsnSleeping) == 0
+	})
+	snSend(sn, &mqttsn.Pingreq{ClientID: "sensor"})
+	snExpect(t, sn, &mqttsn.Disconnect{})
+}
@@ -0,0 +1,544 @@
+package hrotti
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+func countInflight(p Persistence, client string) int {
+	count := 0
+	p.RangeInflight(client, func(dirFlag, uint16, ControlPacket) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+func testPersistence(t *testing.T, p Persistence) {
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "a/b"
+	pp.Payload = []byte("hello")
+	pp.Qos = 1
+	pp.Retain = true
+	//a request's properties have to survive storage for its response to find its way back
+	pp.Properties = &Properties{ResponseTopic: "replies/1", CorrelationData: []byte{0, 1}, UserProperties: []UserProperty{{Key: "k", Value: "v"}, {Key: "k", Value: "w"}}}
+	//as does the time it was received, for a message delivered long after it was published
+	received := time.Unix(1700000000, 123456789)
+	pp.ReceivedAt = received
+	p.StoreRetained("a/b", pp)
+	p.StoreRetained("a/c", pp)
+	p.DeleteRetained("a/c")
+	var topics []string
+	p.RangeRetained(func(topic string, message *PublishPacket) bool {
+		if string(message.Payload) != "hello" || message.Qos != 1 || !message.Retain {
+			t.Errorf("retained message for %s is %v", topic, message)
+		}
+		if props := message.Properties; props == nil || props.ResponseTopic != "replies/1" || string(props.CorrelationData) != "\x00\x01" || len(props.UserProperties) != 2 || props.UserProperties[1].Value != "w" {
+			t.Errorf("retained message for %s has properties %+v", topic, props)
+		}
+		if !message.ReceivedAt.Equal(received) {
+			t.Errorf("retained message for %s was received at %v, should be %v", topic, message.ReceivedAt, received)
+		}
+		topics = append(topics, topic)
+		return true
+	})
+	if len(topics) != 1 || topics[0] != "a/b" {
+		t.Errorf("retained topics are %v, should be [a/b]", topics)
+	}
+	if message, err := p.LoadRetained("a/b"); err != nil || message == nil || string(message.Payload) != "hello" || !message.ReceivedAt.Equal(received) {
+		t.Errorf("loaded retained message for a/b is %v, %v", message, err)
+	}
+	if message, err := p.LoadRetained("a/c"); err != nil || message != nil {
+		t.Errorf("loaded retained message for a/c is %v, %v, should be nil", message, err)
+	}
+
+	session := &Session{Subscriptions: map[string]SubscriptionOptions{"a/#": {Qos: 2, NoLocal: true}}}
+	p.StoreSession("client", session)
+	if loaded, err := p.LoadSession("client"); err != nil || loaded == nil || loaded.Subscriptions["a/#"] != session.Subscriptions["a/#"] {
+		t.Errorf("loaded session is %v %v", loaded, err)
+	}
+	if loaded, _ := p.LoadSession("unknown"); loaded != nil {
+		t.Errorf("loaded session for an unknown client")
+	}
+
+	pp.MessageID = 2
+	prel := NewControlPacket(PUBREL).(*PubrelPacket)
+	prel.MessageID = 1
+	p.StoreInflight("client", OUTBOUND, 2, pp)
+	p.StoreInflight("client", OUTBOUND, 1, pp)
+	p.StoreInflight("client", OUTBOUND, 1, prel)
+	p.StoreInflight("client", INBOUND, 1, pp)
+	p.StoreInflight("client", OUTBOUND, 3, pp)
+	p.DeleteInflight("client", OUTBOUND, 3)
+	var ids []uint16
+	var directions []dirFlag
+	p.RangeInflight("client", func(direction dirFlag, msgID uint16, message ControlPacket) bool {
+		ids = append(ids, msgID)
+		directions = append(directions, direction)
+		if direction == OUTBOUND && msgID == 1 {
+			if _, ok := message.(*PubrelPacket); !ok {
+				t.Errorf("outbound message 1 should have been replaced by its PUBREL")
+			}
+		}
+		if stored, ok := message.(*PublishPacket); ok && (stored.Properties == nil || stored.Properties.ResponseTopic != "replies/1") {
+			t.Errorf("inflight message %d lost its properties", msgID)
+		}
+		if stored, ok := message.(*PublishPacket); ok && !stored.ReceivedAt.Equal(received) {
+			t.Errorf("inflight message %d was received at %v, should be %v", msgID, stored.ReceivedAt, received)
+		}
+		return true
+	})
+	if len(ids) != 3 || directions[0] != INBOUND || ids[1] != 1 || ids[2] != 2 {
+		t.Errorf("inflight messages are %v %v", directions, ids)
+	}
+
+	p.DeleteSession("client")
+	if loaded, _ := p.LoadSession("client"); loaded != nil {
+		t.Errorf("session still exists after being deleted")
+	}
+	if count := countInflight(p, "client"); count != 0 {
+		t.Errorf("%d inflight messages left after the session was deleted", count)
+	}
+}
+
+func Test_MemoryPersistence(t *testing.T) {
+	p := &MemoryPersistence{}
+	p.Open()
+	testPersistence(t, p)
+}
+
+func Test_BoltPersistence(t *testing.T) {
+	p := &BoltPersistence{Path: filepath.Join(t.TempDir(), "hrotti.db")}
+	if err := p.Open(); err != nil {
+		t.Fatalf("failed to open bolt persistence: %s", err.Error())
+	}
+	defer p.Close()
+	testPersistence(t, p)
+}
+
+func Test_BoltRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hrotti.db")
+	h := NewHrotti(100, &BoltPersistence{Path: path})
+	h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0"))
+	conn := connectTestClient(t, h, "durable", false)
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"a/#"}
+	sp.Qoss = []byte{1}
+	sp.Write(conn)
+	ReadPacket(conn)
+	conn.Close()
+	waitFor(t, "client to disconnect", func() bool {
+		return !h.getClient("durable").Connected()
+	})
+
+	h.Publish("a/b", []byte("offline"), 1, false)
+	h.Publish("r/1", []byte("retained"), 0, true)
+	waitFor(t, "message to be persisted", func() bool {
+		return countInflight(h.PersistStore, "durable") == 1
+	})
+	h.Stop()
+
+	h = NewHrotti(100, &BoltPersistence{Path: path})
+	h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0"))
+	defer h.Stop()
+	if retained := h.Retained(); len(retained) != 1 || retained[0].Topic != "r/1" {
+		t.Errorf("retained messages after restart are %+v", retained)
+	}
+	//the subscription is restored so messages published before the client reconnects are kept
+	h.Publish("a/c", []byte("restarted"), 1, false)
+	waitFor(t, "message to be persisted", func() bool {
+		return countInflight(h.PersistStore, "durable") == 2
+	})
+
+	conn = connectTestClient(t, h, "durable", false)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, expected := range []string{"offline", "restarted"} {
+		rp, err := ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("failed to read redelivered message: %s", err.Error())
+		}
+		pp := rp.(*PublishPacket)
+		if string(pp.Payload) != expected || !pp.Dup || pp.Qos != 1 {
+			t.Errorf("redelivered message is %v, should be %s with dup set", pp, expected)
+		}
+		pa := NewControlPacket(PUBACK).(*PubackPacket)
+		pa.MessageID = pp.MessageID
+		pa.Write(conn)
+	}
+	waitFor(t, "acknowledged messages to be removed", func() bool {
+		return countInflight(h.PersistStore, "durable") == 0
+	})
+}
+
+//after a restart a durable client gets sessionPresent and its messages without subscribing again
+func Test_WarmRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hrotti.db")
+	h := NewHrotti(100, &BoltPersistence{Path: path})
+	h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0"))
+	conn := connectTestClient(t, h, "durable", false)
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"a/#", "b/+"}
+	sp.Qoss = []byte{1, 0}
+	sp.Write(conn)
+	ReadPacket(conn)
+	conn.Close()
+	waitFor(t, "client to disconnect", func() bool {
+		return !h.getClient("durable").Connected()
+	})
+	h.Stop()
+
+	h = NewHrotti(100, &BoltPersistence{Path: path})
+	h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0"))
+	defer h.Stop()
+	var metrics bytes.Buffer
+	h.writeMetrics(&metrics)
+	for _, expected := range []string{"hrotti_recovered_sessions 1\n", "hrotti_recovered_subscriptions 2\n"} {
+		if !strings.Contains(metrics.String(), expected) {
+			t.Errorf("metrics don't contain %q", expected)
+		}
+	}
+
+	conn, _ = net.Dial("tcp", h.listeners["test"].ln.Addr().String())
+	defer conn.Close()
+	cp := newConnect("durable")
+	cp.CleanSession = false
+	cp.Write(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	rp, err := ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("no CONNACK: %s", err.Error())
+	}
+	if ca := rp.(*ConnackPacket); ca.ReturnCode != CONN_ACCEPTED || ca.TopicNameCompression != 1 {
+		t.Errorf("CONNACK is %v, should be accepted with session present", ca)
+	}
+	h.Publish("b/c", []byte("restored"), 0, false)
+	rp, err = ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("no message for the restored subscription: %s", err.Error())
+	}
+	if pp, ok := rp.(*PublishPacket); !ok || string(pp.Payload) != "restored" {
+		t.Errorf("received %v, should be the message published to b/c", rp)
+	}
+}
+
+func Test_SessionExpiry(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.SessionExpiry = 200 * time.Millisecond
+	h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0"))
+	defer h.Stop()
+	connected := connectTestClient(t, h, "connected", false)
+	defer connected.Close()
+	conn := connectTestClient(t, h, "gone", false)
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"a/#"}
+	sp.Qoss = []byte{1}
+	sp.Write(conn)
+	ReadPacket(conn)
+	NewControlPacket(DISCONNECT).Write(conn)
+	conn.Close()
+	waitFor(t, "client to disconnect", func() bool {
+		return !h.getClient("gone").Connected()
+	})
+	if session, err := h.PersistStore.LoadSession("gone"); err != nil || session.DisconnectedAt.IsZero() {
+		t.Errorf("session was saved without when the client disconnected: %+v %v", session, err)
+	}
+	h.Publish("a/b", []byte("offline"), 1, false)
+	waitFor(t, "message to be persisted", func() bool {
+		return countInflight(h.PersistStore, "gone") == 1
+	})
+
+	waitFor(t, "session to expire", func() bool { return h.getClient("gone") == nil })
+	if subs := h.subs.clientSubscriptions("gone"); len(subs) != 0 {
+		t.Errorf("expired client still has subscriptions %+v", subs)
+	}
+	if session, _ := h.PersistStore.LoadSession("gone"); session != nil || countInflight(h.PersistStore, "gone") != 0 {
+		t.Errorf("expired session is still persisted")
+	}
+	//a connected client is never expired however long ago it connected
+	h.expireSessions(time.Now().Add(time.Hour))
+	if c := h.getClient("connected"); c == nil || !c.Connected() {
+		t.Errorf("connected client was expired")
+	}
+}
+
+//fakeRedis is a Redis server that keeps its data in memory and understands the commands
+//RedisPersistence uses
+type fakeRedis struct {
+	sync.Mutex
+	ln     net.Listener
+	hashes map[string]map[string]string
+	sets   map[string]map[string]bool
+	zsets  map[string]map[string]float64
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	r := &fakeRedis{
+		ln:     ln,
+		hashes: make(map[string]map[string]string),
+		sets:   make(map[string]map[string]bool),
+		zsets:  make(map[string]map[string]float64),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	var queued [][]string
+	inMulti := false
+	for {
+		command, err := readRedisReply(reader)
+		if err != nil {
+			return
+		}
+		args := redisStrings(command)
+		var reply string
+		switch {
+		case args[0] == "MULTI":
+			inMulti, queued, reply = true, nil, "+OK\r\n"
+		case args[0] == "EXEC":
+			reply = fmt.Sprintf("*%d\r\n", len(queued))
+			for _, args := range queued {
+				reply += r.execute(args)
+			}
+			inMulti = false
+		case inMulti:
+			queued = append(queued, args)
+			reply = "+QUEUED\r\n"
+		default:
+			reply = r.execute(args)
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func redisBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func redisArray(elements []string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(elements))
+	for _, element := range elements {
+		reply += redisBulk(element)
+	}
+	return reply
+}
+
+func (r *fakeRedis) execute(args []string) string {
+	r.Lock()
+	defer r.Unlock()
+	switch args[0] {
+	case "PING":
+		return "+PONG\r\n"
+	case "DEL":
+		for _, key := range args[1:] {
+			delete(r.hashes, key)
+			delete(r.sets, key)
+			delete(r.zsets, key)
+		}
+	case "HSET":
+		if r.hashes[args[1]] == nil {
+			r.hashes[args[1]] = make(map[string]string)
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			r.hashes[args[1]][args[i]] = args[i+1]
+		}
+	case "HDEL":
+		delete(r.hashes[args[1]], args[2])
+	case "HGET":
+		if value, ok := r.hashes[args[1]][args[2]]; ok {
+			return redisBulk(value)
+		}
+		return "$-1\r\n"
+	case "HGETALL":
+		var fields []string
+		for field, value := range r.hashes[args[1]] {
+			fields = append(fields, field, value)
+		}
+		return redisArray(fields)
+	case "SADD":
+		if r.sets[args[1]] == nil {
+			r.sets[args[1]] = make(map[string]bool)
+		}
+		r.sets[args[1]][args[2]] = true
+	case "SREM":
+		delete(r.sets[args[1]], args[2])
+	case "SMEMBERS":
+		var members []string
+		for member := range r.sets[args[1]] {
+			members = append(members, member)
+		}
+		return redisArray(members)
+	case "ZADD":
+		if r.zsets[args[1]] == nil {
+			r.zsets[args[1]] = make(map[string]float64)
+		}
+		score, _ := strconv.ParseFloat(args[2], 64)
+		r.zsets[args[1]][args[3]] = score
+	case "ZREM":
+		delete(r.zsets[args[1]], args[2])
+	case "ZRANGE":
+		zset := r.zsets[args[1]]
+		var members []string
+		for member := range zset {
+			members = append(members, member)
+		}
+		sort.Slice(members, func(i, j int) bool { return zset[members[i]] < zset[members[j]] })
+		return redisArray(members)
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+	return ":1\r\n"
+}
+
+func Test_RedisPersistence(t *testing.T) {
+	r := newFakeRedis(t)
+	p := &RedisPersistence{Addr: r.ln.Addr().String(), Prefix: "hrotti:", PoolSize: 2}
+	if err := p.Open(); err != nil {
+		t.Fatalf("failed to open redis persistence: %s", err.Error())
+	}
+	defer p.Close()
+	testPersistence(t, p)
+
+	disconnectedAt := time.Now().Round(0)
+	p.StoreSession("durable", &Session{Subscriptions: map[string]SubscriptionOptions{"a/b": {Qos: 1}}, DisconnectedAt: disconnectedAt})
+	var clients []string
+	p.RangeSessions(func(client string, session *Session) bool {
+		clients = append(clients, client)
+		if !session.DisconnectedAt.Equal(disconnectedAt) || session.Subscriptions["a/b"].Qos != 1 {
+			t.Errorf("session for %s is %+v", client, session)
+		}
+		return true
+	})
+	if len(clients) != 1 || clients[0] != "durable" {
+		t.Errorf("sessions are %v, should be [durable]", clients)
+	}
+	r.Lock()
+	defer r.Unlock()
+	for _, key := range []string{"hrotti:retained", "hrotti:sessions", "hrotti:session:durable"} {
+		if r.hashes[key] == nil && r.sets[key] == nil {
+			t.Errorf("nothing stored at %s", key)
+		}
+	}
+}
+
+func Test_RedisFallback(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+	h := NewHrotti(100, &RedisPersistence{Addr: addr})
+	defer h.Stop()
+	if _, ok := h.PersistStore.(*MemoryPersistence); !ok {
+		t.Fatalf("persistence is %T with redis unreachable, should be the memory fallback", h.PersistStore)
+	}
+}
+
+//stateFixture fills p with a retained message and a session with an inflight message in
+//each state
+func stateFixture(p Persistence) {
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "a/b"
+	pp.Payload = []byte("retained")
+	pp.Qos = 1
+	pp.Retain = true
+	pp.ReceivedAt = time.Unix(1700000000, 0)
+	p.StoreRetained("a/b", pp)
+	p.StoreSession("device", &Session{Subscriptions: map[string]SubscriptionOptions{"a/#": {Qos: 2}, "c": {Qos: 1}}})
+	for i, direction := range []dirFlag{OUTBOUND, INBOUND} {
+		msg := pp.Copy()
+		msg.Qos = 2
+		msg.MessageID = uint16(i + 1)
+		p.StoreInflight("device", direction, msg.MessageID, msg)
+	}
+	pr := NewControlPacket(PUBREL).(*PubrelPacket)
+	pr.MessageID = 3
+	p.StoreInflight("device", OUTBOUND, 3, pr)
+}
+
+func Test_ExportImportState(t *testing.T) {
+	source := &MemoryPersistence{}
+	source.Open()
+	stateFixture(source)
+	var state bytes.Buffer
+	counts, err := ExportState(source, &state)
+	if expected := (StateCounts{Sessions: 1, Subscriptions: 2, Retained: 1, Inflight: 3}); err != nil || counts != expected {
+		t.Fatalf("exported %+v, %v, should be %+v", counts, err, expected)
+	}
+
+	//a file that is wrong in any way loads nothing
+	lines := strings.SplitAfter(state.String(), "\n")
+	for _, test := range []struct {
+		name  string
+		state string
+	}{
+		{"empty", ""},
+		{"another version", strings.Replace(state.String(), `"version":1`, `"version":2`, 1)},
+		{"cut short", strings.Join(lines[:len(lines)-2], "")},
+		{"duplicate session", strings.Join(append(lines[:3:3], lines[2:]...), "")},
+		{"corrupt packet", strings.Replace(state.String(), `"packet":"`, `"packet":"AA`, 1)},
+		{"inflight without a session", lines[0] + lines[1] + lines[3] + lines[len(lines)-2]},
+	} {
+		target := &MemoryPersistence{}
+		target.Open()
+		if _, err := ImportState(strings.NewReader(test.state), target); err == nil {
+			t.Errorf("%s: state file was imported", test.name)
+		}
+		if len(target.retained) != 0 || len(target.sessions) != 0 || len(target.inflight) != 0 {
+			t.Errorf("%s: state was stored", test.name)
+		}
+	}
+
+	//moving the state to bolt and starting a broker on it restores the session
+	path := filepath.Join(t.TempDir(), "hrotti.db")
+	b := NewBroker(WithPersistence(&BoltPersistence{Path: path}), WithImportedState(bytes.NewReader(state.Bytes())))
+	if err := b.Start(); err != nil {
+		t.Fatalf("failed to start broker with imported state: %s", err.Error())
+	}
+	h := b.Hrotti()
+	if subs, ok := h.ClientSubscriptions("device"); !ok || len(subs) != 2 {
+		t.Errorf("device has subscriptions %v, should have 2", subs)
+	}
+	if msg := h.retainedMessage("a/b"); msg == nil || string(msg.Payload) != "retained" || !msg.ReceivedAt.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("retained message is %v", msg)
+	}
+	if n := countInflight(h.PersistStore, "device"); n != 3 {
+		t.Errorf("device has %d inflight messages, should have 3", n)
+	}
+	//the persistence isn't empty any more
+	if _, err := ImportState(bytes.NewReader(state.Bytes()), h.PersistStore); err == nil {
+		t.Errorf("state was imported into a persistence with state")
+	}
+	b.Stop(context.Background())
+}
@@ -0,0 +1,116 @@
+package hrotti
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+func Test_TopicPolicyLongestMatch(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.TopicPolicies = map[string]*TopicPolicy{
+		"#":                {MaxQos: 2},
+		"telemetry/#":      {MaxQos: 1},
+		"telemetry/+/temp": {MaxQos: 0},
+		"telemetry/a/#":    {MaxQos: 2, MaxSize: 10},
+	}
+	for topic, expected := range map[string]string{
+		"ota/image":          "#",
+		"telemetry":          "telemetry/#",
+		"telemetry/b/temp":   "telemetry/+/temp",
+		"telemetry/a/temp":   "telemetry/a/#",
+		"telemetry/b/humid":  "telemetry/#",
+		"telemetry/a/b/temp": "telemetry/a/#",
+	} {
+		if filter, policy := h.topicPolicy(topic); filter != expected || policy != h.TopicPolicies[expected] {
+			t.Errorf("policy for %s is %s, should be %s", topic, filter, expected)
+		}
+	}
+	h.TopicPolicies = nil
+	if _, policy := h.topicPolicy("a"); policy != nil {
+		t.Errorf("a topic with no policies had policy %+v", policy)
+	}
+}
+
+//publishPolicyTest publishes a message from conn and reads its acknowledgement
+func publishPolicyTest(t *testing.T, conn net.Conn, topic string, payload []byte, qos byte, retain bool) ControlPacket {
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = topic
+	pp.Payload = payload
+	pp.Qos = qos
+	pp.Retain = retain
+	pp.MessageID = 1
+	pp.Write(conn)
+	if qos == 0 {
+		return nil
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	rp, err := ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("publisher wasn't acknowledged: %s", err.Error())
+	}
+	return rp
+}
+
+func Test_TopicPolicy(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.TopicPolicies = map[string]*TopicPolicy{
+		"telemetry/#": {MaxSize: 4, MaxQos: 1, DowngradeQos: true, NoRetain: true},
+		"ota/#":       {MaxSize: 1 << 20, MaxQos: 1},
+	}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub := connectTestClient(t, h, "sub", true)
+	defer sub.Close()
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"#"}
+	sp.Qoss = []byte{2}
+	sp.Write(sub)
+	ReadPacket(sub)
+	pub := connectTestClient(t, h, "pub", true)
+	defer pub.Close()
+
+	//a QoS 2 message is acknowledged as QoS 2 but delivered at the QoS 1 its policy allows
+	if rp := publishPolicyTest(t, pub, "telemetry/a", []byte("ok"), 2, false); rp.Type() != PUBREC {
+		t.Fatalf("QoS 2 message was acknowledged with %s, should be PUBREC", rp.Type())
+	}
+	prel := NewControlPacket(PUBREL).(*PubrelPacket)
+	prel.MessageID = 1
+	prel.Write(pub)
+	ReadPacket(pub)
+	if received := readPublish(t, sub, time.Second); received == nil || received.Qos != 1 || received.TopicName != "telemetry/a" {
+		t.Fatalf("subscriber received %v, should be the message downgraded to QoS 1", received)
+	}
+	//messages over the size limit or retained where retain isn't allowed are dropped and counted
+	publishPolicyTest(t, pub, "telemetry/a", []byte("too big"), 1, false)
+	publishPolicyTest(t, pub, "telemetry/a", []byte("r"), 1, true)
+	//without DowngradeQos a message over MaxQos is dropped, the large payload is allowed
+	publishPolicyTest(t, pub, "ota/image", bytes.Repeat([]byte("x"), 4096), 2, false)
+	prel.Write(pub)
+	ReadPacket(pub)
+	publishPolicyTest(t, pub, "ota/image", bytes.Repeat([]byte("x"), 4096), 1, false)
+	if received := readPublish(t, sub, time.Second); received == nil || received.TopicName != "ota/image" || received.Qos != 1 {
+		t.Fatalf("subscriber received %v, should only be the QoS 1 firmware image", received)
+	}
+	if violations := atomic.LoadInt64(&h.stats.policyViolations); violations != 3 {
+		t.Errorf("%d policy violations were counted, should be 3", violations)
+	}
+	if retained := h.Retained(); len(retained) != 0 {
+		t.Errorf("message was retained against its policy: %+v", retained)
+	}
+
+	//a reload can make a violation disconnect the client
+	h.Reload(&ReloadConfig{TopicPolicies: map[string]*TopicPolicy{"telemetry/#": {MaxSize: 4, MaxQos: 2, Action: DisconnectViolation}}})
+	publishPolicyTest(t, pub, "telemetry/a", []byte("too big"), 0, false)
+	pub.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ReadPacket(pub); err == nil {
+		t.Errorf("client wasn't disconnected for breaking the topic policy")
+	}
+}
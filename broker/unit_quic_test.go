@@ -0,0 +1,95 @@
+//go:build quic
+
+package hrotti
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+	"github.com/quic-go/quic-go"
+)
+
+//a QUIC client keeps its session when it moves to a new address
+func Test_QUICListener(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	defer h.Stop()
+	config := NewListenerConfig("quic://127.0.0.1:0")
+	config.CertFile, config.KeyFile = writeTestCert(t, t.TempDir(), "server")
+	if err := h.AddListener("quic", config); err != nil {
+		t.Fatalf("failed to start quic listener: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	first, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to open udp socket: %s", err.Error())
+	}
+	defer first.Close()
+	transport := &quic.Transport{Conn: first}
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{quicALPN}}
+	conn, err := transport.Dial(ctx, h.listeners["quic"].ln.Addr(), tlsConfig, &quic.Config{})
+	if err != nil {
+		t.Fatalf("failed to connect over quic: %s", err.Error())
+	}
+	defer conn.CloseWithError(0, "")
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("failed to open stream: %s", err.Error())
+	}
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	newConnect("mobile").Write(stream)
+	if rp, err := ReadPacket(stream); err != nil || rp.(*ConnackPacket).ReturnCode != CONN_ACCEPTED {
+		t.Fatalf("quic client was not accepted: %v %v", rp, err)
+	}
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"cell/#"}
+	sp.Qoss = []byte{0}
+	sp.Write(stream)
+	if _, err := ReadPacket(stream); err != nil {
+		t.Fatalf("no SUBACK: %s", err.Error())
+	}
+
+	//move the connection to a new local address
+	second, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to open udp socket: %s", err.Error())
+	}
+	defer second.Close()
+	path, err := conn.AddPath(&quic.Transport{Conn: second})
+	if err != nil {
+		t.Fatalf("failed to add path: %s", err.Error())
+	}
+	if err := path.Probe(ctx); err != nil {
+		t.Fatalf("failed to probe path: %s", err.Error())
+	}
+	if err := path.Switch(); err != nil {
+		t.Fatalf("failed to switch path: %s", err.Error())
+	}
+	//packets from the new address move the server's side of the connection to it
+	NewControlPacket(PINGREQ).Write(stream)
+	if rp, err := ReadPacket(stream); err != nil || rp.Type() != PINGRESP {
+		t.Fatalf("no PINGRESP after migrating: %v %v", rp, err)
+	}
+	h.Publish("cell/a", []byte("migrated"), 0, false)
+	rp, err := ReadPacket(stream)
+	if err != nil {
+		t.Fatalf("no message after migrating: %s", err.Error())
+	}
+	if pp, ok := rp.(*PublishPacket); !ok || string(pp.Payload) != "migrated" {
+		t.Errorf("received %v, should be the message published to cell/a", rp)
+	}
+	c := h.getClient("mobile")
+	if remote := c.conn.RemoteAddr().String(); remote != second.LocalAddr().String() {
+		t.Errorf("client's address is %s, should have moved to %s", remote, second.LocalAddr())
+	}
+	if quicConnections := atomic.LoadInt64(&h.stats.quicConnections); quicConnections != 1 {
+		t.Errorf("%d QUIC connections were counted, should be 1", quicConnections)
+	}
+}
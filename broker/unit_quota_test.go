@@ -0,0 +1,161 @@
+package hrotti
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+func quotaBroker(t *testing.T, quota *Quota) *Hrotti {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.Auth = &Auth{
+		Users:  map[string]string{"tenant": "password", "other": "password"},
+		Quotas: map[string]*Quota{"tenant": quota},
+	}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	return h
+}
+
+func usageOf(h *Hrotti, username string) QuotaInfo {
+	for _, u := range h.QuotaUsage() {
+		if u.Username == username {
+			return u
+		}
+	}
+	return QuotaInfo{}
+}
+
+func Test_QuotaConnections(t *testing.T) {
+	h := quotaBroker(t, &Quota{MaxConnections: 2, MaxSessions: 1})
+	defer h.Stop()
+	a, rc := connectListener(t, h, "test", "a", "tenant", false)
+	if rc != CONN_ACCEPTED {
+		t.Fatalf("first durable session refused with %d", rc)
+	}
+	defer a.Close()
+	if _, rc = connectListener(t, h, "test", "b", "tenant", false); rc != CONN_REF_SERV_UNAVAIL {
+		t.Errorf("second durable session got %d, should be refused as server unavailable", rc)
+	}
+	b, rc := connectListener(t, h, "test", "b", "tenant", true)
+	if rc != CONN_ACCEPTED {
+		t.Fatalf("clean session refused with %d", rc)
+	}
+	defer b.Close()
+	if _, rc = connectListener(t, h, "test", "c", "tenant", true); rc != CONN_REF_SERV_UNAVAIL {
+		t.Errorf("third connection got %d, should be refused as server unavailable", rc)
+	}
+	//a user without a quota isn't limited
+	other, rc := connectListener(t, h, "test", "c", "other", false)
+	if rc != CONN_ACCEPTED {
+		t.Errorf("user without a quota refused with %d", rc)
+	}
+	defer other.Close()
+
+	//taking over a connection and resuming the session needs no more room
+	a2, rc := connectListener(t, h, "test", "a", "tenant", false)
+	if rc != CONN_ACCEPTED {
+		t.Fatalf("takeover refused with %d", rc)
+	}
+	defer a2.Close()
+	expectClosed(t, a, "taken over connection")
+	if u := usageOf(h, "tenant"); u.Connections != 2 || u.Sessions != 1 {
+		t.Errorf("usage is %d connections and %d sessions, should be 2 and 1", u.Connections, u.Sessions)
+	}
+	b.Close()
+	waitFor(t, "the clean session to end", func() bool { return usageOf(h, "tenant").Connections == 1 })
+	if u := usageOf(h, "tenant"); u.Sessions != 1 {
+		t.Errorf("usage is %d sessions after a clean session ended, should be 1", u.Sessions)
+	}
+}
+
+func Test_QuotaQueuedBytes(t *testing.T) {
+	for _, policy := range []QuotaPolicy{RejectOverQuota, DropOldestOverQuota} {
+		h := quotaBroker(t, &Quota{MaxQueuedBytes: 10, Policy: policy})
+		sub, rc := connectListener(t, h, "test", "sub", "tenant", false)
+		if rc != CONN_ACCEPTED {
+			t.Fatalf("subscriber refused with %d", rc)
+		}
+		sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+		sp.MessageID = 1
+		sp.Topics = []string{"a/#"}
+		sp.Qoss = []byte{1}
+		sp.Write(sub)
+		if _, err := ReadPacket(sub); err != nil {
+			t.Fatalf("subscriber did not receive a SUBACK")
+		}
+		sub.Close()
+		waitFor(t, "the subscriber to disconnect", func() bool { return !h.getClient("sub").Connected() })
+
+		h.Publish("a/b", []byte("first!"), 1, false)
+		h.Publish("a/b", []byte("second"), 1, false)
+		if u := usageOf(h, "tenant"); u.QueuedBytes != 6 {
+			t.Errorf("policy %d: %d bytes queued, should be 6", policy, u.QueuedBytes)
+		}
+		if dropped := atomic.LoadInt64(&h.stats.discarded[DropQuota]); dropped != 1 {
+			t.Errorf("policy %d: %d messages dropped for the quota, should be 1", policy, dropped)
+		}
+		kept := "first!"
+		if policy == DropOldestOverQuota {
+			kept = "second"
+		}
+		sub, _ = connectListener(t, h, "test", "sub", "tenant", false)
+		pp := readPublish(t, sub, time.Second)
+		if pp == nil || string(pp.Payload) != kept {
+			t.Errorf("policy %d: resent %v, should be %s", policy, pp, kept)
+		} else {
+			pa := NewControlPacket(PUBACK).(*PubackPacket)
+			pa.MessageID = pp.MessageID
+			pa.Write(sub)
+		}
+		if pp := readPublish(t, sub, 100*time.Millisecond); pp != nil {
+			t.Errorf("policy %d: resent %s as well", policy, pp.Payload)
+		}
+		waitFor(t, "the acknowledged message to be released", func() bool { return usageOf(h, "tenant").QueuedBytes == 0 })
+		sub.Close()
+		h.Stop()
+	}
+}
+
+func Test_QuotaRetained(t *testing.T) {
+	for _, policy := range []QuotaPolicy{RejectOverQuota, DropOldestOverQuota} {
+		h := quotaBroker(t, &Quota{MaxRetained: 1, Policy: policy})
+		pub, rc := connectListener(t, h, "test", "pub", "tenant", true)
+		if rc != CONN_ACCEPTED {
+			t.Fatalf("publisher refused with %d", rc)
+		}
+		retained := func(topic string) bool {
+			_, _, ok := h.subs.retained.get(topic)
+			return ok
+		}
+		//setting a topic the user already owns again needs no more room
+		for _, topic := range []string{"r/1", "r/1", "r/2"} {
+			pp := NewControlPacket(PUBLISH).(*PublishPacket)
+			pp.TopicName = topic
+			pp.Payload = []byte("state")
+			pp.Retain = true
+			pp.Write(pub)
+		}
+		if policy == DropOldestOverQuota {
+			waitFor(t, "r/2 to replace r/1", func() bool { return retained("r/2") && !retained("r/1") })
+		} else {
+			waitFor(t, "r/2 to be rejected", func() bool { return atomic.LoadInt64(&h.stats.retainedOverLimits) == 1 })
+			if !retained("r/1") || retained("r/2") {
+				t.Errorf("reject: r/1 retained %t and r/2 %t, should be only r/1", retained("r/1"), retained("r/2"))
+			}
+		}
+		if u := usageOf(h, "tenant"); u.Retained != 1 {
+			t.Errorf("policy %d: user owns %d retained topics, should be 1", policy, u.Retained)
+		}
+		//clearing a topic frees the room it took
+		h.PurgeRetained("r/#")
+		if u := usageOf(h, "tenant"); u.Retained != 0 {
+			t.Errorf("policy %d: user owns %d retained topics after they were purged", policy, u.Retained)
+		}
+		pub.Close()
+		h.Stop()
+	}
+}
@@ -0,0 +1,96 @@
+package hrotti
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+func Test_TokenBucket(t *testing.T) {
+	b := newTokenBucket(10)
+	now := b.last
+	if wait := b.wait(10, now); wait != 0 {
+		t.Errorf("full bucket should allow a burst of 10, wait is %s", wait)
+	}
+	b.take(10)
+	if wait := b.wait(1, now); wait != 100*time.Millisecond {
+		t.Errorf("empty bucket wait is %s, should be 100ms", wait)
+	}
+	if wait := b.wait(1, now.Add(100*time.Millisecond)); wait != 0 {
+		t.Errorf("bucket did not refill, wait is %s", wait)
+	}
+	if wait := newTokenBucket(0).wait(1000, now); wait != 0 {
+		t.Errorf("bucket with no rate should never wait, wait is %s", wait)
+	}
+}
+
+func publishQos0(t *testing.T, h *Hrotti, id string, count int) {
+	conn := connectTestClient(t, h, id, true)
+	defer conn.Close()
+	for i := 0; i < count; i++ {
+		pp := NewControlPacket(PUBLISH).(*PublishPacket)
+		pp.TopicName = "limited"
+		pp.Payload = []byte("x")
+		pp.Write(conn)
+	}
+}
+
+func Test_RateLimitDrop(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.RateLimit = &RateLimit{MessagesPerSecond: 5, Policy: DropQos0Publishes}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub, _ := newPipeClient(h, "sub", 100)
+	h.AddSub(sub, "limited", SubscriptionOptions{})
+
+	publishQos0(t, h, "chatty", 20)
+	waitFor(t, "publisher to disconnect", func() bool { return h.getClient("chatty") == nil })
+	//the bucket starts full so the first second's worth get through
+	if depth := sub.queueDepth(); depth != 5 {
+		t.Errorf("subscriber received %d messages, should be 5", depth)
+	}
+}
+
+func Test_RateLimitDisconnect(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.RateLimit = &RateLimit{MessagesPerSecond: 10, Policy: DisconnectPublisher, MaxViolations: 2}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	conn := connectTestClient(t, h, "chatty", true)
+	defer conn.Close()
+	//the first violation is delayed by 100ms, the second disconnects
+	for i := 0; i < 12; i++ {
+		pp := NewControlPacket(PUBLISH).(*PublishPacket)
+		pp.TopicName = "limited"
+		pp.Write(conn)
+	}
+	expectClosed(t, conn, "publisher over its rate limit")
+}
+
+func Test_RateLimitPerUser(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.RateLimit = &RateLimit{MessagesPerSecond: 1, Policy: DropQos0Publishes}
+	h.Auth = &Auth{AllowAnonymous: true, RateLimits: map[string]*RateLimit{"trusted": {}}}
+	if h.rateLimit(h.Auth, "trusted") == h.RateLimit || h.rateLimit(h.Auth, "other") != h.RateLimit || h.rateLimit(h.Auth, "") != h.RateLimit {
+		t.Errorf("per user rate limit was not used")
+	}
+	if newRateLimiter(h.rateLimit(h.Auth, "trusted")) != nil {
+		t.Errorf("a rate limit of 0 should not limit")
+	}
+
+	c, _ := newPipeClient(h, "limited", 100)
+	c.limiter = newRateLimiter(h.rateLimit(h.Auth, "other"))
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	if c.limiter.limit(c, pp) != rateAccept || c.limiter.limit(c, pp) != rateDrop {
+		t.Errorf("second message in a second should be dropped")
+	}
+	if dropped := atomic.LoadInt64(&c.rateDropped); dropped != 1 {
+		t.Errorf("client rate limit dropped count is %d, should be 1", dropped)
+	}
+}
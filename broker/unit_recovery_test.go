@@ -0,0 +1,285 @@
+package hrotti
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+var errCrashed = errors.New("broker crashed")
+
+//crashingPersistence is a Persistence that stops writing anything once failAfter writes
+//have been made, as if the broker was killed at that point, and counts the writes made
+type crashingPersistence struct {
+	Persistence
+	sync.Mutex
+	failAfter int
+	writes    int
+}
+
+//write returns errCrashed if the broker has crashed, otherwise it counts a write and calls f
+func (p *crashingPersistence) write(f func() error) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.failAfter >= 0 && p.writes >= p.failAfter {
+		return errCrashed
+	}
+	p.writes++
+	return f()
+}
+
+func (p *crashingPersistence) StoreRetained(topic string, message *PublishPacket) error {
+	return p.write(func() error { return p.Persistence.StoreRetained(topic, message) })
+}
+
+func (p *crashingPersistence) DeleteRetained(topic string) error {
+	return p.write(func() error { return p.Persistence.DeleteRetained(topic) })
+}
+
+func (p *crashingPersistence) StoreSession(client string, session *Session) error {
+	return p.write(func() error { return p.Persistence.StoreSession(client, session) })
+}
+
+func (p *crashingPersistence) DeleteSession(client string) error {
+	return p.write(func() error { return p.Persistence.DeleteSession(client) })
+}
+
+func (p *crashingPersistence) StoreInflight(client string, direction dirFlag, msgID uint16, message ControlPacket) error {
+	return p.write(func() error { return p.Persistence.StoreInflight(client, direction, msgID, message) })
+}
+
+func (p *crashingPersistence) DeleteInflight(client string, direction dirFlag, msgID uint16) error {
+	return p.write(func() error { return p.Persistence.DeleteInflight(client, direction, msgID) })
+}
+
+//addDurableSubscriber subscribes a client called durable to q/# at QoS 1 and disconnects it,
+//leaving its session for the messages published to be persisted for
+func addDurableSubscriber(t *testing.T, h *Hrotti) {
+	conn := connectTestClient(t, h, "durable", false)
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"q/#"}
+	sp.Qoss = []byte{1}
+	sp.Write(conn)
+	ReadPacket(conn)
+	conn.Close()
+	waitFor(t, "client to disconnect", func() bool {
+		return !h.getClient("durable").Connected()
+	})
+}
+
+//publishUntilCrash publishes count QoS 1 messages from a client, one at a time, and returns
+//the payloads the broker acknowledged before it crashed
+func publishUntilCrash(t *testing.T, h *Hrotti, count int) map[string]bool {
+	acked := make(map[string]bool)
+	conn := connectTestClient(t, h, "publisher", true)
+	defer conn.Close()
+	for i := 0; i < count; i++ {
+		pp := NewControlPacket(PUBLISH).(*PublishPacket)
+		pp.TopicName = "q/a"
+		pp.Qos = 1
+		pp.MessageID = uint16(i + 1)
+		pp.Payload = []byte(fmt.Sprintf("message %d", i))
+		pp.Write(conn)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		rp, err := ReadPacket(conn)
+		if err != nil {
+			break
+		}
+		if pa, ok := rp.(*PubackPacket); !ok || pa.MessageID != pp.MessageID {
+			t.Fatalf("publisher received %v, should be the PUBACK for message %d", rp, pp.MessageID)
+		}
+		acked[string(pp.Payload)] = true
+	}
+	return acked
+}
+
+//Test_CrashRecovery crashes the broker after each write it makes to persistence while a
+//client publishes QoS 1 messages for an offline subscriber, restarts it and checks every
+//message the broker acknowledged is delivered to the subscriber when it reconnects
+func Test_CrashRecovery(t *testing.T) {
+	const messages = 5
+	//a run that doesn't crash gives the number of writes there are to crash after
+	for failAfter, writes := 0, -1; writes < 0 || failAfter <= writes; failAfter++ {
+		path := filepath.Join(t.TempDir(), "hrotti.db")
+		p := &crashingPersistence{Persistence: &BoltPersistence{Path: path}, failAfter: -1}
+		h := NewHrotti(100, p)
+		h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0"))
+		addDurableSubscriber(t, h)
+
+		p.Lock()
+		p.writes = 0
+		if writes >= 0 {
+			p.failAfter = failAfter
+		}
+		p.Unlock()
+		acked := publishUntilCrash(t, h, messages)
+		if writes < 0 {
+			if len(acked) != messages {
+				t.Fatalf("%d of %d messages were acknowledged without a crash", len(acked), messages)
+			}
+			p.Lock()
+			writes = p.writes
+			p.Unlock()
+			failAfter = -1
+		}
+		p.Lock()
+		p.failAfter = 0
+		p.Unlock()
+		h.Stop()
+
+		h = NewHrotti(100, &BoltPersistence{Path: path})
+		h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0"))
+		conn := connectTestClient(t, h, "durable", false)
+		for len(acked) > 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			rp, err := ReadPacket(conn)
+			if err != nil {
+				t.Fatalf("crashed after %d writes, acknowledged messages %v were lost", failAfter, acked)
+			}
+			pp, ok := rp.(*PublishPacket)
+			if !ok {
+				continue
+			}
+			delete(acked, string(pp.Payload))
+			pa := NewControlPacket(PUBACK).(*PubackPacket)
+			pa.MessageID = pp.MessageID
+			pa.Write(conn)
+		}
+		conn.Close()
+		h.Stop()
+	}
+}
+
+//pendingPublish is a message the publisher in Test_CrashRetransmit has to send again after
+//the crash, released is set for a QoS 2 message whose PUBREC it received so it resends the
+//PUBREL rather than the message
+type pendingPublish struct {
+	pp       *PublishPacket
+	released bool
+}
+
+//exchange writes cp to conn and returns the reply, or nil if the broker crashed
+func exchange(conn net.Conn, cp ControlPacket) ControlPacket {
+	cp.Write(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	rp, err := ReadPacket(conn)
+	if err != nil {
+		return nil
+	}
+	return rp
+}
+
+//send sends p, completing the QoS 2 flow, and returns false if the broker crashed first
+func (p *pendingPublish) send(t *testing.T, conn net.Conn) bool {
+	if !p.released {
+		rp := exchange(conn, p.pp)
+		if rp == nil {
+			p.pp.Dup = true
+			return false
+		}
+		ack := PacketType(PUBACK)
+		if p.pp.Qos == 2 {
+			ack = PUBREC
+		}
+		if rp.Type() != ack || rp.Details().MessageID != p.pp.MessageID {
+			t.Fatalf("publisher received %v for QoS %d message %d", rp, p.pp.Qos, p.pp.MessageID)
+		}
+		if p.pp.Qos == 1 {
+			return true
+		}
+		p.released = true
+	}
+	prel := NewControlPacket(PUBREL).(*PubrelPacket)
+	prel.MessageID = p.pp.MessageID
+	return exchange(conn, prel) != nil
+}
+
+//Test_CrashRetransmit crashes the broker after each write it makes while a publisher with a
+//session sends QoS 1 and 2 messages for an offline subscriber, restarts it and has the
+//publisher send again everything the broker didn't complete, as a client does when it
+//reconnects, then checks the subscriber receives every message. A QoS 2 message recorded as
+//received before it was routed would be taken for a duplicate when it is resent and lost.
+func Test_CrashRetransmit(t *testing.T) {
+	const messages = 4
+	for _, qos := range []byte{1, 2} {
+		for failAfter, writes := 0, -1; writes < 0 || failAfter <= writes; failAfter++ {
+			path := filepath.Join(t.TempDir(), "hrotti.db")
+			p := &crashingPersistence{Persistence: &BoltPersistence{Path: path}, failAfter: -1}
+			h := NewHrotti(100, p)
+			h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0"))
+			addDurableSubscriber(t, h)
+			conn := connectTestClient(t, h, "publisher", false)
+
+			p.Lock()
+			p.writes = 0
+			if writes >= 0 {
+				p.failAfter = failAfter
+			}
+			p.Unlock()
+			var pending []*pendingPublish
+			for i := 0; i < messages; i++ {
+				pp := NewControlPacket(PUBLISH).(*PublishPacket)
+				pp.TopicName = "q/a"
+				pp.Qos = qos
+				pp.MessageID = uint16(i + 1)
+				pp.Payload = []byte(fmt.Sprintf("message %d", i))
+				pending = append(pending, &pendingPublish{pp: pp})
+			}
+			for len(pending) > 0 && pending[0].send(t, conn) {
+				pending = pending[1:]
+			}
+			conn.Close()
+			if writes < 0 {
+				if len(pending) != 0 {
+					t.Fatalf("QoS %d: %d messages weren't completed without a crash", qos, len(pending))
+				}
+				p.Lock()
+				writes = p.writes
+				p.Unlock()
+				failAfter = -1
+			}
+			p.Lock()
+			p.failAfter = 0
+			p.Unlock()
+			h.Stop()
+
+			h = NewHrotti(100, &BoltPersistence{Path: path})
+			h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0"))
+			conn = connectTestClient(t, h, "publisher", false)
+			for _, p := range pending {
+				if !p.send(t, conn) {
+					t.Fatalf("QoS %d crashed after %d writes: resending message %d failed", qos, failAfter, p.pp.MessageID)
+				}
+			}
+			conn.Close()
+
+			missing := make(map[string]bool)
+			for i := 0; i < messages; i++ {
+				missing[fmt.Sprintf("message %d", i)] = true
+			}
+			conn = connectTestClient(t, h, "durable", false)
+			for len(missing) > 0 {
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				rp, err := ReadPacket(conn)
+				if err != nil {
+					t.Fatalf("QoS %d crashed after %d writes: messages %v were lost", qos, failAfter, missing)
+				}
+				if pp, ok := rp.(*PublishPacket); ok {
+					delete(missing, string(pp.Payload))
+					pa := NewControlPacket(PUBACK).(*PubackPacket)
+					pa.MessageID = pp.MessageID
+					pa.Write(conn)
+				}
+			}
+			conn.Close()
+			h.Stop()
+		}
+	}
+}
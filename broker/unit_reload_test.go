@@ -0,0 +1,116 @@
+package hrotti
+
+import (
+	"crypto/tls"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+func Test_Reload(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.Auth = &Auth{AllowAnonymous: true}
+	tcpConfig := NewListenerConfig("tcp://127.0.0.1:0")
+	if err := h.AddListener("test", tcpConfig); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	tlsConfig := NewListenerConfig("tls://127.0.0.1:0")
+	tlsConfig.CertFile, tlsConfig.KeyFile = writeTestCert(t, dir, "first")
+	if err := h.AddListener("tls", tlsConfig); err != nil {
+		t.Fatalf("failed to start tls listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub := dialTestClient(t, h, "sub", "a/#")
+	defer sub.Close()
+	pub := connectTestClient(t, h, "pub", true)
+	defer pub.Close()
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "a/b"
+	pp.Payload = []byte("before")
+	pp.Write(pub)
+	if topic := receivedTopic(sub, time.Second); topic != "a/b" {
+		t.Fatalf("received %q before the reload, should be a/b", topic)
+	}
+	serverName := func() string {
+		conn, err := tls.Dial("tcp", h.listeners["tls"].ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("failed to connect over tls: %s", err.Error())
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if name := serverName(); name != "first" {
+		t.Errorf("tls listener has certificate %s, should be first", name)
+	}
+
+	reloaded := *tlsConfig
+	reloaded.CertFile, reloaded.KeyFile = writeTestCert(t, dir, "second")
+	err := h.Reload(&ReloadConfig{
+		MaxPacketSize: 1024,
+		Auth: &Auth{
+			AllowAnonymous: true,
+			ACLs:           map[string]*ACL{"": {Publish: []string{"b/#"}, Subscribe: []string{"#"}}},
+		},
+		Listeners: map[string]*ListenerConfig{"test": tcpConfig, "tls": &reloaded},
+	})
+	if err != nil {
+		t.Fatalf("failed to reload: %s", err.Error())
+	}
+	//the connected publisher has the new ACL
+	pp.Payload = []byte("after")
+	pp.Write(pub)
+	if topic := receivedTopic(sub, 300*time.Millisecond); topic != "" {
+		t.Errorf("received a message on %s from a publisher the reloaded ACL denies", topic)
+	}
+	if name := serverName(); name != "second" {
+		t.Errorf("tls listener has certificate %s after the reload, should be second", name)
+	}
+	if size := h.maxPacketSize(); size != 1024 {
+		t.Errorf("max packet size is %d after the reload, should be 1024", size)
+	}
+
+	//a certificate that fails to load leaves the listener with the one it has
+	broken := reloaded
+	broken.CertFile = dir + "/missing.pem"
+	if err := h.Reload(&ReloadConfig{Listeners: map[string]*ListenerConfig{"test": tcpConfig, "tls": &broken}}); err == nil {
+		t.Errorf("reload with a missing certificate succeeded")
+	}
+	if name := serverName(); name != "second" {
+		t.Errorf("tls listener has certificate %s after a failed reload, should be second", name)
+	}
+}
+
+func Test_ReloadWhileConnecting(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	config := NewListenerConfig("tcp://127.0.0.1:0")
+	if err := h.AddListener("test", config); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			h.Reload(&ReloadConfig{
+				RateLimit: &RateLimit{MessagesPerSecond: float64(i + 1)},
+				Auth:      &Auth{AllowAnonymous: true, ACLs: map[string]*ACL{"": {Publish: []string{"#"}}}},
+				Listeners: map[string]*ListenerConfig{"test": config},
+			})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		connectTestClient(t, h, "client"+strconv.Itoa(i), true).Close()
+	}
+	<-done
+	//a client connecting after the reloads has the reloaded ACL
+	conn := connectTestClient(t, h, "last", true)
+	defer conn.Close()
+	c := h.getClient("last")
+	waitFor(t, "client to start", func() bool { return c.Connected() })
+	if c.canSubscribe("a/b") {
+		t.Errorf("client can subscribe with an ACL that only allows publishing")
+	}
+}
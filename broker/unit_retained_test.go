@@ -0,0 +1,443 @@
+package hrotti
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+func setRetained(h *Hrotti, topic string, payload string) {
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = topic
+	pp.Payload = []byte(payload)
+	pp.Retain = true
+	h.subs.SetRetained(topic, pp)
+}
+
+func receive(t *testing.T, c *Client) *PublishPacket {
+	select {
+	case msg := <-c.outboundMessages:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for a message for %s", c.clientID)
+	}
+	return nil
+}
+
+func syncRetained(t *testing.T, h *Hrotti, c *Client, req RetainedSyncRequest) ([]string, RetainedSyncComplete) {
+	var topics []string
+	var complete RetainedSyncComplete
+	payload, _ := json.Marshal(req)
+	h.startRetainedSync(c, payload)
+	for {
+		msg := receive(t, c)
+		if msg.TopicName == RetainedSyncCompleteTopic {
+			if err := json.Unmarshal(msg.Payload, &complete); err != nil {
+				t.Fatalf("bad completion marker: %s", err.Error())
+			}
+			return topics, complete
+		}
+		if !msg.Retain {
+			t.Errorf("synced message for %s does not have retain set", msg.TopicName)
+		}
+		topics = append(topics, msg.TopicName)
+	}
+}
+
+func Test_RetainedSync(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	for _, topic := range []string{"a/3", "b/1", "a/1", "a/2", "c/a/1"} {
+		setRetained(h, topic, "value")
+	}
+	edge := newTestClient(h, "edge")
+
+	topics, complete := syncRetained(t, h, edge, RetainedSyncRequest{Filters: []string{"a/#", "+/a/#"}, Rate: 10000})
+	expected := []string{"a/1", "a/2", "a/3", "c/a/1"}
+	if len(topics) != len(expected) {
+		t.Fatalf("synced topics are %v, should be %v", topics, expected)
+	}
+	for i := range expected {
+		if topics[i] != expected[i] {
+			t.Fatalf("synced topics are %v, should be %v", topics, expected)
+		}
+	}
+	if complete.Count != 4 || complete.Cursor != "c/a/1" {
+		t.Errorf("completion marker is %+v, should have count 4 and cursor c/a/1", complete)
+	}
+
+	//resuming from a cursor only sends the topics after it
+	topics, complete = syncRetained(t, h, edge, RetainedSyncRequest{Filters: []string{"a/#"}, Cursor: "a/1", Rate: 10000})
+	if len(topics) != 2 || topics[0] != "a/2" || topics[1] != "a/3" {
+		t.Errorf("resumed sync topics are %v, should be [a/2 a/3]", topics)
+	}
+	if complete.Count != 2 || complete.Cursor != "a/3" {
+		t.Errorf("completion marker is %+v, should have count 2 and cursor a/3", complete)
+	}
+
+	//a sync with nothing left still completes, keeping the cursor it was given
+	topics, complete = syncRetained(t, h, edge, RetainedSyncRequest{Filters: []string{"a/#"}, Cursor: "a/3", Rate: 10000})
+	if len(topics) != 0 || complete.Count != 0 || complete.Cursor != "a/3" {
+		t.Errorf("empty sync sent %v with marker %+v", topics, complete)
+	}
+
+	//filters the client's ACL doesn't allow are left out, and a RetainedSyncRate too high for
+	//a ticker is capped
+	h.RetainedSyncRate = 2 * MaxRetainedSyncRate
+	edge.acl = &ACL{Subscribe: []string{"a/#"}}
+	topics, complete = syncRetained(t, h, edge, RetainedSyncRequest{Filters: []string{"b/#", "a/#", "#"}, Cursor: "a/2"})
+	if len(topics) != 1 || topics[0] != "a/3" || complete.Count != 1 {
+		t.Errorf("sync with an ACL sent %v with marker %+v, should only be [a/3]", topics, complete)
+	}
+}
+
+//persistedRetained returns the topics with a retained message in h's persistence
+func persistedRetained(h *Hrotti) map[string]bool {
+	topics := make(map[string]bool)
+	h.PersistStore.RangeRetained(func(topic string, _ *PublishPacket) bool {
+		topics[topic] = true
+		return true
+	})
+	return topics
+}
+
+func Test_RetainedLimits(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.MaxRetainedMessages = 2
+	h.MaxRetainedSize = 5
+	sub := newTestClient(h, "sub")
+	h.AddSub(sub, "a/#", SubscriptionOptions{})
+
+	for _, topic := range []string{"a/1", "a/2", "a/3"} {
+		if err := h.Publish(topic, []byte("value"), 0, true); err != nil {
+			t.Fatalf("publish to %s failed: %s", topic, err.Error())
+		}
+		receive(t, sub)
+	}
+	h.Publish("a/1", []byte("new"), 0, true)
+	receive(t, sub)
+	h.Publish("a/2", []byte("too long"), 0, true)
+	receive(t, sub)
+	retained := h.Retained()
+	if len(retained) != 2 || retained[0].Topic != "a/1" || retained[0].Size != 3 || retained[1].Topic != "a/2" || retained[1].Size != 5 {
+		t.Errorf("retained messages are %+v, a/3 is over the limit and a/2's new message too long", retained)
+	}
+	//clearing a retained message makes room for another
+	h.Publish("a/2", nil, 0, true)
+	receive(t, sub)
+	h.Publish("a/3", []byte("value"), 0, true)
+	receive(t, sub)
+	if persisted := persistedRetained(h); len(persisted) != 2 || !persisted["a/1"] || !persisted["a/3"] {
+		t.Errorf("persisted retained messages are %v, should be a/1 and a/3", persisted)
+	}
+
+	h.RetainedLimitPolicy = RejectRetained
+	if err := h.Publish("a/4", []byte("value"), 0, true); err == nil {
+		t.Errorf("retained message over the limit was accepted")
+	}
+	if len(sub.outboundMessages) != 0 {
+		t.Errorf("rejected retained message was delivered")
+	}
+	if h.stats.retainedOverLimits != 3 {
+		t.Errorf("%d retained messages counted as over the limits, should be 3", h.stats.retainedOverLimits)
+	}
+}
+
+func Test_PurgeRetained(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	for _, topic := range []string{"a/1", "a/b/2", "b/1", "$SYS/a"} {
+		h.Publish(topic, []byte("value"), 0, true)
+	}
+	if purged := h.PurgeRetained("#"); purged != 3 {
+		t.Errorf("purged %d retained messages, # should purge 3", purged)
+	}
+	if persisted := persistedRetained(h); len(persisted) != 1 || !persisted["$SYS/a"] {
+		t.Errorf("persisted retained messages are %v after purging #, should be $SYS/a", persisted)
+	}
+	if purged := h.PurgeRetained("$SYS/+"); purged != 1 || len(h.Retained()) != 0 {
+		t.Errorf("purged %d retained messages, $SYS/+ should purge 1", purged)
+	}
+}
+
+//Test_RetainedOrdering subscribes clients while a publisher updates the retained message on
+//the topic, none of them may get an older value after a newer one
+func Test_RetainedOrdering(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	stop := make(chan struct{})
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			pp := NewControlPacket(PUBLISH).(*PublishPacket)
+			pp.TopicName = "race/value"
+			pp.Payload = []byte(strconv.Itoa(i))
+			pp.Retain = true
+			//as a client's PUBLISH is handled, the retained message is set before routing
+			message := h.ingest(pp.TopicName, pp)
+			h.setRetained(message)
+			h.route(message, nil)
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-published
+	}()
+
+	waitFor(t, "retained message", func() bool { return len(h.Retained()) == 1 })
+
+	for i := 0; i < 50; i++ {
+		id := "subscriber" + strconv.Itoa(i)
+		c := newTestClient(h, id)
+		filter := "race/value"
+		if i%2 == 1 {
+			filter = "race/#"
+		}
+		h.AddSub(c, filter, SubscriptionOptions{})
+		last := 0
+		for j := 0; j < 10; j++ {
+			msg := receive(t, c)
+			value, _ := strconv.Atoi(string(msg.Payload))
+			if j == 0 && !msg.Retain {
+				t.Fatalf("%s got live value %d before the retained message", id, value)
+			}
+			if value < last {
+				t.Fatalf("%s got value %d after %d", id, value, last)
+			}
+			last = value
+		}
+		h.DeleteSub(id, filter)
+	}
+}
+
+func Test_RetainedCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hrotti.db")
+	h := NewHrotti(100, &BoltPersistence{Path: path})
+	h.RetainedCacheMessages = 2
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	for i := 0; i < 5; i++ {
+		h.Publish("devices/"+strconv.Itoa(i), []byte(strconv.Itoa(i)), 1, true)
+	}
+	if cached, _ := h.subs.retained.usage(); cached != 2 || h.subs.retained.len() != 5 {
+		t.Fatalf("%d of %d retained messages are in memory, should be 2 of 5", cached, h.subs.retained.len())
+	}
+	if evictions := atomic.LoadInt64(&h.subs.retained.evictions); evictions != 3 {
+		t.Errorf("%d retained messages were evicted, should be 3", evictions)
+	}
+
+	//a wildcard subscription gets the evicted messages too
+	c := newTestClient(h, "c")
+	h.AddSub(c, "devices/#", SubscriptionOptions{Qos: 1})
+	received := make(map[string]string)
+	for i := 0; i < 5; i++ {
+		msg := receive(t, c)
+		if !msg.Retain || msg.Qos != 1 {
+			t.Errorf("%s was delivered with retain %v at QoS %d", msg.TopicName, msg.Retain, msg.Qos)
+		}
+		received[msg.TopicName] = string(msg.Payload)
+	}
+	for i := 0; i < 5; i++ {
+		if topic := "devices/" + strconv.Itoa(i); received[topic] != strconv.Itoa(i) {
+			t.Errorf("%s was %q, should be %d", topic, received[topic], i)
+		}
+	}
+	if hits, misses := atomic.LoadInt64(&h.subs.retained.hits), atomic.LoadInt64(&h.subs.retained.misses); hits != 2 || misses != 3 {
+		t.Errorf("%d cache hits and %d misses, should be 2 and 3", hits, misses)
+	}
+	if cached, _ := h.subs.retained.usage(); cached != 2 {
+		t.Errorf("%d retained messages are in memory after loading, should be 2", cached)
+	}
+
+	//replacing and clearing evicted messages while they are being loaded never leaves an old
+	//message in memory
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(2)
+		go func(topic string) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				h.Publish(topic, []byte(strconv.Itoa(j)), 0, true)
+			}
+		}("devices/" + strconv.Itoa(i))
+		go func(topic string) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				h.retainedMessage(topic)
+			}
+		}("devices/" + strconv.Itoa(i))
+	}
+	wg.Wait()
+	h.Publish("devices/0", nil, 0, true)
+	for i := 1; i < 5; i++ {
+		if msg := h.retainedMessage("devices/" + strconv.Itoa(i)); msg == nil || string(msg.Payload) != "49" {
+			t.Errorf("devices/%d is %v, should be 49", i, msg)
+		}
+	}
+	if msg := h.retainedMessage("devices/0"); msg != nil {
+		t.Errorf("devices/0 is %v, should have been cleared", msg)
+	}
+	h.Stop()
+
+	//the cache is filled as the retained messages are restored
+	b := NewBroker(WithPersistence(&BoltPersistence{Path: path}), WithSettings(func(h *Hrotti) { h.RetainedCacheSize = 4 }))
+	defer b.Stop(context.Background())
+	if cached, bytes := b.Hrotti().subs.retained.usage(); cached != 2 || bytes != 4 || b.Hrotti().subs.retained.len() != 4 {
+		t.Errorf("%d of %d restored messages are in memory with %d bytes, should be 2 of 4 with 4", cached, b.Hrotti().subs.retained.len(), bytes)
+	}
+}
+
+func Test_RetainedStream(t *testing.T) {
+	h := NewHrotti(10, &MemoryPersistence{})
+	for i := 0; i < 100; i++ {
+		setRetained(h, "r/"+strconv.Itoa(i), "retained")
+	}
+	streaming := func(c *Client) bool {
+		c.deliverMu.Lock()
+		defer c.deliverMu.Unlock()
+		return c.retainedStream != nil
+	}
+
+	//a client that isn't reading gets its queue filled to the high-water mark and no further
+	c := newClient(nil, "c", 10)
+	c.state.SetValue(CONNECTED)
+	h.clients.list["c"] = c
+	h.AddSub(c, "r/#", SubscriptionOptions{})
+	waitFor(t, "the stream to pause", func() bool {
+		progress := c.retainedProgress()
+		return progress != nil && progress.Paused
+	})
+	if progress := c.retainedProgress(); len(c.outboundMessages) != 5 || progress.Sent != 5 || progress.Remaining != 95 {
+		t.Fatalf("%d messages are queued with progress %+v, should be 5 sent and 95 remaining", len(c.outboundMessages), progress)
+	}
+	//live messages still have room, and one to a topic still to be streamed skips its retained message
+	queued := make(map[string]bool)
+	var received []*PublishPacket
+	for i := 0; i < 5; i++ {
+		msg := receive(t, c)
+		queued[msg.TopicName] = true
+		received = append(received, msg)
+	}
+	liveTopic := "r/0"
+	for i := 1; queued[liveTopic]; i++ {
+		liveTopic = "r/" + strconv.Itoa(i)
+	}
+	h.Publish(liveTopic, []byte("live"), 0, false)
+	for len(received) < 100 {
+		received = append(received, receive(t, c))
+		c.signalDrained()
+	}
+	waitFor(t, "the stream to finish", func() bool { return !streaming(c) })
+	for i, msg := range received {
+		if msg.TopicName == liveTopic && msg.Retain {
+			t.Errorf("the retained message for %s was sent after the live one", liveTopic)
+		} else if msg.TopicName == liveTopic && i != 5 {
+			t.Errorf("the live message was received at %d, should be straight after the queued retained messages", i)
+		}
+	}
+	if progress := c.retainedProgress(); progress != nil || atomic.LoadInt64(&c.dropped) != 0 || atomic.LoadInt64(&c.stats.retainedSkipped) != 1 {
+		t.Errorf("progress is %+v with %d dropped and %d skipped, should be done with none dropped and 1 skipped", progress, c.dropped, c.stats.retainedSkipped)
+	}
+
+	//a few retained messages are queued straight away without a stream
+	h.AddSub(c, "r/1", SubscriptionOptions{})
+	if streaming(c) || len(c.outboundMessages) != 1 {
+		t.Errorf("a single retained message was streamed")
+	}
+	<-c.outboundMessages
+	h.RemoveSubscription(c, "r/1")
+
+	//unsubscribing stops the stream and removes what it had queued
+	h.AddSub(c, "r/#", SubscriptionOptions{})
+	waitFor(t, "the stream to pause", func() bool {
+		progress := c.retainedProgress()
+		return progress != nil && progress.Paused
+	})
+	h.RemoveSubscription(c, "r/#")
+	waitFor(t, "the stream to stop", func() bool { return !streaming(c) })
+	if progress := c.retainedProgress(); progress != nil || len(c.outboundMessages) != 0 {
+		t.Errorf("progress is %+v with %d queued after unsubscribing", progress, len(c.outboundMessages))
+	}
+
+	//as does disconnecting
+	h.AddSub(c, "r/#", SubscriptionOptions{})
+	close(c.stop)
+	waitFor(t, "the stream to stop", func() bool { return !streaming(c) })
+	if progress := c.retainedProgress(); progress != nil || len(c.outboundMessages) > 5 {
+		t.Errorf("progress is %+v with %d queued after disconnecting", progress, len(c.outboundMessages))
+	}
+}
+
+func Test_RetainedReplayQos(t *testing.T) {
+	handlings := []RetainHandling{RetainSendOnSubscribe, RetainSendIfNew, RetainDontSend}
+	for stored := byte(0); stored <= 2; stored++ {
+		for granted := byte(0); granted <= 2; granted++ {
+			for max := byte(0); max <= 2; max++ {
+				for _, handling := range handlings {
+					for _, existed := range []bool{false, true} {
+						h := NewHrotti(100, &MemoryPersistence{})
+						h.MaxRetainedQos = max
+						pp := NewControlPacket(PUBLISH).(*PublishPacket)
+						pp.TopicName = "state/1"
+						pp.Payload = []byte("on")
+						pp.Qos = stored
+						pp.Retain = true
+						h.subs.SetRetained(pp.TopicName, pp)
+						c := newTestClient(h, "sub")
+						options := SubscriptionOptions{Qos: granted, RetainHandling: handling}
+						if existed {
+							h.addSub(c, "state/#", options)
+						}
+						h.AddSub(c, "state/#", options)
+
+						name := fmt.Sprintf("stored %d granted %d max %d handling %d existed %t", stored, granted, max, handling, existed)
+						sent := handling == RetainSendOnSubscribe || handling == RetainSendIfNew && !existed
+						select {
+						case msg := <-c.outboundMessages:
+							want := calcMinQos(calcMinQos(stored, granted), max)
+							if !sent {
+								t.Errorf("%s: retained message was sent", name)
+							} else if msg.Qos != want {
+								t.Errorf("%s: retained message sent at QoS %d, should be %d", name, msg.Qos, want)
+							}
+						default:
+							if sent {
+								t.Errorf("%s: retained message wasn't sent", name)
+							}
+						}
+					}
+				}
+
+				//a retained sync sends it at the QoS of the filter in the request as if it were
+				//subscribed to, however the client subscribes
+				h := NewHrotti(100, &MemoryPersistence{})
+				h.MaxRetainedQos = max
+				pp := NewControlPacket(PUBLISH).(*PublishPacket)
+				pp.TopicName = "state/1"
+				pp.Payload = []byte("on")
+				pp.Qos = stored
+				pp.Retain = true
+				h.subs.SetRetained(pp.TopicName, pp)
+				c := newTestClient(h, "bridge")
+				payload, _ := json.Marshal(RetainedSyncRequest{Filters: []string{"state/#"}, Qos: []int{int(granted)}})
+				h.startRetainedSync(c, payload)
+				want := calcMinQos(calcMinQos(stored, granted), max)
+				if msg := receive(t, c); msg.TopicName != "state/1" || msg.Qos != want {
+					t.Errorf("stored %d granted %d max %d: retained sync sent %s at QoS %d, should be state/1 at %d", stored, granted, max, msg.TopicName, msg.Qos, want)
+				}
+			}
+		}
+	}
+}
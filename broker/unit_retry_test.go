@@ -0,0 +1,176 @@
+package hrotti
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+func Test_TimingWheel(t *testing.T) {
+	w := newTimingWheel()
+	stop := make(chan struct{})
+	defer close(stop)
+	go w.run(systemClock{}, stop)
+	fired := make(chan int, 3)
+	for i, delay := range []time.Duration{3 * wheelTick, wheelTick, 2 * wheelTick} {
+		i := i
+		w.schedule(delay, func() { fired <- i })
+	}
+	for _, expected := range []int{1, 2, 0} {
+		select {
+		case i := <-fired:
+			if i != expected {
+				t.Errorf("function %d ran, should have been %d", i, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("function %d didn't run", expected)
+		}
+	}
+
+	//a delay longer than a turn of the wheel waits for the turns
+	w = newTimingWheel()
+	ran := false
+	w.schedule((wheelSlots+2)*wheelTick, func() { ran = true })
+	for i := 0; i < wheelSlots+1; i++ {
+		if len(w.advance()) != 0 {
+			t.Fatalf("function ran after %d ticks, should be %d", i+1, wheelSlots+2)
+		}
+	}
+	for _, f := range w.advance() {
+		f()
+	}
+	if !ran {
+		t.Errorf("function didn't run after %d ticks", wheelSlots+2)
+	}
+}
+
+//readPublish reads the next packet from conn, which should be a PUBLISH, within wait
+func readPublish(t *testing.T, conn net.Conn, wait time.Duration) *PublishPacket {
+	conn.SetReadDeadline(time.Now().Add(wait))
+	rp, err := ReadPacket(conn)
+	if err != nil {
+		return nil
+	}
+	pp, ok := rp.(*PublishPacket)
+	if !ok {
+		t.Fatalf("received %s, should be a PUBLISH", rp.Type())
+	}
+	return pp
+}
+
+func Test_RetryUnacknowledged(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.RetryInterval = 200 * time.Millisecond
+	h.MaxRetries = 2
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub := dialTestClient(t, h, "sub", "a/#")
+	defer sub.Close()
+	h.Publish("a/b", []byte("unacked"), 1, false)
+	first := readPublish(t, sub, time.Second)
+	if first == nil || first.Dup {
+		t.Fatalf("first delivery is %v, should be a PUBLISH without dup", first)
+	}
+	for i := 0; i < h.MaxRetries; i++ {
+		pp := readPublish(t, sub, time.Second)
+		if pp == nil || !pp.Dup || pp.MessageID != first.MessageID || string(pp.Payload) != "unacked" {
+			t.Fatalf("resend %d is %v, should be the PUBLISH with dup set", i+1, pp)
+		}
+	}
+	if pp := readPublish(t, sub, 400*time.Millisecond); pp != nil {
+		t.Errorf("message resent more than MaxRetries times")
+	}
+
+	//a QoS 2 message whose PUBCOMP doesn't come has its PUBREL resent
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 2
+	sp.Topics = []string{"q/#"}
+	sp.Qoss = []byte{2}
+	sp.Write(sub)
+	sub.SetReadDeadline(time.Now().Add(time.Second))
+	ReadPacket(sub)
+	h.Publish("q/2", []byte("qos2"), 2, false)
+	pp := readPublish(t, sub, time.Second)
+	if pp == nil {
+		t.Fatalf("QoS 2 message wasn't delivered")
+	}
+	pr := NewControlPacket(PUBREC).(*PubrecPacket)
+	pr.MessageID = pp.MessageID
+	pr.Write(sub)
+	for i := 0; i < 2; i++ {
+		sub.SetReadDeadline(time.Now().Add(time.Second))
+		rp, err := ReadPacket(sub)
+		if prel, ok := rp.(*PubrelPacket); err != nil || !ok || prel.MessageID != pp.MessageID {
+			t.Fatalf("received %v %v, should be the PUBREL", rp, err)
+		}
+	}
+	pc := NewControlPacket(PUBCOMP).(*PubcompPacket)
+	pc.MessageID = pp.MessageID
+	pc.Write(sub)
+	sub.SetReadDeadline(time.Now().Add(400 * time.Millisecond))
+	if rp, err := ReadPacket(sub); err == nil {
+		t.Errorf("received %s after the PUBCOMP", rp.Type())
+	}
+}
+
+func Test_MessageExpiry(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.MessageExpiry = 200 * time.Millisecond
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+
+	//a message that isn't acknowledged is dropped when it expires
+	sub := dialTestClient(t, h, "sub", "a/#")
+	defer sub.Close()
+	h.Publish("a/b", []byte("unacked"), 1, false)
+	if readPublish(t, sub, time.Second) == nil {
+		t.Fatalf("message wasn't delivered")
+	}
+	c := h.getClient("sub")
+	waitFor(t, "unacknowledged message to expire", func() bool {
+		return c.inflight() == 0 && countInflight(h.PersistStore, "sub") == 0
+	})
+
+	//one for a disconnected client isn't sent when it reconnects after the expiry
+	conn := connectTestClient(t, h, "durable", false)
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"d/#"}
+	sp.Qoss = []byte{1}
+	sp.Write(conn)
+	ReadPacket(conn)
+	conn.Close()
+	waitFor(t, "client to disconnect", func() bool {
+		return !h.getClient("durable").Connected()
+	})
+	h.Publish("d/1", []byte("offline"), 1, false)
+	time.Sleep(300 * time.Millisecond)
+	conn = connectTestClient(t, h, "durable", false)
+	defer conn.Close()
+	if pp := readPublish(t, conn, 300*time.Millisecond); pp != nil {
+		t.Errorf("expired message %q was sent on reconnect", pp.Payload)
+	}
+	if expired := atomic.LoadInt64(&h.stats.publishMessagesExpired); expired != 2 {
+		t.Errorf("%d messages counted as expired, should be 2", expired)
+	}
+
+	//and a queued message is dropped instead of being sent
+	queued, _ := newPipeClient(h, "queued", 10)
+	stale := NewControlPacket(PUBLISH).(*PublishPacket)
+	stale.TopicName = "q/1"
+	stale.ExpiresAt = time.Now().Add(-time.Second)
+	fresh := stale.Copy()
+	fresh.ExpiresAt = time.Now().Add(time.Minute)
+	queued.outboundMessages <- stale
+	queued.outboundMessages <- fresh
+	if msg, _, ok := queued.nextPacket(h, nil); !ok || msg != fresh {
+		t.Errorf("next packet is %v, should be the message that hasn't expired", msg)
+	}
+}
@@ -0,0 +1,139 @@
+package hrotti
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+func Test_TopicRewriteRules(t *testing.T) {
+	r, err := ParseTopicRewrite("v1/{id}/{kind}/data -> telemetry/{kind}/{id}")
+	if err != nil {
+		t.Fatalf("failed to parse rule: %s", err.Error())
+	}
+	for topic, expected := range map[string]string{
+		"v1/a/temp/data": "telemetry/temp/a",
+		"v1/+/temp/data": "telemetry/temp/+",
+		"v1/+/+/data":    "telemetry/+/+",
+		//these are left as they are
+		"v1/a/temp/status": "",
+		"v1/a/data":        "",
+		"v1/#":             "",
+		"v1/a/#/data":      "",
+		"v2/a/temp/data":   "",
+	} {
+		if rewritten, ok := r.rewrite(strings.Split(topic, "/")); rewritten != expected || ok != (expected != "") {
+			t.Errorf("%s was rewritten to %q, should be %q", topic, rewritten, expected)
+		}
+	}
+	for _, rule := range []string{
+		"v1/{id}/data",
+		"v1/{id}/data -> telemetry/{device}",
+		"v1/+/data -> telemetry/{id}",
+		"v1/{id}/{id} -> telemetry/{id}",
+		"v1/{id}/data -> telemetry/#",
+		"v1/{}/data -> telemetry",
+		"v1/a{id}/data -> telemetry/{id}",
+		"$SYS/{id} -> telemetry/{id}",
+		" -> telemetry",
+	} {
+		if _, err := ParseTopicRewrite(rule); err == nil {
+			t.Errorf("rule %q should be refused", rule)
+		}
+	}
+
+	parse := func(rules ...string) []*TopicRewrite {
+		var rewrites []*TopicRewrite
+		for _, rule := range rules {
+			r, err := ParseTopicRewrite(rule)
+			if err != nil {
+				t.Fatalf("failed to parse %q: %s", rule, err.Error())
+			}
+			rewrites = append(rewrites, r)
+		}
+		return rewrites
+	}
+	for _, rules := range [][]string{
+		{"a/{x} -> b/{x}", "b/{y} -> a/{y}"},
+		{"a/{x} -> {x}/a", "b/a -> c"},
+		{"a/{x}/{y} -> a/{y}/{x}"},
+	} {
+		if err := CheckTopicRewrites(parse(rules...), nil); err == nil {
+			t.Errorf("loop in %v wasn't refused", rules)
+		}
+	}
+	if err := CheckTopicRewrites(parse("a/{x} -> b/{x}"), parse("b/{y} -> c/{y}")); err == nil {
+		t.Errorf("a listener's rule making topics the broker's rules rewrite wasn't refused")
+	}
+	if err := CheckTopicRewrites(parse("v1/{id}/data -> telemetry/{id}", "v1/{id}/status -> status/{id}"), parse("legacy/{x} -> telemetry/{x}/legacy")); err != nil {
+		t.Errorf("rules without a loop were refused: %s", err.Error())
+	}
+}
+
+func Test_TopicRewrite(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	rule, _ := ParseTopicRewrite("v1/{id}/data -> telemetry/{id}")
+	h.TopicRewrites = []*TopicRewrite{rule}
+	config := NewListenerConfig("tcp://127.0.0.1:0")
+	listenerRule, _ := ParseTopicRewrite("v1/{id}/status -> status/{id}")
+	config.TopicRewrites = []*TopicRewrite{listenerRule}
+	if err := h.AddListener("test", config); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	//an old subscriber's filter is rewritten too so it still gets the messages
+	old := dialTestClient(t, h, "old", "v1/+/data")
+	defer old.Close()
+	current := dialTestClient(t, h, "current", "telemetry/#")
+	defer current.Close()
+	device := connectTestClient(t, h, "device", true)
+	defer device.Close()
+
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "v1/dev1/data"
+	pp.Payload = []byte("21.5")
+	pp.Retain = true
+	pp.Write(device)
+	for _, conn := range []net.Conn{old, current} {
+		if received := readPublish(t, conn, time.Second); received == nil || received.TopicName != "telemetry/dev1" {
+			t.Fatalf("subscriber received %v, should be the message on telemetry/dev1", received)
+		}
+	}
+	if retained := h.Retained(); len(retained) != 1 || retained[0].Topic != "telemetry/dev1" {
+		t.Errorf("retained messages are %+v, should be the message on telemetry/dev1", retained)
+	}
+	pp.TopicName = "v1/dev1/status"
+	pp.Retain = false
+	pp.Write(device)
+	if received := readPublish(t, current, 200*time.Millisecond); received != nil {
+		t.Errorf("%s was received, v1/dev1/status should be rewritten by the listener's rule", received.TopicName)
+	}
+
+	//unsubscribing from the old filter removes the rewritten subscription
+	up := NewControlPacket(UNSUBSCRIBE).(*UnsubscribePacket)
+	up.MessageID = 2
+	up.Topics = []string{"v1/+/data"}
+	up.Write(old)
+	ReadPacket(old)
+	pp.TopicName = "v1/dev1/data"
+	pp.Write(device)
+	if received := readPublish(t, old, 200*time.Millisecond); received != nil {
+		t.Errorf("%s was received after unsubscribing", received.TopicName)
+	}
+	//the subscription, three publishes and the unsubscribe
+	if rewritten := atomic.LoadInt64(&h.stats.topicsRewritten); rewritten != 5 {
+		t.Errorf("%d rewrites were counted, should be 5", rewritten)
+	}
+
+	//a listener whose rules make a loop with the broker's isn't started
+	loop := NewListenerConfig("tcp://127.0.0.1:0")
+	loopRule, _ := ParseTopicRewrite("telemetry/{id} -> v1/{id}/data")
+	loop.TopicRewrites = []*TopicRewrite{loopRule}
+	if err := h.AddListener("loop", loop); err == nil {
+		t.Errorf("listener with a rewrite loop was started")
+	}
+}
@@ -1,13 +1,17 @@
 package hrotti
 
 import (
+	"bufio"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"testing"
 	"time"
+
+	. "github.com/alsm/hrotti/packets"
 )
 
 /*func Test_NewNode(t *testing.T) {
@@ -22,12 +26,26 @@ import (
 	}
 }*/
 
+func newTestClient(h *Hrotti, id string) *Client {
+	c := newClient(nil, id, 100)
+	c.state.SetValue(CONNECTED)
+	h.clients.list[id] = c
+	return c
+}
+
+func publish(h *Hrotti, topic string, publisher *Client) {
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = topic
+	pp.Payload = []byte("test")
+	h.DeliverMessage(topic, pp, publisher)
+}
+
 func Test_AddSub(t *testing.T) {
-	rootNode := NewNode("")
+	h := NewHrotti(100, &MemoryPersistence{})
 	rand.Seed(time.Now().UnixNano())
 	topics := [7]string{"a", "b", "c", "d", "e", "+", "#"}
 	for i := 0; i < 20; i++ {
-		c := newClient(nil, "testClientId"+strconv.Itoa(i), 100)
+		c := newTestClient(h, "testClientId"+strconv.Itoa(i))
 		var sub string
 		r := rand.Intn(7)
 		for j := 0; j <= r; j++ {
@@ -38,7 +56,475 @@ func Test_AddSub(t *testing.T) {
 			}
 			sub += "/"
 		}
-		rootNode.AddSub(c, strings.Split(sub, "/"), 1)
+		h.AddSub(c, sub, SubscriptionOptions{Qos: 1})
+	}
+}
+
+func Test_TopicTree(t *testing.T) {
+	filters := []string{"a/b", "a/+", "a/#", "#", "+/b", "a/b/c", "+/+/c", "$share/g/a/b", "$SYS/#", "$SYS/+/c"}
+	for _, topic := range []string{"a", "a/b", "a/b/c", "b/b", "x/y/c", "a/b/c/d", "$SYS/b", "$SYS/b/c"} {
+		tree := newTopicNode()
+		for _, filter := range filters {
+			f, _ := splitShared(filter)
+			tree.add(strings.Split(f, "/"), filter)
+		}
+		found := make(map[string]bool)
+		tree.match(strings.Split(topic, "/"), func(subscription string) {
+			if found[subscription] {
+				t.Errorf("%s matched %s twice", subscription, topic)
+			}
+			found[subscription] = true
+		})
+		for _, filter := range filters {
+			f, _ := splitShared(filter)
+			if expected := match(strings.Split(f, "/"), strings.Split(topic, "/")); found[filter] != expected {
+				t.Errorf("%s matching %s is %t, should be %t", filter, topic, found[filter], expected)
+			}
+		}
+	}
+
+	tree := newTopicNode()
+	tree.add([]string{"a", "b", "c"}, "a/b/c")
+	tree.add([]string{"a", "b"}, "a/b")
+	tree.remove([]string{"a", "b", "c"}, "a/b/c")
+	if _, ok := tree.children["a"].children["b"].children["c"]; ok {
+		t.Errorf("empty node was not pruned")
+	}
+	if tree.remove([]string{"a", "b"}, "a/b") != true || len(tree.children) != 0 {
+		t.Errorf("tree is not empty after removing every filter")
+	}
+}
+
+func Test_DollarTopics(t *testing.T) {
+	for _, test := range []struct {
+		filter  string
+		topic   string
+		matches bool
+	}{
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+		{"$SYS/broker/uptime", "$SYS/broker/uptime", true},
+		{"#", "a/$b", true},
+		{"a/+", "a/$b", true},
+	} {
+		if matched := match(strings.Split(test.filter, "/"), strings.Split(test.topic, "/")); matched != test.matches {
+			t.Errorf("%s matching %s is %t, should be %t", test.filter, test.topic, matched, test.matches)
+		}
+	}
+
+	h := NewHrotti(100, &MemoryPersistence{})
+	all := newTestClient(h, "all")
+	sys := newTestClient(h, "sys")
+	h.AddSub(all, "#", SubscriptionOptions{})
+	h.AddSub(sys, "$SYS/#", SubscriptionOptions{})
+	h.publishSys("$SYS/broker/uptime", 1)
+	if all.queueDepth() != 0 {
+		t.Errorf("# subscriber received a $SYS message")
+	}
+	if sys.queueDepth() != 1 {
+		t.Errorf("$SYS/# subscriber did not receive the $SYS message")
+	}
+}
+
+//Test_EmptyLevels checks that an empty level is a level like any other everywhere topics are
+//matched, so a slash at the start or end of a topic or two together are never normalized away
+func Test_EmptyLevels(t *testing.T) {
+	for topic, levels := range map[string]int{"foo//bar": 3, "foo/bar/": 3, "/foo": 2, "/": 2, "foo": 1} {
+		if n := len(topicLevels(topic)); n != levels {
+			t.Errorf("%q has %d levels, should have %d", topic, n, levels)
+		}
+	}
+
+	tests := []struct {
+		filter  string
+		topic   string
+		matches bool
+	}{
+		{"foo/+/bar", "foo//bar", true},
+		{"foo/bar", "foo//bar", false},
+		{"foo/+", "foo/", true},
+		{"+/foo", "/foo", true},
+		{"+", "/", false},
+		{"+/+", "/", true},
+		{"foo/#", "foo", true},
+		{"foo/#", "foo/", true},
+		{"foo/bar", "foo/bar/", false},
+		{"foo/bar/", "foo/bar", false},
+		{"foo/bar/", "foo/bar/", true},
+		{"/foo", "foo", false},
+	}
+	for _, test := range tests {
+		tree := newTopicNode()
+		tree.add(topicLevels(test.filter), test.filter)
+		found := false
+		tree.match(topicLevels(test.topic), func(string) { found = true })
+		if matched := match(topicLevels(test.filter), topicLevels(test.topic)); matched != test.matches || found != test.matches {
+			t.Errorf("%s matching %q is %t in the tree and %t by match, should be %t", test.filter, test.topic, found, matched, test.matches)
+		}
+		acl := &ACL{Publish: []string{test.filter}}
+		if acl.canPublish(test.topic) != test.matches {
+			t.Errorf("ACL for %s allowing %q is %t, should be %t", test.filter, test.topic, !test.matches, test.matches)
+		}
+		h := NewHrotti(100, &MemoryPersistence{})
+		h.TopicPolicies = map[string]*TopicPolicy{test.filter: {}}
+		if _, p := h.topicPolicy(test.topic); (p != nil) != test.matches {
+			t.Errorf("policy for %s applying to %q is %t, should be %t", test.filter, test.topic, p != nil, test.matches)
+		}
+	}
+
+	//a message retained under foo/bar/ is only ever fetched with foo/bar/
+	h := NewHrotti(100, &MemoryPersistence{})
+	setRetained(h, "foo/bar/", "trailing")
+	c := newTestClient(h, "c")
+	h.AddSub(c, "foo/bar", SubscriptionOptions{Qos: 1})
+	h.AddSub(c, "foo/+", SubscriptionOptions{Qos: 1})
+	if c.queueDepth() != 0 {
+		t.Errorf("foo/bar or foo/+ received the message retained under foo/bar/")
+	}
+	h.AddSub(c, "foo/bar/", SubscriptionOptions{Qos: 1})
+	if msg := receive(t, c); msg.TopicName != "foo/bar/" {
+		t.Errorf("foo/bar/ received a retained message for %s", msg.TopicName)
+	}
+	if purged := h.PurgeRetained("foo/bar"); purged != 0 {
+		t.Errorf("purging foo/bar deleted %d messages", purged)
+	}
+	if purged := h.PurgeRetained("foo/bar/+"); purged != 1 {
+		t.Errorf("purging foo/bar/+ deleted %d messages, should be the one retained under foo/bar/", purged)
+	}
+}
+
+func Test_OverlappingSubscriptions(t *testing.T) {
+	for _, allowDuplicates := range []bool{false, true} {
+		h := NewHrotti(100, &MemoryPersistence{})
+		h.AllowDuplicateMessages = allowDuplicates
+		c := newTestClient(h, "overlap")
+		h.AddSub(c, "#", SubscriptionOptions{Qos: 0})
+		h.AddSub(c, "a/+", SubscriptionOptions{Qos: 2})
+		h.AddSub(c, "a/b", SubscriptionOptions{Qos: 1})
+		pp := NewControlPacket(PUBLISH).(*PublishPacket)
+		pp.TopicName = "a/b"
+		pp.Qos = 2
+		h.DeliverMessage(pp.TopicName, pp, nil)
+
+		var qoss []int
+		for c.queueDepth() > 0 {
+			qoss = append(qoss, int((<-c.outboundMessages).Qos))
+		}
+		sort.Ints(qoss)
+		expected := "[2]"
+		if allowDuplicates {
+			expected = "[0 1 2]"
+		}
+		if fmt.Sprint(qoss) != expected {
+			t.Errorf("with duplicates allowed %t the client received messages at QoS %v, should be %s", allowDuplicates, qoss, expected)
+		}
+	}
+}
+
+func Test_MessagePackets(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	qos1 := newTestClient(h, "qos1")
+	qos2 := newTestClient(h, "qos2")
+	h.AddSub(qos1, "a/b", SubscriptionOptions{Qos: 1})
+	h.AddSub(qos2, "a/b", SubscriptionOptions{Qos: 2})
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "a/b"
+	pp.Payload = []byte("shared")
+	pp.Qos = 2
+	pp.Retain = true
+	message := h.ingest(pp.TopicName, pp)
+	h.setRetained(message)
+	h.route(message, nil)
+
+	first, second := receive(t, qos1), receive(t, qos2)
+	if first == second {
+		t.Fatalf("subscribers were sent the same PUBLISH")
+	}
+	if first.Qos != 1 || second.Qos != 2 || first.Retain || second.Retain {
+		t.Errorf("subscribers were sent QoS %d retain %t and QoS %d retain %t, should be QoS 1 and 2 not retained", first.Qos, first.Retain, second.Qos, second.Retain)
+	}
+	if &first.Payload[0] != &second.Payload[0] || &first.Payload[0] != &message.Payload[0] {
+		t.Errorf("the payload was copied for each subscriber")
+	}
+	//setting each subscriber's message id, QoS and flags leaves the message as it was
+	if message.Qos != 2 || !message.Retain {
+		t.Errorf("message is QoS %d retain %t after routing, should be QoS 2 retained", message.Qos, message.Retain)
+	}
+	late := newTestClient(h, "late")
+	h.AddSub(late, "a/b", SubscriptionOptions{Qos: 2})
+	if retained := receive(t, late); retained.Qos != 2 || !retained.Retain || string(retained.Payload) != "shared" {
+		t.Errorf("retained message was QoS %d retain %t %q, should be QoS 2 retained \"shared\"", retained.Qos, retained.Retain, retained.Payload)
+	}
+}
+
+func Test_UnsubscribePurgesQueue(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	c, _ := newPipeClient(h, "unsub", 100)
+	h.AddSub(c, "a/#", SubscriptionOptions{Qos: 1})
+	h.AddSub(c, "b/#", SubscriptionOptions{Qos: 1})
+	h.AddSub(c, "a/keep", SubscriptionOptions{Qos: 0})
+	for _, topic := range []string{"a/1", "b/1", "a/keep", "a/2"} {
+		pp := NewControlPacket(PUBLISH).(*PublishPacket)
+		pp.TopicName = topic
+		pp.Qos = 1
+		h.DeliverMessage(topic, pp, nil)
+	}
+	h.RemoveSubscription(c, "a/#")
+
+	var topics []string
+	for c.queueDepth() > 0 {
+		topics = append(topics, (<-c.outboundMessages).TopicName)
+	}
+	if strings.Join(topics, ",") != "b/1,a/keep" {
+		t.Errorf("queued messages after unsubscribing are %v, should be [b/1 a/keep]", topics)
+	}
+	//b/1 is still inflight, a/1 and a/2 were removed with their message ids
+	if inflight := c.inflight(); inflight != 2 || countInflight(h.PersistStore, "unsub") != 2 {
+		t.Errorf("%d message ids and %d persisted messages inflight, should be 2", inflight, countInflight(h.PersistStore, "unsub"))
+	}
+	if len(h.subs.subMap["a/#"]) != 0 || h.subs.filters.children["a"].children["#"] != nil {
+		t.Errorf("a/# is still in the subscriptionMap")
+	}
+	if session, _ := h.PersistStore.LoadSession("unsub"); session == nil || len(session.Subscriptions) != 2 {
+		t.Errorf("stored session after unsubscribing is %v, should have 2 subscriptions", session)
+	}
+}
+
+func Test_UnsubscribeDuringPublish(t *testing.T) {
+	h := NewHrotti(10000, &MemoryPersistence{})
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub := dialTestClient(t, h, "unsub", "burst")
+	defer sub.Close()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				pp := NewControlPacket(PUBLISH).(*PublishPacket)
+				pp.TopicName = "burst"
+				pp.Payload = []byte("x")
+				h.DeliverMessage(pp.TopicName, pp, nil)
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	up := NewControlPacket(UNSUBSCRIBE).(*UnsubscribePacket)
+	up.MessageID = 7
+	up.Topics = []string{"burst", "never/subscribed"}
+	up.Write(sub)
+	sub.SetReadDeadline(time.Now().Add(2 * time.Second))
+	acked := false
+	for !acked {
+		rp, err := ReadPacket(sub)
+		if err != nil {
+			t.Fatalf("no UNSUBACK received: %s", err.Error())
+		}
+		switch p := rp.(type) {
+		case *UnsubackPacket:
+			if p.MessageID != 7 {
+				t.Errorf("UNSUBACK message id is %d, should be 7", p.MessageID)
+			}
+			acked = true
+		case *PublishPacket:
+		default:
+			t.Fatalf("unexpected %s", rp.Type())
+		}
+	}
+	//nothing on the topic is delivered after the UNSUBACK, while it is still being published
+	sub.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if rp, err := ReadPacket(sub); err == nil {
+		t.Errorf("received %v after the UNSUBACK", rp)
+	}
+	close(stop)
+	<-done
+}
+
+func Test_NoLocal(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	c1 := newTestClient(h, "c1")
+	c2 := newTestClient(h, "c2")
+	h.AddSub(c1, "a/#", SubscriptionOptions{NoLocal: true})
+	h.AddSub(c2, "a/#", SubscriptionOptions{})
+
+	publish(h, "a/b", c1)
+	if len(c1.outboundMessages) != 0 {
+		t.Errorf("c1 subscribed with NoLocal received %d of its own messages", len(c1.outboundMessages))
+	}
+	if len(c2.outboundMessages) != 1 {
+		t.Errorf("c2 received %d messages, should be 1", len(c2.outboundMessages))
+	}
+
+	publish(h, "a/b", c2)
+	if len(c1.outboundMessages) != 1 {
+		t.Errorf("c1 received %d messages from c2, should be 1", len(c1.outboundMessages))
+	}
+	if len(c2.outboundMessages) != 2 {
+		t.Errorf("c2 without NoLocal received %d messages, should be 2", len(c2.outboundMessages))
+	}
+}
+
+func Test_SuppressEcho(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.AddClientProfile(&ClientProfile{ClientIDPrefix: "agg-", SuppressEcho: true})
+	if !h.clientProfile("agg-1").SuppressEcho {
+		t.Fatalf("agg-1 should match the suppressEcho profile")
+	}
+	if h.clientProfile("sensor-1").SuppressEcho {
+		t.Fatalf("sensor-1 should not match the suppressEcho profile")
+	}
+	agg := newTestClient(h, "agg-1")
+	agg.suppressEcho = h.clientProfile(agg.clientID).SuppressEcho
+	sensor := newTestClient(h, "sensor-1")
+	h.AddSub(agg, "#", SubscriptionOptions{})
+	h.AddSub(sensor, "telemetry/+", SubscriptionOptions{})
+
+	publish(h, "telemetry/agg-1", agg)
+	if len(agg.outboundMessages) != 0 {
+		t.Errorf("suppressEcho client received %d of its own messages", len(agg.outboundMessages))
+	}
+	if len(sensor.outboundMessages) != 1 {
+		t.Errorf("sensor received %d messages, should be 1", len(sensor.outboundMessages))
+	}
+	publish(h, "telemetry/sensor-1", sensor)
+	if len(agg.outboundMessages) != 1 {
+		t.Errorf("suppressEcho client received %d messages from others, should be 1", len(agg.outboundMessages))
+	}
+}
+
+func Test_SharedSubscriptionSkipsPublisher(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	members := []*Client{newTestClient(h, "m1"), newTestClient(h, "m2"), newTestClient(h, "m3")}
+	members[0].suppressEcho = true
+	for _, c := range members {
+		h.AddSub(c, "$share/workers/jobs/#", SubscriptionOptions{})
+	}
+
+	for i := 0; i < 6; i++ {
+		publish(h, "jobs/1", members[0])
+	}
+	if len(members[0].outboundMessages) != 0 {
+		t.Errorf("publishing group member received %d of its own messages", len(members[0].outboundMessages))
+	}
+	if total := len(members[1].outboundMessages) + len(members[2].outboundMessages); total != 6 {
+		t.Errorf("other group members received %d messages, should be 6", total)
+	}
+
+	for _, c := range members {
+		for len(c.outboundMessages) > 0 {
+			<-c.outboundMessages
+		}
+	}
+	for i := 0; i < 6; i++ {
+		publish(h, "jobs/1", nil)
+	}
+	for _, c := range members {
+		if len(c.outboundMessages) != 2 {
+			t.Errorf("%s received %d messages from round robin, should be 2", c.clientID, len(c.outboundMessages))
+		}
+	}
+}
+
+func Test_SharedStrategies(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.SharedStrategies = map[string]SharedStrategy{"s": SharedLeastQueue, "sticky": SharedSticky}
+	drain := func(c *Client) []string {
+		var topics []string
+		for len(c.outboundMessages) > 0 {
+			topics = append(topics, (<-c.outboundMessages).TopicName)
+		}
+		return topics
+	}
+
+	busy, idle := newTestClient(h, "busy"), newTestClient(h, "idle")
+	h.AddSub(busy, "$share/slow/jobs/#", SubscriptionOptions{})
+	h.AddSub(idle, "$share/slow/jobs/#", SubscriptionOptions{})
+	for i := 0; i < 3; i++ {
+		busy.outboundMessages <- NewControlPacket(PUBLISH).(*PublishPacket)
+	}
+	for i := 0; i < 3; i++ {
+		publish(h, "jobs/1", nil)
+	}
+	if len(busy.outboundMessages) != 3 || len(idle.outboundMessages) != 3 {
+		t.Errorf("least-queue group gave %d messages to the busy member and %d to the idle one, should be 0 and 3", len(busy.outboundMessages)-3, len(idle.outboundMessages))
+	}
+	drain(busy)
+	drain(idle)
+
+	members := []*Client{newTestClient(h, "m1"), newTestClient(h, "m2"), newTestClient(h, "m3")}
+	for _, c := range members {
+		h.AddSub(c, "$share/sticky/orders/#", SubscriptionOptions{})
+	}
+	owners := func() map[string]string {
+		owner := make(map[string]string)
+		for i := 0; i < 50; i++ {
+			publish(h, "orders/"+strconv.Itoa(i), nil)
+			publish(h, "orders/"+strconv.Itoa(i), nil)
+		}
+		for _, c := range members {
+			for _, topic := range drain(c) {
+				if previous, ok := owner[topic]; ok && previous != c.clientID {
+					t.Errorf("%s went to %s and %s, a sticky group should send a topic to one member", topic, previous, c.clientID)
+				}
+				owner[topic] = c.clientID
+			}
+		}
+		return owner
+	}
+	before := owners()
+	h.DeleteSub("m3", "$share/sticky/orders/#")
+	after := owners()
+	for topic, owner := range before {
+		if owner != "m3" && after[topic] != owner {
+			t.Errorf("%s moved from %s to %s when m3 left", topic, owner, after[topic])
+		}
+		if after[topic] == "m3" {
+			t.Errorf("%s went to m3 after it left", topic)
+		}
+	}
+}
+
+func Test_SharedRedelivery(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	w1 := dialTestClient(t, h, "w1", "$share/jobs/jobs/#")
+	defer w1.Close()
+	w2 := dialTestClient(t, h, "w2", "$share/jobs/jobs/#")
+	defer w2.Close()
+
+	h.Publish("jobs/1", []byte("1"), 1, false)
+	h.Publish("jobs/2", []byte("2"), 1, false)
+	unacked := readPublish(t, w1, time.Second)
+	acked := readPublish(t, w2, time.Second)
+	if unacked == nil || acked == nil {
+		t.Fatalf("workers received %v and %v, should be a message each", unacked, acked)
+	}
+	pa := NewControlPacket(PUBACK).(*PubackPacket)
+	pa.MessageID = acked.MessageID
+	pa.Write(w2)
+
+	//w1 goes without acknowledging its message, which is moved to w2
+	w1.Close()
+	if pp := readPublish(t, w2, time.Second); pp == nil || pp.TopicName != unacked.TopicName {
+		t.Fatalf("w2 received %v, should be %s moved from w1", pp, unacked.TopicName)
+	}
+	groups := h.subs.sharedSnapshot()
+	if len(groups) != 1 || groups[0].Strategy != "round-robin" || groups[0].Delivered != 3 || groups[0].Redelivered != 1 ||
+		len(groups[0].Members) != 1 || groups[0].Members[0].ClientID != "w2" || groups[0].Members[0].Delivered != 2 {
+		t.Errorf("shared groups are %+v", groups)
 	}
 }
 
@@ -99,11 +585,11 @@ func Test_AddSub2(t *testing.T) {
 }*/
 
 func BenchmarkNormalRouter(b *testing.B) {
-	rootNode := NewNode("")
+	h := NewHrotti(100, &MemoryPersistence{})
 	rand.Seed(time.Now().UnixNano())
 	topics := [7]string{"a", "b", "c", "d", "e", "+", "#"}
 	for i := 0; i < b.N; i++ {
-		c := newClient(nil, "testClientId"+strconv.Itoa(i), 100)
+		c := newTestClient(h, "testClientId"+strconv.Itoa(i))
 		var sub string
 		r := rand.Intn(7)
 		for j := 0; j <= r; j++ {
@@ -114,24 +600,219 @@ func BenchmarkNormalRouter(b *testing.B) {
 			}
 			sub += "/"
 		}
-		rootNode.AddSub(c, strings.Split(sub, "/"), 1)
+		h.AddSub(c, sub, SubscriptionOptions{Qos: 1})
+	}
+	b.ResetTimer()
+	publish(h, "a/b/c/d/e", nil)
+}
+
+//BenchmarkFanOut delivers a 1KB message to 5000 subscribers, half at QoS 0 and half at QoS 1,
+//and writes each subscriber's copy to a buffered writer as their Send goroutines would
+func BenchmarkFanOut(b *testing.B) {
+	h := NewHrotti(10, &MemoryPersistence{})
+	var clients []*Client
+	for i := 0; i < 5000; i++ {
+		c := newTestClient(h, "fanout"+strconv.Itoa(i))
+		h.AddSub(c, "sensors/fan/out", SubscriptionOptions{Qos: byte(i % 2)})
+		clients = append(clients, c)
 	}
-	var treeWorkers sync.WaitGroup
-	recipients := make(chan *Entry)
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "sensors/fan/out"
+	pp.Qos = 1
+	pp.Payload = make([]byte, 1024)
+	w := bufio.NewWriter(ioutil.Discard)
+	b.ReportAllocs()
 	b.ResetTimer()
-	treeWorkers.Add(1)
-	rootNode.FindRecipients(strings.Split("a/b/c/d/e", "/"), recipients, &treeWorkers)
-	treeWorkers.Wait()
-	close(recipients)
-	for {
-		_, ok := <-recipients
-		if !ok {
-			break
+	for i := 0; i < b.N; i++ {
+		h.DeliverMessage(pp.TopicName, pp, nil)
+		for _, c := range clients {
+			msg := <-c.outboundMessages
+			msg.Write(w)
+			if msg.Qos > 0 {
+				h.PersistStore.DeleteInflight(c.clientID, OUTBOUND, msg.MessageID)
+				c.freeID(msg.MessageID)
+			}
 		}
 	}
 }
 
+func Test_MatchCache(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.subs.matches.setSize(2)
+	a := newTestClient(h, "a")
+	b := newTestClient(h, "b")
+	h.AddSub(a, "devices/+/telemetry", SubscriptionOptions{})
+	h.AddSub(a, "devices/1/cmd", SubscriptionOptions{})
+	matching := func(topic string) []string {
+		h.subs.RLock()
+		defer h.subs.RUnlock()
+		_, subscriptions := h.subs.matching(topic)
+		sorted := append([]string(nil), subscriptions...)
+		sort.Strings(sorted)
+		return sorted
+	}
+	expect := func(topic string, hits int64, subscriptions ...string) {
+		t.Helper()
+		if matched := matching(topic); strings.Join(matched, ",") != strings.Join(subscriptions, ",") {
+			t.Errorf("%s matched %v, should match %v", topic, matched, subscriptions)
+		}
+		if h.subs.matches.hits != hits {
+			t.Errorf("%d hits after matching %s, should be %d", h.subs.matches.hits, topic, hits)
+		}
+	}
+	expect("devices/1/telemetry", 0, "devices/+/telemetry")
+	expect("devices/1/telemetry", 1, "devices/+/telemetry")
+	//a filter on another branch, or another client joining a filter, changes nothing it depended on
+	h.AddSub(b, "devices/2/cmd", SubscriptionOptions{})
+	h.AddSub(b, "devices/+/telemetry", SubscriptionOptions{})
+	expect("devices/1/telemetry", 2, "devices/+/telemetry")
+	//filters that match it invalidate it
+	h.AddSub(b, "devices/1/#", SubscriptionOptions{})
+	expect("devices/1/telemetry", 2, "devices/+/telemetry", "devices/1/#")
+	h.AddSub(b, "$share/g/devices/1/telemetry", SubscriptionOptions{})
+	expect("devices/1/telemetry", 2, "$share/g/devices/1/telemetry", "devices/+/telemetry", "devices/1/#")
+	expect("devices/1/telemetry", 3, "$share/g/devices/1/telemetry", "devices/+/telemetry", "devices/1/#")
+	//as does removing the last subscription to one
+	h.DeleteSub("b", "devices/1/#")
+	h.DeleteSub("b", "$share/g/devices/1/telemetry")
+	expect("devices/1/telemetry", 3, "devices/+/telemetry")
+	h.DeleteSub("a", "devices/+/telemetry")
+	expect("devices/1/telemetry", 4, "devices/+/telemetry")
+	h.DeleteSub("b", "devices/+/telemetry")
+	expect("devices/1/telemetry", 4)
+	//a $ topic isn't matched by wildcards at the root
+	h.AddSub(a, "#", SubscriptionOptions{})
+	expect("$SYS/uptime", 4)
+	expect("$SYS/uptime", 5)
+	expect("devices/1/telemetry", 5, "#")
+	//the least recently used topic is evicted
+	expect("devices/3/telemetry", 5, "#")
+	expect("devices/1/telemetry", 6, "#")
+	expect("$SYS/uptime", 6)
+	if h.subs.matches.len() != 2 {
+		t.Errorf("%d topics are cached, should be 2", h.subs.matches.len())
+	}
+	h.subs.matches.setSize(0)
+	expect("devices/1/telemetry", 6, "#")
+	expect("devices/1/telemetry", 6, "#")
+}
+
+//BenchmarkRoute100kTopics routes messages published by 100k devices, each to its own topic
+//and subscribed to its own command topic, to a handful of services subscribed with
+//wildcards, with and without the match cache
+func BenchmarkRoute100kTopics(b *testing.B) {
+	const devices = 100000
+	for _, size := range []int{0, devices} {
+		b.Run("cache="+strconv.Itoa(size), func(b *testing.B) {
+			h := NewHrotti(100, &MemoryPersistence{})
+			h.subs.matches.setSize(size)
+			//the services aren't connected so nothing is queued for them
+			for i, filter := range []string{"devices/+/telemetry", "devices/#", "+/+/telemetry", "devices/+/+", "$share/workers/devices/+/telemetry"} {
+				h.AddSub(newClient(nil, "service"+strconv.Itoa(i), 100), filter, SubscriptionOptions{})
+			}
+			topics := make([]string, devices)
+			for i := range topics {
+				topics[i] = "devices/" + strconv.Itoa(i) + "/telemetry"
+				h.AddSub(newClient(nil, "device"+strconv.Itoa(i), 100), "devices/"+strconv.Itoa(i)+"/cmd", SubscriptionOptions{})
+			}
+			pp := NewControlPacket(PUBLISH).(*PublishPacket)
+			pp.Payload = make([]byte, 64)
+			for _, topic := range topics {
+				h.DeliverMessage(topic, pp, nil)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.DeliverMessage(topics[i%devices], pp, nil)
+			}
+		})
+	}
+}
+
 func main() {
 	br := testing.Benchmark(BenchmarkNormalRouter)
 	fmt.Println(br)
 }
+
+//sessionCounter counts the sessions stored
+type sessionCounter struct {
+	MemoryPersistence
+	stored int
+}
+
+func (p *sessionCounter) StoreSession(client string, session *Session) error {
+	p.stored++
+	return p.MemoryPersistence.StoreSession(client, session)
+}
+
+func Test_Resubscribe(t *testing.T) {
+	p := &sessionCounter{}
+	h := NewHrotti(100, p)
+	c := newTestClient(h, "durable")
+	c.cleanSession = false
+	setRetained(h, "a/1", "state")
+	expect := func(what string, stored int, retained bool) {
+		t.Helper()
+		if p.stored != stored {
+			t.Errorf("%s: session stored %d times, should be %d", what, p.stored, stored)
+		}
+		if retained {
+			if msg := receive(t, c); msg.TopicName != "a/1" {
+				t.Errorf("%s: received %s, should be the retained a/1", what, msg.TopicName)
+			}
+		} else {
+			expectNothing(t, c)
+		}
+	}
+	h.AddSubscription(c, []string{"a/+", "b"}, []byte{1, 0})
+	expect("subscribing", 1, true)
+	sub := h.subs.subMap["a/+"]["durable"]
+
+	//the same filters again change nothing, but are sent the retained messages as MQTT says
+	if granted := h.AddSubscription(c, []string{"a/+", "b"}, []byte{1, 0}); granted[0] != 1 || granted[1] != 0 {
+		t.Errorf("resubscribing granted %v, should be [1 0]", granted)
+	}
+	expect("resubscribing", 1, true)
+	if h.subs.subMap["a/+"]["durable"] != sub {
+		t.Errorf("resubscribing replaced the subscription")
+	}
+	h.SkipRetainedOnResubscribe = true
+	h.AddSubscription(c, []string{"a/+", "b"}, []byte{1, 0})
+	expect("resubscribing skipping retained", 1, false)
+
+	//a changed filter is replaced
+	h.AddSubscription(c, []string{"a/+", "b"}, []byte{0, 0})
+	expect("changing the QoS", 2, true)
+	if sub := h.subs.subMap["a/+"]["durable"]; sub.qos != 0 {
+		t.Errorf("subscription has QoS %d after changing it, should be 0", sub.qos)
+	}
+}
+
+//BenchmarkResubscribe has a durable session with 5000 filters send its whole SUBSCRIBE list
+//again, as it would on reconnecting, with the filters unchanged and with every QoS changed
+func BenchmarkResubscribe(b *testing.B) {
+	for _, changed := range []bool{false, true} {
+		b.Run("changed="+strconv.FormatBool(changed), func(b *testing.B) {
+			h := NewHrotti(100, &MemoryPersistence{})
+			c := newTestClient(h, "durable")
+			c.cleanSession = false
+			filters := make([]string, 5000)
+			qoss := make([]byte, len(filters))
+			for i := range filters {
+				filters[i] = "devices/" + strconv.Itoa(i) + "/+"
+				qoss[i] = 1
+			}
+			h.AddSubscription(c, filters, qoss)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if changed {
+					for j := range qoss {
+						qoss[j] ^= 1
+					}
+				}
+				h.AddSubscription(c, filters, qoss)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package hrotti
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+func newConnect(id string) *ConnectPacket {
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.CleanSession = true
+	cp.KeepaliveTimer = 30
+	cp.ClientIdentifier = id
+	return cp
+}
+
+//pipeConnect serves one end of a net.Pipe on h, sends cp over the other and returns it with
+//the CONNACK return code
+func pipeConnect(t *testing.T, h *Hrotti, cp *ConnectPacket) (net.Conn, byte) {
+	client, server := net.Pipe()
+	h.ServeConn(server)
+	cp.Write(client)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	rp, err := ReadPacket(client)
+	if err != nil {
+		t.Fatalf("no CONNACK for %s: %s", cp.ClientIdentifier, err.Error())
+	}
+	client.SetReadDeadline(time.Time{})
+	return client, rp.(*ConnackPacket).ReturnCode
+}
+
+func Test_ServeConnConnack(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.Auth = &Auth{Users: map[string]string{"user": "password"}}
+	h.MinKeepAlive = 10
+	defer h.Stop()
+
+	tests := []struct {
+		name   string
+		modify func(*ConnectPacket)
+		rc     byte
+	}{
+		{"accepted", func(cp *ConnectPacket) {}, CONN_ACCEPTED},
+		{"bad protocol version", func(cp *ConnectPacket) { cp.ProtocolVersion = 9 }, CONN_REF_BAD_PROTO_VER},
+		{"empty id with a session", func(cp *ConnectPacket) { cp.ClientIdentifier, cp.CleanSession = "", false }, CONN_REF_ID_REJ},
+		{"wrong password", func(cp *ConnectPacket) { cp.Password = []byte("wrong") }, CONN_REF_BAD_USER_PASS},
+		{"keepalive below the minimum", func(cp *ConnectPacket) { cp.KeepaliveTimer = 5 }, CONN_REF_NOT_AUTH},
+	}
+	for _, test := range tests {
+		cp := newConnect("pipe")
+		cp.UsernameFlag, cp.Username = true, "user"
+		cp.PasswordFlag, cp.Password = true, []byte("password")
+		test.modify(cp)
+		conn, rc := pipeConnect(t, h, cp)
+		if rc != test.rc {
+			t.Errorf("%s: CONNACK return code is %d, should be %d", test.name, rc, test.rc)
+		}
+		if rc != CONN_ACCEPTED {
+			expectClosed(t, conn, test.name)
+		} else {
+			NewControlPacket(DISCONNECT).Write(conn)
+		}
+		conn.Close()
+	}
+}
+
+func Test_ServeConnRetained(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	defer h.Stop()
+
+	publisher, _ := pipeConnect(t, h, newConnect("publisher"))
+	defer publisher.Close()
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "status/pump"
+	pp.Payload = []byte("running")
+	pp.Retain = true
+	pp.Write(publisher)
+	waitFor(t, "retained message", func() bool { return len(h.Retained()) == 1 })
+
+	subscriber, _ := pipeConnect(t, h, newConnect("subscriber"))
+	defer subscriber.Close()
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"status/#"}
+	sp.Qoss = []byte{0}
+	sp.Write(subscriber)
+	//the retained message can be sent before or after the SUBACK
+	subscriber.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 2; i++ {
+		rp, err := ReadPacket(subscriber)
+		if err != nil {
+			t.Fatalf("no retained message: %s", err.Error())
+		}
+		if msg, ok := rp.(*PublishPacket); ok {
+			if !msg.Retain || msg.TopicName != "status/pump" || string(msg.Payload) != "running" {
+				t.Errorf("retained message was %s %q retain %t", msg.TopicName, msg.Payload, msg.Retain)
+			}
+			return
+		}
+	}
+	t.Errorf("subscriber didn't receive the retained message")
+}
+
+func Test_ServeConnKeepalive(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	cp := newConnect("quiet")
+	cp.KeepaliveTimer = 1
+	conn, _ := pipeConnect(t, h, cp)
+	defer conn.Close()
+	//a client is disconnected after one and a half keepalives without a packet
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if rp, err := ReadPacket(conn); err == nil {
+		t.Errorf("quiet client received %v", rp)
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Errorf("quiet client wasn't disconnected after its keepalive")
+	}
+
+	h.Stop()
+	client, server := net.Pipe()
+	defer client.Close()
+	h.ServeConn(server)
+	expectClosed(t, client, "connection served after Stop")
+}
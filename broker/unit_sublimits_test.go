@@ -0,0 +1,170 @@
+package hrotti
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+func Test_SubscriptionLimits(t *testing.T) {
+	//the session restored from persistence already has three of the client's four subscriptions
+	path := filepath.Join(t.TempDir(), "hrotti.db")
+	p := &BoltPersistence{Path: path}
+	if err := p.Open(); err != nil {
+		t.Fatalf("failed to open bolt persistence: %s", err.Error())
+	}
+	p.StoreSession("limited", &Session{Subscriptions: map[string]SubscriptionOptions{"a": {Qos: 1}, "b": {Qos: 1}, "$share/g/c": {Qos: 1}}})
+	p.Close()
+
+	h := NewHrotti(100, &BoltPersistence{Path: path})
+	h.MaxSubscriptions = 4
+	h.MaxFilterLength = 16
+	h.MaxFilterLevels = 3
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	conn := connectTestClient(t, h, "limited", false)
+	defer conn.Close()
+	subscribe := func(filters ...string) *SubackPacket {
+		sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+		sp.MessageID = 1
+		sp.Topics = filters
+		for range filters {
+			sp.Qoss = append(sp.Qoss, 1)
+		}
+		sp.Write(conn)
+		rp, err := ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("no SUBACK for %v: %s", filters, err.Error())
+		}
+		return rp.(*SubackPacket)
+	}
+
+	//subscribing again to a filter it has doesn't count, so only e is over the limit, and the
+	//others are over the length and levels
+	sa := subscribe("a", "d", "$share/g/c", "e", "a/very/long/filter", "a/b/c/d")
+	if string(sa.GrantedQoss) != string([]byte{1, 1, 1, 0x80, 0x80, 0x80}) {
+		t.Errorf("granted QoSs are %v, should be 1, 1, 1, 0x80, 0x80, 0x80", sa.GrantedQoss)
+	}
+	if info, _ := h.Client("limited"); info.Subscriptions != 4 {
+		t.Errorf("client has %d subscriptions, should be 4", info.Subscriptions)
+	}
+	if refused := atomic.LoadInt64(&h.stats.subscriptionsRefused); refused != 3 {
+		t.Errorf("%d refused subscriptions were counted, should be 3", refused)
+	}
+	//unsubscribing makes room for another
+	up := NewControlPacket(UNSUBSCRIBE).(*UnsubscribePacket)
+	up.MessageID = 2
+	up.Topics = []string{"$share/g/c"}
+	up.Write(conn)
+	ReadPacket(conn)
+	if sa := subscribe("e"); sa.GrantedQoss[0] != 1 {
+		t.Errorf("subscription after unsubscribing was refused")
+	}
+	if total := h.subs.total(); total != 4 {
+		t.Errorf("broker has %d subscriptions, should be 4", total)
+	}
+}
+
+func Test_SubscriptionLimitDisconnect(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.MaxSubscriptions = 1
+	h.SubscriptionLimitPolicy = DisconnectSubscriber
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	conn := connectTestClient(t, h, "limited", true)
+	defer conn.Close()
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"a", "b"}
+	sp.Qoss = []byte{1, 1}
+	sp.Write(conn)
+	expectClosed(t, conn, "client over the subscription limit")
+}
+
+func Test_TopicLimits(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.MaxTopicLevels = 4
+	h.MaxTopicLevelLength = 8
+	permissive := NewListenerConfig("tcp://127.0.0.1:0")
+	permissive.Permissive = true
+	for name, config := range map[string]*ListenerConfig{"test": NewListenerConfig("tcp://127.0.0.1:0"), "permissive": permissive} {
+		if err := h.AddListener(name, config); err != nil {
+			t.Fatalf("failed to start listener: %s", err.Error())
+		}
+	}
+	defer h.Stop()
+	//as deep as a topic in a packet can be
+	deep := strings.Repeat("a/", 32000) + "a"
+	subscribe := func(conn net.Conn, filter string) {
+		sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+		sp.MessageID = 1
+		sp.Topics = []string{filter}
+		sp.Qoss = []byte{1}
+		sp.Write(conn)
+	}
+
+	//a strict listener disconnects a filter, topic or will topic over the limits
+	conn := connectTestClient(t, h, "deep-sub", true)
+	subscribe(conn, deep)
+	expectClosed(t, conn, "SUBSCRIBE over the limits")
+	conn = connectTestClient(t, h, "long-sub", true)
+	subscribe(conn, "a/abcdefghi")
+	expectClosed(t, conn, "SUBSCRIBE with a level over the limits")
+	conn = connectTestClient(t, h, "deep-pub", true)
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = deep
+	pp.Write(conn)
+	expectClosed(t, conn, "PUBLISH over the limits")
+	conn, _ = net.Dial("tcp", h.listeners["test"].ln.Addr().String())
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName, cp.ProtocolVersion, cp.CleanSession, cp.ClientIdentifier = "MQTT", 4, true, "deep-will"
+	cp.WillFlag, cp.WillTopic = true, "a/b/c/d/e"
+	cp.Write(conn)
+	expectClosed(t, conn, "CONNECT with a will topic over the limits")
+	h.subs.RLock()
+	subscriptions := len(h.subs.subMap)
+	h.subs.RUnlock()
+	if subscriptions != 0 {
+		t.Errorf("%d filters were added to the subscriptions", subscriptions)
+	}
+
+	//a permissive one refuses the filter and acknowledges and drops the message
+	conn, _ = net.Dial("tcp", h.listeners["permissive"].ln.Addr().String())
+	defer conn.Close()
+	cp.ClientIdentifier = "permissive"
+	cp.Write(conn)
+	if rp, err := ReadPacket(conn); err != nil || rp.(*ConnackPacket).ReturnCode != CONN_ACCEPTED {
+		t.Fatalf("permissive listener returned %v %v, should accept the CONNECT without its will", rp, err)
+	}
+	subscribe(conn, deep)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if rp, err := ReadPacket(conn); err != nil || rp.(*SubackPacket).GrantedQoss[0] != 0x80 {
+		t.Errorf("received %v %v, should be a SUBACK refusing the filter", rp, err)
+	}
+	pp.Qos, pp.MessageID = 1, 2
+	pp.Write(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if rp, err := ReadPacket(conn); err != nil || rp.Type() != PUBACK {
+		t.Errorf("received %v %v, should be the PUBACK", rp, err)
+	}
+	if discarded := atomic.LoadInt64(&h.stats.discarded[DropTopicLimits]); discarded != 1 {
+		t.Errorf("%d messages dropped over the topic limits, should be 1", discarded)
+	}
+
+	//and the retained store doesn't take a topic over the limits from anywhere
+	retained := NewControlPacket(PUBLISH).(*PublishPacket)
+	retained.Payload, retained.Retain = []byte("deep"), true
+	h.setRetained(newMessage("a/b/c/d/e", retained))
+	if message := h.retainedMessage("a/b/c/d/e"); message != nil {
+		t.Errorf("retained a message on a topic over the limits")
+	}
+}
@@ -0,0 +1,61 @@
+package hrotti
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_TCPOptions(t *testing.T) {
+	options := TCPOptions{
+		DisableNoDelay:    true,
+		KeepAliveIdle:     30 * time.Second,
+		KeepAliveInterval: 5 * time.Second,
+		ReadBuffer:        65536,
+	}
+	if s := options.String(); s != "nodelay=false keepalive=30s/5s/9 readbuffer=65536" {
+		t.Errorf("options are described as %q", s)
+	}
+	if s := (TCPOptions{DisableKeepAlive: true}).String(); s != "nodelay=true keepalive=off" {
+		t.Errorf("options are described as %q", s)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			defer conn.Close()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %s", err.Error())
+	}
+	defer conn.Close()
+	options.KeepAliveCount = 3
+	options.WriteBuffer = 65536
+	if err := options.apply(conn.(*net.TCPConn)); err != nil {
+		t.Errorf("failed to apply options: %s", err.Error())
+	}
+}
+
+func Test_TCPOptionsListener(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	config := NewListenerConfig("tcp://127.0.0.1:0")
+	config.MaxConnections = 10
+	config.TCP = TCPOptions{KeepAliveIdle: 10 * time.Second, KeepAliveCount: 3, ReadBuffer: 32768, WriteBuffer: 32768}
+	if err := h.AddListener("test", config); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	//the options are set underneath the connection limit, so clients connect as usual
+	conn := connectTestClient(t, h, "tuned", true)
+	defer conn.Close()
+	if _, ok := h.Client("tuned"); !ok {
+		t.Errorf("client on a listener with TCP options didn't connect")
+	}
+}
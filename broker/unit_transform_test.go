@@ -0,0 +1,238 @@
+package hrotti
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+type transformFunc func(Delivery) ([]byte, error)
+
+func (f transformFunc) TransformPayload(delivery Delivery) ([]byte, error) {
+	return f(delivery)
+}
+
+func Test_JSONEnvelope(t *testing.T) {
+	for payload, expected := range map[string]string{
+		`{"temp":21.5}`: `{"temp":21.5}`,
+		"21.5":          `21.5`,
+		"on":            `"on"`,
+		"":              `""`,
+		"\xff\x00":      `"/wA="`,
+	} {
+		shared := []byte(payload)
+		transformed, err := JSONEnvelope{}.TransformPayload(Delivery{Topic: "a/b", Payload: shared, Publisher: "sensor"})
+		if err != nil {
+			t.Fatalf("failed to transform %q: %s", payload, err.Error())
+		}
+		var envelope map[string]json.RawMessage
+		if err := json.Unmarshal(transformed, &envelope); err != nil {
+			t.Fatalf("envelope %s isn't JSON: %s", transformed, err.Error())
+		}
+		if string(envelope["payload"]) != expected || string(envelope["topic"]) != `"a/b"` || string(envelope["clientId"]) != `"sensor"` {
+			t.Errorf("envelope for %q is %s", payload, transformed)
+		}
+		if _, err := time.Parse(`"`+time.RFC3339Nano+`"`, string(envelope["timestamp"])); err != nil {
+			t.Errorf("envelope timestamp %s isn't RFC 3339", envelope["timestamp"])
+		}
+		if (string(envelope["encoding"]) == `"base64"`) != (payload == "\xff\x00") {
+			t.Errorf("envelope for %q has encoding %s", payload, envelope["encoding"])
+		}
+		if string(shared) != payload {
+			t.Errorf("transforming changed the payload to %q", shared)
+		}
+	}
+}
+
+func Test_PayloadTransform(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.PayloadTransformers = map[string]PayloadTransformer{
+		"telemetry/#": JSONEnvelope{},
+		//the most specific filter is used
+		"telemetry/secret": transformFunc(func(delivery Delivery) ([]byte, error) {
+			if delivery.Subscriber == "plain" {
+				return nil, errors.New("plain can't have it")
+			}
+			return []byte(delivery.Filter + " " + delivery.Subscriber), nil
+		}),
+	}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	qos1 := dialTestClient(t, h, "qos1", "telemetry/#")
+	defer qos1.Close()
+	plain := connectTestClient(t, h, "plain", true)
+	defer plain.Close()
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"telemetry/+"}
+	sp.Qoss = []byte{0}
+	sp.Write(plain)
+	ReadPacket(plain)
+	sensor := connectTestClient(t, h, "sensor", true)
+	defer sensor.Close()
+
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "telemetry/temp"
+	pp.Payload = []byte("21.5")
+	pp.Qos = 1
+	pp.MessageID = 1
+	pp.Retain = true
+	pp.Write(sensor)
+	for _, conn := range []net.Conn{qos1, plain} {
+		received := readPublish(t, conn, time.Second)
+		if received == nil {
+			t.Fatalf("message wasn't delivered")
+		}
+		var envelope struct {
+			ClientID string  `json:"clientId"`
+			Payload  float64 `json:"payload"`
+		}
+		if err := json.Unmarshal(received.Payload, &envelope); err != nil || envelope.ClientID != "sensor" || envelope.Payload != 21.5 {
+			t.Errorf("received %s, should be the envelope of the message from sensor", received.Payload)
+		}
+	}
+	//the retained message is kept as it was published and transformed for each new subscriber
+	if retained := h.Retained(); len(retained) != 1 || retained[0].Size != 4 {
+		t.Errorf("retained messages are %+v, should be the original message", retained)
+	}
+	late := connectTestClient(t, h, "late", true)
+	defer late.Close()
+	sp.Topics = []string{"telemetry/temp"}
+	sp.Write(late)
+	//the retained message is queued before the SUBACK
+	if received := readPublish(t, late, time.Second); received == nil || !received.Retain || !json.Valid(received.Payload) {
+		t.Errorf("new subscriber received %v, should be the retained message in an envelope", received)
+	}
+
+	//a transformer's error only skips the client it was for
+	pp.TopicName = "telemetry/secret"
+	pp.Retain = false
+	pp.MessageID = 2
+	pp.Write(sensor)
+	if received := readPublish(t, qos1, time.Second); received == nil || string(received.Payload) != "telemetry/# qos1" {
+		t.Errorf("received %v, should be transformed with the most specific filter's transformer", received)
+	}
+	if received := readPublish(t, plain, 200*time.Millisecond); received != nil {
+		t.Errorf("plain received %s, its transform failed", received.Payload)
+	}
+	if failed := atomic.LoadInt64(&h.stats.transformsFailed); failed != 1 {
+		t.Errorf("%d failed transforms were counted, should be 1", failed)
+	}
+}
+
+func Test_EnvelopeProperties(t *testing.T) {
+	//the properties of a retained request survive a restart and are folded into the envelope
+	path := filepath.Join(t.TempDir(), "hrotti.db")
+	h := NewHrotti(100, &BoltPersistence{Path: path})
+	properties := &Properties{ContentType: "text/plain", ResponseTopic: "replies/1", CorrelationData: []byte("id-1"), UserProperties: []UserProperty{{Key: "k", Value: "v"}}}
+	if err := h.PublishWithProperties("requests/1", []byte("ping"), 1, true, properties); err != nil {
+		t.Fatalf("failed to publish: %s", err.Error())
+	}
+	h.Stop()
+
+	h = NewHrotti(100, &BoltPersistence{Path: path})
+	h.PayloadTransformers = map[string]PayloadTransformer{
+		"requests/#": JSONEnvelope{Properties: []string{"responseTopic", "correlationData"}},
+	}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	conn := connectTestClient(t, h, "responder", true)
+	defer conn.Close()
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"requests/#"}
+	sp.Qoss = []byte{1}
+	sp.Write(conn)
+	received := readPublish(t, conn, time.Second)
+	if received == nil {
+		t.Fatalf("retained request wasn't delivered")
+	}
+	var envelope struct {
+		Payload    string                     `json:"payload"`
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(received.Payload, &envelope); err != nil {
+		t.Fatalf("received %s, should be an envelope: %s", received.Payload, err.Error())
+	}
+	//only the properties the envelope picks are included, correlation data is base64
+	if envelope.Payload != "ping" || len(envelope.Properties) != 2 || string(envelope.Properties["responseTopic"]) != `"replies/1"` || string(envelope.Properties["correlationData"]) != `"aWQtMQ=="` {
+		t.Errorf("received %s, should have the response topic and correlation data", received.Payload)
+	}
+	//an envelope that picks none leaves them out
+	plain, _ := JSONEnvelope{}.TransformPayload(Delivery{Topic: "requests/1", Payload: []byte("ping"), Properties: properties})
+	if strings.Contains(string(plain), "properties") {
+		t.Errorf("envelope without properties picked is %s", plain)
+	}
+}
+
+func Test_TimestampProperty(t *testing.T) {
+	//the time a retained message was received survives a restart and replaces the ts the
+	//publisher set
+	path := filepath.Join(t.TempDir(), "hrotti.db")
+	h := NewHrotti(100, &BoltPersistence{Path: path})
+	h.TimestampProperty = true
+	before := time.Now()
+	properties := &Properties{UserProperties: []UserProperty{{Key: "ts", Value: "forged"}, {Key: "k", Value: "v"}}}
+	if err := h.PublishWithProperties("readings/1", []byte("21.5"), 1, true, properties); err != nil {
+		t.Fatalf("failed to publish: %s", err.Error())
+	}
+	after := time.Now()
+	h.Stop()
+	if len(properties.UserProperties) != 2 || properties.UserProperties[0].Value != "forged" {
+		t.Errorf("stamping changed the publisher's properties to %v", properties.UserProperties)
+	}
+
+	h = NewHrotti(100, &BoltPersistence{Path: path})
+	h.MessageExpiry = time.Hour
+	h.PayloadTransformers = map[string]PayloadTransformer{
+		"readings/#": JSONEnvelope{Properties: []string{"userProperties"}},
+	}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	retained := h.retainedMessage("readings/1")
+	if retained == nil || retained.ReceivedAt.Before(before) || retained.ReceivedAt.After(after) {
+		t.Fatalf("retained message is %v, should have been received between %v and %v", retained, before, after)
+	}
+	//a message loaded after a restart expires MessageExpiry after it was first received
+	if expires := h.expiresAt(retained.packet(retained.Qos, true)); !expires.Equal(retained.ReceivedAt.Add(time.Hour)) {
+		t.Errorf("restored message expires at %v, should be an hour after %v", expires, retained.ReceivedAt)
+	}
+
+	conn := connectTestClient(t, h, "auditor", true)
+	defer conn.Close()
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"readings/#"}
+	sp.Qoss = []byte{1}
+	sp.Write(conn)
+	received := readPublish(t, conn, time.Second)
+	if received == nil {
+		t.Fatalf("retained message wasn't delivered")
+	}
+	var envelope struct {
+		Properties Properties `json:"properties"`
+	}
+	if err := json.Unmarshal(received.Payload, &envelope); err != nil {
+		t.Fatalf("received %s, should be an envelope: %s", received.Payload, err.Error())
+	}
+	user := envelope.Properties.UserProperties
+	if len(user) != 2 || user[0] != (UserProperty{Key: "k", Value: "v"}) || user[1].Key != "ts" {
+		t.Fatalf("received %s, should have the user properties k and ts", received.Payload)
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, user[1].Value); err != nil || !ts.Equal(retained.ReceivedAt) {
+		t.Errorf("ts is %s, should be %s", user[1].Value, retained.ReceivedAt.UTC().Format(time.RFC3339Nano))
+	}
+}
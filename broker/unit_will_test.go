@@ -0,0 +1,161 @@
+package hrotti
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//connectWillClient connects a clean session MQTT client with a will published to will/id
+func connectWillClient(t *testing.T, h *Hrotti, id string) net.Conn {
+	conn, err := net.Dial("tcp", h.listeners["test"].ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.CleanSession = true
+	cp.KeepaliveTimer = 30
+	cp.ClientIdentifier = id
+	cp.WillFlag = true
+	cp.WillTopic = "will/" + id
+	cp.WillMessage = []byte("offline")
+	cp.Write(conn)
+	if rp, err := ReadPacket(conn); err != nil || rp.(*ConnackPacket).ReturnCode != CONN_ACCEPTED {
+		t.Fatalf("client %s was not accepted", id)
+	}
+	return conn
+}
+
+//receivedTopic reads from the subscriber conn for wait and returns the topic of the message
+//it received, or "" if it received nothing
+func receivedTopic(conn net.Conn, wait time.Duration) string {
+	conn.SetReadDeadline(time.Now().Add(wait))
+	rp, err := ReadPacket(conn)
+	if err != nil {
+		return ""
+	}
+	return rp.(*PublishPacket).TopicName
+}
+
+func Test_WillDelay(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.WillDelay = 300 * time.Millisecond
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub := dialTestClient(t, h, "sub", "will/#")
+	defer sub.Close()
+
+	//a client that reconnects within the delay doesn't have its will published
+	connectWillClient(t, h, "blip").Close()
+	time.Sleep(50 * time.Millisecond)
+	conn := connectWillClient(t, h, "blip")
+	defer conn.Close()
+	if topic := receivedTopic(sub, 500*time.Millisecond); topic != "" {
+		t.Errorf("received the will on %s from a client that reconnected", topic)
+	}
+
+	//one that stays away has it published after the delay
+	start := time.Now()
+	connectWillClient(t, h, "gone").Close()
+	if topic := receivedTopic(sub, time.Second); topic != "will/gone" {
+		t.Fatalf("received %q, should be the will on will/gone", topic)
+	}
+	if time.Since(start) < h.WillDelay {
+		t.Errorf("will published after %s, before the will delay", time.Since(start))
+	}
+}
+
+func Test_WillOnTakeover(t *testing.T) {
+	for _, onTakeover := range []bool{false, true} {
+		h := NewHrotti(100, &MemoryPersistence{})
+		h.WillOnTakeover = onTakeover
+		if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+			t.Fatalf("failed to start listener: %s", err.Error())
+		}
+		sub := dialTestClient(t, h, "sub", "will/#")
+		old := connectWillClient(t, h, "device")
+		conn := connectWillClient(t, h, "device")
+		topic := receivedTopic(sub, 300*time.Millisecond)
+		if !onTakeover && topic != "" {
+			t.Errorf("received the will on %s when the client was taken over", topic)
+		}
+		if onTakeover && topic != "will/device" {
+			t.Errorf("received %q, should be the will on will/device with WillOnTakeover", topic)
+		}
+		old.Close()
+		conn.Close()
+		sub.Close()
+		h.Stop()
+	}
+}
+
+//receivedPresence reads a message from the subscriber conn for wait, acknowledging it, and
+//returns its topic and payload separated by a space, or "" if it received nothing
+func receivedPresence(conn net.Conn, wait time.Duration) string {
+	conn.SetReadDeadline(time.Now().Add(wait))
+	rp, err := ReadPacket(conn)
+	if err != nil {
+		return ""
+	}
+	pp := rp.(*PublishPacket)
+	if pp.Qos > 0 {
+		pa := NewControlPacket(PUBACK).(*PubackPacket)
+		pa.MessageID = pp.MessageID
+		pa.Write(conn)
+	}
+	return pp.TopicName + " " + string(pp.Payload)
+}
+
+func Test_Presence(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.Presence = &Presence{ClientIDPrefix: "device-", Qos: 1}
+	if err := h.AddListener("test", NewListenerConfig("tcp://127.0.0.1:0")); err != nil {
+		t.Fatalf("failed to start listener: %s", err.Error())
+	}
+	defer h.Stop()
+	sub := dialTestClient(t, h, "sub", "presence/#")
+	defer sub.Close()
+
+	connectTestClient(t, h, "other", true).Close()
+	old := connectWillClient(t, h, "device-1")
+	defer old.Close()
+	if got := receivedPresence(sub, time.Second); got != "presence/device-1 online" {
+		t.Fatalf("received %q, should be device-1 online and nothing for other", got)
+	}
+	//a takeover leaves the client online
+	conn := connectWillClient(t, h, "device-1")
+	if got := receivedPresence(sub, time.Second); got != "presence/device-1 online" {
+		t.Fatalf("received %q after the takeover, should be device-1 online", got)
+	}
+	//a clean disconnect still sends offline, though the will isn't published
+	dp := NewControlPacket(DISCONNECT)
+	dp.Write(conn)
+	conn.Close()
+	if got := receivedPresence(sub, time.Second); got != "presence/device-1 offline" {
+		t.Fatalf("received %q after the disconnect, should be device-1 offline", got)
+	}
+	if retained := h.retainedMessage("presence/device-1"); retained == nil || string(retained.Payload) != "offline" {
+		t.Errorf("retained presence is %v, should be offline", retained)
+	}
+
+	//waiting for the session to end a durable client stays online until its session expires
+	h.Presence.OnSessionEnd = true
+	h.SessionExpiry = time.Minute
+	connectTestClient(t, h, "device-2", false).Close()
+	if got := receivedPresence(sub, time.Second); got != "presence/device-2 online" {
+		t.Fatalf("received %q, should be device-2 online", got)
+	}
+	if got := receivedPresence(sub, 300*time.Millisecond); got != "" {
+		t.Errorf("received %q when the durable client disconnected", got)
+	}
+	h.expireSessions(time.Now().Add(time.Hour))
+	if got := receivedPresence(sub, time.Second); got != "presence/device-2 offline" {
+		t.Errorf("received %q when the session expired, should be device-2 offline", got)
+	}
+}
@@ -0,0 +1,65 @@
+package hrotti
+
+import (
+	"sync"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//delayedWills holds the will messages waiting for their WillDelay to pass, by client id
+type delayedWills struct {
+	sync.Mutex
+	timers map[string]Timer
+}
+
+func newDelayedWills() *delayedWills {
+	return &delayedWills{timers: make(map[string]Timer)}
+}
+
+//publishWill publishes the will message of the client with id clientID after WillDelay, so
+//a client that reconnects before then, such as a device behind NAT whose connection blipped,
+//doesn't have its will published.
+func (h *Hrotti) publishWill(clientID string, will *PublishPacket) {
+	if h.WillDelay <= 0 {
+		h.sessionLog.Debug("Sending will message", "client", clientID)
+		go h.DeliverMessage(will.TopicName, will, nil)
+		return
+	}
+	h.sessionLog.Debug("Delaying will message", "client", clientID, "delay", h.WillDelay)
+	h.wills.Lock()
+	defer h.wills.Unlock()
+	if t, ok := h.wills.timers[clientID]; ok {
+		t.Stop()
+	}
+	var t Timer
+	t = h.Clock.AfterFunc(h.WillDelay, func() {
+		h.wills.Lock()
+		//a timer that was cancelled or replaced after it fired doesn't send its will
+		if h.wills.timers[clientID] != t {
+			h.wills.Unlock()
+			return
+		}
+		delete(h.wills.timers, clientID)
+		h.wills.Unlock()
+		select {
+		case <-h.stop:
+			return
+		default:
+		}
+		h.sessionLog.Debug("Sending will message", "client", clientID)
+		h.DeliverMessage(will.TopicName, will, nil)
+	})
+	h.wills.timers[clientID] = t
+}
+
+//cancelWill stops a delayed will for clientID being published, it is called when the client
+//reconnects
+func (h *Hrotti) cancelWill(clientID string) {
+	h.wills.Lock()
+	defer h.wills.Unlock()
+	if t, ok := h.wills.timers[clientID]; ok {
+		t.Stop()
+		delete(h.wills.timers, clientID)
+		h.sessionLog.Info("Client reconnected within the will delay, will cancelled", "client", clientID)
+	}
+}
@@ -0,0 +1,508 @@
+//Package client is a small MQTT 3.1.1 client built on the packets package, for bridges, load
+//tests and integration tests. It connects over a connection the caller provides, publishes
+//at QoS 0, 1 and 2 waiting for each message to be acknowledged, calls a handler for each
+//subscription's messages and keeps the connection alive with PINGREQs. It doesn't reconnect,
+//a Client is finished once its connection is lost and Done is closed.
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/alsm/hrotti/packets"
+	"golang.org/x/net/websocket"
+)
+
+//defaultConnectTimeout is how long Connect waits for the CONNACK when Options doesn't say
+const defaultConnectTimeout = 30 * time.Second
+
+//ErrClosed is returned by a call that was waiting for an acknowledgement when the connection
+//was closed by Disconnect
+var ErrClosed = errors.New("client is disconnected")
+
+//ErrPingTimeout is the Err of a client whose connection was closed because the broker didn't
+//answer a PINGREQ within the keepalive
+var ErrPingTimeout = errors.New("no PINGRESP from the broker")
+
+//Options are the settings for a connection. KeepAlive is rounded down to whole seconds, zero
+//turns keepalive off. A ConnectTimeout of zero waits 30 seconds for the CONNACK.
+type Options struct {
+	ClientID       string
+	Username       string
+	Password       []byte
+	CleanSession   bool
+	KeepAlive      time.Duration
+	Will           *Will
+	ConnectTimeout time.Duration
+}
+
+//Will is the message the broker publishes for the client if it goes without disconnecting
+type Will struct {
+	Topic   string
+	Payload []byte
+	Qos     byte
+	Retain  bool
+}
+
+//MessageHandler is called with each message that matches the subscription it was given for
+type MessageHandler func(*PublishPacket)
+
+//Client is a connection to a broker. Its methods can be called from any goroutine, but the
+//MessageHandlers are called one at a time on the goroutine reading from the connection, so a
+//handler that publishes at QoS 1 or 2 or subscribes waits forever for its acknowledgement
+//and must do it from a goroutine of its own.
+type Client struct {
+	conn      net.Conn
+	keepAlive time.Duration
+	writeMu   sync.Mutex
+	mu        sync.Mutex
+	//lastID is the last message id allocated, pending has a channel for the acknowledgement of
+	//each id in use
+	lastID  uint16
+	pending map[uint16]chan ControlPacket
+	//handlers are the MessageHandlers by subscription filter, received has the ids of the QoS
+	//2 messages received that are waiting for their PUBREL
+	handlers map[string]MessageHandler
+	received map[uint16]bool
+	//lastSent is when a packet was last written, pingSent when the unanswered PINGREQ was
+	lastSent time.Time
+	pingSent time.Time
+	//closeErr is why the client closed the connection itself, err why it was closed
+	closeErr error
+	err      error
+	done     chan struct{}
+}
+
+//Dial connects to the broker at address over TCP, see Connect
+func Dial(address string, options Options) (*Client, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return Connect(conn, options)
+}
+
+//DialURL connects to the broker at rawURL, see Connect. The URL is in the form the broker's
+//listeners use: tcp://host:port, tls://host:port (or ssl), ws://host:port/path or
+//wss://host:port/path. tlsConfig is used for tls and wss, nil is the default config.
+func DialURL(rawURL string, tlsConfig *tls.Config, options Options) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp":
+		conn, err = net.Dial("tcp", u.Host)
+	case "tls", "ssl":
+		conn, err = tls.Dial("tcp", u.Host, tlsConfig)
+	case "ws", "wss":
+		origin := "http://" + u.Host
+		if u.Scheme == "wss" {
+			origin = "https://" + u.Host
+		}
+		var config *websocket.Config
+		if config, err = websocket.NewConfig(u.String(), origin); err != nil {
+			return nil, err
+		}
+		config.Protocol = []string{"mqtt"}
+		config.TlsConfig = tlsConfig
+		var ws *websocket.Conn
+		if ws, err = websocket.DialConfig(config); err == nil {
+			ws.PayloadType = websocket.BinaryFrame
+			conn = ws
+		}
+	default:
+		return nil, fmt.Errorf("unknown scheme %q, it should be tcp, tls, ssl, ws or wss", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Connect(conn, options)
+}
+
+//Connect sends a CONNECT over conn and waits for the CONNACK, conn is closed if the broker
+//refuses the connection or doesn't answer within the ConnectTimeout
+func Connect(conn net.Conn, options Options) (*Client, error) {
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.CleanSession = options.CleanSession
+	cp.ClientIdentifier = options.ClientID
+	cp.KeepaliveTimer = uint16(options.KeepAlive / time.Second)
+	if options.Username != "" {
+		cp.UsernameFlag, cp.Username = true, options.Username
+	}
+	if options.Password != nil {
+		cp.PasswordFlag, cp.Password = true, options.Password
+	}
+	if will := options.Will; will != nil {
+		cp.WillFlag = true
+		cp.WillTopic, cp.WillMessage = will.Topic, will.Payload
+		cp.WillQos, cp.WillRetain = will.Qos, will.Retain
+	}
+	timeout := options.ConnectTimeout
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := cp.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := NewReader(conn)
+	rp, err := reader.ReadPacket(0)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ca, ok := rp.(*ConnackPacket)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("broker sent a %s instead of a CONNACK", rp.Type())
+	}
+	if ca.ReturnCode != CONN_ACCEPTED {
+		conn.Close()
+		return nil, fmt.Errorf("%s", ConnackReturnCodes[ca.ReturnCode])
+	}
+	conn.SetDeadline(time.Time{})
+	c := &Client{
+		conn:      conn,
+		keepAlive: time.Duration(cp.KeepaliveTimer) * time.Second,
+		pending:   make(map[uint16]chan ControlPacket),
+		handlers:  make(map[string]MessageHandler),
+		received:  make(map[uint16]bool),
+		lastSent:  time.Now(),
+		done:      make(chan struct{}),
+	}
+	go c.read(reader)
+	if c.keepAlive > 0 {
+		go c.ping()
+	}
+	return c, nil
+}
+
+//Done is closed when the connection is lost or closed by Disconnect, Err then says why
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+//Err is the reason the connection was closed, ErrClosed after Disconnect, or nil while it
+//is still open
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Client) write(cp ControlPacket) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := cp.Write(c.conn); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.lastSent = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+//allocate gives the packet an id and returns the channel its acknowledgements arrive on
+func (c *Client) allocate() (uint16, chan ControlPacket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+	id := NextMessageID(c.lastID, func(id uint16) bool { return c.pending[id] != nil })
+	if id == 0 {
+		return 0, nil, errors.New("every message id is in use")
+	}
+	c.lastID = id
+	//a QoS 2 PUBLISH gets a PUBREC and a PUBCOMP
+	acks := make(chan ControlPacket, 2)
+	c.pending[id] = acks
+	return id, acks, nil
+}
+
+func (c *Client) free(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+//await waits for the next acknowledgement of an id, or the connection to close
+func (c *Client) await(acks chan ControlPacket) (ControlPacket, error) {
+	select {
+	case ack := <-acks:
+		return ack, nil
+	case <-c.done:
+		return nil, c.Err()
+	}
+}
+
+//Publish publishes payload to topic. At QoS 1 it returns once the broker has sent the
+//PUBACK and at QoS 2 once it has sent the PUBCOMP, at QoS 0 as soon as the message is
+//written.
+func (c *Client) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = topic
+	pp.Payload = payload
+	pp.Qos = qos
+	pp.Retain = retain
+	if qos == 0 {
+		return c.write(pp)
+	}
+	id, acks, err := c.allocate()
+	if err != nil {
+		return err
+	}
+	defer c.free(id)
+	pp.MessageID = id
+	if err := c.write(pp); err != nil {
+		return err
+	}
+	ack, err := c.await(acks)
+	if err != nil || qos == 1 {
+		return err
+	}
+	if _, ok := ack.(*PubrecPacket); !ok {
+		return fmt.Errorf("broker answered a QoS 2 PUBLISH with a %s", ack.Type())
+	}
+	prp := NewControlPacket(PUBREL).(*PubrelPacket)
+	prp.MessageID = id
+	if err := c.write(prp); err != nil {
+		return err
+	}
+	_, err = c.await(acks)
+	return err
+}
+
+//Subscribe subscribes to filter at qos and returns the QoS the broker granted, handler is
+//called with each message matching filter. A message matching more than one subscription
+//is passed to the handler of each.
+func (c *Client) Subscribe(filter string, qos byte, handler MessageHandler) (byte, error) {
+	id, acks, err := c.allocate()
+	if err != nil {
+		return 0, err
+	}
+	defer c.free(id)
+	//messages can arrive before the SUBACK
+	c.mu.Lock()
+	previous, subscribed := c.handlers[filter]
+	c.handlers[filter] = handler
+	c.mu.Unlock()
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = id
+	sp.Topics = []string{filter}
+	sp.Qoss = []byte{qos}
+	if err := c.write(sp); err != nil {
+		return 0, err
+	}
+	ack, err := c.await(acks)
+	if err != nil {
+		return 0, err
+	}
+	sa, ok := ack.(*SubackPacket)
+	if !ok || len(sa.GrantedQoss) != 1 {
+		return 0, fmt.Errorf("broker answered a SUBSCRIBE with %s", ack)
+	}
+	if sa.GrantedQoss[0] == 0x80 {
+		c.mu.Lock()
+		if subscribed {
+			c.handlers[filter] = previous
+		} else {
+			delete(c.handlers, filter)
+		}
+		c.mu.Unlock()
+		return 0, errors.New("broker refused the subscription to " + filter)
+	}
+	return sa.GrantedQoss[0], nil
+}
+
+//Unsubscribe removes the subscriptions to filters and their handlers
+func (c *Client) Unsubscribe(filters ...string) error {
+	id, acks, err := c.allocate()
+	if err != nil {
+		return err
+	}
+	defer c.free(id)
+	up := NewControlPacket(UNSUBSCRIBE).(*UnsubscribePacket)
+	up.MessageID = id
+	up.Topics = filters
+	if err := c.write(up); err != nil {
+		return err
+	}
+	if _, err := c.await(acks); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	for _, filter := range filters {
+		delete(c.handlers, filter)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+//Disconnect sends a DISCONNECT, so the broker discards the will, and closes the connection.
+//Calls waiting for acknowledgements return ErrClosed.
+func (c *Client) Disconnect() error {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.closeErr = ErrClosed
+	c.mu.Unlock()
+	err := c.write(NewControlPacket(DISCONNECT))
+	c.conn.Close()
+	<-c.done
+	return err
+}
+
+//read reads the packets from the broker until the connection is closed
+func (c *Client) read(reader *Reader) {
+	var err error
+	for err == nil {
+		var rp ControlPacket
+		if rp, err = reader.ReadPacket(0); err == nil {
+			err = c.handle(rp)
+		}
+	}
+	c.conn.Close()
+	c.mu.Lock()
+	if c.closeErr != nil {
+		err = c.closeErr
+	}
+	c.err = err
+	c.mu.Unlock()
+	close(c.done)
+}
+
+func (c *Client) handle(rp ControlPacket) error {
+	switch p := rp.(type) {
+	case *PublishPacket:
+		return c.receive(p)
+	case *PubrelPacket:
+		c.mu.Lock()
+		delete(c.received, p.MessageID)
+		c.mu.Unlock()
+		pcp := NewControlPacket(PUBCOMP).(*PubcompPacket)
+		pcp.MessageID = p.MessageID
+		return c.write(pcp)
+	case *PingrespPacket:
+		c.mu.Lock()
+		c.pingSent = time.Time{}
+		c.mu.Unlock()
+	case *PubackPacket, *PubrecPacket, *PubcompPacket, *SubackPacket, *UnsubackPacket:
+		c.mu.Lock()
+		acks := c.pending[rp.Details().MessageID]
+		c.mu.Unlock()
+		if acks == nil {
+			return fmt.Errorf("broker sent a %s for message id %d, which isn't in use", rp.Type(), rp.Details().MessageID)
+		}
+		acks <- rp
+	default:
+		return fmt.Errorf("broker sent a %s", rp.Type())
+	}
+	return nil
+}
+
+//receive passes a PUBLISH to the handlers and acknowledges it. A QoS 2 message sent again
+//before its PUBREL has already been passed on, so it is only acknowledged again.
+func (c *Client) receive(pp *PublishPacket) error {
+	switch pp.Qos {
+	case 0:
+		c.dispatch(pp)
+	case 1:
+		c.dispatch(pp)
+		pa := NewControlPacket(PUBACK).(*PubackPacket)
+		pa.MessageID = pp.MessageID
+		return c.write(pa)
+	case 2:
+		c.mu.Lock()
+		duplicate := c.received[pp.MessageID]
+		c.received[pp.MessageID] = true
+		c.mu.Unlock()
+		if !duplicate {
+			c.dispatch(pp)
+		}
+		prp := NewControlPacket(PUBREC).(*PubrecPacket)
+		prp.MessageID = pp.MessageID
+		return c.write(prp)
+	}
+	return nil
+}
+
+func (c *Client) dispatch(pp *PublishPacket) {
+	var handlers []MessageHandler
+	topic := strings.Split(pp.TopicName, "/")
+	c.mu.Lock()
+	for filter, handler := range c.handlers {
+		if matches(strings.Split(filter, "/"), topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.mu.Unlock()
+	for _, handler := range handlers {
+		handler(pp)
+	}
+}
+
+//matches is true if the filter's levels match the topic's. Topics starting with $ aren't
+//matched by a wildcard at the first level.
+func matches(filter []string, topic []string) bool {
+	if strings.HasPrefix(topic[0], "$") && (filter[0] == "+" || filter[0] == "#") {
+		return false
+	}
+	for i, level := range filter {
+		switch {
+		case level == "#":
+			return true
+		case i >= len(topic):
+			return false
+		case level != "+" && level != topic[i]:
+			return false
+		}
+	}
+	return len(filter) == len(topic)
+}
+
+//ping sends a PINGREQ when nothing has been sent for the keepalive, and closes the
+//connection if the broker doesn't answer one within the keepalive
+func (c *Client) ping() {
+	for {
+		c.mu.Lock()
+		next := c.lastSent.Add(c.keepAlive)
+		if !c.pingSent.IsZero() {
+			next = c.pingSent.Add(c.keepAlive)
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.done:
+			return
+		case <-time.After(time.Until(next)):
+		}
+		c.mu.Lock()
+		pingSent, idle := c.pingSent, time.Since(c.lastSent)
+		switch {
+		case !pingSent.IsZero() && time.Since(pingSent) >= c.keepAlive:
+			c.closeErr = ErrPingTimeout
+			c.mu.Unlock()
+			c.conn.Close()
+			return
+		case pingSent.IsZero() && idle >= c.keepAlive:
+			c.pingSent = time.Now()
+			c.mu.Unlock()
+			c.write(NewControlPacket(PINGREQ))
+		default:
+			c.mu.Unlock()
+		}
+	}
+}
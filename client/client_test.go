@@ -0,0 +1,194 @@
+package client
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	hrotti "github.com/alsm/hrotti/broker"
+	. "github.com/alsm/hrotti/packets"
+)
+
+//pipeConnect connects a client to h over a net.Pipe, the returned conn is the client's end
+func pipeConnect(t *testing.T, h *hrotti.Hrotti, options Options) (*Client, net.Conn) {
+	conn, server := net.Pipe()
+	h.ServeConn(server)
+	c, err := Connect(conn, options)
+	if err != nil {
+		t.Fatalf("%s failed to connect: %s", options.ClientID, err.Error())
+	}
+	return c, conn
+}
+
+func receive(t *testing.T, messages chan *PublishPacket) *PublishPacket {
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for a message")
+	}
+	return nil
+}
+
+//roundTrip subscribes sub to topic and publishes to it from pub at each QoS
+func roundTrip(t *testing.T, pub *Client, sub *Client, topic string) {
+	messages := make(chan *PublishPacket, 10)
+	if granted, err := sub.Subscribe(topic, 2, func(pp *PublishPacket) { messages <- pp }); err != nil || granted != 2 {
+		t.Fatalf("subscribe was granted QoS %d: %v", granted, err)
+	}
+	for qos := byte(0); qos <= 2; qos++ {
+		payload := "qos" + string('0'+qos)
+		if err := pub.Publish(topic, []byte(payload), qos, false); err != nil {
+			t.Fatalf("QoS %d publish failed: %s", qos, err.Error())
+		}
+		if msg := receive(t, messages); msg.Qos != qos || string(msg.Payload) != payload {
+			t.Errorf("received %q at QoS %d, should be %q at QoS %d", msg.Payload, msg.Qos, payload, qos)
+		}
+	}
+	if err := sub.Unsubscribe(topic); err != nil {
+		t.Fatalf("unsubscribe failed: %s", err.Error())
+	}
+	pub.Publish(topic, []byte("unsubscribed"), 1, false)
+	select {
+	case msg := <-messages:
+		t.Errorf("received %q after unsubscribing", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_PublishSubscribe(t *testing.T) {
+	h := hrotti.NewHrotti(100, &hrotti.MemoryPersistence{})
+	defer h.Stop()
+	pub, _ := pipeConnect(t, h, Options{ClientID: "pub", CleanSession: true})
+	sub, _ := pipeConnect(t, h, Options{ClientID: "sub", CleanSession: true})
+	roundTrip(t, pub, sub, "client/test")
+	if err := pub.Disconnect(); err != nil {
+		t.Errorf("disconnect failed: %s", err.Error())
+	}
+	if pub.Err() != ErrClosed {
+		t.Errorf("disconnected client's Err is %v", pub.Err())
+	}
+	if err := pub.Publish("client/test", nil, 1, false); err == nil {
+		t.Errorf("disconnected client published")
+	}
+	sub.Disconnect()
+}
+
+//Test_ExternalBroker runs the round trip against the broker at HROTTI_TEST_BROKER, such as
+//a mosquitto on localhost:1883
+func Test_ExternalBroker(t *testing.T) {
+	address := os.Getenv("HROTTI_TEST_BROKER")
+	if address == "" {
+		t.Skip("HROTTI_TEST_BROKER isn't set")
+	}
+	pub, err := Dial(address, Options{ClientID: "hrotti-client-pub", CleanSession: true, KeepAlive: 30 * time.Second})
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	defer pub.Disconnect()
+	sub, err := Dial(address, Options{ClientID: "hrotti-client-sub", CleanSession: true, KeepAlive: 30 * time.Second})
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	defer sub.Disconnect()
+	roundTrip(t, pub, sub, "hrotti/client/test")
+}
+
+func Test_Refused(t *testing.T) {
+	h := hrotti.NewHrotti(100, &hrotti.MemoryPersistence{})
+	h.Auth = &hrotti.Auth{Users: map[string]string{"user": "password"}}
+	defer h.Stop()
+	conn, server := net.Pipe()
+	h.ServeConn(server)
+	_, err := Connect(conn, Options{ClientID: "refused", CleanSession: true, Username: "user", Password: []byte("wrong")})
+	if err == nil || !strings.Contains(err.Error(), "Username or Password") {
+		t.Errorf("connect with the wrong password returned %v", err)
+	}
+	c, _ := pipeConnect(t, h, Options{ClientID: "accepted", CleanSession: true, Username: "user", Password: []byte("password")})
+	c.Disconnect()
+}
+
+func Test_Will(t *testing.T) {
+	h := hrotti.NewHrotti(100, &hrotti.MemoryPersistence{})
+	defer h.Stop()
+	sub, _ := pipeConnect(t, h, Options{ClientID: "watcher", CleanSession: true})
+	defer sub.Disconnect()
+	messages := make(chan *PublishPacket, 1)
+	sub.Subscribe("status/+", 1, func(pp *PublishPacket) { messages <- pp })
+
+	c, conn := pipeConnect(t, h, Options{ClientID: "device", CleanSession: true, Will: &Will{Topic: "status/device", Payload: []byte("gone"), Qos: 1}})
+	conn.Close()
+	if msg := receive(t, messages); msg.TopicName != "status/device" || string(msg.Payload) != "gone" {
+		t.Errorf("will was %s %q", msg.TopicName, msg.Payload)
+	}
+	<-c.Done()
+	if c.Err() == nil || c.Err() == ErrClosed {
+		t.Errorf("client whose connection was lost has Err %v", c.Err())
+	}
+}
+
+func Test_KeepAlive(t *testing.T) {
+	h := hrotti.NewHrotti(100, &hrotti.MemoryPersistence{})
+	defer h.Stop()
+	c, _ := pipeConnect(t, h, Options{ClientID: "idle", CleanSession: true, KeepAlive: time.Second})
+	//the broker drops a client that sends nothing for one and a half keepalives
+	select {
+	case <-c.Done():
+		t.Fatalf("idle client was disconnected: %v", c.Err())
+	case <-time.After(2500 * time.Millisecond):
+	}
+	if err := c.Publish("still/here", nil, 1, false); err != nil {
+		t.Errorf("publish after idling failed: %s", err.Error())
+	}
+	c.Disconnect()
+
+	//a broker that stops answering is noticed within two keepalives
+	conn, server := net.Pipe()
+	go func() {
+		reader := NewReader(server)
+		reader.ReadPacket(0)
+		NewControlPacket(CONNACK).Write(server)
+		for {
+			if _, err := reader.ReadPacket(0); err != nil {
+				return
+			}
+		}
+	}()
+	c, err := Connect(conn, Options{ClientID: "unanswered", KeepAlive: time.Second})
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	select {
+	case <-c.Done():
+		if c.Err() != ErrPingTimeout {
+			t.Errorf("client with no PINGRESP has Err %v", c.Err())
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("client with no PINGRESP wasn't closed")
+	}
+}
+
+func Test_Matches(t *testing.T) {
+	for _, test := range []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/+", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"#", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"a/+/c", "a//c", true},
+		{"a/+", "a/", true},
+		{"a/b", "a/b/", false},
+	} {
+		if matches(strings.Split(test.filter, "/"), strings.Split(test.topic, "/")) != test.match {
+			t.Errorf("%s matching %s should be %t", test.filter, test.topic, test.match)
+		}
+	}
+}
@@ -2,31 +2,568 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/url"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	. "github.com/alsm/hrotti/broker"
+	. "github.com/alsm/hrotti/packets"
 )
 
 type ListenerEntry struct {
-	URL string `json:"url"`
+	URL                 string  `json:"url"`
+	MaxConnections      int     `json:"maxConnections"`
+	AcceptRate          float64 `json:"acceptRate"`
+	CertFile            string  `json:"certFile"`
+	KeyFile             string  `json:"keyFile"`
+	ProxyProtocol       bool    `json:"proxyProtocol"`
+	CAFile              string  `json:"caFile"`
+	UseIdentityFromCert bool    `json:"useIdentityFromCert"`
+	CertIdentity        string  `json:"certIdentity"`
+	RejectCredentials   bool    `json:"rejectCredentials"`
+	Auth                string  `json:"auth"`
+	//TopicRewrites are "from -> to" rules applied before the broker's topicRewrites
+	TopicRewrites []string  `json:"topicRewrites"`
+	TCP           *TCPEntry `json:"tcp"`
+	//CRLFile, DeniedFingerprints and AllowedFingerprints check client certificates
+	CRLFile             string   `json:"crlFile"`
+	DeniedFingerprints  []string `json:"deniedFingerprints"`
+	AllowedFingerprints []string `json:"allowedFingerprints"`
+	//ProtocolMode is strict or permissive, Fixups are the names of the fixups a permissive
+	//listener applies
+	ProtocolMode string   `json:"protocolMode"`
+	Fixups       []string `json:"fixups"`
+}
+
+//TCPEntry is a listener's tcp section, the keepalive times are in seconds
+type TCPEntry struct {
+	NoDelay           *bool `json:"noDelay"`
+	KeepAlive         *bool `json:"keepAlive"`
+	KeepAliveIdle     int   `json:"keepAliveIdle"`
+	KeepAliveInterval int   `json:"keepAliveInterval"`
+	KeepAliveCount    int   `json:"keepAliveCount"`
+	ReadBuffer        int   `json:"readBuffer"`
+	WriteBuffer       int   `json:"writeBuffer"`
+}
+
+//TCPOptions returns the hrotti.TCPOptions for the entry
+func (t *TCPEntry) TCPOptions() TCPOptions {
+	if t == nil {
+		return TCPOptions{}
+	}
+	return TCPOptions{
+		DisableNoDelay:    t.NoDelay != nil && !*t.NoDelay,
+		DisableKeepAlive:  t.KeepAlive != nil && !*t.KeepAlive,
+		KeepAliveIdle:     time.Duration(t.KeepAliveIdle) * time.Second,
+		KeepAliveInterval: time.Duration(t.KeepAliveInterval) * time.Second,
+		KeepAliveCount:    t.KeepAliveCount,
+		ReadBuffer:        t.ReadBuffer,
+		WriteBuffer:       t.WriteBuffer,
+	}
+}
+
+type BridgeTopicEntry struct {
+	Pattern      string `json:"pattern"`
+	Direction    string `json:"direction"`
+	Qos          byte   `json:"qos"`
+	LocalPrefix  string `json:"localPrefix"`
+	RemotePrefix string `json:"remotePrefix"`
+}
+
+type BridgeEntry struct {
+	URL              string              `json:"url"`
+	ClientID         string              `json:"clientId"`
+	Username         string              `json:"username"`
+	Password         string              `json:"password"`
+	KeepAlive        uint16              `json:"keepAlive"`
+	CleanSession     bool                `json:"cleanSession"`
+	SkipRetainedSync bool                `json:"skipRetainedSync"`
+	ProtocolVersion  byte                `json:"protocolVersion"`
+	TryPrivate       *bool               `json:"tryPrivate"`
+	Topics           []*BridgeTopicEntry `json:"topics"`
+}
+
+type RateLimitEntry struct {
+	MessagesPerSecond float64 `json:"messagesPerSecond"`
+	BytesPerSecond    float64 `json:"bytesPerSecond"`
+	Policy            string  `json:"policy"`
+	MaxViolations     int     `json:"maxViolations"`
+}
+
+//AuthEntry is the broker's auth section and each of its authProfiles. Anonymous is read-only
+//anonymous access, it allows anonymous clients and is their acl, which can't let them publish.
+type AuthEntry struct {
+	AllowAnonymous bool                       `json:"allowAnonymous"`
+	Users          map[string]string          `json:"users"`
+	RateLimits     map[string]*RateLimitEntry `json:"rateLimits"`
+	ACLs           map[string]*ACL            `json:"acls"`
+	Anonymous      *ACL                       `json:"anonymous"`
+	Quotas         map[string]*QuotaEntry     `json:"quotas"`
+}
+
+//QuotaEntry is the quota of one of the usernames in an auth section, "" for anonymous clients
+type QuotaEntry struct {
+	MaxConnections int             `json:"maxConnections"`
+	MaxSessions    int             `json:"maxSessions"`
+	MaxQueuedBytes int64           `json:"maxQueuedBytes"`
+	MaxRetained    int             `json:"maxRetained"`
+	RateLimit      *RateLimitEntry `json:"rateLimit"`
+	Policy         string          `json:"policy"`
+}
+
+//Auth returns the Auth for the entry, which must have been validated
+func (a *AuthEntry) Auth() *Auth {
+	auth := &Auth{AllowAnonymous: a.AllowAnonymous, Users: a.Users, ACLs: a.ACLs}
+	if a.Anonymous != nil {
+		auth.AllowAnonymous = true
+		auth.ACLs = map[string]*ACL{"": a.Anonymous}
+		for username, acl := range a.ACLs {
+			auth.ACLs[username] = acl
+		}
+	}
+	if len(a.RateLimits) > 0 {
+		auth.RateLimits = make(map[string]*RateLimit)
+		for username, limit := range a.RateLimits {
+			auth.RateLimits[username] = limit.RateLimit()
+		}
+	}
+	if len(a.Quotas) > 0 {
+		auth.Quotas = make(map[string]*Quota)
+		for username, quota := range a.Quotas {
+			auth.Quotas[username] = quota.Quota()
+		}
+	}
+	return auth
+}
+
+//Quota returns the Quota for the entry, which must have been validated
+func (q *QuotaEntry) Quota() *Quota {
+	quota := &Quota{
+		MaxConnections: q.MaxConnections,
+		MaxSessions:    q.MaxSessions,
+		MaxQueuedBytes: q.MaxQueuedBytes,
+		MaxRetained:    q.MaxRetained,
+	}
+	if q.RateLimit != nil {
+		quota.RateLimit = q.RateLimit.RateLimit()
+	}
+	if q.Policy == "drop-oldest" {
+		quota.Policy = DropOldestOverQuota
+	}
+	return quota
+}
+
+func (q *QuotaEntry) validate(name string) error {
+	if q.MaxConnections < 0 || q.MaxSessions < 0 || q.MaxQueuedBytes < 0 || q.MaxRetained < 0 {
+		return fmt.Errorf("%s can't have negative values", name)
+	}
+	switch q.Policy {
+	case "", "reject", "drop-oldest":
+	default:
+		return fmt.Errorf("%s has unknown policy %q, it should be reject or drop-oldest", name, q.Policy)
+	}
+	if q.RateLimit != nil {
+		return q.RateLimit.validate(name + " rate limit")
+	}
+	return nil
+}
+
+//validate checks the entry, its ACLs can't have a filter over limits as no topic a client can
+//use would match it
+func (a *AuthEntry) validate(name string, limits TopicLimits) error {
+	if a.Anonymous != nil {
+		if len(a.Anonymous.Publish) > 0 {
+			return fmt.Errorf("%s anonymous access is read-only, use the acl for \"\" to let anonymous clients publish", name)
+		}
+		if _, ok := a.ACLs[""]; ok {
+			return fmt.Errorf("%s has both anonymous and an acl for \"\"", name)
+		}
+	}
+	acls := map[string]*ACL{"anonymous": a.Anonymous}
+	for username, acl := range a.ACLs {
+		acls["acl for "+username] = acl
+	}
+	for aclName, acl := range acls {
+		if acl == nil {
+			continue
+		}
+		for _, filter := range append(append([]string(nil), acl.Publish...), acl.Subscribe...) {
+			if err := limits.Check(filter); err != nil {
+				return fmt.Errorf("%s %s has filter %q over the topicLimits: %s", name, aclName, filter, err)
+			}
+		}
+	}
+	for username, limit := range a.RateLimits {
+		if err := limit.validate(name + " rate limit for " + username); err != nil {
+			return err
+		}
+	}
+	for username, quota := range a.Quotas {
+		if err := quota.validate(name + " quota for " + username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var rateLimitPolicies map[string]RateLimitPolicy = map[string]RateLimitPolicy{
+	"":           DelayPublishes,
+	"delay":      DelayPublishes,
+	"drop":       DropQos0Publishes,
+	"disconnect": DisconnectPublisher,
+}
+
+//RateLimit returns the RateLimit for the entry, which must have been validated
+func (r *RateLimitEntry) RateLimit() *RateLimit {
+	return &RateLimit{
+		MessagesPerSecond: r.MessagesPerSecond,
+		BytesPerSecond:    r.BytesPerSecond,
+		Policy:            rateLimitPolicies[r.Policy],
+		MaxViolations:     r.MaxViolations,
+	}
+}
+
+func (r *RateLimitEntry) validate(name string) error {
+	if _, ok := rateLimitPolicies[r.Policy]; !ok {
+		return fmt.Errorf("%s has unknown policy %q, it should be delay, drop or disconnect", name, r.Policy)
+	}
+	if r.MessagesPerSecond < 0 || r.BytesPerSecond < 0 || r.MaxViolations < 0 {
+		return fmt.Errorf("%s can't have negative values", name)
+	}
+	return nil
+}
+
+//PolicyEntry is the policy for one of the filters in topicPolicies. MaxQos defaults to 2
+//and retain to true, so an entry only restricts what it sets.
+type PolicyEntry struct {
+	MaxSize   int    `json:"maxSize"`
+	MaxQos    *int   `json:"maxQos"`
+	QosPolicy string `json:"qosPolicy"`
+	Retain    *bool  `json:"retain"`
+	Policy    string `json:"policy"`
+}
+
+//TopicPolicy returns the TopicPolicy for the entry, which must have been validated
+func (p *PolicyEntry) TopicPolicy() *TopicPolicy {
+	policy := &TopicPolicy{
+		MaxSize:      p.MaxSize,
+		MaxQos:       2,
+		DowngradeQos: p.QosPolicy != "reject",
+		NoRetain:     p.Retain != nil && !*p.Retain,
+	}
+	if p.MaxQos != nil {
+		policy.MaxQos = byte(*p.MaxQos)
+	}
+	if p.Policy == "disconnect" {
+		policy.Action = DisconnectViolation
+	}
+	return policy
+}
+
+func (p *PolicyEntry) validate(filter string) error {
+	if !validFilter(filter) {
+		return fmt.Errorf("Topic policy filter %q isn't a valid topic filter", filter)
+	}
+	if p.MaxSize < 0 {
+		return fmt.Errorf("Topic policy for %s has a negative maxSize", filter)
+	}
+	if p.MaxQos != nil && (*p.MaxQos < 0 || *p.MaxQos > 2) {
+		return fmt.Errorf("Topic policy for %s has maxQos %d, it should be 0, 1 or 2", filter, *p.MaxQos)
+	}
+	switch p.QosPolicy {
+	case "", "downgrade", "reject":
+	default:
+		return fmt.Errorf("Topic policy for %s has unknown qosPolicy %q, it should be downgrade or reject", filter, p.QosPolicy)
+	}
+	switch p.Policy {
+	case "", "drop", "disconnect":
+	default:
+		return fmt.Errorf("Topic policy for %s has unknown policy %q, it should be drop or disconnect", filter, p.Policy)
+	}
+	return nil
+}
+
+//validFilter is true if filter is a valid MQTT topic filter, a + or # has to be a whole
+//level and # has to be the last level
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) > 1 || level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+//Policies returns the TopicPolicies for the topicPolicies entries, keyed by filter
+func (c *BrokerConfig) Policies() map[string]*TopicPolicy {
+	if len(c.TopicPolicies) == 0 {
+		return nil
+	}
+	policies := make(map[string]*TopicPolicy)
+	for filter, entry := range c.TopicPolicies {
+		policies[filter] = entry.TopicPolicy()
+	}
+	return policies
+}
+
+//sharedStrategies are the sharedStrategies names of each SharedStrategy
+var sharedStrategies = map[string]SharedStrategy{
+	"round-robin": SharedRoundRobin,
+	"least-queue": SharedLeastQueue,
+	"sticky":      SharedSticky,
+}
+
+//TransformEntry is the PayloadTransformer for one of the filters in payloadTransforms, Type
+//is the name of one of the built in transformers. Properties are the message properties a
+//json-envelope includes.
+type TransformEntry struct {
+	Type       string   `json:"type"`
+	Properties []string `json:"properties"`
+}
+
+//payloadTransformers make the built in transformers by the name used for them in the config
+var payloadTransformers = map[string]func(*TransformEntry) PayloadTransformer{
+	"json-envelope": func(entry *TransformEntry) PayloadTransformer {
+		return JSONEnvelope{Properties: entry.Properties}
+	},
+}
+
+//PayloadTransformers returns the transformers for the payloadTransforms entries, keyed by
+//filter
+func (c *BrokerConfig) PayloadTransformers() map[string]PayloadTransformer {
+	if len(c.Transforms) == 0 {
+		return nil
+	}
+	transformers := make(map[string]PayloadTransformer)
+	for filter, entry := range c.Transforms {
+		transformers[filter] = payloadTransformers[entry.Type](entry)
+	}
+	return transformers
+}
+
+//PresenceEntry is the presence section, offlineOn is disconnect or session and online and
+//offline are the payloads, the defaults when empty
+type PresenceEntry struct {
+	ClientIDPrefix string `json:"clientIdPrefix"`
+	Topic          string `json:"topic"`
+	Online         string `json:"online"`
+	Offline        string `json:"offline"`
+	Qos            int    `json:"qos"`
+	OfflineOn      string `json:"offlineOn"`
+}
+
+//Presence returns the Presence for the entry, which must have been validated
+func (p *PresenceEntry) Presence() *Presence {
+	presence := &Presence{ClientIDPrefix: p.ClientIDPrefix, Topic: p.Topic, Qos: byte(p.Qos), OnSessionEnd: p.OfflineOn == "session"}
+	if p.Online != "" {
+		presence.Online = []byte(p.Online)
+	}
+	if p.Offline != "" {
+		presence.Offline = []byte(p.Offline)
+	}
+	return presence
+}
+
+func (p *PresenceEntry) validate() error {
+	if p.Topic != "" && (strings.ContainsAny(p.Topic, "+#") || !strings.Contains(p.Topic, "%c")) {
+		return fmt.Errorf("presence topic %q must be a topic name containing %%c", p.Topic)
+	}
+	if p.Qos < 0 || p.Qos > 2 {
+		return fmt.Errorf("presence has QoS %d, it should be 0, 1 or 2", p.Qos)
+	}
+	switch p.OfflineOn {
+	case "", "disconnect", "session":
+	default:
+		return fmt.Errorf("presence offlineOn %q should be disconnect or session", p.OfflineOn)
+	}
+	return nil
+}
+
+//DeadLetterEntry is the deadLetter section, reasons are the names of the reasons messages
+//are dropped for as they appear in the dead letter topics
+type DeadLetterEntry struct {
+	Topic   string   `json:"topic"`
+	Reasons []string `json:"reasons"`
+	MaxSize int      `json:"maxSize"`
+	Rate    float64  `json:"rate"`
+	Qos     int      `json:"qos"`
+}
+
+//DeadLetter returns the DeadLetter for the entry, which must have been validated
+func (d *DeadLetterEntry) DeadLetter() *DeadLetter {
+	deadLetter := &DeadLetter{Topic: d.Topic, MaxSize: d.MaxSize, Rate: d.Rate, Qos: byte(d.Qos)}
+	for _, name := range d.Reasons {
+		reason, _ := ParseDropReason(name)
+		deadLetter.Reasons = append(deadLetter.Reasons, reason)
+	}
+	return deadLetter
+}
+
+func (d *DeadLetterEntry) validate() error {
+	if d.Topic != "" && (strings.ContainsAny(d.Topic, "+#") || strings.HasSuffix(d.Topic, "/")) {
+		return fmt.Errorf("deadLetter topic %q must be a topic name without a trailing /", d.Topic)
+	}
+	for _, name := range d.Reasons {
+		if _, ok := ParseDropReason(name); !ok {
+			return fmt.Errorf("deadLetter has unknown reason %q", name)
+		}
+	}
+	if d.MaxSize < 0 || d.Rate < 0 {
+		return fmt.Errorf("deadLetter can't have negative values")
+	}
+	if d.Qos < 0 || d.Qos > 2 {
+		return fmt.Errorf("deadLetter has QoS %d, it should be 0, 1 or 2", d.Qos)
+	}
+	return nil
+}
+
+//parseRewrites returns the TopicRewrites for "from -> to" rules, in order
+func parseRewrites(rules []string) ([]*TopicRewrite, error) {
+	var rewrites []*TopicRewrite
+	for _, rule := range rules {
+		r, err := ParseTopicRewrite(rule)
+		if err != nil {
+			return nil, err
+		}
+		rewrites = append(rewrites, r)
+	}
+	return rewrites, nil
+}
+
+//TopicRewrites returns the broker's topicRewrites rules, which validate has checked
+func (c *BrokerConfig) TopicRewrites() []*TopicRewrite {
+	rewrites, _ := parseRewrites(c.Rewrites)
+	return rewrites
+}
+
+var bridgeDirections map[string]BridgeDirection = map[string]BridgeDirection{
+	"out":  BridgeOut,
+	"in":   BridgeIn,
+	"both": BridgeBoth,
 }
 
 //Current configuration struct, maxQueueDepth sets the maximum number of unacknowledged mesages
-//for a client. Listeners is a slice of ListenerConfigs
+//for a client. Listeners and Bridges are built from the entries read from the config file.
 type BrokerConfig struct {
-	MaxQueueDepth   int                       `json:"maxQueueDepth"`
-	ListenerEntries map[string]*ListenerEntry `json:"listeners"`
-	Listeners       map[string]*ListenerConfig
-	Logging         struct {
-		Info     string `json:"info"`
-		Protocol string `json:"protocol"`
-		Errlog   string `json:"error"`
-		Debug    string `json:"debug"`
-	}
+	MaxQueueDepth             int                        `json:"maxQueueDepth"`
+	RetainedSyncRate          int                        `json:"retainedSyncRate"`
+	RetainedHighWater         int                        `json:"retainedHighWater"`
+	MaxPacketSize             int                        `json:"maxPacketSize"`
+	MaxInflight               int                        `json:"maxInflight"`
+	ReceiveMaximum            int                        `json:"receiveMaximum"`
+	AllowDuplicates           bool                       `json:"allowDuplicateMessages"`
+	DupWindow                 *int                       `json:"duplicateWindow"`
+	MaxBridgeHops             *int                       `json:"maxBridgeHops"`
+	MatchCacheSize            *int                       `json:"matchCacheSize"`
+	MaxRetainedQos            *int                       `json:"maxRetainedQos"`
+	SkipRetainedOnResubscribe bool                       `json:"skipRetainedOnResubscribe"`
+	RetainEnabled             *bool                      `json:"retainEnabled"`
+	ListenerEntries           map[string]*ListenerEntry  `json:"listeners"`
+	Listeners                 map[string]*ListenerConfig `json:"-"`
+	BridgeEntries             map[string]*BridgeEntry    `json:"bridges"`
+	Bridges                   map[string]*BridgeConfig   `json:"-"`
+	Profiles                  []*ClientProfile           `json:"profiles"`
+	StatsInterval             int                        `json:"statsInterval"`
+	ClientStats               int                        `json:"clientStatsInterval"`
+	ConnectTimeout            int                        `json:"connectTimeout"`
+	HealthTimeout             int                        `json:"healthTimeout"`
+	MaxKeepAlive              int                        `json:"maxKeepAlive"`
+	MinKeepAlive              int                        `json:"minKeepAlive"`
+	SessionExpiry             int                        `json:"sessionExpiry"`
+	WillDelay                 int                        `json:"willDelay"`
+	WillOnTakeover            bool                       `json:"willOnTakeover"`
+	RetryInterval             int                        `json:"retryInterval"`
+	MaxRetries                int                        `json:"maxRetries"`
+	MessageExpiry             int                        `json:"messageExpiry"`
+	TimestampProp             bool                       `json:"timestampProperty"`
+	DeadLetter                *DeadLetterEntry           `json:"deadLetter"`
+	Presence                  *PresenceEntry             `json:"presence"`
+	RateLimit                 *RateLimitEntry            `json:"rateLimit"`
+	Auth                      *AuthEntry                 `json:"auth"`
+	AuthProfiles              map[string]*AuthEntry      `json:"authProfiles"`
+	TopicPolicies             map[string]*PolicyEntry    `json:"topicPolicies"`
+	Rewrites                  []string                   `json:"topicRewrites"`
+	Transforms                map[string]*TransformEntry `json:"payloadTransforms"`
+	TopicMetrics              []string                   `json:"topicMetrics"`
+	SharedStrategies          map[string]string          `json:"sharedStrategies"`
+	User                      string                     `json:"user"`
+	Group                     string                     `json:"group"`
+	Admin                     struct {
+		Address  string `json:"address"`
+		Username string `json:"username"`
+	} `json:"admin"`
+	Metrics struct {
+		Address string `json:"address"`
+	} `json:"metrics"`
+	Persistence struct {
+		Type     string `json:"type"`
+		Path     string `json:"path"`
+		Address  string `json:"address"`
+		Password string `json:"password"`
+		DB       int    `json:"db"`
+		Prefix   string `json:"prefix"`
+		PoolSize int    `json:"poolSize"`
+	} `json:"persistence"`
+	SlowConsumer struct {
+		Policy      string `json:"policy"`
+		GracePeriod int    `json:"gracePeriod"`
+	} `json:"slowConsumer"`
+	RetainedLimits struct {
+		MaxMessages int    `json:"maxMessages"`
+		MaxSize     int    `json:"maxSize"`
+		Policy      string `json:"policy"`
+	} `json:"retainedLimits"`
+	RetainedCache struct {
+		MaxBytes    int `json:"maxBytes"`
+		MaxMessages int `json:"maxMessages"`
+	} `json:"retainedCache"`
+	ConnectionLimits struct {
+		Max    int    `json:"max"`
+		PerIP  int    `json:"perIP"`
+		Policy string `json:"policy"`
+	} `json:"connectionLimits"`
+	AuthBans struct {
+		Failures   int `json:"failures"`
+		Window     int `json:"window"`
+		Duration   int `json:"duration"`
+		MaxEntries int `json:"maxEntries"`
+	} `json:"authBans"`
+	SubscriptionLimits struct {
+		MaxPerClient    int    `json:"maxPerClient"`
+		MaxFilterLength int    `json:"maxFilterLength"`
+		MaxFilterLevels int    `json:"maxFilterLevels"`
+		Policy          string `json:"policy"`
+	} `json:"subscriptionLimits"`
+	//TopicLimits.MaxLevels is DefaultMaxTopicLevels if it isn't set, 0 is no limit
+	TopicLimits struct {
+		MaxLevels      *int `json:"maxLevels"`
+		MaxLevelLength int  `json:"maxLevelLength"`
+		MaxLength      int  `json:"maxLength"`
+	} `json:"topicLimits"`
+	Logging struct {
+		Level      string            `json:"level"`
+		Components map[string]string `json:"components"`
+		Format     string            `json:"format"`
+		Output     string            `json:"output"`
+	} `json:"logging"`
+	MDNS struct {
+		Name string `json:"name"`
+	} `json:"mdns"`
+	WriteBatch struct {
+		Packets int `json:"packets"`
+		Bytes   int `json:"bytes"`
+		Delay   int `json:"delayMicroseconds"`
+	} `json:"writeBatch"`
 }
 
 var logTargets map[string]io.Writer = map[string]io.Writer{
@@ -35,47 +572,526 @@ var logTargets map[string]io.Writer = map[string]io.Writer{
 	"discard": ioutil.Discard,
 }
 
-func (c *BrokerConfig) SetLogTargets() {
-	target, ok := logTargets[c.Logging.Info]
+var logFormats = map[string]bool{"": true, "text": true, "json": true}
+
+var logComponents = map[string]bool{"listener": true, "session": true, "packets": true, "persistence": true, "bridge": true}
+
+//SetLogTargets applies the logging config with setOutput and setLevel, SetLogOutput and
+//SetLogLevel for the broker about to be created or the methods of a running Hrotti when
+//the config is reloaded. By default every component logs at info to stderr as text. The
+//config has already been checked by validate.
+func (c *BrokerConfig) SetLogTargets(setOutput func(io.Writer, bool), setLevel func(string, LogLevel) error) {
+	target, ok := logTargets[c.Logging.Output]
 	if !ok {
-		target = os.Stdout
+		target = os.Stderr
 	}
-	INFO = log.New(target, "INFO: ", log.Ldate|log.Ltime)
-	target, ok = logTargets[c.Logging.Protocol]
-	if !ok {
-		target = ioutil.Discard
+	setOutput(target, c.Logging.Format == "json")
+	//a reloaded config that no longer sets a level goes back to the default
+	level := LogInfo
+	if c.Logging.Level != "" {
+		level, _ = ParseLogLevel(c.Logging.Level)
 	}
-	PROTOCOL = log.New(target, "PROTOCOL: ", log.Ldate|log.Ltime)
-	target, ok = logTargets[c.Logging.Errlog]
-	if !ok {
-		target = os.Stderr
+	setLevel("", level)
+	for component, name := range c.Logging.Components {
+		level, _ := ParseLogLevel(name)
+		setLevel(component, level)
 	}
-	ERROR = log.New(target, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-	target, ok = logTargets[c.Logging.Debug]
-	if !ok {
-		target = ioutil.Discard
+}
+
+//liveSettings are the settings a reload applies to the running broker, listeners are
+//checked by the broker's Reload
+var liveSettings = map[string]bool{"maxPacketSize": true, "rateLimit": true, "auth": true, "authProfiles": true, "topicPolicies": true, "logging": true, "listeners": true}
+
+//restartRequired returns the settings that differ between c and reloaded that need the
+//broker to be restarted to take effect
+func (c *BrokerConfig) restartRequired(reloaded *BrokerConfig) []string {
+	var settings []string
+	current, next := reflect.ValueOf(*c), reflect.ValueOf(*reloaded)
+	for i := 0; i < current.NumField(); i++ {
+		name := strings.Split(current.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name == "-" || liveSettings[name] {
+			continue
+		}
+		if !reflect.DeepEqual(current.Field(i).Interface(), next.Field(i).Interface()) {
+			settings = append(settings, name)
+		}
 	}
-	DEBUG = log.New(target, "DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
+	return settings
 }
 
+//defaultListener is used when there is no config file and HROTTI_URL isn't set
+const defaultListener = "tcp://0.0.0.0:1883"
+
+var listenerSchemes = map[string]bool{"tcp": true, "ws": true, "tls": true, "ssl": true, "wss": true, "quic": true, "mqttsn": true}
+
+//secureSchemes are the listener schemes that need a certificate and can check client ones
+var secureSchemes = map[string]bool{"tls": true, "ssl": true, "wss": true, "quic": true}
+
+var certIdentities = map[string]bool{"": true, "cn": true, "dns": true, "email": true, "uri": true}
+
+//ParseConfig reads the config file confFile into confVar, with no file the broker listens on
+//defaultListener. The environment variables in envOverrides are applied on top, then the
+//config is checked and its Listeners and Bridges are built.
 func ParseConfig(confFile string, confVar *BrokerConfig) error {
-	file, err := os.Open(confFile)
-	if err != nil {
+	if confFile == "" {
+		confVar.ListenerEntries = map[string]*ListenerEntry{"envconfig": {URL: defaultListener}}
+	} else {
+		file, err := os.Open(confFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		decoder := json.NewDecoder(file)
+		//a misspelt key would otherwise be silently ignored
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(confVar); err != nil {
+			return fmt.Errorf("Failed to parse %s: %s", confFile, err.Error())
+		}
+	}
+	if err := confVar.applyEnv(); err != nil {
 		return err
 	}
-	decoder := json.NewDecoder(file)
-
-	err = decoder.Decode(confVar)
-	if err != nil {
+	if confVar.MaxQueueDepth == 0 {
+		confVar.MaxQueueDepth = 100
+	}
+	if err := confVar.validate(); err != nil {
 		return err
 	}
 
 	for name, entry := range confVar.ListenerEntries {
+		url, _ := url.Parse(entry.URL)
+		confVar.Listeners[name] = &ListenerConfig{
+			URL:                 url,
+			MaxConnections:      entry.MaxConnections,
+			AcceptRate:          entry.AcceptRate,
+			CertFile:            entry.CertFile,
+			KeyFile:             entry.KeyFile,
+			ProxyProtocol:       entry.ProxyProtocol,
+			CAFile:              entry.CAFile,
+			UseIdentityFromCert: entry.UseIdentityFromCert,
+			CertIdentity:        entry.CertIdentity,
+			RejectCredentials:   entry.RejectCredentials,
+			TCP:                 entry.TCP.TCPOptions(),
+			CRLFile:             entry.CRLFile,
+			DeniedFingerprints:  entry.DeniedFingerprints,
+			AllowedFingerprints: entry.AllowedFingerprints,
+			Permissive:          entry.ProtocolMode == "permissive",
+		}
+		for _, fixupName := range entry.Fixups {
+			fixup, _ := ParseFixup(fixupName)
+			confVar.Listeners[name].Fixups = append(confVar.Listeners[name].Fixups, fixup)
+		}
+		if entry.Auth != "" {
+			confVar.Listeners[name].Auth = confVar.AuthProfiles[entry.Auth].Auth()
+		}
+		confVar.Listeners[name].TopicRewrites, _ = parseRewrites(entry.TopicRewrites)
+	}
+
+	for name, entry := range confVar.BridgeEntries {
+		url, _ := url.Parse(entry.URL)
+		bridge := &BridgeConfig{
+			URL:               url,
+			ClientID:          entry.ClientID,
+			Username:          entry.Username,
+			Password:          []byte(entry.Password),
+			KeepAlive:         entry.KeepAlive,
+			CleanSession:      entry.CleanSession,
+			SkipRetainedSync:  entry.SkipRetainedSync,
+			ProtocolVersion:   entry.ProtocolVersion,
+			DisableTryPrivate: entry.TryPrivate != nil && !*entry.TryPrivate,
+		}
+		for _, topic := range entry.Topics {
+			bridge.Topics = append(bridge.Topics, &BridgeTopic{
+				Pattern:      topic.Pattern,
+				Direction:    bridgeDirections[topic.Direction],
+				Qos:          topic.Qos,
+				LocalPrefix:  topic.LocalPrefix,
+				RemotePrefix: topic.RemotePrefix,
+			})
+		}
+		confVar.Bridges[name] = bridge
+	}
+	return nil
+}
+
+//validate checks the values read from the config file and environment
+//topicLimits returns the limits of the topicLimits section
+func (c *BrokerConfig) topicLimits() TopicLimits {
+	limits := TopicLimits{MaxLevels: DefaultMaxTopicLevels, MaxLevelLength: c.TopicLimits.MaxLevelLength, MaxLength: c.TopicLimits.MaxLength}
+	if c.TopicLimits.MaxLevels != nil {
+		limits.MaxLevels = *c.TopicLimits.MaxLevels
+	}
+	return limits
+}
+
+func (c *BrokerConfig) validate() error {
+	for name, value := range map[string]int{
+		"maxQueueDepth":       c.MaxQueueDepth,
+		"maxPacketSize":       c.MaxPacketSize,
+		"maxInflight":         c.MaxInflight,
+		"receiveMaximum":      c.ReceiveMaximum,
+		"retainedSyncRate":    c.RetainedSyncRate,
+		"retainedHighWater":   c.RetainedHighWater,
+		"statsInterval":       c.StatsInterval,
+		"clientStatsInterval": c.ClientStats,
+		"connectTimeout":      c.ConnectTimeout,
+		"healthTimeout":       c.HealthTimeout,
+		"maxKeepAlive":        c.MaxKeepAlive,
+		"minKeepAlive":        c.MinKeepAlive,
+		"sessionExpiry":       c.SessionExpiry,
+		"willDelay":           c.WillDelay,
+		"retryInterval":       c.RetryInterval,
+		"maxRetries":          c.MaxRetries,
+		"messageExpiry":       c.MessageExpiry,
+	} {
+		if value < 0 {
+			return fmt.Errorf("%s is %d, it can't be negative", name, value)
+		}
+	}
+	for name, value := range map[string]int{"maxKeepAlive": c.MaxKeepAlive, "minKeepAlive": c.MinKeepAlive} {
+		if value > 65535 {
+			return fmt.Errorf("%s is %d, it can't be more than 65535 seconds", name, value)
+		}
+	}
+	if c.MaxKeepAlive > 0 && c.MinKeepAlive > c.MaxKeepAlive {
+		return fmt.Errorf("minKeepAlive %d is more than maxKeepAlive %d", c.MinKeepAlive, c.MaxKeepAlive)
+	}
+	if c.DupWindow != nil && *c.DupWindow < 0 {
+		return fmt.Errorf("duplicateWindow is %d, it can't be negative", *c.DupWindow)
+	}
+	if c.Group != "" && c.User == "" {
+		return fmt.Errorf("group %s is set without a user to run as", c.Group)
+	}
+	if c.MaxBridgeHops != nil && *c.MaxBridgeHops < 0 {
+		return fmt.Errorf("maxBridgeHops is %d, it can't be negative", *c.MaxBridgeHops)
+	}
+	if c.MatchCacheSize != nil && *c.MatchCacheSize < 0 {
+		return fmt.Errorf("matchCacheSize is %d, it can't be negative", *c.MatchCacheSize)
+	}
+	if c.MaxRetainedQos != nil && (*c.MaxRetainedQos < 0 || *c.MaxRetainedQos > 2) {
+		return fmt.Errorf("maxRetainedQos is %d, it should be 0, 1 or 2", *c.MaxRetainedQos)
+	}
+	if c.RetainedSyncRate > MaxRetainedSyncRate {
+		return fmt.Errorf("retainedSyncRate is %d, it can't be more than %d messages a second", c.RetainedSyncRate, MaxRetainedSyncRate)
+	}
+	for _, profile := range c.Profiles {
+		if profile.RetainHandling > RetainDontSend {
+			return fmt.Errorf("profile %q has retainHandling %d, it should be 0, 1 or 2", profile.ClientIDPrefix, profile.RetainHandling)
+		}
+	}
+	//the name is a single DNS label
+	if len(c.MDNS.Name) > 63 || strings.Contains(c.MDNS.Name, ".") {
+		return fmt.Errorf("mdns name %q should be at most 63 bytes without dots", c.MDNS.Name)
+	}
+	if c.Logging.Level != "" {
+		if _, err := ParseLogLevel(c.Logging.Level); err != nil {
+			return err
+		}
+	}
+	for component, name := range c.Logging.Components {
+		if _, err := ParseLogLevel(name); err != nil {
+			return fmt.Errorf("logging component %s: %s", component, err.Error())
+		}
+		if !logComponents[component] {
+			return fmt.Errorf("Unknown logging component %q, it should be listener, session, packets, persistence or bridge", component)
+		}
+	}
+	if _, ok := logTargets[c.Logging.Output]; !ok && c.Logging.Output != "" {
+		return fmt.Errorf("logging output %q should be stdout, stderr or discard", c.Logging.Output)
+	}
+	if !logFormats[c.Logging.Format] {
+		return fmt.Errorf("logging format %q should be text or json", c.Logging.Format)
+	}
+	rewrites, err := parseRewrites(c.Rewrites)
+	if err == nil {
+		err = CheckTopicRewrites(nil, rewrites)
+	}
+	if err != nil {
+		return err
+	}
+	for name, entry := range c.ListenerEntries {
 		url, err := url.Parse(entry.URL)
 		if err != nil {
+			return fmt.Errorf("Listener %s has a bad url: %s", name, err.Error())
+		}
+		if !listenerSchemes[url.Scheme] {
+			return fmt.Errorf("Listener %s has unknown scheme %q, it should be tcp, ws, tls, wss, quic or mqttsn", name, url.Scheme)
+		}
+		if url.Host == "" {
+			return fmt.Errorf("Listener %s url %q has no address to listen on", name, entry.URL)
+		}
+		if secureSchemes[url.Scheme] && (entry.CertFile == "" || entry.KeyFile == "") {
+			return fmt.Errorf("Listener %s uses %s so it needs a certFile and keyFile", name, url.Scheme)
+		}
+		if entry.CAFile != "" && !secureSchemes[url.Scheme] {
+			return fmt.Errorf("Listener %s has a caFile but uses %s, client certificates need tls, wss or quic", name, url.Scheme)
+		}
+		if (url.Scheme == "quic" || url.Scheme == "mqttsn") && (entry.ProxyProtocol || entry.TCP != nil) {
+			return fmt.Errorf("Listener %s uses %s so it can't have proxyProtocol or tcp options", name, url.Scheme)
+		}
+		if entry.UseIdentityFromCert && entry.CAFile == "" {
+			return fmt.Errorf("Listener %s uses useIdentityFromCert so it needs a caFile", name)
+		}
+		if (entry.CRLFile != "" || len(entry.DeniedFingerprints) > 0 || len(entry.AllowedFingerprints) > 0) && entry.CAFile == "" {
+			return fmt.Errorf("Listener %s checks client certificates so it needs a caFile", name)
+		}
+		for _, fingerprint := range append(entry.DeniedFingerprints, entry.AllowedFingerprints...) {
+			if _, err := ParseFingerprint(fingerprint); err != nil {
+				return fmt.Errorf("Listener %s: %s", name, err.Error())
+			}
+		}
+		if !certIdentities[entry.CertIdentity] {
+			return fmt.Errorf("Listener %s has unknown certIdentity %q, it should be cn, dns, email or uri", name, entry.CertIdentity)
+		}
+		if entry.MaxConnections < 0 {
+			return fmt.Errorf("Listener %s maxConnections is %d, it can't be negative", name, entry.MaxConnections)
+		}
+		if entry.AcceptRate < 0 {
+			return fmt.Errorf("Listener %s acceptRate is %v, it can't be negative", name, entry.AcceptRate)
+		}
+		switch entry.ProtocolMode {
+		case "", "strict":
+			if len(entry.Fixups) > 0 {
+				return fmt.Errorf("Listener %s has fixups but its protocolMode isn't permissive", name)
+			}
+		case "permissive":
+		default:
+			return fmt.Errorf("Listener %s has unknown protocolMode %q, it should be strict or permissive", name, entry.ProtocolMode)
+		}
+		for _, fixup := range entry.Fixups {
+			if _, ok := ParseFixup(fixup); !ok {
+				return fmt.Errorf("Listener %s has unknown fixup %q", name, fixup)
+			}
+		}
+		if tcp := entry.TCP; tcp != nil {
+			for setting, value := range map[string]int{
+				"keepAliveIdle":     tcp.KeepAliveIdle,
+				"keepAliveInterval": tcp.KeepAliveInterval,
+				"keepAliveCount":    tcp.KeepAliveCount,
+				"readBuffer":        tcp.ReadBuffer,
+				"writeBuffer":       tcp.WriteBuffer,
+			} {
+				if value < 0 {
+					return fmt.Errorf("Listener %s tcp %s is %d, it can't be negative", name, setting, value)
+				}
+			}
+		}
+		if _, ok := c.AuthProfiles[entry.Auth]; entry.Auth != "" && !ok {
+			return fmt.Errorf("Listener %s uses auth profile %q which isn't in authProfiles", name, entry.Auth)
+		}
+		//a loop can be made by the listener's rules, the broker's or the two together
+		listenerRewrites, err := parseRewrites(entry.TopicRewrites)
+		if err == nil {
+			err = CheckTopicRewrites(listenerRewrites, rewrites)
+		}
+		if err != nil {
+			return fmt.Errorf("Listener %s: %s", name, err.Error())
+		}
+	}
+	for name, entry := range c.BridgeEntries {
+		if _, err := url.Parse(entry.URL); err != nil {
+			return fmt.Errorf("Bridge %s has a bad url: %s", name, err.Error())
+		}
+		if entry.ProtocolVersion != 0 && entry.ProtocolVersion != 3 && entry.ProtocolVersion != 4 {
+			return fmt.Errorf("Bridge %s has protocol version %d, it should be 3 or 4", name, entry.ProtocolVersion)
+		}
+		for _, topic := range entry.Topics {
+			if _, ok := bridgeDirections[topic.Direction]; !ok {
+				return fmt.Errorf("Bridge %s topic %s has unknown direction %q", name, topic.Pattern, topic.Direction)
+			}
+			if topic.Qos > 2 {
+				return fmt.Errorf("Bridge %s topic %s has QoS %d, it should be 0, 1 or 2", name, topic.Pattern, topic.Qos)
+			}
+		}
+	}
+	if c.RateLimit != nil {
+		if err := c.RateLimit.validate("rateLimit"); err != nil {
 			return err
 		}
-		confVar.Listeners[name] = &ListenerConfig{URL: url}
+	}
+	if c.DeadLetter != nil {
+		if err := c.DeadLetter.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Presence != nil {
+		if err := c.Presence.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Auth != nil {
+		if err := c.Auth.validate("auth", c.topicLimits()); err != nil {
+			return err
+		}
+	}
+	for name, profile := range c.AuthProfiles {
+		if err := profile.validate("Auth profile "+name, c.topicLimits()); err != nil {
+			return err
+		}
+	}
+	for filter, policy := range c.TopicPolicies {
+		if err := policy.validate(filter); err != nil {
+			return err
+		}
+	}
+	for filter, transform := range c.Transforms {
+		if !validFilter(filter) {
+			return fmt.Errorf("Payload transform filter %q isn't a valid topic filter", filter)
+		}
+		if transform == nil {
+			return fmt.Errorf("Payload transform for %s has no type", filter)
+		}
+		if _, ok := payloadTransformers[transform.Type]; !ok {
+			return fmt.Errorf("Payload transform for %s has unknown type %q, it should be json-envelope", filter, transform.Type)
+		}
+		for _, property := range transform.Properties {
+			known := false
+			for _, name := range EnvelopeProperties {
+				known = known || name == property
+			}
+			if !known {
+				return fmt.Errorf("Payload transform for %s has unknown property %q, it should be one of %s", filter, property, strings.Join(EnvelopeProperties, ", "))
+			}
+		}
+	}
+	for prefix, strategy := range c.SharedStrategies {
+		if _, ok := sharedStrategies[strategy]; !ok {
+			return fmt.Errorf("Shared strategy for groups starting %q is %q, it should be round-robin, least-queue or sticky", prefix, strategy)
+		}
+	}
+	for _, prefix := range c.TopicMetrics {
+		trimmed := strings.TrimSuffix(prefix, "/")
+		if trimmed == "" || strings.ContainsAny(prefix, "+#") {
+			return fmt.Errorf("Topic metrics prefix %q should be one or more topic levels without wildcards", prefix)
+		}
+		//the topics under no prefix are counted as other
+		if trimmed == "other" {
+			return fmt.Errorf("Topic metrics prefix %q is the name used for topics under no prefix", prefix)
+		}
+	}
+	switch c.Persistence.Type {
+	case "", "memory", "bolt":
+	case "redis":
+		if c.Persistence.Address == "" {
+			return fmt.Errorf("Redis persistence needs an address")
+		}
+		if c.Persistence.DB < 0 || c.Persistence.PoolSize < 0 {
+			return fmt.Errorf("Redis persistence db and poolSize can't be negative")
+		}
+	default:
+		return fmt.Errorf("Unknown persistence type %q, it should be memory, bolt or redis", c.Persistence.Type)
+	}
+	switch c.SlowConsumer.Policy {
+	case "", "drop", "disconnect":
+	default:
+		return fmt.Errorf("Unknown slowConsumer policy %q, it should be drop or disconnect", c.SlowConsumer.Policy)
+	}
+	if c.RetainedLimits.MaxMessages < 0 || c.RetainedLimits.MaxSize < 0 {
+		return fmt.Errorf("retainedLimits maxMessages and maxSize can't be negative")
+	}
+	if c.RetainedCache.MaxBytes < 0 || c.RetainedCache.MaxMessages < 0 {
+		return fmt.Errorf("retainedCache maxBytes and maxMessages can't be negative")
+	}
+	switch c.RetainedLimits.Policy {
+	case "", "deliver", "reject":
+	default:
+		return fmt.Errorf("Unknown retainedLimits policy %q, it should be deliver or reject", c.RetainedLimits.Policy)
+	}
+	if limits := c.topicLimits(); limits.MaxLevels < 0 || limits.MaxLevelLength < 0 || limits.MaxLength < 0 {
+		return fmt.Errorf("topicLimits maxLevels, maxLevelLength and maxLength can't be negative")
+	}
+	if c.SubscriptionLimits.MaxPerClient < 0 || c.SubscriptionLimits.MaxFilterLength < 0 || c.SubscriptionLimits.MaxFilterLevels < 0 {
+		return fmt.Errorf("subscriptionLimits maxPerClient, maxFilterLength and maxFilterLevels can't be negative")
+	}
+	switch c.SubscriptionLimits.Policy {
+	case "", "refuse", "disconnect":
+	default:
+		return fmt.Errorf("Unknown subscriptionLimits policy %q, it should be refuse or disconnect", c.SubscriptionLimits.Policy)
+	}
+	if c.WriteBatch.Packets < 0 || c.WriteBatch.Bytes < 0 || c.WriteBatch.Delay < 0 {
+		return fmt.Errorf("writeBatch packets, bytes and delayMicroseconds can't be negative")
+	}
+	if c.ConnectionLimits.Max < 0 || c.ConnectionLimits.PerIP < 0 {
+		return fmt.Errorf("connectionLimits max and perIP can't be negative")
+	}
+	switch c.ConnectionLimits.Policy {
+	case "", "close", "connack":
+	default:
+		return fmt.Errorf("Unknown connectionLimits policy %q, it should be close or connack", c.ConnectionLimits.Policy)
+	}
+	if bans := c.AuthBans; bans.Failures < 0 || bans.Window < 0 || bans.Duration < 0 || bans.MaxEntries < 0 {
+		return fmt.Errorf("authBans failures, window, duration and maxEntries can't be negative")
+	}
+	return nil
+}
+
+//envOverrides are the environment variables that override settings from the config file,
+//each function applies the value of the variable to the config
+var envOverrides = map[string]func(c *BrokerConfig, value string) error{
+	"HROTTI_URL": func(c *BrokerConfig, value string) error {
+		c.ListenerEntries = map[string]*ListenerEntry{"envconfig": {URL: value}}
+		return nil
+	},
+	"HROTTI_MAX_QUEUE_DEPTH": func(c *BrokerConfig, value string) error {
+		return envInt(value, &c.MaxQueueDepth)
+	},
+	"HROTTI_MAX_PACKET_SIZE": func(c *BrokerConfig, value string) error {
+		return envInt(value, &c.MaxPacketSize)
+	},
+	"HROTTI_MAX_INFLIGHT": func(c *BrokerConfig, value string) error {
+		return envInt(value, &c.MaxInflight)
+	},
+	"HROTTI_CONNECT_TIMEOUT": func(c *BrokerConfig, value string) error {
+		return envInt(value, &c.ConnectTimeout)
+	},
+	"HROTTI_RETAIN_ENABLED": func(c *BrokerConfig, value string) error {
+		enabled, err := strconv.ParseBool(value)
+		c.RetainEnabled = &enabled
+		return err
+	},
+	"HROTTI_LOG_LEVEL": func(c *BrokerConfig, value string) error {
+		c.Logging.Level = value
+		return nil
+	},
+	"HROTTI_LOG_FORMAT": func(c *BrokerConfig, value string) error {
+		c.Logging.Format = value
+		return nil
+	},
+	"HROTTI_PERSISTENCE": func(c *BrokerConfig, value string) error {
+		c.Persistence.Type = value
+		return nil
+	},
+	"HROTTI_PERSISTENCE_PATH": func(c *BrokerConfig, value string) error {
+		c.Persistence.Path = value
+		return nil
+	},
+	"HROTTI_PERSISTENCE_ADDRESS": func(c *BrokerConfig, value string) error {
+		c.Persistence.Address = value
+		return nil
+	},
+	"HROTTI_ADMIN_ADDRESS": func(c *BrokerConfig, value string) error {
+		c.Admin.Address = value
+		return nil
+	},
+	"HROTTI_METRICS_ADDRESS": func(c *BrokerConfig, value string) error {
+		c.Metrics.Address = value
+		return nil
+	},
+}
+
+func envInt(value string, field *int) error {
+	i, err := strconv.Atoi(value)
+	*field = i
+	return err
+}
+
+func (c *BrokerConfig) applyEnv() error {
+	for name, apply := range envOverrides {
+		if value := os.Getenv(name); value != "" {
+			if err := apply(c, value); err != nil {
+				return fmt.Errorf("Bad value %q for %s: %s", value, name, err.Error())
+			}
+		}
 	}
 	return nil
 }
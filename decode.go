@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	. "github.com/alsm/hrotti/packets"
+)
+
+//decodeCommand is "hrotti decode [-raw] [file]", it prints the MQTT packets in a capture of
+//one side of a connection read from file or stdin. The capture is the TCP payload in hex,
+//such as tshark's tcp.payload field or a Wireshark hex stream, unless -raw is given. It
+//returns the exit status, 1 if any of the capture couldn't be decoded.
+func decodeCommand(args []string, stdin io.Reader, out io.Writer) int {
+	flags := flag.NewFlagSet("decode", flag.ContinueOnError)
+	flags.SetOutput(out)
+	raw := flags.Bool("raw", false, "The input is raw bytes rather than hex")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	in := stdin
+	if flags.NArg() > 0 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintln(out, err.Error())
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		fmt.Fprintln(out, err.Error())
+		return 1
+	}
+	if !*raw {
+		if data, err = decodeHex(string(data)); err != nil {
+			fmt.Fprintln(out, err.Error())
+			return 1
+		}
+	}
+	if !decodePackets(data, out) {
+		return 1
+	}
+	return 0
+}
+
+//decodeHex turns a hex dump into bytes. Whitespace, colons and 0x prefixes are ignored,
+//as is the offset at the start of each line of a hex dump.
+func decodeHex(dump string) ([]byte, error) {
+	var digits strings.Builder
+	for _, line := range strings.Split(dump, "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, ":"); i > 0 && strings.HasPrefix(line, "0x") && !strings.ContainsAny(line[:i], " \t") {
+			line = line[i+1:]
+		}
+		for _, field := range strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' || r == ':' }) {
+			digits.WriteString(strings.TrimPrefix(field, "0x"))
+		}
+	}
+	b, err := hex.DecodeString(digits.String())
+	if err != nil {
+		return nil, errors.New("Input isn't hex, use -raw for raw bytes: " + err.Error())
+	}
+	return b, nil
+}
+
+//decodePackets prints each packet in data with its offset. A packet that can't be unpacked
+//is reported and skipped using the length in its fixed header, a packet cut off at the
+//end of data is reported and ends the decoding. It returns false if any of data couldn't
+//be decoded.
+func decodePackets(data []byte, out io.Writer) bool {
+	ok := true
+	for offset := 0; offset < len(data); {
+		length, headerLength, err := packetLength(data[offset:])
+		if err != nil {
+			fmt.Fprintf(out, "offset %d: %s, %d bytes not decoded\n", offset, err.Error(), len(data)-offset)
+			return false
+		}
+		if offset+headerLength+length > len(data) {
+			fmt.Fprintf(out, "offset %d: partial %s, %d of %d bytes\n", offset, packetName(data[offset]), len(data)-offset, headerLength+length)
+			return false
+		}
+		packet := data[offset : offset+headerLength+length]
+		cp, err := ReadPacket(bytes.NewReader(packet))
+		if err != nil {
+			fmt.Fprintf(out, "offset %d: malformed %s, %d bytes: %s\n  %x\n", offset, packetName(data[offset]), len(packet), err.Error(), packet)
+			ok = false
+		} else {
+			fmt.Fprintf(out, "offset %d: %s, %d bytes\n%s\n", offset, cp.Type(), len(packet), strings.TrimRight(cp.String(), "\n"))
+		}
+		offset += len(packet)
+	}
+	return ok
+}
+
+//packetLength reads the fixed header at the start of data, returning the remaining length
+//and the length of the fixed header
+func packetLength(data []byte) (int, int, error) {
+	length, multiplier := 0, 1
+	for i := 1; i < len(data) && i <= 4; i++ {
+		length += int(data[i]&127) * multiplier
+		if data[i]&128 == 0 {
+			return length, i + 1, nil
+		}
+		multiplier *= 128
+	}
+	if len(data) < 5 {
+		return 0, 0, errors.New("partial fixed header")
+	}
+	return 0, 0, errors.New("remaining length is longer than 4 bytes")
+}
+
+func packetName(typeAndFlags byte) string {
+	if name, ok := PacketNames[PacketType(typeAndFlags>>4)]; ok {
+		return name
+	}
+	return fmt.Sprintf("packet of unknown type %d", typeAndFlags>>4)
+}
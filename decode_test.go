@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCapture(t *testing.T) {
+	//a CONNECT, a QoS 1 PUBLISH, a PUBACK with a byte missing from its body, a PINGREQ
+	//and the first byte of a PUBLISH that was cut off
+	capture := `0x0000:  1010 0004 4d51 5454 0402 003c 0004 7465
+	0x0010:  7374 3209 0003 612f 6200 0168 6940 0100
+	0x0020:  c000 30`
+	var out bytes.Buffer
+	if status := decodeCommand(nil, strings.NewReader(capture), &out); status != 1 {
+		t.Errorf("exit status is %d, should be 1 as the capture has a malformed packet", status)
+	}
+	for _, expected := range []string{
+		"offset 0: CONNECT, 18 bytes",
+		"clientId: test",
+		"offset 18: PUBLISH, 11 bytes",
+		"topicName: a/b MessageID: 1",
+		"offset 29: malformed PUBACK, 3 bytes",
+		"offset 32: PINGREQ, 2 bytes",
+		"offset 34: partial fixed header, 1 bytes not decoded",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("output doesn't contain %q:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestDecodeRaw(t *testing.T) {
+	var out bytes.Buffer
+	//a SUBSCRIBE whose remaining length is more than the bytes that follow
+	if status := decodeCommand([]string{"-raw"}, bytes.NewReader([]byte{0x82, 0x08, 0x00, 0x01}), &out); status != 1 {
+		t.Errorf("exit status is %d, should be 1", status)
+	}
+	if !strings.Contains(out.String(), "offset 0: partial SUBSCRIBE, 4 of 10 bytes") {
+		t.Errorf("output is %q", out.String())
+	}
+	out.Reset()
+	if status := decodeCommand(nil, strings.NewReader("d000 e0:00"), &out); status != 0 {
+		t.Errorf("exit status is %d for valid packets:\n%s", status, out.String())
+	}
+}
@@ -1,54 +1,337 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	. "github.com/alsm/hrotti/broker"
 )
 
-func createConfig() BrokerConfig {
-	configFile := flag.String("conf", "", "A configuration file")
+//createConfig reads the config, it returns the config file so it can be reloaded and the
+//state file to import, if any
+func createConfig() (string, string, BrokerConfig) {
+	configFile := flag.String("config", "", "A configuration file")
+	flag.StringVar(configFile, "conf", "", "Deprecated, the same as -config")
+	importFile := flag.String("import", "", "A state file from hrotti export or the admin API to load into the empty persistence before starting")
 
 	flag.Parse()
 
 	var config BrokerConfig
-	config.ListenerEntries = make(map[string]*ListenerEntry)
 	config.Listeners = make(map[string]*ListenerConfig)
+	config.Bridges = make(map[string]*BridgeConfig)
 
-	if *configFile == "" {
-		listener := NewListenerConfig(os.Getenv("HROTTI_URL"))
-		if listener.URL.Host == "" {
-			listener = NewListenerConfig("tcp://0.0.0.0:1883")
-		}
-		config.Listeners["envconfig"] = listener
-		config.MaxQueueDepth = 100
-	} else {
+	if *configFile != "" {
 		fmt.Println("Reading config file", *configFile)
-		err := ParseConfig(*configFile, &config)
+	}
+	if err := ParseConfig(*configFile, &config); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%s\n", err.Error()))
+		os.Exit(1)
+	}
+	config.SetLogTargets(SetLogOutput, SetLogLevel)
+	return *configFile, *importFile, config
+}
+
+//reloadConfig re-reads configFile and applies what it can to the running broker, anything
+//else that changed from current is reported as needing a restart. It returns the config now
+//in effect, a file that fails to parse leaves current in effect.
+func reloadConfig(h *Hrotti, configFile string, current BrokerConfig) BrokerConfig {
+	fmt.Println("Reloading config file", configFile)
+	var config BrokerConfig
+	config.Listeners = make(map[string]*ListenerConfig)
+	config.Bridges = make(map[string]*BridgeConfig)
+	if err := ParseConfig(configFile, &config); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to reload config,", err.Error())
+		return current
+	}
+	config.SetLogTargets(h.SetLogOutput, h.SetLogLevel)
+	for _, setting := range current.restartRequired(&config) {
+		fmt.Fprintln(os.Stderr, setting, "changed, it needs a restart to take effect")
+	}
+	reload := &ReloadConfig{MaxPacketSize: config.MaxPacketSize, TopicPolicies: config.Policies(), Listeners: config.Listeners}
+	if config.RateLimit != nil {
+		reload.RateLimit = config.RateLimit.RateLimit()
+	}
+	if config.Auth != nil {
+		reload.Auth = config.Auth.Auth()
+	}
+	if err := h.Reload(reload); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to reload config,", err.Error())
+	}
+	return config
+}
+
+//hashPasswordCommand is "hrotti hash-password", it prints a hash of the password read from
+//stdin, up to the first newline, to use in the users of an auth section
+func hashPasswordCommand(stdin io.Reader, out io.Writer) int {
+	password, err := bufio.NewReader(stdin).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		fmt.Fprintln(os.Stderr, "Failed to read the password,", err.Error())
+		return 1
+	}
+	fmt.Fprintln(out, HashPassword(bytes.TrimRight(password, "\r\n")))
+	return 0
+}
+
+//newPersistence returns the persistence config uses, it hasn't been opened
+func newPersistence(config BrokerConfig) Persistence {
+	var r Persistence = &MemoryPersistence{}
+	switch config.Persistence.Type {
+	case "bolt":
+		if config.Persistence.Path == "" {
+			config.Persistence.Path = "hrotti.db"
+		}
+		r = &BoltPersistence{Path: config.Persistence.Path}
+	case "redis":
+		r = &RedisPersistence{
+			Addr:     config.Persistence.Address,
+			Password: config.Persistence.Password,
+			DB:       config.Persistence.DB,
+			Prefix:   config.Persistence.Prefix,
+			PoolSize: config.Persistence.PoolSize,
+		}
+	}
+	return r
+}
+
+//exportCommand is "hrotti export [-config file] [file]", it writes the state in the
+//persistence of the config to file or stdout as a state file, for "hrotti -import" on another
+//node or with another persistence. The broker has to be stopped first, bolt only lets one
+//process open its database. It returns the exit status, 1 if the state couldn't be read.
+func exportCommand(args []string, out io.Writer, errOut io.Writer) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	configFile := flags.String("config", "", "A configuration file")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	var config BrokerConfig
+	config.Listeners = make(map[string]*ListenerConfig)
+	config.Bridges = make(map[string]*BridgeConfig)
+	if err := ParseConfig(*configFile, &config); err != nil {
+		fmt.Fprintln(errOut, err.Error())
+		return 1
+	}
+	if flags.NArg() > 0 {
+		f, err := os.Create(flags.Arg(0))
 		if err != nil {
-			os.Stderr.WriteString(fmt.Sprintf("%s\n", err.Error()))
+			fmt.Fprintln(errOut, err.Error())
+			return 1
 		}
+		defer f.Close()
+		out = f
 	}
-	config.SetLogTargets()
-	return config
+	persistence := newPersistence(config)
+	if err := persistence.Open(); err != nil {
+		fmt.Fprintln(errOut, "Failed to open the persistence,", err.Error())
+		return 1
+	}
+	defer persistence.Close()
+	counts, err := ExportState(persistence, out)
+	if err != nil {
+		fmt.Fprintln(errOut, "Failed to export the state,", err.Error())
+		return 1
+	}
+	fmt.Fprintf(errOut, "Exported %d sessions with %d subscriptions, %d retained messages and %d inflight messages\n",
+		counts.Sessions, counts.Subscriptions, counts.Retained, counts.Inflight)
+	return 0
+}
+
+//brokerOptions returns the options for a Broker running config, with the sockets inherited
+//from socket activation
+func brokerOptions(config BrokerConfig, inherited []net.Listener) []Option {
+	connectionLimitPolicy := CloseConnection
+	if config.ConnectionLimits.Policy == "connack" {
+		connectionLimitPolicy = ConnackServerUnavailable
+	}
+	options := []Option{
+		WithPersistence(newPersistence(config)),
+		WithMaxQueueDepth(config.MaxQueueDepth),
+		WithMaxPacketSize(config.MaxPacketSize),
+		WithConnectionLimits(config.ConnectionLimits.Max, config.ConnectionLimits.PerIP, connectionLimitPolicy),
+		WithInheritedListeners(inherited),
+		WithAdminListener(config.Admin.Address),
+		WithMetricsListener(config.Metrics.Address),
+		WithSettings(func(h *Hrotti) {
+			h.RetainedSyncRate = config.RetainedSyncRate
+			h.RetainedHighWater = config.RetainedHighWater
+			if config.Admin.Username != "" {
+				h.AdminUsername = config.Admin.Username
+			}
+			h.StatsInterval = time.Duration(config.StatsInterval) * time.Second
+			h.ClientStatsInterval = time.Duration(config.ClientStats) * time.Second
+			h.MaxInflight = config.MaxInflight
+			h.ReceiveMaximum = config.ReceiveMaximum
+			h.AllowDuplicateMessages = config.AllowDuplicates
+			if config.DupWindow != nil {
+				h.DuplicateWindow = *config.DupWindow
+			}
+			if config.MaxBridgeHops != nil {
+				h.MaxBridgeHops = *config.MaxBridgeHops
+			}
+			if config.MatchCacheSize != nil {
+				h.MatchCacheSize = *config.MatchCacheSize
+			}
+			if config.MaxRetainedQos != nil {
+				h.MaxRetainedQos = byte(*config.MaxRetainedQos)
+			}
+			h.SkipRetainedOnResubscribe = config.SkipRetainedOnResubscribe
+			h.DisableRetain = config.RetainEnabled != nil && !*config.RetainEnabled
+			h.BanAuthFailures = config.AuthBans.Failures
+			if config.AuthBans.Window > 0 {
+				h.BanWindow = time.Duration(config.AuthBans.Window) * time.Second
+			}
+			if config.AuthBans.Duration > 0 {
+				h.BanDuration = time.Duration(config.AuthBans.Duration) * time.Second
+			}
+			if config.AuthBans.MaxEntries > 0 {
+				h.MaxBans = config.AuthBans.MaxEntries
+			}
+			h.MDNSName = config.MDNS.Name
+			h.MaxKeepAlive = uint16(config.MaxKeepAlive)
+			h.MinKeepAlive = uint16(config.MinKeepAlive)
+			h.TopicPolicies = config.Policies()
+			h.TopicRewrites = config.TopicRewrites()
+			h.PayloadTransformers = config.PayloadTransformers()
+			h.TopicMetrics = config.TopicMetrics
+			h.SessionExpiry = time.Duration(config.SessionExpiry) * time.Second
+			h.WillDelay = time.Duration(config.WillDelay) * time.Second
+			h.WillOnTakeover = config.WillOnTakeover
+			h.RetryInterval = time.Duration(config.RetryInterval) * time.Second
+			h.MaxRetries = config.MaxRetries
+			h.MessageExpiry = time.Duration(config.MessageExpiry) * time.Second
+			h.TimestampProperty = config.TimestampProp
+			if config.DeadLetter != nil {
+				h.DeadLetter = config.DeadLetter.DeadLetter()
+			}
+			if config.Presence != nil {
+				h.Presence = config.Presence.Presence()
+			}
+			if config.ConnectTimeout > 0 {
+				h.ConnectTimeout = time.Duration(config.ConnectTimeout) * time.Second
+			}
+			h.HealthTimeout = time.Duration(config.HealthTimeout) * time.Second
+			if config.SlowConsumer.Policy == "disconnect" {
+				h.SlowConsumerPolicy = DisconnectSlowConsumer
+			}
+			h.SlowConsumerGrace = time.Duration(config.SlowConsumer.GracePeriod) * time.Second
+			h.MaxRetainedMessages = config.RetainedLimits.MaxMessages
+			h.MaxRetainedSize = config.RetainedLimits.MaxSize
+			h.RetainedCacheSize = config.RetainedCache.MaxBytes
+			h.RetainedCacheMessages = config.RetainedCache.MaxMessages
+			if config.RetainedLimits.Policy == "reject" {
+				h.RetainedLimitPolicy = RejectRetained
+			}
+			h.WriteBatchPackets = config.WriteBatch.Packets
+			h.WriteBatchBytes = config.WriteBatch.Bytes
+			h.WriteBatchDelay = time.Duration(config.WriteBatch.Delay) * time.Microsecond
+			h.MaxSubscriptions = config.SubscriptionLimits.MaxPerClient
+			h.MaxFilterLength = config.SubscriptionLimits.MaxFilterLength
+			h.MaxFilterLevels = config.SubscriptionLimits.MaxFilterLevels
+			limits := config.topicLimits()
+			h.MaxTopicLevels, h.MaxTopicLevelLength, h.MaxTopicLength = limits.MaxLevels, limits.MaxLevelLength, limits.MaxLength
+			if config.SubscriptionLimits.Policy == "disconnect" {
+				h.SubscriptionLimitPolicy = DisconnectSubscriber
+			}
+			if len(config.SharedStrategies) > 0 {
+				h.SharedStrategies = make(map[string]SharedStrategy)
+				for prefix, strategy := range config.SharedStrategies {
+					h.SharedStrategies[prefix] = sharedStrategies[strategy]
+				}
+			}
+		}),
+	}
+	if config.RateLimit != nil {
+		options = append(options, WithRateLimit(config.RateLimit.RateLimit()))
+	}
+	if config.Auth != nil {
+		options = append(options, WithAuth(config.Auth.Auth()))
+	}
+	for _, profile := range config.Profiles {
+		options = append(options, WithClientProfile(profile))
+	}
+	for name, listener := range config.Listeners {
+		options = append(options, WithListener(name, listener))
+	}
+	for name, bridge := range config.Bridges {
+		options = append(options, WithBridge(name, bridge))
+	}
+	return options
 }
 
 func main() {
-	config := createConfig()
+	if len(os.Args) > 1 && os.Args[1] == "decode" {
+		os.Exit(decodeCommand(os.Args[2:], os.Stdin, os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		os.Exit(hashPasswordCommand(os.Stdin, os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(exportCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "pub" {
+		os.Exit(pubCommand(os.Args[2:], os.Stdin, os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sub" {
+		os.Exit(subCommand(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(benchCommand(os.Args[2:], os.Stdout))
+	}
+	configFile, importFile, config := createConfig()
 
-	//r := &RedisPersistence{Server: ":6379"}
-	r := &MemoryPersistence{}
-	h := NewHrotti(config.MaxQueueDepth, r)
+	//sockets passed in by systemd are used by the listeners with their addresses, the other
+	//listeners bind as usual
+	inherited, err := SocketActivation()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to use the sockets from socket activation,", err.Error())
+		os.Exit(1)
+	}
+	options := brokerOptions(config, inherited)
+	if importFile != "" {
+		f, err := os.Open(importFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to open the state file,", err.Error())
+			os.Exit(1)
+		}
+		options = append(options, WithImportedState(f))
+		defer f.Close()
+	}
+	b := NewBroker(options...)
+	if err := b.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to start,", err.Error())
+		os.Exit(1)
+	}
+	h := b.Hrotti()
 
-	for name, listener := range config.Listeners {
-		h.AddListener(name, listener)
+	//everything that binds a port has, so root isn't needed any more
+	if config.User != "" {
+		dropped, err := dropPrivileges(config.User, config.Group)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to run as user", config.User+",", err.Error())
+			b.Stop(context.Background())
+			os.Exit(1)
+		}
+		if !dropped {
+			fmt.Fprintln(os.Stderr, "Not started as root, running as the current user rather than", config.User)
+		}
 	}
+
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
-	h.Stop()
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range c {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		config = reloadConfig(h, configFile, config)
+	}
+	b.Stop(context.Background())
 }
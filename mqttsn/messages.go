@@ -0,0 +1,364 @@
+package mqttsn
+
+import (
+	"encoding/binary"
+)
+
+//Connect starts a client's connection, Duration is its keepalive in seconds
+type Connect struct {
+	Will         bool
+	CleanSession bool
+	ProtocolID   byte
+	Duration     uint16
+	ClientID     string
+}
+
+func (c *Connect) Type() MsgType { return CONNECT }
+
+func (c *Connect) Pack() []byte {
+	f := byte(0)
+	if c.Will {
+		f |= flagWill
+	}
+	if c.CleanSession {
+		f |= flagCleanSession
+	}
+	body := []byte{f, c.ProtocolID}
+	body = appendUint16(body, c.Duration)
+	return pack(CONNECT, append(body, c.ClientID...))
+}
+
+func (c *Connect) unpack(b []byte) error {
+	if len(b) < 4 {
+		return ErrMalformed
+	}
+	c.Will = b[0]&flagWill != 0
+	c.CleanSession = b[0]&flagCleanSession != 0
+	c.ProtocolID = b[1]
+	c.Duration = binary.BigEndian.Uint16(b[2:])
+	c.ClientID = string(b[4:])
+	return nil
+}
+
+//Connack answers a Connect
+type Connack struct {
+	ReturnCode byte
+}
+
+func (c *Connack) Type() MsgType { return CONNACK }
+
+func (c *Connack) Pack() []byte {
+	return pack(CONNACK, []byte{c.ReturnCode})
+}
+
+func (c *Connack) unpack(b []byte) error {
+	if len(b) != 1 {
+		return ErrMalformed
+	}
+	c.ReturnCode = b[0]
+	return nil
+}
+
+//Register asks for a topic id for TopicName, a client sends it with a TopicID of 0 and the
+//gateway with the id it has given the topic
+type Register struct {
+	TopicID   uint16
+	MsgID     uint16
+	TopicName string
+}
+
+func (r *Register) Type() MsgType { return REGISTER }
+
+func (r *Register) Pack() []byte {
+	body := appendUint16(make([]byte, 0, 4+len(r.TopicName)), r.TopicID)
+	body = appendUint16(body, r.MsgID)
+	return pack(REGISTER, append(body, r.TopicName...))
+}
+
+func (r *Register) unpack(b []byte) error {
+	if len(b) < 5 {
+		return ErrMalformed
+	}
+	r.TopicID = binary.BigEndian.Uint16(b)
+	r.MsgID = binary.BigEndian.Uint16(b[2:])
+	r.TopicName = string(b[4:])
+	return nil
+}
+
+//Regack answers a Register
+type Regack struct {
+	TopicID    uint16
+	MsgID      uint16
+	ReturnCode byte
+}
+
+func (r *Regack) Type() MsgType { return REGACK }
+
+func (r *Regack) Pack() []byte {
+	body := appendUint16(make([]byte, 0, 5), r.TopicID)
+	body = appendUint16(body, r.MsgID)
+	return pack(REGACK, append(body, r.ReturnCode))
+}
+
+func (r *Regack) unpack(b []byte) error {
+	if len(b) != 5 {
+		return ErrMalformed
+	}
+	r.TopicID = binary.BigEndian.Uint16(b)
+	r.MsgID = binary.BigEndian.Uint16(b[2:])
+	r.ReturnCode = b[4]
+	return nil
+}
+
+//Publish is a message to the topic TopicID, which is a short topic name rather than an id
+//if TopicIDType is TopicShortName
+type Publish struct {
+	Dup         bool
+	Qos         byte
+	Retain      bool
+	TopicIDType byte
+	TopicID     uint16
+	MsgID       uint16
+	Data        []byte
+}
+
+func (p *Publish) Type() MsgType { return PUBLISH }
+
+func (p *Publish) Pack() []byte {
+	body := make([]byte, 0, 5+len(p.Data))
+	body = append(body, flags(p.Dup, p.Qos, p.Retain, p.TopicIDType))
+	body = appendUint16(body, p.TopicID)
+	body = appendUint16(body, p.MsgID)
+	return pack(PUBLISH, append(body, p.Data...))
+}
+
+func (p *Publish) unpack(b []byte) error {
+	if len(b) < 5 {
+		return ErrMalformed
+	}
+	p.Dup = b[0]&flagDup != 0
+	p.Qos = b[0] & flagQos >> 5
+	p.Retain = b[0]&flagRetain != 0
+	p.TopicIDType = b[0] & flagTopicIDType
+	p.TopicID = binary.BigEndian.Uint16(b[1:])
+	p.MsgID = binary.BigEndian.Uint16(b[3:])
+	p.Data = make([]byte, len(b)-5)
+	copy(p.Data, b[5:])
+	return nil
+}
+
+//Puback acknowledges a QoS 1 Publish, or rejects a Publish of any QoS
+type Puback struct {
+	TopicID    uint16
+	MsgID      uint16
+	ReturnCode byte
+}
+
+func (p *Puback) Type() MsgType { return PUBACK }
+
+func (p *Puback) Pack() []byte {
+	body := appendUint16(make([]byte, 0, 5), p.TopicID)
+	body = appendUint16(body, p.MsgID)
+	return pack(PUBACK, append(body, p.ReturnCode))
+}
+
+func (p *Puback) unpack(b []byte) error {
+	if len(b) != 5 {
+		return ErrMalformed
+	}
+	p.TopicID = binary.BigEndian.Uint16(b)
+	p.MsgID = binary.BigEndian.Uint16(b[2:])
+	p.ReturnCode = b[4]
+	return nil
+}
+
+//Subscribe subscribes to TopicName, a filter or a short topic name, or to the predefined
+//TopicID
+type Subscribe struct {
+	Dup         bool
+	Qos         byte
+	TopicIDType byte
+	MsgID       uint16
+	TopicName   string
+	TopicID     uint16
+}
+
+func (s *Subscribe) Type() MsgType { return SUBSCRIBE }
+
+func (s *Subscribe) Pack() []byte {
+	body := []byte{flags(s.Dup, s.Qos, false, s.TopicIDType)}
+	body = appendUint16(body, s.MsgID)
+	return pack(SUBSCRIBE, appendTopic(body, s.TopicIDType, s.TopicName, s.TopicID))
+}
+
+func (s *Subscribe) unpack(b []byte) error {
+	if len(b) < 4 {
+		return ErrMalformed
+	}
+	s.Dup = b[0]&flagDup != 0
+	s.Qos = b[0] & flagQos >> 5
+	s.TopicIDType = b[0] & flagTopicIDType
+	s.MsgID = binary.BigEndian.Uint16(b[1:])
+	var err error
+	s.TopicName, s.TopicID, err = unpackTopic(b[3:], s.TopicIDType)
+	return err
+}
+
+//Suback answers a Subscribe, TopicID is the id the gateway gave a topic name without
+//wildcards and otherwise 0
+type Suback struct {
+	Qos        byte
+	TopicID    uint16
+	MsgID      uint16
+	ReturnCode byte
+}
+
+func (s *Suback) Type() MsgType { return SUBACK }
+
+func (s *Suback) Pack() []byte {
+	body := []byte{flags(false, s.Qos, false, 0)}
+	body = appendUint16(body, s.TopicID)
+	body = appendUint16(body, s.MsgID)
+	return pack(SUBACK, append(body, s.ReturnCode))
+}
+
+func (s *Suback) unpack(b []byte) error {
+	if len(b) != 6 {
+		return ErrMalformed
+	}
+	s.Qos = b[0] & flagQos >> 5
+	s.TopicID = binary.BigEndian.Uint16(b[1:])
+	s.MsgID = binary.BigEndian.Uint16(b[3:])
+	s.ReturnCode = b[5]
+	return nil
+}
+
+//Unsubscribe removes the subscription a Subscribe with the same topic made
+type Unsubscribe struct {
+	TopicIDType byte
+	MsgID       uint16
+	TopicName   string
+	TopicID     uint16
+}
+
+func (u *Unsubscribe) Type() MsgType { return UNSUBSCRIBE }
+
+func (u *Unsubscribe) Pack() []byte {
+	body := []byte{flags(false, 0, false, u.TopicIDType)}
+	body = appendUint16(body, u.MsgID)
+	return pack(UNSUBSCRIBE, appendTopic(body, u.TopicIDType, u.TopicName, u.TopicID))
+}
+
+func (u *Unsubscribe) unpack(b []byte) error {
+	if len(b) < 4 {
+		return ErrMalformed
+	}
+	u.TopicIDType = b[0] & flagTopicIDType
+	u.MsgID = binary.BigEndian.Uint16(b[1:])
+	var err error
+	u.TopicName, u.TopicID, err = unpackTopic(b[3:], u.TopicIDType)
+	return err
+}
+
+//Unsuback answers an Unsubscribe
+type Unsuback struct {
+	MsgID uint16
+}
+
+func (u *Unsuback) Type() MsgType { return UNSUBACK }
+
+func (u *Unsuback) Pack() []byte {
+	return pack(UNSUBACK, appendUint16(nil, u.MsgID))
+}
+
+func (u *Unsuback) unpack(b []byte) error {
+	if len(b) != 2 {
+		return ErrMalformed
+	}
+	u.MsgID = binary.BigEndian.Uint16(b)
+	return nil
+}
+
+//Pingreq keeps a connection alive, a sleeping client sends its ClientID to wake up and be
+//sent the messages buffered for it
+type Pingreq struct {
+	ClientID string
+}
+
+func (p *Pingreq) Type() MsgType { return PINGREQ }
+
+func (p *Pingreq) Pack() []byte {
+	return pack(PINGREQ, []byte(p.ClientID))
+}
+
+func (p *Pingreq) unpack(b []byte) error {
+	p.ClientID = string(b)
+	return nil
+}
+
+//Pingresp answers a Pingreq, a woken client goes back to sleep when it gets it
+type Pingresp struct{}
+
+func (p *Pingresp) Type() MsgType { return PINGRESP }
+
+func (p *Pingresp) Pack() []byte {
+	return pack(PINGRESP, nil)
+}
+
+func (p *Pingresp) unpack(b []byte) error {
+	if len(b) != 0 {
+		return ErrMalformed
+	}
+	return nil
+}
+
+//Disconnect ends a connection, or with a Duration puts the client to sleep for that many
+//seconds
+type Disconnect struct {
+	Duration uint16
+}
+
+func (d *Disconnect) Type() MsgType { return DISCONNECT }
+
+func (d *Disconnect) Pack() []byte {
+	if d.Duration == 0 {
+		return pack(DISCONNECT, nil)
+	}
+	return pack(DISCONNECT, appendUint16(nil, d.Duration))
+}
+
+func (d *Disconnect) unpack(b []byte) error {
+	switch len(b) {
+	case 0:
+		d.Duration = 0
+	case 2:
+		d.Duration = binary.BigEndian.Uint16(b)
+	default:
+		return ErrMalformed
+	}
+	return nil
+}
+
+//appendTopic appends the topic of a Subscribe or Unsubscribe, a name unless it is a
+//predefined id
+func appendTopic(b []byte, topicIDType byte, name string, id uint16) []byte {
+	if topicIDType == TopicPredefined {
+		return appendUint16(b, id)
+	}
+	return append(b, name...)
+}
+
+func unpackTopic(b []byte, topicIDType byte) (string, uint16, error) {
+	switch topicIDType {
+	case TopicPredefined:
+		if len(b) != 2 {
+			return "", 0, ErrMalformed
+		}
+		return "", binary.BigEndian.Uint16(b), nil
+	case TopicShortName:
+		if len(b) != 2 {
+			return "", 0, ErrMalformed
+		}
+	}
+	return string(b), 0, nil
+}
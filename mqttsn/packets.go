@@ -0,0 +1,224 @@
+//Package mqttsn encodes and decodes the MQTT-SN 1.2 messages a gateway exchanges with its
+//clients, each of which is a UDP datagram of its own
+package mqttsn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+//Packet is any MQTT-SN message. Pack returns the whole datagram, length and type included,
+//unpack is given the message after its type byte.
+type Packet interface {
+	Type() MsgType
+	Pack() []byte
+	unpack(body []byte) error
+}
+
+//MsgType is an MQTT-SN message type, the byte after the length
+type MsgType byte
+
+const (
+	ADVERTISE     MsgType = 0x00
+	SEARCHGW      MsgType = 0x01
+	GWINFO        MsgType = 0x02
+	CONNECT       MsgType = 0x04
+	CONNACK       MsgType = 0x05
+	WILLTOPICREQ  MsgType = 0x06
+	WILLTOPIC     MsgType = 0x07
+	WILLMSGREQ    MsgType = 0x08
+	WILLMSG       MsgType = 0x09
+	REGISTER      MsgType = 0x0A
+	REGACK        MsgType = 0x0B
+	PUBLISH       MsgType = 0x0C
+	PUBACK        MsgType = 0x0D
+	PUBCOMP       MsgType = 0x0E
+	PUBREC        MsgType = 0x0F
+	PUBREL        MsgType = 0x10
+	SUBSCRIBE     MsgType = 0x12
+	SUBACK        MsgType = 0x13
+	UNSUBSCRIBE   MsgType = 0x14
+	UNSUBACK      MsgType = 0x15
+	PINGREQ       MsgType = 0x16
+	PINGRESP      MsgType = 0x17
+	DISCONNECT    MsgType = 0x18
+	WILLTOPICUPD  MsgType = 0x1A
+	WILLTOPICRESP MsgType = 0x1B
+	WILLMSGUPD    MsgType = 0x1C
+	WILLMSGRESP   MsgType = 0x1D
+)
+
+var MsgNames = map[MsgType]string{
+	ADVERTISE:     "ADVERTISE",
+	SEARCHGW:      "SEARCHGW",
+	GWINFO:        "GWINFO",
+	CONNECT:       "CONNECT",
+	CONNACK:       "CONNACK",
+	WILLTOPICREQ:  "WILLTOPICREQ",
+	WILLTOPIC:     "WILLTOPIC",
+	WILLMSGREQ:    "WILLMSGREQ",
+	WILLMSG:       "WILLMSG",
+	REGISTER:      "REGISTER",
+	REGACK:        "REGACK",
+	PUBLISH:       "PUBLISH",
+	PUBACK:        "PUBACK",
+	PUBCOMP:       "PUBCOMP",
+	PUBREC:        "PUBREC",
+	PUBREL:        "PUBREL",
+	SUBSCRIBE:     "SUBSCRIBE",
+	SUBACK:        "SUBACK",
+	UNSUBSCRIBE:   "UNSUBSCRIBE",
+	UNSUBACK:      "UNSUBACK",
+	PINGREQ:       "PINGREQ",
+	PINGRESP:      "PINGRESP",
+	DISCONNECT:    "DISCONNECT",
+	WILLTOPICUPD:  "WILLTOPICUPD",
+	WILLTOPICRESP: "WILLTOPICRESP",
+	WILLMSGUPD:    "WILLMSGUPD",
+	WILLMSGRESP:   "WILLMSGRESP",
+}
+
+//String is the name of the message type from MsgNames
+func (t MsgType) String() string {
+	if name, ok := MsgNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("RESERVED(%d)", byte(t))
+}
+
+//ProtocolID is the only protocol id a CONNECT can have
+const ProtocolID = 0x01
+
+//The return codes of CONNACK, REGACK, PUBACK and SUBACK
+const (
+	Accepted               = 0x00
+	RejectedCongestion     = 0x01
+	RejectedInvalidTopicID = 0x02
+	RejectedNotSupported   = 0x03
+)
+
+//The types of topic id in the flags of PUBLISH, SUBSCRIBE and UNSUBSCRIBE. A normal topic id
+//is one from a REGISTER, a predefined one is agreed beforehand and a short topic name is a
+//topic of two characters sent in place of an id.
+const (
+	TopicNormal     = 0x00
+	TopicPredefined = 0x01
+	TopicShortName  = 0x02
+)
+
+//QosNoConnection is the QoS -1 of a PUBLISH sent without connecting, as the flags have it
+const QosNoConnection = 0x03
+
+const (
+	flagDup          = 0x80
+	flagQos          = 0x60
+	flagRetain       = 0x10
+	flagWill         = 0x08
+	flagCleanSession = 0x04
+	flagTopicIDType  = 0x03
+)
+
+//ErrUnknownType is returned by Decode for a message of a reserved type, or one it doesn't
+//decode such as the will and QoS 2 messages
+var ErrUnknownType = errors.New("Reserved or unsupported message type")
+
+//ErrMalformed is returned by Decode for a datagram whose length doesn't match its contents
+var ErrMalformed = errors.New("Malformed message")
+
+//Decode returns the message in datagram b
+func Decode(b []byte) (Packet, error) {
+	var length, header int
+	switch {
+	case len(b) >= 3 && b[0] == 0x01:
+		length, header = int(binary.BigEndian.Uint16(b[1:])), 3
+	case len(b) >= 1 && b[0] > 1:
+		length, header = int(b[0]), 1
+	default:
+		return nil, ErrMalformed
+	}
+	if length != len(b) || length <= header {
+		return nil, ErrMalformed
+	}
+	var p Packet
+	switch MsgType(b[header]) {
+	case CONNECT:
+		p = &Connect{}
+	case CONNACK:
+		p = &Connack{}
+	case REGISTER:
+		p = &Register{}
+	case REGACK:
+		p = &Regack{}
+	case PUBLISH:
+		p = &Publish{}
+	case PUBACK:
+		p = &Puback{}
+	case SUBSCRIBE:
+		p = &Subscribe{}
+	case SUBACK:
+		p = &Suback{}
+	case UNSUBSCRIBE:
+		p = &Unsubscribe{}
+	case UNSUBACK:
+		p = &Unsuback{}
+	case PINGREQ:
+		p = &Pingreq{}
+	case PINGRESP:
+		p = &Pingresp{}
+	case DISCONNECT:
+		p = &Disconnect{}
+	default:
+		return nil, ErrUnknownType
+	}
+	if err := p.unpack(b[header+1:]); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//pack returns the datagram of a message of msgType with body, the length is one byte if the
+//whole message fits in 255 and three otherwise
+func pack(msgType MsgType, body []byte) []byte {
+	length := len(body) + 2
+	var b []byte
+	if length <= 255 {
+		b = make([]byte, 0, length)
+		b = append(b, byte(length))
+	} else {
+		length += 2
+		b = make([]byte, 0, length)
+		b = append(b, 0x01, byte(length>>8), byte(length))
+	}
+	b = append(b, byte(msgType))
+	return append(b, body...)
+}
+
+//ShortTopicID returns the topic id that carries the two character topic name
+func ShortTopicID(name string) uint16 {
+	if len(name) != 2 {
+		return 0
+	}
+	return uint16(name[0])<<8 | uint16(name[1])
+}
+
+//ShortTopicName returns the two character topic name carried by a short topic id
+func ShortTopicName(id uint16) string {
+	return string([]byte{byte(id >> 8), byte(id)})
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+//flags is the flags byte shared by several messages, each only uses some of the fields
+func flags(dup bool, qos byte, retain bool, topicIDType byte) byte {
+	f := qos<<5&flagQos | topicIDType&flagTopicIDType
+	if dup {
+		f |= flagDup
+	}
+	if retain {
+		f |= flagRetain
+	}
+	return f
+}
@@ -0,0 +1,92 @@
+package mqttsn
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, p := range []Packet{
+		&Connect{CleanSession: true, ProtocolID: ProtocolID, Duration: 60, ClientID: "sensor-1"},
+		&Connect{Will: true, ProtocolID: ProtocolID, ClientID: "s"},
+		&Connack{ReturnCode: RejectedCongestion},
+		&Register{TopicID: 7, MsgID: 2, TopicName: "sensors/1/temp"},
+		&Regack{TopicID: 7, MsgID: 2, ReturnCode: Accepted},
+		&Publish{Dup: true, Qos: 1, Retain: true, TopicIDType: TopicShortName, TopicID: ShortTopicID("t1"), MsgID: 9, Data: []byte("21.5")},
+		&Publish{Qos: QosNoConnection, TopicIDType: TopicPredefined, TopicID: 1, Data: []byte{}},
+		&Puback{TopicID: 7, MsgID: 9, ReturnCode: RejectedInvalidTopicID},
+		&Subscribe{Qos: 1, MsgID: 3, TopicName: "sensors/+/temp"},
+		&Subscribe{TopicIDType: TopicPredefined, MsgID: 4, TopicID: 12},
+		&Suback{Qos: 1, TopicID: 7, MsgID: 3, ReturnCode: Accepted},
+		&Unsubscribe{TopicIDType: TopicShortName, MsgID: 5, TopicName: "t1"},
+		&Unsuback{MsgID: 5},
+		&Pingreq{},
+		&Pingreq{ClientID: "sensor-1"},
+		&Pingresp{},
+		&Disconnect{},
+		&Disconnect{Duration: 3600},
+	} {
+		b := p.Pack()
+		if int(b[0]) != len(b) {
+			t.Errorf("%s has length %d, should be %d", p.Type(), b[0], len(b))
+		}
+		decoded, err := Decode(b)
+		if err != nil {
+			t.Errorf("decoding %s failed: %s", p.Type(), err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(decoded, p) {
+			t.Errorf("decoded %#v, should be %#v", decoded, p)
+		}
+	}
+}
+
+//A message over 255 bytes has a three byte length starting 0x01
+func TestLongMessage(t *testing.T) {
+	p := &Publish{Qos: 1, TopicID: 1, MsgID: 1, Data: bytes.Repeat([]byte("x"), 300)}
+	b := p.Pack()
+	if b[0] != 0x01 || int(b[1])<<8|int(b[2]) != len(b) || len(b) != 309 {
+		t.Fatalf("long message starts % x and is %d bytes, should start 01 01 35 and be 309", b[:3], len(b))
+	}
+	decoded, err := Decode(b)
+	if err != nil {
+		t.Fatalf("decoding a long message failed: %s", err.Error())
+	}
+	if !reflect.DeepEqual(decoded, p) {
+		t.Errorf("decoded %#v, should be %#v", decoded, p)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		b    []byte
+		err  error
+	}{
+		{"empty", nil, ErrMalformed},
+		{"length too long", []byte{0x05, byte(PINGRESP)}, ErrMalformed},
+		{"length too short", []byte{0x02, byte(PINGRESP), 0x00}, ErrMalformed},
+		{"no type", []byte{0x01, 0x00, 0x03}, ErrMalformed},
+		{"reserved type", []byte{0x02, 0x11}, ErrUnknownType},
+		{"will message", []byte{0x03, byte(WILLMSG), 'x'}, ErrUnknownType},
+		{"short connack", []byte{0x02, byte(CONNACK)}, ErrMalformed},
+		{"short publish", []byte{0x05, byte(PUBLISH), 0x00, 0x00, 0x01}, ErrMalformed},
+		{"long short topic", []byte{0x07, byte(SUBSCRIBE), TopicShortName, 0x00, 0x01, 'a', 'b'}, nil},
+		{"three character short topic", []byte{0x08, byte(SUBSCRIBE), TopicShortName, 0x00, 0x01, 'a', 'b', 'c'}, ErrMalformed},
+		{"disconnect with one byte", []byte{0x03, byte(DISCONNECT), 0x01}, ErrMalformed},
+	} {
+		if _, err := Decode(test.b); err != test.err {
+			t.Errorf("%s: decoding % x returned %v, should be %v", test.name, test.b, err, test.err)
+		}
+	}
+}
+
+func TestShortTopic(t *testing.T) {
+	if id := ShortTopicID("ab"); id != 0x6162 {
+		t.Errorf("short topic id of ab is %#x, should be 0x6162", id)
+	}
+	if name := ShortTopicName(0x6162); name != "ab" {
+		t.Errorf("short topic name of 0x6162 is %s, should be ab", name)
+	}
+}
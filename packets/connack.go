@@ -1,7 +1,6 @@
 package packets
 
 import (
-	"bytes"
 	"fmt"
 	"github.com/google/uuid"
 	"io"
@@ -23,22 +22,22 @@ func (ca *ConnackPacket) String() string {
 }
 
 func (ca *ConnackPacket) Write(w io.Writer) error {
-	var body bytes.Buffer
-	var err error
-
-	body.WriteByte(ca.TopicNameCompression)
-	body.WriteByte(ca.ReturnCode)
 	ca.FixedHeader.RemainingLength = 2
-	packet := ca.FixedHeader.pack()
-	packet.Write(body.Bytes())
-	_, err = packet.WriteTo(w)
+	packet := make([]byte, 0, ca.FixedHeader.packetLength())
+	packet = ca.FixedHeader.appendTo(packet)
+	packet = append(packet, ca.TopicNameCompression, ca.ReturnCode)
+	_, err := w.Write(packet)
 
 	return err
 }
 
-func (ca *ConnackPacket) Unpack(b io.Reader) {
-	ca.TopicNameCompression = decodeByte(b)
-	ca.ReturnCode = decodeByte(b)
+func (ca *ConnackPacket) Unpack(b io.Reader) error {
+	var err error
+	if ca.TopicNameCompression, err = decodeByte(b); err != nil {
+		return err
+	}
+	ca.ReturnCode, err = decodeByte(b)
+	return err
 }
 
 func (ca *ConnackPacket) Details() Details {
@@ -1,7 +1,6 @@
 package packets
 
 import (
-	"bytes"
 	"fmt"
 	"github.com/google/uuid"
 	"io"
@@ -9,6 +8,8 @@ import (
 
 //CONNECT packet
 
+const bridgeFlag = 0x80
+
 type ConnectPacket struct {
 	FixedHeader
 	ProtocolName    string
@@ -30,43 +31,64 @@ type ConnectPacket struct {
 	uuid             uuid.UUID
 }
 
+//String describes the packet without its password, only the password's length is shown
 func (c *ConnectPacket) String() string {
 	str := fmt.Sprintf("%s\n", c.FixedHeader)
-	str += fmt.Sprintf("protocolversion: %d protocolname: %s cleansession: %t willflag: %t WillQos: %d WillRetain: %t Usernameflag: %t Passwordflag: %t keepalivetimer: %d\nclientId: %s\nwilltopic: %s\nwillmessage: %s\nUsername: %s\nPassword: %s\n", c.ProtocolVersion, c.ProtocolName, c.CleanSession, c.WillFlag, c.WillQos, c.WillRetain, c.UsernameFlag, c.PasswordFlag, c.KeepaliveTimer, c.ClientIdentifier, c.WillTopic, c.WillMessage, c.Username, c.Password)
+	str += fmt.Sprintf("protocolversion: %d protocolname: %s cleansession: %t willflag: %t WillQos: %d WillRetain: %t Usernameflag: %t Passwordflag: %t keepalivetimer: %d\nclientId: %s\nwilltopic: %s\nwillmessage: %s\nUsername: %s\nPassword: [%d bytes]\n", c.ProtocolVersion, c.ProtocolName, c.CleanSession, c.WillFlag, c.WillQos, c.WillRetain, c.UsernameFlag, c.PasswordFlag, c.KeepaliveTimer, c.ClientIdentifier, c.WillTopic, c.WillMessage, c.Username, len(c.Password))
 	return str
 }
 
 func (c *ConnectPacket) Write(w io.Writer) error {
-	var body bytes.Buffer
-	var err error
-
-	body.Write(encodeString(c.ProtocolName))
-	body.WriteByte(c.ProtocolVersion)
-	body.WriteByte(boolToByte(c.CleanSession)<<1 | boolToByte(c.WillFlag)<<2 | c.WillQos<<3 | boolToByte(c.WillRetain)<<5 | boolToByte(c.PasswordFlag)<<6 | boolToByte(c.UsernameFlag)<<7)
-	body.Write(encodeUint16(c.KeepaliveTimer))
-	body.Write(encodeString(c.ClientIdentifier))
+	c.FixedHeader.RemainingLength = 2 + len(c.ProtocolName) + 4 + 2 + len(c.ClientIdentifier)
+	if c.WillFlag {
+		c.FixedHeader.RemainingLength += 2 + len(c.WillTopic) + 2 + len(c.WillMessage)
+	}
+	if c.UsernameFlag {
+		c.FixedHeader.RemainingLength += 2 + len(c.Username)
+	}
+	if c.PasswordFlag {
+		c.FixedHeader.RemainingLength += 2 + len(c.Password)
+	}
+	if err := c.FixedHeader.checkLength(); err != nil {
+		return err
+	}
+	if err := checkFields(len(c.ProtocolName), len(c.ClientIdentifier), len(c.WillTopic), len(c.WillMessage), len(c.Username), len(c.Password)); err != nil {
+		return err
+	}
+	packet := make([]byte, 0, c.FixedHeader.packetLength())
+	packet = c.FixedHeader.appendTo(packet)
+	packet = appendField(packet, c.ProtocolName)
+	packet = append(packet, c.ProtocolVersion)
+	packet = append(packet, boolToByte(c.CleanSession)<<1|boolToByte(c.WillFlag)<<2|c.WillQos<<3|boolToByte(c.WillRetain)<<5|boolToByte(c.PasswordFlag)<<6|boolToByte(c.UsernameFlag)<<7)
+	packet = appendUint16(packet, c.KeepaliveTimer)
+	packet = appendField(packet, c.ClientIdentifier)
 	if c.WillFlag {
-		body.Write(encodeString(c.WillTopic))
-		body.Write(encodeBytes(c.WillMessage))
+		packet = appendField(packet, c.WillTopic)
+		packet = appendBytesField(packet, c.WillMessage)
 	}
 	if c.UsernameFlag {
-		body.Write(encodeString(c.Username))
+		packet = appendField(packet, c.Username)
 	}
 	if c.PasswordFlag {
-		body.Write(encodeBytes(c.Password))
+		packet = appendBytesField(packet, c.Password)
 	}
-	c.FixedHeader.RemainingLength = body.Len()
-	packet := c.FixedHeader.pack()
-	packet.Write(body.Bytes())
-	_, err = packet.WriteTo(w)
+	_, err := w.Write(packet)
 
 	return err
 }
 
-func (c *ConnectPacket) Unpack(b io.Reader) {
-	c.ProtocolName = decodeString(b)
-	c.ProtocolVersion = decodeByte(b)
-	options := decodeByte(b)
+func (c *ConnectPacket) Unpack(b io.Reader) error {
+	var err error
+	if c.ProtocolName, err = decodeString(b); err != nil {
+		return err
+	}
+	if c.ProtocolVersion, err = decodeByte(b); err != nil {
+		return err
+	}
+	options, err := decodeByte(b)
+	if err != nil {
+		return err
+	}
 	c.ReservedBit = 1 & options
 	c.CleanSession = 1&(options>>1) > 0
 	c.WillFlag = 1&(options>>2) > 0
@@ -74,18 +96,31 @@ func (c *ConnectPacket) Unpack(b io.Reader) {
 	c.WillRetain = 1&(options>>5) > 0
 	c.PasswordFlag = 1&(options>>6) > 0
 	c.UsernameFlag = 1&(options>>7) > 0
-	c.KeepaliveTimer = decodeUint16(b)
-	c.ClientIdentifier = decodeString(b)
+	if c.KeepaliveTimer, err = decodeUint16(b); err != nil {
+		return err
+	}
+	if c.ClientIdentifier, err = decodeString(b); err != nil {
+		return err
+	}
 	if c.WillFlag {
-		c.WillTopic = decodeString(b)
-		c.WillMessage = decodeBytes(b)
+		if c.WillTopic, err = decodeString(b); err != nil {
+			return err
+		}
+		if c.WillMessage, err = decodeBytes(b); err != nil {
+			return err
+		}
 	}
 	if c.UsernameFlag {
-		c.Username = decodeString(b)
+		if c.Username, err = decodeString(b); err != nil {
+			return err
+		}
 	}
 	if c.PasswordFlag {
-		c.Password = decodeBytes(b)
+		if c.Password, err = decodeBytes(b); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func (c *ConnectPacket) Validate() byte {
@@ -93,23 +128,31 @@ func (c *ConnectPacket) Validate() byte {
 		return CONN_REF_BAD_USER_PASS
 	}
 	if c.ReservedBit != 0 {
-		fmt.Println("Bad reserved bit")
 		return CONN_PROTOCOL_VIOLATION
 	}
-	if (c.ProtocolName == "MQIsdp" && c.ProtocolVersion != 3) || (c.ProtocolName == "MQTT" && c.ProtocolVersion != 4) {
+	version := c.ProtocolVersion &^ bridgeFlag
+	if (c.ProtocolName == "MQIsdp" && version != 3) || (c.ProtocolName == "MQTT" && version != 4) {
 		return CONN_REF_BAD_PROTO_VER
 	}
 	if c.ProtocolName != "MQIsdp" && c.ProtocolName != "MQTT" {
-		fmt.Println("Bad protocol name")
 		return CONN_PROTOCOL_VIOLATION
 	}
 	if len(c.ClientIdentifier) > 65535 || len(c.Username) > 65535 || len(c.Password) > 65535 {
-		fmt.Println("Bad size field")
 		return CONN_PROTOCOL_VIOLATION
 	}
+	//the server can only assign a client id to a client that doesn't need its session kept
+	if len(c.ClientIdentifier) == 0 && !c.CleanSession {
+		return CONN_REF_ID_REJ
+	}
 	return CONN_ACCEPTED
 }
 
+//Bridge returns true if the protocol version has the high bit set, which is how
+//mosquitto style bridges identify themselves to the remote broker (try_private)
+func (c *ConnectPacket) Bridge() bool {
+	return c.ProtocolVersion&bridgeFlag != 0
+}
+
 func (c *ConnectPacket) Details() Details {
 	return Details{Qos: 0, MessageID: 0}
 }
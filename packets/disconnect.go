@@ -19,13 +19,14 @@ func (d *DisconnectPacket) String() string {
 }
 
 func (d *DisconnectPacket) Write(w io.Writer) error {
-	packet := d.FixedHeader.pack()
-	_, err := packet.WriteTo(w)
+	d.FixedHeader.RemainingLength = 0
+	_, err := w.Write(d.FixedHeader.appendTo(make([]byte, 0, d.FixedHeader.packetLength())))
 
 	return err
 }
 
-func (d *DisconnectPacket) Unpack(b io.Reader) {
+func (d *DisconnectPacket) Unpack(b io.Reader) error {
+	return nil
 }
 
 func (d *DisconnectPacket) Details() Details {
@@ -0,0 +1,121 @@
+package packets
+
+import (
+	"strings"
+)
+
+//Fixup is one of the ways devices in the field break the MQTT 3.1.1 spec that a server can
+//safely correct rather than closing the connection
+type Fixup int
+
+const (
+	//FixReservedFlags sets the fixed header flags of a packet other than PUBLISH to the
+	//ones the spec requires and clears the reserved bit of the CONNECT flags
+	FixReservedFlags Fixup = iota
+	//FixProtocolName trims the spaces around a CONNECT's protocol name, so "MQIsdp " is
+	//taken as "MQIsdp"
+	FixProtocolName
+	//FixKeepaliveByteOrder swaps the bytes of a CONNECT's keepalive that was sent little
+	//endian, taken to be one whose low byte is 0 and high byte isn't, so 60 seconds sent as
+	//3c 00 isn't read as 15360. A client really asking for a multiple of 256 seconds gets
+	//the wrong keepalive, so it is only for listeners used by devices that need it.
+	FixKeepaliveByteOrder
+	//FixQos0Dup clears the dup flag of a QoS 0 PUBLISH
+	FixQos0Dup
+	//FixSubscribeOptions clears the reserved upper 6 bits of the requested QoS bytes of a
+	//SUBSCRIBE, which some client stacks use for options of their own, leaving the QoS in
+	//the low 2 bits
+	FixSubscribeOptions
+	//NumFixups is the number of Fixups
+	NumFixups
+)
+
+var fixupNames = [NumFixups]string{
+	FixReservedFlags:      "reserved-flags",
+	FixProtocolName:       "protocol-name",
+	FixKeepaliveByteOrder: "keepalive-byte-order",
+	FixQos0Dup:            "qos0-dup",
+	FixSubscribeOptions:   "subscribe-options",
+}
+
+func (f Fixup) String() string {
+	if f < 0 || f >= NumFixups {
+		return "unknown"
+	}
+	return fixupNames[f]
+}
+
+//ParseFixup returns the Fixup called name, and false if there isn't one
+func ParseFixup(name string) (Fixup, bool) {
+	for fixup, fixupName := range fixupNames {
+		if fixupName == name {
+			return Fixup(fixup), true
+		}
+	}
+	return 0, false
+}
+
+//header gives the fixups the fixed header of any packet to change
+func (fh *FixedHeader) header() *FixedHeader {
+	return fh
+}
+
+//FixInbound corrects the ways cp, a packet a server received from a client, breaks the spec
+//that are in fixups and returns the ones it corrected. It is called before ValidateInbound,
+//which then only finds the violations that weren't corrected.
+func FixInbound(cp ControlPacket, fixups []Fixup) []Fixup {
+	var fixed []Fixup
+	for _, fixup := range fixups {
+		if fixup.fix(cp) {
+			fixed = append(fixed, fixup)
+		}
+	}
+	return fixed
+}
+
+//fix corrects cp if it breaks the spec in the way f is for, returning true if it did
+func (f Fixup) fix(cp ControlPacket) bool {
+	switch f {
+	case FixReservedFlags:
+		fixed := false
+		if required, ok := requiredFlags[cp.Type()]; ok {
+			fh := cp.(interface{ header() *FixedHeader }).header()
+			if fh.flags() != required {
+				fh.Dup, fh.Qos, fh.Retain = false, required>>1, false
+				fixed = true
+			}
+		}
+		if c, ok := cp.(*ConnectPacket); ok && c.ReservedBit != 0 {
+			c.ReservedBit = 0
+			fixed = true
+		}
+		return fixed
+	case FixProtocolName:
+		if c, ok := cp.(*ConnectPacket); ok && strings.TrimSpace(c.ProtocolName) != c.ProtocolName {
+			c.ProtocolName = strings.TrimSpace(c.ProtocolName)
+			return true
+		}
+	case FixKeepaliveByteOrder:
+		if c, ok := cp.(*ConnectPacket); ok && c.KeepaliveTimer&0xff == 0 && c.KeepaliveTimer != 0 {
+			c.KeepaliveTimer >>= 8
+			return true
+		}
+	case FixQos0Dup:
+		if p, ok := cp.(*PublishPacket); ok && p.Qos == 0 && p.Dup {
+			p.Dup = false
+			return true
+		}
+	case FixSubscribeOptions:
+		fixed := false
+		if s, ok := cp.(*SubscribePacket); ok {
+			for i, qos := range s.Qoss {
+				if qos&^subscribeQosMask != 0 {
+					s.Qoss[i] = qos & subscribeQosMask
+					fixed = true
+				}
+			}
+		}
+		return fixed
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package packets
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+//seedPackets are valid packets of every type, packed to seed the fuzz targets
+func seedPackets() [][]byte {
+	connect := NewControlPacket(CONNECT).(*ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.CleanSession = true
+	connect.ClientIdentifier = "client"
+	connect.WillFlag, connect.WillTopic, connect.WillMessage, connect.WillQos = true, "will", []byte("gone"), 1
+	connect.UsernameFlag, connect.Username = true, "user"
+	connect.PasswordFlag, connect.Password = true, []byte("password")
+	connack := NewControlPacket(CONNACK).(*ConnackPacket)
+	connack.ReturnCode = CONN_REF_NOT_AUTH
+	publish := NewControlPacket(PUBLISH).(*PublishPacket)
+	publish.TopicName, publish.Payload = "a/b", []byte("payload")
+	publish1 := NewControlPacket(PUBLISH).(*PublishPacket)
+	publish1.Qos, publish1.Retain, publish1.MessageID = 1, true, 1
+	publish1.TopicName, publish1.Payload = "a/b", []byte("payload")
+	subscribe := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	subscribe.MessageID, subscribe.Topics, subscribe.Qoss = 2, []string{"a/#", "+/b"}, []byte{0, 2}
+	suback := NewControlPacket(SUBACK).(*SubackPacket)
+	suback.MessageID, suback.GrantedQoss = 2, []byte{0, 2}
+	unsubscribe := NewControlPacket(UNSUBSCRIBE).(*UnsubscribePacket)
+	unsubscribe.MessageID, unsubscribe.Topics = 3, []string{"a/#", "+/b"}
+	packets := []ControlPacket{connect, connack, publish, publish1, subscribe, suback, unsubscribe}
+	for _, t := range []PacketType{PUBACK, PUBREC, PUBREL, PUBCOMP, UNSUBACK, PINGREQ, PINGRESP, DISCONNECT} {
+		packets = append(packets, NewControlPacket(t))
+	}
+	var seeds [][]byte
+	for _, cp := range packets {
+		var b bytes.Buffer
+		cp.Write(&b)
+		seeds = append(seeds, b.Bytes())
+	}
+	return seeds
+}
+
+//repack writes cp and reads it back, then writes that, both writes must be the same
+func repack(t *testing.T, cp ControlPacket) []byte {
+	var packed bytes.Buffer
+	if err := cp.Write(&packed); err != nil {
+		t.Fatalf("failed to write unpacked packet: %s", err.Error())
+	}
+	again, err := ReadPacket(bytes.NewReader(packed.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read back written packet %x: %s", packed.Bytes(), err.Error())
+	}
+	var repacked bytes.Buffer
+	again.Write(&repacked)
+	if !bytes.Equal(packed.Bytes(), repacked.Bytes()) {
+		t.Fatalf("packet changed when written again\n%x\n%x", packed.Bytes(), repacked.Bytes())
+	}
+	return packed.Bytes()
+}
+
+func FuzzReadPacket(f *testing.F) {
+	for _, seed := range seedPackets() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cp, err := ReadPacket(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		repack(t, cp)
+	})
+}
+
+func FuzzUnpack(f *testing.F) {
+	for _, seed := range seedPackets() {
+		var fh FixedHeader
+		fh.unpack(seed[0], bytes.NewReader(seed[1:]))
+		f.Add(seed[0], seed[len(seed)-fh.RemainingLength:])
+	}
+	f.Fuzz(func(t *testing.T, typeAndFlags byte, body []byte) {
+		var fh FixedHeader
+		fh.unpack(typeAndFlags, bytes.NewReader(encodeInto(nil, len(body))))
+		cp := NewControlPacketWithHeader(fh)
+		if cp == nil {
+			return
+		}
+		if err := cp.Unpack(bytes.NewReader(body)); err != nil {
+			return
+		}
+		repack(t, cp)
+	})
+}
+
+//the seeds are written canonically, so reading and writing them gives the same bytes
+func TestSeedsRoundTrip(t *testing.T) {
+	for _, seed := range seedPackets() {
+		cp, err := ReadPacket(bytes.NewReader(seed))
+		if err != nil {
+			t.Fatalf("failed to read %x: %s", seed, err.Error())
+		}
+		if packed := repack(t, cp); !bytes.Equal(packed, seed) {
+			t.Errorf("%s was written as %x, should be %x", cp.Type(), packed, seed)
+		}
+	}
+}
+
+func TestMalformedPackets(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"publish shorter than its topic":     {0x30, 0x03, 0x00, 0x05, 'a'},
+		"remaining length over 4 bytes":      {0x30, 0xff, 0xff, 0xff, 0xff, 0x7f},
+		"puback with trailing bytes":         {0x40, 0x03, 0x00, 0x01, 0x00},
+		"pubrel without its message id":      {0x62, 0x01, 0x00},
+		"unsuback with nothing in it":        {0xb0, 0x00},
+		"connect without a client id":        {0x10, 0x0a, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c},
+		"subscribe with its qos missing":     {0x82, 0x05, 0x00, 0x01, 0x00, 0x01, 'a'},
+		"unsubscribe with a truncated topic": {0xa2, 0x05, 0x00, 0x01, 0x00, 0x05, 'a'},
+	} {
+		if _, err := ReadPacket(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s was read without an error", name)
+		}
+	}
+}
+
+//randomString is a string of n random letters and slashes
+func randomString(r *rand.Rand, n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz/"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[r.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+//roundTrip writes cp and reads it back, the copy must have every field of the original
+func roundTrip(t *testing.T, cp ControlPacket) ControlPacket {
+	var b bytes.Buffer
+	if err := cp.Write(&b); err != nil {
+		t.Fatalf("failed to write %s: %s", cp.Type(), err.Error())
+	}
+	read, err := ReadPacket(&b)
+	if err != nil {
+		t.Fatalf("failed to read back %s: %s", cp.Type(), err.Error())
+	}
+	return read
+}
+
+func TestConnectRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		cp := NewControlPacket(CONNECT).(*ConnectPacket)
+		cp.ProtocolName, cp.ProtocolVersion = "MQTT", 4
+		if r.Intn(2) == 0 {
+			cp.ProtocolName, cp.ProtocolVersion = "MQIsdp", 3
+		}
+		cp.CleanSession = r.Intn(2) == 0
+		cp.KeepaliveTimer = uint16(r.Intn(65536))
+		cp.ClientIdentifier = randomString(r, r.Intn(30))
+		if r.Intn(2) == 0 {
+			cp.WillFlag, cp.WillQos, cp.WillRetain = true, byte(r.Intn(3)), r.Intn(2) == 0
+			cp.WillTopic, cp.WillMessage = randomString(r, 1+r.Intn(50)), randomBytes(r, r.Intn(200))
+		}
+		if r.Intn(2) == 0 {
+			cp.UsernameFlag, cp.Username = true, randomString(r, r.Intn(30))
+			if r.Intn(2) == 0 {
+				cp.PasswordFlag, cp.Password = true, randomBytes(r, r.Intn(30))
+			}
+		}
+		read := roundTrip(t, cp).(*ConnectPacket)
+		read.uuid = cp.uuid
+		if !reflect.DeepEqual(cp, read) {
+			t.Fatalf("CONNECT changed in a round trip\n%+v\n%+v", cp, read)
+		}
+	}
+}
+
+func TestPublishRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	//remaining lengths either side of where the encoded length grows a byte
+	var lengths []int
+	for _, boundary := range []int{127, 16383, 2097151} {
+		lengths = append(lengths, boundary-1, boundary, boundary+1)
+	}
+	for i := 0; i < 100; i++ {
+		lengths = append(lengths, 10+r.Intn(1000))
+	}
+	for _, length := range lengths {
+		for qos := byte(0); qos < 3; qos++ {
+			pp := NewControlPacket(PUBLISH).(*PublishPacket)
+			pp.Qos, pp.Retain, pp.Dup = qos, r.Intn(2) == 0, qos > 0 && r.Intn(2) == 0
+			pp.TopicName = randomString(r, 1+r.Intn(8))
+			header := 2 + len(pp.TopicName)
+			if qos > 0 {
+				pp.MessageID = uint16(1 + r.Intn(65535))
+				header += 2
+			}
+			pp.Payload = randomBytes(r, length-header)
+			read := roundTrip(t, pp).(*PublishPacket)
+			if read.RemainingLength != length {
+				t.Fatalf("remaining length is %d, should be %d", read.RemainingLength, length)
+			}
+			//Write doesn't change the packet, so pp has no remaining length or encoded topic
+			read.uuid, read.RemainingLength, read.topicField = pp.uuid, 0, nil
+			if !reflect.DeepEqual(pp, read) {
+				t.Fatalf("PUBLISH with qos %d and remaining length %d changed in a round trip", qos, length)
+			}
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package packets
+
+//messageIDCount is how many message ids NextMessageID cycles through, from 1
+const messageIDCount = 65534
+
+//NextMessageID returns the first id after last that inUse reports is free. Ids are handed
+//out in sequence, wrapping round to 1, so the order of the ids in use is the order they
+//were allocated in and an id isn't reused straight after it is freed. It returns 0 if
+//every id is in use.
+func NextMessageID(last uint16, inUse func(uint16) bool) uint16 {
+	for i := 0; i < messageIDCount; i++ {
+		last = last%messageIDCount + 1
+		if !inUse(last) {
+			return last
+		}
+	}
+	return 0
+}
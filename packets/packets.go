@@ -9,15 +9,32 @@ import (
 	"io"
 )
 
+//ControlPacket is any MQTT packet, Details gives the QoS and message id of a packet without
+//needing to know its type. Unpack is given exactly the packet's variable header and payload,
+//its RemainingLength bytes, by a reader that has already set the FixedHeader from the bytes
+//before them, and it reads no more than that.
 type ControlPacket interface {
 	Write(io.Writer) error
-	Unpack(io.Reader)
+	Unpack(io.Reader) error
 	String() string
 	Details() Details
 	UUID() uuid.UUID
+	Type() PacketType
 }
 
-var PacketNames = map[uint8]string{
+//PacketType is an MQTT control packet type, the high 4 bits of the first byte of the fixed
+//header. Types 0 and 15 are reserved.
+type PacketType byte
+
+//String is the name of the packet type from PacketNames
+func (t PacketType) String() string {
+	if name, ok := PacketNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("RESERVED(%d)", byte(t))
+}
+
+var PacketNames = map[PacketType]string{
 	1:  "CONNECT",
 	2:  "CONNACK",
 	3:  "PUBLISH",
@@ -35,20 +52,20 @@ var PacketNames = map[uint8]string{
 }
 
 const (
-	CONNECT     = 1
-	CONNACK     = 2
-	PUBLISH     = 3
-	PUBACK      = 4
-	PUBREC      = 5
-	PUBREL      = 6
-	PUBCOMP     = 7
-	SUBSCRIBE   = 8
-	SUBACK      = 9
-	UNSUBSCRIBE = 10
-	UNSUBACK    = 11
-	PINGREQ     = 12
-	PINGRESP    = 13
-	DISCONNECT  = 14
+	CONNECT     PacketType = 1
+	CONNACK     PacketType = 2
+	PUBLISH     PacketType = 3
+	PUBACK      PacketType = 4
+	PUBREC      PacketType = 5
+	PUBREL      PacketType = 6
+	PUBCOMP     PacketType = 7
+	SUBSCRIBE   PacketType = 8
+	SUBACK      PacketType = 9
+	UNSUBSCRIBE PacketType = 10
+	UNSUBACK    PacketType = 11
+	PINGREQ     PacketType = 12
+	PINGRESP    PacketType = 13
+	DISCONNECT  PacketType = 14
 )
 
 const (
@@ -73,29 +90,52 @@ var ConnackReturnCodes = map[uint8]string{
 	255: "Connection Refused: Protocol Violation",
 }
 
+//ErrUnknownPacketType is returned for a packet with a reserved packet type
+var ErrUnknownPacketType = errors.New("Reserved or unknown packet type")
+
+//ErrPacketTooLarge is returned by ReadPacketLimit for a packet over its size limit
+var ErrPacketTooLarge = errors.New("Packet exceeds maximum packet size")
+
+//MaxRemainingLength is the largest remaining length its 4 byte encoding can hold, so the
+//largest packet body MQTT allows
+const MaxRemainingLength = 268435455
+
+//ErrRemainingLengthTooLarge is returned by Write for a packet whose body is longer than
+//MaxRemainingLength, as the packet can't be encoded nothing is written
+var ErrRemainingLengthTooLarge = errors.New("Packet body exceeds the maximum remaining length")
+
+//MaxFieldLength is the longest string or binary field its 2 byte length can hold
+const MaxFieldLength = 65535
+
+//ErrFieldTooLong is returned by Write for a packet with a string or binary field longer
+//than MaxFieldLength, as the packet can't be encoded nothing is written
+var ErrFieldTooLong = errors.New("Packet field exceeds the maximum field length")
+
+//ErrMalformedPacket is returned for a packet whose remaining length or body doesn't
+//match the fields it should contain
+var ErrMalformedPacket = errors.New("Malformed packet")
+
 func ReadPacket(r io.Reader) (cp ControlPacket, err error) {
-	var fh FixedHeader
-	b := make([]byte, 1)
+	return ReadPacketLimit(r, 0)
+}
 
-	_, err = io.ReadFull(r, b)
-	if err != nil {
-		return nil, err
-	}
-	fh.unpack(b[0], r)
-	cp = NewControlPacketWithHeader(fh)
-	if cp == nil {
-		return nil, errors.New("Bad data from client")
-	}
-	packetBytes := make([]byte, fh.RemainingLength)
-	_, err = io.ReadFull(r, packetBytes)
-	if err != nil {
-		return nil, err
-	}
-	cp.Unpack(bytes.NewBuffer(packetBytes))
-	return cp, nil
+//ReadPacketLimit reads a packet like ReadPacket, but if the packet including its fixed
+//header is larger than maxSize bytes it returns ErrPacketTooLarge without reading the
+//rest of it. A maxSize of 0 means no limit. A connection that packets are read from one
+//after another should use a Reader of its own.
+func ReadPacketLimit(r io.Reader, maxSize int) (cp ControlPacket, err error) {
+	return NewReader(r).ReadPacket(maxSize)
+}
+
+//NewControlPacket returns a new packet of packetType, or nil if it is reserved. It is for
+//packet types known to be valid, such as the constants, use NewPacket otherwise.
+func NewControlPacket(packetType PacketType) ControlPacket {
+	cp, _ := NewPacket(packetType)
+	return cp
 }
 
-func NewControlPacket(packetType byte) (cp ControlPacket) {
+//NewPacket returns a new packet of packetType, or ErrUnknownPacketType if it is reserved
+func NewPacket(packetType PacketType) (cp ControlPacket, err error) {
 	switch packetType {
 	case CONNECT:
 		cp = &ConnectPacket{FixedHeader: FixedHeader{MessageType: CONNECT}, uuid: uuid.New()}
@@ -118,7 +158,7 @@ func NewControlPacket(packetType byte) (cp ControlPacket) {
 	case SUBACK:
 		cp = &SubackPacket{FixedHeader: FixedHeader{MessageType: SUBACK}, uuid: uuid.New()}
 	case UNSUBSCRIBE:
-		cp = &UnsubscribePacket{FixedHeader: FixedHeader{MessageType: UNSUBSCRIBE}, uuid: uuid.New()}
+		cp = &UnsubscribePacket{FixedHeader: FixedHeader{MessageType: UNSUBSCRIBE, Qos: 1}, uuid: uuid.New()}
 	case UNSUBACK:
 		cp = &UnsubackPacket{FixedHeader: FixedHeader{MessageType: UNSUBACK}, uuid: uuid.New()}
 	case PINGREQ:
@@ -126,9 +166,9 @@ func NewControlPacket(packetType byte) (cp ControlPacket) {
 	case PINGRESP:
 		cp = &PingrespPacket{FixedHeader: FixedHeader{MessageType: PINGRESP}, uuid: uuid.New()}
 	default:
-		return nil
+		return nil, ErrUnknownPacketType
 	}
-	return cp
+	return cp, nil
 }
 
 func NewControlPacketWithHeader(fh FixedHeader) (cp ControlPacket) {
@@ -167,13 +207,14 @@ func NewControlPacketWithHeader(fh FixedHeader) (cp ControlPacket) {
 	return cp
 }
 
+//Details are the QoS and message id of a packet, both are 0 for packets that don't have them
 type Details struct {
 	Qos       byte
 	MessageID uint16
 }
 
 type FixedHeader struct {
-	MessageType     byte
+	MessageType     PacketType
 	Dup             bool
 	Qos             byte
 	Retain          bool
@@ -181,7 +222,12 @@ type FixedHeader struct {
 }
 
 func (fh FixedHeader) String() string {
-	return fmt.Sprintf("%s: dup: %t qos: %d retain: %t rLength: %d", PacketNames[fh.MessageType], fh.Dup, fh.Qos, fh.Retain, fh.RemainingLength)
+	return fmt.Sprintf("%s: dup: %t qos: %d retain: %t rLength: %d", fh.MessageType, fh.Dup, fh.Qos, fh.Retain, fh.RemainingLength)
+}
+
+//Type returns the MQTT control packet type, one of the keys of PacketNames
+func (fh FixedHeader) Type() PacketType {
+	return fh.MessageType
 }
 
 func boolToByte(b bool) byte {
@@ -193,93 +239,189 @@ func boolToByte(b bool) byte {
 	}
 }
 
-func (fh *FixedHeader) pack() bytes.Buffer {
-	var header bytes.Buffer
-	header.WriteByte(fh.MessageType<<4 | boolToByte(fh.Dup)<<3 | fh.Qos<<1 | boolToByte(fh.Retain))
-	header.Write(encodeLength(fh.RemainingLength))
-	return header
+//packetLength is the size of the whole packet, the fixed header and RemainingLength
+func (fh *FixedHeader) packetLength() int {
+	return 1 + lengthSize(fh.RemainingLength) + fh.RemainingLength
+}
+
+//checkLength returns ErrRemainingLengthTooLarge if the remaining length can't be encoded,
+//appendTo would otherwise write a length the receiver can't decode and lose its place in
+//the stream
+func (fh *FixedHeader) checkLength() error {
+	if fh.RemainingLength > MaxRemainingLength {
+		return ErrRemainingLengthTooLarge
+	}
+	return nil
+}
+
+//checkFields returns ErrFieldTooLong if any of the lengths of a packet's string and binary
+//fields is over MaxFieldLength
+func checkFields(lengths ...int) error {
+	for _, length := range lengths {
+		if length > MaxFieldLength {
+			return ErrFieldTooLong
+		}
+	}
+	return nil
+}
+
+//appendTo appends the packed fixed header to buf
+func (fh *FixedHeader) appendTo(buf []byte) []byte {
+	buf = append(buf, byte(fh.MessageType)<<4|boolToByte(fh.Dup)<<3|fh.Qos<<1|boolToByte(fh.Retain))
+	return encodeInto(buf, fh.RemainingLength)
 }
 
-func (fh *FixedHeader) unpack(typeAndFlags byte, r io.Reader) {
-	fh.MessageType = typeAndFlags >> 4
+//packetType returns the packet type in the first byte of a fixed header, or
+//ErrUnknownPacketType if it is reserved
+func packetType(typeAndFlags byte) (PacketType, error) {
+	t := PacketType(typeAndFlags >> 4)
+	if _, ok := PacketNames[t]; !ok {
+		return 0, ErrUnknownPacketType
+	}
+	return t, nil
+}
+
+func (fh *FixedHeader) unpack(typeAndFlags byte, r io.Reader) error {
+	return fh.unpackLength(typeAndFlags, r, make([]byte, 1))
+}
+
+//unpackLength is unpack reading the remaining length a byte at a time into b
+func (fh *FixedHeader) unpackLength(typeAndFlags byte, r io.Reader, b []byte) error {
+	var err error
+	if fh.MessageType, err = packetType(typeAndFlags); err != nil {
+		return err
+	}
 	fh.Dup = (typeAndFlags>>3)&0x01 > 0
 	fh.Qos = (typeAndFlags >> 1) & 0x03
 	fh.Retain = typeAndFlags&0x01 > 0
-	fh.RemainingLength = decodeLength(r)
+	fh.RemainingLength, err = decodeLength(r, b)
+	return err
 }
 
-func decodeByte(b io.Reader) byte {
-	num := make([]byte, 1)
-	b.Read(num)
-	return num[0]
+//readFull reads len(b) bytes of a packet's body, running out means the packet is malformed
+func readFull(r io.Reader, b []byte) error {
+	_, err := io.ReadFull(r, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrMalformedPacket
+	}
+	return err
 }
 
-func decodeUint16(b io.Reader) uint16 {
-	num := make([]byte, 2)
-	b.Read(num)
-	return binary.BigEndian.Uint16(num)
+//next returns the next n bytes of a packet's body. From a *bytes.Buffer they are part of the
+//buffer's and are only valid until it is read again, so the fields that don't keep them don't
+//need to allocate.
+func next(b io.Reader, n int) ([]byte, error) {
+	if buffer, ok := b.(*bytes.Buffer); ok {
+		if buffer.Len() < n {
+			return nil, ErrMalformedPacket
+		}
+		return buffer.Next(n), nil
+	}
+	field := make([]byte, n)
+	if err := readFull(b, field); err != nil {
+		return nil, err
+	}
+	return field, nil
 }
 
-func encodeUint16(num uint16) []byte {
-	bytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(bytes, num)
-	return bytes
+func decodeByte(b io.Reader) (byte, error) {
+	num, err := next(b, 1)
+	if err != nil {
+		return 0, err
+	}
+	return num[0], nil
 }
 
-func encodeString(field string) []byte {
-	fieldLength := make([]byte, 2)
-	binary.BigEndian.PutUint16(fieldLength, uint16(len(field)))
-	return append(fieldLength, []byte(field)...)
+func decodeUint16(b io.Reader) (uint16, error) {
+	num, err := next(b, 2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(num), nil
 }
 
-func decodeString(b io.Reader) string {
-	fieldLength := decodeUint16(b)
-	field := make([]byte, fieldLength)
-	b.Read(field)
-	return string(field)
+func appendUint16(buf []byte, num uint16) []byte {
+	return append(buf, byte(num>>8), byte(num))
+}
+
+//appendField appends field with its 2 byte length
+func appendField(buf []byte, field string) []byte {
+	buf = appendUint16(buf, uint16(len(field)))
+	return append(buf, field...)
 }
 
-func decodeBytes(b io.Reader) []byte {
-	fieldLength := decodeUint16(b)
+func decodeString(b io.Reader) (string, error) {
+	fieldLength, err := decodeUint16(b)
+	if err != nil {
+		return "", err
+	}
+	field, err := next(b, int(fieldLength))
+	if err != nil {
+		return "", err
+	}
+	return string(field), nil
+}
+
+func decodeBytes(b io.Reader) ([]byte, error) {
+	fieldLength, err := decodeUint16(b)
+	if err != nil {
+		return nil, err
+	}
 	field := make([]byte, fieldLength)
-	b.Read(field)
-	return field
+	if err = readFull(b, field); err != nil {
+		return nil, err
+	}
+	return field, nil
 }
 
-func encodeBytes(field []byte) []byte {
-	fieldLength := make([]byte, 2)
-	binary.BigEndian.PutUint16(fieldLength, uint16(len(field)))
-	return append(fieldLength, field...)
+//appendBytesField appends field with its 2 byte length
+func appendBytesField(buf []byte, field []byte) []byte {
+	buf = appendUint16(buf, uint16(len(field)))
+	return append(buf, field...)
 }
 
-func encodeLength(length int) []byte {
-	var encLength []byte
+//encodeInto appends the variable length encoding of a remaining length to buf
+func encodeInto(buf []byte, length int) []byte {
 	for {
 		digit := byte(length % 128)
 		length /= 128
 		if length > 0 {
 			digit |= 0x80
 		}
-		encLength = append(encLength, digit)
+		buf = append(buf, digit)
 		if length == 0 {
-			break
+			return buf
 		}
 	}
-	return encLength
 }
 
-func decodeLength(r io.Reader) int {
+//lengthSize is how many bytes encodeInto uses for length
+func lengthSize(length int) int {
+	switch {
+	case length < 128:
+		return 1
+	case length < 16384:
+		return 2
+	case length < 2097152:
+		return 3
+	}
+	return 4
+}
+
+//decodeLength reads a remaining length, which is at most 4 bytes long, a byte at a time into b
+func decodeLength(r io.Reader, b []byte) (int, error) {
 	var rLength uint32
-	var multiplier uint32 = 0
-	b := make([]byte, 1)
-	for {
-		io.ReadFull(r, b)
+	var multiplier uint32
+	for i := 0; i < 4; i++ {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, err
+		}
 		digit := b[0]
 		rLength |= uint32(digit&127) << multiplier
 		if (digit & 128) == 0 {
-			break
+			return int(rLength), nil
 		}
 		multiplier += 7
 	}
-	return int(rLength)
+	return 0, ErrMalformedPacket
 }
@@ -1,7 +1,14 @@
 package packets
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -50,6 +57,56 @@ func TestPacketNames(t *testing.T) {
 	}
 }
 
+//Details of a packet read off the wire give its QoS and message id whatever its type
+func TestDetails(t *testing.T) {
+	publish := NewControlPacket(PUBLISH).(*PublishPacket)
+	publish.Qos, publish.MessageID, publish.TopicName = 2, 7, "a"
+	puback := NewControlPacket(PUBACK).(*PubackPacket)
+	puback.MessageID = 7
+	pubrec := NewControlPacket(PUBREC).(*PubrecPacket)
+	pubrec.MessageID = 7
+	pubrel := NewControlPacket(PUBREL).(*PubrelPacket)
+	pubrel.MessageID = 7
+	pubcomp := NewControlPacket(PUBCOMP).(*PubcompPacket)
+	pubcomp.MessageID = 7
+	subscribe := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	subscribe.MessageID, subscribe.Topics, subscribe.Qoss = 7, []string{"a"}, []byte{1}
+	suback := NewControlPacket(SUBACK).(*SubackPacket)
+	suback.MessageID, suback.GrantedQoss = 7, []byte{1}
+	unsubscribe := NewControlPacket(UNSUBSCRIBE).(*UnsubscribePacket)
+	unsubscribe.MessageID, unsubscribe.Topics = 7, []string{"a"}
+	unsuback := NewControlPacket(UNSUBACK).(*UnsubackPacket)
+	unsuback.MessageID = 7
+	for _, test := range []struct {
+		cp      ControlPacket
+		details Details
+	}{
+		{publish, Details{Qos: 2, MessageID: 7}},
+		{puback, Details{MessageID: 7}},
+		{pubrec, Details{MessageID: 7}},
+		{pubrel, Details{Qos: 1, MessageID: 7}},
+		{pubcomp, Details{MessageID: 7}},
+		{subscribe, Details{Qos: 1, MessageID: 7}},
+		{suback, Details{MessageID: 7}},
+		{unsubscribe, Details{Qos: 1, MessageID: 7}},
+		{unsuback, Details{MessageID: 7}},
+		{NewControlPacket(CONNACK), Details{}},
+		{NewControlPacket(PINGREQ), Details{}},
+		{NewControlPacket(PINGRESP), Details{}},
+		{NewControlPacket(DISCONNECT), Details{}},
+	} {
+		var b bytes.Buffer
+		test.cp.Write(&b)
+		cp, err := ReadPacket(&b)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", test.cp.Type(), err.Error())
+		}
+		if cp.Details() != test.details {
+			t.Errorf("%s details are %+v, should be %+v", cp.Type(), cp.Details(), test.details)
+		}
+	}
+}
+
 func TestPacketConsts(t *testing.T) {
 	if CONNECT != 1 {
 		t.Errorf("Const for CONNECT is %d, should be %d", CONNECT, 1)
@@ -95,6 +152,24 @@ func TestPacketConsts(t *testing.T) {
 	}
 }
 
+//the reserved packet types 0 and 15 can't be created or read
+func TestReservedPacketTypes(t *testing.T) {
+	for _, reserved := range []PacketType{0, 15} {
+		if cp, err := NewPacket(reserved); cp != nil || err != ErrUnknownPacketType {
+			t.Errorf("NewPacket(%d) returned %v, %v, should be ErrUnknownPacketType", reserved, cp, err)
+		}
+		if _, err := ReadPacket(bytes.NewReader([]byte{byte(reserved) << 4, 0x00})); err != ErrUnknownPacketType {
+			t.Errorf("reading packet type %d returned %v, should be ErrUnknownPacketType", reserved, err)
+		}
+		if name := reserved.String(); name != fmt.Sprintf("RESERVED(%d)", reserved) {
+			t.Errorf("packet type %d is called %s", reserved, name)
+		}
+	}
+	if PUBLISH.String() != "PUBLISH" {
+		t.Errorf("PUBLISH is called %s", PUBLISH)
+	}
+}
+
 func TestConnackConsts(t *testing.T) {
 	if CONN_ACCEPTED != 0x00 {
 		t.Errorf("Const for CONN_ACCEPTED is %d, should be %d", CONN_ACCEPTED, 0)
@@ -157,3 +232,604 @@ func TestConnectPacket(t *testing.T) {
 		t.Errorf("Connect Packet WillMessage is %s, should be %s", string(cp.WillMessage), "Test Payload")
 	}
 }
+
+//goldenPackets are packets with the exact bytes the broker has always put on the wire
+//for them, checked by hand against the MQTT 3.1.1 spec. Write must produce these bytes and
+//ReadPacket must read them back to a packet with the same fields that writes the same bytes
+//again, so any change to how packets are packed or unpacked has to keep them.
+func goldenPackets() []struct {
+	name   string
+	packet ControlPacket
+	wire   []byte
+} {
+	connect := NewControlPacket(CONNECT).(*ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.CleanSession = true
+	connect.KeepaliveTimer = 30
+	connect.ClientIdentifier = "test"
+
+	//every flag and field set
+	connectFull := NewControlPacket(CONNECT).(*ConnectPacket)
+	connectFull.ProtocolName = "MQTT"
+	connectFull.ProtocolVersion = 4
+	connectFull.CleanSession = true
+	connectFull.KeepaliveTimer = 60
+	connectFull.ClientIdentifier = "client"
+	connectFull.WillFlag, connectFull.WillQos, connectFull.WillRetain = true, 1, true
+	connectFull.WillTopic, connectFull.WillMessage = "will", []byte("gone")
+	connectFull.UsernameFlag, connectFull.Username = true, "user"
+	connectFull.PasswordFlag, connectFull.Password = true, []byte("pw")
+
+	connectNoID := NewControlPacket(CONNECT).(*ConnectPacket)
+	connectNoID.ProtocolName = "MQTT"
+	connectNoID.ProtocolVersion = 4
+	connectNoID.CleanSession = true
+	connectNoID.KeepaliveTimer = 30
+
+	connectEmptyWill := NewControlPacket(CONNECT).(*ConnectPacket)
+	connectEmptyWill.ProtocolName = "MQTT"
+	connectEmptyWill.ProtocolVersion = 4
+	connectEmptyWill.CleanSession = true
+	connectEmptyWill.ClientIdentifier = "c"
+	connectEmptyWill.WillFlag, connectEmptyWill.WillTopic = true, "w"
+
+	connect31 := NewControlPacket(CONNECT).(*ConnectPacket)
+	connect31.ProtocolName = "MQIsdp"
+	connect31.ProtocolVersion = 3
+	connect31.CleanSession = true
+	connect31.KeepaliveTimer = 30
+	connect31.ClientIdentifier = "c"
+
+	connack := NewControlPacket(CONNACK).(*ConnackPacket)
+	connack.ReturnCode = CONN_REF_BAD_PROTO_VER
+	connackSession := NewControlPacket(CONNACK).(*ConnackPacket)
+	connackSession.TopicNameCompression = 1
+
+	publish := NewControlPacket(PUBLISH).(*PublishPacket)
+	publish.Qos = 1
+	publish.Retain = true
+	publish.TopicName = "a/b"
+	publish.MessageID = 10
+	publish.Payload = []byte("hi")
+
+	publish0 := NewControlPacket(PUBLISH).(*PublishPacket)
+	publish0.TopicName = "a"
+	publish0.Payload = []byte("x")
+
+	//a remaining length of 203 takes two bytes
+	publishLong := NewControlPacket(PUBLISH).(*PublishPacket)
+	publishLong.TopicName = "a"
+	publishLong.Payload = bytes.Repeat([]byte{'x'}, 200)
+
+	publishDup := NewControlPacket(PUBLISH).(*PublishPacket)
+	publishDup.Dup = true
+	publishDup.Qos = 2
+	publishDup.TopicName = "a/b"
+	publishDup.MessageID = 0xffff
+
+	//a PUBLISH with a remaining length of length, which is the 3 bytes of its topic and the
+	//payload, and its encoding
+	publishOfLength := func(length int, encoded ...byte) (*PublishPacket, []byte) {
+		pp := NewControlPacket(PUBLISH).(*PublishPacket)
+		pp.TopicName = "a"
+		pp.Payload = bytes.Repeat([]byte{'x'}, length-3)
+		wire := append(append([]byte{0x30}, encoded...), 0x00, 0x01, 'a')
+		return pp, append(wire, pp.Payload...)
+	}
+	publish127, wire127 := publishOfLength(127, 0x7f)
+	publish128, wire128 := publishOfLength(128, 0x80, 0x01)
+	publish16383, wire16383 := publishOfLength(16383, 0xff, 0x7f)
+	publish16384, wire16384 := publishOfLength(16384, 0x80, 0x80, 0x01)
+
+	puback := NewControlPacket(PUBACK).(*PubackPacket)
+	puback.MessageID = 10
+	pubrec := NewControlPacket(PUBREC).(*PubrecPacket)
+	pubrec.MessageID = 10
+	pubrel := NewControlPacket(PUBREL).(*PubrelPacket)
+	pubrel.MessageID = 10
+	pubcomp := NewControlPacket(PUBCOMP).(*PubcompPacket)
+	pubcomp.MessageID = 10
+
+	subscribe := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	subscribe.MessageID = 1
+	subscribe.Topics = []string{"a/#"}
+	subscribe.Qoss = []byte{1}
+	subscribe3 := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	subscribe3.MessageID = 0x1234
+	subscribe3.Topics = []string{"a/b", "c/#", "+/d"}
+	subscribe3.Qoss = []byte{0, 1, 2}
+	suback := NewControlPacket(SUBACK).(*SubackPacket)
+	suback.MessageID = 1
+	suback.GrantedQoss = []byte{1, 0x80}
+	unsubscribe := NewControlPacket(UNSUBSCRIBE).(*UnsubscribePacket)
+	unsubscribe.MessageID = 2
+	unsubscribe.Topics = []string{"a/#"}
+	unsubscribe2 := NewControlPacket(UNSUBSCRIBE).(*UnsubscribePacket)
+	unsubscribe2.MessageID = 0x1234
+	unsubscribe2.Topics = []string{"a/b", "+/d"}
+	unsuback := NewControlPacket(UNSUBACK).(*UnsubackPacket)
+	unsuback.MessageID = 2
+
+	return []struct {
+		name   string
+		packet ControlPacket
+		wire   []byte
+	}{
+		{"CONNECT", connect, []byte{0x10, 0x10, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x1e, 0x00, 0x04, 't', 'e', 's', 't'}},
+		{"CONNECT every field", connectFull, []byte{0x10, 0x28, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0xee, 0x00, 0x3c,
+			0x00, 0x06, 'c', 'l', 'i', 'e', 'n', 't', 0x00, 0x04, 'w', 'i', 'l', 'l', 0x00, 0x04, 'g', 'o', 'n', 'e',
+			0x00, 0x04, 'u', 's', 'e', 'r', 0x00, 0x02, 'p', 'w'}},
+		{"CONNECT empty client id", connectNoID, []byte{0x10, 0x0c, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x1e, 0x00, 0x00}},
+		{"CONNECT empty will message", connectEmptyWill, []byte{0x10, 0x12, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x06, 0x00, 0x00,
+			0x00, 0x01, 'c', 0x00, 0x01, 'w', 0x00, 0x00}},
+		{"CONNECT MQTT 3.1", connect31, []byte{0x10, 0x0f, 0x00, 0x06, 'M', 'Q', 'I', 's', 'd', 'p', 0x03, 0x02, 0x00, 0x1e, 0x00, 0x01, 'c'}},
+		{"CONNACK", connack, []byte{0x20, 0x02, 0x00, 0x01}},
+		{"CONNACK session present", connackSession, []byte{0x20, 0x02, 0x01, 0x00}},
+		{"PUBLISH QoS 1", publish, []byte{0x33, 0x09, 0x00, 0x03, 'a', '/', 'b', 0x00, 0x0a, 'h', 'i'}},
+		{"PUBLISH QoS 0", publish0, []byte{0x30, 0x04, 0x00, 0x01, 'a', 'x'}},
+		{"PUBLISH long", publishLong, append([]byte{0x30, 0xcb, 0x01, 0x00, 0x01, 'a'}, bytes.Repeat([]byte{'x'}, 200)...)},
+		{"PUBLISH QoS 2 dup empty payload", publishDup, []byte{0x3c, 0x07, 0x00, 0x03, 'a', '/', 'b', 0xff, 0xff}},
+		{"PUBLISH remaining length 127", publish127, wire127},
+		{"PUBLISH remaining length 128", publish128, wire128},
+		{"PUBLISH remaining length 16383", publish16383, wire16383},
+		{"PUBLISH remaining length 16384", publish16384, wire16384},
+		{"PUBACK", puback, []byte{0x40, 0x02, 0x00, 0x0a}},
+		{"PUBREC", pubrec, []byte{0x50, 0x02, 0x00, 0x0a}},
+		{"PUBREL", pubrel, []byte{0x62, 0x02, 0x00, 0x0a}},
+		{"PUBCOMP", pubcomp, []byte{0x70, 0x02, 0x00, 0x0a}},
+		{"SUBSCRIBE", subscribe, []byte{0x82, 0x08, 0x00, 0x01, 0x00, 0x03, 'a', '/', '#', 0x01}},
+		{"SUBSCRIBE 3 topics", subscribe3, []byte{0x82, 0x14, 0x12, 0x34, 0x00, 0x03, 'a', '/', 'b', 0x00,
+			0x00, 0x03, 'c', '/', '#', 0x01, 0x00, 0x03, '+', '/', 'd', 0x02}},
+		{"SUBACK", suback, []byte{0x90, 0x04, 0x00, 0x01, 0x01, 0x80}},
+		{"UNSUBSCRIBE", unsubscribe, []byte{0xa2, 0x07, 0x00, 0x02, 0x00, 0x03, 'a', '/', '#'}},
+		{"UNSUBSCRIBE 2 topics", unsubscribe2, []byte{0xa2, 0x0c, 0x12, 0x34, 0x00, 0x03, 'a', '/', 'b', 0x00, 0x03, '+', '/', 'd'}},
+		{"UNSUBACK", unsuback, []byte{0xb0, 0x02, 0x00, 0x02}},
+		{"PINGREQ", NewControlPacket(PINGREQ), []byte{0xc0, 0x00}},
+		{"PINGRESP", NewControlPacket(PINGRESP), []byte{0xd0, 0x00}},
+		{"DISCONNECT", NewControlPacket(DISCONNECT), []byte{0xe0, 0x00}},
+	}
+}
+
+func TestConnectBinaryPassword(t *testing.T) {
+	password := []byte{0x00, 'p', 0xff, 0xfe, 0x00, 0xc3, 0x28}
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.ClientIdentifier = "binary"
+	cp.UsernameFlag, cp.Username = true, "user"
+	cp.PasswordFlag, cp.Password = true, password
+	var b bytes.Buffer
+	cp.Write(&b)
+	packet, err := ReadPacket(&b)
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err.Error())
+	}
+	if received := packet.(*ConnectPacket).Password; !bytes.Equal(received, password) {
+		t.Errorf("Connect Packet Password is %x, should be %x", received, password)
+	}
+	if str := packet.String(); strings.Contains(str, string(password)) || !strings.Contains(str, "Password: [7 bytes]") {
+		t.Errorf("Connect Packet String shows the password: %s", str)
+	}
+}
+
+func TestGoldenBytes(t *testing.T) {
+	for _, golden := range goldenPackets() {
+		var b bytes.Buffer
+		if err := golden.packet.Write(&b); err != nil {
+			t.Errorf("%s: Write failed: %s", golden.name, err.Error())
+			continue
+		}
+		if !bytes.Equal(b.Bytes(), golden.wire) {
+			t.Errorf("%s: wrote % x, should be % x", golden.name, b.Bytes(), golden.wire)
+		}
+
+		read, err := ReadPacket(bytes.NewReader(golden.wire))
+		if err != nil {
+			t.Errorf("%s: ReadPacket failed: %s", golden.name, err.Error())
+			continue
+		}
+		if read.Type() != golden.packet.Type() {
+			t.Errorf("%s: read a %s", golden.name, read.Type())
+			continue
+		}
+		if field := differentField(golden.packet, read); field != "" {
+			t.Errorf("%s: read packet has a different %s", golden.name, field)
+		}
+		b.Reset()
+		read.Write(&b)
+		if !bytes.Equal(b.Bytes(), golden.wire) {
+			t.Errorf("%s: read packet wrote % x, should be % x", golden.name, b.Bytes(), golden.wire)
+		}
+	}
+}
+
+//TestUnpackBody pins the contract between the reader and Unpack: the fixed header is set
+//from the NewControlPacketWithHeader and Unpack is given the body alone, all of which it reads
+func TestUnpackBody(t *testing.T) {
+	for _, golden := range goldenPackets() {
+		read, err := ReadPacket(bytes.NewReader(golden.wire))
+		if err != nil {
+			t.Errorf("%s: ReadPacket failed: %s", golden.name, err.Error())
+			continue
+		}
+		fh := reflect.ValueOf(read).Elem().FieldByName("FixedHeader").Interface().(FixedHeader)
+		body := golden.wire[fh.packetLength()-fh.RemainingLength:]
+		if len(body) != fh.RemainingLength {
+			t.Errorf("%s: has %d bytes after its fixed header, remaining length is %d", golden.name, len(body), fh.RemainingLength)
+			continue
+		}
+		cp := NewControlPacketWithHeader(fh)
+		r := bytes.NewReader(body)
+		if err := cp.Unpack(r); err != nil {
+			t.Errorf("%s: Unpack failed: %s", golden.name, err.Error())
+			continue
+		}
+		if r.Len() != 0 {
+			t.Errorf("%s: Unpack left %d bytes of the body", golden.name, r.Len())
+		}
+		if field := differentField(golden.packet, cp); field != "" {
+			t.Errorf("%s: unpacked packet has a different %s", golden.name, field)
+		}
+	}
+}
+
+//differentField returns the name of the first field that is on the wire that a and b, which
+//are the same type of packet, don't have the same value for. The remaining length is worked
+//out by Write so isn't compared, and an empty slice is the same as a nil one.
+func differentField(a ControlPacket, b ControlPacket) string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		field := va.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		x, y := va.Field(i).Interface(), vb.Field(i).Interface()
+		if fh, ok := x.(FixedHeader); ok {
+			other := y.(FixedHeader)
+			fh.RemainingLength, other.RemainingLength = 0, 0
+			x, y = fh, other
+		}
+		if va.Field(i).Kind() == reflect.Slice && va.Field(i).Len() == 0 && vb.Field(i).Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(x, y) {
+			return field.Name
+		}
+	}
+	return ""
+}
+
+func TestSubscribeMalformed(t *testing.T) {
+	if _, err := ReadPacket(bytes.NewReader([]byte{0x82, 0x05, 0x00, 0x01, 0x00, 0x05, 'a'})); err != ErrMalformedPacket {
+		t.Errorf("reading a SUBSCRIBE whose filter is longer than the packet returned %v", err)
+	}
+	//read from a stream rather than the packet's body, the filter runs into what follows it
+	sp := NewControlPacketWithHeader(FixedHeader{MessageType: SUBSCRIBE, Qos: 1, RemainingLength: 6})
+	if err := sp.Unpack(bytes.NewReader([]byte{0x00, 0x01, 0x00, 0x03, 'a', 'b', 'c', 0x01})); err != ErrMalformedPacket {
+		t.Errorf("unpacking a SUBSCRIBE whose filter runs past its remaining length returned %v", err)
+	}
+}
+
+func TestReadPacketLimit(t *testing.T) {
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "a/b"
+	pp.Payload = make([]byte, 100)
+	var b bytes.Buffer
+	pp.Write(&b)
+	size := b.Len()
+
+	if _, err := ReadPacketLimit(bytes.NewReader(b.Bytes()), size-1); err != ErrPacketTooLarge {
+		t.Errorf("reading a %d byte packet with a limit of %d returned %v", size, size-1, err)
+	}
+	if _, err := ReadPacketLimit(bytes.NewReader(b.Bytes()), size); err != nil {
+		t.Errorf("reading a %d byte packet with a limit of %d failed: %s", size, size, err.Error())
+	}
+}
+
+func TestValidateInbound(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		packet      []byte
+		established bool
+		valid       bool
+	}{
+		{"CONNECT", []byte{0x10, 0x0c, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c, 0x00, 0x00}, false, true},
+		{"second CONNECT", []byte{0x10, 0x0c, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c, 0x00, 0x00}, true, false},
+		{"PINGREQ before CONNECT", []byte{0xc0, 0x00}, false, false},
+		{"PINGREQ", []byte{0xc0, 0x00}, true, true},
+		{"PINGREQ with flags", []byte{0xc1, 0x00}, true, false},
+		{"PUBREL", []byte{0x62, 0x02, 0x00, 0x01}, true, true},
+		{"PUBREL without QoS 1", []byte{0x60, 0x02, 0x00, 0x01}, true, false},
+		{"SUBSCRIBE", []byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x01}, true, true},
+		{"SUBSCRIBE with flags 0", []byte{0x80, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x01}, true, false},
+		{"SUBSCRIBE without topics", []byte{0x82, 0x02, 0x00, 0x01}, true, false},
+		{"SUBSCRIBE for QoS 3", []byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x03}, true, false},
+		{"SUBSCRIBE with option bits", []byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x05}, true, false},
+		{"SUBSCRIBE to an empty filter", []byte{0x82, 0x05, 0x00, 0x01, 0x00, 0x00, 0x01}, true, false},
+		{"UNSUBSCRIBE without topics", []byte{0xa2, 0x02, 0x00, 0x01}, true, false},
+		{"PUBLISH", []byte{0x32, 0x05, 0x00, 0x01, 'a', 0x00, 0x01}, true, true},
+		{"PUBLISH with QoS 3", []byte{0x36, 0x05, 0x00, 0x01, 'a', 0x00, 0x01}, true, false},
+		{"PUBLISH QoS 0 with dup", []byte{0x38, 0x03, 0x00, 0x01, 'a'}, true, false},
+		{"PUBLISH to a wildcard", []byte{0x30, 0x03, 0x00, 0x01, '#'}, true, false},
+		{"CONNACK from a client", []byte{0x20, 0x02, 0x00, 0x00}, true, false},
+	} {
+		cp, err := ReadPacket(bytes.NewReader(test.packet))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+		if err = ValidateInbound(cp, test.established); (err == nil) != test.valid {
+			t.Errorf("%s: ValidateInbound returned %v", test.name, err)
+		}
+	}
+}
+
+func TestTopicLimits(t *testing.T) {
+	limits := TopicLimits{MaxLevels: 3, MaxLevelLength: 4, MaxLength: 12}
+	for _, test := range []struct {
+		topic string
+		valid bool
+	}{
+		{"a/b/c", true},
+		{"a/b/c/d", false},
+		{"a//", true},
+		{"///", false},
+		{"abcd/efgh", true},
+		{"abcde/f", false},
+		{"a/abcde", false},
+		{"abcd/abcd/ab", true},
+		{"abcd/abcd/abc", false},
+		{strings.Repeat("a/", 100000), false},
+	} {
+		if err := limits.Check(test.topic); (err == nil) != test.valid {
+			t.Errorf("%.20s: Check returned %v", test.topic, err)
+		}
+	}
+	if err := (TopicLimits{}).Check(strings.Repeat("a/", 100000)); err != nil {
+		t.Errorf("no limits returned %v", err)
+	}
+
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.Topics = []string{"a/b", "a/b/c/d"}
+	if err := ValidateTopicLimits(sp, limits); err == nil {
+		t.Errorf("SUBSCRIBE with a filter over the limits is valid")
+	}
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.WillTopic = "a/b/c/d"
+	if err := ValidateTopicLimits(cp, limits); err != nil {
+		t.Errorf("CONNECT without a will returned %v", err)
+	}
+	cp.WillFlag = true
+	if err := ValidateTopicLimits(cp, limits); err == nil {
+		t.Errorf("CONNECT with a will topic over the limits is valid")
+	}
+}
+
+func TestFixInbound(t *testing.T) {
+	all := []Fixup{FixReservedFlags, FixProtocolName, FixKeepaliveByteOrder, FixQos0Dup, FixSubscribeOptions}
+	for _, test := range []struct {
+		name   string
+		packet []byte
+		fixups []Fixup
+		fixed  []Fixup
+	}{
+		{"CONNECT", []byte{0x10, 0x0c, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c, 0x00, 0x00}, all, nil},
+		{"CONNECT with MQIsdp and a space", []byte{0x10, 0x0f, 0x00, 0x07, 'M', 'Q', 'I', 's', 'd', 'p', ' ', 0x03, 0x02, 0x00, 0x3c, 0x00, 0x00}, all, []Fixup{FixProtocolName}},
+		{"CONNECT with a little endian keepalive", []byte{0x10, 0x0c, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x3c, 0x00, 0x00, 0x00}, all, []Fixup{FixKeepaliveByteOrder}},
+		{"CONNECT with the reserved flag", []byte{0x10, 0x0c, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x03, 0x00, 0x3c, 0x00, 0x00}, all, []Fixup{FixReservedFlags}},
+		{"PINGREQ with flags", []byte{0xc1, 0x00}, all, []Fixup{FixReservedFlags}},
+		{"PUBREL without QoS 1", []byte{0x60, 0x02, 0x00, 0x01}, all, []Fixup{FixReservedFlags}},
+		{"PUBREL without QoS 1 not fixed", []byte{0x60, 0x02, 0x00, 0x01}, []Fixup{FixQos0Dup}, nil},
+		{"PUBLISH QoS 0 with dup", []byte{0x38, 0x03, 0x00, 0x01, 'a'}, all, []Fixup{FixQos0Dup}},
+		{"SUBSCRIBE with option bits", []byte{0x82, 0x0a, 0x00, 0x01, 0x00, 0x01, 'a', 0x2d, 0x00, 0x01, 'b', 0x01}, all, []Fixup{FixSubscribeOptions}},
+	} {
+		cp, err := ReadPacket(bytes.NewReader(test.packet))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+		if fixed := FixInbound(cp, test.fixups); !reflect.DeepEqual(fixed, test.fixed) {
+			t.Errorf("%s: FixInbound fixed %v, should be %v", test.name, fixed, test.fixed)
+		}
+		if err = ValidateInbound(cp, cp.Type() != CONNECT); (err == nil) != (len(test.fixed) > 0 || test.name == "CONNECT") {
+			t.Errorf("%s: ValidateInbound returned %v after fixing", test.name, err)
+		}
+		if c, ok := cp.(*ConnectPacket); ok && (c.Validate() != CONN_ACCEPTED || c.KeepaliveTimer != 60) {
+			t.Errorf("%s: fixed CONNECT returned %d with keepalive %d", test.name, c.Validate(), c.KeepaliveTimer)
+		}
+		if s, ok := cp.(*SubscribePacket); ok && !bytes.Equal(s.Qoss, []byte{1, 1}) {
+			t.Errorf("%s: fixed SUBSCRIBE requests QoS %v, should be [1 1]", test.name, s.Qoss)
+		}
+	}
+	if fixup, ok := ParseFixup("qos0-dup"); !ok || fixup != FixQos0Dup {
+		t.Errorf("ParseFixup returned %v, %v", fixup, ok)
+	}
+}
+
+func TestPublishWriters(t *testing.T) {
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "a/b"
+	pp.Qos = 1
+	pp.MessageID = 7
+	pp.Payload = []byte("payload")
+	var packed bytes.Buffer
+	pp.Write(&packed)
+	//a copy shares the encoded topic, which mustn't be used once its topic is changed
+	copied := pp.Copy()
+	copied.Qos, copied.MessageID = 1, 7
+	copied.TopicName = "c/d"
+
+	var buffered bytes.Buffer
+	w := bufio.NewWriter(&buffered)
+	pp.Write(w)
+	w.Flush()
+	server, client := net.Pipe()
+	go func() {
+		pp.Write(server)
+		copied.Write(server)
+		server.Close()
+	}()
+	vectored, _ := ioutil.ReadAll(client)
+	if !bytes.Equal(buffered.Bytes(), packed.Bytes()) || !bytes.HasPrefix(vectored, packed.Bytes()) {
+		t.Fatalf("PUBLISH written differently:\npacked   %x\nbuffered %x\nvectored %x", packed.Bytes(), buffered.Bytes(), vectored)
+	}
+	cp, err := ReadPacket(bytes.NewReader(vectored[packed.Len():]))
+	if err != nil || cp.(*PublishPacket).TopicName != "c/d" {
+		t.Errorf("copy with a new topic was read back as %v %v", cp, err)
+	}
+}
+
+func benchmarkPublishWrite(b *testing.B, size int) {
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.Qos = 1
+	pp.MessageID = 1
+	pp.TopicName = "sensors/building1/floor2/temperature"
+	pp.Payload = make([]byte, size)
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	for i := 0; i < b.N; i++ {
+		pp.Write(ioutil.Discard)
+	}
+}
+
+func BenchmarkPublishWrite64B(b *testing.B) {
+	benchmarkPublishWrite(b, 64)
+}
+
+func BenchmarkPublishWrite1KB(b *testing.B) {
+	benchmarkPublishWrite(b, 1024)
+}
+
+func BenchmarkPublishWrite64KB(b *testing.B) {
+	benchmarkPublishWrite(b, 64*1024)
+}
+
+func TestRemainingLengthTooLarge(t *testing.T) {
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "a/b"
+	//the largest payload a QoS 0 message can have, the message id of a QoS 1 one takes it over.
+	//The payload is never read so its pages aren't touched.
+	pp.Payload = make([]byte, MaxRemainingLength-2-len(pp.TopicName))
+	pp.Qos = 1
+	pp.MessageID = 1
+	var packed bytes.Buffer
+	buffered := bufio.NewWriter(ioutil.Discard)
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	for _, w := range []io.Writer{&packed, buffered, server} {
+		if err := pp.Write(w); err != ErrRemainingLengthTooLarge {
+			t.Errorf("writing to %T returned %v, should be ErrRemainingLengthTooLarge", w, err)
+		}
+	}
+	if packed.Len() > 0 || buffered.Buffered() > 0 {
+		t.Errorf("%d and %d bytes were written for a packet that can't be encoded", packed.Len(), buffered.Buffered())
+	}
+
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.WillFlag = true
+	cp.WillTopic = "will"
+	cp.WillMessage = make([]byte, MaxRemainingLength)
+	if err := cp.Write(&packed); err != ErrRemainingLengthTooLarge || packed.Len() > 0 {
+		t.Errorf("writing a CONNECT with an oversized will returned %v", err)
+	}
+}
+
+func TestFieldTooLong(t *testing.T) {
+	long := strings.Repeat("a", MaxFieldLength+1)
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = long
+	pp.Payload = []byte("payload")
+	var packed bytes.Buffer
+	buffered := bufio.NewWriter(ioutil.Discard)
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	for _, w := range []io.Writer{&packed, buffered, server} {
+		if err := pp.Write(w); err != ErrFieldTooLong {
+			t.Errorf("writing to %T returned %v, should be ErrFieldTooLong", w, err)
+		}
+	}
+	if packed.Len() > 0 || buffered.Buffered() > 0 {
+		t.Errorf("%d and %d bytes were written for a topic that can't be encoded", packed.Len(), buffered.Buffered())
+	}
+	//the longest field can still be written
+	pp.TopicName = long[1:]
+	if err := pp.Write(&packed); err != nil {
+		t.Errorf("writing a topic of MaxFieldLength returned %v", err)
+	}
+	packed.Reset()
+
+	cp := NewControlPacket(CONNECT).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.ClientIdentifier = "client"
+	cp.PasswordFlag = true
+	cp.Password = []byte(long)
+	sp := NewControlPacket(SUBSCRIBE).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"a/b", long}
+	sp.Qoss = []byte{0, 1}
+	up := NewControlPacket(UNSUBSCRIBE).(*UnsubscribePacket)
+	up.MessageID = 1
+	up.Topics = []string{long}
+	for _, cp := range []ControlPacket{cp, sp, up} {
+		if err := cp.Write(&packed); err != ErrFieldTooLong || packed.Len() > 0 {
+			t.Errorf("writing a %s with a field over MaxFieldLength returned %v", cp.Type(), err)
+		}
+	}
+}
+
+func TestReaderReusesBuffers(t *testing.T) {
+	var stream bytes.Buffer
+	for _, payload := range []string{"first", "second", "third"} {
+		pp := NewControlPacket(PUBLISH).(*PublishPacket)
+		pp.Qos = 1
+		pp.MessageID = 1
+		pp.TopicName = "a/" + payload
+		pp.Payload = []byte(payload)
+		pp.Write(&stream)
+	}
+	reader := NewReader(&stream)
+	var read []*PublishPacket
+	for i := 0; i < 3; i++ {
+		cp, err := reader.ReadPacket(0)
+		if err != nil {
+			t.Fatalf("failed to read packet %d: %s", i, err.Error())
+		}
+		read = append(read, cp.(*PublishPacket))
+	}
+	//each packet was read into the same pooled buffer, the ones read earlier must be unchanged
+	for i, payload := range []string{"first", "second", "third"} {
+		if string(read[i].Payload) != payload || read[i].TopicName != "a/"+payload || string(read[i].encodedTopic()[2:]) != "a/"+payload {
+			t.Errorf("packet %d has topic %s and payload %s, should be a/%s and %s", i, read[i].TopicName, read[i].Payload, payload, payload)
+		}
+	}
+	if _, err := reader.ReadPacket(0); err != io.EOF {
+		t.Errorf("reading past the end returned %v, should be EOF", err)
+	}
+}
+
+//BenchmarkReadPublish reads a stream of 64 byte QoS 0 PUBLISHes from one connection, as the
+//broker does for each client
+func BenchmarkReadPublish(b *testing.B) {
+	pp := NewControlPacket(PUBLISH).(*PublishPacket)
+	pp.TopicName = "sensors/building1/floor2/temperature"
+	pp.Payload = make([]byte, 64)
+	var packet bytes.Buffer
+	pp.Write(&packet)
+	stream := bytes.Repeat(packet.Bytes(), 1000)
+	r := bytes.NewReader(stream)
+	reader := NewReader(r)
+	b.ReportAllocs()
+	b.SetBytes(int64(packet.Len()))
+	for i := 0; i < b.N; i++ {
+		if r.Len() == 0 {
+			r.Reset(stream)
+		}
+		if _, err := reader.ReadPacket(0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
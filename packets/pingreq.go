@@ -19,13 +19,14 @@ func (pr *PingreqPacket) String() string {
 }
 
 func (pr *PingreqPacket) Write(w io.Writer) error {
-	packet := pr.FixedHeader.pack()
-	_, err := packet.WriteTo(w)
+	pr.FixedHeader.RemainingLength = 0
+	_, err := w.Write(pr.FixedHeader.appendTo(make([]byte, 0, pr.FixedHeader.packetLength())))
 
 	return err
 }
 
-func (pr *PingreqPacket) Unpack(b io.Reader) {
+func (pr *PingreqPacket) Unpack(b io.Reader) error {
+	return nil
 }
 
 func (pr *PingreqPacket) Details() Details {
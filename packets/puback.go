@@ -21,17 +21,19 @@ func (pa *PubackPacket) String() string {
 }
 
 func (pa *PubackPacket) Write(w io.Writer) error {
-	var err error
 	pa.FixedHeader.RemainingLength = 2
-	packet := pa.FixedHeader.pack()
-	packet.Write(encodeUint16(pa.MessageID))
-	_, err = packet.WriteTo(w)
+	packet := make([]byte, 0, pa.FixedHeader.packetLength())
+	packet = pa.FixedHeader.appendTo(packet)
+	packet = appendUint16(packet, pa.MessageID)
+	_, err := w.Write(packet)
 
 	return err
 }
 
-func (pa *PubackPacket) Unpack(b io.Reader) {
-	pa.MessageID = decodeUint16(b)
+func (pa *PubackPacket) Unpack(b io.Reader) error {
+	var err error
+	pa.MessageID, err = decodeUint16(b)
+	return err
 }
 
 func (pa *PubackPacket) Details() Details {
@@ -21,17 +21,19 @@ func (pc *PubcompPacket) String() string {
 }
 
 func (pc *PubcompPacket) Write(w io.Writer) error {
-	var err error
 	pc.FixedHeader.RemainingLength = 2
-	packet := pc.FixedHeader.pack()
-	packet.Write(encodeUint16(pc.MessageID))
-	_, err = packet.WriteTo(w)
+	packet := make([]byte, 0, pc.FixedHeader.packetLength())
+	packet = pc.FixedHeader.appendTo(packet)
+	packet = appendUint16(packet, pc.MessageID)
+	_, err := w.Write(packet)
 
 	return err
 }
 
-func (pc *PubcompPacket) Unpack(b io.Reader) {
-	pc.MessageID = decodeUint16(b)
+func (pc *PubcompPacket) Unpack(b io.Reader) error {
+	var err error
+	pc.MessageID, err = decodeUint16(b)
+	return err
 }
 
 func (pc *PubcompPacket) Details() Details {
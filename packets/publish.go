@@ -5,16 +5,41 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"io"
+	"net"
+	"time"
 )
 
 //PUBLISH packet
 
+//PublishPacket is a PUBLISH. Its Payload is shared with the copies made by Copy and can be
+//written by several clients at once, so it must not be changed once the packet has been
+//copied or delivered. Unpack copies the topic and payload out of the buffer the packet is
+//read from, which a Reader reuses for the next packet, so an unpacked PUBLISH owns its Payload.
 type PublishPacket struct {
 	FixedHeader
 	TopicName string
 	MessageID uint16
 	Payload   []byte
+	//Hops is how many bridges the message has crossed to reach a server. It isn't part of the
+	//packet on the wire and is kept by Copy.
+	Hops int
+	//Properties are the message's MQTT 5 properties, nil if it has none. MQTT 3.1.1 has no
+	//properties so they aren't part of the packet on the wire, a server keeps them with the
+	//message. They are shared with the copies made by Copy and can't be changed.
+	Properties *Properties
+	//ExpiresAt is when a server drops the message if it hasn't been delivered, zero is never.
+	//It isn't part of the packet on the wire and is kept by Copy.
+	ExpiresAt time.Time
+	//ReceivedAt is when a server received the message from its publisher, zero if it hasn't
+	//been. It isn't part of the packet on the wire and is kept by Copy.
+	ReceivedAt time.Time
+	//Publisher is the client id of the client that published the message, empty if a server
+	//published it. It isn't part of the packet on the wire and is kept by Copy.
+	Publisher string
 	uuid      uuid.UUID
+	//topicField is TopicName encoded with its length, shared with the packet's copies so a
+	//message delivered to many clients only encodes it once
+	topicField []byte
 }
 
 func (p *PublishPacket) String() string {
@@ -24,40 +49,149 @@ func (p *PublishPacket) String() string {
 	return str
 }
 
+//Write writes the PUBLISH without packing it into a buffer of its own when it can. A network
+//connection is given the fixed header, topic name, message id and payload as net.Buffers,
+//which a TCP connection writes with one vectored write, and a buffered writer, such as the
+//bufio.Writer each client's packets are written through, has them copied straight in. Write
+//doesn't change the packet, so one PUBLISH can be written to several clients at once.
 func (p *PublishPacket) Write(w io.Writer) error {
-	var body bytes.Buffer
-	var err error
-
-	body.Write(encodeString(p.TopicName))
+	fh := p.FixedHeader
+	fh.RemainingLength = 2 + len(p.TopicName) + len(p.Payload)
 	if p.Qos > 0 {
-		body.Write(encodeUint16(p.MessageID))
+		fh.RemainingLength += 2
 	}
-	p.FixedHeader.RemainingLength = body.Len() + len(p.Payload)
-	packet := p.FixedHeader.pack()
-	packet.Write(body.Bytes())
-	packet.Write(p.Payload)
-	_, err = w.Write(packet.Bytes())
-
+	if err := fh.checkLength(); err != nil {
+		return err
+	}
+	if err := checkFields(len(p.TopicName)); err != nil {
+		return err
+	}
+	switch w := w.(type) {
+	case net.Conn:
+		//the fixed header is at most 5 bytes followed by 2 for the message id
+		header := fh.appendTo(make([]byte, 0, 7))
+		buffers := make(net.Buffers, 2, 4)
+		buffers[0], buffers[1] = header, p.encodedTopic()
+		if p.Qos > 0 {
+			buffers = append(buffers, appendUint16(header[len(header):], p.MessageID))
+		}
+		if len(p.Payload) > 0 {
+			buffers = append(buffers, p.Payload)
+		}
+		_, err := buffers.WriteTo(w)
+		return err
+	case bufferedWriter:
+		var header [5]byte
+		for _, b := range fh.appendTo(header[:0]) {
+			w.WriteByte(b)
+		}
+		w.WriteByte(byte(len(p.TopicName) >> 8))
+		w.WriteByte(byte(len(p.TopicName)))
+		w.WriteString(p.TopicName)
+		if p.Qos > 0 {
+			w.WriteByte(byte(p.MessageID >> 8))
+			w.WriteByte(byte(p.MessageID))
+		}
+		_, err := w.Write(p.Payload)
+		return err
+	}
+	packet := make([]byte, 0, fh.packetLength())
+	packet = fh.appendTo(packet)
+	packet = appendField(packet, p.TopicName)
+	if p.Qos > 0 {
+		packet = appendUint16(packet, p.MessageID)
+	}
+	packet = append(packet, p.Payload...)
+	_, err := w.Write(packet)
 	return err
 }
 
-func (p *PublishPacket) Unpack(b io.Reader) {
+//bufferedWriter is a writer that copies what it is given into a buffer, like bufio.Writer,
+//an error writing to it is returned by its next Write
+type bufferedWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+	Buffered() int
+}
+
+//encodedTopic returns topicField if it is still the encoding of TopicName, which can be
+//changed after the packet was copied or unpacked, otherwise it encodes TopicName
+func (p *PublishPacket) encodedTopic() []byte {
+	if len(p.topicField) == 2+len(p.TopicName) && string(p.topicField[2:]) == p.TopicName {
+		return p.topicField
+	}
+	return appendField(nil, p.TopicName)
+}
+
+func (p *PublishPacket) Unpack(b io.Reader) error {
 	var payloadLength = p.FixedHeader.RemainingLength
-	p.TopicName = decodeString(b)
+	var err error
+	//the rest of a body in a buffer is copied with one allocation, which the encoded topic and
+	//payload share
+	buffer, buffered := b.(*bytes.Buffer)
+	var raw []byte
+	if buffered {
+		raw = bytes.Clone(buffer.Bytes())
+	}
+	if p.TopicName, err = decodeString(b); err != nil {
+		return err
+	}
+	if buffered {
+		p.topicField = raw[:2+len(p.TopicName)]
+	}
 	if p.Qos > 0 {
-		p.MessageID = decodeUint16(b)
+		if p.MessageID, err = decodeUint16(b); err != nil {
+			return err
+		}
 		payloadLength -= len(p.TopicName) + 4
 	} else {
 		payloadLength -= len(p.TopicName) + 2
 	}
+	if payloadLength < 0 {
+		return ErrMalformedPacket
+	}
+	if buffered {
+		if buffer.Len() < payloadLength {
+			return ErrMalformedPacket
+		}
+		offset := len(raw) - buffer.Len()
+		p.Payload = raw[offset : offset+payloadLength]
+		buffer.Next(payloadLength)
+		return nil
+	}
 	p.Payload = make([]byte, payloadLength)
-	b.Read(p.Payload)
+	return readFull(b, p.Payload)
+}
+
+//Properties are the MQTT 5 properties of a PUBLISH that are for the applications exchanging
+//the message, such as the response topic and correlation data of a request
+type Properties struct {
+	ContentType     string         `json:"contentType,omitempty"`
+	ResponseTopic   string         `json:"responseTopic,omitempty"`
+	CorrelationData []byte         `json:"correlationData,omitempty"`
+	UserProperties  []UserProperty `json:"userProperties,omitempty"`
+}
+
+//UserProperty is one of the name and value pairs of a message's user properties, a name
+//can appear more than once
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
 }
 
+//Copy returns a new PUBLISH with the same topic and payload for delivering to another
+//client, sharing the payload and encoded topic with p
 func (p *PublishPacket) Copy() *PublishPacket {
 	newP := NewControlPacket(PUBLISH).(*PublishPacket)
 	newP.TopicName = p.TopicName
 	newP.Payload = p.Payload
+	newP.ExpiresAt = p.ExpiresAt
+	newP.ReceivedAt = p.ReceivedAt
+	newP.Publisher = p.Publisher
+	newP.Hops = p.Hops
+	newP.Properties = p.Properties
+	newP.topicField = p.encodedTopic()
 
 	return newP
 }
@@ -21,17 +21,19 @@ func (pr *PubrelPacket) String() string {
 }
 
 func (pr *PubrelPacket) Write(w io.Writer) error {
-	var err error
 	pr.FixedHeader.RemainingLength = 2
-	packet := pr.FixedHeader.pack()
-	packet.Write(encodeUint16(pr.MessageID))
-	_, err = packet.WriteTo(w)
+	packet := make([]byte, 0, pr.FixedHeader.packetLength())
+	packet = pr.FixedHeader.appendTo(packet)
+	packet = appendUint16(packet, pr.MessageID)
+	_, err := w.Write(packet)
 
 	return err
 }
 
-func (pr *PubrelPacket) Unpack(b io.Reader) {
-	pr.MessageID = decodeUint16(b)
+func (pr *PubrelPacket) Unpack(b io.Reader) error {
+	var err error
+	pr.MessageID, err = decodeUint16(b)
+	return err
 }
 
 func (pr *PubrelPacket) Details() Details {
@@ -0,0 +1,91 @@
+package packets
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+//readBufferSizes are the sizes of the pooled buffers packet bodies are read into, a body
+//larger than the largest size is read into a buffer of its own
+var readBufferSizes = [...]int{256, 2048, 16384, 131072}
+
+var readBuffers [len(readBufferSizes)]sync.Pool
+
+//readBuffer is a buffer a packet body is read into and the bytes.Buffer it is unpacked
+//from, kept together so that neither is allocated for each packet
+type readBuffer struct {
+	data []byte
+	body bytes.Buffer
+}
+
+//getReadBuffer returns a buffer of at least size bytes, from the pool for its size
+func getReadBuffer(size int) *readBuffer {
+	for i, max := range readBufferSizes {
+		if size <= max {
+			if rb, ok := readBuffers[i].Get().(*readBuffer); ok {
+				return rb
+			}
+			return &readBuffer{data: make([]byte, max)}
+		}
+	}
+	return &readBuffer{data: make([]byte, size)}
+}
+
+//putReadBuffer returns rb to its pool, a buffer larger than the pooled sizes is dropped
+func putReadBuffer(rb *readBuffer) {
+	rb.body.Reset()
+	for i, max := range readBufferSizes {
+		if len(rb.data) == max {
+			readBuffers[i].Put(rb)
+			return
+		}
+	}
+}
+
+//Reader reads packets from a connection. Most clients are idle most of the time, so rather
+//than buffering the connection it reads the fixed header into an array of its own and each
+//body into a pooled buffer that is reused once the packet is unpacked. Unpack copies out
+//every field it keeps, so a packet never refers to the buffer it was read from.
+type Reader struct {
+	r io.Reader
+	//header holds each byte of the fixed header as it is read
+	header [1]byte
+}
+
+//NewReader returns a Reader for the packets read from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+//ReadPacket reads the next packet, if the packet including its fixed header is larger than
+//maxSize bytes it returns ErrPacketTooLarge without reading the rest of it. A maxSize of 0
+//means no limit.
+func (pr *Reader) ReadPacket(maxSize int) (ControlPacket, error) {
+	var fh FixedHeader
+	if _, err := io.ReadFull(pr.r, pr.header[:]); err != nil {
+		return nil, err
+	}
+	if err := fh.unpackLength(pr.header[0], pr.r, pr.header[:]); err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && fh.packetLength() > maxSize {
+		return nil, ErrPacketTooLarge
+	}
+	cp := NewControlPacketWithHeader(fh)
+	rb := getReadBuffer(fh.RemainingLength)
+	defer putReadBuffer(rb)
+	data := rb.data[:fh.RemainingLength]
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return nil, err
+	}
+	rb.body = *bytes.NewBuffer(data)
+	if err := cp.Unpack(&rb.body); err != nil {
+		return nil, err
+	}
+	//anything left over means the remaining length was wrong
+	if rb.body.Len() > 0 {
+		return nil, ErrMalformedPacket
+	}
+	return cp, nil
+}
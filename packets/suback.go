@@ -23,23 +23,30 @@ func (sa *SubackPacket) String() string {
 }
 
 func (sa *SubackPacket) Write(w io.Writer) error {
-	var body bytes.Buffer
-	var err error
-	body.Write(encodeUint16(sa.MessageID))
-	body.Write(sa.GrantedQoss)
-	sa.FixedHeader.RemainingLength = body.Len()
-	packet := sa.FixedHeader.pack()
-	packet.Write(body.Bytes())
-	_, err = packet.WriteTo(w)
+	sa.FixedHeader.RemainingLength = 2 + len(sa.GrantedQoss)
+	if err := sa.FixedHeader.checkLength(); err != nil {
+		return err
+	}
+	packet := make([]byte, 0, sa.FixedHeader.packetLength())
+	packet = sa.FixedHeader.appendTo(packet)
+	packet = appendUint16(packet, sa.MessageID)
+	packet = append(packet, sa.GrantedQoss...)
+	_, err := w.Write(packet)
 
 	return err
 }
 
-func (sa *SubackPacket) Unpack(b io.Reader) {
+func (sa *SubackPacket) Unpack(b io.Reader) error {
 	var qosBuffer bytes.Buffer
-	sa.MessageID = decodeUint16(b)
-	qosBuffer.ReadFrom(b)
+	var err error
+	if sa.MessageID, err = decodeUint16(b); err != nil {
+		return err
+	}
+	if _, err = qosBuffer.ReadFrom(b); err != nil {
+		return err
+	}
 	sa.GrantedQoss = qosBuffer.Bytes()
+	return nil
 }
 
 func (sa *SubackPacket) Details() Details {
@@ -1,7 +1,6 @@
 package packets
 
 import (
-	"bytes"
 	"fmt"
 	"github.com/google/uuid"
 	"io"
@@ -24,32 +23,54 @@ func (s *SubscribePacket) String() string {
 }
 
 func (s *SubscribePacket) Write(w io.Writer) error {
-	var body bytes.Buffer
-	var err error
-
-	body.Write(encodeUint16(s.MessageID))
+	s.FixedHeader.RemainingLength = 2
+	for _, topic := range s.Topics {
+		s.FixedHeader.RemainingLength += 2 + len(topic) + 1
+	}
+	if err := s.FixedHeader.checkLength(); err != nil {
+		return err
+	}
+	for _, topic := range s.Topics {
+		if err := checkFields(len(topic)); err != nil {
+			return err
+		}
+	}
+	packet := make([]byte, 0, s.FixedHeader.packetLength())
+	packet = s.FixedHeader.appendTo(packet)
+	packet = appendUint16(packet, s.MessageID)
 	for i, topic := range s.Topics {
-		body.Write(encodeString(topic))
-		body.WriteByte(s.Qoss[i])
+		packet = appendField(packet, topic)
+		packet = append(packet, s.Qoss[i])
 	}
-	s.FixedHeader.RemainingLength = body.Len()
-	packet := s.FixedHeader.pack()
-	packet.Write(body.Bytes())
-	_, err = packet.WriteTo(w)
+	_, err := w.Write(packet)
 
 	return err
 }
 
-func (s *SubscribePacket) Unpack(b io.Reader) {
-	s.MessageID = decodeUint16(b)
+func (s *SubscribePacket) Unpack(b io.Reader) error {
+	var err error
+	if s.MessageID, err = decodeUint16(b); err != nil {
+		return err
+	}
 	payloadLength := s.FixedHeader.RemainingLength - 2
 	for payloadLength > 0 {
-		topic := decodeString(b)
+		topic, err := decodeString(b)
+		if err != nil {
+			return err
+		}
 		s.Topics = append(s.Topics, topic)
-		qos := decodeByte(b)
+		qos, err := decodeByte(b)
+		if err != nil {
+			return err
+		}
 		s.Qoss = append(s.Qoss, qos)
 		payloadLength -= 2 + len(topic) + 1 //2 bytes of string length, plus string, plus 1 byte for Qos
 	}
+	//a filter that runs past the remaining length isn't one the client sent
+	if payloadLength < 0 {
+		return ErrMalformedPacket
+	}
+	return nil
 }
 
 func (s *SubscribePacket) Details() Details {
@@ -21,17 +21,19 @@ func (ua *UnsubackPacket) String() string {
 }
 
 func (ua *UnsubackPacket) Write(w io.Writer) error {
-	var err error
 	ua.FixedHeader.RemainingLength = 2
-	packet := ua.FixedHeader.pack()
-	packet.Write(encodeUint16(ua.MessageID))
-	_, err = packet.WriteTo(w)
+	packet := make([]byte, 0, ua.FixedHeader.packetLength())
+	packet = ua.FixedHeader.appendTo(packet)
+	packet = appendUint16(packet, ua.MessageID)
+	_, err := w.Write(packet)
 
 	return err
 }
 
-func (ua *UnsubackPacket) Unpack(b io.Reader) {
-	ua.MessageID = decodeUint16(b)
+func (ua *UnsubackPacket) Unpack(b io.Reader) error {
+	var err error
+	ua.MessageID, err = decodeUint16(b)
+	return err
 }
 
 func (ua *UnsubackPacket) Details() Details {
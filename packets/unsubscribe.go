@@ -1,7 +1,6 @@
 package packets
 
 import (
-	"bytes"
 	"fmt"
 	"github.com/google/uuid"
 	"io"
@@ -23,26 +22,44 @@ func (u *UnsubscribePacket) String() string {
 }
 
 func (u *UnsubscribePacket) Write(w io.Writer) error {
-	var body bytes.Buffer
-	var err error
-	body.Write(encodeUint16(u.MessageID))
+	u.FixedHeader.RemainingLength = 2
+	for _, topic := range u.Topics {
+		u.FixedHeader.RemainingLength += 2 + len(topic)
+	}
+	if err := u.FixedHeader.checkLength(); err != nil {
+		return err
+	}
 	for _, topic := range u.Topics {
-		body.Write(encodeString(topic))
+		if err := checkFields(len(topic)); err != nil {
+			return err
+		}
 	}
-	u.FixedHeader.RemainingLength = body.Len()
-	packet := u.FixedHeader.pack()
-	packet.Write(body.Bytes())
-	_, err = packet.WriteTo(w)
+	packet := make([]byte, 0, u.FixedHeader.packetLength())
+	packet = u.FixedHeader.appendTo(packet)
+	packet = appendUint16(packet, u.MessageID)
+	for _, topic := range u.Topics {
+		packet = appendField(packet, topic)
+	}
+	_, err := w.Write(packet)
 
 	return err
 }
 
-func (u *UnsubscribePacket) Unpack(b io.Reader) {
-	u.MessageID = decodeUint16(b)
-	var topic string
-	for topic = decodeString(b); topic != ""; topic = decodeString(b) {
+func (u *UnsubscribePacket) Unpack(b io.Reader) error {
+	var err error
+	if u.MessageID, err = decodeUint16(b); err != nil {
+		return err
+	}
+	payloadLength := u.FixedHeader.RemainingLength - 2
+	for payloadLength > 0 {
+		topic, err := decodeString(b)
+		if err != nil {
+			return err
+		}
 		u.Topics = append(u.Topics, topic)
+		payloadLength -= 2 + len(topic)
 	}
+	return nil
 }
 
 func (u *UnsubscribePacket) Details() Details {
@@ -0,0 +1,168 @@
+package packets
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//requiredFlags are the flag bits, the low 4 bits of the fixed header, MQTT 3.1.1 requires
+//for each packet type a client sends other than PUBLISH, whose flags are its dup, QoS and
+//retain. A packet type missing from here is one only a server sends.
+var requiredFlags = map[PacketType]byte{
+	CONNECT:     0x00,
+	PUBACK:      0x00,
+	PUBREC:      0x00,
+	PUBREL:      0x02,
+	PUBCOMP:     0x00,
+	SUBSCRIBE:   0x02,
+	UNSUBSCRIBE: 0x02,
+	PINGREQ:     0x00,
+	DISCONNECT:  0x00,
+}
+
+//subscribeQosMask is the bits of a SUBSCRIBE's requested QoS byte that are the QoS, MQTT 3.1.1
+//reserves the rest and requires them to be 0
+const subscribeQosMask = 0x03
+
+//flags packs the dup, QoS and retain of the fixed header as they were on the wire
+func (fh FixedHeader) flags() byte {
+	return boolToByte(fh.Dup)<<3 | fh.Qos<<1 | boolToByte(fh.Retain)
+}
+
+//ValidateInbound checks a packet a server received from a client against the rules of the
+//MQTT 3.1.1 spec that ReadPacket doesn't, returning an error naming the rule that was
+//broken. sessionEstablished is whether the client's CONNECT has been accepted, the first
+//packet has to be a CONNECT and there can't be another. A server has to close the
+//connection of a client that breaks these rules.
+func ValidateInbound(cp ControlPacket, sessionEstablished bool) error {
+	if cp.Type() == CONNECT && sessionEstablished {
+		return errors.New("Second CONNECT on a connection")
+	}
+	if cp.Type() != CONNECT && !sessionEstablished {
+		return fmt.Errorf("%s before CONNECT", cp.Type())
+	}
+	flags := cp.(interface{ flags() byte }).flags()
+	if cp.Type() != PUBLISH {
+		required, ok := requiredFlags[cp.Type()]
+		if !ok {
+			return fmt.Errorf("%s can only be sent by a server", cp.Type())
+		}
+		if flags != required {
+			return fmt.Errorf("%s has fixed header flags %04b, they must be %04b", cp.Type(), flags, required)
+		}
+	}
+	switch p := cp.(type) {
+	case *PublishPacket:
+		switch {
+		case p.Qos > 2:
+			return errors.New("PUBLISH has QoS 3")
+		case p.Qos == 0 && p.Dup:
+			return errors.New("PUBLISH has QoS 0 with the dup flag set")
+		case p.Qos > 0 && p.MessageID == 0:
+			return errors.New("PUBLISH has QoS > 0 and message id 0")
+		case len(p.TopicName) == 0:
+			return errors.New("PUBLISH has an empty topic name")
+		case strings.ContainsAny(p.TopicName, "+#"):
+			return errors.New("PUBLISH topic name contains a wildcard")
+		}
+	case *SubscribePacket:
+		if len(p.Topics) == 0 {
+			return errors.New("SUBSCRIBE has no topic filters")
+		}
+		if p.MessageID == 0 {
+			return errors.New("SUBSCRIBE has message id 0")
+		}
+		for i, qos := range p.Qoss {
+			switch {
+			case len(p.Topics[i]) == 0:
+				return errors.New("SUBSCRIBE has an empty topic filter")
+			case qos&^subscribeQosMask != 0:
+				return fmt.Errorf("SUBSCRIBE requested QoS byte %08b has reserved bits set", qos)
+			case qos > 2:
+				return fmt.Errorf("SUBSCRIBE requests QoS %d", qos)
+			}
+		}
+	case *PubackPacket, *PubrecPacket, *PubrelPacket, *PubcompPacket:
+		if p.Details().MessageID == 0 {
+			return fmt.Errorf("%s has message id 0", p.Type())
+		}
+	case *UnsubscribePacket:
+		if len(p.Topics) == 0 {
+			return errors.New("UNSUBSCRIBE has no topic filters")
+		}
+		if p.MessageID == 0 {
+			return errors.New("UNSUBSCRIBE has message id 0")
+		}
+	}
+	return nil
+}
+
+//DefaultMaxTopicLevels is the most levels a server accepts in a topic name or filter by
+//default, MQTT has no limit of its own
+const DefaultMaxTopicLevels = 128
+
+//TopicLimits are the largest topic names and filters a server accepts, so a client can't
+//make it split and store a topic with a pathological number of levels. MaxLevels is the
+//most levels, MaxLevelLength the most bytes in one level and MaxLength the most bytes in
+//the whole topic, 0 is no limit.
+type TopicLimits struct {
+	MaxLevels      int
+	MaxLevelLength int
+	MaxLength      int
+}
+
+//Check returns an error saying how topic is over the limits, or nil if it isn't. The topic
+//is scanned rather than split into its levels, so a topic over the limits is found without
+//allocating anything for it.
+func (l TopicLimits) Check(topic string) error {
+	if l.MaxLength > 0 && len(topic) > l.MaxLength {
+		return fmt.Errorf("topic is %d bytes, more than the maximum of %d", len(topic), l.MaxLength)
+	}
+	if l.MaxLevels <= 0 && l.MaxLevelLength <= 0 {
+		return nil
+	}
+	levels, start := 1, 0
+	for i := 0; i <= len(topic); i++ {
+		if i < len(topic) && topic[i] != '/' {
+			continue
+		}
+		if l.MaxLevelLength > 0 && i-start > l.MaxLevelLength {
+			return fmt.Errorf("topic level %d is %d bytes, more than the maximum of %d", levels, i-start, l.MaxLevelLength)
+		}
+		if i < len(topic) {
+			levels++
+			start = i + 1
+			if l.MaxLevels > 0 && levels > l.MaxLevels {
+				return fmt.Errorf("topic has more than the maximum of %d levels", l.MaxLevels)
+			}
+		}
+	}
+	return nil
+}
+
+//ValidateTopicLimits checks the topic names and filters cp carries, the topic of a PUBLISH,
+//the filters of a SUBSCRIBE or UNSUBSCRIBE and the will topic of a CONNECT, against limits,
+//returning an error naming the packet and how its topic is over them.
+func ValidateTopicLimits(cp ControlPacket, limits TopicLimits) error {
+	var topics []string
+	switch p := cp.(type) {
+	case *PublishPacket:
+		topics = []string{p.TopicName}
+	case *SubscribePacket:
+		topics = p.Topics
+	case *UnsubscribePacket:
+		topics = p.Topics
+	case *ConnectPacket:
+		if !p.WillFlag {
+			return nil
+		}
+		topics = []string{p.WillTopic}
+	}
+	for _, topic := range topics {
+		if err := limits.Check(topic); err != nil {
+			return fmt.Errorf("%s %s", cp.Type(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+//dropPrivileges switches the process to username and group, or the user's own group if
+//group is empty, once the listeners have been bound. It does nothing unless the broker was
+//started as root, and returns false with it.
+func dropPrivileges(username, group string) (bool, error) {
+	if os.Getuid() != 0 {
+		return false, nil
+	}
+	u, err := user.Lookup(username)
+	if err != nil {
+		return false, err
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return false, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	//the group has to be changed while we are still root, and the supplementary groups
+	//root had are dropped along with it
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return false, fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return false, fmt.Errorf("setgid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return false, fmt.Errorf("setuid %d: %w", uid, err)
+	}
+	return true, nil
+}
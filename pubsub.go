@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alsm/hrotti/client"
+	. "github.com/alsm/hrotti/packets"
+)
+
+//clientFlags are the connection settings shared by the pub and sub commands
+type clientFlags struct {
+	url         string
+	clientID    string
+	username    string
+	password    string
+	keepSession bool
+	keepAlive   time.Duration
+	caFile      string
+	certFile    string
+	keyFile     string
+	insecure    bool
+	willTopic   string
+	willPayload string
+	willQos     int
+	willRetain  bool
+}
+
+func (f *clientFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.url, "url", "tcp://localhost:1883", "The broker's URL, tcp://, tls://, ws:// or wss://")
+	flags.StringVar(&f.clientID, "i", "", "The client id, by default the broker assigns one")
+	flags.StringVar(&f.username, "u", "", "The username")
+	flags.StringVar(&f.password, "P", "", "The password")
+	flags.BoolVar(&f.keepSession, "c", false, "Connect with cleanSession false, needs -i")
+	flags.DurationVar(&f.keepAlive, "k", time.Minute, "The keepalive")
+	flags.StringVar(&f.caFile, "cafile", "", "The CA certificates to verify a tls or wss broker with, in PEM format")
+	flags.StringVar(&f.certFile, "cert", "", "A client certificate in PEM format")
+	flags.StringVar(&f.keyFile, "key", "", "The key of the client certificate in PEM format")
+	flags.BoolVar(&f.insecure, "insecure", false, "Don't verify the broker's certificate")
+	flags.StringVar(&f.willTopic, "will-topic", "", "The topic of the will")
+	flags.StringVar(&f.willPayload, "will-payload", "", "The payload of the will")
+	flags.IntVar(&f.willQos, "will-qos", 0, "The QoS of the will")
+	flags.BoolVar(&f.willRetain, "will-retain", false, "Retain the will")
+}
+
+//tlsConfig returns the TLS config for the certificate flags
+func (f *clientFlags) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: f.insecure}
+	if f.caFile != "" {
+		pem, err := ioutil.ReadFile(f.caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates in " + f.caFile)
+		}
+	}
+	if f.certFile != "" || f.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+//connect connects to the broker with the flags, a CONNACK refusing the connection is
+//returned as an error
+func (f *clientFlags) connect() (*client.Client, error) {
+	if f.willQos < 0 || f.willQos > 2 {
+		return nil, errors.New("will-qos must be 0, 1 or 2")
+	}
+	if f.keepSession && f.clientID == "" {
+		return nil, errors.New("-c needs a client id, -i")
+	}
+	tlsConfig, err := f.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	options := client.Options{
+		ClientID:     f.clientID,
+		Username:     f.username,
+		CleanSession: !f.keepSession,
+		KeepAlive:    f.keepAlive,
+	}
+	if f.password != "" {
+		options.Password = []byte(f.password)
+	}
+	if f.willTopic != "" {
+		options.Will = &client.Will{Topic: f.willTopic, Payload: []byte(f.willPayload), Qos: byte(f.willQos), Retain: f.willRetain}
+	}
+	return client.DialURL(f.url, tlsConfig, options)
+}
+
+//pubCommand is "hrotti pub [flags]", it publishes one message, from -m, a file or stdin, and
+//disconnects once it has been acknowledged. It returns the exit status, 1 if the broker
+//refused the connection or the message couldn't be published.
+func pubCommand(args []string, stdin io.Reader, out io.Writer) int {
+	flags := flag.NewFlagSet("pub", flag.ContinueOnError)
+	flags.SetOutput(out)
+	var connection clientFlags
+	connection.register(flags)
+	topic := flags.String("t", "", "The topic to publish to")
+	message := flags.String("m", "", "The message, empty if there is no -m, -f or -s")
+	file := flags.String("f", "", "Publish the contents of this file")
+	fromStdin := flags.Bool("s", false, "Publish what is read from stdin")
+	qos := flags.Int("q", 0, "The QoS to publish at")
+	retain := flags.Bool("retain", false, "Retain the message")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *topic == "" || *qos < 0 || *qos > 2 || (*file != "" && *fromStdin) {
+		fmt.Fprintln(out, "pub needs a topic, -t, a qos, -q, of 0, 1 or 2 and only one of -m, -f and -s")
+		return 2
+	}
+	payload := []byte(*message)
+	var err error
+	if *file != "" {
+		payload, err = ioutil.ReadFile(*file)
+	} else if *fromStdin {
+		payload, err = ioutil.ReadAll(stdin)
+	}
+	if err != nil {
+		fmt.Fprintln(out, "Failed to read the message,", err.Error())
+		return 1
+	}
+	c, err := connection.connect()
+	if err != nil {
+		fmt.Fprintln(out, "Failed to connect,", err.Error())
+		return 1
+	}
+	defer c.Disconnect()
+	if err := c.Publish(*topic, payload, byte(*qos), *retain); err != nil {
+		fmt.Fprintln(out, "Failed to publish,", err.Error())
+		return 1
+	}
+	return 0
+}
+
+//topicList is a flag that can be given more than once
+type topicList []string
+
+func (t *topicList) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *topicList) Set(value string) error {
+	*t = append(*t, value)
+	return nil
+}
+
+//receivedMessage is how the sub command prints each message, one JSON object to a line. A
+//payload that isn't UTF-8 is printed base64 encoded in payloadBase64, with payload empty.
+type receivedMessage struct {
+	Topic         string `json:"topic"`
+	Qos           byte   `json:"qos"`
+	Retain        bool   `json:"retain"`
+	Dup           bool   `json:"dup"`
+	Payload       string `json:"payload"`
+	PayloadBase64 []byte `json:"payloadBase64,omitempty"`
+}
+
+//subCommand is "hrotti sub [flags]", it subscribes to the -t filters and prints each
+//message it receives until it has received -count, the connection is lost or it is
+//interrupted. It returns the exit status, 1 if the broker refused the connection or a
+//subscription, the connection was lost or -timeout passed before -count messages arrived.
+func subCommand(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("sub", flag.ContinueOnError)
+	flags.SetOutput(out)
+	var connection clientFlags
+	connection.register(flags)
+	var filters topicList
+	flags.Var(&filters, "t", "A topic filter to subscribe to, can be given more than once")
+	qos := flags.Int("q", 0, "The QoS to subscribe at")
+	count := flags.Int("count", 0, "Exit after this many messages, 0 to keep going")
+	timeout := flags.Duration("timeout", 0, "Exit with status 1 if -count messages haven't arrived in this long, 0 waits forever")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(filters) == 0 || *qos < 0 || *qos > 2 || *count < 0 || *timeout < 0 {
+		fmt.Fprintln(out, "sub needs a topic filter, -t, a qos, -q, of 0, 1 or 2 and count and timeout not negative")
+		return 2
+	}
+	c, err := connection.connect()
+	if err != nil {
+		fmt.Fprintln(out, "Failed to connect,", err.Error())
+		return 1
+	}
+	defer c.Disconnect()
+	//messages are printed by this goroutine, a handler blocking on a full channel holds up
+	//the client's reads until they are, or until the command is finished so Disconnect
+	//isn't left waiting for the reads to stop
+	messages := make(chan *PublishPacket, 100)
+	finished := make(chan struct{})
+	defer close(finished)
+	handler := func(pp *PublishPacket) {
+		select {
+		case messages <- pp:
+		case <-finished:
+		}
+	}
+	for _, filter := range filters {
+		if _, err := c.Subscribe(filter, byte(*qos), handler); err != nil {
+			fmt.Fprintln(out, "Failed to subscribe,", err.Error())
+			return 1
+		}
+	}
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+	var expired <-chan time.Time
+	if *timeout > 0 {
+		timer := time.NewTimer(*timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	encoder := json.NewEncoder(out)
+	for received := 0; *count == 0 || received < *count; received++ {
+		select {
+		case pp := <-messages:
+			message := receivedMessage{Topic: pp.TopicName, Qos: pp.Qos, Retain: pp.Retain, Dup: pp.Dup}
+			if utf8.Valid(pp.Payload) {
+				message.Payload = string(pp.Payload)
+			} else {
+				message.PayloadBase64 = pp.Payload
+			}
+			encoder.Encode(message)
+		case <-c.Done():
+			fmt.Fprintln(out, "Connection lost,", c.Err().Error())
+			return 1
+		case <-expired:
+			fmt.Fprintln(out, "Timed out after", received, "messages")
+			return 1
+		case <-interrupted:
+			return 0
+		}
+	}
+	return 0
+}
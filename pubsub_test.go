@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/alsm/hrotti/broker"
+)
+
+//subscribed is true once a client of h has subscribed
+func subscribed(h *Hrotti) bool {
+	for _, client := range h.Clients() {
+		if client.Subscriptions > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPubSub(t *testing.T) {
+	h := NewHrotti(100, &MemoryPersistence{})
+	h.SetLogLevel("", LogWarn)
+	h.Auth = &Auth{Users: map[string]string{"user": "secret"}}
+	h.MaxFilterLevels = 2
+	urls := make(map[string]string)
+	for _, scheme := range []string{"tcp", "ws"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to find a free port: %s", err.Error())
+		}
+		urls[scheme] = scheme + "://" + ln.Addr().String()
+		ln.Close()
+		if scheme == "ws" {
+			urls[scheme] += "/mqtt"
+		}
+		if err := h.AddListener(scheme, NewListenerConfig(urls[scheme])); err != nil {
+			t.Fatalf("failed to start listener: %s", err.Error())
+		}
+	}
+	defer h.Stop()
+
+	//a retained message is published over tcp and received with a live one over ws
+	var out bytes.Buffer
+	if status := pubCommand([]string{"-url", urls["tcp"], "-u", "user", "-P", "secret", "-t", "a/b", "-m", "retained", "-q", "1", "-retain"}, nil, &out); status != 0 {
+		t.Fatalf("pub exited with %d: %s", status, out.String())
+	}
+	var sub bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if status := subCommand([]string{"-url", urls["ws"], "-u", "user", "-P", "secret", "-t", "a/#", "-q", "2", "-count", "2", "-timeout", "5s"}, &sub); status != 0 {
+			t.Errorf("sub exited with %d: %s", status, sub.String())
+		}
+	}()
+	//the live message isn't published until the subscription has been made
+	for deadline := time.Now().Add(5 * time.Second); !subscribed(h); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("sub didn't subscribe")
+		}
+	}
+	if status := pubCommand([]string{"-url", urls["tcp"], "-u", "user", "-P", "secret", "-t", "a/c", "-s", "-q", "2"}, strings.NewReader("live\xff"), &out); status != 0 {
+		t.Fatalf("pub exited with %d: %s", status, out.String())
+	}
+	wg.Wait()
+	lines := strings.Split(strings.TrimSpace(sub.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("sub printed %q, should be two messages", sub.String())
+	}
+	var retained, live receivedMessage
+	json.Unmarshal([]byte(lines[0]), &retained)
+	json.Unmarshal([]byte(lines[1]), &live)
+	if retained.Topic != "a/b" || retained.Payload != "retained" || !retained.Retain || retained.Qos != 1 {
+		t.Errorf("first message is %s, should be the retained message", lines[0])
+	}
+	if live.Topic != "a/c" || string(live.PayloadBase64) != "live\xff" || live.Retain || live.Qos != 2 {
+		t.Errorf("second message is %s, should be the live message", lines[1])
+	}
+
+	//refused connections and subscriptions exit with 1
+	for _, test := range []struct {
+		name    string
+		command func(*bytes.Buffer) int
+	}{
+		{"bad password", func(out *bytes.Buffer) int {
+			return pubCommand([]string{"-url", urls["tcp"], "-u", "user", "-P", "wrong", "-t", "a"}, nil, out)
+		}},
+		{"too many levels", func(out *bytes.Buffer) int {
+			return subCommand([]string{"-url", urls["tcp"], "-u", "user", "-P", "secret", "-t", "a/b/c"}, out)
+		}},
+		{"timeout", func(out *bytes.Buffer) int {
+			return subCommand([]string{"-url", urls["tcp"], "-u", "user", "-P", "secret", "-t", "nothing", "-count", "1", "-timeout", "100ms"}, out)
+		}},
+	} {
+		var out bytes.Buffer
+		if status := test.command(&out); status != 1 {
+			t.Errorf("%s: exited with %d, should be 1: %s", test.name, status, out.String())
+		}
+	}
+	if status := pubCommand([]string{"-m", "no topic"}, nil, &out); status != 2 {
+		t.Errorf("pub without a topic exited with %d, should be 2", status)
+	}
+}
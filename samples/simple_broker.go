@@ -10,9 +10,8 @@ import (
 
 func main() {
 	h := hrotti.NewHrotti(100, &hrotti.MemoryPersistence{})
-	hrotti.INFO.SetOutput(os.Stdout)
-	hrotti.DEBUG.SetOutput(os.Stdout)
-	hrotti.ERROR.SetOutput(os.Stdout)
+	h.SetLogOutput(os.Stdout, false)
+	h.SetLogLevel("", hrotti.LogDebug)
 	h.AddListener("test", hrotti.NewListenerConfig("tcp://0.0.0.0:1883"))
 
 	c := make(chan os.Signal, 1)